@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"strings"
+)
+
+func init() {
+	expvar.Publish("captures_running", expvar.Func(func() interface{} { return runningCaptures.Load() }))
+	expvar.Publish("build", expvar.Func(func() interface{} { return exporterBuildInfo() }))
+}
+
+// secretFlags are the command line flags whose values the admin handlers
+// leave out of the command line they report
+var secretFlags = map[string]bool{"password": true}
+
+// redactedArgs returns args with the values of secretFlags replaced
+func redactedArgs(args []string) []string {
+	out := make([]string, len(args))
+	copy(out, args)
+	for i := 1; i < len(out); i++ {
+		name, value, hasValue := strings.Cut(strings.TrimLeft(out[i], "-"), "=")
+		if !strings.HasPrefix(out[i], "-") || !secretFlags[name] {
+			continue
+		}
+		if hasValue {
+			out[i] = out[i][:len(out[i])-len(value)] + "REDACTED"
+		} else if i+1 < len(out) {
+			out[i+1] = "REDACTED"
+			i++
+		}
+	}
+	return out
+}
+
+// handleVars serves the published expvar variables like expvar.Handler,
+// with secrets removed from cmdline
+func handleVars(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	fmt.Fprintf(w, "{\n")
+	first := true
+	expvar.Do(func(kv expvar.KeyValue) {
+		if !first {
+			fmt.Fprintf(w, ",\n")
+		}
+		first = false
+		value := kv.Value.String()
+		if kv.Key == "cmdline" {
+			data, _ := json.Marshal(redactedArgs(os.Args))
+			value = string(data)
+		}
+		fmt.Fprintf(w, "%q: %s", kv.Key, value)
+	})
+	fmt.Fprintf(w, "\n}\n")
+}
+
+// handleCmdline serves the command line like pprof.Cmdline, with secrets
+// removed
+func handleCmdline(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprint(w, strings.Join(redactedArgs(os.Args), "\x00"))
+}
+
+// newAdminMux serves the exporter's own expvar variables and Go profiles,
+// for debugging the exporter itself, behind the same authentication as the
+// API
+func newAdminMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	handle := func(pattern string, handler http.HandlerFunc) {
+		mux.HandleFunc(pattern, authenticated(handler))
+	}
+	handle("GET /debug/vars", handleVars)
+	handle("/debug/pprof/", pprof.Index)
+	handle("/debug/pprof/cmdline", handleCmdline)
+	handle("/debug/pprof/profile", pprof.Profile)
+	handle("/debug/pprof/symbol", pprof.Symbol)
+	handle("/debug/pprof/trace", pprof.Trace)
+	return mux
+}
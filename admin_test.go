@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRedactedArgs(t *testing.T) {
+	tests := []struct {
+		args []string
+		want []string
+	}{
+		{[]string{"bcc-exporter", "-port", "9090"}, []string{"bcc-exporter", "-port", "9090"}},
+		{[]string{"bcc-exporter", "-password", "secret", "-port", "9090"}, []string{"bcc-exporter", "-password", "REDACTED", "-port", "9090"}},
+		{[]string{"bcc-exporter", "--password=secret"}, []string{"bcc-exporter", "--password=REDACTED"}},
+		{[]string{"bcc-exporter", "-password-file", "/etc/pw"}, []string{"bcc-exporter", "-password-file", "/etc/pw"}},
+		{[]string{"bcc-exporter", "-password"}, []string{"bcc-exporter", "-password"}},
+	}
+	for _, tt := range tests {
+		if got := redactedArgs(tt.args); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("redactedArgs(%q) = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestAdminMux(t *testing.T) {
+	origArgs, origState := os.Args, state.Load()
+	t.Cleanup(func() {
+		os.Args = origArgs
+		state.Store(origState)
+	})
+	os.Args = []string{"bcc-exporter", "-password", "secret"}
+	state.Store(&serverState{cfg: &config{}, checkPassword: func(user, pass string) bool {
+		return user == "admin" && pass == "secret"
+	}})
+	runningCaptures.Store(2)
+	defer runningCaptures.Store(0)
+
+	mux := newAdminMux()
+	get := func(path string, auth bool) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		if auth {
+			req.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("admin:secret")))
+		}
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		return rr
+	}
+
+	if rr := get("/debug/vars", false); rr.Code != http.StatusUnauthorized {
+		t.Errorf("/debug/vars without credentials: status %d", rr.Code)
+	}
+
+	rr := get("/debug/vars", true)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("/debug/vars: status %d", rr.Code)
+	}
+	var vars map[string]json.RawMessage
+	if err := json.Unmarshal(rr.Body.Bytes(), &vars); err != nil {
+		t.Fatalf("/debug/vars is not JSON: %v\n%s", err, rr.Body)
+	}
+	if string(vars["captures_running"]) != "2" {
+		t.Errorf("captures_running = %s, want 2", vars["captures_running"])
+	}
+	if vars["memstats"] == nil || vars["build"] == nil {
+		t.Error("/debug/vars lacks memstats or build")
+	}
+	if strings.Contains(rr.Body.String(), "secret") {
+		t.Error("/debug/vars reveals the password")
+	}
+
+	if rr := get("/debug/pprof/cmdline", true); strings.Contains(rr.Body.String(), "secret") {
+		t.Errorf("/debug/pprof/cmdline = %q, reveals the password", rr.Body.String())
+	}
+	if rr := get("/debug/pprof/goroutine?debug=1", true); rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "goroutine profile") {
+		t.Errorf("/debug/pprof/goroutine: status %d", rr.Code)
+	}
+}
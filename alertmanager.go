@@ -0,0 +1,246 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxAlertTargets bounds the processes profiled for a single alert
+const maxAlertTargets = 16
+
+// alertmanagerConfig configures captures triggered by Alertmanager webhooks
+type alertmanagerConfig struct {
+	Seconds int    `json:"seconds"`
+	Format  string `json:"format"`
+	// Cooldown suppresses new captures of the same process, since
+	// Alertmanager re-sends firing alerts every group_interval (default 5m)
+	Cooldown duration `json:"cooldown"`
+}
+
+func (c *alertmanagerConfig) validate() error {
+	if c.Seconds == 0 {
+		c.Seconds = 10
+	}
+	if c.Seconds < 0 || c.Seconds > 300 {
+		return fmt.Errorf("seconds must be between 1 and 300")
+	}
+	switch c.Format {
+	case "":
+		c.Format = "pprof"
+	case "pprof", "folded":
+	default:
+		return fmt.Errorf("format must be pprof or folded")
+	}
+	if c.Cooldown == 0 {
+		c.Cooldown = duration(5 * time.Minute)
+	}
+	return nil
+}
+
+// alertmanagerPayload is the subset of the Alertmanager webhook payload we use
+type alertmanagerPayload struct {
+	Status string              `json:"status"`
+	Alerts []alertmanagerAlert `json:"alerts"`
+}
+
+type alertmanagerAlert struct {
+	Status      string            `json:"status"`
+	Labels      map[string]string `json:"labels"`
+	Annotations map[string]string `json:"annotations"`
+	StartsAt    time.Time         `json:"startsAt"`
+}
+
+// alertResult reports what the receiver did with one alert
+type alertResult struct {
+	Alert string `json:"alert"`
+	PIDs  []int  `json:"pids,omitempty"`
+	// ProfileIDs are the profiles the captures of PIDs will be stored as;
+	// their progress is at /api/v1/profiles/{id}/events
+	ProfileIDs []string `json:"profile_ids,omitempty"`
+	Skipped    string   `json:"skipped,omitempty"`
+}
+
+// alertReceiver turns firing alerts into stored profiles of the processes
+// described by their pid, comm and container labels
+type alertReceiver struct {
+	cfg  alertmanagerConfig
+	mu   sync.Mutex
+	last map[int]time.Time
+
+	// capture takes and stores the profile; replaced in tests
+	capture func(opts profileOptions, meta profileMeta)
+}
+
+func newAlertReceiver(cfg alertmanagerConfig) *alertReceiver {
+	return &alertReceiver{
+		cfg:  cfg,
+		last: make(map[int]time.Time),
+		capture: func(opts profileOptions, meta profileMeta) {
+			if _, err := captureToStore(opts, meta); err != nil {
+				log.Printf("Alert capture of PID %s failed: %v", opts.PID, err)
+			}
+		},
+	}
+}
+
+// alertTargets resolves the processes an alert refers to; every label that is
+// present narrows the selection
+func alertTargets(labels map[string]string) ([]int, error) {
+	var sets [][]int
+
+	if pid := labels["pid"]; pid != "" {
+		n, err := strconv.Atoi(pid)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pid label %q", pid)
+		}
+		if err := validatePID(pid); err != nil {
+			return nil, err
+		}
+		sets = append(sets, []int{n})
+	}
+	if comm := labels["comm"]; comm != "" {
+		pids, err := findPIDsByComm(comm)
+		if err != nil {
+			return nil, err
+		}
+		sets = append(sets, pids)
+	}
+	container := labels["container_id"]
+	if container == "" {
+		container = labels["container"]
+	}
+	if container != "" {
+		// Strip runtime prefixes such as docker:// or containerd://
+		if i := strings.LastIndex(container, "://"); i >= 0 {
+			container = container[i+3:]
+		}
+		pids, err := findPIDsByContainer(container)
+		if err != nil {
+			return nil, err
+		}
+		sets = append(sets, pids)
+	}
+
+	if len(sets) == 0 {
+		return nil, fmt.Errorf("alert has no pid, comm or container label")
+	}
+
+	// Intersect the selections
+	counts := make(map[int]int)
+	for _, set := range sets {
+		for _, pid := range set {
+			counts[pid]++
+		}
+	}
+	var pids []int
+	for pid, n := range counts {
+		if n == len(sets) {
+			pids = append(pids, pid)
+		}
+	}
+	sort.Ints(pids)
+	return pids, nil
+}
+
+// handle processes one alert, starting background captures of its targets
+func (ar *alertReceiver) handle(alert alertmanagerAlert, now time.Time) alertResult {
+	res := alertResult{Alert: alert.Labels["alertname"]}
+
+	if alert.Status != "firing" {
+		res.Skipped = "alert is " + alert.Status
+		return res
+	}
+
+	pids, err := alertTargets(alert.Labels)
+	if err != nil {
+		res.Skipped = err.Error()
+		return res
+	}
+	if len(pids) == 0 {
+		res.Skipped = "no matching processes"
+		return res
+	}
+	if len(pids) > maxAlertTargets {
+		log.Printf("Alert %s matches %d processes, profiling the first %d", res.Alert, len(pids), maxAlertTargets)
+		pids = pids[:maxAlertTargets]
+	}
+
+	ar.mu.Lock()
+	defer ar.mu.Unlock()
+
+	for _, pid := range pids {
+		if now.Sub(ar.last[pid]) < time.Duration(ar.cfg.Cooldown) {
+			continue
+		}
+		ar.last[pid] = now
+		res.PIDs = append(res.PIDs, pid)
+
+		opts := profileOptions{
+			PID:         strconv.Itoa(pid),
+			Duration:    ar.cfg.Seconds,
+			Stacks:      "both",
+			CallGraph:   "fp",
+			LBRFallback: "fp",
+		}
+		meta := captureMeta(opts, ar.cfg.Format)
+		meta.Trigger = "alertmanager"
+		meta.TriggerReason = alertReason(alert)
+		if id, err := newProfileID(); err == nil {
+			meta.ID = id
+			res.ProfileIDs = append(res.ProfileIDs, id)
+		}
+
+		log.Printf("Alert %s: capturing %ds profile of PID %d", res.Alert, ar.cfg.Seconds, pid)
+		go ar.capture(opts, meta)
+	}
+	if len(res.PIDs) == 0 {
+		res.Skipped = "all matching processes were profiled recently"
+	}
+	return res
+}
+
+// alertReason summarizes an alert for the stored profile's trigger metadata
+func alertReason(alert alertmanagerAlert) string {
+	keys := make([]string, 0, len(alert.Labels))
+	for k := range alert.Labels {
+		if k != "alertname" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		parts = append(parts, fmt.Sprintf("%s=%q", k, alert.Labels[k]))
+	}
+	return fmt.Sprintf("%s{%s}", alert.Labels["alertname"], strings.Join(parts, ","))
+}
+
+// ServeHTTP accepts an Alertmanager webhook and profiles the targets of its
+// firing alerts in the background
+func (ar *alertReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !requireStore(w) {
+		return
+	}
+
+	var payload alertmanagerPayload
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&payload); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid Alertmanager payload: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now()
+	results := make([]alertResult, 0, len(payload.Alerts))
+	for _, alert := range payload.Alerts {
+		results = append(results, ar.handle(alert, now))
+	}
+
+	writeJSON(w, http.StatusAccepted, results)
+}
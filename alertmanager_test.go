@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAlertTargets(t *testing.T) {
+	writeFakeProc(t, map[int]int{})
+	writeFakeStat(t, 100, "redis-server", 0)
+	writeFakeStat(t, 101, "redis-server", 0)
+	writeFakeStat(t, 102, "envoy", 0)
+	container := "0123456789abcdef0123456789abcdef"
+	for _, pid := range []string{"101", "102"} {
+		cg := "0::/kubepods/burstable/pod1/" + container + "\n"
+		if err := os.WriteFile(filepath.Join(procRoot, pid, "cgroup"), []byte(cg), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name    string
+		labels  map[string]string
+		want    []int
+		wantErr bool
+	}{
+		{name: "comm", labels: map[string]string{"comm": "redis-server"}, want: []int{100, 101}},
+		{name: "container", labels: map[string]string{"container_id": "containerd://" + container}, want: []int{101, 102}},
+		{name: "comm in container", labels: map[string]string{"comm": "redis-server", "container": container[:12]}, want: []int{101}},
+		{name: "no selector", labels: map[string]string{"alertname": "RedisHighCPU"}, wantErr: true},
+		{name: "bad pid", labels: map[string]string{"pid": "abc"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := alertTargets(tt.labels)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("alertTargets() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("alertTargets() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAlertmanagerWebhook(t *testing.T) {
+	withTestStore(t)
+	writeFakeProc(t, map[int]int{})
+	writeFakeStat(t, 100, "redis-server", 0)
+
+	cfg := alertmanagerConfig{}
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+	ar := newAlertReceiver(cfg)
+
+	var mu sync.Mutex
+	var captured []profileMeta
+	ar.capture = func(opts profileOptions, meta profileMeta) {
+		mu.Lock()
+		captured = append(captured, meta)
+		mu.Unlock()
+	}
+
+	payload := `{
+		"status": "firing",
+		"alerts": [
+			{"status": "firing", "labels": {"alertname": "RedisHighCPU", "comm": "redis-server", "instance": "cache-1:6379"}},
+			{"status": "resolved", "labels": {"alertname": "RedisHighCPU", "comm": "redis-server"}},
+			{"status": "firing", "labels": {"alertname": "DiskFull"}}
+		]
+	}`
+
+	send := func() []alertResult {
+		rr := httptest.NewRecorder()
+		ar.ServeHTTP(rr, httptest.NewRequest("POST", "/api/v1/hooks/alertmanager", strings.NewReader(payload)))
+		if rr.Code != http.StatusAccepted {
+			t.Fatalf("webhook returned %d: %s", rr.Code, rr.Body.String())
+		}
+		var results []alertResult
+		if err := json.Unmarshal(rr.Body.Bytes(), &results); err != nil {
+			t.Fatal(err)
+		}
+		return results
+	}
+
+	results := send()
+	if len(results) != 3 || !reflect.DeepEqual(results[0].PIDs, []int{100}) || results[1].Skipped == "" || results[2].Skipped == "" {
+		t.Errorf("unexpected results: %+v", results)
+	}
+	ids := results[0].ProfileIDs
+
+	// Alertmanager re-sends firing alerts; the cooldown suppresses a second capture
+	results = send()
+	if len(results[0].PIDs) != 0 {
+		t.Errorf("repeated alert captured again: %+v", results[0])
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		mu.Lock()
+		n := len(captured)
+		mu.Unlock()
+		if n > 0 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(captured) != 1 {
+		t.Fatalf("captured %d profiles, want 1", len(captured))
+	}
+	if captured[0].Trigger != "alertmanager" || captured[0].TriggerReason != `RedisHighCPU{comm="redis-server",instance="cache-1:6379"}` {
+		t.Errorf("unexpected trigger metadata: %+v", captured[0])
+	}
+	if len(ids) != 1 || captured[0].ID != ids[0] {
+		t.Errorf("capture stored as %q, webhook reported %q", captured[0].ID, ids)
+	}
+}
+
+func TestAlertmanagerWebhookInvalid(t *testing.T) {
+	withTestStore(t)
+
+	rr := httptest.NewRecorder()
+	newAlertReceiver(alertmanagerConfig{}).ServeHTTP(rr, httptest.NewRequest("POST", "/api/v1/hooks/alertmanager", strings.NewReader("{")))
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("invalid payload returned %d, want 400", rr.Code)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/google/pprof/profile"
+)
+
+// Suffixes FlameGraph's flamegraph.pl colors kernel and JIT compiled frames by
+const (
+	kernelAnnotation = "_[k]"
+	jitAnnotation    = "_[j]"
+)
+
+// jitDSORe matches the DSOs perf gives JIT compiled code: perf maps, jitdump
+// objects written by perf inject --jit and perf's own [JIT] name
+var jitDSORe = regexp.MustCompile(`^/tmp/perf-\d+\.map$|^jitted-\d+-\d+\.so$|^\[JIT\]`)
+
+// frameAnnotation returns the suffix of frames in mapping m, named after the
+// DSO perf reported: kernel.kallsyms and modules are in brackets, like the
+// user space [vdso] and [unknown] which are left alone
+func frameAnnotation(m *profile.Mapping) string {
+	if m == nil {
+		return ""
+	}
+	switch {
+	case jitDSORe.MatchString(m.File) || jitDSORe.MatchString(filepath.Base(m.File)):
+		return jitAnnotation
+	case m.File == "[vdso]" || m.File == "[vsyscall]" || m.File == "[unknown]" || m.File == "[heap]" || m.File == "[stack]":
+		return ""
+	case strings.HasPrefix(m.File, "[") && strings.HasSuffix(m.File, "]"):
+		return kernelAnnotation
+	}
+	return ""
+}
+
+// annotateFrames suffixes the functions of the kernel and JIT compiled
+// frames of a perf profile, for folded output
+func annotateFrames(p *profile.Profile) {
+	done := make(map[*profile.Function]bool)
+	for _, loc := range p.Location {
+		suffix := frameAnnotation(loc.Mapping)
+		if suffix == "" {
+			continue
+		}
+		for _, line := range loc.Line {
+			if fn := line.Function; fn != nil && !done[fn] {
+				done[fn] = true
+				fn.Name += suffix
+			}
+		}
+	}
+}
+
+// perfMapSymbols returns the names of the JIT compiled functions in the perf
+// map of pid
+func perfMapSymbols(pid int) (map[string]bool, error) {
+	f, err := os.Open(perfMapPath(pid))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	names := make(map[string]bool)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		// "START SIZE name", where the name may contain spaces
+		fields := strings.SplitN(scanner.Text(), " ", 3)
+		if len(fields) == 3 {
+			names[fields[2]] = true
+		}
+	}
+	return names, scanner.Err()
+}
+
+// annotateJITFrames suffixes the frames of collapsed stacks named in jit,
+// the symbols of a perf map, which profile-bpfcc cannot tell apart itself
+func annotateJITFrames(folded []byte, jit map[string]bool) []byte {
+	if len(jit) == 0 {
+		return folded
+	}
+	var out bytes.Buffer
+	out.Grow(len(folded))
+	for _, line := range strings.SplitAfter(string(folded), "\n") {
+		sep := strings.LastIndexByte(line, ' ')
+		if sep < 0 {
+			out.WriteString(line)
+			continue
+		}
+		frames := strings.Split(line[:sep], ";")
+		for i, frame := range frames {
+			if jit[frame] {
+				frames[i] = frame + jitAnnotation
+			}
+		}
+		out.WriteString(strings.Join(frames, ";"))
+		out.WriteString(line[sep:])
+	}
+	return out.Bytes()
+}
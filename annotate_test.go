@@ -0,0 +1,121 @@
+package main
+
+import (
+	"net/http/httptest"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/google/pprof/profile"
+)
+
+func TestFrameAnnotation(t *testing.T) {
+	tests := []struct {
+		dso  string
+		want string
+	}{
+		{"[kernel.kallsyms]", "_[k]"},
+		{"[nf_conntrack]", "_[k]"},
+		{"[guest.kernel.kallsyms]", "_[k]"},
+		{"/tmp/perf-4242.map", "_[j]"},
+		{"/root/.debug/jit/java-jit-20240611.XXabcd/jitted-4242-17.so", "_[j]"},
+		{"[JIT] tid 4242", "_[j]"},
+		{"/usr/bin/redis-server", ""},
+		{"/usr/lib/x86_64-linux-gnu/libc.so.6", ""},
+		{"[vdso]", ""},
+		{"[unknown]", ""},
+	}
+	for _, tt := range tests {
+		if got := frameAnnotation(&profile.Mapping{File: tt.dso}); got != tt.want {
+			t.Errorf("frameAnnotation(%q) = %q, want %q", tt.dso, got, tt.want)
+		}
+	}
+	if got := frameAnnotation(nil); got != "" {
+		t.Errorf("frameAnnotation(nil) = %q", got)
+	}
+}
+
+func TestAnnotateFrames(t *testing.T) {
+	p := buildProfile([]perfSample{
+		{Stack: []perfFrame{
+			{Addr: 1, Symbol: "do_syscall_64", DSO: "[kernel.kallsyms]"},
+			{Addr: 2, Symbol: "LazyCompile:*handler /app/index.js:10", DSO: "/tmp/perf-42.map"},
+			{Addr: 3, Symbol: "main", DSO: "/usr/bin/node"},
+		}},
+		{Stack: []perfFrame{
+			{Addr: 4, Symbol: "do_syscall_64", DSO: "[kernel.kallsyms]"},
+			{Addr: 3, Symbol: "main", DSO: "/usr/bin/node"},
+		}},
+	}, nil, nil, nil)
+	annotateFrames(p)
+	folded := profileToFolded(p)
+	want := map[string]int64{
+		"main;LazyCompile:*handler /app/index.js:10_[j];do_syscall_64_[k]": 1,
+		// The function shared by two locations is suffixed once
+		"main;do_syscall_64_[k]": 1,
+	}
+	if len(folded) != len(want) {
+		t.Fatalf("folded = %v", folded)
+	}
+	for stack, n := range want {
+		if folded[stack] != n {
+			t.Errorf("folded = %v, want %v", folded, want)
+		}
+	}
+}
+
+func TestAnnotateJITFrames(t *testing.T) {
+	// A PID close to pid_max so the map cannot belong to a real process
+	const pid = 4190002
+	if err := os.WriteFile(perfMapPath(pid), []byte("3ef414c0 398 LazyCompile:~main /app/index.js:1\n3ef41600 40 Stub:CEntry\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Remove(perfMapPath(pid)) })
+
+	jit, err := perfMapSymbols(pid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !jit["LazyCompile:~main /app/index.js:1"] || !jit["Stub:CEntry"] || len(jit) != 2 {
+		t.Errorf("perfMapSymbols = %v", jit)
+	}
+
+	folded := "node;LazyCompile:~main /app/index.js:1;Stub:CEntry;entry_SYSCALL_64_[k] 7\nnode;uv_run 3\n"
+	got := string(annotateJITFrames([]byte(folded), jit))
+	want := "node;LazyCompile:~main /app/index.js:1_[j];Stub:CEntry_[j];entry_SYSCALL_64_[k] 7\nnode;uv_run 3\n"
+	if got != want {
+		t.Errorf("annotateJITFrames = %q, want %q", got, want)
+	}
+	if got := string(annotateJITFrames([]byte(folded), nil)); got != folded {
+		t.Errorf("annotateJITFrames without symbols = %q", got)
+	}
+}
+
+func TestAnnotateOption(t *testing.T) {
+	for _, tt := range []struct {
+		query string
+		want  bool
+	}{
+		{"pid=1&seconds=5", true},
+		{"pid=1&seconds=5&annotate=true", true},
+		{"pid=1&seconds=5&annotate=false", false},
+	} {
+		opts, err := parseProfileOptions(httptest.NewRequest("GET", "/debug/folded/profile?"+tt.query, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if opts.Annotate != tt.want {
+			t.Errorf("%s: Annotate = %v", tt.query, opts.Annotate)
+		}
+		if got := slices.Contains(bccProfileArgs(opts), "-a"); got != tt.want {
+			t.Errorf("%s: profile-bpfcc -a = %v", tt.query, got)
+		}
+	}
+
+	collapsed := asyncProfilerConfig{Event: "cpu"}
+	args := strings.Join(asyncProfilerArgs(collapsed, profileOptions{PID: "42", Duration: 10, Annotate: true}, ""), " ")
+	if !strings.HasSuffix(args, "-o collapsed -a 42") {
+		t.Errorf("asyncProfilerArgs = %s", args)
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// asyncProfilerConfig is the async_profiler section of the configuration
+// file; the backend is only available when Path is set
+type asyncProfilerConfig struct {
+	// Path is the async-profiler launcher, bin/asprof or profiler.sh for
+	// releases before 3.0
+	Path string `json:"path"`
+	// LibPath points the launcher at libasyncProfiler.so when it is not
+	// installed next to it
+	LibPath string `json:"lib_path"`
+	// Event is the profiling event (default "cpu")
+	Event string `json:"event"`
+	// Output is what async-profiler records before the conversion to
+	// pprof: "collapsed" (default) or "jfr"
+	Output string `json:"output"`
+	// Jfrconv is the JFR converter used with output "jfr" (default jfrconv
+	// next to Path)
+	Jfrconv string `json:"jfrconv"`
+}
+
+func (c *asyncProfilerConfig) validate() error {
+	if c.Path == "" {
+		return nil
+	}
+	if c.Event == "" {
+		c.Event = "cpu"
+	}
+	switch c.Output {
+	case "":
+		c.Output = "collapsed"
+	case "collapsed", "jfr":
+	default:
+		return fmt.Errorf("output must be collapsed or jfr")
+	}
+	if c.Output == "jfr" && c.Jfrconv == "" {
+		c.Jfrconv = filepath.Join(filepath.Dir(c.Path), "jfrconv")
+	}
+	return nil
+}
+
+// asyncProfiler holds the async_profiler section of the configuration file
+var asyncProfiler asyncProfilerConfig
+
+// asyncProfilerSupports returns why opts cannot be captured by async-profiler,
+// or nil when they can
+func asyncProfilerSupports(opts profileOptions) error {
+	switch {
+	case opts.Output != "":
+		return fmt.Errorf("format=%s is not supported", opts.Output)
+	case opts.TID != "", opts.Children, opts.ThreadLabels:
+		return fmt.Errorf("tid, children and thread_labels need perf")
+	case opts.Snapshots > 1, opts.RedisMetadata:
+		return fmt.Errorf("snapshots and redis_metadata need perf")
+	case opts.Stacks == "kernel":
+		return fmt.Errorf("stacks=kernel needs perf")
+	case opts.Event != "":
+		return fmt.Errorf("event needs perf")
+	}
+	return nil
+}
+
+// asyncCPUEvents are the async-profiler events sampling CPU time
+var asyncCPUEvents = []string{"cpu", "itimer", "cycles", "cpu-clock"}
+
+// asyncProfilerArgs builds the launcher command line; collapsed output goes
+// to stdout, JFR to outputPath
+func asyncProfilerArgs(cfg asyncProfilerConfig, opts profileOptions, outputPath string) []string {
+	// The interval is in nanoseconds of the event, CPU time by default
+	interval := strconv.Itoa(int(time.Second) / opts.frequency())
+	event := cfg.Event
+	if opts.Mode == "wall" {
+		event = "wall"
+	}
+	args := []string{"-d", strconv.Itoa(opts.Duration), "-e", event, "-i", interval}
+
+	switch opts.CallGraph {
+	case "dwarf", "lbr":
+		args = append(args, "--cstack", opts.CallGraph)
+	}
+	if opts.Stacks == "user" {
+		args = append(args, "--all-user")
+	}
+	if cfg.LibPath != "" {
+		args = append(args, "--libpath", cfg.LibPath)
+	}
+
+	if cfg.Output == "jfr" {
+		args = append(args, "-o", "jfr", "-f", outputPath)
+	} else {
+		args = append(args, "-o", "collapsed")
+		// Kernel frames are always suffixed with _[k]
+		if opts.Annotate {
+			args = append(args, "-a")
+		}
+	}
+	return append(args, opts.PID)
+}
+
+// captureAsyncProfile attaches async-profiler to the JVM in opts and returns
+// the collapsed stacks it recorded
+func captureAsyncProfile(opts profileOptions, dir string) ([]byte, error) {
+	jfrPath := filepath.Join(dir, "profile.jfr")
+	if asyncProfiler.Output == "jfr" {
+		// The JVM writes the recording itself, as its own user
+		if err := prepareJVMOutput(opts.PID, dir, jfrPath); err != nil {
+			return nil, err
+		}
+	}
+
+	args := asyncProfilerArgs(asyncProfiler, opts, jfrPath)
+	log.Printf("Running command: %s %s", asyncProfiler.Path, strings.Join(args, " "))
+	cmd := exec.Command(asyncProfiler.Path, args...)
+	var stderr bytes.Buffer
+	stdout := newLimitedBuffer()
+	cmd.Stdout = stdout
+	cmd.Stderr = &stderr
+	if err := runJob(cmd, captureTimeout(opts.Duration)); err != nil {
+		if _, ok := err.(*captureError); ok {
+			return nil, err
+		}
+		return nil, &captureError{http.StatusInternalServerError, fmt.Sprintf("async-profiler failed: %v\nStderr: %s", err, stderr.String())}
+	}
+
+	if asyncProfiler.Output != "jfr" {
+		if err := stdout.check("async-profiler output"); err != nil {
+			return nil, err
+		}
+		return stdout.Bytes(), nil
+	}
+
+	collapsedPath := filepath.Join(dir, "profile.collapsed")
+	cmd = exec.Command(asyncProfiler.Jfrconv, "-o", "collapsed", jfrPath, collapsedPath)
+	stderr.Reset()
+	cmd.Stderr = &stderr
+	if err := runJob(cmd, jobGrace); err != nil {
+		if _, ok := err.(*captureError); ok {
+			return nil, err
+		}
+		return nil, &captureError{http.StatusInternalServerError, fmt.Sprintf("jfrconv failed: %v\nStderr: %s", err, stderr.String())}
+	}
+	return readOutputFile("async-profiler output", collapsedPath)
+}
+
+// prepareJVMOutput lets the JVM pid write the file at path inside dir
+func prepareJVMOutput(pid, dir, path string) error {
+	n, _ := strconv.Atoi(pid)
+	uid, err := readUID(n)
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(dir, 0711); err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, nil, 0600); err != nil {
+		return err
+	}
+	return os.Chown(path, uid, -1)
+}
+
+// runAsyncProfile serves an async-profiler capture of opts as pprof or, for
+// the folded endpoint, as the collapsed stacks themselves
+func runAsyncProfile(w http.ResponseWriter, opts profileOptions, format string) {
+	tempDir, err := newCaptureDir()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to create temp directory: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer os.RemoveAll(tempDir)
+
+	folded, err := captureAsyncProfile(opts, tempDir)
+	if err != nil {
+		writeCaptureError(w, err)
+		return
+	}
+
+	serveFoldedCapture(w, opts, format, "async-profiler", folded)
+	log.Printf("Successfully served async-profiler profile for PID %s", opts.PID)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestAsyncProfilerArgs(t *testing.T) {
+	collapsed := asyncProfilerConfig{Path: "/opt/async-profiler/bin/asprof", Event: "cpu", Output: "collapsed"}
+	jfr := asyncProfilerConfig{Path: "/opt/async-profiler/bin/asprof", LibPath: "/opt/lib/libasyncProfiler.so", Event: "itimer", Output: "jfr"}
+
+	tests := []struct {
+		name string
+		cfg  asyncProfilerConfig
+		opts profileOptions
+		want []string
+	}{
+		{
+			name: "collapsed",
+			cfg:  collapsed,
+			opts: profileOptions{PID: "42", Duration: 10, Stacks: "both", CallGraph: "fp"},
+			want: []string{"-d", "10", "-e", "cpu", "-i", "1001001", "-o", "collapsed", "42"},
+		},
+		{
+			name: "dwarf user stacks",
+			cfg:  collapsed,
+			opts: profileOptions{PID: "42", Duration: 5, Stacks: "user", CallGraph: "dwarf"},
+			want: []string{"-d", "5", "-e", "cpu", "-i", "1001001", "--cstack", "dwarf", "--all-user", "-o", "collapsed", "42"},
+		},
+		{
+			name: "jfr",
+			cfg:  jfr,
+			opts: profileOptions{PID: "42", Duration: 10, Stacks: "both", CallGraph: "fp"},
+			want: []string{"-d", "10", "-e", "itimer", "-i", "1001001", "--libpath", "/opt/lib/libasyncProfiler.so", "-o", "jfr", "-f", "/tmp/x/profile.jfr", "42"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := asyncProfilerArgs(tt.cfg, tt.opts, "/tmp/x/profile.jfr")
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("asyncProfilerArgs = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAsyncProfilerConfig(t *testing.T) {
+	cfg := asyncProfilerConfig{Path: "/opt/async-profiler/bin/asprof", Output: "jfr"}
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Event != "cpu" || cfg.Jfrconv != "/opt/async-profiler/bin/jfrconv" {
+		t.Errorf("defaults not applied: %+v", cfg)
+	}
+
+	cfg = asyncProfilerConfig{Path: "/opt/async-profiler/bin/asprof", Output: "html"}
+	if err := cfg.validate(); err == nil {
+		t.Error("validate accepted output html")
+	}
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"log/syslog"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// auditQueueSize bounds the records waiting to be sent to the webhook
+const auditQueueSize = 256
+
+// auditConfig is the audit section of the configuration file
+type auditConfig struct {
+	// File is appended one JSON record per line; auditing is off when no
+	// destination is set
+	File string `json:"file"`
+	// Syslog forwards records to "local" syslog or to a udp:// or tcp://
+	// address
+	Syslog string `json:"syslog"`
+	// Webhook receives each record as a JSON POST
+	Webhook string `json:"webhook"`
+}
+
+func (c *auditConfig) validate() error {
+	if c.Syslog != "" && c.Syslog != "local" {
+		u, err := url.Parse(c.Syslog)
+		if err != nil || (u.Scheme != "udp" && u.Scheme != "tcp") || u.Host == "" {
+			return fmt.Errorf("syslog must be local or a udp:// or tcp:// address")
+		}
+	}
+	if c.Webhook != "" {
+		if u, err := url.Parse(c.Webhook); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return fmt.Errorf("invalid webhook %q", c.Webhook)
+		}
+	}
+	return nil
+}
+
+// auditRecord describes one profiling request
+type auditRecord struct {
+	Time   time.Time `json:"time"`
+	Client string    `json:"client"`
+	Remote string    `json:"remote,omitempty"`
+	Method string    `json:"method,omitempty"`
+	Path   string    `json:"path"`
+	// PID is the profiled process once resolved from redis_port or a
+	// container, the pid parameter otherwise
+	PID       string `json:"pid,omitempty"`
+	RedisPort string `json:"redis_port,omitempty"`
+	Container string `json:"container,omitempty"`
+	Tool      string `json:"tool"`
+	// Seconds is the requested capture duration
+	Seconds    string  `json:"seconds,omitempty"`
+	ElapsedSec float64 `json:"elapsed_seconds"`
+	Status     int     `json:"status"`
+	Bytes      int64   `json:"bytes"`
+	Error      string  `json:"error,omitempty"`
+}
+
+// auditLog writes audit records to the configured destinations
+type auditLog struct {
+	mu      sync.Mutex
+	file    *os.File
+	syslog  *syslog.Writer
+	webhook string
+	queue   chan []byte
+}
+
+// audit is the audit log, nil when auditing is off
+var audit *auditLog
+
+// openAuditLog opens the destinations of cfg, or returns nil when none is set
+func openAuditLog(cfg auditConfig) (*auditLog, error) {
+	if cfg.File == "" && cfg.Syslog == "" && cfg.Webhook == "" {
+		return nil, nil
+	}
+
+	a := &auditLog{webhook: cfg.Webhook}
+	if cfg.File != "" {
+		f, err := os.OpenFile(cfg.File, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return nil, err
+		}
+		a.file = f
+	}
+	if cfg.Syslog != "" {
+		network, addr := "", ""
+		if cfg.Syslog != "local" {
+			u, _ := url.Parse(cfg.Syslog)
+			network, addr = u.Scheme, u.Host
+		}
+		w, err := syslog.Dial(network, addr, syslog.LOG_NOTICE|syslog.LOG_AUTH, "bcc-exporter")
+		if err != nil {
+			return nil, fmt.Errorf("syslog: %v", err)
+		}
+		a.syslog = w
+	}
+	if cfg.Webhook != "" {
+		a.queue = make(chan []byte, auditQueueSize)
+		go a.sendWebhook()
+	}
+	return a, nil
+}
+
+// record writes rec to every destination. Failures are logged, not
+// returned: the request has already been served.
+func (a *auditLog) record(rec auditRecord) {
+	if a == nil {
+		return
+	}
+	data, err := json.Marshal(rec)
+	if err != nil {
+		log.Printf("Failed to encode audit record: %v", err)
+		return
+	}
+
+	a.mu.Lock()
+	if a.file != nil {
+		if _, err := a.file.Write(append(data, '\n')); err != nil {
+			log.Printf("Failed to write audit log: %v", err)
+		}
+	}
+	if a.syslog != nil {
+		if err := a.syslog.Notice(string(data)); err != nil {
+			log.Printf("Failed to send audit record to syslog: %v", err)
+		}
+	}
+	a.mu.Unlock()
+
+	if a.queue != nil {
+		select {
+		case a.queue <- data:
+		default:
+			log.Printf("Audit webhook queue is full, dropping record of %s %s", rec.Client, rec.Path)
+		}
+	}
+}
+
+// sendWebhook posts queued records to the webhook one at a time, so a slow
+// receiver never delays profiling requests
+func (a *auditLog) sendWebhook() {
+	client := &http.Client{Timeout: 10 * time.Second}
+	for data := range a.queue {
+		resp, err := client.Post(a.webhook, "application/json", bytes.NewReader(data))
+		if err != nil {
+			log.Printf("Failed to send audit record to webhook: %v", err)
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			log.Printf("Audit webhook returned %s", resp.Status)
+		}
+	}
+}
+
+// auditKey is the context key of the record of a request being audited
+type auditKey struct{}
+
+// auditPID records the PID a request resolved its target to
+func auditPID(r *http.Request, pid string) {
+	if rec, ok := r.Context().Value(auditKey{}).(*auditRecord); ok {
+		rec.PID = pid
+	}
+}
+
+// auditWriter counts the status and size of a response
+type auditWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+	errBuf strings.Builder
+}
+
+// Unwrap lets http.ResponseController flush and hijack the response
+func (w *auditWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *auditWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *auditWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	// Keep the start of error responses, which http.Error writes as text
+	if w.status >= 400 && w.errBuf.Len() < 200 {
+		w.errBuf.Write(p[:min(len(p), 200-w.errBuf.Len())])
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// wrap records every request to handler in the audit log. tool names what
+// the endpoint runs unless the handler reports its backend in the
+// X-Profile-Backend header.
+func (a *auditLog) wrap(tool string, handler http.HandlerFunc) http.HandlerFunc {
+	if a == nil {
+		return handler
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		q := r.URL.Query()
+		rec := &auditRecord{
+			Time:      start.UTC(),
+			Client:    clientName(r),
+			Remote:    r.RemoteAddr,
+			Method:    r.Method,
+			Path:      r.URL.Path,
+			PID:       q.Get("pid"),
+			RedisPort: q.Get("redis_port"),
+			Container: q.Get("container"),
+			Seconds:   q.Get("seconds"),
+		}
+		if rec.Client == "" {
+			rec.Client = "anonymous"
+		}
+		aw := &auditWriter{ResponseWriter: w}
+		handler(aw, r.WithContext(context.WithValue(r.Context(), auditKey{}, rec)))
+
+		rec.Tool = tool
+		if backend := w.Header().Get("X-Profile-Backend"); backend != "" {
+			rec.Tool = backend
+		}
+		rec.ElapsedSec = time.Since(start).Seconds()
+		rec.Status = aw.status
+		if rec.Status == 0 {
+			rec.Status = http.StatusOK
+		}
+		rec.Bytes = aw.bytes
+		if rec.Status >= 400 {
+			rec.Error = strings.TrimSpace(aw.errBuf.String())
+		}
+		a.record(*rec)
+	}
+}
+
+// auditCapture records a capture started by the exporter itself, such as
+// by the watchdog, under the name of its trigger
+func auditCapture(opts profileOptions, meta profileMeta, tool string, start time.Time, size int64, err error) {
+	rec := auditRecord{
+		Time:       start.UTC(),
+		Client:     "trigger:" + meta.Trigger,
+		Path:       "capture",
+		PID:        opts.PID,
+		Tool:       tool,
+		Seconds:    strconv.Itoa(opts.Duration),
+		ElapsedSec: time.Since(start).Seconds(),
+		Status:     http.StatusOK,
+		Bytes:      size,
+	}
+	if err != nil {
+		rec.Status = http.StatusInternalServerError
+		rec.Error = err.Error()
+	}
+	audit.record(rec)
+}
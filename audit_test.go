@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// readAuditRecords returns the records of the audit log file at path
+func readAuditRecords(t *testing.T, path string) []auditRecord {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var records []auditRecord
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var rec auditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			t.Fatalf("malformed audit record %q: %v", scanner.Text(), err)
+		}
+		records = append(records, rec)
+	}
+	return records
+}
+
+func TestAuditConfigValidate(t *testing.T) {
+	tests := []struct {
+		cfg     auditConfig
+		wantErr bool
+	}{
+		{auditConfig{}, false},
+		{auditConfig{File: "/var/log/audit.log", Syslog: "local"}, false},
+		{auditConfig{Syslog: "udp://syslog.example.com:514", Webhook: "https://audit.example.com/hook"}, false},
+		{auditConfig{Syslog: "syslog.example.com:514"}, true},
+		{auditConfig{Syslog: "udp://"}, true},
+		{auditConfig{Webhook: "audit.example.com"}, true},
+	}
+	for _, tt := range tests {
+		if err := tt.cfg.validate(); (err != nil) != tt.wantErr {
+			t.Errorf("validate(%+v) error = %v, wantErr %v", tt.cfg, err, tt.wantErr)
+		}
+	}
+
+	if a, err := openAuditLog(auditConfig{}); a != nil || err != nil {
+		t.Errorf("openAuditLog without destinations = %v, %v; want nil", a, err)
+	}
+}
+
+func TestAuditWrap(t *testing.T) {
+	received := make(chan auditRecord, 4)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var rec auditRecord
+		body, _ := io.ReadAll(r.Body)
+		if err := json.Unmarshal(body, &rec); err != nil {
+			t.Errorf("webhook body %q: %v", body, err)
+		}
+		received <- rec
+	}))
+	defer hook.Close()
+
+	path := filepath.Join(t.TempDir(), "audit.log")
+	a, err := openAuditLog(auditConfig{File: path, Webhook: hook.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := a.wrap("perf", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("pid") == "" {
+			auditPID(r, "4242")
+			w.Header().Set("X-Profile-Backend", "async-profiler")
+			w.Write([]byte("profile data"))
+			return
+		}
+		http.Error(w, "Invalid PID: no such process", http.StatusBadRequest)
+	})
+
+	requests := []*http.Request{
+		httptest.NewRequest("GET", "/debug/pprof/profile?redis_port=6379&seconds=10", nil),
+		httptest.NewRequest("GET", "/debug/pprof/profile?pid=999999&seconds=5", nil),
+	}
+	// Authentication names the client before the audit log sees the request
+	requests[0] = requests[0].WithContext(context.WithValue(requests[0].Context(), clientKey{}, "alice"))
+	for _, req := range requests {
+		handler(httptest.NewRecorder(), req)
+	}
+
+	records := readAuditRecords(t, path)
+	if len(records) != 2 {
+		t.Fatalf("%d audit records, want 2", len(records))
+	}
+	ok, failed := records[0], records[1]
+	if ok.Client != "alice" || ok.PID != "4242" || ok.RedisPort != "6379" || ok.Tool != "async-profiler" ||
+		ok.Seconds != "10" || ok.Status != http.StatusOK || ok.Bytes != int64(len("profile data")) || ok.Error != "" {
+		t.Errorf("record of the successful capture = %+v", ok)
+	}
+	if failed.Client != "anonymous" || failed.PID != "999999" || failed.Tool != "perf" ||
+		failed.Status != http.StatusBadRequest || failed.Error != "Invalid PID: no such process" {
+		t.Errorf("record of the failed capture = %+v", failed)
+	}
+
+	for i := 0; i < 2; i++ {
+		select {
+		case rec := <-received:
+			if rec.Path != "/debug/pprof/profile" {
+				t.Errorf("webhook record = %+v", rec)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("audit record was not sent to the webhook")
+		}
+	}
+}
+
+func TestAuditCapture(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	a, err := openAuditLog(auditConfig{File: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	orig := audit
+	audit = a
+	t.Cleanup(func() { audit = orig })
+
+	opts := profileOptions{PID: "100", Duration: 10}
+	auditCapture(opts, profileMeta{Trigger: "watchdog"}, "perf", time.Now(), 2048, nil)
+	auditCapture(opts, profileMeta{Trigger: "alertmanager"}, "bcc", time.Now(), 0, errors.New("profile-bpfcc failed"))
+
+	records := readAuditRecords(t, path)
+	if len(records) != 2 {
+		t.Fatalf("%d audit records, want 2", len(records))
+	}
+	if r := records[0]; r.Client != "trigger:watchdog" || r.PID != "100" || r.Seconds != "10" || r.Bytes != 2048 || r.Status != http.StatusOK {
+		t.Errorf("watchdog record = %+v", r)
+	}
+	if r := records[1]; r.Client != "trigger:alertmanager" || r.Tool != "bcc" || r.Status != http.StatusInternalServerError || r.Error == "" {
+		t.Errorf("alertmanager record = %+v", r)
+	}
+
+	// Without destinations nothing is recorded and handlers are unchanged
+	var disabled *auditLog
+	disabled.record(auditRecord{})
+	if disabled.wrap("perf", handlePprof) == nil {
+		t.Error("wrap on a nil audit log returned nil")
+	}
+}
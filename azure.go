@@ -0,0 +1,269 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// azureVersion is the Blob service REST API version of the requests
+const azureVersion = "2021-08-06"
+
+// azureConfig is the storage.azure section of the configuration file
+type azureConfig struct {
+	// Account is the storage account
+	Account string `json:"account"`
+	// Container holds the profiles
+	Container string `json:"container"`
+	// Prefix is prepended to the blob names, e.g. "profiles/"
+	Prefix string `json:"prefix"`
+	// Endpoint is the URL of the Blob service (default
+	// https://<account>.blob.core.windows.net), e.g. for Azurite
+	Endpoint string `json:"endpoint"`
+}
+
+func (c *azureConfig) validate() error {
+	if c.Account == "" || c.Container == "" {
+		return fmt.Errorf("account and container are required")
+	}
+	if c.Endpoint == "" {
+		c.Endpoint = "https://" + c.Account + ".blob.core.windows.net"
+	}
+	if u, err := url.Parse(c.Endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid endpoint %q", c.Endpoint)
+	}
+	return nil
+}
+
+// azureIMDSEndpoint returns the token endpoint of the Azure Instance
+// Metadata Service; tests point it to a fake server
+var azureIMDSEndpoint = func() string {
+	return "http://169.254.169.254/metadata/identity/oauth2/token"
+}
+
+// azureCredentials authorizes Blob service requests, with the SAS token in
+// $AZURE_STORAGE_SAS_TOKEN or else a managed identity token, of the identity
+// $AZURE_CLIENT_ID when several are assigned, renewed before it expires
+type azureCredentials struct {
+	sas    url.Values
+	client *http.Client
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+func newAzureCredentials() (*azureCredentials, error) {
+	c := &azureCredentials{client: &http.Client{Timeout: 30 * time.Second}}
+	if sas := os.Getenv("AZURE_STORAGE_SAS_TOKEN"); sas != "" {
+		values, err := url.ParseQuery(strings.TrimPrefix(sas, "?"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid AZURE_STORAGE_SAS_TOKEN: %v", err)
+		}
+		c.sas = values
+		return c, nil
+	}
+	if _, err := c.bearer(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// bearer returns a managed identity token for the storage service
+func (c *azureCredentials) bearer() (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if time.Until(c.expires) > 5*time.Minute {
+		return c.token, nil
+	}
+
+	query := url.Values{"api-version": {"2018-02-01"}, "resource": {"https://storage.azure.com/"}}
+	if id := os.Getenv("AZURE_CLIENT_ID"); id != "" {
+		query.Set("client_id", id)
+	}
+	req, _ := http.NewRequest("GET", azureIMDSEndpoint()+"?"+query.Encode(), nil)
+	req.Header.Set("Metadata", "true")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("managed identity: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("managed identity token request returned %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	// IMDS sends expires_in as a string
+	var token struct {
+		AccessToken string      `json:"access_token"`
+		ExpiresIn   json.Number `json:"expires_in"`
+	}
+	if err := json.Unmarshal(body, &token); err != nil || token.AccessToken == "" {
+		return "", fmt.Errorf("invalid managed identity token response: %s", strings.TrimSpace(string(body)))
+	}
+	seconds, _ := token.ExpiresIn.Int64()
+	c.token = token.AccessToken
+	c.expires = time.Now().Add(time.Duration(seconds) * time.Second)
+	return c.token, nil
+}
+
+// authorize adds the SAS token to the query of req, or its bearer token
+func (c *azureCredentials) authorize(req *http.Request) error {
+	if c.sas != nil {
+		query := req.URL.Query()
+		for name, values := range c.sas {
+			query[name] = values
+		}
+		req.URL.RawQuery = query.Encode()
+		return nil
+	}
+	token, err := c.bearer()
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return nil
+}
+
+// azureStorage keeps objects as block blobs of an Azure Storage container,
+// under the configured prefix
+type azureStorage struct {
+	cfg    azureConfig
+	creds  *azureCredentials
+	client *http.Client
+}
+
+// newAzureStorage returns the storage of cfg. It fails when no credentials
+// are available.
+func newAzureStorage(cfg azureConfig) (*azureStorage, error) {
+	creds, err := newAzureCredentials()
+	if err != nil {
+		return nil, err
+	}
+	return &azureStorage{cfg: cfg, creds: creds, client: &http.Client{Timeout: 10 * time.Minute}}, nil
+}
+
+func (s *azureStorage) String() string {
+	return strings.TrimSuffix(s.cfg.Endpoint, "/") + "/" + s.cfg.Container + "/" + s.cfg.Prefix
+}
+
+// do sends an authorized request for the blob name, or for the container
+// when name is ""
+func (s *azureStorage) do(method, name string, query url.Values, header http.Header, body io.Reader, size int64) (*http.Response, error) {
+	u := strings.TrimSuffix(s.cfg.Endpoint, "/") + "/" + url.PathEscape(s.cfg.Container)
+	if name != "" {
+		u += "/" + (&url.URL{Path: s.cfg.Prefix + name}).EscapedPath()
+	}
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = size
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	req.Header.Set("x-ms-version", azureVersion)
+	req.Header.Set("x-ms-date", time.Now().UTC().Format(http.TimeFormat))
+	if err := s.creds.authorize(req); err != nil {
+		return nil, err
+	}
+	return s.client.Do(req)
+}
+
+// azureError returns the error of a failed Blob service response, whose
+// XML body has the same Code and Message as the errors of S3
+func azureError(op string, resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	return fmt.Errorf("%s: %s: %s", op, resp.Status, s3ErrorMessage(body))
+}
+
+func (s *azureStorage) Put(name string, r io.Reader, size int64) error {
+	r, size, cleanup, err := spool(r, size)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	header := http.Header{"X-Ms-Blob-Type": {"BlockBlob"}, "Content-Type": {"application/octet-stream"}}
+	resp, err := s.do("PUT", name, nil, header, r, size)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return azureError("PUT "+name, resp)
+	}
+	return nil
+}
+
+func (s *azureStorage) Get(name string) (io.ReadSeekCloser, error) {
+	return openRemoteObject(func(offset int64) (*http.Response, error) {
+		header := http.Header{}
+		if r := rangeHeader(offset); r != "" {
+			header.Set("Range", r)
+		}
+		return s.do("GET", name, nil, header, nil, 0)
+	})
+}
+
+func (s *azureStorage) List(prefix string) ([]string, error) {
+	var names []string
+	marker := ""
+	for {
+		query := url.Values{"restype": {"container"}, "comp": {"list"}, "prefix": {s.cfg.Prefix + prefix}, "delimiter": {"/"}}
+		if marker != "" {
+			query.Set("marker", marker)
+		}
+		resp, err := s.do("GET", "", query, nil, nil, 0)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			err := azureError("list "+s.String(), resp)
+			resp.Body.Close()
+			return nil, err
+		}
+		var result struct {
+			Blobs []struct {
+				Name string `xml:"Name"`
+			} `xml:"Blobs>Blob"`
+			NextMarker string `xml:"NextMarker"`
+		}
+		err = xml.NewDecoder(io.LimitReader(resp.Body, 16<<20)).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("invalid Azure listing: %v", err)
+		}
+		for _, blob := range result.Blobs {
+			names = append(names, strings.TrimPrefix(blob.Name, s.cfg.Prefix))
+		}
+		if result.NextMarker == "" {
+			return names, nil
+		}
+		marker = result.NextMarker
+	}
+}
+
+func (s *azureStorage) Delete(name string) error {
+	resp, err := s.do("DELETE", name, nil, nil, nil, 0)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 && resp.StatusCode != http.StatusNotFound {
+		return azureError("DELETE "+name, resp)
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// fakeAzure serves the Blob service of one container, accepting the SAS
+// token sig=secret
+type fakeAzure struct {
+	*fakeObjects
+	container string
+}
+
+func (s *fakeAzure) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if query.Get("sig") != "secret" || r.Header.Get("x-ms-version") == "" {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("<Error><Code>AuthenticationFailed</Code><Message>Signature did not match</Message></Error>"))
+		return
+	}
+	if r.URL.Path == "/"+s.container && query.Get("comp") == "list" {
+		var result struct {
+			XMLName xml.Name `xml:"EnumerationResults"`
+			Blobs   []struct {
+				Name string `xml:"Name"`
+			} `xml:"Blobs>Blob"`
+		}
+		for _, name := range s.list(query.Get("prefix")) {
+			result.Blobs = append(result.Blobs, struct {
+				Name string `xml:"Name"`
+			}{name})
+		}
+		w.Header().Set("Content-Type", "application/xml")
+		xml.NewEncoder(w).Encode(result)
+		return
+	}
+	name, ok := strings.CutPrefix(r.URL.Path, "/"+s.container+"/")
+	if !ok {
+		http.Error(w, "unexpected request", http.StatusBadRequest)
+		return
+	}
+	switch r.Method {
+	case "PUT":
+		if r.Header.Get("x-ms-blob-type") != "BlockBlob" {
+			http.Error(w, "missing blob type", http.StatusBadRequest)
+			return
+		}
+		s.put(name, r.Body)
+		w.WriteHeader(http.StatusCreated)
+	case "GET":
+		s.serve(w, r, name)
+	case "DELETE":
+		if !s.delete(name) {
+			http.Error(w, "<Error><Code>BlobNotFound</Code></Error>", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
+func TestAzureStorage(t *testing.T) {
+	fake := &fakeAzure{fakeObjects: newFakeObjects(), container: "profiles"}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+	t.Setenv("AZURE_STORAGE_SAS_TOKEN", "?sv=2021-08-06&sp=racwdl&sig=secret")
+
+	cfg := azureConfig{Account: "devstoreaccount1", Container: "profiles", Prefix: "bcc/", Endpoint: srv.URL}
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+	st, err := newAzureStorage(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStorage(t, st)
+
+	t.Setenv("AZURE_STORAGE_SAS_TOKEN", "sig=wrong")
+	if st, err = newAzureStorage(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.Put("x.json", strings.NewReader("{}"), 2); err == nil || !strings.Contains(err.Error(), "AuthenticationFailed") {
+		t.Errorf("Put() with a bad SAS token: %v", err)
+	}
+}
+
+func TestAzureManagedIdentity(t *testing.T) {
+	imds := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Metadata") != "true" || r.URL.Query().Get("client_id") != "1234" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		// IMDS sends the lifetime as a string
+		writeJSON(w, http.StatusOK, map[string]string{"access_token": "eyJ0eXAi.token", "expires_in": "86399"})
+	}))
+	defer imds.Close()
+	orig := azureIMDSEndpoint
+	azureIMDSEndpoint = func() string { return imds.URL }
+	defer func() { azureIMDSEndpoint = orig }()
+	t.Setenv("AZURE_STORAGE_SAS_TOKEN", "")
+	t.Setenv("AZURE_CLIENT_ID", "1234")
+
+	creds, err := newAzureCredentials()
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("GET", "https://account.blob.core.windows.net/profiles/x", nil)
+	if err := creds.authorize(req); err != nil || req.Header.Get("Authorization") != "Bearer eyJ0eXAi.token" {
+		t.Errorf("authorize() = %v, Authorization %q", err, req.Header.Get("Authorization"))
+	}
+}
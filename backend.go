@@ -0,0 +1,125 @@
+package main
+
+import (
+	"debug/elf"
+	"fmt"
+	"path/filepath"
+	"strconv"
+)
+
+// isGoBinary reports whether pid runs a Go binary, which perf profiles well
+// since Go keeps frame pointers
+func isGoBinary(pid int) bool {
+	f, err := elf.Open(filepath.Join(procRoot, strconv.Itoa(pid), "exe"))
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	return f.Section(".go.buildinfo") != nil
+}
+
+// detectRuntime identifies the language runtime of pid from its mapped
+// libraries, binary and comm: "java", "python", "node", "go" or "" for
+// native code
+func detectRuntime(pid int) string {
+	switch {
+	case isJavaProcess(pid):
+		return "java"
+	case isPythonProcess(pid):
+		return "python"
+	case isNodeProcess(pid):
+		return "node"
+	case isGoBinary(pid):
+		return "go"
+	}
+	return ""
+}
+
+// selectBackend picks the profiler for opts on the endpoint serving format:
+// "perf", "bcc", "async-profiler" or "py-spy". backend=auto prefers the
+// runtime specific profilers when they are available and can serve the
+// request, and otherwise uses the endpoint's own tool (perf for pprof,
+// profile-bpfcc for folded); other backend values are checked as given.
+func selectBackend(opts profileOptions, format string) (string, error) {
+	runtime := opts.Runtime
+	if runtime == "" {
+		pid, _ := strconv.Atoi(opts.PID)
+		runtime = detectRuntime(pid)
+	}
+
+	// profile-bpfcc only samples running threads, so folded wall-clock
+	// captures use perf too
+	native := "perf"
+	if format != "pprof" && opts.Mode != "wall" {
+		native = "bcc"
+	}
+
+	backend := opts.Backend
+	switch backend {
+	case "native":
+		backend = native
+	case "auto":
+		backend = native
+		switch {
+		case runtime == "java" && asyncProfiler.Path != "" && asyncProfilerSupports(opts) == nil:
+			backend = "async-profiler"
+		case runtime == "python" && pySpyInstalled() && pySpySupports(opts) == nil:
+			backend = "py-spy"
+		}
+	}
+
+	switch backend {
+	case "async-profiler":
+		if asyncProfiler.Path == "" {
+			return "", fmt.Errorf("backend=async-profiler: async-profiler is not configured")
+		}
+		if runtime != "java" {
+			return "", fmt.Errorf("backend=async-profiler: PID %s is not a JVM", opts.PID)
+		}
+		if err := asyncProfilerSupports(opts); err != nil {
+			return "", fmt.Errorf("backend=async-profiler: %v", err)
+		}
+		return backend, nil
+	case "py-spy":
+		if !pySpyInstalled() {
+			return "", fmt.Errorf("backend=py-spy: py-spy not found: install with pip install py-spy")
+		}
+		if runtime != "python" {
+			return "", fmt.Errorf("backend=py-spy: PID %s is not a Python process (set runtime=python for embedded interpreters)", opts.PID)
+		}
+		if err := pySpySupports(opts); err != nil {
+			return "", fmt.Errorf("backend=py-spy: %v", err)
+		}
+		return backend, nil
+	}
+
+	if opts.Output == "speedscope" || opts.Output == "flamegraph" {
+		return "", fmt.Errorf("format=%s is only available for Python targets profiled with py-spy", opts.Output)
+	}
+	// BCC only walks frame pointers, so DWARF and LBR unwinding are perf-only
+	if backend == "bcc" && opts.CallGraph != "fp" {
+		return "", fmt.Errorf("callgraph=%s is only supported by the pprof endpoint or backend=perf", opts.CallGraph)
+	}
+	if backend == "bcc" && opts.Output != "" {
+		return "", fmt.Errorf("format=%s needs perf", opts.Output)
+	}
+	if backend == "bcc" && opts.Event != "" {
+		return "", fmt.Errorf("event=%s needs perf", opts.Event)
+	}
+	if backend == "bcc" && opts.Mode == "wall" {
+		return "", fmt.Errorf("mode=wall needs perf")
+	}
+	// profile-bpfcc aggregates the stacks of all threads
+	if backend == "bcc" && opts.ThreadLabels && format == "pprof" {
+		return "", fmt.Errorf("thread_labels needs perf")
+	}
+	// Series and Redis bundles of the folded endpoint are BCC captures
+	if format != "pprof" && opts.Mode == "wall" && (opts.Snapshots > 1 || opts.RedisMetadata) {
+		return "", fmt.Errorf("mode=wall cannot be combined with snapshots or redis_metadata on this endpoint")
+	}
+	// Series and Redis bundles store the endpoint's own format
+	if backend != native && (opts.Snapshots > 1 || opts.RedisMetadata) {
+		return "", fmt.Errorf("backend=%s cannot be combined with snapshots or redis_metadata on this endpoint", backend)
+	}
+	return backend, nil
+}
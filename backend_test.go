@@ -0,0 +1,127 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+// writeFakeRuntimes gives the fake /proc processes 42 (JVM), 43 (Python),
+// 44 (Node.js), 45 (Go) and 46 (native code)
+func writeFakeRuntimes(t *testing.T) {
+	t.Helper()
+	writeFakeProc(t, map[int]int{42: 1, 43: 1, 44: 1, 45: 1, 46: 1})
+
+	// The test binary itself is a Go binary
+	goExe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := []struct {
+		pid     int
+		name    string
+		content string
+	}{
+		{42, "maps", "7f0000000000-7f0000100000 r-xp 00000000 08:01 1234 /usr/lib/jvm/java-21/lib/server/libjvm.so\n"},
+		{43, "maps", "7f0000000000-7f0000100000 r-xp 00000000 08:01 1234 /usr/lib/x86_64-linux-gnu/libpython3.11.so.1.0\n"},
+		{44, "comm", "node\n"},
+	}
+	for _, f := range files {
+		if err := os.WriteFile(filepath.Join(procRoot, strconv.Itoa(f.pid), f.name), []byte(f.content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(goExe, filepath.Join(procRoot, "45", "exe")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("/usr/bin/redis-server", filepath.Join(procRoot, "46", "exe")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDetectRuntime(t *testing.T) {
+	writeFakeRuntimes(t)
+
+	want := map[int]string{42: "java", 43: "python", 44: "node", 45: "go", 46: "", 999: ""}
+	for pid, runtime := range want {
+		if got := detectRuntime(pid); got != runtime {
+			t.Errorf("detectRuntime(%d) = %q, want %q", pid, got, runtime)
+		}
+	}
+}
+
+func TestSelectBackend(t *testing.T) {
+	writeFakeRuntimes(t)
+
+	orig := asyncProfiler
+	t.Cleanup(func() { asyncProfiler = orig })
+	asyncProfiler = asyncProfilerConfig{Path: "/opt/async-profiler/bin/asprof", Event: "cpu", Output: "collapsed"}
+
+	bin := t.TempDir()
+	if err := os.WriteFile(filepath.Join(bin, "py-spy"), []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin)
+
+	base := func(pid, backend string) profileOptions {
+		return profileOptions{PID: pid, Backend: backend, Stacks: "both", CallGraph: "fp", Snapshots: 1}
+	}
+	with := func(opts profileOptions, f func(*profileOptions)) profileOptions {
+		f(&opts)
+		return opts
+	}
+
+	tests := []struct {
+		name    string
+		opts    profileOptions
+		format  string
+		want    string
+		wantErr bool
+	}{
+		{"auto native pprof", base("46", "auto"), "pprof", "perf", false},
+		{"auto native folded", base("46", "auto"), "folded", "bcc", false},
+		{"auto go", base("45", "auto"), "pprof", "perf", false},
+		{"auto node", base("44", "auto"), "pprof", "perf", false},
+		{"auto java", base("42", "auto"), "pprof", "async-profiler", false},
+		{"auto java folded", base("42", "auto"), "folded", "async-profiler", false},
+		{"auto java needs perf", with(base("42", "auto"), func(o *profileOptions) { o.Output = "perfdata" }), "pprof", "perf", false},
+		{"auto python", base("43", "auto"), "pprof", "py-spy", false},
+		{"auto declared runtime", with(base("46", "auto"), func(o *profileOptions) { o.Runtime = "python" }), "pprof", "py-spy", false},
+		{"native java", base("42", "native"), "folded", "bcc", false},
+		{"perf on folded", with(base("46", "perf"), func(o *profileOptions) { o.CallGraph = "dwarf" }), "folded", "perf", false},
+		{"bcc on pprof", base("46", "bcc"), "pprof", "bcc", false},
+		{"bcc dwarf", with(base("46", "bcc"), func(o *profileOptions) { o.CallGraph = "dwarf" }), "pprof", "", true},
+		{"folded dwarf", with(base("46", "auto"), func(o *profileOptions) { o.CallGraph = "dwarf" }), "folded", "", true},
+		{"bcc thread labels on pprof", with(base("46", "bcc"), func(o *profileOptions) { o.ThreadLabels = true }), "pprof", "", true},
+		{"bcc series on pprof", with(base("46", "bcc"), func(o *profileOptions) { o.Snapshots = 3 }), "pprof", "", true},
+		{"speedscope without py-spy", with(base("46", "auto"), func(o *profileOptions) { o.Output = "speedscope" }), "pprof", "", true},
+		{"forced async-profiler not a JVM", base("43", "async-profiler"), "pprof", "", true},
+		{"forced py-spy not python", base("42", "py-spy"), "pprof", "", true},
+		{"forced py-spy tid", with(base("43", "py-spy"), func(o *profileOptions) { o.TID = "44" }), "pprof", "", true},
+		{"auto native folded wall", with(base("46", "auto"), func(o *profileOptions) { o.Mode = "wall" }), "folded", "perf", false},
+		{"auto python wall", with(base("43", "auto"), func(o *profileOptions) { o.Mode = "wall" }), "folded", "py-spy", false},
+		{"bcc wall", with(base("46", "bcc"), func(o *profileOptions) { o.Mode = "wall" }), "folded", "", true},
+		{"folded wall series", with(base("46", "auto"), func(o *profileOptions) { o.Mode = "wall"; o.Snapshots = 3 }), "folded", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := selectBackend(tt.opts, tt.format)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("selectBackend error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("selectBackend = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	asyncProfiler = asyncProfilerConfig{}
+	if _, err := selectBackend(base("42", "async-profiler"), "pprof"); err == nil {
+		t.Error("backend=async-profiler without configuration succeeded")
+	}
+	t.Setenv("PATH", t.TempDir())
+	if got, _ := selectBackend(base("43", "auto"), "pprof"); got != "perf" {
+		t.Errorf("auto python without py-spy = %q, want perf", got)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// bccProfileArgs builds the profile-bpfcc command line for the given options
+func bccProfileArgs(opts profileOptions) []string {
+	args := []string{"profile-bpfcc"}
+
+	if opts.TID != "" {
+		args = append(args, "-L", opts.TID)
+	} else {
+		args = append(args, "-p", opts.targetPIDs())
+	}
+
+	args = append(args,
+		"-F", fmt.Sprintf("%d", opts.frequency()),
+		"-f", // folded format
+	)
+	if opts.Annotate {
+		args = append(args, "-a") // _[k] suffix on kernel frames
+	}
+
+	switch opts.Stacks {
+	case "user":
+		args = append(args, "-U")
+	case "kernel":
+		args = append(args, "-K")
+	}
+
+	// duration as positional argument
+	return append(args, fmt.Sprintf("%d", opts.Duration))
+}
+
+// captureBCCProfile runs profile-bpfcc for opts and returns its folded output
+func captureBCCProfile(opts profileOptions) (folded []byte, err error) {
+	args := bccProfileArgs(opts)
+
+	stage := opts.Span.child("profile-bpfcc")
+	stage.set("profile.seconds", opts.Duration)
+	defer func() { stage.done(err) }()
+
+	cmd := privilegedCommand(context.Background(), args...)
+
+	// Capture both stdout and stderr
+	var stderr bytes.Buffer
+	stdout := newLimitedBuffer()
+	cmd.Stdout = stdout
+	cmd.Stderr = &stderr
+
+	log.Printf("Running command: %s", strings.Join(cmd.Args, " "))
+
+	if err := runJob(cmd, captureTimeout(opts.Duration)); err != nil {
+		log.Printf("Command failed: %v", err)
+		log.Printf("Stderr: %s", stderr.String())
+		if _, ok := err.(*captureError); ok {
+			return nil, err
+		}
+		return nil, &captureError{http.StatusInternalServerError, fmt.Sprintf("Profiler failed: %v\nStderr: %s", err, stderr.String())}
+	}
+
+	if err := stdout.check("profile-bpfcc output"); err != nil {
+		return nil, err
+	}
+	if opts.Annotate && opts.PerfMap {
+		pid, _ := strconv.Atoi(opts.PID)
+		jit, err := perfMapSymbols(pid)
+		if err != nil {
+			log.Printf("Failed to read perf map of PID %s: %v", opts.PID, err)
+		}
+		return annotateJITFrames(stdout.Bytes(), jit), nil
+	}
+	return stdout.Bytes(), nil
+}
+
+// runBCCProfile serves a profile-bpfcc capture as folded stacks, or as pprof
+// when selected for the pprof endpoint with backend=bcc
+func runBCCProfile(w http.ResponseWriter, r *http.Request, opts profileOptions, format string) {
+	folded, err := captureBCCProfile(opts)
+	if err != nil {
+		writeCaptureError(w, err)
+		return
+	}
+	serveFoldedCapture(w, opts, format, "bcc", folded)
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os/exec"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// bpftraceScripts holds the vetted scripts served by /debug/bpftrace/run.
+// Each script exits after $1 seconds and filters on PID $2 when it is not 0.
+//
+//go:embed bpftrace/*.bt
+var bpftraceScripts embed.FS
+
+// bpftraceLine is one record of bpftrace -f json output
+type bpftraceLine struct {
+	Type string          `json:"type"`
+	Data json.RawMessage `json:"data"`
+}
+
+// runBpftrace runs bpftrace with args as root, killing it when ctx is done
+// or seconds plus -job-grace have passed, and returns its stdout
+func runBpftrace(ctx context.Context, seconds int, args ...string) ([]byte, error) {
+	if _, err := exec.LookPath("bpftrace"); err != nil {
+		return nil, &captureError{http.StatusInternalServerError, "bpftrace not found. Install with: sudo apt-get install bpftrace"}
+	}
+
+	cmd := privilegedCommand(ctx, append([]string{"bpftrace"}, args...)...)
+	var stderr bytes.Buffer
+	stdout := newLimitedBuffer()
+	cmd.Stdout = stdout
+	cmd.Stderr = &stderr
+
+	if err := runJob(cmd, captureTimeout(seconds)); err != nil {
+		if _, ok := err.(*captureError); ok {
+			return nil, err
+		}
+		return nil, &captureError{http.StatusInternalServerError, fmt.Sprintf("bpftrace failed: %v\nStderr: %s", err, stderr.String())}
+	}
+	if err := stdout.check("bpftrace output"); err != nil {
+		return nil, err
+	}
+	return stdout.Bytes(), nil
+}
+
+// bpftraceScript describes a script of the library
+type bpftraceScript struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+// listBpftraceScripts returns the library scripts with the description
+// taken from their leading comment
+func listBpftraceScripts() ([]bpftraceScript, error) {
+	entries, err := bpftraceScripts.ReadDir("bpftrace")
+	if err != nil {
+		return nil, err
+	}
+
+	var scripts []bpftraceScript
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), ".bt")
+		if !ok {
+			continue
+		}
+		data, err := bpftraceScripts.ReadFile(path.Join("bpftrace", entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		var desc []string
+		for _, line := range strings.Split(string(data), "\n") {
+			comment, ok := strings.CutPrefix(line, "// ")
+			if !ok {
+				break
+			}
+			desc = append(desc, comment)
+		}
+		scripts = append(scripts, bpftraceScript{Name: name, Description: strings.Join(desc, " ")})
+	}
+	sort.Slice(scripts, func(i, j int) bool { return scripts[i].Name < scripts[j].Name })
+	return scripts, nil
+}
+
+// bpftraceResult is the structured output of a bpftrace run
+type bpftraceResult struct {
+	Script     string                     `json:"script"`
+	PID        string                     `json:"pid,omitempty"`
+	Seconds    int                        `json:"seconds"`
+	Maps       map[string]json.RawMessage `json:"maps"`
+	Output     []string                   `json:"output,omitempty"`
+	LostEvents int64                      `json:"lost_events,omitempty"`
+}
+
+// parseBpftraceOutput collects the maps and printf output of bpftrace -f json
+func parseBpftraceOutput(r io.Reader, result *bpftraceResult) error {
+	result.Maps = make(map[string]json.RawMessage)
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	for scanner.Scan() {
+		var line bpftraceLine
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			continue
+		}
+
+		switch line.Type {
+		case "map", "hist", "stats":
+			var maps map[string]json.RawMessage
+			if err := json.Unmarshal(line.Data, &maps); err != nil {
+				return fmt.Errorf("malformed %s record: %v", line.Type, err)
+			}
+			for name, value := range maps {
+				result.Maps[name] = value
+			}
+		case "printf":
+			var text string
+			json.Unmarshal(line.Data, &text)
+			result.Output = append(result.Output, strings.TrimRight(text, "\n"))
+		case "lost_events":
+			var lost struct {
+				Events int64 `json:"events"`
+			}
+			json.Unmarshal(line.Data, &lost)
+			result.LostEvents += lost.Events
+		}
+	}
+	return scanner.Err()
+}
+
+// handleBpftraceScripts lists the scripts of the library
+func handleBpftraceScripts(w http.ResponseWriter, r *http.Request) {
+	scripts, err := listBpftraceScripts()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to list scripts: %v", err), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, scripts)
+}
+
+// handleBpftraceRun runs a library script for the requested duration and
+// returns its maps as JSON
+func handleBpftraceRun(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	name := q.Get("script")
+	seconds, err := strconv.Atoi(q.Get("seconds"))
+	if name == "" || err != nil || seconds <= 0 || seconds > 300 {
+		http.Error(w, "Missing script or invalid seconds (1-300)", http.StatusBadRequest)
+		return
+	}
+
+	// Names come from the embedded library only, never from a path
+	script, err := bpftraceScripts.ReadFile(path.Join("bpftrace", path.Base(name)+".bt"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Unknown script %q, see /debug/bpftrace/scripts", name), http.StatusNotFound)
+		return
+	}
+
+	result := bpftraceResult{Script: name, PID: q.Get("pid"), Seconds: seconds}
+	pid := "0"
+	if result.PID != "" {
+		if err := validatePID(result.PID); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid PID: %v", err), http.StatusBadRequest)
+			return
+		}
+		pid = result.PID
+	}
+	if err := currentPolicy().checkTrace(pid); err != nil {
+		http.Error(w, fmt.Sprintf("Forbidden target: %v", err), http.StatusForbidden)
+		return
+	}
+
+	if q.Get("test") == "true" {
+		result.Maps = map[string]json.RawMessage{
+			"@usecs": json.RawMessage(`[{"min": 64, "max": 127, "count": 12}, {"min": 128, "max": 255, "count": 3}]`),
+		}
+		writeJSON(w, http.StatusOK, result)
+		return
+	}
+
+	release, ok := takeCaptureSlot(w, r, result.PID)
+	if !ok {
+		return
+	}
+	defer release()
+
+	log.Printf("Running bpftrace script %s for %d seconds (pid %s)", name, seconds, pid)
+	out, err := runBpftrace(r.Context(), seconds, "-f", "json", "-e", string(script), strconv.Itoa(seconds), pid)
+	if err != nil {
+		writeCaptureError(w, err)
+		return
+	}
+	if err := parseBpftraceOutput(bytes.NewReader(out), &result); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to parse bpftrace output: %v", err), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, result)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestBpftraceLibrary(t *testing.T) {
+	scripts, err := listBpftraceScripts()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names := make(map[string]bool)
+	for _, s := range scripts {
+		names[s.Name] = true
+		if s.Description == "" {
+			t.Errorf("script %s has no description comment", s.Name)
+		}
+
+		// Every script must stop on its own after the requested duration
+		data, err := bpftraceScripts.ReadFile(path.Join("bpftrace", s.Name+".bt"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(data), "interval:s:$1 { exit(); }") {
+			t.Errorf("script %s does not exit after $1 seconds", s.Name)
+		}
+	}
+	for _, want := range []string{"biolatency", "fsynclat", "cowfaults", "runqlat"} {
+		if !names[want] {
+			t.Errorf("library is missing %s", want)
+		}
+	}
+}
+
+func TestParseBpftraceOutput(t *testing.T) {
+	output := `{"type": "attached_probes", "data": {"probes": 3}}
+{"type": "printf", "data": "tracing...\n"}
+{"type": "hist", "data": {"@usecs": {"fsync": [{"min": 128, "max": 255, "count": 4}]}}}
+{"type": "map", "data": {"@forks": {"redis-server,redis-rdb-bgsave": 1}}}
+{"type": "lost_events", "data": {"events": 7}}
+`
+	var result bpftraceResult
+	if err := parseBpftraceOutput(strings.NewReader(output), &result); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(result.Maps) != 2 || result.Maps["@usecs"] == nil || result.Maps["@forks"] == nil {
+		t.Errorf("Maps = %v, want @usecs and @forks", result.Maps)
+	}
+	if len(result.Output) != 1 || result.Output[0] != "tracing..." {
+		t.Errorf("Output = %q", result.Output)
+	}
+	if result.LostEvents != 7 {
+		t.Errorf("LostEvents = %d, want 7", result.LostEvents)
+	}
+}
+
+func TestBpftraceRunEndpoint(t *testing.T) {
+	tests := []struct {
+		query      string
+		wantStatus int
+	}{
+		{"script=biolatency&seconds=5&test=true", http.StatusOK},
+		{"script=biolatency&test=true", http.StatusBadRequest},
+		{"script=biolatency&seconds=301&test=true", http.StatusBadRequest},
+		{"script=nope&seconds=5&test=true", http.StatusNotFound},
+		{"script=../main&seconds=5&test=true", http.StatusNotFound},
+		{"script=fsynclat&seconds=5&pid=999999999&test=true", http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/debug/bpftrace/run?"+tt.query, nil)
+		rr := httptest.NewRecorder()
+		handleBpftraceRun(rr, req)
+
+		if rr.Code != tt.wantStatus {
+			t.Errorf("%s: status = %d, want %d: %s", tt.query, rr.Code, tt.wantStatus, rr.Body.String())
+			continue
+		}
+		if rr.Code == http.StatusOK {
+			var result bpftraceResult
+			if err := json.Unmarshal(rr.Body.Bytes(), &result); err != nil {
+				t.Errorf("%s: %v", tt.query, err)
+			} else if result.Script != "biolatency" || result.Maps["@usecs"] == nil {
+				t.Errorf("%s: result = %+v", tt.query, result)
+			}
+		}
+	}
+}
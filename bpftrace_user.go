@@ -0,0 +1,343 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// maxUserScriptSize bounds the bpftrace programs accepted from clients
+const maxUserScriptSize = 16 << 10
+
+// userBpftraceConfig enables and restricts client supplied bpftrace programs
+type userBpftraceConfig struct {
+	// Enabled turns on POST /debug/bpftrace/user; it is off by default
+	Enabled bool `json:"enabled"`
+	// MaxSeconds is the hard runtime limit of a program (default 60)
+	MaxSeconds int `json:"max_seconds"`
+	// Probes lists the allowed probe types (default tracepoint, profile,
+	// interval, software, hardware, BEGIN and END)
+	Probes []string `json:"probes"`
+	// SystemWide accepts programs without a pid, which may trace every
+	// process of the host; off by default
+	SystemWide bool `json:"system_wide"`
+}
+
+func (c *userBpftraceConfig) validate() error {
+	if c.MaxSeconds == 0 {
+		c.MaxSeconds = 60
+	}
+	if c.MaxSeconds < 0 || c.MaxSeconds > 300 {
+		return fmt.Errorf("max_seconds must be between 1 and 300")
+	}
+	if len(c.Probes) == 0 {
+		c.Probes = []string{"tracepoint", "profile", "interval", "software", "hardware", "BEGIN", "END"}
+	}
+	for _, probe := range c.Probes {
+		if _, ok := bpftraceProbeTypes[probe]; !ok {
+			return fmt.Errorf("unknown probe type %q", probe)
+		}
+	}
+	return nil
+}
+
+// bpftraceProbeTypes maps probe types and their short aliases to the full type
+var bpftraceProbeTypes = map[string]string{
+	"BEGIN": "BEGIN", "END": "END",
+	"tracepoint": "tracepoint", "t": "tracepoint",
+	"rawtracepoint": "rawtracepoint", "rt": "rawtracepoint",
+	"kprobe": "kprobe", "k": "kprobe",
+	"kretprobe": "kretprobe", "kr": "kretprobe",
+	"uprobe": "uprobe", "u": "uprobe",
+	"uretprobe": "uretprobe", "ur": "uretprobe",
+	"usdt": "usdt", "U": "usdt",
+	"fentry": "fentry", "f": "fentry",
+	"fexit": "fexit", "fr": "fexit",
+	"profile": "profile", "p": "profile",
+	"interval": "interval", "i": "interval",
+	"software": "software", "s": "software",
+	"hardware": "hardware", "h": "hardware",
+}
+
+// bpftraceCallRe matches the calls of a program whose literals were stripped
+var bpftraceCallRe = regexp.MustCompile(`\b([A-Za-z_][A-Za-z0-9_]*)\s*\(`)
+
+// bpftraceAllowedCalls are the keywords and builtins that only read and
+// aggregate data. Anything else is rejected, such as running commands
+// (system), sending signals (signal), changing return values (override) or
+// reading files (cat).
+var bpftraceAllowedCalls = map[string]bool{
+	// Keywords followed by a parenthesis
+	"if": true, "while": true, "for": true, "unroll": true, "sizeof": true, "offsetof": true,
+	// Output and control
+	"printf": true, "print": true, "time": true, "strftime": true, "exit": true, "clear": true, "zero": true, "delete": true, "has_key": true, "len": true,
+	// Aggregations
+	"count": true, "sum": true, "avg": true, "min": true, "max": true, "stats": true, "hist": true, "lhist": true,
+	// Reading and formatting values
+	"str": true, "buf": true, "join": true, "strncmp": true, "strcontains": true, "ntop": true, "pton": true, "macaddr": true, "reg": true, "bswap": true,
+	"kstack": true, "ustack": true, "ksym": true, "usym": true, "kaddr": true, "uaddr": true, "cgroupid": true, "path": true,
+}
+
+// stripBpftraceLiterals blanks out comments and the contents of string
+// literals so braces and calls inside them are not mistaken for code
+func stripBpftraceLiterals(src string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(src); i++ {
+		switch {
+		case strings.HasPrefix(src[i:], "//"):
+			end := strings.IndexByte(src[i:], '\n')
+			if end < 0 {
+				return b.String(), nil
+			}
+			i += end - 1
+		case strings.HasPrefix(src[i:], "/*"):
+			end := strings.Index(src[i+2:], "*/")
+			if end < 0 {
+				return "", fmt.Errorf("unterminated comment")
+			}
+			i += end + 3
+			b.WriteByte(' ')
+		case src[i] == '"':
+			b.WriteByte('"')
+			for i++; ; i++ {
+				if i >= len(src) || src[i] == '\n' {
+					return "", fmt.Errorf("unterminated string")
+				}
+				if src[i] == '\\' {
+					i++
+					continue
+				}
+				if src[i] == '"' {
+					break
+				}
+			}
+			b.WriteByte('"')
+		default:
+			b.WriteByte(src[i])
+		}
+	}
+	return b.String(), nil
+}
+
+// bpftraceProbe is a probe specification and the predicate of its block
+type bpftraceProbe struct {
+	spec, predicate string
+}
+
+// bpftraceProbes returns the probes of a program whose literals were
+// stripped, rejecting anything at the top level other than probe blocks
+func bpftraceProbes(code string) ([]bpftraceProbe, error) {
+	var probes []bpftraceProbe
+	depth, start := 0, 0
+	for i := 0; i < len(code); i++ {
+		switch code[i] {
+		case '{':
+			if depth == 0 {
+				header := strings.TrimSpace(code[start:i])
+				if header == "" {
+					return nil, fmt.Errorf("block without probe")
+				}
+				// The predicate follows the probe list after whitespace
+				var predicate string
+				if j := strings.Index(header, " /"); j >= 0 {
+					predicate = strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(header[j+2:]), "/"))
+					header = header[:j]
+				}
+				for _, spec := range strings.Split(header, ",") {
+					probes = append(probes, bpftraceProbe{spec: strings.TrimSpace(spec), predicate: predicate})
+				}
+			}
+			depth++
+		case '}':
+			depth--
+			if depth < 0 {
+				return nil, fmt.Errorf("unbalanced braces")
+			}
+			if depth == 0 {
+				start = i + 1
+			}
+		}
+	}
+	if depth != 0 {
+		return nil, fmt.Errorf("unbalanced braces")
+	}
+	if rest := strings.TrimSpace(code[start:]); rest != "" {
+		return nil, fmt.Errorf("unexpected statement %q outside a probe", rest)
+	}
+	if len(probes) == 0 {
+		return nil, fmt.Errorf("program has no probes")
+	}
+	return probes, nil
+}
+
+// bpftracePIDFilterRe matches the predicates limiting a probe to the target:
+// pid == $2, alone or and-ed with a parenthesized condition
+var bpftracePIDFilterRe = regexp.MustCompile(`^pid\s*==\s*\$2(\s*&&\s*(\(.*\)))?$`)
+
+// filtersTargetPID reports whether a probe with predicate only fires in the
+// target process
+func filtersTargetPID(predicate string) bool {
+	m := bpftracePIDFilterRe.FindStringSubmatch(predicate)
+	if m == nil {
+		return false
+	}
+	// The parenthesis must hold the whole condition, or an || after it
+	// would fire for other processes too
+	depth := 0
+	for i, c := range m[2] {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth == 0 && i != len(m[2])-1 {
+				return false
+			}
+		}
+	}
+	return depth == 0
+}
+
+// validateUserBpftrace checks a client supplied program against the probe
+// type and builtin allowlists, and reports whether it traces the whole
+// system: whether any probe other than BEGIN and END fires without the
+// /pid == $2/ predicate
+func validateUserBpftrace(src string, allowed []string) (bool, error) {
+	if len(src) > maxUserScriptSize {
+		return false, fmt.Errorf("program is larger than %d bytes", maxUserScriptSize)
+	}
+	code, err := stripBpftraceLiterals(src)
+	if err != nil {
+		return false, err
+	}
+	if strings.Contains(code, "#") {
+		return false, fmt.Errorf("preprocessor directives are not allowed")
+	}
+	for _, m := range bpftraceCallRe.FindAllStringSubmatch(code, -1) {
+		if !bpftraceAllowedCalls[m[1]] {
+			return false, fmt.Errorf("%s() is not allowed", m[1])
+		}
+	}
+
+	probes, err := bpftraceProbes(code)
+	if err != nil {
+		return false, err
+	}
+	allow := make(map[string]bool)
+	for _, probe := range allowed {
+		allow[probe] = true
+	}
+	systemWide := false
+	for _, probe := range probes {
+		kind, _, _ := strings.Cut(probe.spec, ":")
+		full, ok := bpftraceProbeTypes[kind]
+		if !ok {
+			return false, fmt.Errorf("invalid probe %q", probe.spec)
+		}
+		if !allow[full] {
+			return false, fmt.Errorf("probe type %s is not allowed", full)
+		}
+		if full != "BEGIN" && full != "END" && !filtersTargetPID(probe.predicate) {
+			systemWide = true
+		}
+	}
+	return systemWide, nil
+}
+
+// userBpftraceHandler runs client supplied bpftrace programs when enabled
+type userBpftraceHandler struct {
+	cfg userBpftraceConfig
+}
+
+func newUserBpftraceHandler(cfg userBpftraceConfig) *userBpftraceHandler {
+	return &userBpftraceHandler{cfg: cfg}
+}
+
+// ServeHTTP validates the program in the request body and runs it for the
+// requested number of seconds, at most MaxSeconds
+func (h *userBpftraceHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !h.cfg.Enabled {
+		http.Error(w, "User bpftrace programs are disabled (set bpftrace_user.enabled in the configuration file)", http.StatusForbidden)
+		return
+	}
+
+	q := r.URL.Query()
+	seconds, err := strconv.Atoi(q.Get("seconds"))
+	if err != nil || seconds <= 0 || seconds > h.cfg.MaxSeconds {
+		http.Error(w, fmt.Sprintf("Invalid seconds: must be between 1 and %d", h.cfg.MaxSeconds), http.StatusBadRequest)
+		return
+	}
+
+	pid := "0"
+	if p := q.Get("pid"); p != "" && p != "0" {
+		if err := validatePID(p); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid PID: %v", err), http.StatusBadRequest)
+			return
+		}
+		pid = p
+	}
+	// The target policy only applies to the pid, which a program tracing
+	// the whole system does not have
+	if pid == "0" && !h.cfg.SystemWide {
+		http.Error(w, "System-wide programs are disabled: give a pid, or set bpftrace_user.system_wide in the configuration file", http.StatusForbidden)
+		return
+	}
+	if err := currentPolicy().checkTrace(pid); err != nil {
+		http.Error(w, fmt.Sprintf("Forbidden target: %v", err), http.StatusForbidden)
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxUserScriptSize+1))
+	if err != nil || len(body) > maxUserScriptSize {
+		http.Error(w, fmt.Sprintf("Program must be at most %d bytes", maxUserScriptSize), http.StatusRequestEntityTooLarge)
+		return
+	}
+	src := string(body)
+	systemWide, err := validateUserBpftrace(src, h.cfg.Probes)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Rejected program: %v", err), http.StatusBadRequest)
+		return
+	}
+	// $2 is only a parameter: a probe that does not filter on it traces
+	// every process, whatever pid was checked above
+	if systemWide && pid != "0" {
+		if !h.cfg.SystemWide {
+			http.Error(w, "System-wide programs are disabled: filter every probe other than BEGIN and END with /pid == $2/, or set bpftrace_user.system_wide in the configuration file", http.StatusForbidden)
+			return
+		}
+		if err := currentPolicy().checkTrace("0"); err != nil {
+			http.Error(w, fmt.Sprintf("Forbidden target: %v", err), http.StatusForbidden)
+			return
+		}
+	}
+
+	release, ok := takeCaptureSlot(w, r, q.Get("pid"))
+	if !ok {
+		return
+	}
+	defer release()
+
+	sum := sha256.Sum256(body)
+	log.Printf("Running user bpftrace program %s from %s for %d seconds", hex.EncodeToString(sum[:8]), r.RemoteAddr, seconds)
+
+	// The program cannot outlive seconds whether or not it exits on its own
+	program := src + fmt.Sprintf("\ninterval:s:%d { exit(); }\n", seconds)
+	result := bpftraceResult{Script: "user", PID: q.Get("pid"), Seconds: seconds}
+	out, err := runBpftrace(r.Context(), seconds, "-f", "json", "-e", program, strconv.Itoa(seconds), pid)
+	if err != nil {
+		writeCaptureError(w, err)
+		return
+	}
+	if err := parseBpftraceOutput(bytes.NewReader(out), &result); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to parse bpftrace output: %v", err), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, result)
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestValidateUserBpftrace(t *testing.T) {
+	cfg := userBpftraceConfig{}
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		src     string
+		wantErr string
+	}{
+		{"tracepoint", `tracepoint:syscalls:sys_enter_write /pid == $2/ { @bytes[comm] = sum(args->count); }`, ""},
+		{"aliases and predicate", "t:block:block_rq_issue, t:block:block_rq_insert { @[probe] = count(); }\nEND { clear(@); }", ""},
+		{"nested blocks", `profile:hz:99 { if (pid == $2) { @[ustack] = count(); } }`, ""},
+		{"braces in strings and comments", "BEGIN { printf(\"}{ system(\\\"x\\\")\\n\"); } // kprobe:x { }\n/* } */", ""},
+		{"kprobe not allowed", `kprobe:do_sys_open { @ = count(); }`, "probe type kprobe is not allowed"},
+		{"uprobe alias not allowed", `u:/usr/bin/redis-server:aclCommand { @ = count(); }`, "probe type uprobe is not allowed"},
+		{"system", `BEGIN { system("id"); }`, "system() is not allowed"},
+		{"cat", `BEGIN { cat("/etc/shadow"); }`, "cat() is not allowed"},
+		{"unlisted builtin", `tracepoint:net:net_dev_queue { skboutput("/tmp/x.pcap", args->skbaddr, 1500, 0); }`, "skboutput() is not allowed"},
+		{"keywords and casts", `profile:hz:99 { if (pid == $2) { @[(uint64)cpu, kstack(3)] = count(); } }`, ""},
+		{"include", "#include <linux/sched.h>\nBEGIN { }", "preprocessor directives are not allowed"},
+		{"unknown probe", `nonsense:foo { }`, "invalid probe"},
+		{"statement outside probe", `BEGIN { } config = 1`, "outside a probe"},
+		{"unbalanced", `BEGIN { if (1) { }`, "unbalanced braces"},
+		{"unterminated string", `BEGIN { printf("x); }`, "unterminated string"},
+		{"empty", ``, "no probes"},
+		{"too large", "BEGIN { }" + strings.Repeat(" ", maxUserScriptSize), "larger than"},
+	}
+
+	for _, tt := range tests {
+		_, err := validateUserBpftrace(tt.src, cfg.Probes)
+		if tt.wantErr == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error %v", tt.name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%s: error = %v, want %q", tt.name, err, tt.wantErr)
+		}
+	}
+
+	// Allowing a probe type through the configuration
+	if _, err := validateUserBpftrace(`kprobe:do_wp_page { @ = count(); }`, []string{"kprobe"}); err != nil {
+		t.Errorf("kprobe with kprobes allowed: %v", err)
+	}
+}
+
+func TestUserBpftraceSystemWide(t *testing.T) {
+	cfg := userBpftraceConfig{}
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		src  string
+		want bool
+	}{
+		{`tracepoint:syscalls:sys_enter_write /pid == $2/ { @ = count(); } END { print(@); }`, false},
+		{`t:block:block_rq_issue, t:block:block_rq_insert /pid==$2 && (args->bytes > 4096 || comm == "x")/ { @ = count(); }`, false},
+		{`BEGIN { printf("tracing\n"); }`, false},
+		{`tracepoint:syscalls:sys_enter_write { @ = count(); }`, true},
+		{`profile:hz:99 { if (pid == $2) { @[ustack] = count(); } }`, true},
+		{`tracepoint:syscalls:sys_enter_write /pid == $2 || 1/ { @ = count(); }`, true},
+		{`tracepoint:syscalls:sys_enter_write /pid == $2 && (1) || (1)/ { @ = count(); }`, true},
+		{`tracepoint:syscalls:sys_enter_write /pid == $2/ { } interval:s:1 { print(@); }`, true},
+	}
+	for _, tt := range tests {
+		got, err := validateUserBpftrace(tt.src, cfg.Probes)
+		if err != nil {
+			t.Errorf("%s: %v", tt.src, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: system-wide = %v, want %v", tt.src, got, tt.want)
+		}
+	}
+}
+
+func TestUserBpftraceConfigValidation(t *testing.T) {
+	cfg := userBpftraceConfig{MaxSeconds: 301}
+	if err := cfg.validate(); err == nil {
+		t.Error("validate() accepted max_seconds 301")
+	}
+	cfg = userBpftraceConfig{Probes: []string{"tracepoint", "bogus"}}
+	if err := cfg.validate(); err == nil {
+		t.Error("validate() accepted an unknown probe type")
+	}
+}
+
+func TestUserBpftraceHandler(t *testing.T) {
+	disabled := newUserBpftraceHandler(userBpftraceConfig{})
+	req := httptest.NewRequest("POST", "/debug/bpftrace/user?seconds=5", strings.NewReader("BEGIN { }"))
+	rr := httptest.NewRecorder()
+	disabled.ServeHTTP(rr, req)
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("disabled handler: status = %d, want %d", rr.Code, http.StatusForbidden)
+	}
+
+	cfg := userBpftraceConfig{Enabled: true, MaxSeconds: 30}
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Programs without a target trace the whole system, which needs
+	// system_wide
+	for _, query := range []string{"seconds=5", "seconds=5&pid=0"} {
+		req := httptest.NewRequest("POST", "/debug/bpftrace/user?"+query, strings.NewReader("BEGIN { }"))
+		rr := httptest.NewRecorder()
+		newUserBpftraceHandler(cfg).ServeHTTP(rr, req)
+		if rr.Code != http.StatusForbidden {
+			t.Errorf("%s without system_wide: status = %d, want %d", query, rr.Code, http.StatusForbidden)
+		}
+	}
+
+	// So are programs given a pid that they do not filter on
+	pid := strconv.Itoa(os.Getpid())
+	req = httptest.NewRequest("POST", "/debug/bpftrace/user?seconds=5&pid="+pid, strings.NewReader(`tracepoint:syscalls:sys_enter_write { @ = count(); }`))
+	rr = httptest.NewRecorder()
+	newUserBpftraceHandler(cfg).ServeHTTP(rr, req)
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("unfiltered program without system_wide: status = %d, want %d", rr.Code, http.StatusForbidden)
+	}
+
+	cfg.SystemWide = true
+	h := newUserBpftraceHandler(cfg)
+
+	tests := []struct {
+		query      string
+		body       string
+		wantStatus int
+	}{
+		{"seconds=31", "BEGIN { }", http.StatusBadRequest},
+		{"seconds=5", `kprobe:vfs_read { }`, http.StatusBadRequest},
+		{"seconds=5", strings.Repeat("x", maxUserScriptSize+1), http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("POST", "/debug/bpftrace/user?"+tt.query, strings.NewReader(tt.body))
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		if rr.Code != tt.wantStatus {
+			t.Errorf("%s: status = %d, want %d: %s", tt.query, rr.Code, tt.wantStatus, rr.Body.String())
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"debug/elf"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// procMapping is an executable file mapping of a process from
+// /proc/<pid>/maps
+type procMapping struct {
+	Start, Limit, Offset uint64
+	Path                 string
+}
+
+// parseProcMaps returns the executable file mappings of a maps file,
+// ordered by address
+func parseProcMaps(data []byte) []procMapping {
+	var maps []procMapping
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		// "55d0c1a00000-55d0c1b00000 r-xp 00100000 08:01 1234 /usr/bin/redis-server"
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 6 || len(fields[1]) < 3 || fields[1][2] != 'x' || !strings.HasPrefix(fields[5], "/") {
+			continue
+		}
+		start, limit, ok := strings.Cut(fields[0], "-")
+		if !ok {
+			continue
+		}
+		m := procMapping{Path: strings.Join(fields[5:], " ")}
+		var err1, err2, err3 error
+		m.Start, err1 = strconv.ParseUint(start, 16, 64)
+		m.Limit, err2 = strconv.ParseUint(limit, 16, 64)
+		m.Offset, err3 = strconv.ParseUint(fields[2], 16, 64)
+		if err1 != nil || err2 != nil || err3 != nil {
+			continue
+		}
+		maps = append(maps, m)
+	}
+	sort.Slice(maps, func(i, j int) bool { return maps[i].Start < maps[j].Start })
+	return maps
+}
+
+// elfBuildID returns the GNU build ID of the ELF file at path as hex
+func elfBuildID(path string) (string, error) {
+	f, err := elf.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	for _, s := range f.Sections {
+		if s.Type != elf.SHT_NOTE {
+			continue
+		}
+		data, err := s.Data()
+		if err != nil {
+			continue
+		}
+		// Notes are namesz, descsz and type, then the name and the
+		// description, each padded to 4 bytes
+		for len(data) >= 12 {
+			namesz, descsz, typ := f.ByteOrder.Uint32(data), f.ByteOrder.Uint32(data[4:]), f.ByteOrder.Uint32(data[8:])
+			nameEnd := 12 + (uint64(namesz)+3)&^3
+			descEnd := nameEnd + (uint64(descsz)+3)&^3
+			if descEnd > uint64(len(data)) {
+				break
+			}
+			if typ == 3 && string(data[12:12+namesz]) == "GNU\x00" { // NT_GNU_BUILD_ID
+				return hex.EncodeToString(data[nameEnd : nameEnd+uint64(descsz)]), nil
+			}
+			data = data[descEnd:]
+		}
+	}
+	return "", fmt.Errorf("%s has no build ID", path)
+}
+
+// processMaps resolves sampled addresses to the file mappings and build IDs
+// of the processes they were taken in, while those are still running
+type processMaps struct {
+	byPID    map[int][]procMapping
+	buildIDs map[fileID]string
+}
+
+// fileID identifies a mapped file by device and inode, which tells a
+// replaced binary from the one now at its path
+type fileID struct {
+	dev, ino uint64
+}
+
+func newProcessMaps() *processMaps {
+	return &processMaps{byPID: make(map[int][]procMapping), buildIDs: make(map[fileID]string)}
+}
+
+// lookup returns the mapping of pid holding addr, or nil when the process
+// is gone or addr is not in a file mapping
+func (pm *processMaps) lookup(pid int, addr uint64) *procMapping {
+	maps, ok := pm.byPID[pid]
+	if !ok {
+		data, err := os.ReadFile(filepath.Join(procRoot, strconv.Itoa(pid), "maps"))
+		if err == nil {
+			maps = parseProcMaps(data)
+		}
+		pm.byPID[pid] = maps
+	}
+	i := sort.Search(len(maps), func(i int) bool { return maps[i].Limit > addr })
+	if i < len(maps) && maps[i].Start <= addr {
+		return &maps[i]
+	}
+	return nil
+}
+
+// buildID returns the build ID of the file of m in pid, or "" when it has
+// none. The file is read through map_files, which still holds a binary that
+// was replaced on disk, and otherwise through the root of the process.
+func (pm *processMaps) buildID(pid int, m *procMapping) string {
+	proc := filepath.Join(procRoot, strconv.Itoa(pid))
+	for _, path := range []string{
+		filepath.Join(proc, "map_files", fmt.Sprintf("%x-%x", m.Start, m.Limit)),
+		filepath.Join(proc, "root", m.Path),
+	} {
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		var key fileID
+		if st, ok := info.Sys().(*syscall.Stat_t); ok {
+			key = fileID{uint64(st.Dev), st.Ino}
+			if id, ok := pm.buildIDs[key]; ok {
+				return id
+			}
+		}
+		id, err := elfBuildID(path)
+		if os.IsPermission(err) {
+			continue
+		}
+		if key != (fileID{}) {
+			pm.buildIDs[key] = id
+		}
+		return id
+	}
+	return ""
+}
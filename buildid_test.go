@@ -0,0 +1,93 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"testing"
+)
+
+const testProcMaps = `55d0c1a00000-55d0c1a40000 r--p 00000000 08:01 1234 /usr/bin/redis-server
+55d0c1a40000-55d0c1b80000 r-xp 00040000 08:01 1234 /usr/bin/redis-server
+55d0c1c00000-55d0c1c21000 rw-p 00000000 00:00 0 [heap]
+7f1a2c000000-7f1a2c028000 r--p 00000000 08:01 5678 /usr/lib/x86_64-linux-gnu/libc.so.6
+7f1a2c028000-7f1a2c1bd000 r-xp 00028000 08:01 5678 /usr/lib/x86_64-linux-gnu/libc.so.6
+7f1a2d000000-7f1a2d002000 r-xp 00000000 00:00 0 [vdso]
+7f1a2e000000-7f1a2e001000 r-xp 00000000 08:01 9012 /opt/app/lib with space.so
+`
+
+func TestParseProcMaps(t *testing.T) {
+	got := parseProcMaps([]byte(testProcMaps))
+	want := []procMapping{
+		{0x55d0c1a40000, 0x55d0c1b80000, 0x40000, "/usr/bin/redis-server"},
+		{0x7f1a2c028000, 0x7f1a2c1bd000, 0x28000, "/usr/lib/x86_64-linux-gnu/libc.so.6"},
+		{0x7f1a2e000000, 0x7f1a2e001000, 0, "/opt/app/lib with space.so"},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("parseProcMaps = %+v", got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("mapping %d = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestElfBuildID(t *testing.T) {
+	id, err := elfBuildID("/usr/bin/true")
+	if os.IsNotExist(err) {
+		t.Skip("no /usr/bin/true")
+	}
+	if err != nil {
+		t.Skipf("/usr/bin/true: %v", err)
+	}
+	if !regexp.MustCompile(`^[0-9a-f]{16,}$`).MatchString(id) {
+		t.Errorf("build ID = %q", id)
+	}
+
+	notELF := filepath.Join(t.TempDir(), "perf-42.map")
+	os.WriteFile(notELF, []byte("3ef414c0 398 LazyCompile:~main\n"), 0644)
+	if _, err := elfBuildID(notELF); err == nil {
+		t.Error("build ID of a perf map")
+	}
+}
+
+func TestBuildProfileMappings(t *testing.T) {
+	const pid = 4242
+	writeFakeProc(t, map[int]int{pid: 1})
+	pidDir := filepath.Join(procRoot, strconv.Itoa(pid))
+	maps := "55d0c1a40000-55d0c1b80000 r-xp 00040000 08:01 1234 /usr/bin/true\n"
+	if err := os.WriteFile(filepath.Join(pidDir, "maps"), []byte(maps), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("/", filepath.Join(pidDir, "root")); err != nil {
+		t.Fatal(err)
+	}
+	wantID, _ := elfBuildID("/usr/bin/true")
+
+	p := buildProfile([]perfSample{
+		{PID: pid, Stack: []perfFrame{
+			{Addr: 0x55d0c1a41000, Symbol: "main", DSO: "/usr/bin/true"},
+			{Addr: 0xffffffff81000000, Symbol: "do_syscall_64", DSO: "[kernel.kallsyms]"},
+		}},
+		// A process that exited keeps bare mappings
+		{PID: 4243, Stack: []perfFrame{{Addr: 0x55d0c1a41000, Symbol: "main", DSO: "/usr/bin/true"}}},
+	}, nil, newProcessMaps(), nil)
+	if len(p.Mapping) != 3 {
+		t.Fatalf("mappings = %+v", p.Mapping)
+	}
+	m := p.Sample[0].Location[0].Mapping
+	if m.File != "/usr/bin/true" || m.Start != 0x55d0c1a40000 || m.Limit != 0x55d0c1b80000 || m.Offset != 0x40000 || m.BuildID != wantID {
+		t.Errorf("mapping of the target = %+v, want build ID %s", m, wantID)
+	}
+	if m := p.Sample[0].Location[1].Mapping; m.Start != 0 || m.BuildID != "" {
+		t.Errorf("kernel mapping = %+v", m)
+	}
+	if m := p.Sample[1].Location[0].Mapping; m.Start != 0 || m.File != "/usr/bin/true" {
+		t.Errorf("mapping of an exited process = %+v", m)
+	}
+	if err := p.CheckValid(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"time"
+
+	"github.com/google/pprof/profile"
+)
+
+// writeBundle writes p as a gzipped tar archive holding the pprof profile,
+// its folded stacks and an SVG flamegraph, so all three show the same
+// samples
+func writeBundle(w io.Writer, meta profileMeta, p *profile.Profile) error {
+	modTime := time.Now()
+	if p.TimeNanos != 0 {
+		modTime = time.Unix(0, p.TimeNanos)
+	}
+
+	var pprof, folded, svg bytes.Buffer
+	if err := p.Write(&pprof); err != nil {
+		return err
+	}
+	stacks := profileToFolded(p)
+	if err := writeFolded(&folded, stacks); err != nil {
+		return err
+	}
+	if err := renderFlameGraph(&svg, flameTreeFromFolded(stacks), flameTitle(meta), false); err != nil {
+		return err
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	for _, entry := range []struct {
+		name string
+		data []byte
+	}{
+		{"profile" + profileExtension("pprof"), pprof.Bytes()},
+		{"profile" + profileExtension("folded"), folded.Bytes()},
+		{"flamegraph" + profileExtension("flamegraph"), svg.Bytes()},
+	} {
+		if err := writeTarFile(tw, entry.name, modTime, entry.data); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
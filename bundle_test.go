@@ -0,0 +1,66 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/pprof/profile"
+)
+
+func TestBundleFormat(t *testing.T) {
+	rr := httptest.NewRecorder()
+	handlePprof(rr, httptest.NewRequest("GET", "/debug/pprof/profile?pid=1234&seconds=5&test=true&format=bundle", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rr.Code, rr.Body.String())
+	}
+	if ct := rr.Header().Get("Content-Type"); ct != "application/gzip" {
+		t.Errorf("Content-Type %s", ct)
+	}
+	if cd := rr.Header().Get("Content-Disposition"); cd != "attachment; filename=profile-1234-5.tar.gz" {
+		t.Errorf("Content-Disposition %s", cd)
+	}
+
+	gz, err := gzip.NewReader(rr.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := make(map[string][]byte)
+	var names []string
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := io.ReadAll(tr)
+		files[hdr.Name] = data
+		names = append(names, hdr.Name)
+	}
+	if strings.Join(names, " ") != "profile.pb.gz profile.folded.txt flamegraph.svg" {
+		t.Fatalf("bundle holds %v", names)
+	}
+
+	p, err := profile.Parse(bytes.NewReader(files["profile.pb.gz"]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The three files describe the same samples
+	var folded bytes.Buffer
+	writeFolded(&folded, profileToFolded(p))
+	if folded.String() != string(files["profile.folded.txt"]) {
+		t.Errorf("folded stacks differ from the profile:\n%s", files["profile.folded.txt"])
+	}
+	svg := string(files["flamegraph.svg"])
+	if !strings.HasPrefix(svg, "<?xml") || !strings.Contains(svg, "PID 1234") {
+		t.Errorf("flamegraph = %.200s", svg)
+	}
+}
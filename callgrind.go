@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/google/pprof/profile"
+)
+
+// callgrindFunction is the cost of a function and of the calls it makes
+type callgrindFunction struct {
+	file string
+	self int64
+	// calls holds the inclusive cost and sample count of each callee
+	calls map[string]*callgrindCall
+}
+
+type callgrindCall struct {
+	count, inclusive int64
+}
+
+// callgrindNames compresses repeated file and function names into the (id)
+// references of the callgrind format
+type callgrindNames map[string]int
+
+func (n callgrindNames) ref(name string) string {
+	if id, ok := n[name]; ok {
+		return fmt.Sprintf("(%d)", id)
+	}
+	id := len(n) + 1
+	n[name] = id
+	return fmt.Sprintf("(%d) %s", id, name)
+}
+
+// writeCallgrind writes p in the callgrind format of KCachegrind and
+// QCacheGrind, with the samples of each function as its self cost and the
+// samples below each caller/callee pair as the inclusive cost of the call
+func writeCallgrind(w io.Writer, p *profile.Profile) error {
+	index := sampleIndex(p)
+	event := "samples"
+	if index >= 0 {
+		event = p.SampleType[index].Type
+	}
+
+	funcs := make(map[string]*callgrindFunction)
+	function := func(name, file string) *callgrindFunction {
+		f, ok := funcs[name]
+		if !ok {
+			f = &callgrindFunction{file: file, calls: make(map[string]*callgrindCall)}
+			funcs[name] = f
+		}
+		if f.file == "" {
+			f.file = file
+		}
+		return f
+	}
+	var total int64
+	for _, s := range p.Sample {
+		if index < 0 || s.Value[index] == 0 {
+			continue
+		}
+		v := s.Value[index]
+		total += v
+		stack, files := sampleFrames(s)
+		if len(stack) == 0 {
+			continue
+		}
+		function(stack[len(stack)-1], files[len(files)-1]).self += v
+		// A recursive call path counts once per sample, as in pprof
+		seen := make(map[[2]string]bool, len(stack))
+		for i := 1; i < len(stack); i++ {
+			caller := function(stack[i-1], files[i-1])
+			function(stack[i], files[i])
+			edge := [2]string{stack[i-1], stack[i]}
+			if seen[edge] {
+				continue
+			}
+			seen[edge] = true
+			c, ok := caller.calls[stack[i]]
+			if !ok {
+				c = &callgrindCall{}
+				caller.calls[stack[i]] = c
+			}
+			c.count++
+			c.inclusive += v
+		}
+	}
+
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "# callgrind format\nversion: 1\ncreator: bcc-exporter\npositions: line\nevents: %s\nsummary: %d\n", event, total)
+	files, fns := callgrindNames{}, callgrindNames{}
+	names := make([]string, 0, len(funcs))
+	for name := range funcs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		f := funcs[name]
+		fmt.Fprintf(bw, "\nfl=%s\nfn=%s\n0 %d\n", files.ref(callgrindFile(f.file)), fns.ref(name), f.self)
+		callees := make([]string, 0, len(f.calls))
+		for callee := range f.calls {
+			callees = append(callees, callee)
+		}
+		sort.Strings(callees)
+		for _, callee := range callees {
+			c := f.calls[callee]
+			fmt.Fprintf(bw, "cfl=%s\ncfn=%s\ncalls=%d 0\n0 %d\n", files.ref(callgrindFile(funcs[callee].file)), fns.ref(callee), c.count, c.inclusive)
+		}
+	}
+	return bw.Flush()
+}
+
+// callgrindFile names the source file of functions without one, which
+// KCachegrind groups together
+func callgrindFile(file string) string {
+	if file == "" {
+		return "???"
+	}
+	return file
+}
+
+// sampleFrames returns the frames of a sample from root to leaf, as
+// sampleStack does, together with their source files
+func sampleFrames(s *profile.Sample) (stack, files []string) {
+	for i := len(s.Location) - 1; i >= 0; i-- {
+		loc := s.Location[i]
+		if len(loc.Line) == 0 {
+			stack = append(stack, fmt.Sprintf("0x%x", loc.Address))
+			files = append(files, "")
+			continue
+		}
+		for j := len(loc.Line) - 1; j >= 0; j-- {
+			stack = append(stack, frameName(loc, loc.Line[j]))
+			file := ""
+			if fn := loc.Line[j].Function; fn != nil {
+				file = fn.Filename
+			}
+			files = append(files, file)
+		}
+	}
+	return stack, files
+}
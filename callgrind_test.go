@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWriteCallgrind(t *testing.T) {
+	p, err := parseProfileData([]byte("main;processCommand;dictFind 6\nmain;aeMain;epoll_wait 3\nmain;processCommand 1\nmain;sort;sort 4\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out strings.Builder
+	if err := writeCallgrind(&out, p); err != nil {
+		t.Fatal(err)
+	}
+	want := `# callgrind format
+version: 1
+creator: bcc-exporter
+positions: line
+events: samples
+summary: 14
+
+fl=(1) ???
+fn=(1) aeMain
+0 0
+cfl=(1)
+cfn=(2) epoll_wait
+calls=1 0
+0 3
+
+fl=(1)
+fn=(3) dictFind
+0 6
+
+fl=(1)
+fn=(2)
+0 3
+
+fl=(1)
+fn=(4) main
+0 0
+cfl=(1)
+cfn=(1)
+calls=1 0
+0 3
+cfl=(1)
+cfn=(5) processCommand
+calls=2 0
+0 7
+cfl=(1)
+cfn=(6) sort
+calls=1 0
+0 4
+
+fl=(1)
+fn=(5)
+0 1
+cfl=(1)
+cfn=(3)
+calls=1 0
+0 6
+
+fl=(1)
+fn=(6)
+0 4
+cfl=(1)
+cfn=(6)
+calls=1 0
+0 4
+`
+	if out.String() != want {
+		t.Errorf("callgrind output:\n%s\nwant:\n%s", out.String(), want)
+	}
+}
+
+func TestCallgrindFormat(t *testing.T) {
+	rr := httptest.NewRecorder()
+	handlePprof(rr, httptest.NewRequest("GET", "/debug/pprof/profile?pid=1234&seconds=5&test=true&format=callgrind", nil))
+	if rr.Code != http.StatusOK || !strings.HasPrefix(rr.Body.String(), "# callgrind format\n") {
+		t.Fatalf("status %d: %s", rr.Code, rr.Body.String())
+	}
+	if cd := rr.Header().Get("Content-Disposition"); cd != "attachment; filename=callgrind.out.1234" {
+		t.Errorf("Content-Disposition %s", cd)
+	}
+
+	rr = httptest.NewRecorder()
+	handlePprof(rr, httptest.NewRequest("GET", "/debug/pprof/profile?pid=1234&seconds=5&test=true&format=callgrind&nodecount=5", nil))
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("nodecount with callgrind: %d", rr.Code)
+	}
+}
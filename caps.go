@@ -0,0 +1,313 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// Linux capability numbers, see capability(7)
+const (
+	capSysPtrace   = 19
+	capSysAdmin    = 21
+	capSysResource = 24
+	capPerfmon     = 38 // Linux 5.8+, CAP_SYS_ADMIN before
+	capBPF         = 39 // Linux 5.8+, CAP_SYS_ADMIN before
+)
+
+// capNames names the capabilities the exporter uses
+var capNames = map[int]string{
+	capSysPtrace:   "cap_sys_ptrace",
+	capSysAdmin:    "cap_sys_admin",
+	capSysResource: "cap_sys_resource",
+	capPerfmon:     "cap_perfmon",
+	capBPF:         "cap_bpf",
+}
+
+// capSet is a capability bit mask as found in /proc/<pid>/status
+type capSet uint64
+
+func (c capSet) has(cap int) bool {
+	return c&(1<<uint(cap)) != 0
+}
+
+// canTrace reports whether c allows perf events on any process
+func (c capSet) canTrace() bool {
+	return c.has(capPerfmon) || c.has(capSysAdmin)
+}
+
+// canBPF reports whether c allows loading the BPF programs of BCC and bpftrace
+func (c capSet) canBPF() bool {
+	return (c.has(capBPF) && c.has(capPerfmon)) || c.has(capSysAdmin)
+}
+
+// exporterCaps holds the effective capabilities of the exporter; until they
+// are read nothing is refused up front
+var exporterCaps = ^capSet(0)
+
+// parseCapStatus returns the effective and permitted sets of a
+// /proc/<pid>/status file
+func parseCapStatus(status string) (eff, prm capSet, err error) {
+	found := 0
+	for _, line := range strings.Split(status, "\n") {
+		key, value, ok := strings.Cut(line, ":")
+		if !ok || (key != "CapEff" && key != "CapPrm") {
+			continue
+		}
+		mask, err := strconv.ParseUint(strings.TrimSpace(value), 16, 64)
+		if err != nil {
+			return 0, 0, fmt.Errorf("malformed %s line %q", key, line)
+		}
+		if key == "CapEff" {
+			eff = capSet(mask)
+		} else {
+			prm = capSet(mask)
+		}
+		found++
+	}
+	if found != 2 {
+		return 0, 0, fmt.Errorf("no CapEff and CapPrm lines")
+	}
+	return eff, prm, nil
+}
+
+// capabilityReport describes what the capabilities in c allow
+func capabilityReport(c capSet) []string {
+	var report []string
+	for _, cap := range []int{capPerfmon, capBPF, capSysPtrace, capSysAdmin} {
+		state := "missing"
+		if c.has(cap) {
+			state = "present"
+		}
+		report = append(report, fmt.Sprintf("%s: %s", strings.ToUpper(capNames[cap]), state))
+	}
+	if !c.canTrace() {
+		report = append(report, "perf profiles are limited by kernel.perf_event_paranoid and to processes of the exporter's user")
+	}
+	if !c.canBPF() {
+		report = append(report, "BCC, bpftrace and py-spy need root through -escalation")
+	}
+	return report
+}
+
+// perfEventParanoid returns kernel.perf_event_paranoid, 2 when unreadable
+func perfEventParanoid() int {
+	data, err := os.ReadFile(filepath.Join(procRoot, "sys", "kernel", "perf_event_paranoid"))
+	if err != nil {
+		return 2
+	}
+	level, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 2
+	}
+	return level
+}
+
+// perfNotPermitted returns why perf cannot capture opts with capabilities c
+// and the given perf_event_paranoid level, or nil when it can
+func perfNotPermitted(opts profileOptions, c capSet, paranoid int) error {
+	if c.canTrace() {
+		return nil
+	}
+	if paranoid >= 3 {
+		return fmt.Errorf("kernel.perf_event_paranoid is %d, which disables perf for processes without CAP_PERFMON (run bcc-exporter setcap)", paranoid)
+	}
+	if paranoid >= 2 && opts.Stacks != "user" {
+		return fmt.Errorf("kernel stacks need CAP_PERFMON or kernel.perf_event_paranoid below 2; use stacks=user or run bcc-exporter setcap")
+	}
+
+	// Without CAP_PERFMON perf must pass the same checks as ptrace
+	if c.has(capSysPtrace) {
+		return nil
+	}
+	pid, _ := strconv.Atoi(opts.PID)
+	if uid, err := readUID(pid); err == nil && uid != os.Getuid() {
+		return fmt.Errorf("PID %s belongs to user %d; profiling other users' processes needs CAP_PERFMON or CAP_SYS_PTRACE (run bcc-exporter setcap)", opts.PID, uid)
+	}
+	return nil
+}
+
+// checkPerfPermitted is perfNotPermitted for the exporter itself
+func checkPerfPermitted(opts profileOptions) error {
+	return perfNotPermitted(opts, exporterCaps, perfEventParanoid())
+}
+
+// ambientCaps are passed on to the tools the exporter runs, so file
+// capabilities set by bcc-exporter setcap reach perf
+var ambientCaps []uintptr
+
+// capHeader and capData are the arguments of the capget and capset syscalls
+type capHeader struct {
+	version uint32
+	pid     int32
+}
+
+type capData struct {
+	effective   uint32
+	permitted   uint32
+	inheritable uint32
+}
+
+const linuxCapabilityVersion3 = 0x20080522
+
+// initCapabilities reads the capabilities of the exporter, logs what they
+// allow and makes the useful ones inheritable so commands can receive them
+// as ambient capabilities
+func initCapabilities() {
+	data, err := os.ReadFile("/proc/self/status")
+	if err != nil {
+		log.Printf("Failed to read capabilities: %v", err)
+		return
+	}
+	eff, prm, err := parseCapStatus(string(data))
+	if err != nil {
+		log.Printf("Failed to read capabilities: %v", err)
+		return
+	}
+	exporterCaps = eff
+	for _, line := range capabilityReport(eff) {
+		log.Printf("Capabilities: %s", line)
+	}
+
+	// Root passes everything on already
+	if os.Geteuid() == 0 {
+		return
+	}
+
+	hdr := capHeader{version: linuxCapabilityVersion3}
+	var caps [2]capData
+	if _, _, errno := syscall.Syscall(syscall.SYS_CAPGET, uintptr(unsafe.Pointer(&hdr)), uintptr(unsafe.Pointer(&caps[0])), 0); errno != 0 {
+		log.Printf("capget failed: %v", errno)
+		return
+	}
+	var ambient []uintptr
+	for _, cap := range []int{capPerfmon, capBPF, capSysPtrace, capSysAdmin, capSysResource} {
+		if prm.has(cap) {
+			caps[cap/32].inheritable |= 1 << uint(cap%32)
+			ambient = append(ambient, uintptr(cap))
+		}
+	}
+	if len(ambient) == 0 {
+		return
+	}
+	if _, _, errno := syscall.Syscall(syscall.SYS_CAPSET, uintptr(unsafe.Pointer(&hdr)), uintptr(unsafe.Pointer(&caps[0])), 0); errno != 0 {
+		log.Printf("capset failed, tools will run without capabilities: %v", errno)
+		return
+	}
+	ambientCaps = ambient
+}
+
+// newCommand is exec.Command passing the exporter's capabilities on
+func newCommand(name string, args ...string) *exec.Cmd {
+	cmd := exec.Command(name, args...)
+	if len(ambientCaps) > 0 {
+		cmd.SysProcAttr = &syscall.SysProcAttr{AmbientCaps: ambientCaps}
+	}
+	return cmd
+}
+
+// setcapSpec returns the file capabilities that let the exporter profile
+// without root; kernels before 5.8 know neither CAP_PERFMON nor CAP_BPF
+func setcapSpec(lastCap int) string {
+	caps := []int{capSysPtrace, capSysResource}
+	if lastCap >= capBPF {
+		caps = append(caps, capPerfmon, capBPF)
+	} else {
+		caps = append(caps, capSysAdmin)
+	}
+	names := make([]string, len(caps))
+	for i, cap := range caps {
+		names[i] = capNames[cap]
+	}
+	// Inheritable so the exporter can hand them to perf as ambient caps
+	return strings.Join(names, ",") + "+eip"
+}
+
+// runSetcap implements the setcap subcommand, which applies setcapSpec to
+// the exporter binary (or the path given as argument)
+func runSetcap(args []string) error {
+	path, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if len(args) > 0 {
+		path = args[0]
+	}
+	if path, err = filepath.EvalSymlinks(path); err != nil {
+		return err
+	}
+
+	lastCap := 0
+	if data, err := os.ReadFile("/proc/sys/kernel/cap_last_cap"); err == nil {
+		lastCap, _ = strconv.Atoi(strings.TrimSpace(string(data)))
+	}
+	spec := setcapSpec(lastCap)
+
+	cmd := exec.Command("setcap", spec, path)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("setcap %s %s: %v (run as root; setcap is in libcap2-bin)", spec, path, err)
+	}
+	fmt.Printf("Applied %s to %s\n", spec, path)
+	return nil
+}
+
+// escalation is the -escalation method used to run BCC, bpftrace and py-spy
+// as root: "auto", "none", "sudo", "pkexec" or "doas"
+var escalation = "auto"
+
+// validEscalation reports whether method is a supported -escalation value
+func validEscalation(method string) bool {
+	switch method {
+	case "auto", "none", "sudo", "pkexec", "doas":
+		return true
+	}
+	return false
+}
+
+// escalationMethod resolves "auto": no escalation when the exporter runs as
+// root or hands BPF capabilities to its tools, sudo otherwise
+func escalationMethod() string {
+	if escalation != "auto" {
+		return escalation
+	}
+	if os.Geteuid() == 0 || (len(ambientCaps) > 0 && exporterCaps.canBPF()) {
+		return "none"
+	}
+	return "sudo"
+}
+
+// privilegedCommand runs args as root using the -escalation method, killing
+// it when ctx is done
+func privilegedCommand(ctx context.Context, args ...string) *exec.Cmd {
+	if method := escalationMethod(); method != "none" {
+		args = append([]string{method}, args...)
+	}
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	if len(ambientCaps) > 0 {
+		cmd.SysProcAttr = &syscall.SysProcAttr{AmbientCaps: ambientCaps}
+	}
+	return cmd
+}
+
+// userCommand runs args as user uid and group gid: through sudo -u with
+// -escalation sudo, otherwise by switching credentials directly, which
+// needs root
+func userCommand(uid, gid int, args ...string) *exec.Cmd {
+	if escalationMethod() == "sudo" {
+		return exec.Command("sudo", append([]string{"-u", fmt.Sprintf("#%d", uid)}, args...)...)
+	}
+	cmd := exec.Command(args[0], args[1:]...)
+	if uid != os.Getuid() {
+		cmd.SysProcAttr = &syscall.SysProcAttr{Credential: &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}}
+	}
+	return cmd
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestParseCapStatus(t *testing.T) {
+	status := "Name:\tbcc-exporter\nCapInh:\t0000000000000000\nCapPrm:\t000000c000080000\nCapEff:\t000000c000080000\nCapBnd:\t000001ffffffffff\n"
+	eff, prm, err := parseCapStatus(status)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if eff != prm {
+		t.Errorf("eff %x != prm %x", eff, prm)
+	}
+	for _, cap := range []int{capPerfmon, capBPF, capSysPtrace} {
+		if !eff.has(cap) {
+			t.Errorf("missing %s", capNames[cap])
+		}
+	}
+	if eff.has(capSysAdmin) || !eff.canTrace() || !eff.canBPF() {
+		t.Errorf("unexpected capabilities %x", eff)
+	}
+
+	if _, _, err := parseCapStatus("Name:\tbcc-exporter\n"); err == nil {
+		t.Error("parseCapStatus succeeded without capability lines")
+	}
+}
+
+func TestPerfNotPermitted(t *testing.T) {
+	writeFakeProc(t, map[int]int{42: 1, 43: 1})
+	for pid, uid := range map[string]int{"42": os.Getuid(), "43": os.Getuid() + 1} {
+		status := "Name:\tredis-server\nUid:\t" + strconv.Itoa(uid) + "\t0\t0\t0\n"
+		if err := os.WriteFile(filepath.Join(procRoot, pid, "status"), []byte(status), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	perfmon := capSet(1 << capPerfmon)
+	ptrace := capSet(1 << capSysPtrace)
+
+	tests := []struct {
+		name     string
+		opts     profileOptions
+		caps     capSet
+		paranoid int
+		wantErr  string
+	}{
+		{"perfmon", profileOptions{PID: "43", Stacks: "both"}, perfmon, 4, ""},
+		{"paranoid 3", profileOptions{PID: "42", Stacks: "user"}, 0, 3, "perf_event_paranoid is 3"},
+		{"kernel stacks", profileOptions{PID: "42", Stacks: "both"}, 0, 2, "stacks=user"},
+		{"own process", profileOptions{PID: "42", Stacks: "user"}, 0, 2, ""},
+		{"other user", profileOptions{PID: "43", Stacks: "user"}, 0, 2, "belongs to user"},
+		{"other user with ptrace", profileOptions{PID: "43", Stacks: "both"}, ptrace, 1, ""},
+	}
+	for _, tt := range tests {
+		err := perfNotPermitted(tt.opts, tt.caps, tt.paranoid)
+		switch {
+		case tt.wantErr == "" && err != nil:
+			t.Errorf("%s: unexpected error %v", tt.name, err)
+		case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+			t.Errorf("%s: error = %v, want %q", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestSetcapSpec(t *testing.T) {
+	if got, want := setcapSpec(40), "cap_sys_ptrace,cap_sys_resource,cap_perfmon,cap_bpf+eip"; got != want {
+		t.Errorf("setcapSpec(40) = %q, want %q", got, want)
+	}
+	// Kernels before 5.8
+	if got, want := setcapSpec(37), "cap_sys_ptrace,cap_sys_resource,cap_sys_admin+eip"; got != want {
+		t.Errorf("setcapSpec(37) = %q, want %q", got, want)
+	}
+}
+
+// setEscalation sets -escalation for the duration of the test
+func setEscalation(t *testing.T, method string) {
+	orig := escalation
+	escalation = method
+	t.Cleanup(func() { escalation = orig })
+}
+
+func TestPrivilegedCommand(t *testing.T) {
+	tests := []struct {
+		method string
+		want   []string
+	}{
+		{"none", []string{"profile-bpfcc", "-p", "42"}},
+		{"sudo", []string{"sudo", "profile-bpfcc", "-p", "42"}},
+		{"pkexec", []string{"pkexec", "profile-bpfcc", "-p", "42"}},
+		{"doas", []string{"doas", "profile-bpfcc", "-p", "42"}},
+	}
+	for _, tt := range tests {
+		setEscalation(t, tt.method)
+		cmd := privilegedCommand(context.Background(), "profile-bpfcc", "-p", "42")
+		if !reflect.DeepEqual(cmd.Args, tt.want) {
+			t.Errorf("-escalation %s: %q, want %q", tt.method, cmd.Args, tt.want)
+		}
+	}
+
+	if validEscalation("su") {
+		t.Error("validEscalation accepted su")
+	}
+}
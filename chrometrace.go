@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// traceEvent is one event of the Trace Event Format read by chrome://tracing
+// and Perfetto
+type traceEvent struct {
+	Name  string            `json:"name"`
+	Phase string            `json:"ph"`
+	Cat   string            `json:"cat,omitempty"`
+	TS    float64           `json:"ts"` // microseconds
+	Dur   float64           `json:"dur,omitempty"`
+	PID   int               `json:"pid"`
+	TID   int               `json:"tid"`
+	Args  map[string]string `json:"args,omitempty"`
+}
+
+// chromeTrace is a trace in the JSON Object Format of the Trace Event Format
+type chromeTrace struct {
+	TraceEvents     []traceEvent      `json:"traceEvents"`
+	DisplayTimeUnit string            `json:"displayTimeUnit"`
+	OtherData       map[string]string `json:"otherData,omitempty"`
+}
+
+// traceThread is the flame chart of one thread while it is being built
+type traceThread struct {
+	pid, tid int
+	stack    []perfFrame // root first
+	starts   []float64   // when each frame of stack was first sampled
+	last     float64     // time of the thread's latest sample
+}
+
+// buildChromeTrace lays out perf samples as a flame chart per thread: a
+// frame on the stack of consecutive samples becomes one complete event
+// spanning them. A thread not sampled for more than two sampling intervals
+// (in seconds) closes its stack, so the gaps show when it was off CPU.
+func buildChromeTrace(samples []perfSample, interval float64) chromeTrace {
+	trace := chromeTrace{TraceEvents: []traceEvent{}, DisplayTimeUnit: "ms"}
+	if len(samples) == 0 {
+		return trace
+	}
+	samples = append([]perfSample(nil), samples...)
+	sort.SliceStable(samples, func(i, j int) bool { return samples[i].Time < samples[j].Time })
+	// perf timestamps are seconds since boot; the trace starts at the first
+	// sample
+	origin := samples[0].Time
+	trace.OtherData = map[string]string{"start_since_boot": fmt.Sprintf("%.6f", origin)}
+	micros := func(t float64) float64 { return (t - origin) * 1e6 }
+
+	// pop closes the frames of th from depth on at end
+	pop := func(th *traceThread, depth int, end float64) {
+		for i := len(th.stack) - 1; i >= depth; i-- {
+			trace.TraceEvents = append(trace.TraceEvents, traceEvent{
+				Name: th.stack[i].Symbol, Phase: "X", Cat: "cpu",
+				TS: micros(th.starts[i]), Dur: micros(end) - micros(th.starts[i]),
+				PID: th.pid, TID: th.tid,
+				Args: map[string]string{"dso": th.stack[i].DSO},
+			})
+		}
+		th.stack, th.starts = th.stack[:depth], th.starts[:depth]
+	}
+
+	threads := make(map[int]*traceThread)
+	var order []*traceThread
+	processes := make(map[int]bool)
+	for _, s := range samples {
+		if !processes[s.PID] {
+			processes[s.PID] = true
+			trace.TraceEvents = append(trace.TraceEvents, traceEvent{
+				Name: "process_name", Phase: "M", PID: s.PID, TID: s.PID,
+				Args: map[string]string{"name": fmt.Sprintf("%s %d", s.Comm, s.PID)},
+			})
+		}
+		th, ok := threads[s.TID]
+		if !ok {
+			th = &traceThread{pid: s.PID, tid: s.TID}
+			threads[s.TID] = th
+			order = append(order, th)
+			trace.TraceEvents = append(trace.TraceEvents, traceEvent{
+				Name: "thread_name", Phase: "M", PID: s.PID, TID: s.TID,
+				Args: map[string]string{"name": fmt.Sprintf("%s %d", s.Comm, s.TID)},
+			})
+		}
+		if s.Time-th.last > 2*interval {
+			pop(th, 0, th.last+interval)
+		}
+		// Keep the frames the sample shares with the open stack
+		depth := 0
+		for depth < len(th.stack) && depth < len(s.Stack) && th.stack[depth] == s.Stack[len(s.Stack)-1-depth] {
+			depth++
+		}
+		pop(th, depth, s.Time)
+		for i := len(s.Stack) - 1 - depth; i >= 0; i-- {
+			th.stack = append(th.stack, s.Stack[i])
+			th.starts = append(th.starts, s.Time)
+		}
+		th.last = s.Time
+	}
+	for _, th := range order {
+		pop(th, 0, th.last+interval)
+	}
+	return trace
+}
+
+// captureChromeTrace runs perf record for opts inside dir and returns the
+// path of a Trace Event JSON timeline of its samples
+func captureChromeTrace(opts profileOptions, dir string) (string, error) {
+	if err := checkPerf(); err != nil {
+		return "", &captureError{http.StatusInternalServerError, err.Error()}
+	}
+
+	perfDataPath, err := recordPerf(opts, dir)
+	if err != nil {
+		return "", err
+	}
+
+	log.Printf("Running perf script for PID %s", opts.PID)
+	stage := opts.Span.child("perf script")
+	cmd := newCommand("perf", perfScriptArgs(perfDataPath)...)
+	cmd.Env = symbolEnv()
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err = runJob(cmd, jobGrace)
+	stage.done(err)
+	if _, ok := err.(*captureError); ok {
+		return "", err
+	} else if err != nil {
+		return "", &captureError{http.StatusInternalServerError, fmt.Sprintf("perf script failed: %v\nStderr: %s", err, stderr.String())}
+	}
+
+	samples, err := parsePerfScript(&stdout)
+	if err != nil {
+		return "", &captureError{http.StatusInternalServerError, fmt.Sprintf("Failed to parse perf script output: %v", err)}
+	}
+	data, err := json.Marshal(buildChromeTrace(samples, 1/float64(opts.frequency())))
+	if err != nil {
+		return "", err
+	}
+	tracePath := filepath.Join(dir, "trace.json")
+	if err := os.WriteFile(tracePath, data, 0600); err != nil {
+		return "", err
+	}
+	return tracePath, nil
+}
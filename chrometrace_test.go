@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestBuildChromeTrace(t *testing.T) {
+	frames := func(names ...string) []perfFrame {
+		var stack []perfFrame
+		for _, name := range names {
+			stack = append(stack, perfFrame{Symbol: name, DSO: "/usr/bin/redis-server"})
+		}
+		return stack
+	}
+	samples := []perfSample{
+		{Comm: "redis-server", PID: 1, TID: 1, Time: 100.000, Stack: frames("aeApiPoll", "aeMain")},
+		{Comm: "io_thd_1", PID: 1, TID: 2, Time: 100.001, Stack: frames("read", "IOThreadMain")},
+		{Comm: "redis-server", PID: 1, TID: 1, Time: 100.010, Stack: frames("lookupCommand", "processCommand", "aeMain")},
+		{Comm: "redis-server", PID: 1, TID: 1, Time: 100.020, Stack: frames("processCommand", "aeMain")},
+		// Off CPU for longer than two intervals
+		{Comm: "redis-server", PID: 1, TID: 1, Time: 100.100, Stack: frames("aeMain")},
+	}
+	trace := buildChromeTrace(samples, 0.010)
+	if trace.OtherData["start_since_boot"] != "100.000000" {
+		t.Errorf("otherData = %v", trace.OtherData)
+	}
+
+	type span struct {
+		name    string
+		tid     int
+		ts, dur float64
+	}
+	var spans []span
+	var threads []string
+	for _, e := range trace.TraceEvents {
+		switch e.Phase {
+		case "X":
+			// Round away float noise of the microsecond conversion
+			spans = append(spans, span{e.Name, e.TID, float64(int64(e.TS + 0.5)), float64(int64(e.Dur + 0.5))})
+		case "M":
+			threads = append(threads, e.Name+"="+e.Args["name"])
+		}
+	}
+	want := []span{
+		{"aeApiPoll", 1, 0, 10000},
+		{"lookupCommand", 1, 10000, 10000},
+		{"processCommand", 1, 10000, 20000},
+		{"aeMain", 1, 0, 30000},
+		{"aeMain", 1, 100000, 10000},
+		{"read", 2, 1000, 10000},
+		{"IOThreadMain", 2, 1000, 10000},
+	}
+	if len(spans) != len(want) {
+		t.Fatalf("spans = %v, want %v", spans, want)
+	}
+	for i := range want {
+		if spans[i] != want[i] {
+			t.Errorf("span %d = %v, want %v", i, spans[i], want[i])
+		}
+	}
+	if strings.Join(threads, ",") != "process_name=redis-server 1,thread_name=redis-server 1,thread_name=io_thd_1 2" {
+		t.Errorf("metadata = %v", threads)
+	}
+
+	if empty := buildChromeTrace(nil, 0.001); empty.TraceEvents == nil || len(empty.TraceEvents) != 0 {
+		t.Errorf("empty trace = %+v", empty)
+	}
+}
+
+func TestChromeTraceFormat(t *testing.T) {
+	rr := httptest.NewRecorder()
+	handlePprof(rr, httptest.NewRequest("GET", "/debug/pprof/profile?pid=1234&seconds=5&test=true&format=chrometrace", nil))
+	if rr.Code != http.StatusOK || rr.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("status %d %s: %s", rr.Code, rr.Header().Get("Content-Type"), rr.Body.String())
+	}
+	var trace chromeTrace
+	if err := json.Unmarshal(rr.Body.Bytes(), &trace); err != nil || len(trace.TraceEvents) == 0 {
+		t.Errorf("trace %s: %v", rr.Body.String(), err)
+	}
+}
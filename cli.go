@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"bcc-exporter/pkg/client"
+)
+
+// profileExtensions are the file extensions of the formats the profile
+// subcommand can fetch
+var profileExtensions = map[string]string{
+	"pprof":        "pb.gz",
+	"folded":       "folded",
+	"perfscript":   "perfscript.txt",
+	"perfdata":     "perf.data",
+	"perfarchive":  "tar",
+	"speedscope":   "speedscope.json",
+	"flamegraph":   "svg",
+	"top":          "top.txt",
+	"summary-json": "summary.json",
+	"callgrind":    "callgrind",
+	"chrometrace":  "trace.json",
+	"html":         "html",
+	"bundle":       "tar.gz",
+}
+
+// repeatedFlag collects the values of a flag given several times
+type repeatedFlag []string
+
+func (f *repeatedFlag) String() string { return strings.Join(*f, ",") }
+
+func (f *repeatedFlag) Set(v string) error {
+	*f = append(*f, v)
+	return nil
+}
+
+// openProfile opens path in go tool pprof's web UI or speedscope
+func openProfile(tool, path string) error {
+	var cmd *exec.Cmd
+	switch tool {
+	case "pprof":
+		cmd = exec.Command("go", "tool", "pprof", "-http=localhost:0", path)
+	case "speedscope":
+		cmd = exec.Command("speedscope", path)
+	}
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s: %v", strings.Join(cmd.Args, " "), err)
+	}
+	return nil
+}
+
+// runProfileCommand implements the profile subcommand, which captures a
+// profile on a remote exporter, or downloads a background capture once it
+// is stored, and writes it to a file
+func runProfileCommand(args []string, stdout, stderr io.Writer) error {
+	fs := flag.NewFlagSet("profile", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	defaultURL := os.Getenv("BCC_EXPORTER_URL")
+	if defaultURL == "" {
+		defaultURL = "http://localhost:8080"
+	}
+	var (
+		rawURL    = fs.String("url", defaultURL, "URL of the exporter, with its -http-prefix (default $BCC_EXPORTER_URL or http://localhost:8080)")
+		user      = fs.String("user", "admin", "User for basic authentication")
+		passFile  = fs.String("password-file", "", "File holding the password for basic authentication (default $BCC_EXPORTER_PASSWORD)")
+		tokenFile = fs.String("token-file", "", "File holding a bearer token, e.g. an OIDC ID token (default $BCC_EXPORTER_TOKEN)")
+		pid       = fs.Int("pid", 0, "PID of the process to profile")
+		redisPort = fs.Int("redis-port", 0, "Profile the process listening on this port instead of -pid")
+		container = fs.String("container", "", "Container ID -pid is given in")
+		seconds   = fs.Int("seconds", 30, "Capture duration")
+		format    = fs.String("format", "pprof", "pprof, folded, perfscript, perfdata, perfarchive, speedscope or flamegraph")
+		id        = fs.String("id", "", "Wait for the background capture with this profile ID and download it, instead of starting a capture")
+		output    = fs.String("o", "", "File to write the profile to, - for stdout (default named after the target and time)")
+		open      = fs.String("open", "", "Open the profile in pprof (go tool pprof -http) or speedscope once written")
+		labels    repeatedFlag
+		params    repeatedFlag
+	)
+	fs.Var(&labels, "label", "name:value label of the capture; repeat for several")
+	fs.Var(&params, "param", "Other capture parameter as name=value, e.g. frequency=99; repeat for several")
+	fs.Usage = func() {
+		fmt.Fprintf(stderr, "Usage: bcc-exporter profile [flags]\n\nCaptures a profile on a remote exporter and writes it to a file.\n\n")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("unexpected arguments: %s", strings.Join(fs.Args(), " "))
+	}
+
+	ext, ok := profileExtensions[*format]
+	if !ok {
+		return fmt.Errorf("invalid -format %q", *format)
+	}
+	if *open != "" && *open != "pprof" && *open != "speedscope" {
+		return fmt.Errorf("invalid -open %q: must be pprof or speedscope", *open)
+	}
+	if *open != "" && *output == "-" {
+		return fmt.Errorf("-open needs a file, not -o -")
+	}
+	req := client.CaptureRequest{
+		Target:  client.Target{PID: *pid, RedisPort: *redisPort, Container: *container},
+		Seconds: *seconds,
+		Format:  *format,
+		Params:  url.Values{"label": labels},
+	}
+	if *id == "" {
+		if (*pid == 0) == (*redisPort == 0) {
+			return fmt.Errorf("one of -pid, -redis-port or -id is required")
+		}
+		for _, param := range params {
+			name, value, ok := strings.Cut(param, "=")
+			if !ok || name == "" {
+				return fmt.Errorf("invalid -param %q: must be name=value", param)
+			}
+			req.Params.Add(name, value)
+		}
+	}
+
+	c, err := client.New(*rawURL)
+	if err != nil {
+		return err
+	}
+	if !strings.Contains(*rawURL, "@") {
+		c.Username = *user
+	}
+	if c.Password == "" {
+		c.Password = os.Getenv("BCC_EXPORTER_PASSWORD")
+	}
+	if *passFile != "" {
+		data, err := os.ReadFile(*passFile)
+		if err != nil {
+			return err
+		}
+		c.Password = strings.TrimSpace(string(data))
+	}
+	c.Token = os.Getenv("BCC_EXPORTER_TOKEN")
+	if *tokenFile != "" {
+		data, err := os.ReadFile(*tokenFile)
+		if err != nil {
+			return err
+		}
+		c.Token = strings.TrimSpace(string(data))
+	}
+	c.RetryLimit = 10 * time.Minute
+	c.OnRetry = func(err *client.Error, wait time.Duration) {
+		fmt.Fprintf(stderr, "Exporter busy (%s), retrying in %s\n", err.Message, wait)
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	var p *client.Profile
+	target := *id
+	if *id != "" {
+		err = c.Follow(ctx, *id, func(e client.Event) {
+			if e.Event == "progress" {
+				fmt.Fprintf(stderr, "Recording: %d/%ds\n", e.Elapsed, e.Seconds)
+			} else {
+				fmt.Fprintf(stderr, "Capture %s: %s\n", *id, e.Event)
+			}
+		})
+		if err == nil {
+			p, err = c.Download(ctx, *id)
+		}
+	} else {
+		desc := fmt.Sprintf("PID %d", *pid)
+		target = strconv.Itoa(*pid)
+		if *redisPort != 0 {
+			desc = fmt.Sprintf("Redis port %d", *redisPort)
+			target = fmt.Sprintf("port%d", *redisPort)
+		}
+		fmt.Fprintf(stderr, "Capturing %s for %ds on %s\n", desc, *seconds, c.BaseURL)
+		p, err = c.Capture(ctx, req)
+	}
+	var apiErr *client.Error
+	if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusUnauthorized {
+		return fmt.Errorf("%v: set BCC_EXPORTER_PASSWORD, -password-file or BCC_EXPORTER_TOKEN", err)
+	} else if err != nil {
+		return err
+	}
+	defer p.Close()
+	for _, warning := range p.Warnings {
+		fmt.Fprintf(stderr, "Warning: %s\n", warning)
+	}
+
+	path := *output
+	if path == "" {
+		if p.ContentType == "application/x-tar" {
+			ext = "tar"
+		}
+		path = fmt.Sprintf("profile-%s-%s.%s", target, time.Now().Format("20060102-150405"), ext)
+	}
+	if path == "-" {
+		_, err := io.Copy(stdout, p)
+		return err
+	}
+	n, err := writeProfileFile(path, p)
+	if err != nil {
+		return err
+	}
+	msg := fmt.Sprintf("Wrote %s (%s)", path, formatSize(n))
+	if p.ID != "" && *id == "" {
+		msg += ", stored as " + p.ID
+	}
+	fmt.Fprintln(stderr, msg)
+	if *open != "" {
+		return openProfile(*open, path)
+	}
+	return nil
+}
+
+// writeProfileFile copies the downloaded profile from r to path
+func writeProfileFile(path string, r io.Reader) (int64, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(f, r)
+	if err != nil {
+		f.Close()
+		return n, fmt.Errorf("downloading the profile: %v", err)
+	}
+	return n, f.Close()
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestProfileCommandArgs(t *testing.T) {
+	for name, args := range map[string][]string{
+		"no target":   {},
+		"two targets": {"-pid", "1", "-redis-port", "6379"},
+		"bad format":  {"-pid", "1", "-format", "png"},
+		"bad open":    {"-pid", "1", "-open", "firefox"},
+		"open stdout": {"-pid", "1", "-open", "pprof", "-o", "-"},
+		"bad param":   {"-pid", "1", "-param", "frequency"},
+		"bad url":     {"-pid", "1", "-url", "ftp://host"},
+		"extra args":  {"-pid", "1", "now"},
+	} {
+		var stderr bytes.Buffer
+		if err := runProfileCommand(args, &bytes.Buffer{}, &stderr); err == nil {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+}
+
+func TestProfileCommand(t *testing.T) {
+	busy := true
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, ok := r.BasicAuth(); !ok || user != "admin" || pass != "s3cr3t" {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/profiling/debug/pprof/profile":
+			if busy {
+				busy = false
+				w.Header().Set("Retry-After", "1")
+				http.Error(w, "All capture slots are busy", http.StatusServiceUnavailable)
+				return
+			}
+			q := r.URL.Query()
+			if q.Get("redis_port") != "6379" || q.Get("seconds") != "5" || q.Get("frequency") != "99" || q.Get("label") != "incident:INC-1" || q.Get("format") != "perfscript" {
+				t.Errorf("capture query %s", r.URL.RawQuery)
+			}
+			w.Header().Set("X-Profile-ID", "3f9a1c0e7b2d4856")
+			fmt.Fprint(w, "perf script output")
+		case "/profiling/api/v1/profiles/0123456789abcdef/events":
+			if r.Header.Get("Last-Event-ID") == "" {
+				// Break off after the first event, as a proxy would
+				fmt.Fprint(w, "id: 1\nevent: recording\ndata: {\"event\":\"recording\",\"seconds\":10}\n\n")
+				return
+			}
+			if r.Header.Get("Last-Event-ID") != "1" {
+				t.Errorf("resumed after %q", r.Header.Get("Last-Event-ID"))
+			}
+			fmt.Fprint(w, "id: 2\nevent: done\ndata: {\"event\":\"done\",\"samples\":42}\n\n")
+		case "/profiling/api/v1/profiles/0123456789abcdef":
+			fmt.Fprint(w, "stored profile")
+		case "/profiling/api/v1/profiles/fedcba9876543210/events":
+			fmt.Fprint(w, "id: 1\nevent: failed\ndata: {\"event\":\"failed\",\"message\":\"perf exited with status 1\"}\n\n")
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	passFile := filepath.Join(dir, "password")
+	if err := os.WriteFile(passFile, []byte("s3cr3t\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("BCC_EXPORTER_URL", srv.URL+"/profiling/")
+	t.Setenv("BCC_EXPORTER_PASSWORD", "")
+	t.Setenv("BCC_EXPORTER_TOKEN", "")
+
+	out := filepath.Join(dir, "redis.txt")
+	var stderr bytes.Buffer
+	err := runProfileCommand([]string{"-password-file", passFile, "-redis-port", "6379", "-seconds", "5", "-format", "perfscript", "-label", "incident:INC-1", "-param", "frequency=99", "-o", out}, &bytes.Buffer{}, &stderr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(out); string(data) != "perf script output" {
+		t.Errorf("wrote %q", data)
+	}
+	if !strings.Contains(stderr.String(), "retrying in 1s") || !strings.Contains(stderr.String(), "stored as 3f9a1c0e7b2d4856") {
+		t.Errorf("stderr = %q", stderr.String())
+	}
+
+	var stdout bytes.Buffer
+	t.Setenv("BCC_EXPORTER_URL", strings.Replace(srv.URL, "http://", "http://admin:s3cr3t@", 1)+"/profiling")
+	if err := runProfileCommand([]string{"-id", "0123456789abcdef", "-o", "-"}, &stdout, &bytes.Buffer{}); err != nil {
+		t.Fatal(err)
+	}
+	if stdout.String() != "stored profile" {
+		t.Errorf("downloaded %q", stdout.String())
+	}
+
+	err = runProfileCommand([]string{"-id", "fedcba9876543210", "-o", "-"}, &bytes.Buffer{}, &bytes.Buffer{})
+	if err == nil || !strings.Contains(err.Error(), "perf exited with status 1") {
+		t.Errorf("failed capture: %v", err)
+	}
+
+	t.Setenv("BCC_EXPORTER_URL", srv.URL+"/profiling")
+	err = runProfileCommand([]string{"-pid", "1", "-o", "-"}, &bytes.Buffer{}, &bytes.Buffer{})
+	if err == nil || !strings.Contains(err.Error(), "BCC_EXPORTER_PASSWORD") {
+		t.Errorf("unauthenticated capture: %v", err)
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// compressibleTypes are the media types of the responses compressed for
+// clients that accept it. pprof profiles are gzipped already and perf.data
+// is mostly binary, so archives are sent as they are.
+var compressibleTypes = []string{"text/plain", "application/json", "image/svg+xml", "text/html"}
+
+// minCompressSize leaves responses of a known, smaller length uncompressed
+const minCompressSize = 1024
+
+// zstdWindowSize keeps zstd responses decodable by browsers, which refuse
+// windows above 8 MiB
+const zstdWindowSize = 8 << 20
+
+// flushWriteCloser is a compressor
+type flushWriteCloser interface {
+	io.WriteCloser
+	Flush() error
+}
+
+var (
+	gzipWriters = sync.Pool{New: func() interface{} { return gzip.NewWriter(nil) }}
+	zstdWriters = sync.Pool{New: func() interface{} {
+		enc, _ := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1), zstd.WithWindowSize(zstdWindowSize))
+		return enc
+	}}
+)
+
+// newCompressor returns a pooled compressor of encoding writing to w, and
+// the function returning it to its pool after Close
+func newCompressor(encoding string, w io.Writer) (flushWriteCloser, func()) {
+	if encoding == "zstd" {
+		enc := zstdWriters.Get().(*zstd.Encoder)
+		enc.Reset(w)
+		return enc, func() { zstdWriters.Put(enc) }
+	}
+	gz := gzipWriters.Get().(*gzip.Writer)
+	gz.Reset(w)
+	return gz, func() { gzipWriters.Put(gz) }
+}
+
+// negotiateEncoding picks the response encoding from an Accept-Encoding
+// header: zstd or gzip, whichever has the higher weight with zstd winning
+// ties, or "" to send the response as it is
+func negotiateEncoding(accept string) string {
+	weights := make(map[string]float64)
+	for _, part := range strings.Split(accept, ",") {
+		coding, params, _ := strings.Cut(part, ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			var err error
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		weights[coding] = q
+	}
+	if q, ok := weights["*"]; ok {
+		for _, coding := range []string{"zstd", "gzip"} {
+			if _, listed := weights[coding]; !listed {
+				weights[coding] = q
+			}
+		}
+	}
+
+	best, bestQ := "", 0.0
+	for _, coding := range []string{"zstd", "gzip"} {
+		if q := weights[coding]; q > bestQ {
+			best, bestQ = coding, q
+		}
+	}
+	return best
+}
+
+// compressWriter compresses the body of a response when its status, type
+// and length allow once the handler starts writing it
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+
+	decided bool
+	enc     flushWriteCloser
+	release func()
+}
+
+// Unwrap lets http.ResponseController hijack the response
+func (w *compressWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// start decides whether to compress a response with status
+func (w *compressWriter) start(status int) {
+	w.decided = true
+	h := w.Header()
+	switch {
+	case status < http.StatusOK, status == http.StatusNoContent, status == http.StatusNotModified, status == http.StatusPartialContent:
+		return
+	case h.Get("Content-Encoding") != "":
+		return
+	case h.Get("Accept-Ranges") != "":
+		// Byte ranges refer to the uncompressed body: compressing the
+		// full response would break resumed downloads
+		return
+	}
+	mediaType, _, _ := mime.ParseMediaType(h.Get("Content-Type"))
+	if !slices.Contains(compressibleTypes, mediaType) {
+		return
+	}
+	h.Add("Vary", "Accept-Encoding")
+	if w.encoding == "" {
+		return
+	}
+	if n, err := strconv.Atoi(h.Get("Content-Length")); err == nil && n < minCompressSize {
+		return
+	}
+	h.Del("Content-Length")
+	h.Set("Content-Encoding", w.encoding)
+	w.enc, w.release = newCompressor(w.encoding, w.ResponseWriter)
+}
+
+func (w *compressWriter) WriteHeader(status int) {
+	if !w.decided {
+		w.start(status)
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *compressWriter) Write(p []byte) (int, error) {
+	if !w.decided {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.enc == nil {
+		return w.ResponseWriter.Write(p)
+	}
+	return w.enc.Write(p)
+}
+
+// FlushError sends what was compressed so far, for streamed responses
+func (w *compressWriter) FlushError() error {
+	if w.enc != nil {
+		if err := w.enc.Flush(); err != nil {
+			return err
+		}
+	}
+	return http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// close finishes the compressed body
+func (w *compressWriter) close() {
+	if w.enc == nil {
+		return
+	}
+	w.enc.Close()
+	w.release()
+	w.enc = nil
+}
+
+// compressed compresses the text and JSON responses of handler with gzip or
+// zstd, as the client's Accept-Encoding allows
+func compressed(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		cw := &compressWriter{ResponseWriter: w, encoding: negotiateEncoding(r.Header.Get("Accept-Encoding"))}
+		defer cw.close()
+		handler.ServeHTTP(cw, r)
+	})
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   string
+	}{
+		{"", ""},
+		{"gzip", "gzip"},
+		{"gzip, deflate, br, zstd", "zstd"},
+		{"zstd;q=0.5, gzip", "gzip"},
+		{"GZIP;q=0.8", "gzip"},
+		{"gzip;q=0, zstd;q=0", ""},
+		{"*", "zstd"},
+		{"*;q=0.5, gzip", "gzip"},
+		{"identity", ""},
+		{"gzip;q=bogus", ""},
+	}
+	for _, tt := range tests {
+		if got := negotiateEncoding(tt.accept); got != tt.want {
+			t.Errorf("negotiateEncoding(%q) = %q, want %q", tt.accept, got, tt.want)
+		}
+	}
+}
+
+// decode returns the body of rr after undoing its Content-Encoding
+func decode(t *testing.T, rr *httptest.ResponseRecorder) string {
+	t.Helper()
+	var r io.Reader = rr.Body
+	switch rr.Header().Get("Content-Encoding") {
+	case "gzip":
+		gz, err := gzip.NewReader(rr.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r = gz
+	case "zstd":
+		dec, err := zstd.NewReader(rr.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer dec.Close()
+		r = dec
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestCompressed(t *testing.T) {
+	folded := strings.Repeat("main;aeMain;aeProcessEvents;readQueryFromClient 12\n", 1000)
+	handler := compressed(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/folded":
+			w.Header().Set("Content-Type", "text/plain")
+			io.WriteString(w, folded)
+		case "/pprof":
+			w.Header().Set("Content-Type", "application/octet-stream")
+			io.WriteString(w, folded)
+		case "/small":
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Content-Length", "2")
+			io.WriteString(w, "{}")
+		case "/download":
+			w.Header().Set("Content-Type", "text/plain")
+			w.Header().Set("Accept-Ranges", "bytes")
+			io.WriteString(w, folded)
+		case "/error":
+			http.Error(w, strings.Repeat("perf failed ", 200), http.StatusInternalServerError)
+		}
+	}))
+
+	tests := []struct {
+		path, accept string
+		wantEncoding string
+		wantVary     bool
+	}{
+		{"/folded", "gzip", "gzip", true},
+		{"/folded", "gzip, zstd", "zstd", true},
+		{"/folded", "", "", true},
+		{"/pprof", "gzip", "", false},
+		{"/small", "gzip", "", true},
+		{"/download", "gzip", "", false},
+		{"/error", "gzip", "gzip", true},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", tt.path, nil)
+		req.Header.Set("Accept-Encoding", tt.accept)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		if got := rr.Header().Get("Content-Encoding"); got != tt.wantEncoding {
+			t.Errorf("%s with %q: Content-Encoding %q, want %q", tt.path, tt.accept, got, tt.wantEncoding)
+		}
+		if got := rr.Header().Get("Vary") == "Accept-Encoding"; got != tt.wantVary {
+			t.Errorf("%s with %q: Vary %q", tt.path, tt.accept, rr.Header().Get("Vary"))
+		}
+		if tt.path == "/folded" {
+			if tt.wantEncoding != "" && rr.Body.Len() > len(folded)/10 {
+				t.Errorf("%s with %q: %d bytes for %d", tt.path, tt.accept, rr.Body.Len(), len(folded))
+			}
+			if body := decode(t, rr); body != folded {
+				t.Errorf("%s with %q: body does not round trip", tt.path, tt.accept)
+			}
+		}
+	}
+}
+
+func TestCompressedStream(t *testing.T) {
+	next := make(chan struct{})
+	srv := httptest.NewServer(compressed(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, "main;run 1\n")
+		http.NewResponseController(w).Flush()
+		<-next
+		io.WriteString(w, "main;run 2\n")
+	})))
+	defer srv.Close()
+
+	req, _ := http.NewRequest("GET", srv.URL, nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Encoding") != "gzip" {
+		t.Fatalf("Content-Encoding = %q", resp.Header.Get("Content-Encoding"))
+	}
+
+	// The first chunk can be decoded before the handler writes the second
+	gz, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := make([]byte, len("main;run 1\n"))
+	if _, err := io.ReadFull(gz, first); err != nil || string(first) != "main;run 1\n" {
+		t.Fatalf("first chunk %q, %v", first, err)
+	}
+	close(next)
+	rest, err := io.ReadAll(gz)
+	if err != nil || string(rest) != "main;run 2\n" {
+		t.Errorf("rest %q, %v", rest, err)
+	}
+}
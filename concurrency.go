@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// concurrencyConfig is the concurrency section of the configuration file,
+// which bounds how many captures run at once
+type concurrencyConfig struct {
+	// MaxCaptures is how many captures may run on the host at once;
+	// unlimited when 0
+	MaxCaptures int `json:"max_captures"`
+	// MaxPerTarget is how many captures may profile one process at once;
+	// unlimited when 0
+	MaxPerTarget int `json:"max_per_target"`
+	// MaxQueue is how many requests with queue=true may wait for a capture
+	// slot (default 16)
+	MaxQueue int `json:"max_queue"`
+	// QueueTimeout is how long a queued request waits for its slot before
+	// it gives up (default 5m)
+	QueueTimeout duration `json:"queue_timeout"`
+}
+
+func (c *concurrencyConfig) validate() error {
+	if c.MaxCaptures < 0 || c.MaxPerTarget < 0 || c.MaxQueue < 0 || c.QueueTimeout < 0 {
+		return fmt.Errorf("limits must not be negative")
+	}
+	if c.MaxQueue == 0 {
+		c.MaxQueue = 16
+	}
+	if c.QueueTimeout == 0 {
+		c.QueueTimeout = duration(5 * time.Minute)
+	}
+	return nil
+}
+
+// currentConcurrency returns the concurrency limits in effect; none before
+// the server state is set up
+func currentConcurrency() concurrencyConfig {
+	if s := state.Load(); s != nil {
+		return s.cfg.Concurrency
+	}
+	return concurrencyConfig{}
+}
+
+// slotHolder is a capture of target, expected to run for expected and to
+// end at end once it started
+type slotHolder struct {
+	target   string
+	expected time.Duration
+	end      time.Time
+}
+
+// slotWaiter is a queued request for a capture slot
+type slotWaiter struct {
+	holder *slotHolder
+	ready  chan struct{}
+}
+
+// busyError is returned when a capture slot is not available
+type busyError struct {
+	Message string
+	// RetryAfter is when a slot is expected to free up
+	RetryAfter time.Duration
+	// Position is the place the request has, or would have had, in the queue
+	Position int
+}
+
+func (e *busyError) Error() string {
+	return e.Message
+}
+
+// captureSlots hands out a slot to each running capture within the
+// concurrency limits. Slots freed go to queued requests in order, skipping
+// those whose target is still busy.
+type captureSlots struct {
+	now     func() time.Time
+	mu      sync.Mutex
+	holders []*slotHolder
+	waiters []*slotWaiter
+}
+
+// slots are the capture slots of the exporter. They outlive reloads, so
+// captures running under the previous limits still count.
+var slots = &captureSlots{now: time.Now}
+
+// blocking returns the holders that keep a capture of target from starting
+// under cfg, or nil when it may start
+func (s *captureSlots) blocking(cfg concurrencyConfig, target string) []*slotHolder {
+	if cfg.MaxCaptures > 0 && len(s.holders) >= cfg.MaxCaptures {
+		return s.holders
+	}
+	if target == "" || cfg.MaxPerTarget == 0 {
+		return nil
+	}
+	var same []*slotHolder
+	for _, h := range s.holders {
+		if h.target == target {
+			same = append(same, h)
+		}
+	}
+	if len(same) >= cfg.MaxPerTarget {
+		return same
+	}
+	return nil
+}
+
+// retryAfter estimates how long until one of holders ends
+func (s *captureSlots) retryAfter(holders []*slotHolder) time.Duration {
+	first := holders[0].end
+	for _, h := range holders[1:] {
+		if h.end.Before(first) {
+			first = h.end
+		}
+	}
+	return max(first.Sub(s.now()), time.Second)
+}
+
+// acquire takes a slot for a capture of target, which is expected to run
+// for expected; target is "" for captures of the whole host. When no slot
+// is free it returns a *busyError, or waits for one when queue is set. The
+// returned function gives the slot back.
+func (s *captureSlots) acquire(ctx context.Context, target string, expected time.Duration, queue bool) (func(), error) {
+	cfg := currentConcurrency()
+	s.mu.Lock()
+	holder := &slotHolder{target: target, expected: expected, end: s.now().Add(expected)}
+	blocked := s.blocking(cfg, target)
+	if blocked == nil {
+		s.holders = append(s.holders, holder)
+		s.mu.Unlock()
+		return func() { s.release(holder) }, nil
+	}
+	busy := &busyError{RetryAfter: s.retryAfter(blocked), Position: len(s.waiters) + 1}
+	if !queue || len(s.waiters) >= cfg.MaxQueue {
+		s.mu.Unlock()
+		busy.Message = s.busyMessage(cfg, target, queue)
+		return nil, busy
+	}
+	w := &slotWaiter{holder: holder, ready: make(chan struct{})}
+	s.waiters = append(s.waiters, w)
+	s.mu.Unlock()
+
+	timeout := time.NewTimer(time.Duration(cfg.QueueTimeout))
+	defer timeout.Stop()
+	select {
+	case <-w.ready:
+		return func() { s.release(holder) }, nil
+	case <-timeout.C:
+		busy.Message = fmt.Sprintf("No capture slot became free within %s", time.Duration(cfg.QueueTimeout))
+	case <-ctx.Done():
+		busy.Message = "Client went away while queued"
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if i := slices.Index(s.waiters, w); i >= 0 {
+		s.waiters = slices.Delete(s.waiters, i, i+1)
+		return nil, busy
+	}
+	// The slot was handed over as the wait ended
+	return func() { s.release(holder) }, nil
+}
+
+// busyMessage explains why a capture of target cannot start
+func (s *captureSlots) busyMessage(cfg concurrencyConfig, target string, queue bool) string {
+	msg := fmt.Sprintf("%d captures are running, the most concurrency.max_captures allows", len(s.holders))
+	if cfg.MaxCaptures == 0 || len(s.holders) < cfg.MaxCaptures {
+		msg = fmt.Sprintf("PID %s is being profiled by as many captures as concurrency.max_per_target allows", target)
+	}
+	if queue {
+		return msg + fmt.Sprintf(", and %d requests are queued already", len(s.waiters))
+	}
+	return msg + ". Retry later, or set queue=true to wait for a slot"
+}
+
+// release gives back the slot of holder and hands the free slots to the
+// queued requests that fit
+func (s *captureSlots) release(holder *slotHolder) {
+	cfg := currentConcurrency()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if i := slices.Index(s.holders, holder); i >= 0 {
+		s.holders = slices.Delete(s.holders, i, i+1)
+	}
+	for i := 0; i < len(s.waiters); {
+		w := s.waiters[i]
+		if s.blocking(cfg, w.holder.target) != nil {
+			i++
+			continue
+		}
+		w.holder.end = s.now().Add(w.holder.expected)
+		s.holders = append(s.holders, w.holder)
+		s.waiters = slices.Delete(s.waiters, i, i+1)
+		close(w.ready)
+	}
+}
+
+// expectedDuration estimates how long the capture requested by r runs from
+// its seconds, snapshots and delay parameters
+func expectedDuration(r *http.Request) time.Duration {
+	q := r.URL.Query()
+	seconds, _ := strconv.Atoi(q.Get("seconds"))
+	snapshots, _ := strconv.Atoi(q.Get("snapshots"))
+	delay, _ := strconv.Atoi(q.Get("delay"))
+	return time.Duration(seconds*max(snapshots, 1)+delay) * time.Second
+}
+
+// takeCaptureSlot takes a capture slot for target, the PID the request r
+// profiles or "" for the whole host. When none is free it answers 503 with
+// Retry-After and X-Queue-Position and returns false.
+func takeCaptureSlot(w http.ResponseWriter, r *http.Request, target string) (func(), bool) {
+	queue := r.URL.Query().Get("queue") == "true"
+	release, err := slots.acquire(r.Context(), target, expectedDuration(r), queue)
+	if err != nil {
+		busy := err.(*busyError)
+		log.Printf("Refused capture request from %s: %v", r.RemoteAddr, err)
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(busy.RetryAfter.Seconds()))))
+		w.Header().Set("X-Queue-Position", strconv.Itoa(busy.Position))
+		http.Error(w, busy.Message, http.StatusServiceUnavailable)
+		return nil, false
+	}
+	return release, true
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// setConcurrency puts cfg in effect for the duration of the test, with
+// fresh capture slots whose clock stands still
+func setConcurrency(t *testing.T, cfg concurrencyConfig) *captureSlots {
+	t.Helper()
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+	origState, origSlots := state.Load(), slots
+	t.Cleanup(func() {
+		state.Store(origState)
+		slots = origSlots
+	})
+	state.Store(&serverState{cfg: &config{Concurrency: cfg}})
+	now := time.Now()
+	slots = &captureSlots{now: func() time.Time { return now }}
+	return slots
+}
+
+func TestConcurrencyConfigDefaults(t *testing.T) {
+	var cfg concurrencyConfig
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.MaxQueue != 16 || time.Duration(cfg.QueueTimeout) != 5*time.Minute {
+		t.Errorf("defaults = %+v", cfg)
+	}
+	cfg = concurrencyConfig{MaxCaptures: -1}
+	if err := cfg.validate(); err == nil {
+		t.Error("negative max_captures accepted")
+	}
+}
+
+func TestCaptureSlotsLimits(t *testing.T) {
+	s := setConcurrency(t, concurrencyConfig{MaxCaptures: 3, MaxPerTarget: 1})
+	ctx := context.Background()
+
+	release, err := s.acquire(ctx, "42", 30*time.Second, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.acquire(ctx, "42", 10*time.Second, false)
+	busy, ok := err.(*busyError)
+	if !ok || busy.RetryAfter != 30*time.Second || busy.Position != 1 {
+		t.Fatalf("second capture of the same target: %#v", err)
+	}
+	if _, err := s.acquire(ctx, "43", 10*time.Second, false); err != nil {
+		t.Errorf("capture of another target: %v", err)
+	}
+	if _, err := s.acquire(ctx, "", 20*time.Second, false); err != nil {
+		t.Errorf("capture of the whole host: %v", err)
+	}
+	// max_captures reached: the capture ending first frees a slot
+	_, err = s.acquire(ctx, "44", 10*time.Second, false)
+	if busy, ok := err.(*busyError); !ok || busy.RetryAfter != 10*time.Second {
+		t.Fatalf("capture over max_captures: %#v", err)
+	}
+
+	release()
+	if _, err := s.acquire(ctx, "42", 10*time.Second, false); err != nil {
+		t.Errorf("capture after release: %v", err)
+	}
+}
+
+func TestCaptureSlotsQueue(t *testing.T) {
+	s := setConcurrency(t, concurrencyConfig{MaxCaptures: 1, MaxQueue: 1})
+	ctx := context.Background()
+	release, err := s.acquire(ctx, "42", time.Second, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	granted := make(chan func())
+	go func() {
+		release, err := s.acquire(ctx, "43", time.Second, true)
+		if err != nil {
+			t.Error(err)
+		}
+		granted <- release
+	}()
+	for queued := 0; queued == 0; {
+		s.mu.Lock()
+		queued = len(s.waiters)
+		s.mu.Unlock()
+	}
+
+	// The queue is full
+	_, err = s.acquire(ctx, "44", time.Second, true)
+	if busy, ok := err.(*busyError); !ok || busy.Position != 2 {
+		t.Fatalf("request over max_queue: %#v", err)
+	}
+
+	release()
+	select {
+	case release := <-granted:
+		release()
+	case <-time.After(5 * time.Second):
+		t.Fatal("queued request did not get the freed slot")
+	}
+	if len(s.holders) != 0 || len(s.waiters) != 0 {
+		t.Errorf("slots left: %d holders, %d waiters", len(s.holders), len(s.waiters))
+	}
+}
+
+func TestCaptureSlotsQueueAbandoned(t *testing.T) {
+	s := setConcurrency(t, concurrencyConfig{MaxCaptures: 1, QueueTimeout: duration(10 * time.Millisecond)})
+	if _, err := s.acquire(context.Background(), "42", time.Second, false); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.acquire(context.Background(), "43", time.Second, true); err == nil {
+		t.Error("queued request got a slot that was never freed")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := s.acquire(ctx, "43", time.Second, true); err == nil {
+		t.Error("request of a client that went away got a slot")
+	}
+	if len(s.waiters) != 0 {
+		t.Errorf("%d requests left in the queue", len(s.waiters))
+	}
+}
+
+func TestTakeCaptureSlot(t *testing.T) {
+	s := setConcurrency(t, concurrencyConfig{MaxPerTarget: 1})
+	if _, err := s.acquire(context.Background(), "42", 90*time.Second, false); err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	if _, ok := takeCaptureSlot(rr, httptest.NewRequest("GET", "/debug/pprof/profile?pid=42&seconds=10", nil), "42"); ok {
+		t.Fatal("took a slot of a busy target")
+	}
+	if rr.Code != http.StatusServiceUnavailable || rr.Header().Get("Retry-After") != "90" || rr.Header().Get("X-Queue-Position") != "1" {
+		t.Errorf("busy response = %d %v", rr.Code, rr.Header())
+	}
+
+	release, ok := takeCaptureSlot(httptest.NewRecorder(), httptest.NewRequest("GET", "/debug/pprof/profile?pid=43&seconds=10", nil), "43")
+	if !ok {
+		t.Fatal("no slot for an idle target")
+	}
+	release()
+}
+
+func TestExpectedDuration(t *testing.T) {
+	for query, want := range map[string]time.Duration{
+		"seconds=10":                     10 * time.Second,
+		"seconds=10&snapshots=3&delay=5": 35 * time.Second,
+		"seconds=bad":                    0,
+	} {
+		r := httptest.NewRequest("GET", "/debug/pprof/profile?"+query, nil)
+		if got := expectedDuration(r); got != want {
+			t.Errorf("expectedDuration(%s) = %s, want %s", query, got, want)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// config is the optional JSON configuration file given with -config
+type config struct {
+	Watchdog      watchdogConfig      `json:"watchdog"`
+	Alertmanager  alertmanagerConfig  `json:"alertmanager"`
+	RedisWatch    redisWatchConfig    `json:"redis_watch"`
+	Redis         redisCredentials    `json:"redis"`
+	BpftraceUser  userBpftraceConfig  `json:"bpftrace_user"`
+	AsyncProfiler asyncProfilerConfig `json:"async_profiler"`
+	Debuginfod    debuginfodConfig    `json:"debuginfod"`
+	TargetPolicy  targetPolicy        `json:"target_policy"`
+	RateLimit     rateLimitConfig     `json:"rate_limit"`
+	OIDC          oidcConfig          `json:"oidc"`
+	Audit         auditConfig         `json:"audit"`
+	CORS          corsConfig          `json:"cors"`
+	Tracing       tracingConfig       `json:"tracing"`
+	TopFunctions  topFunctionsConfig  `json:"top_functions"`
+	Limits        limitsConfig        `json:"limits"`
+	Concurrency   concurrencyConfig   `json:"concurrency"`
+	S3            s3Config            `json:"s3"`
+	Storage       storageConfig       `json:"storage"`
+	Webhooks      webhooksConfig      `json:"webhooks"`
+	Slack         slackConfig         `json:"slack"`
+	Quota         quotaConfig         `json:"quota"`
+	Signing       signingConfig       `json:"signing"`
+	Fanout        fanoutConfig        `json:"fanout"`
+	GrafanaCloud  grafanaCloudConfig  `json:"grafana_cloud"`
+	Consul        consulConfig        `json:"consul"`
+	Kubernetes    kubernetesConfig    `json:"kubernetes"`
+	Labels        map[string]string   `json:"labels"`
+}
+
+// duration is a time.Duration that unmarshals from strings such as "10s"
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string such as \"10s\": %v", err)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// byteSize is a size in bytes written as a string such as "512M" or a number
+type byteSize int64
+
+func (b *byteSize) UnmarshalJSON(data []byte) error {
+	var n int64
+	if err := json.Unmarshal(data, &n); err == nil {
+		*b = byteSize(n)
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("size must be a string such as \"512M\" or a number of bytes: %v", err)
+	}
+	v, err := parseByteSize(s)
+	if err != nil {
+		return err
+	}
+	*b = byteSize(v)
+	return nil
+}
+
+// loadConfig reads and validates the configuration file at path; an empty
+// path yields the defaults
+func loadConfig(path string) (*config, error) {
+	var cfg config
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(data, &cfg); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+
+	if err := cfg.Watchdog.validate(); err != nil {
+		return nil, fmt.Errorf("%s: watchdog: %v", path, err)
+	}
+	if err := cfg.Alertmanager.validate(); err != nil {
+		return nil, fmt.Errorf("%s: alertmanager: %v", path, err)
+	}
+	if err := cfg.Redis.validate(); err != nil {
+		return nil, fmt.Errorf("%s: redis: %v", path, err)
+	}
+	if err := cfg.RedisWatch.validate(); err != nil {
+		return nil, fmt.Errorf("%s: redis_watch: %v", path, err)
+	}
+	if err := cfg.BpftraceUser.validate(); err != nil {
+		return nil, fmt.Errorf("%s: bpftrace_user: %v", path, err)
+	}
+	if err := cfg.AsyncProfiler.validate(); err != nil {
+		return nil, fmt.Errorf("%s: async_profiler: %v", path, err)
+	}
+	if err := cfg.Debuginfod.validate(); err != nil {
+		return nil, fmt.Errorf("%s: debuginfod: %v", path, err)
+	}
+	if err := cfg.TargetPolicy.validate(); err != nil {
+		return nil, fmt.Errorf("%s: target_policy: %v", path, err)
+	}
+	if err := cfg.RateLimit.validate(); err != nil {
+		return nil, fmt.Errorf("%s: rate_limit: %v", path, err)
+	}
+	if err := cfg.OIDC.validate(); err != nil {
+		return nil, fmt.Errorf("%s: oidc: %v", path, err)
+	}
+	if err := cfg.Audit.validate(); err != nil {
+		return nil, fmt.Errorf("%s: audit: %v", path, err)
+	}
+	if err := cfg.CORS.validate(); err != nil {
+		return nil, fmt.Errorf("%s: cors: %v", path, err)
+	}
+	if err := cfg.Tracing.validate(); err != nil {
+		return nil, fmt.Errorf("%s: tracing: %v", path, err)
+	}
+	if err := cfg.TopFunctions.validate(); err != nil {
+		return nil, fmt.Errorf("%s: top_functions: %v", path, err)
+	}
+	if err := cfg.Limits.validate(); err != nil {
+		return nil, fmt.Errorf("%s: limits: %v", path, err)
+	}
+	if err := cfg.Concurrency.validate(); err != nil {
+		return nil, fmt.Errorf("%s: concurrency: %v", path, err)
+	}
+	if err := cfg.S3.validate(); err != nil {
+		return nil, fmt.Errorf("%s: s3: %v", path, err)
+	}
+	if err := cfg.Storage.validate(); err != nil {
+		return nil, fmt.Errorf("%s: storage: %v", path, err)
+	}
+	if err := cfg.Webhooks.validate(); err != nil {
+		return nil, fmt.Errorf("%s: webhooks: %v", path, err)
+	}
+	if err := cfg.Slack.validate(); err != nil {
+		return nil, fmt.Errorf("%s: slack: %v", path, err)
+	}
+	if err := cfg.Quota.validate(); err != nil {
+		return nil, fmt.Errorf("%s: quota: %v", path, err)
+	}
+	if err := cfg.Signing.validate(); err != nil {
+		return nil, fmt.Errorf("%s: signing: %v", path, err)
+	}
+	if err := cfg.Fanout.validate(); err != nil {
+		return nil, fmt.Errorf("%s: fanout: %v", path, err)
+	}
+	if err := cfg.GrafanaCloud.validate(); err != nil {
+		return nil, fmt.Errorf("%s: grafana_cloud: %v", path, err)
+	}
+	if err := cfg.Consul.validate(); err != nil {
+		return nil, fmt.Errorf("%s: consul: %v", path, err)
+	}
+	if err := cfg.Kubernetes.validate(); err != nil {
+		return nil, fmt.Errorf("%s: kubernetes: %v", path, err)
+	}
+	if err := validateLabels(cfg.Labels); err != nil {
+		return nil, fmt.Errorf("%s: labels: %v", path, err)
+	}
+	return &cfg, nil
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"reflect"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// consulConfig is the consul section of the configuration file: the
+// exporter registers itself as a service of the local Consul agent
+type consulConfig struct {
+	// Address of the Consul agent, e.g. http://127.0.0.1:8500; registration
+	// is disabled without it
+	Address string `json:"address"`
+	// Token is the ACL token; Token, TokenFile and TokenEnv work like the
+	// Redis password settings
+	Token     string `json:"token,omitempty"`
+	TokenFile string `json:"token_file,omitempty"`
+	TokenEnv  string `json:"token_env,omitempty"`
+	// Service is the service name (default bcc-exporter) and ID the
+	// service ID (default the service name and the hostname)
+	Service string `json:"service"`
+	ID      string `json:"id"`
+	// ServiceAddress is the address other hosts reach the exporter at
+	// (default the address of the agent's node)
+	ServiceAddress string `json:"service_address,omitempty"`
+	// Role is the role of the host, registered as a role=<role> tag, e.g.
+	// primary or replica
+	Role string            `json:"role,omitempty"`
+	Tags []string          `json:"tags,omitempty"`
+	Meta map[string]string `json:"meta,omitempty"`
+	// CheckURL is the URL the agent checks the health of the exporter at
+	// (default /-/healthy on the service address or 127.0.0.1)
+	CheckURL      string   `json:"check_url,omitempty"`
+	CheckInterval duration `json:"check_interval"`
+	// DeregisterAfter removes the service once its check has been critical
+	// that long (default 10m)
+	DeregisterAfter duration `json:"deregister_after"`
+	// RefreshInterval is how often the Redis ports are discovered again
+	// to update the tags (default 1m)
+	RefreshInterval duration `json:"refresh_interval"`
+}
+
+func (c *consulConfig) validate() error {
+	if c.Address == "" {
+		return nil
+	}
+	if !strings.Contains(c.Address, "://") {
+		c.Address = "http://" + c.Address
+	}
+	if u, err := url.Parse(c.Address); err != nil || u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("address must be host:port or an http(s) URL")
+	}
+	c.Address = strings.TrimSuffix(c.Address, "/")
+	token, err := resolveSecret(c.Token, c.TokenFile, c.TokenEnv)
+	if err != nil {
+		return fmt.Errorf("token: %v", err)
+	}
+	c.Token = token
+	if c.Service == "" {
+		c.Service = "bcc-exporter"
+	}
+	if c.ID == "" {
+		hostname, _ := os.Hostname()
+		c.ID = c.Service + "-" + hostname
+	}
+	for _, tag := range c.Tags {
+		if strings.HasPrefix(tag, "role=") || strings.HasPrefix(tag, "redis_port=") {
+			return fmt.Errorf("tag %q is set by the exporter", tag)
+		}
+	}
+	if c.CheckURL != "" {
+		if u, err := url.Parse(c.CheckURL); err != nil || u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+			return fmt.Errorf("check_url is not a URL")
+		}
+	}
+	if c.CheckInterval == 0 {
+		c.CheckInterval = duration(10 * time.Second)
+	}
+	if c.DeregisterAfter == 0 {
+		c.DeregisterAfter = duration(10 * time.Minute)
+	}
+	if c.RefreshInterval == 0 {
+		c.RefreshInterval = duration(time.Minute)
+	}
+	if c.CheckInterval < 0 || c.DeregisterAfter < duration(time.Minute) || c.RefreshInterval < 0 {
+		return fmt.Errorf("check_interval and refresh_interval must be positive and deregister_after at least 1m, Consul's minimum")
+	}
+	return nil
+}
+
+// consulCheck is the health check of a Consul service registration
+type consulCheck struct {
+	HTTP                           string `json:"HTTP"`
+	Interval                       string `json:"Interval"`
+	Timeout                        string `json:"Timeout"`
+	DeregisterCriticalServiceAfter string `json:"DeregisterCriticalServiceAfter"`
+}
+
+// consulService is the body of the agent's service registration endpoint
+type consulService struct {
+	ID      string            `json:"ID"`
+	Name    string            `json:"Name"`
+	Tags    []string          `json:"Tags"`
+	Address string            `json:"Address,omitempty"`
+	Port    int               `json:"Port"`
+	Meta    map[string]string `json:"Meta"`
+	Check   consulCheck       `json:"Check"`
+}
+
+// consulRegistration returns the registration of the exporter listening on
+// port, tagged with the ports of the Redis servers found on the host
+func consulRegistration(cfg consulConfig, port int, redis []redisTarget) consulService {
+	svc := consulService{
+		ID:      cfg.ID,
+		Name:    cfg.Service,
+		Tags:    append([]string{}, cfg.Tags...),
+		Address: cfg.ServiceAddress,
+		Port:    port,
+		Meta:    map[string]string{"version": exporterBuildInfo().Version},
+	}
+	for name, value := range cfg.Meta {
+		svc.Meta[name] = value
+	}
+	if cfg.Role != "" {
+		svc.Tags = append(svc.Tags, "role="+cfg.Role)
+	}
+	var ports []string
+	for _, target := range redis {
+		if target.Port != "" {
+			svc.Tags = append(svc.Tags, "redis_port="+target.Port)
+			ports = append(ports, target.Port)
+		}
+	}
+	if len(ports) > 0 {
+		svc.Meta["redis_ports"] = strings.Join(ports, ",")
+	}
+
+	check := cfg.CheckURL
+	if check == "" {
+		host := cfg.ServiceAddress
+		if host == "" {
+			host = "127.0.0.1"
+		}
+		check = "http://" + net.JoinHostPort(host, strconv.Itoa(port)) + *prefix + "/-/healthy"
+	}
+	svc.Check = consulCheck{
+		HTTP:                           check,
+		Interval:                       time.Duration(cfg.CheckInterval).String(),
+		Timeout:                        "5s",
+		DeregisterCriticalServiceAfter: time.Duration(cfg.DeregisterAfter).String(),
+	}
+	return svc
+}
+
+// consulClient sends requests to the Consul agent
+var consulClient = &http.Client{Timeout: 10 * time.Second}
+
+// consulDo sends a PUT request with body to path of the agent
+func consulDo(cfg consulConfig, path string, body interface{}) error {
+	var r io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest("PUT", cfg.Address+path, r)
+	if err != nil {
+		return err
+	}
+	if cfg.Token != "" {
+		req.Header.Set("X-Consul-Token", cfg.Token)
+	}
+	resp, err := consulClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// runConsulRegistration registers the exporter listening on port and
+// registers it again whenever the Redis servers of the host change or a
+// registration failed, until stop is closed
+func runConsulRegistration(cfg consulConfig, port int, stop <-chan struct{}) {
+	ticker := time.NewTicker(time.Duration(cfg.RefreshInterval))
+	defer ticker.Stop()
+
+	var registered *consulService
+	for {
+		redis, err := findRedisTargets()
+		if err != nil {
+			log.Printf("Consul: failed to list Redis servers: %v", err)
+		}
+		svc := consulRegistration(cfg, port, redis)
+		if registered == nil || !reflect.DeepEqual(*registered, svc) {
+			if err := consulDo(cfg, "/v1/agent/service/register", svc); err != nil {
+				log.Printf("Consul: failed to register %s: %v", svc.ID, err)
+				registered = nil
+			} else {
+				log.Printf("Registered %s in Consul with tags %s", svc.ID, strings.Join(svc.Tags, ", "))
+				registered = &svc
+			}
+		}
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// deregisterConsulOnExit removes the registration when the exporter is
+// stopped with SIGINT or SIGTERM, then exits
+func deregisterConsulOnExit(cfg consulConfig) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	s := <-sig
+	if err := consulDo(cfg, "/v1/agent/service/deregister/"+url.PathEscape(cfg.ID), nil); err != nil {
+		log.Printf("Consul: failed to deregister %s: %v", cfg.ID, err)
+	} else {
+		log.Printf("Deregistered %s from Consul", cfg.ID)
+	}
+	log.Printf("Exiting on %s", s)
+	os.Exit(0)
+}
+
+// handleHealthy answers the health checks of service registries; it needs
+// no authentication and only tells that requests are being served
+func handleHealthy(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	io.WriteString(w, "OK\n")
+}
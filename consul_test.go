@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestConsulConfigValidate(t *testing.T) {
+	for name, cfg := range map[string]consulConfig{
+		"bad address":      {Address: "ftp://consul:8500"},
+		"reserved tag":     {Address: "127.0.0.1:8500", Tags: []string{"role=primary"}},
+		"bad check url":    {Address: "127.0.0.1:8500", CheckURL: "/-/healthy"},
+		"short deregister": {Address: "127.0.0.1:8500", DeregisterAfter: duration(30 * time.Second)},
+	} {
+		if err := cfg.validate(); err == nil {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+
+	t.Setenv("CONSUL_TOKEN", "s3cr3t")
+	cfg := consulConfig{Address: "127.0.0.1:8500/", TokenEnv: "CONSUL_TOKEN"}
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+	hostname, _ := os.Hostname()
+	if cfg.Address != "http://127.0.0.1:8500" || cfg.Token != "s3cr3t" || cfg.Service != "bcc-exporter" || cfg.ID != "bcc-exporter-"+hostname {
+		t.Errorf("config = %+v", cfg)
+	}
+}
+
+func TestConsulRegistration(t *testing.T) {
+	cfg := consulConfig{Address: "127.0.0.1:8500", ID: "bcc-exporter-redis-7", Role: "primary", Tags: []string{"profiling"}, Meta: map[string]string{"dc": "eu"}}
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+	svc := consulRegistration(cfg, 8080, []redisTarget{{PID: 10, Port: "6379"}, {PID: 11}, {PID: 12, Port: "6380"}})
+	if !slices.Equal(svc.Tags, []string{"profiling", "role=primary", "redis_port=6379", "redis_port=6380"}) {
+		t.Errorf("tags = %v", svc.Tags)
+	}
+	if svc.Meta["redis_ports"] != "6379,6380" || svc.Meta["dc"] != "eu" || svc.Meta["version"] == "" {
+		t.Errorf("meta = %v", svc.Meta)
+	}
+	if svc.Port != 8080 || svc.Check.HTTP != "http://127.0.0.1:8080/-/healthy" || svc.Check.Interval != "10s" || svc.Check.DeregisterCriticalServiceAfter != "10m0s" {
+		t.Errorf("registration = %+v", svc)
+	}
+
+	cfg.ServiceAddress = "10.0.0.7"
+	if svc := consulRegistration(cfg, 8080, nil); svc.Check.HTTP != "http://10.0.0.7:8080/-/healthy" || svc.Address != "10.0.0.7" {
+		t.Errorf("registration with a service address = %+v", svc)
+	}
+}
+
+func TestConsulAgent(t *testing.T) {
+	writeFakeProc(t, map[int]int{100: 1})
+	if err := os.WriteFile(filepath.Join(procRoot, "100", "comm"), []byte("redis-server\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	writeFakeListener(t, 100, 6379, "555")
+
+	registered := make(chan consulService, 1)
+	var deregistered string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "PUT" || r.Header.Get("X-Consul-Token") != "s3cr3t" {
+			t.Errorf("request = %s %s %v", r.Method, r.URL, r.Header)
+		}
+		switch r.URL.Path {
+		case "/v1/agent/service/register":
+			var svc consulService
+			json.NewDecoder(r.Body).Decode(&svc)
+			registered <- svc
+		default:
+			deregistered = r.URL.Path
+		}
+	}))
+	defer srv.Close()
+
+	cfg := consulConfig{Address: srv.URL, Token: "s3cr3t", ID: "exporter-1"}
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		runConsulRegistration(cfg, 8080, stop)
+		close(done)
+	}()
+	svc := <-registered
+	close(stop)
+	<-done
+	if svc.ID != "exporter-1" || !slices.Contains(svc.Tags, "redis_port=6379") {
+		t.Errorf("registered %+v", svc)
+	}
+
+	if err := consulDo(cfg, "/v1/agent/service/deregister/exporter-1", nil); err != nil || deregistered != "/v1/agent/service/deregister/exporter-1" {
+		t.Errorf("deregister: %v, %q", err, deregistered)
+	}
+
+	rr := httptest.NewRecorder()
+	handleHealthy(rr, httptest.NewRequest("GET", "/-/healthy", nil))
+	if rr.Code != http.StatusOK || rr.Body.String() != "OK\n" {
+		t.Errorf("/-/healthy: %d %q", rr.Code, rr.Body.String())
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// inOtherMountNS reports whether pid sees a different filesystem than the
+// exporter, as processes in containers do
+func inOtherMountNS(pid int) bool {
+	theirs, err := os.Readlink(filepath.Join(procRoot, strconv.Itoa(pid), "ns", "mnt"))
+	if err != nil {
+		return false
+	}
+	ours, err := os.Readlink(filepath.Join(procRoot, "self", "ns", "mnt"))
+	if err != nil {
+		// A -host-proc from another PID namespace has no self
+		ours, err = os.Readlink("/proc/self/ns/mnt")
+	}
+	return err == nil && theirs != ours
+}
+
+// containerBinaryDirs returns the host paths, through /proc/<pid>/root, of
+// the directories holding the binaries and libraries mapped by pid when it
+// runs in another mount namespace, so pprof can find files whose paths only
+// exist inside the container
+func containerBinaryDirs(pid int) []string {
+	if !inOtherMountNS(pid) {
+		return nil
+	}
+
+	pidDir := filepath.Join(procRoot, strconv.Itoa(pid))
+	f, err := os.Open(filepath.Join(pidDir, "maps"))
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	seen := make(map[string]bool)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// address perms offset dev inode path
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 6 || !strings.HasPrefix(fields[5], "/") || fields[4] == "0" {
+			continue
+		}
+		seen[filepath.Join(pidDir, "root", filepath.Dir(fields[5]))] = true
+	}
+
+	dirs := make([]string, 0, len(seen))
+	for dir := range seen {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+	return dirs
+}
+
+// captureBinaryDirs returns the container binary directories of every
+// process in the capture
+func captureBinaryDirs(opts profileOptions) []string {
+	var dirs []string
+	for _, p := range strings.Split(opts.targetPIDs(), ",") {
+		if pid, err := strconv.Atoi(p); err == nil {
+			dirs = append(dirs, containerBinaryDirs(pid)...)
+		}
+	}
+	return dirs
+}
+
+// readNSpid returns the NSpid line of a /proc status file: the ID in every
+// PID namespace the task belongs to, from the exporter's to the innermost
+func readNSpid(statusPath string) ([]int, error) {
+	data, err := os.ReadFile(statusPath)
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		rest, ok := strings.CutPrefix(line, "NSpid:")
+		if !ok {
+			continue
+		}
+		var ids []int
+		for _, field := range strings.Fields(rest) {
+			id, err := strconv.Atoi(field)
+			if err != nil {
+				return nil, fmt.Errorf("malformed NSpid line %q", line)
+			}
+			ids = append(ids, id)
+		}
+		return ids, nil
+	}
+	return nil, fmt.Errorf("no NSpid in %s (kernel 4.1+ required)", statusPath)
+}
+
+// inContainer reports whether the cgroup of pid belongs to container, a
+// cgroup path or a container ID (full or short) as it appears in cgroup
+// names such as docker-<id>.scope or cri-containerd-<id>.scope
+func inContainer(pid int, container string) bool {
+	data, err := os.ReadFile(filepath.Join(procRoot, strconv.Itoa(pid), "cgroup"))
+	if err != nil {
+		return false
+	}
+	cgroups := string(data)
+	if strings.Contains(container, "/") {
+		return strings.Contains(cgroups, container)
+	}
+
+	// An ID prefix must start a cgroup name component
+	for i := strings.Index(cgroups, container); i >= 0; {
+		if i > 0 && strings.ContainsRune("/-:", rune(cgroups[i-1])) {
+			return true
+		}
+		next := strings.Index(cgroups[i+1:], container)
+		if next < 0 {
+			break
+		}
+		i += next + 1
+	}
+	return false
+}
+
+// translateContainerPID returns the host PID of the process known as
+// localPID inside container
+func translateContainerPID(container string, localPID int) (int, error) {
+	pids, err := listPIDs()
+	if err != nil {
+		return 0, err
+	}
+
+	var matches []int
+	for _, pid := range pids {
+		if !inContainer(pid, container) {
+			continue
+		}
+		ids, err := readNSpid(filepath.Join(procRoot, strconv.Itoa(pid), "status"))
+		if err != nil || len(ids) == 0 {
+			continue
+		}
+		if ids[len(ids)-1] == localPID {
+			matches = append(matches, pid)
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return 0, fmt.Errorf("no process with PID %d in container %s", localPID, container)
+	case 1:
+		return matches[0], nil
+	}
+	// A pod-level cgroup holds several containers, each with its own PID 1
+	return 0, fmt.Errorf("PID %d matches processes %v: container %s is ambiguous", localPID, matches, container)
+}
+
+// translateContainerTID returns the host TID of the thread known as localTID
+// inside the PID namespace of the process hostPID
+func translateContainerTID(hostPID, localTID int) (int, error) {
+	taskDir := filepath.Join(procRoot, strconv.Itoa(hostPID), "task")
+	entries, err := os.ReadDir(taskDir)
+	if err != nil {
+		return 0, err
+	}
+	for _, entry := range entries {
+		ids, err := readNSpid(filepath.Join(taskDir, entry.Name(), "status"))
+		if err == nil && len(ids) > 0 && ids[len(ids)-1] == localTID {
+			return ids[0], nil
+		}
+	}
+	return 0, fmt.Errorf("no thread with TID %d in process %d", localTID, hostPID)
+}
+
+// resolveContainerPID turns the container-local pid and tid of opts into
+// host IDs when the request names a container
+func resolveContainerPID(opts *profileOptions) error {
+	if opts.Container == "" {
+		return nil
+	}
+	localPID, _ := strconv.Atoi(opts.PID)
+	pid, err := translateContainerPID(opts.Container, localPID)
+	if err != nil {
+		return err
+	}
+	log.Printf("Translated PID %d in container %s to host PID %d", localPID, opts.Container, pid)
+	opts.PID = strconv.Itoa(pid)
+
+	if opts.TID != "" {
+		localTID, _ := strconv.Atoi(opts.TID)
+		tid, err := translateContainerTID(pid, localTID)
+		if err != nil {
+			return err
+		}
+		opts.TID = strconv.Itoa(tid)
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// writeFakeMountNS makes pid live in the given mount namespace of the fake
+// /proc; the exporter itself lives in mnt:[1]
+func writeFakeMountNS(t *testing.T, pid, ns string) {
+	t.Helper()
+	for _, dir := range []string{pid, "self"} {
+		if err := os.MkdirAll(filepath.Join(procRoot, dir, "ns"), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	os.Symlink("mnt:[1]", filepath.Join(procRoot, "self", "ns", "mnt"))
+	if err := os.Symlink(ns, filepath.Join(procRoot, pid, "ns", "mnt")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestContainerBinaryDirs(t *testing.T) {
+	writeFakeProc(t, map[int]int{42: 1, 43: 1})
+	writeFakeMountNS(t, "42", "mnt:[4026532512]")
+	writeFakeMountNS(t, "43", "mnt:[1]")
+
+	maps := `55d000000000-55d000100000 r-xp 00000000 00:2e 1311 /usr/local/bin/redis-server
+55d000100000-55d000200000 r--p 00100000 00:2e 1311 /usr/local/bin/redis-server
+7f0000000000-7f0000100000 r-xp 00000000 00:2e 2048 /lib/x86_64-linux-gnu/libc.so.6
+7f0000200000-7f0000300000 rw-p 00000000 00:00 0 
+7ffd00000000-7ffd00021000 rw-p 00000000 00:00 0 [stack]
+7ffd00100000-7ffd00102000 r-xp 00000000 00:00 0 [vdso]
+`
+	for _, pid := range []string{"42", "43"} {
+		if err := os.WriteFile(filepath.Join(procRoot, pid, "maps"), []byte(maps), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := []string{
+		filepath.Join(procRoot, "42", "root", "lib/x86_64-linux-gnu"),
+		filepath.Join(procRoot, "42", "root", "usr/local/bin"),
+	}
+	if got := containerBinaryDirs(42); !reflect.DeepEqual(got, want) {
+		t.Errorf("containerBinaryDirs(42) = %q, want %q", got, want)
+	}
+	if got := containerBinaryDirs(43); got != nil {
+		t.Errorf("containerBinaryDirs(43) in the host namespace = %q, want none", got)
+	}
+	if got := captureBinaryDirs(profileOptions{PID: "43", ChildPIDs: []string{"42"}}); !reflect.DeepEqual(got, want) {
+		t.Errorf("captureBinaryDirs = %q, want %q", got, want)
+	}
+}
+
+// writeFakeContainer puts host pid, with the given NSpid line, in the cgroup
+// of container
+func writeFakeContainer(t *testing.T, pid, nspid, container string) {
+	t.Helper()
+	cgroup := "0::/system.slice/docker-" + container + ".scope\n"
+	status := "Name:\tredis-server\nNSpid:\t" + nspid + "\n"
+	for path, content := range map[string]string{
+		filepath.Join(procRoot, pid, "cgroup"):              cgroup,
+		filepath.Join(procRoot, pid, "status"):              status,
+		filepath.Join(procRoot, pid, "task", pid, "status"): status,
+	} {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestReadNSpid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "status")
+	os.WriteFile(path, []byte("Name:\tredis-server\nPid:\t4242\nNSpid:\t4242\t17\t1\n"), 0644)
+	ids, err := readNSpid(path)
+	if err != nil || !reflect.DeepEqual(ids, []int{4242, 17, 1}) {
+		t.Errorf("readNSpid = %v, %v", ids, err)
+	}
+
+	os.WriteFile(path, []byte("Name:\tredis-server\nPid:\t4242\n"), 0644)
+	if _, err := readNSpid(path); err == nil {
+		t.Error("readNSpid succeeded without an NSpid line")
+	}
+}
+
+func TestTranslateContainerPID(t *testing.T) {
+	const redis = "3f4e5d6c7b8a91021324354657687980a1b2c3d4e5f60718293a4b5c6d7e8f90"
+	const sidecar = "0a1b2c3d4e5f60718293a4b5c6d7e8f903f4e5d6c7b8a91021324354657687980"
+	writeFakeProc(t, map[int]int{4242: 1, 4250: 4242, 5000: 1, 6000: 1})
+	writeFakeContainer(t, "4242", "4242\t1", redis)
+	writeFakeContainer(t, "4250", "4250\t9", redis)
+	writeFakeContainer(t, "5000", "5000\t1", sidecar)
+	writeFakeContainer(t, "6000", "6000", "") // host process
+
+	tests := []struct {
+		container string
+		pid       int
+		want      int
+		wantErr   bool
+	}{
+		{redis, 1, 4242, false},
+		{redis[:12], 9, 4250, false},
+		{sidecar[:12], 1, 5000, false},
+		{redis, 2, 0, true},
+		{redis[1:13], 1, 0, true},     // not an ID prefix
+		{"/system.slice", 1, 0, true}, // matches both containers
+	}
+	for _, tt := range tests {
+		got, err := translateContainerPID(tt.container, tt.pid)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("translateContainerPID(%s, %d) error = %v, wantErr %v", tt.container, tt.pid, err, tt.wantErr)
+		}
+		if got != tt.want {
+			t.Errorf("translateContainerPID(%s, %d) = %d, want %d", tt.container, tt.pid, got, tt.want)
+		}
+	}
+
+	if tid, err := translateContainerTID(4242, 1); err != nil || tid != 4242 {
+		t.Errorf("translateContainerTID(4242, 1) = %d, %v", tid, err)
+	}
+
+	req := httptest.NewRequest("GET", "/debug/folded/profile?pid=9&container="+redis[:12]+"&seconds=5&test=true", nil)
+	rr := httptest.NewRecorder()
+	handleFolded(rr, req)
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "PID 4250") {
+		t.Errorf("container PID 9: status %d: %s", rr.Code, rr.Body.String())
+	}
+
+	// The reports outside runProfile target the host PID too
+	for path, handler := range map[string]http.HandlerFunc{
+		"/debug/perfstat":         handlePerfStat,
+		"/debug/redis/cmdlatency": handleRedisCmdLatency,
+		"/debug/memaccess":        handleMemAccess,
+		"/debug/numa":             handleNUMA,
+		"/debug/sched":            handleSched,
+	} {
+		req := httptest.NewRequest("GET", path+"?pid=9&container="+redis[:12]+"&seconds=5&test=true", nil)
+		rr := httptest.NewRecorder()
+		handler(rr, req)
+		if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `"pid": "4250"`) {
+			t.Errorf("%s with container PID 9: status %d: %s", path, rr.Code, rr.Body.String())
+		}
+	}
+}
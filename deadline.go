@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os/exec"
+	"path/filepath"
+	"time"
+)
+
+// jobGrace is how long a child command may take on top of the capture
+// duration, for starting up, attaching probes and writing its output, and
+// how long conversion commands may take at all (-job-grace)
+var jobGrace = 60 * time.Second
+
+// captureTimeout returns the deadline of a command capturing for seconds
+func captureTimeout(seconds int) time.Duration {
+	return time.Duration(seconds)*time.Second + jobGrace
+}
+
+// jobName returns the tool cmd runs, looking past the -escalation wrapper
+func jobName(cmd *exec.Cmd) string {
+	name := filepath.Base(cmd.Args[0])
+	if name == escalationMethod() && len(cmd.Args) > 1 {
+		name = filepath.Base(cmd.Args[1])
+	}
+	return name
+}
+
+// runJob runs cmd like cmd.Run, tracked in the sessions file, and kills it
+// together with its children when it runs longer than timeout. Hung
+// commands, such as perf stuck on an NFS-backed build-ID cache, then fail
+// with 504 Gateway Timeout instead of holding the request forever.
+func runJob(cmd *exec.Cmd, timeout time.Duration) error {
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	untrack := sessions.track(cmd)
+	defer untrack()
+
+	waited := make(chan error, 1)
+	go func() { waited <- cmd.Wait() }()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err := <-waited:
+		return err
+	case <-timer.C:
+		// Killed before the command is reaped, so its PID cannot have
+		// been reused yet
+		killTree(cmd.Process.Pid)
+		<-waited
+		return &captureError{http.StatusGatewayTimeout, fmt.Sprintf("%s did not finish within %s and was killed", jobName(cmd), timeout)}
+	}
+}
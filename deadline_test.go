@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJobName(t *testing.T) {
+	orig := escalation
+	t.Cleanup(func() { escalation = orig })
+	escalation = "sudo"
+
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"/usr/bin/perf", "record"}, "perf"},
+		{[]string{"sudo", "profile-bpfcc", "-F", "99"}, "profile-bpfcc"},
+		{[]string{"sudo"}, "sudo"},
+	}
+	for _, tt := range tests {
+		if got := jobName(&exec.Cmd{Args: tt.args}); got != tt.want {
+			t.Errorf("jobName(%q) = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestRunJob(t *testing.T) {
+	if err := runJob(exec.Command("true"), time.Second); err != nil {
+		t.Errorf("runJob(true) = %v", err)
+	}
+	if err := runJob(exec.Command("false"), time.Second); err == nil {
+		t.Error("runJob(false) succeeded")
+	} else if _, ok := err.(*captureError); ok {
+		t.Errorf("runJob(false) = %v, a timeout", err)
+	}
+
+	// The child of a hung command is killed with it
+	start := time.Now()
+	err := runJob(exec.Command("sh", "-c", "sleep 60; true"), 100*time.Millisecond)
+	ce, ok := err.(*captureError)
+	if !ok || ce.Status != http.StatusGatewayTimeout || !strings.Contains(ce.Message, "sh did not finish within 100ms") {
+		t.Errorf("runJob(hung) = %v, want a 504 captureError", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("runJob(hung) took %s", elapsed)
+	}
+}
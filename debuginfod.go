@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"debug/elf"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// debuginfodConfig is the debuginfod section of the configuration file
+type debuginfodConfig struct {
+	// URLs are the debuginfod servers tried in order (default
+	// $DEBUGINFOD_URLS); debuginfod is off when there are none
+	URLs []string `json:"urls"`
+	// CacheDir holds the fetched files in the <build-id>/debuginfo layout
+	// shared with libdebuginfod (default ~/.cache/debuginfod_client)
+	CacheDir string `json:"cache_dir"`
+	// Timeout bounds each download (default 30s)
+	Timeout duration `json:"timeout"`
+}
+
+func (c *debuginfodConfig) validate() error {
+	if len(c.URLs) == 0 {
+		c.URLs = strings.Fields(os.Getenv("DEBUGINFOD_URLS"))
+	}
+	for _, u := range c.URLs {
+		if parsed, err := url.Parse(u); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+			return fmt.Errorf("invalid url %q", u)
+		}
+	}
+	if c.CacheDir == "" {
+		dir, err := os.UserCacheDir()
+		if err != nil {
+			dir = os.TempDir()
+		}
+		c.CacheDir = filepath.Join(dir, "debuginfod_client")
+	}
+	if c.Timeout == 0 {
+		c.Timeout = duration(30 * time.Second)
+	}
+	return nil
+}
+
+// debuginfod holds the debuginfod section of the configuration file
+var debuginfod debuginfodConfig
+
+// parseBuildIDList parses perf buildid-list output ("<build-id> <path>" per
+// line) into a build-id to path map, skipping kernel and vDSO entries
+func parseBuildIDList(r io.Reader) map[string]string {
+	ids := make(map[string]string)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		id, path, ok := strings.Cut(strings.TrimSpace(scanner.Text()), " ")
+		if !ok || strings.HasPrefix(path, "[") {
+			continue
+		}
+		ids[id] = path
+	}
+	return ids
+}
+
+// hasSymbols reports whether the binary at path carries a symbol table; a
+// binary that cannot be read is treated as stripped
+func hasSymbols(path string) bool {
+	f, err := elf.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	return f.Section(".symtab") != nil || f.Section(".debug_info") != nil
+}
+
+// debugInfoPath is where the debuginfo of buildID is cached
+func (c debuginfodConfig) debugInfoPath(buildID string) string {
+	return filepath.Join(c.CacheDir, buildID, "debuginfo")
+}
+
+// fetchDebugInfo downloads the debuginfo of buildID into the cache from the
+// first server that has it
+func (c debuginfodConfig) fetchDebugInfo(buildID string) error {
+	client := &http.Client{Timeout: time.Duration(c.Timeout)}
+	var lastErr error
+	for _, server := range c.URLs {
+		resp, err := client.Get(strings.TrimSuffix(server, "/") + "/buildid/" + buildID + "/debuginfo")
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			lastErr = fmt.Errorf("%s: %s", server, resp.Status)
+			continue
+		}
+		err = c.saveDebugInfo(buildID, resp.Body)
+		resp.Body.Close()
+		return err
+	}
+	return lastErr
+}
+
+// saveDebugInfo writes a downloaded file into the cache atomically, so
+// concurrent captures never see a partial file
+func (c debuginfodConfig) saveDebugInfo(buildID string, r io.Reader) error {
+	dir := filepath.Dir(c.debugInfoPath(buildID))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, "debuginfo-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), c.debugInfoPath(buildID))
+}
+
+// fetchMissingDebugInfo fetches the debuginfo of the stripped binaries that
+// perfDataPath references and are not cached yet
+func (c debuginfodConfig) fetchMissingDebugInfo(perfDataPath string) {
+	if len(c.URLs) == 0 {
+		return
+	}
+
+	cmd := newCommand("perf", "buildid-list", "-i", perfDataPath)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := runJob(cmd, jobGrace); err != nil {
+		log.Printf("perf buildid-list failed: %v: %s", err, stderr.String())
+		return
+	}
+
+	for id, path := range parseBuildIDList(&stdout) {
+		if _, err := os.Stat(c.debugInfoPath(id)); err == nil || hasSymbols(filepath.Join(symfs, path)) {
+			continue
+		}
+		if err := c.fetchDebugInfo(id); err != nil {
+			log.Printf("No debuginfo for %s (%s): %v", path, id, err)
+			continue
+		}
+		log.Printf("Fetched debuginfo for %s (%s)", path, id)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseBuildIDList(t *testing.T) {
+	out := `4a1c3f1e0d2b5c6a7e8f9a0b1c2d3e4f5a6b7c8d [kernel.kallsyms]
+0f1e2d3c4b5a69788796a5b4c3d2e1f0a9b8c7d6 /usr/bin/redis-server
+11223344556677889900aabbccddeeff00112233 /usr/lib/x86_64-linux-gnu/libc.so.6
+99887766554433221100ffeeddccbbaa99887766 [vdso]
+`
+	want := map[string]string{
+		"0f1e2d3c4b5a69788796a5b4c3d2e1f0a9b8c7d6": "/usr/bin/redis-server",
+		"11223344556677889900aabbccddeeff00112233": "/usr/lib/x86_64-linux-gnu/libc.so.6",
+	}
+	if got := parseBuildIDList(strings.NewReader(out)); !reflect.DeepEqual(got, want) {
+		t.Errorf("parseBuildIDList = %v, want %v", got, want)
+	}
+}
+
+func TestHasSymbols(t *testing.T) {
+	// Binaries that cannot be read are treated as stripped
+	notELF := filepath.Join(t.TempDir(), "script.sh")
+	if err := os.WriteFile(notELF, []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{notELF, "/nonexistent/redis-server"} {
+		if hasSymbols(path) {
+			t.Errorf("hasSymbols(%s) = true", path)
+		}
+	}
+}
+
+func TestFetchDebugInfo(t *testing.T) {
+	const buildID = "0f1e2d3c4b5a69788796a5b4c3d2e1f0a9b8c7d6"
+
+	empty := httptest.NewServer(http.NotFoundHandler())
+	defer empty.Close()
+	var requested string
+	full := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested = r.URL.Path
+		w.Write([]byte("ELF debuginfo"))
+	}))
+	defer full.Close()
+
+	cfg := debuginfodConfig{URLs: []string{empty.URL, full.URL + "/"}}
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+	cfg.CacheDir = t.TempDir()
+
+	if err := cfg.fetchDebugInfo(buildID); err != nil {
+		t.Fatal(err)
+	}
+	if requested != "/buildid/"+buildID+"/debuginfo" {
+		t.Errorf("requested %q", requested)
+	}
+	data, err := os.ReadFile(filepath.Join(cfg.CacheDir, buildID, "debuginfo"))
+	if err != nil || string(data) != "ELF debuginfo" {
+		t.Errorf("cached debuginfo = %q, %v", data, err)
+	}
+
+	cfg.URLs = []string{empty.URL}
+	if err := cfg.fetchDebugInfo("deadbeef"); err == nil {
+		t.Error("fetchDebugInfo succeeded without a server having the file")
+	}
+}
+
+func TestDebuginfodConfig(t *testing.T) {
+	t.Setenv("DEBUGINFOD_URLS", "https://debuginfod.ubuntu.com https://debuginfod.elfutils.org/")
+	var cfg debuginfodConfig
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.URLs) != 2 || cfg.CacheDir == "" {
+		t.Errorf("defaults not applied: %+v", cfg)
+	}
+
+	cfg = debuginfodConfig{URLs: []string{"ftp://example.com"}}
+	if err := cfg.validate(); err == nil {
+		t.Error("validate accepted an ftp url")
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/google/pprof/profile"
+)
+
+// maxUploadSize bounds profiles uploaded to the analysis endpoints
+const maxUploadSize = 64 << 20
+
+// readProfile parses a pprof or folded profile from r
+func readProfile(r io.Reader) (*profile.Profile, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return parseProfileData(data)
+}
+
+// loadStoredProfile parses a profile from the store
+func loadStoredProfile(id string) (*profile.Profile, error) {
+	if store == nil {
+		return nil, fmt.Errorf("profile store is not enabled (start with -store-dir or configure storage)")
+	}
+
+	f, _, err := store.Open(id)
+	if err != nil {
+		return nil, fmt.Errorf("profile %s: %v", id, err)
+	}
+	defer f.Close()
+
+	p, err := readProfile(f)
+	if err != nil {
+		return nil, fmt.Errorf("profile %s: %v", id, err)
+	}
+	return p, nil
+}
+
+// loadUploadedProfile parses a profile uploaded as the named multipart form file
+func loadUploadedProfile(r *http.Request, name string) (*profile.Profile, error) {
+	f, _, err := r.FormFile(name)
+	if err != nil {
+		return nil, fmt.Errorf("missing uploaded profile %q", name)
+	}
+	defer f.Close()
+
+	p, err := readProfile(f)
+	if err != nil {
+		return nil, fmt.Errorf("uploaded profile %q: %v", name, err)
+	}
+	return p, nil
+}
+
+// loadNamedProfile loads the profile given either as a stored profile ID in
+// the query parameter name or as an uploaded multipart file of the same name
+func loadNamedProfile(r *http.Request, name string) (*profile.Profile, error) {
+	if r.Method == http.MethodPost {
+		return loadUploadedProfile(r, name)
+	}
+	id := r.URL.Query().Get(name)
+	if id == "" {
+		return nil, fmt.Errorf("missing %s profile ID", name)
+	}
+	return loadStoredProfile(id)
+}
+
+// diffProfiles returns target minus base as a single pprof profile, marking
+// base samples the way pprof's -diff_base does
+func diffProfiles(base, target *profile.Profile) (*profile.Profile, error) {
+	base = base.Copy()
+	for _, s := range base.Sample {
+		if s.Label == nil {
+			s.Label = make(map[string][]string)
+		}
+		s.Label["pprof::base"] = []string{"true"}
+	}
+	base.Scale(-1)
+
+	diff, err := mergeProfiles([]*profile.Profile{target, base})
+	if err != nil {
+		return nil, fmt.Errorf("profiles cannot be compared: %v", err)
+	}
+	return diff, nil
+}
+
+// diffFlameTree builds a flamegraph tree sized by target and colored by the
+// change from base
+func diffFlameTree(base, target *profile.Profile) *flameNode {
+	root := newFlameNode("all")
+	for stack, v := range profileToFolded(target) {
+		root.add(strings.Split(stack, ";"), v, 0)
+	}
+	for stack, v := range profileToFolded(base) {
+		root.add(strings.Split(stack, ";"), 0, v)
+	}
+	return root
+}
+
+// writeDiffFolded writes the two-column "stack base target" format produced
+// by difffolded.pl, which flamegraph.pl renders as a differential graph
+func writeDiffFolded(w io.Writer, base, target *profile.Profile) error {
+	baseFolded, targetFolded := profileToFolded(base), profileToFolded(target)
+
+	var stacks []string
+	for stack := range baseFolded {
+		stacks = append(stacks, stack)
+	}
+	for stack := range targetFolded {
+		if _, ok := baseFolded[stack]; !ok {
+			stacks = append(stacks, stack)
+		}
+	}
+	sort.Strings(stacks)
+
+	bw := bufio.NewWriter(w)
+	for _, stack := range stacks {
+		fmt.Fprintf(bw, "%s %d %d\n", stack, baseFolded[stack], targetFolded[stack])
+	}
+	return bw.Flush()
+}
+
+// handleDiff compares two profiles given as stored IDs (?base=&target=) or as
+// uploaded multipart files named base and target
+func handleDiff(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		r.Body = http.MaxBytesReader(w, r.Body, 2*maxUploadSize)
+		if err := r.ParseMultipartForm(maxUploadSize); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid upload: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	base, err := loadNamedProfile(r, "base")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	target, err := loadNamedProfile(r, "target")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	switch format := r.URL.Query().Get("format"); format {
+	case "", "pprof":
+		diff, err := diffProfiles(base, target)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", "attachment; filename=diff.pb.gz")
+		diff.Write(w)
+	case "flamegraph":
+		w.Header().Set("Content-Type", "image/svg+xml")
+		renderFlameGraph(w, diffFlameTree(base, target), "Differential Flame Graph", true)
+	case "folded":
+		w.Header().Set("Content-Type", "text/plain")
+		writeDiffFolded(w, base, target)
+	default:
+		http.Error(w, "Invalid format: must be pprof, flamegraph or folded", http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/pprof/profile"
+)
+
+const (
+	diffBase   = "main;aeMain;aeApiPoll 50\nmain;aeMain;call 40\n"
+	diffTarget = "main;aeMain;aeApiPoll 20\nmain;aeMain;call 80\n"
+)
+
+func TestDiffProfiles(t *testing.T) {
+	base, _ := parseFolded(strings.NewReader(diffBase))
+	target, _ := parseFolded(strings.NewReader(diffTarget))
+
+	diff, err := diffProfiles(base, target)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	folded := profileToFolded(diff)
+	if folded["main;aeMain;aeApiPoll"] != -30 || folded["main;aeMain;call"] != 40 {
+		t.Errorf("diff = %v", folded)
+	}
+
+	// The inputs must not be modified
+	if profileToFolded(base)["main;aeMain;call"] != 40 {
+		t.Errorf("diffProfiles() modified the base profile")
+	}
+}
+
+func TestDiffEndpointStored(t *testing.T) {
+	s := withTestStore(t)
+	base, err := s.Save(profileMeta{Format: "folded"}, strings.NewReader(diffBase))
+	if err != nil {
+		t.Fatal(err)
+	}
+	target, err := s.Save(profileMeta{Format: "folded"}, strings.NewReader(diffTarget))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	handleDiff(rr, httptest.NewRequest("GET", "/api/v1/diff?format=folded&base="+base.ID+"&target="+target.ID, nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("diff returned %d: %s", rr.Code, rr.Body.String())
+	}
+	want := "main;aeMain;aeApiPoll 50 20\nmain;aeMain;call 40 80\n"
+	if rr.Body.String() != want {
+		t.Errorf("folded diff = %q, want %q", rr.Body.String(), want)
+	}
+
+	rr = httptest.NewRecorder()
+	handleDiff(rr, httptest.NewRequest("GET", "/api/v1/diff?format=flamegraph&base="+base.ID+"&target="+target.ID, nil))
+	svg := rr.Body.String()
+	if rr.Code != http.StatusOK || !strings.Contains(svg, "<svg") || !strings.Contains(svg, "aeApiPoll (20 samples, -30 from base)") {
+		t.Errorf("flamegraph diff = %d %q", rr.Code, svg)
+	}
+
+	rr = httptest.NewRecorder()
+	handleDiff(rr, httptest.NewRequest("GET", "/api/v1/diff?base="+base.ID+"&target=0123456789abcdef", nil))
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("diff against a missing profile returned %d, want 400", rr.Code)
+	}
+}
+
+func TestDiffEndpointUpload(t *testing.T) {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for name, data := range map[string]string{"base": diffBase, "target": diffTarget} {
+		fw, err := mw.CreateFormFile(name, name+".txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write([]byte(data))
+	}
+	mw.Close()
+
+	req := httptest.NewRequest("POST", "/api/v1/diff", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	rr := httptest.NewRecorder()
+	handleDiff(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("diff returned %d: %s", rr.Code, rr.Body.String())
+	}
+	p, err := profile.Parse(rr.Body)
+	if err != nil {
+		t.Fatalf("diff response is not a pprof profile: %v", err)
+	}
+	if got := profileToFolded(p)["main;aeMain;call"]; got != 40 {
+		t.Errorf("diff call = %d, want 40", got)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+)
+
+// perfSampleBytes is roughly what perf record writes per sample with frame
+// pointer or LBR call graphs; DWARF samples add the user stack dump
+const perfSampleBytes = 512
+
+// perfDataSlack covers the headers, build IDs and mmap records perf.data
+// holds besides samples
+const perfDataSlack = 16 << 20
+
+// tempRoot is where captures keep their working files (-temp-dir); empty
+// means os.TempDir()
+var tempRoot string
+
+// newCaptureDir creates a working directory for one capture under tempRoot
+func newCaptureDir() (string, error) {
+	return os.MkdirTemp(tempRoot, instancePrefix())
+}
+
+// checkTempRoot reports whether dir can hold capture working directories
+func checkTempRoot(dir string) error {
+	if info, err := os.Stat(dir); err != nil {
+		return err
+	} else if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+	probe, err := os.MkdirTemp(dir, "bcc-exporter-")
+	if err != nil {
+		return err
+	}
+	return os.Remove(probe)
+}
+
+// targetThreads returns how many threads perf record samples for opts, at
+// most one per CPU since a thread only gets sampled while it runs
+func targetThreads(opts profileOptions) int {
+	if opts.TID != "" {
+		return 1
+	}
+	threads := 0
+	for _, pid := range strings.Split(opts.targetPIDs(), ",") {
+		if tasks, err := os.ReadDir(filepath.Join(procRoot, pid, "task")); err == nil {
+			threads += len(tasks)
+		}
+	}
+	return max(1, min(threads, runtime.NumCPU()))
+}
+
+// estimatePerfData returns an upper estimate of the disk space a perf
+// capture of opts needs: perf.data, at most limits.max_perf_data, plus as
+// much again for its conversion
+func estimatePerfData(opts profileOptions) int64 {
+	perSample := int64(perfSampleBytes)
+	if opts.CallGraph == "dwarf" {
+		perSample += int64(opts.DwarfSize)
+	}
+	samples := int64(opts.frequency()) * int64(opts.Duration) * int64(targetThreads(opts))
+	data := samples * perSample
+	if limit := int64(currentLimits().MaxPerfData); limit > 0 {
+		data = min(data, limit)
+	}
+	return 2 * (data + perfDataSlack)
+}
+
+// freeSpace returns the bytes available to unprivileged users in the
+// filesystem holding dir
+func freeSpace(dir string) (int64, error) {
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(dir, &fs); err != nil {
+		return 0, err
+	}
+	return int64(fs.Bavail) * fs.Bsize, nil
+}
+
+// formatSize renders a byte count in MiB
+func formatSize(n int64) string {
+	return fmt.Sprintf("%.1f MiB", float64(n)/(1<<20))
+}
+
+// checkDiskSpace fails with 507 Insufficient Storage when the filesystem of
+// dir has less than need bytes available, so captures fail up front rather
+// than midway with a truncated perf.data
+func checkDiskSpace(dir string, need int64) error {
+	free, err := freeSpace(dir)
+	if err != nil {
+		log.Printf("Failed to check free space in %s: %v", dir, err)
+		return nil
+	}
+	if free < need {
+		return &captureError{http.StatusInsufficientStorage, fmt.Sprintf(
+			"Not enough disk space for this capture: it needs about %s in %s, but only %s is available. Shorten the capture or set -temp-dir to a larger filesystem",
+			formatSize(need), dir, formatSize(free))}
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestEstimatePerfData(t *testing.T) {
+	writeFakeProc(t, map[int]int{1234: 1})
+	for _, tid := range []string{"1234", "1235", "1236"} {
+		if err := os.MkdirAll(filepath.Join(procRoot, "1234", "task", tid), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	threads := min(3, runtime.NumCPU())
+	if got := targetThreads(profileOptions{PID: "1234"}); got != threads {
+		t.Errorf("targetThreads = %d, want %d", got, threads)
+	}
+	if got := targetThreads(profileOptions{PID: "1234", TID: "1235"}); got != 1 {
+		t.Errorf("targetThreads with a TID = %d, want 1", got)
+	}
+	if got := targetThreads(profileOptions{PID: "999"}); got != 1 {
+		t.Errorf("targetThreads of a missing PID = %d, want 1", got)
+	}
+
+	fp := estimatePerfData(profileOptions{PID: "1234", Duration: 30, CallGraph: "fp"})
+	if want := int64(2 * (999*30*threads*perfSampleBytes + perfDataSlack)); fp != want {
+		t.Errorf("estimatePerfData(fp) = %d, want %d", fp, want)
+	}
+	if dwarf := estimatePerfData(profileOptions{PID: "1234", Duration: 30, CallGraph: "dwarf", DwarfSize: 8192}); dwarf <= fp {
+		t.Errorf("estimatePerfData(dwarf) = %d, not above fp %d", dwarf, fp)
+	}
+}
+
+func TestCheckDiskSpace(t *testing.T) {
+	dir := t.TempDir()
+	if err := checkDiskSpace(dir, 1); err != nil {
+		t.Errorf("checkDiskSpace(1 byte) = %v", err)
+	}
+	err := checkDiskSpace(dir, math.MaxInt64)
+	ce, ok := err.(*captureError)
+	if !ok || ce.Status != http.StatusInsufficientStorage || !strings.Contains(ce.Message, "-temp-dir") {
+		t.Errorf("checkDiskSpace(MaxInt64) = %v, want a 507 captureError", err)
+	}
+}
+
+func TestCheckTempRoot(t *testing.T) {
+	dir := t.TempDir()
+	if err := checkTempRoot(dir); err != nil {
+		t.Errorf("checkTempRoot(%s) = %v", dir, err)
+	}
+	file := filepath.Join(dir, "file")
+	os.WriteFile(file, nil, 0644)
+	for _, path := range []string{file, filepath.Join(dir, "missing")} {
+		if err := checkTempRoot(path); err == nil {
+			t.Errorf("checkTempRoot(%s) succeeded", path)
+		}
+	}
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+const (
+	// encryptionMagic starts every encrypted object
+	encryptionMagic = "BCCENC1\n"
+	// encryptionHeaderSize is the magic followed by the salt of the key of
+	// the object
+	encryptionHeaderSize = len(encryptionMagic) + 16
+	// encryptionChunkSize is the plaintext size of the chunks sealed one
+	// by one, so objects are decrypted a chunk at a time and can be read
+	// from any offset
+	encryptionChunkSize = 64 << 10
+)
+
+// encryptionConfig is the storage.encryption section: objects are encrypted
+// with AES-256-GCM before they reach the storage backend
+type encryptionConfig struct {
+	// Key is the base64 encoded 32 byte key; Key, KeyFile and KeyEnv work
+	// like the Redis password settings
+	Key     string `json:"key,omitempty"`
+	KeyFile string `json:"key_file,omitempty"`
+	KeyEnv  string `json:"key_env,omitempty"`
+	// KMS decrypts the key instead, a data key generated by AWS KMS
+	KMS kmsConfig `json:"kms"`
+	// AllowPlaintext reads objects stored before encryption was enabled
+	// as they are, while migrating a store; otherwise they are refused
+	AllowPlaintext bool `json:"allow_plaintext"`
+}
+
+// kmsConfig names an AWS KMS encrypted data key
+type kmsConfig struct {
+	// DataKey is the base64 CiphertextBlob of
+	// aws kms generate-data-key --key-spec AES_256
+	DataKey string `json:"data_key"`
+	// Region of the KMS key (default $AWS_REGION, or us-east-1)
+	Region string `json:"region"`
+}
+
+func (c *encryptionConfig) validate() error {
+	key, err := resolveSecret(c.Key, c.KeyFile, c.KeyEnv)
+	if err != nil {
+		return fmt.Errorf("key: %v", err)
+	}
+	c.Key = key
+	if c.Key != "" && c.KMS.DataKey != "" {
+		return fmt.Errorf("key and kms.data_key are mutually exclusive")
+	}
+	if c.Key != "" {
+		if _, err := decodeEncryptionKey(c.Key); err != nil {
+			return fmt.Errorf("key: %v", err)
+		}
+	}
+	if c.KMS.DataKey != "" {
+		if _, err := base64.StdEncoding.DecodeString(c.KMS.DataKey); err != nil {
+			return fmt.Errorf("kms.data_key is not base64: %v", err)
+		}
+		c.KMS.Region = awsRegion(c.KMS.Region)
+	}
+	return nil
+}
+
+// enabled reports whether objects are encrypted
+func (c encryptionConfig) enabled() bool {
+	return c.Key != "" || c.KMS.DataKey != ""
+}
+
+// decodeEncryptionKey decodes a base64 AES-256 key
+func decodeEncryptionKey(s string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("not base64: %v", err)
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("must be 32 bytes, e.g. from openssl rand -base64 32, not %d", len(key))
+	}
+	return key, nil
+}
+
+// kmsEndpoint returns the URL of the KMS service of region
+var kmsEndpoint = func(region string) string {
+	return "https://kms." + region + ".amazonaws.com/"
+}
+
+// kmsDecrypt returns the plaintext of a data key encrypted by AWS KMS
+func kmsDecrypt(cfg kmsConfig) ([]byte, error) {
+	client := &http.Client{Timeout: 30 * time.Second}
+	creds, err := (&awsCredentialSource{region: cfg.Region, client: client}).get()
+	if err != nil {
+		return nil, err
+	}
+	body, err := json.Marshal(map[string]string{"CiphertextBlob": cfg.DataKey})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", kmsEndpoint(cfg.Region), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "TrentService.Decrypt")
+	digest := sha256.Sum256(body)
+	signV4(req, creds, cfg.Region, "kms", hex.EncodeToString(digest[:]), time.Now())
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Plaintext string `json:"Plaintext"`
+		Type      string `json:"__type"`
+		Message   string `json:"message"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&result); err != nil {
+		return nil, fmt.Errorf("KMS returned %s: %v", resp.Status, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("KMS returned %s: %s %s", resp.Status, result.Type, result.Message)
+	}
+	return decodeEncryptionKey(result.Plaintext)
+}
+
+// encryptedStorage encrypts the objects of a Storage. Each object is keyed
+// by the configured key, a random salt and its name, so objects cannot be
+// swapped, and is sealed in chunks whose nonce counts them and marks the
+// last one, so chunks cannot be reordered or cut off.
+type encryptedStorage struct {
+	Storage
+	key []byte
+	// allowPlaintext returns objects without the encryption header as
+	// they are
+	allowPlaintext bool
+}
+
+// newEncryptedStorage wraps s with the key of cfg, decrypting it with KMS
+// when needed
+func newEncryptedStorage(s Storage, cfg encryptionConfig) (*encryptedStorage, error) {
+	if cfg.KMS.DataKey != "" {
+		key, err := kmsDecrypt(cfg.KMS)
+		if err != nil {
+			return nil, fmt.Errorf("decrypting the data key with KMS: %v", err)
+		}
+		return &encryptedStorage{Storage: s, key: key, allowPlaintext: cfg.AllowPlaintext}, nil
+	}
+	key, err := decodeEncryptionKey(cfg.Key)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptedStorage{Storage: s, key: key, allowPlaintext: cfg.AllowPlaintext}, nil
+}
+
+func (s *encryptedStorage) String() string {
+	return fmt.Sprint(s.Storage) + " (encrypted)"
+}
+
+// aead returns the cipher of object name with salt
+func (s *encryptedStorage) aead(name string, salt []byte) (cipher.AEAD, error) {
+	key, err := hkdf.Key(sha256.New, s.key, salt, "bcc-exporter object "+name, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// chunkNonce returns the nonce of chunk i, the last one of its object or not
+func chunkNonce(i int64, last bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce, uint64(i))
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// encryptedSize returns the size of an object of size plaintext bytes once
+// encrypted, or -1 when unknown. The last chunk is short, empty when size
+// is a multiple of the chunk size.
+func encryptedSize(size int64) int64 {
+	if size < 0 {
+		return -1
+	}
+	return int64(encryptionHeaderSize) + size + (size/encryptionChunkSize+1)*16
+}
+
+func (s *encryptedStorage) Put(name string, r io.Reader, size int64) error {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+	aead, err := s.aead(name, salt)
+	if err != nil {
+		return err
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		if _, err := pw.Write(append([]byte(encryptionMagic), salt...)); err != nil {
+			return
+		}
+		buf := make([]byte, encryptionChunkSize, encryptionChunkSize+16)
+		for i := int64(0); ; i++ {
+			n, err := io.ReadFull(r, buf)
+			last := err == io.EOF || err == io.ErrUnexpectedEOF
+			if err != nil && !last {
+				pw.CloseWithError(err)
+				return
+			}
+			if _, err := pw.Write(aead.Seal(buf[:0], chunkNonce(i, last), buf[:n], nil)); err != nil {
+				return
+			}
+			if last {
+				pw.Close()
+				return
+			}
+		}
+	}()
+	err = s.Storage.Put(name, pr, encryptedSize(size))
+	// Stops the goroutine when the backend gave up before the end
+	pr.CloseWithError(io.ErrClosedPipe)
+	return err
+}
+
+func (s *encryptedStorage) Get(name string) (io.ReadSeekCloser, error) {
+	f, err := s.Storage.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, encryptionHeaderSize)
+	if _, err := io.ReadFull(f, header); err != nil || string(header[:len(encryptionMagic)]) != encryptionMagic {
+		if !s.allowPlaintext {
+			f.Close()
+			return nil, fmt.Errorf("%s: object is not encrypted", name)
+		}
+		// Stored before encryption was enabled
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			f.Close()
+			return nil, err
+		}
+		return f, nil
+	}
+	aead, err := s.aead(name, header[len(encryptionMagic):])
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	total, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	body := total - int64(encryptionHeaderSize)
+	chunks := (body + encryptionChunkSize + 16 - 1) / (encryptionChunkSize + 16)
+	if chunks == 0 || body-(chunks-1)*(encryptionChunkSize+16) < 16 {
+		f.Close()
+		return nil, fmt.Errorf("%s: encrypted object is truncated", name)
+	}
+	return &decryptedObject{name: name, f: f, aead: aead, chunks: chunks, size: body - chunks*16, chunk: -1}, nil
+}
+
+// decryptedObject reads an encrypted object, decrypting the chunk holding
+// the read position
+type decryptedObject struct {
+	name   string
+	f      io.ReadSeekCloser
+	aead   cipher.AEAD
+	chunks int64
+	size   int64
+	pos    int64
+
+	// plain is the decrypted chunk number chunk
+	plain []byte
+	chunk int64
+}
+
+// load decrypts chunk i
+func (o *decryptedObject) load(i int64) error {
+	if _, err := o.f.Seek(int64(encryptionHeaderSize)+i*(encryptionChunkSize+16), io.SeekStart); err != nil {
+		return err
+	}
+	n := int64(encryptionChunkSize + 16)
+	if i == o.chunks-1 {
+		n = o.size - i*encryptionChunkSize + 16
+	}
+	sealed := make([]byte, n)
+	if _, err := io.ReadFull(o.f, sealed); err != nil {
+		return err
+	}
+	plain, err := o.aead.Open(sealed[:0], chunkNonce(i, i == o.chunks-1), sealed, nil)
+	if err != nil {
+		return fmt.Errorf("%s: chunk %d does not decrypt: wrong key or tampered object", o.name, i)
+	}
+	o.plain, o.chunk = plain, i
+	return nil
+}
+
+func (o *decryptedObject) Read(p []byte) (int, error) {
+	if o.pos >= o.size {
+		// The last chunk is authenticated even when it is empty, so a
+		// truncated object fails instead of ending early
+		if o.chunk != o.chunks-1 {
+			if err := o.load(o.chunks - 1); err != nil {
+				return 0, err
+			}
+		}
+		return 0, io.EOF
+	}
+	if i := o.pos / encryptionChunkSize; i != o.chunk {
+		if err := o.load(i); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, o.plain[o.pos%encryptionChunkSize:])
+	o.pos += int64(n)
+	return n, nil
+}
+
+func (o *decryptedObject) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += o.pos
+	case io.SeekEnd:
+		offset += o.size
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("negative offset")
+	}
+	o.pos = offset
+	return offset, nil
+}
+
+func (o *decryptedObject) Close() error {
+	return o.f.Close()
+}
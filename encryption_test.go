@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// testEncryptedStorage returns an encrypted storage over a local directory,
+// and the directory's storage to look at the objects as written
+func testEncryptedStorage(t *testing.T, key byte) (*encryptedStorage, *localStorage) {
+	t.Helper()
+	local, err := newLocalStorage(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := encryptionConfig{Key: base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{key}, 32))}
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+	s, err := newEncryptedStorage(local, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, local
+}
+
+func TestEncryptionConfigValidate(t *testing.T) {
+	for _, cfg := range []encryptionConfig{
+		{Key: "c2hvcnQ="},
+		{Key: "not base64!"},
+		{Key: base64.StdEncoding.EncodeToString(make([]byte, 32)), KMS: kmsConfig{DataKey: "AQID"}},
+		{KMS: kmsConfig{DataKey: "not base64!"}},
+	} {
+		if err := cfg.validate(); err == nil {
+			t.Errorf("%+v accepted", cfg)
+		}
+	}
+	t.Setenv("AWS_REGION", "eu-west-1")
+	cfg := encryptionConfig{KMS: kmsConfig{DataKey: "AQID"}}
+	if err := cfg.validate(); err != nil || cfg.KMS.Region != "eu-west-1" || !cfg.enabled() {
+		t.Errorf("kms config = %+v, %v", cfg, err)
+	}
+}
+
+func TestEncryptedStorage(t *testing.T) {
+	s, local := testEncryptedStorage(t, 1)
+	for _, size := range []int{0, 1, encryptionChunkSize - 1, encryptionChunkSize, encryptionChunkSize + 1, 3*encryptionChunkSize + 5} {
+		data := make([]byte, size)
+		for i := range data {
+			data[i] = byte(i % 251)
+		}
+		for _, known := range []bool{true, false} {
+			n := int64(-1)
+			if known {
+				n = int64(size)
+			}
+			if err := s.Put("obj", bytes.NewReader(data), n); err != nil {
+				t.Fatal(err)
+			}
+			raw, _ := local.Get("obj")
+			sealed, _ := io.ReadAll(raw)
+			raw.Close()
+			if int64(len(sealed)) != encryptedSize(int64(size)) {
+				t.Errorf("size %d: %d bytes stored, want %d", size, len(sealed), encryptedSize(int64(size)))
+			}
+			if size > 16 && bytes.Contains(sealed, data[:16]) {
+				t.Errorf("size %d: plaintext stored", size)
+			}
+
+			f, err := s.Get("obj")
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := io.ReadAll(f)
+			if err != nil || !bytes.Equal(got, data) {
+				t.Errorf("size %d: read %d bytes, %v", size, len(got), err)
+			}
+			if end, _ := f.Seek(0, io.SeekEnd); end != int64(size) {
+				t.Errorf("size %d: end at %d", size, end)
+			}
+			if size > encryptionChunkSize+2 {
+				f.Seek(encryptionChunkSize-2, io.SeekStart)
+				part := make([]byte, 4)
+				if _, err := io.ReadFull(f, part); err != nil || !bytes.Equal(part, data[encryptionChunkSize-2:encryptionChunkSize+2]) {
+					t.Errorf("size %d: read across chunks = %v, %v", size, part, err)
+				}
+			}
+			f.Close()
+		}
+	}
+}
+
+func TestEncryptedStorageTampering(t *testing.T) {
+	s, local := testEncryptedStorage(t, 1)
+	data := bytes.Repeat([]byte("redis-server;aeMain 1\n"), 10000)
+	if err := s.Put("a.folded.txt", bytes.NewReader(data), int64(len(data))); err != nil {
+		t.Fatal(err)
+	}
+	raw, _ := local.Get("a.folded.txt")
+	sealed, _ := io.ReadAll(raw)
+	raw.Close()
+
+	read := func(name string, s Storage) error {
+		f, err := s.Get(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.ReadAll(f)
+		return err
+	}
+	flipped := bytes.Clone(sealed)
+	flipped[len(flipped)/2] ^= 1
+	truncated := sealed[:encryptionHeaderSize+2*(encryptionChunkSize+16)]
+	for name, obj := range map[string][]byte{"flipped": flipped, "truncated": truncated, "moved": sealed} {
+		local.Put(name, bytes.NewReader(obj), int64(len(obj)))
+		if err := read(name, s); err == nil {
+			t.Errorf("%s object read without error", name)
+		}
+	}
+	other, _ := testEncryptedStorage(t, 2)
+	other.Storage = local
+	if err := read("a.folded.txt", other); err == nil {
+		t.Error("object read with the wrong key")
+	}
+
+	// Objects without the encryption header are refused, unless reading
+	// a store being migrated
+	local.Put("old.json", strings.NewReader(`{"id":"old"}`), -1)
+	if err := read("old.json", s); err == nil {
+		t.Error("plaintext object read without allow_plaintext")
+	}
+	s.allowPlaintext = true
+	f, err := s.Get("old.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := io.ReadAll(f); string(got) != `{"id":"old"}` {
+		t.Errorf("plaintext object = %q", got)
+	}
+}
+
+func TestEncryptedProfileStore(t *testing.T) {
+	st, _ := testEncryptedStorage(t, 1)
+	s := &profileStore{storage: st}
+	meta, err := s.Save(profileMeta{Format: "folded", PID: "42"}, strings.NewReader("a;b 1\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, got, err := s.Open(meta.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	data, _ := io.ReadAll(f)
+	if string(data) != "a;b 1\n" || got.SHA256 != meta.SHA256 || got.Size != 6 {
+		t.Errorf("read %q, %+v", data, got)
+	}
+	if metas, err := s.List(); err != nil || len(metas) != 1 {
+		t.Errorf("List() = %v, %v", metas, err)
+	}
+}
+
+func TestKMSDecrypt(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, 32)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct{ CiphertextBlob string }
+		json.NewDecoder(r.Body).Decode(&req)
+		if r.Header.Get("X-Amz-Target") != "TrentService.Decrypt" || !strings.Contains(r.Header.Get("Authorization"), "/eu-west-1/kms/aws4_request") {
+			t.Errorf("request headers = %v", r.Header)
+		}
+		if req.CiphertextBlob != "AQID" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"__type": "InvalidCiphertextException", "message": "bad blob"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"KeyId": "arn:aws:kms:eu-west-1:1:key/k", "Plaintext": base64.StdEncoding.EncodeToString(key)})
+	}))
+	defer srv.Close()
+	orig := kmsEndpoint
+	kmsEndpoint = func(string) string { return srv.URL }
+	t.Cleanup(func() { kmsEndpoint = orig })
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKID")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+
+	got, err := kmsDecrypt(kmsConfig{DataKey: "AQID", Region: "eu-west-1"})
+	if err != nil || !bytes.Equal(got, key) {
+		t.Errorf("kmsDecrypt() = %x, %v", got, err)
+	}
+	if _, err := kmsDecrypt(kmsConfig{DataKey: "BAUG", Region: "eu-west-1"}); err == nil || !strings.Contains(err.Error(), "InvalidCiphertextException") {
+		t.Errorf("kmsDecrypt() of a bad blob: %v", err)
+	}
+}
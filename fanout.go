@@ -0,0 +1,368 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/pprof/profile"
+)
+
+// maxFanoutPeers bounds the peers of a single fan-out request
+const maxFanoutPeers = 100
+
+// fanoutEndpoints are the capture endpoints a fan-out request may forward,
+// with the format they answer in without a format parameter
+var fanoutEndpoints = map[string]string{
+	"/debug/pprof/profile":    "pprof",
+	"/debug/pprof/redis":      "pprof",
+	"/debug/folded/profile":   "folded",
+	"/debug/perfstat":         "json",
+	"/debug/memaccess":        "json",
+	"/debug/numa":             "json",
+	"/debug/sched":            "json",
+	"/debug/redis/cmdlatency": "json",
+	"/debug/bpftrace/run":     "json",
+}
+
+// fanoutConfig is the fanout section of the configuration file: the fleet
+// of exporters /debug/fanout forwards captures to
+type fanoutConfig struct {
+	// Peers are the exporters of the fleet, as host:port or as a base URL
+	// such as https://redis-7:8443/profiling
+	Peers []string `json:"peers"`
+	// AllowAnyPeer lets requests name peers outside of Peers
+	AllowAnyPeer bool `json:"allow_any_peer"`
+	// Username and Password authenticate to the peers; without them the
+	// client's own Authorization header is forwarded. Neither is sent to
+	// peers outside of Peers
+	Username     string `json:"username,omitempty"`
+	Password     string `json:"password,omitempty"`
+	PasswordFile string `json:"password_file,omitempty"`
+	PasswordEnv  string `json:"password_env,omitempty"`
+	// Timeout is how long peers may take beyond the capture duration
+	// (default 30s)
+	Timeout duration `json:"timeout"`
+}
+
+func (c *fanoutConfig) validate() error {
+	password, err := resolveSecret(c.Password, c.PasswordFile, c.PasswordEnv)
+	if err != nil {
+		return fmt.Errorf("password: %v", err)
+	}
+	c.Password = password
+	if c.Password != "" && c.Username == "" {
+		return fmt.Errorf("password needs a username")
+	}
+	for i, peer := range c.Peers {
+		if c.Peers[i], err = parsePeer(peer); err != nil {
+			return fmt.Errorf("peers: %v", err)
+		}
+	}
+	if c.Timeout < 0 {
+		return fmt.Errorf("timeout must not be negative")
+	}
+	if c.Timeout == 0 {
+		c.Timeout = duration(30 * time.Second)
+	}
+	return nil
+}
+
+// currentFanout returns the fan-out settings in effect; none before the
+// server state is set up
+func currentFanout() fanoutConfig {
+	if s := state.Load(); s != nil {
+		return s.cfg.Fanout
+	}
+	return fanoutConfig{Timeout: duration(30 * time.Second)}
+}
+
+// parsePeer returns the base URL of a peer given as host:port or as a URL
+func parsePeer(peer string) (string, error) {
+	base := peer
+	if !strings.Contains(base, "://") {
+		base = "http://" + base
+	}
+	u, err := url.Parse(base)
+	if err != nil || u.Scheme != "http" && u.Scheme != "https" || u.Host == "" || u.RawQuery != "" || u.Fragment != "" {
+		return "", fmt.Errorf("invalid peer %q: must be host:port or an http(s) URL", peer)
+	}
+	return strings.TrimSuffix(u.String(), "/"), nil
+}
+
+// peerName returns the short name of a peer used in labels and file names:
+// its host and port, followed by its path prefix if any
+func peerName(base string) string {
+	u, _ := url.Parse(base)
+	return u.Host + u.Path
+}
+
+// fanoutResult is the response of one peer
+type fanoutResult struct {
+	peer        string
+	contentType string
+	data        []byte
+	err         error
+}
+
+// fanoutRequest is a validated /debug/fanout request
+type fanoutRequest struct {
+	peers    []string
+	endpoint string
+	// format is what the peers answer in, "pprof", "folded" or another
+	// format of the endpoint
+	format string
+	// merged is set to merge the profiles of all peers into one, instead
+	// of returning them in a tar archive
+	merged bool
+	// query is forwarded to the peers
+	query   url.Values
+	timeout time.Duration
+}
+
+// parseFanoutRequest decodes the fan-out parameters of r; the other
+// parameters are left for the peers
+func parseFanoutRequest(r *http.Request, cfg fanoutConfig) (fanoutRequest, error) {
+	q := r.URL.Query()
+	req := fanoutRequest{endpoint: q.Get("endpoint"), query: url.Values{}}
+	var ok bool
+	if req.format, ok = fanoutEndpoints[req.endpoint]; !ok {
+		endpoints := make([]string, 0, len(fanoutEndpoints))
+		for endpoint := range fanoutEndpoints {
+			endpoints = append(endpoints, endpoint)
+		}
+		slices.Sort(endpoints)
+		return req, &captureError{http.StatusBadRequest, "Invalid endpoint: must be one of " + strings.Join(endpoints, ", ")}
+	}
+	if format := q.Get("format"); format != "" {
+		req.format = format
+	}
+
+	for _, peers := range q["peers"] {
+		for _, peer := range strings.Split(peers, ",") {
+			if peer = strings.TrimSpace(peer); peer == "" {
+				continue
+			}
+			base, err := parsePeer(peer)
+			if err != nil {
+				return req, &captureError{http.StatusBadRequest, err.Error()}
+			}
+			if !cfg.AllowAnyPeer && !slices.Contains(cfg.Peers, base) {
+				return req, &captureError{http.StatusForbidden, fmt.Sprintf("Peer %s is not in fanout.peers", peer)}
+			}
+			if !slices.Contains(req.peers, base) {
+				req.peers = append(req.peers, base)
+			}
+		}
+	}
+	if len(req.peers) == 0 {
+		req.peers = cfg.Peers
+	}
+	if len(req.peers) == 0 {
+		return req, &captureError{http.StatusBadRequest, "No peers: give peers or configure fanout.peers"}
+	}
+	if len(req.peers) > maxFanoutPeers {
+		return req, &captureError{http.StatusBadRequest, fmt.Sprintf("Too many peers: at most %d", maxFanoutPeers)}
+	}
+
+	switch output := q.Get("output"); output {
+	case "", "merged":
+		req.merged = req.format == "pprof" || req.format == "folded"
+		if output == "merged" && !req.merged {
+			return req, &captureError{http.StatusBadRequest, fmt.Sprintf("Invalid output: %s output cannot be merged, use output=tar", req.format)}
+		}
+	case "tar":
+	default:
+		return req, &captureError{http.StatusBadRequest, "Invalid output: must be merged or tar"}
+	}
+
+	for name, values := range q {
+		if name != "peers" && name != "endpoint" && name != "output" {
+			req.query[name] = values
+		}
+	}
+	seconds, _ := strconv.Atoi(q.Get("seconds"))
+	if seconds == 0 && req.endpoint == "/debug/pprof/profile" {
+		seconds = defaultPprofSeconds
+	}
+	delay, _ := strconv.Atoi(q.Get("delay"))
+	req.timeout = time.Duration(seconds+delay)*time.Second + time.Duration(cfg.Timeout)
+	return req, nil
+}
+
+// fanoutClient sends the requests to peers; each request has its own
+// deadline
+var fanoutClient = &http.Client{}
+
+// capturePeer runs the capture of req on one peer
+func capturePeer(ctx context.Context, req fanoutRequest, cfg fanoutConfig, auth, base string) fanoutResult {
+	res := fanoutResult{peer: peerName(base)}
+	ctx, cancel := context.WithTimeout(ctx, req.timeout)
+	defer cancel()
+	hreq, err := http.NewRequestWithContext(ctx, "GET", base+req.endpoint+"?"+req.query.Encode(), nil)
+	if err != nil {
+		res.err = err
+		return res
+	}
+	// Peers named with allow_any_peer may be any host the client chose
+	switch {
+	case !slices.Contains(cfg.Peers, base):
+	case cfg.Username != "":
+		hreq.SetBasicAuth(cfg.Username, cfg.Password)
+	case auth != "":
+		hreq.Header.Set("Authorization", auth)
+	}
+	hreq.Header.Set("User-Agent", "bcc-exporter/"+exporterBuildInfo().Version)
+	resp, err := fanoutClient.Do(hreq)
+	if err != nil {
+		res.err = err
+		return res
+	}
+	defer resp.Body.Close()
+
+	limit := int64(currentLimits().MaxResponse)
+	if limit <= 0 {
+		limit = 512 << 20
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+	switch {
+	case err != nil:
+		res.err = err
+	case resp.StatusCode != http.StatusOK:
+		msg, _, _ := strings.Cut(strings.TrimSpace(string(data)), "\n")
+		res.err = fmt.Errorf("%s: %s", resp.Status, msg)
+	case int64(len(data)) > limit:
+		res.err = outputTooLarge("response", limit)
+	default:
+		res.contentType, res.data = resp.Header.Get("Content-Type"), data
+	}
+	return res
+}
+
+// peerLabelRe matches the characters kept in file names of tar entries
+var peerLabelRe = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+
+// fanoutExtension returns the file extension of a peer response
+func fanoutExtension(format, contentType string) string {
+	switch format {
+	case "pprof", "folded", "perfscript", "perfdata", "perfarchive", "speedscope", "flamegraph", "chrometrace":
+		return profileExtension(format)
+	}
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch mediaType {
+	case "application/json":
+		return ".json"
+	case "text/plain":
+		return ".txt"
+	case "application/x-tar":
+		return ".tar"
+	}
+	return ".bin"
+}
+
+// mergePeerProfiles merges the profiles of the peers, labelling the samples
+// with the peer they come from
+func mergePeerProfiles(results []fanoutResult) (*profile.Profile, error) {
+	var profiles []*profile.Profile
+	for _, res := range results {
+		p, err := parseProfileData(res.data)
+		if err != nil {
+			return nil, fmt.Errorf("peer %s: %v", res.peer, err)
+		}
+		for _, s := range p.Sample {
+			if s.Label == nil {
+				s.Label = make(map[string][]string)
+			}
+			s.Label["peer"] = []string{res.peer}
+		}
+		profiles = append(profiles, p)
+	}
+	return mergeProfiles(profiles)
+}
+
+// handleFanout runs a capture on every peer at once and returns the merged
+// profile, or a tar archive of the responses of the peers
+func handleFanout(w http.ResponseWriter, r *http.Request) {
+	cfg := currentFanout()
+	req, err := parseFanoutRequest(r, cfg)
+	if err != nil {
+		writeCaptureError(w, err)
+		return
+	}
+
+	results := make([]fanoutResult, len(req.peers))
+	var wg sync.WaitGroup
+	for i, base := range req.peers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = capturePeer(r.Context(), req, cfg, r.Header.Get("Authorization"), base)
+		}()
+	}
+	wg.Wait()
+
+	var ok []fanoutResult
+	for _, res := range results {
+		if res.err != nil {
+			addWarning(w, fmt.Sprintf("peer %s failed: %v", res.peer, res.err))
+		} else {
+			ok = append(ok, res)
+		}
+	}
+	log.Printf("Fan-out of %s to %d peers: %d succeeded", req.endpoint, len(results), len(ok))
+	if r.Context().Err() != nil {
+		return
+	}
+	if len(ok) == 0 {
+		http.Error(w, fmt.Sprintf("All %d peers failed: %v", len(results), results[0].err), http.StatusBadGateway)
+		return
+	}
+
+	if !req.merged {
+		w.Header().Set("Content-Type", "application/x-tar")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=fanout-%s.tar", time.Now().UTC().Format("20060102T150405Z")))
+		tw := tar.NewWriter(w)
+		now := time.Now()
+		for _, res := range results {
+			name := peerLabelRe.ReplaceAllString(res.peer, "_")
+			if res.err != nil {
+				writeTarFile(tw, name+".error.txt", now, []byte(res.err.Error()+"\n"))
+				continue
+			}
+			writeTarFile(tw, name+fanoutExtension(req.format, res.contentType), now, res.data)
+		}
+		tw.Close()
+		return
+	}
+
+	merged, err := mergePeerProfiles(ok)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	if req.format == "folded" {
+		w.Header().Set("Content-Type", "text/plain")
+		writeFolded(w, profileToFolded(merged))
+		return
+	}
+	var buf bytes.Buffer
+	if err := merged.Write(&buf); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to write pprof profile: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", "attachment; filename=fanout.pb.gz")
+	w.Write(buf.Bytes())
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/pprof/profile"
+)
+
+// fanoutPeer serves folded stacks as a pprof profile like a peer exporter,
+// recording the requests it gets
+func fanoutPeer(t *testing.T, folded string, got chan<- *http.Request) *httptest.Server {
+	t.Helper()
+	p, err := parseFolded(strings.NewReader(folded))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	p.Write(&buf)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got <- r
+		if r.URL.Query().Get("format") == "folded" {
+			w.Header().Set("Content-Type", "text/plain")
+			io.WriteString(w, folded)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(buf.Bytes())
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestParseFanoutRequest(t *testing.T) {
+	cfg := fanoutConfig{Peers: []string{"redis-1:8080", "https://redis-2:8443/profiling/"}}
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Peers[0] != "http://redis-1:8080" || cfg.Peers[1] != "https://redis-2:8443/profiling" {
+		t.Errorf("peers = %v", cfg.Peers)
+	}
+
+	r := httptest.NewRequest("GET", "/debug/fanout?endpoint=/debug/pprof/redis&redis_port=6379&seconds=10&peers=redis-1:8080", nil)
+	req, err := parseFanoutRequest(r, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(req.peers) != 1 || !req.merged || req.query.Encode() != "redis_port=6379&seconds=10" || req.timeout.Seconds() != 40 {
+		t.Errorf("request = %+v", req)
+	}
+
+	for query, status := range map[string]int{
+		"endpoint=/debug/live":                              http.StatusBadRequest,
+		"endpoint=/debug/pprof/profile&peers=evil:80":       http.StatusForbidden,
+		"endpoint=/debug/pprof/profile&peers=ftp://redis-1": http.StatusBadRequest,
+		"endpoint=/debug/perfstat&output=merged":            http.StatusBadRequest,
+		"endpoint=/debug/pprof/profile&output=zip":          http.StatusBadRequest,
+	} {
+		_, err := parseFanoutRequest(httptest.NewRequest("GET", "/debug/fanout?"+query, nil), cfg)
+		if ce, ok := err.(*captureError); !ok || ce.Status != status {
+			t.Errorf("%s: %v, want %d", query, err, status)
+		}
+	}
+	if _, err := parseFanoutRequest(httptest.NewRequest("GET", "/debug/fanout?endpoint=/debug/pprof/profile", nil), fanoutConfig{}); err == nil {
+		t.Error("request without peers accepted")
+	}
+}
+
+func TestFanout(t *testing.T) {
+	got := make(chan *http.Request, 10)
+	a := fanoutPeer(t, "main;aeMain;dictFind 3\n", got)
+	b := fanoutPeer(t, "main;aeMain;dictFind 2\nmain;aeMain;zslInsert 5\n", got)
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "PID 42 does not exist", http.StatusBadRequest)
+	}))
+	defer down.Close()
+
+	cfg := fanoutConfig{Peers: []string{a.URL, b.URL, down.URL}}
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+	orig := state.Load()
+	t.Cleanup(func() { state.Store(orig) })
+	state.Store(&serverState{cfg: &config{Fanout: cfg}})
+
+	fanout := func(query string) *httptest.ResponseRecorder {
+		t.Helper()
+		r := httptest.NewRequest("GET", "/debug/fanout?"+query, nil)
+		r.SetBasicAuth("admin", "secret")
+		rr := httptest.NewRecorder()
+		handleFanout(rr, r)
+		return rr
+	}
+
+	rr := fanout("endpoint=/debug/pprof/profile&pid=42&seconds=1")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("merged: %d %s", rr.Code, rr.Body.String())
+	}
+	for i := 0; i < 2; i++ {
+		r := <-got
+		if user, pass, _ := r.BasicAuth(); user != "admin" || pass != "secret" || r.URL.Path != "/debug/pprof/profile" || r.URL.RawQuery != "pid=42&seconds=1" {
+			t.Errorf("peer request = %s %v", r.URL, r.Header)
+		}
+	}
+	if w := rr.Header().Values("X-Profile-Warning"); len(w) != 1 || !strings.Contains(w[0], "PID 42 does not exist") {
+		t.Errorf("warnings = %q", w)
+	}
+	p, err := profile.Parse(rr.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	perPeer := map[string]int64{}
+	for _, s := range p.Sample {
+		perPeer[s.Label["peer"][0]] += s.Value[0]
+	}
+	if perPeer[peerName(a.URL)] != 3 || perPeer[peerName(b.URL)] != 7 {
+		t.Errorf("samples per peer = %v", perPeer)
+	}
+
+	rr = fanout("endpoint=/debug/folded/profile&format=folded&pid=42&output=tar")
+	files := map[string]string{}
+	tr := tar.NewReader(rr.Body)
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			break
+		}
+		data, _ := io.ReadAll(tr)
+		files[hdr.Name] = string(data)
+	}
+	name := strings.ReplaceAll(peerName(down.URL), ":", "_")
+	if len(files) != 3 || !strings.Contains(files[name+".error.txt"], "400 Bad Request") ||
+		files[strings.ReplaceAll(peerName(a.URL), ":", "_")+".folded.txt"] != "main;aeMain;dictFind 3\n" {
+		t.Errorf("tar files = %v", files)
+	}
+
+	state.Store(&serverState{cfg: &config{Fanout: fanoutConfig{Peers: []string{down.URL}}}})
+	if rr := fanout("endpoint=/debug/pprof/profile&pid=42"); rr.Code != http.StatusBadGateway {
+		t.Errorf("all peers failed: %d", rr.Code)
+	}
+
+	// Credentials only go to the configured peers, not to those the
+	// client names with allow_any_peer
+	for len(got) > 0 {
+		<-got
+	}
+	for _, cfg := range []fanoutConfig{
+		{Peers: []string{a.URL}, AllowAnyPeer: true},
+		{Peers: []string{a.URL}, AllowAnyPeer: true, Username: "fanout", Password: "peer-secret"},
+	} {
+		if err := cfg.validate(); err != nil {
+			t.Fatal(err)
+		}
+		state.Store(&serverState{cfg: &config{Fanout: cfg}})
+		if rr := fanout("endpoint=/debug/pprof/profile&pid=42&seconds=1&peers=" + a.URL + "," + b.URL); rr.Code != http.StatusOK {
+			t.Fatalf("any peer: %d %s", rr.Code, rr.Body.String())
+		}
+		for i := 0; i < 2; i++ {
+			r := <-got
+			auth := r.Header.Get("Authorization")
+			if listed := "http://"+r.Host == a.URL; listed != (auth != "") {
+				t.Errorf("peer %s (listed %v, username %q) got Authorization %q", r.Host, listed, cfg.Username, auth)
+			}
+		}
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"hash/fnv"
+	"html"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Flamegraph layout, matching the defaults of Brendan Gregg's flamegraph.pl
+const (
+	flameWidth       = 1200
+	flameFrameHeight = 16
+	flamePadTop      = 40
+	flamePadSide     = 10
+	flameFontSize    = 12
+	flameFontWidth   = 0.59
+	flameMinWidth    = 0.1
+)
+
+// flameNode is one frame of a flamegraph; Value is the width of the frame
+// and Base the value of the same stack in the baseline of a differential graph
+type flameNode struct {
+	Name     string
+	Value    int64
+	Base     int64
+	Children map[string]*flameNode
+}
+
+func newFlameNode(name string) *flameNode {
+	return &flameNode{Name: name, Children: make(map[string]*flameNode)}
+}
+
+// add accumulates a root-to-leaf stack into the tree
+func (n *flameNode) add(stack []string, value, base int64) {
+	n.Value += value
+	n.Base += base
+	cur := n
+	for _, frame := range stack {
+		child, ok := cur.Children[frame]
+		if !ok {
+			child = newFlameNode(frame)
+			cur.Children[frame] = child
+		}
+		child.Value += value
+		child.Base += base
+		cur = child
+	}
+}
+
+// depth returns the number of frame levels below n
+func (n *flameNode) depth() int {
+	max := 0
+	for _, child := range n.Children {
+		if d := child.depth() + 1; d > max {
+			max = d
+		}
+	}
+	return max
+}
+
+// sortedChildren returns the children of n in alphabetical order, as flamegraph.pl does
+func (n *flameNode) sortedChildren() []*flameNode {
+	children := make([]*flameNode, 0, len(n.Children))
+	for _, child := range n.Children {
+		children = append(children, child)
+	}
+	sort.Slice(children, func(i, j int) bool { return children[i].Name < children[j].Name })
+	return children
+}
+
+// flameTreeFromFolded builds a flamegraph tree from collapsed stacks
+func flameTreeFromFolded(folded map[string]int64) *flameNode {
+	root := newFlameNode("all")
+	for stack, value := range folded {
+		root.add(strings.Split(stack, ";"), value, 0)
+	}
+	return root
+}
+
+// hotColor returns a deterministic flamegraph.pl style warm color for a
+// frame, or like flamegraph.pl --color=java orange for _[k] kernel frames
+// and green for _[j] JIT compiled ones
+func hotColor(name string) string {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	v := h.Sum32()
+	switch {
+	case strings.HasSuffix(name, kernelAnnotation):
+		return fmt.Sprintf("rgb(%d,%d,0)", 190+v%65, 90+(v>>8)%65)
+	case strings.HasSuffix(name, jitAnnotation):
+		return fmt.Sprintf("rgb(%d,%d,%d)", 50+v%60, 200+(v>>8)%55, 50+(v>>16)%60)
+	}
+	return fmt.Sprintf("rgb(%d,%d,%d)", 205+v%50, (v>>8)%230, (v>>16)%55)
+}
+
+// diffColor shades grown frames red and shrunk frames blue, scaled by how
+// much the frame changed relative to the largest change in the graph
+func diffColor(n *flameNode, maxDelta int64) string {
+	delta := n.Value - n.Base
+	if delta == 0 || maxDelta == 0 {
+		return "rgb(250,250,250)"
+	}
+	mag := delta
+	if mag < 0 {
+		mag = -mag
+	}
+	c := 210 - int(210*mag/maxDelta)
+	if delta > 0 {
+		return fmt.Sprintf("rgb(255,%d,%d)", c, c)
+	}
+	return fmt.Sprintf("rgb(%d,%d,255)", c, c)
+}
+
+// maxDelta returns the largest absolute value change of any frame below n
+func maxDelta(n *flameNode) int64 {
+	var max int64
+	for _, child := range n.Children {
+		d := child.Value - child.Base
+		if d < 0 {
+			d = -d
+		}
+		if d > max {
+			max = d
+		}
+		if d := maxDelta(child); d > max {
+			max = d
+		}
+	}
+	return max
+}
+
+// renderFlameGraph writes root as a static SVG flamegraph; in diff mode the
+// frame colors show the change from each frame's Base to its Value
+func renderFlameGraph(w io.Writer, root *flameNode, title string, diff bool) error {
+	height := (root.depth()+1)*flameFrameHeight + flamePadTop + flamePadSide
+	scale := 0.0
+	if root.Value > 0 {
+		scale = float64(flameWidth-2*flamePadSide) / float64(root.Value)
+	}
+	delta := maxDelta(root)
+
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, `<?xml version="1.0" standalone="no"?>
+<svg version="1.1" width="%d" height="%d" viewBox="0 0 %d %d" xmlns="http://www.w3.org/2000/svg">
+<rect x="0" y="0" width="100%%" height="100%%" fill="rgb(248,248,248)"/>
+<text x="%d" y="24" font-size="17" font-family="Verdana" text-anchor="middle">%s</text>
+`, flameWidth, height, flameWidth, height, flameWidth/2, html.EscapeString(title))
+
+	var draw func(n *flameNode, x float64, level int)
+	draw = func(n *flameNode, x float64, level int) {
+		width := float64(n.Value) * scale
+		if width < flameMinWidth {
+			return
+		}
+		y := height - flamePadSide - (level+1)*flameFrameHeight
+
+		color := hotColor(n.Name)
+		tooltip := fmt.Sprintf("%s (%d samples, %.2f%%)", n.Name, n.Value, 100*float64(n.Value)/float64(root.Value))
+		if diff {
+			color = diffColor(n, delta)
+			tooltip = fmt.Sprintf("%s (%d samples, %+d from base)", n.Name, n.Value, n.Value-n.Base)
+		}
+
+		fmt.Fprintf(bw, "<g><title>%s</title><rect x=\"%.1f\" y=\"%d\" width=\"%.1f\" height=\"%d\" fill=\"%s\" rx=\"2\" ry=\"2\"/>",
+			html.EscapeString(tooltip), x, y, width, flameFrameHeight-1, color)
+		if chars := int(width / (flameFontSize * flameFontWidth)); chars >= 3 {
+			label := n.Name
+			if len(label) > chars {
+				label = label[:chars-2] + ".."
+			}
+			fmt.Fprintf(bw, "<text x=\"%.1f\" y=\"%d\" font-size=\"%d\" font-family=\"Verdana\">%s</text>",
+				x+3, y+flameFrameHeight-5, flameFontSize, html.EscapeString(label))
+		}
+		bw.WriteString("</g>\n")
+
+		for _, child := range n.sortedChildren() {
+			draw(child, x, level+1)
+			x += float64(child.Value) * scale
+		}
+	}
+	draw(root, flamePadSide, 0)
+
+	bw.WriteString("</svg>\n")
+	return bw.Flush()
+}
+
+// handleProfileFlameGraph renders a stored pprof or folded profile as an SVG
+// flamegraph, or an interactive page with format=html; stored flamegraphs are
+// served as they are
+func handleProfileFlameGraph(w http.ResponseWriter, r *http.Request) {
+	if !requireStore(w) {
+		return
+	}
+	id := r.PathValue("id")
+	meta, err := store.Get(id)
+	if err == errProfileNotFound {
+		http.Error(w, "Profile not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to open profile: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	if format := r.URL.Query().Get("format"); format != "" && format != "svg" && format != "html" {
+		http.Error(w, "Invalid format: must be svg or html", http.StatusBadRequest)
+		return
+	}
+
+	switch meta.Format {
+	case "flamegraph":
+		if r.URL.Query().Get("format") == "html" {
+			http.Error(w, fmt.Sprintf("Profile %s is a py-spy flamegraph, which is only available as SVG", id), http.StatusBadRequest)
+			return
+		}
+		handleGetProfile(w, r)
+		return
+	case "pprof", "folded":
+	default:
+		http.Error(w, fmt.Sprintf("Profile %s is in %s format, which cannot be rendered as a flamegraph", id, meta.Format), http.StatusBadRequest)
+		return
+	}
+
+	p, err := loadStoredProfile(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if r.URL.Query().Get("format") == "html" {
+		w.Header().Set("Content-Type", reportFormats["html"])
+		renderFlameGraphHTML(w, flameTreeFromFolded(profileToFolded(p)), flameTitle(meta))
+		return
+	}
+	w.Header().Set("Content-Type", "image/svg+xml")
+	renderFlameGraph(w, flameTreeFromFolded(profileToFolded(p)), flameTitle(meta), false)
+}
+
+// flameTitle is the heading of the flamegraph of the profile of meta
+func flameTitle(meta profileMeta) string {
+	title := "Flame Graph"
+	if meta.Comm != "" {
+		title += ": " + meta.Comm
+	}
+	if meta.PID != "" {
+		title += " (PID " + meta.PID + ")"
+	}
+	return title
+}
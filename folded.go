@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/google/pprof/profile"
+)
+
+// parseFolded converts collapsed stacks ("root;child;leaf count" per line)
+// into a pprof profile with a samples/count value
+func parseFolded(r io.Reader) (*profile.Profile, error) {
+	p := &profile.Profile{
+		SampleType: []*profile.ValueType{{Type: "samples", Unit: "count"}},
+		PeriodType: &profile.ValueType{Type: "samples", Unit: "count"},
+	}
+	locations := make(map[string]*profile.Location)
+
+	locationFor := func(name string) *profile.Location {
+		if l, ok := locations[name]; ok {
+			return l
+		}
+		f := &profile.Function{ID: uint64(len(p.Function) + 1), Name: name, SystemName: name}
+		l := &profile.Location{ID: uint64(len(p.Location) + 1), Line: []profile.Line{{Function: f}}}
+		p.Function = append(p.Function, f)
+		p.Location = append(p.Location, l)
+		locations[name] = l
+		return l
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		sep := strings.LastIndexByte(line, ' ')
+		if sep < 0 {
+			return nil, fmt.Errorf("malformed folded line: %q", line)
+		}
+		count, err := strconv.ParseInt(line[sep+1:], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("malformed folded count: %q", line)
+		}
+
+		frames := strings.Split(line[:sep], ";")
+		sample := &profile.Sample{Value: []int64{count}}
+		// pprof stores the leaf first
+		for i := len(frames) - 1; i >= 0; i-- {
+			sample.Location = append(sample.Location, locationFor(frames[i]))
+		}
+		p.Sample = append(p.Sample, sample)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(p.Sample) == 0 {
+		return nil, fmt.Errorf("no stacks found in folded profile")
+	}
+	return p, nil
+}
+
+// parseProfileData decodes a pprof profile, falling back to folded stacks
+func parseProfileData(data []byte) (*profile.Profile, error) {
+	if p, err := profile.ParseData(data); err == nil {
+		return p, nil
+	}
+	p, err := parseFolded(strings.NewReader(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("not a pprof or folded profile: %v", err)
+	}
+	return p, nil
+}
+
+// sampleIndex picks the sample value used when flattening a profile: the
+// samples count when present, otherwise pprof's default of the last type
+func sampleIndex(p *profile.Profile) int {
+	for i, st := range p.SampleType {
+		if st.Type == "samples" {
+			return i
+		}
+	}
+	return len(p.SampleType) - 1
+}
+
+// frameName returns the display name of one line of a location
+func frameName(loc *profile.Location, line profile.Line) string {
+	if line.Function != nil && line.Function.Name != "" {
+		return line.Function.Name
+	}
+	return fmt.Sprintf("0x%x", loc.Address)
+}
+
+// sampleStack returns the frames of a sample from root to leaf
+func sampleStack(s *profile.Sample) []string {
+	var stack []string
+	for i := len(s.Location) - 1; i >= 0; i-- {
+		loc := s.Location[i]
+		if len(loc.Line) == 0 {
+			stack = append(stack, fmt.Sprintf("0x%x", loc.Address))
+			continue
+		}
+		// Line[0] is the innermost inlined function
+		for j := len(loc.Line) - 1; j >= 0; j-- {
+			stack = append(stack, frameName(loc, loc.Line[j]))
+		}
+	}
+	return stack
+}
+
+// profileToFolded aggregates the samples of a profile into collapsed stacks
+func profileToFolded(p *profile.Profile) map[string]int64 {
+	index := sampleIndex(p)
+	folded := make(map[string]int64)
+	for _, s := range p.Sample {
+		if v := s.Value[index]; v != 0 {
+			folded[strings.Join(sampleStack(s), ";")] += v
+		}
+	}
+	return folded
+}
+
+// writeFolded writes collapsed stacks sorted by stack for stable output
+func writeFolded(w io.Writer, folded map[string]int64) error {
+	stacks := make([]string, 0, len(folded))
+	for stack := range folded {
+		stacks = append(stacks, stack)
+	}
+	sort.Strings(stacks)
+
+	bw := bufio.NewWriter(w)
+	for _, stack := range stacks {
+		fmt.Fprintf(bw, "%s %d\n", stack, folded[stack])
+	}
+	return bw.Flush()
+}
+
+// serveFoldedCapture serves collapsed stacks recorded by backend as-is on the
+// folded endpoint, or converted to a labelled pprof profile
+func serveFoldedCapture(w http.ResponseWriter, opts profileOptions, format, backend string, folded []byte) {
+	if format != "pprof" {
+		storeCapture(w, captureMeta(opts, "folded"), bytes.NewReader(folded))
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write(folded)
+		return
+	}
+
+	p, err := parseFolded(bytes.NewReader(folded))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to convert %s output: %v", backend, err), http.StatusInternalServerError)
+		return
+	}
+	hostname, _ := os.Hostname()
+	labels := captureLabels(opts, hostname)
+	labels["backend"] = []string{backend}
+	for _, s := range p.Sample {
+		s.Label = labels
+	}
+	setCPUTime(p, opts, backend != "async-profiler" || slices.Contains(asyncCPUEvents, asyncProfiler.Event))
+
+	var buf bytes.Buffer
+	if err := p.Write(&buf); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to write pprof profile: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	storeCapture(w, captureMeta(opts, "pprof"), bytes.NewReader(buf.Bytes()))
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=profile-%s-%d.pb.gz", opts.PID, opts.Duration))
+	w.Write(buf.Bytes())
+}
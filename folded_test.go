@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestFoldedRoundTrip(t *testing.T) {
+	input := "# comment\nredis-server;main;aeMain;aeApiPoll 50\nredis-server;main;aeMain;processCommand;call 40\n"
+
+	p, err := parseFolded(strings.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.CheckValid(); err != nil {
+		t.Fatalf("invalid profile: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := writeFolded(&buf, profileToFolded(p)); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "redis-server;main;aeMain;aeApiPoll 50\nredis-server;main;aeMain;processCommand;call 40\n"
+	if buf.String() != want {
+		t.Errorf("round trip = %q, want %q", buf.String(), want)
+	}
+}
+
+func TestParseFoldedMalformed(t *testing.T) {
+	for _, input := range []string{"", "a;b;c\n", "a;b notanumber\n"} {
+		if _, err := parseFolded(strings.NewReader(input)); err == nil {
+			t.Errorf("parseFolded(%q) should fail", input)
+		}
+	}
+}
+
+func TestParseProfileData(t *testing.T) {
+	folded, err := parseFolded(strings.NewReader("a;b 3\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := folded.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, data := range map[string][]byte{"pprof": buf.Bytes(), "folded": []byte("a;b 3\n")} {
+		p, err := parseProfileData(data)
+		if err != nil {
+			t.Errorf("parseProfileData(%s): %v", name, err)
+			continue
+		}
+		if got := profileToFolded(p)["a;b"]; got != 3 {
+			t.Errorf("parseProfileData(%s) a;b = %d, want 3", name, got)
+		}
+	}
+}
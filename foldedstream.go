@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// addFolded adds the collapsed stacks in data to total
+func addFolded(total map[string]int64, data []byte) {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		sep := strings.LastIndexByte(line, ' ')
+		if sep < 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if count, err := strconv.ParseInt(line[sep+1:], 10, 64); err == nil {
+			total[line[:sep]] += count
+		}
+	}
+}
+
+// captureBCCIntervals captures opts in consecutive profile-bpfcc runs of
+// opts.StreamInterval seconds, handing the collapsed stacks of each run to
+// send as soon as it ends. It returns the stacks of all runs and the
+// seconds captured, stopping early when ctx is done or a run fails.
+func captureBCCIntervals(ctx context.Context, opts profileOptions, send func(elapsed int, folded []byte)) (map[string]int64, int, error) {
+	total := make(map[string]int64)
+	elapsed := 0
+	for elapsed < opts.Duration {
+		if err := ctx.Err(); err != nil {
+			return total, elapsed, err
+		}
+		interval := opts
+		interval.Duration = min(opts.StreamInterval, opts.Duration-elapsed)
+		folded, err := captureBCCProfile(interval)
+		if err != nil {
+			return total, elapsed, err
+		}
+		elapsed += interval.Duration
+		addFolded(total, folded)
+		send(elapsed, folded)
+	}
+	return total, elapsed, nil
+}
+
+// streamBCCFolded sends the collapsed stacks of each interval of a capture
+// as soon as it ends, so clients can render before the capture is over and
+// the exporter only holds one interval of output. A stack busy in several
+// intervals appears once per interval; folded stack consumers add them up.
+func streamBCCFolded(w http.ResponseWriter, r *http.Request, opts profileOptions) {
+	rc := http.NewResponseController(w)
+	// The profile is only stored once the whole capture is in
+	w.Header().Set("Trailer", "X-Profile-ID")
+	w.Header().Set("Content-Type", "text/plain")
+
+	total, elapsed, err := captureBCCIntervals(r.Context(), opts, func(elapsed int, folded []byte) {
+		w.Write(folded)
+		rc.Flush()
+	})
+	switch {
+	case r.Context().Err() != nil:
+		log.Printf("Client went away during streamed capture of PID %s", opts.PID)
+		return
+	case err != nil && elapsed == 0:
+		writeCaptureError(w, err)
+		return
+	case err != nil:
+		// The status is sent already; end with a comment folded stack
+		// parsers skip
+		log.Printf("Streamed capture of PID %s failed after %d seconds: %v", opts.PID, elapsed, err)
+		fmt.Fprintf(w, "# capture failed after %d seconds: %s\n", elapsed, strings.ReplaceAll(err.Error(), "\n", " "))
+		return
+	}
+
+	var buf bytes.Buffer
+	writeFolded(&buf, total)
+	storeCapture(w, captureMeta(opts, "folded"), &buf)
+	log.Printf("Successfully streamed folded profile for PID %s", opts.PID)
+}
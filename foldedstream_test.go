@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestAddFolded(t *testing.T) {
+	total := map[string]int64{"main;a": 1}
+	addFolded(total, []byte("main;a 2\nmain;b c 3\n# comment\n\nmalformed\n"))
+	want := map[string]int64{"main;a": 3, "main;b c": 3}
+	if !reflect.DeepEqual(total, want) {
+		t.Errorf("addFolded = %v, want %v", total, want)
+	}
+}
+
+// fakeProfileBPFCC puts a profile-bpfcc on PATH that runs script, with the
+// capture duration as $last
+func fakeProfileBPFCC(t *testing.T, script string) {
+	t.Helper()
+	dir := fakeTools(t)
+	if err := os.WriteFile(filepath.Join(dir, "profile-bpfcc"), []byte("#!/bin/sh\n"+script+"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	orig := escalation
+	t.Cleanup(func() { escalation = orig })
+	escalation = "none"
+}
+
+func TestStreamBCCFolded(t *testing.T) {
+	fakeProfileBPFCC(t, `for last; do :; done; echo "main;run $last"`)
+
+	rr := httptest.NewRecorder()
+	streamBCCFolded(rr, httptest.NewRequest("GET", "/debug/folded/profile", nil), profileOptions{PID: "1", Duration: 5, StreamInterval: 2})
+	if got := rr.Body.String(); got != "main;run 2\nmain;run 2\nmain;run 1\n" {
+		t.Errorf("streamed body = %q, want one chunk per 2s interval", got)
+	}
+	if !rr.Flushed {
+		t.Error("chunks were not flushed")
+	}
+	if rr.Header().Get("Trailer") != "X-Profile-ID" {
+		t.Errorf("Trailer = %q", rr.Header().Get("Trailer"))
+	}
+}
+
+func TestStreamBCCFoldedFailure(t *testing.T) {
+	count := filepath.Join(t.TempDir(), "count")
+	fakeProfileBPFCC(t, `echo x >> `+count+`; [ $(wc -l < `+count+`) -lt 2 ] || { echo 'probe detached' >&2; exit 1; }; echo "main;run 1"`)
+
+	rr := httptest.NewRecorder()
+	streamBCCFolded(rr, httptest.NewRequest("GET", "/debug/folded/profile", nil), profileOptions{PID: "1", Duration: 3, StreamInterval: 1})
+	body := rr.Body.String()
+	if rr.Code != 200 || !strings.HasPrefix(body, "main;run 1\n# capture failed after 1 seconds: ") || !strings.Contains(body, "probe detached") {
+		t.Errorf("status %d, body %q, want the first interval and a failure comment", rr.Code, body)
+	}
+
+	// A failure before anything was sent is a plain error response
+	os.Remove(count)
+	os.WriteFile(count, []byte("x\n"), 0644)
+	rr = httptest.NewRecorder()
+	streamBCCFolded(rr, httptest.NewRequest("GET", "/debug/folded/profile", nil), profileOptions{PID: "1", Duration: 3, StreamInterval: 1})
+	if rr.Code != 500 {
+		t.Errorf("status %d, want 500", rr.Code)
+	}
+}
+
+func TestParseStreamInterval(t *testing.T) {
+	tests := []struct {
+		query   string
+		want    int
+		wantErr bool
+	}{
+		{"seconds=30", 0, false},
+		{"seconds=30&stream_interval=5", 5, false},
+		{"seconds=30&stream_interval=0", 0, true},
+		{"seconds=30&stream_interval=31", 0, true},
+		{"seconds=30&stream_interval=5&snapshots=2", 0, true},
+	}
+	for _, tt := range tests {
+		q, _ := url.ParseQuery("pid=1&" + tt.query)
+		opts, err := parseCaptureOptions(q)
+		if (err != nil) != tt.wantErr || (err == nil && opts.StreamInterval != tt.want) {
+			t.Errorf("parseCaptureOptions(%s) = %d, %v, want %d, wantErr %v", tt.query, opts.StreamInterval, err, tt.want, tt.wantErr)
+		}
+	}
+}
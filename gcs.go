@@ -0,0 +1,332 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// gcsScope is the OAuth scope of the tokens the GCS backend requests
+const gcsScope = "https://www.googleapis.com/auth/devstorage.read_write"
+
+// gcsConfig is the storage.gcs section of the configuration file
+type gcsConfig struct {
+	// Bucket holds the profiles
+	Bucket string `json:"bucket"`
+	// Prefix is prepended to the object names, e.g. "profiles/"
+	Prefix string `json:"prefix"`
+	// Endpoint is the URL of the JSON API (default
+	// https://storage.googleapis.com), e.g. for an emulator
+	Endpoint string `json:"endpoint"`
+	// CredentialsFile is a service account key (default
+	// $GOOGLE_APPLICATION_CREDENTIALS); without one, tokens come from the
+	// metadata server of GCE and GKE
+	CredentialsFile string `json:"credentials_file"`
+}
+
+func (c *gcsConfig) validate() error {
+	if c.Bucket == "" {
+		return fmt.Errorf("bucket is required")
+	}
+	if c.Endpoint == "" {
+		c.Endpoint = "https://storage.googleapis.com"
+	}
+	if u, err := url.Parse(c.Endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid endpoint %q", c.Endpoint)
+	}
+	if c.CredentialsFile == "" {
+		c.CredentialsFile = os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	}
+	return nil
+}
+
+// gcsServiceAccount is a service account key file
+type gcsServiceAccount struct {
+	Type        string `json:"type"`
+	ClientEmail string `json:"client_email"`
+	PrivateKey  string `json:"private_key"`
+	TokenURI    string `json:"token_uri"`
+}
+
+// gcsMetadataHost returns the metadata server of GCE and GKE
+func gcsMetadataHost() string {
+	if host := os.Getenv("GCE_METADATA_HOST"); host != "" {
+		return host
+	}
+	return "metadata.google.internal"
+}
+
+// gcsTokenSource returns OAuth access tokens for GCS, from a service account
+// key or the metadata server, renewed before they expire
+type gcsTokenSource struct {
+	account *gcsServiceAccount
+	key     *rsa.PrivateKey
+	client  *http.Client
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+// newGCSTokenSource reads the service account key in credentialsFile, or
+// uses the metadata server when it is ""
+func newGCSTokenSource(credentialsFile string) (*gcsTokenSource, error) {
+	ts := &gcsTokenSource{client: &http.Client{Timeout: 30 * time.Second}}
+	if credentialsFile == "" {
+		return ts, nil
+	}
+	data, err := os.ReadFile(credentialsFile)
+	if err != nil {
+		return nil, err
+	}
+	var account gcsServiceAccount
+	if err := json.Unmarshal(data, &account); err != nil {
+		return nil, fmt.Errorf("%s: %v", credentialsFile, err)
+	}
+	if account.Type != "service_account" || account.ClientEmail == "" {
+		return nil, fmt.Errorf("%s is not a service account key", credentialsFile)
+	}
+	block, _ := pem.Decode([]byte(account.PrivateKey))
+	if block == nil {
+		return nil, fmt.Errorf("%s: private_key is not PEM encoded", credentialsFile)
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", credentialsFile, err)
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: private_key is not an RSA key", credentialsFile)
+	}
+	if account.TokenURI == "" {
+		account.TokenURI = "https://oauth2.googleapis.com/token"
+	}
+	ts.account, ts.key = &account, key
+	return ts, nil
+}
+
+// get returns a valid access token
+func (ts *gcsTokenSource) get() (string, error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if time.Until(ts.expires) > 5*time.Minute {
+		return ts.token, nil
+	}
+
+	var resp *http.Response
+	var err error
+	if ts.account != nil {
+		var assertion string
+		if assertion, err = ts.assertion(time.Now()); err != nil {
+			return "", err
+		}
+		resp, err = ts.client.PostForm(ts.account.TokenURI, url.Values{
+			"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+			"assertion":  {assertion},
+		})
+	} else {
+		req, _ := http.NewRequest("GET", "http://"+gcsMetadataHost()+"/computeMetadata/v1/instance/service-accounts/default/token", nil)
+		req.Header.Set("Metadata-Flavor", "Google")
+		resp, err = ts.client.Do(req)
+	}
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token request returned %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.Unmarshal(body, &token); err != nil || token.AccessToken == "" {
+		return "", fmt.Errorf("invalid token response: %s", strings.TrimSpace(string(body)))
+	}
+	ts.token = token.AccessToken
+	ts.expires = time.Now().Add(time.Duration(token.ExpiresIn) * time.Second)
+	return ts.token, nil
+}
+
+// assertion returns the JWT signed with the service account key that is
+// exchanged for an access token
+func (ts *gcsTokenSource) assertion(now time.Time) (string, error) {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iss":   ts.account.ClientEmail,
+		"scope": gcsScope,
+		"aud":   ts.account.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, ts.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// gcsStorage keeps objects in a Google Cloud Storage bucket, under the
+// configured prefix, through the JSON API
+type gcsStorage struct {
+	cfg    gcsConfig
+	tokens *gcsTokenSource
+	client *http.Client
+}
+
+// newGCSStorage returns the storage of cfg. It fails when no token can be
+// obtained.
+func newGCSStorage(cfg gcsConfig) (*gcsStorage, error) {
+	tokens, err := newGCSTokenSource(cfg.CredentialsFile)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tokens.get(); err != nil {
+		return nil, err
+	}
+	return &gcsStorage{cfg: cfg, tokens: tokens, client: &http.Client{Timeout: 10 * time.Minute}}, nil
+}
+
+func (s *gcsStorage) String() string {
+	return "gs://" + s.cfg.Bucket + "/" + s.cfg.Prefix
+}
+
+// do sends an authorized request to path of the JSON API
+func (s *gcsStorage) do(method, path string, query url.Values, header http.Header, body io.Reader, size int64) (*http.Response, error) {
+	token, err := s.tokens.get()
+	if err != nil {
+		return nil, err
+	}
+	u := strings.TrimSuffix(s.cfg.Endpoint, "/") + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = size
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return s.client.Do(req)
+}
+
+// objectPath returns the path of object name in the JSON API
+func (s *gcsStorage) objectPath(name string) string {
+	return "/storage/v1/b/" + url.PathEscape(s.cfg.Bucket) + "/o/" + url.PathEscape(s.cfg.Prefix+name)
+}
+
+// gcsError returns the error of a failed JSON API response
+func gcsError(op string, resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	var doc struct {
+		Error struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if json.Unmarshal(body, &doc) == nil && doc.Error.Message != "" {
+		return fmt.Errorf("%s: %s: %s", op, resp.Status, doc.Error.Message)
+	}
+	return fmt.Errorf("%s: %s: %s", op, resp.Status, strings.TrimSpace(string(body)))
+}
+
+func (s *gcsStorage) Put(name string, r io.Reader, size int64) error {
+	r, size, cleanup, err := spool(r, size)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	query := url.Values{"uploadType": {"media"}, "name": {s.cfg.Prefix + name}}
+	header := http.Header{"Content-Type": {"application/octet-stream"}}
+	resp, err := s.do("POST", "/upload/storage/v1/b/"+url.PathEscape(s.cfg.Bucket)+"/o", query, header, r, size)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return gcsError("upload "+name, resp)
+	}
+	return nil
+}
+
+func (s *gcsStorage) Get(name string) (io.ReadSeekCloser, error) {
+	return openRemoteObject(func(offset int64) (*http.Response, error) {
+		header := http.Header{}
+		if r := rangeHeader(offset); r != "" {
+			header.Set("Range", r)
+		}
+		return s.do("GET", s.objectPath(name), url.Values{"alt": {"media"}}, header, nil, 0)
+	})
+}
+
+func (s *gcsStorage) List(prefix string) ([]string, error) {
+	var names []string
+	token := ""
+	for {
+		query := url.Values{"prefix": {s.cfg.Prefix + prefix}, "delimiter": {"/"}, "fields": {"items(name),nextPageToken"}}
+		if token != "" {
+			query.Set("pageToken", token)
+		}
+		resp, err := s.do("GET", "/storage/v1/b/"+url.PathEscape(s.cfg.Bucket)+"/o", query, nil, nil, 0)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			err := gcsError("list "+s.String(), resp)
+			resp.Body.Close()
+			return nil, err
+		}
+		var result struct {
+			Items []struct {
+				Name string `json:"name"`
+			} `json:"items"`
+			NextPageToken string `json:"nextPageToken"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("invalid GCS listing: %v", err)
+		}
+		for _, item := range result.Items {
+			names = append(names, strings.TrimPrefix(item.Name, s.cfg.Prefix))
+		}
+		if result.NextPageToken == "" {
+			return names, nil
+		}
+		token = result.NextPageToken
+	}
+}
+
+func (s *gcsStorage) Delete(name string) error {
+	resp, err := s.do("DELETE", s.objectPath(name), nil, nil, nil, 0)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 && resp.StatusCode != http.StatusNotFound {
+		return gcsError("delete "+name, resp)
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeGCS serves the JSON API of one bucket, and the OAuth token endpoint
+type fakeGCS struct {
+	*fakeObjects
+	bucket string
+}
+
+func (s *fakeGCS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/token" {
+		r.ParseForm()
+		if parts := strings.Split(r.Form.Get("assertion"), "."); len(parts) != 3 {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"access_token": "ya29.token", "expires_in": 3600})
+		return
+	}
+	if r.Header.Get("Authorization") != "Bearer ya29.token" {
+		http.Error(w, `{"error":{"message":"Invalid Credentials"}}`, http.StatusUnauthorized)
+		return
+	}
+	objects := "/storage/v1/b/" + s.bucket + "/o"
+	switch {
+	case r.Method == "POST" && r.URL.Path == "/upload"+objects:
+		s.put(r.URL.Query().Get("name"), r.Body)
+	case r.Method == "GET" && r.URL.Path == objects:
+		var items []map[string]string
+		for _, name := range s.list(r.URL.Query().Get("prefix")) {
+			items = append(items, map[string]string{"name": name})
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"items": items})
+	case r.Method == "GET" && strings.HasPrefix(r.URL.Path, objects+"/"):
+		s.serve(w, r, strings.TrimPrefix(r.URL.Path, objects+"/"))
+	case r.Method == "DELETE" && strings.HasPrefix(r.URL.Path, objects+"/"):
+		if !s.delete(strings.TrimPrefix(r.URL.Path, objects+"/")) {
+			http.Error(w, `{"error":{"message":"No such object"}}`, http.StatusNotFound)
+		}
+	default:
+		http.Error(w, `{"error":{"message":"unexpected request"}}`, http.StatusBadRequest)
+	}
+}
+
+func TestGCSStorage(t *testing.T) {
+	fake := &fakeGCS{fakeObjects: newFakeObjects(), bucket: "profiles"}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, _ := x509.MarshalPKCS8PrivateKey(key)
+	account, _ := json.Marshal(gcsServiceAccount{
+		Type:        "service_account",
+		ClientEmail: "bcc-exporter@project.iam.gserviceaccount.com",
+		PrivateKey:  string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		TokenURI:    srv.URL + "/token",
+	})
+	credentials := filepath.Join(t.TempDir(), "key.json")
+	if err := os.WriteFile(credentials, account, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := gcsConfig{Bucket: "profiles", Prefix: "bcc/", Endpoint: srv.URL, CredentialsFile: credentials}
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+	st, err := newGCSStorage(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStorage(t, st)
+	if _, ok := fake.objects["bcc/3f9a1c0e7b2d4856.folded.txt"]; !ok {
+		t.Errorf("objects = %v, want them under the prefix", fake.list(""))
+	}
+}
+
+func TestGCSMetadataToken(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Metadata-Flavor") != "Google" || r.URL.Path != "/computeMetadata/v1/instance/service-accounts/default/token" {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"access_token": "ya29.metadata", "expires_in": 3600})
+	}))
+	defer srv.Close()
+	t.Setenv("GCE_METADATA_HOST", strings.TrimPrefix(srv.URL, "http://"))
+
+	ts, err := newGCSTokenSource("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token, err := ts.get(); err != nil || token != "ya29.metadata" {
+		t.Errorf("get() = %q, %v", token, err)
+	}
+}
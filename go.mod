@@ -1,3 +1,11 @@
 module bcc-exporter
 
 go 1.24.4
+
+require (
+	github.com/google/pprof v0.0.0-20251007162407-5df77e3f7d1d
+	github.com/klauspost/compress v1.19.2
+	golang.org/x/crypto v0.48.0
+)
+
+require github.com/ianlancetaylor/demangle v0.0.0-20250417193237-f615e6bd150b // indirect
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/pprof/profile"
+)
+
+// offCPUArgs builds the offcputime-bpfcc command line for the given options;
+// its folded output counts the microseconds each stack spent blocked
+func offCPUArgs(opts profileOptions) []string {
+	args := []string{"offcputime-bpfcc"}
+
+	if opts.TID != "" {
+		args = append(args, "-t", opts.TID)
+	} else {
+		args = append(args, "-p", opts.targetPIDs())
+	}
+	args = append(args, "-f")
+
+	switch opts.Stacks {
+	case "user":
+		args = append(args, "-U")
+	case "kernel":
+		args = append(args, "-K")
+	}
+
+	return append(args, fmt.Sprintf("%d", opts.Duration))
+}
+
+// captureOffCPU runs offcputime-bpfcc for opts and returns its folded output
+func captureOffCPU(opts profileOptions) (folded []byte, err error) {
+	stage := opts.Span.child("offcputime-bpfcc")
+	stage.set("profile.seconds", opts.Duration)
+	defer func() { stage.done(err) }()
+
+	cmd := privilegedCommand(context.Background(), offCPUArgs(opts)...)
+	var stderr bytes.Buffer
+	stdout := newLimitedBuffer()
+	cmd.Stdout = stdout
+	cmd.Stderr = &stderr
+
+	log.Printf("Running command: %s", strings.Join(cmd.Args, " "))
+	if err := runJob(cmd, captureTimeout(opts.Duration)); err != nil {
+		if _, ok := err.(*captureError); ok {
+			return nil, err
+		}
+		return nil, &captureError{http.StatusInternalServerError, fmt.Sprintf("offcputime-bpfcc failed: %v\nStderr: %s", err, stderr.String())}
+	}
+	if err := stdout.check("offcputime-bpfcc output"); err != nil {
+		return nil, err
+	}
+	return stdout.Bytes(), nil
+}
+
+// hotColdSampleTypes are the values of a hot/cold profile: time on CPU, time
+// blocked and their sum
+var hotColdSampleTypes = []string{"cpu", "off-cpu", "wall"}
+
+// hotColdProfile merges the folded stacks of profile-bpfcc sampling at
+// frequency Hz and of offcputime-bpfcc over the same window into one profile
+// whose samples hold cpu, off-cpu and wall nanoseconds, wall by default
+func hotColdProfile(onCPU, offCPU []byte, frequency int) (*profile.Profile, error) {
+	period := int64(time.Second) / int64(frequency)
+	var profiles []*profile.Profile
+	for _, part := range []struct {
+		folded []byte
+		// scale turns a folded count into nanoseconds, index is the
+		// value it is recorded as
+		scale int64
+		index int
+	}{
+		{onCPU, period, 0},
+		{offCPU, int64(time.Microsecond), 1},
+	} {
+		// A target that never ran or never blocked leaves one side empty
+		if len(bytes.TrimSpace(part.folded)) == 0 {
+			continue
+		}
+		p, err := parseFolded(bytes.NewReader(part.folded))
+		if err != nil {
+			return nil, err
+		}
+		p.SampleType = nil
+		for _, typ := range hotColdSampleTypes {
+			p.SampleType = append(p.SampleType, &profile.ValueType{Type: typ, Unit: "nanoseconds"})
+		}
+		p.DefaultSampleType = "wall"
+		p.PeriodType = &profile.ValueType{Type: "cpu", Unit: "nanoseconds"}
+		p.Period = period
+		for _, s := range p.Sample {
+			ns := s.Value[0] * part.scale
+			s.Value = make([]int64, len(hotColdSampleTypes))
+			s.Value[part.index], s.Value[2] = ns, ns
+		}
+		profiles = append(profiles, p)
+	}
+	if len(profiles) == 0 {
+		return nil, fmt.Errorf("no stacks were captured on or off CPU")
+	}
+	return mergeProfiles(profiles)
+}
+
+// runHotCold captures the on-CPU and off-CPU stacks of opts concurrently
+// and serves them as one hot/cold pprof profile
+func runHotCold(w http.ResponseWriter, opts profileOptions) {
+	var onCPU, offCPU []byte
+	var onErr, offErr error
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		onCPU, onErr = captureBCCProfile(opts)
+	}()
+	go func() {
+		defer wg.Done()
+		offCPU, offErr = captureOffCPU(opts)
+	}()
+	wg.Wait()
+
+	for _, err := range []error{onErr, offErr} {
+		if err != nil {
+			writeCaptureError(w, err)
+			return
+		}
+	}
+	serveHotCold(w, opts, onCPU, offCPU)
+}
+
+// serveHotCold writes the hot/cold profile of the folded stacks captured on
+// and off CPU for opts
+func serveHotCold(w http.ResponseWriter, opts profileOptions, onCPU, offCPU []byte) {
+	p, err := hotColdProfile(onCPU, offCPU, opts.frequency())
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to build hot/cold profile: %v", err), http.StatusInternalServerError)
+		return
+	}
+	hostname, _ := os.Hostname()
+	labels := captureLabels(opts, hostname)
+	labels["backend"] = []string{"bcc"}
+	for _, s := range p.Sample {
+		s.Label = labels
+	}
+	setCPUTime(p, opts, false)
+
+	var buf bytes.Buffer
+	if err := p.Write(&buf); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to write pprof profile: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	storeCapture(w, captureMeta(opts, "pprof"), bytes.NewReader(buf.Bytes()))
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=hotcold-%s-%d.pb.gz", opts.PID, opts.Duration))
+	w.Write(buf.Bytes())
+	log.Printf("Successfully served hot/cold profile for PID %s", opts.PID)
+}
+
+// generateMockOffCPU returns offcputime-bpfcc style folded stacks, in
+// microseconds, for test mode
+func generateMockOffCPU() string {
+	return `redis-server;main;aeMain;aeProcessEvents;aeApiPoll;epoll_wait;entry_SYSCALL_64;do_epoll_wait;schedule 3200000
+redis-server;main;aeMain;beforeSleep;flushAppendOnlyFile;fsync;entry_SYSCALL_64;do_fsync;schedule 450000
+bio_aof;bioProcessBackgroundJobs;pthread_cond_wait;futex_wait;schedule 1300000
+`
+}
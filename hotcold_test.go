@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/pprof/profile"
+)
+
+func TestOffCPUArgs(t *testing.T) {
+	got := strings.Join(offCPUArgs(profileOptions{PID: "42", Duration: 10, Stacks: "user"}), " ")
+	if got != "offcputime-bpfcc -p 42 -f -U 10" {
+		t.Errorf("offCPUArgs = %s", got)
+	}
+	got = strings.Join(offCPUArgs(profileOptions{PID: "42", TID: "43", Duration: 10, Stacks: "both"}), " ")
+	if got != "offcputime-bpfcc -t 43 -f 10" {
+		t.Errorf("offCPUArgs with tid = %s", got)
+	}
+}
+
+func TestHotColdProfile(t *testing.T) {
+	p, err := hotColdProfile([]byte("redis-server;main;processCommand 3\nredis-server;main;fsync 1\n"), []byte("redis-server;main;fsync 2000\n"), 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.CheckValid(); err != nil {
+		t.Fatal(err)
+	}
+	if len(p.SampleType) != 3 || p.SampleType[1].Type != "off-cpu" || p.DefaultSampleType != "wall" {
+		t.Errorf("sample types %v, default %q", p.SampleType, p.DefaultSampleType)
+	}
+
+	ms := int64(time.Millisecond)
+	want := map[string][3]int64{
+		"redis-server;main;processCommand": {3 * ms, 0, 3 * ms},
+		// The stack seen on and off CPU is one sample
+		"redis-server;main;fsync": {1 * ms, 2 * ms, 3 * ms},
+	}
+	if len(p.Sample) != len(want) {
+		t.Fatalf("samples = %v", p.Sample)
+	}
+	for _, s := range p.Sample {
+		stack := strings.Join(sampleStack(s), ";")
+		if got := [3]int64(s.Value); got != want[stack] {
+			t.Errorf("%s = %v, want %v", stack, got, want[stack])
+		}
+	}
+
+	if p, err := hotColdProfile([]byte("redis-server;main 1\n"), nil, 1000); err != nil || len(p.Sample) != 1 {
+		t.Errorf("without off-CPU stacks: %v", err)
+	}
+	if _, err := hotColdProfile(nil, []byte("\n"), 1000); err == nil {
+		t.Error("hot/cold profile of nothing")
+	}
+}
+
+func TestHotColdEndpoint(t *testing.T) {
+	get := func(query string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		handleHotCold(rr, httptest.NewRequest("GET", "/debug/pprof/hotcold?pid=1234&seconds=5&test=true"+query, nil))
+		return rr
+	}
+
+	rr := get("")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rr.Code, rr.Body.String())
+	}
+	p, err := profile.ParseData(rr.Body.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cpu, offCPU int64
+	for _, s := range p.Sample {
+		cpu += s.Value[0]
+		offCPU += s.Value[1]
+		if s.Value[0]+s.Value[1] != s.Value[2] {
+			t.Errorf("wall %d of %v is not cpu plus off-cpu", s.Value[2], sampleStack(s))
+		}
+	}
+	if cpu == 0 || offCPU != int64(4950*time.Millisecond) {
+		t.Errorf("cpu %d, off-cpu %d", cpu, offCPU)
+	}
+
+	for _, query := range []string{"&backend=perf", "&mode=wall", "&format=perfdata", "&snapshots=2"} {
+		if rr := get(query); rr.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d", query, rr.Code)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"html/template"
+	"io"
+)
+
+// d3Node is a frame in the hierarchy format of d3-flamegraph
+type d3Node struct {
+	Name     string    `json:"name"`
+	Value    int64     `json:"value"`
+	Children []*d3Node `json:"children,omitempty"`
+}
+
+// toD3 converts a flamegraph tree into the hierarchy format of d3-flamegraph
+func (n *flameNode) toD3() *d3Node {
+	d := &d3Node{Name: n.Name, Value: n.Value}
+	for _, child := range n.sortedChildren() {
+		d.Children = append(d.Children, child.toD3())
+	}
+	return d
+}
+
+// flameHTMLTemplate is a single page with the profile and its renderer
+// inlined, so it opens offline when attached to a ticket. The renderer
+// follows d3-flamegraph: click a frame to zoom into it, search to highlight
+// matching frames.
+var flameHTMLTemplate = template.Must(template.New("flamegraph").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+body { font-family: Verdana, sans-serif; margin: 10px; background: #f8f8f8; }
+h1 { font-size: 17px; font-weight: normal; text-align: center; }
+#controls { margin-bottom: 8px; font-size: 12px; }
+#controls input { width: 240px; }
+#details { margin-left: 12px; color: #555; }
+#chart { position: relative; width: 100%; overflow: hidden; }
+.frame { position: absolute; height: 15px; box-sizing: border-box; border: 1px solid #f8f8f8; border-radius: 2px;
+  font-size: 12px; line-height: 13px; padding-left: 3px; overflow: hidden; white-space: nowrap; text-overflow: ellipsis; cursor: pointer; }
+.frame.match { background: rgb(230,0,230) !important; }
+.frame.faded { opacity: 0.5; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<div id="controls">
+<button id="reset">Reset zoom</button>
+<input id="search" type="search" placeholder="Search functions (regexp)">
+<span id="details"></span>
+</div>
+<div id="chart"></div>
+<script>
+(function() {
+  var root = {{.Tree}};
+  var chart = document.getElementById("chart");
+  var details = document.getElementById("details");
+  var search = document.getElementById("search");
+  var frameHeight = 16;
+  var focus = root, pattern = null;
+
+  function depth(n) {
+    var d = 0;
+    (n.children || []).forEach(function(c) { d = Math.max(d, depth(c) + 1); });
+    return d;
+  }
+  function color(name) {
+    var h = 2166136261;
+    for (var i = 0; i < name.length; i++) { h ^= name.charCodeAt(i); h = Math.imul(h, 16777619) >>> 0; }
+    if (/_\[k\]$/.test(name)) return "rgb(" + (190 + h % 65) + "," + (90 + (h >>> 8) % 65) + ",0)";
+    if (/_\[j\]$/.test(name)) return "rgb(" + (50 + h % 60) + "," + (200 + (h >>> 8) % 55) + "," + (50 + (h >>> 16) % 60) + ")";
+    return "rgb(" + (205 + h % 50) + "," + ((h >>> 8) % 230) + "," + ((h >>> 16) % 55) + ")";
+  }
+  function percent(v) { return (100 * v / root.value).toFixed(2) + "%"; }
+  function parents(n, target, path) {
+    if (n === target) return path.concat([n]);
+    for (var i = 0; i < (n.children || []).length; i++) {
+      var p = parents(n.children[i], target, path.concat([n]));
+      if (p) return p;
+    }
+    return null;
+  }
+
+  function render() {
+    chart.innerHTML = "";
+    var width = chart.clientWidth, levels = depth(root) + 1;
+    chart.style.height = (levels * frameHeight) + "px";
+    var matched = 0;
+    // The ancestors of the focused frame span the full width
+    var path = parents(root, focus, []);
+    path.forEach(function(n, level) { if (n !== focus) draw(n, 0, width, level, true, true); });
+    layout(focus, 0, width / focus.value, path.length - 1, false);
+
+    // Frames below a match are not counted again
+    function layout(n, x, scale, level, counted) {
+      if (n === focus) counted = draw(n, 0, width, level, false, counted);
+      var x0 = x;
+      (n.children || []).forEach(function(c) {
+        if (c.value * scale >= 0.5) {
+          layout(c, x0, scale, level + 1, draw(c, x0, c.value * scale, level + 1, false, counted));
+        }
+        x0 += c.value * scale;
+      });
+    }
+    function draw(n, x, w, level, faded, counted) {
+      var div = document.createElement("div");
+      div.className = "frame" + (faded ? " faded" : "");
+      var match = pattern && pattern.test(n.name);
+      if (match) { div.className += " match"; if (!counted) matched += n.value; }
+      div.style.left = x + "px";
+      div.style.width = w + "px";
+      div.style.bottom = (level * frameHeight) + "px";
+      div.style.background = color(n.name);
+      div.textContent = w > 21 ? n.name : "";
+      div.title = n.name + " (" + n.value + " samples, " + percent(n.value) + ")";
+      div.onclick = function() { focus = n; render(); };
+      div.onmouseover = function() { details.textContent = div.title; };
+      chart.appendChild(div);
+      return counted || match;
+    }
+    if (pattern) details.textContent = "Matched: " + percent(matched);
+  }
+
+  document.getElementById("reset").onclick = function() { focus = root; render(); };
+  search.oninput = function() {
+    try { pattern = search.value ? new RegExp(search.value) : null; } catch (e) { pattern = null; }
+    render();
+  };
+  window.onresize = render;
+  render();
+})();
+</script>
+</body>
+</html>
+`))
+
+// renderFlameGraphHTML writes root as an interactive flamegraph page
+func renderFlameGraphHTML(w io.Writer, root *flameNode, title string) error {
+	return flameHTMLTemplate.Execute(w, struct {
+		Title string
+		Tree  *d3Node
+	}{title, root.toD3()})
+}
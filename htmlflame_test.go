@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRenderFlameGraphHTML(t *testing.T) {
+	root := flameTreeFromFolded(map[string]int64{"main;aeMain;processCommand": 10, "main;</script><b>x": 2})
+	var out strings.Builder
+	if err := renderFlameGraphHTML(&out, root, "Flame Graph: <redis>"); err != nil {
+		t.Fatal(err)
+	}
+	page := out.String()
+	for _, want := range []string{
+		"<title>Flame Graph: &lt;redis&gt;</title>",
+		`"name":"all","value":12,"children":[{"name":"main","value":12,"children":[`,
+		`{"name":"processCommand","value":10}`,
+	} {
+		if !strings.Contains(page, want) {
+			t.Errorf("page lacks %s:\n%s", want, page)
+		}
+	}
+	// Frame names cannot end the script
+	if strings.Count(page, "</script>") != 1 {
+		t.Errorf("frame name escaped the script:\n%s", page)
+	}
+}
+
+func TestFlameGraphHTMLFormat(t *testing.T) {
+	rr := httptest.NewRecorder()
+	handlePprof(rr, httptest.NewRequest("GET", "/debug/pprof/profile?pid=1234&seconds=5&test=true&format=html", nil))
+	if rr.Code != http.StatusOK || rr.Header().Get("Content-Type") != "text/html; charset=utf-8" || !strings.Contains(rr.Body.String(), "<!DOCTYPE html>") {
+		t.Errorf("format=html: %d %s", rr.Code, rr.Header().Get("Content-Type"))
+	}
+
+	s := withTestStore(t)
+	folded, err := s.Save(profileMeta{Format: "folded", PID: "42", Comm: "redis-server"}, strings.NewReader("main;aeMain;processCommand 10\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := func(query string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/api/v1/profiles/"+folded.ID+"/flamegraph?"+query, nil)
+		r.SetPathValue("id", folded.ID)
+		rr := httptest.NewRecorder()
+		handleProfileFlameGraph(rr, r)
+		return rr
+	}
+	if rr := get("format=html"); rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `"name":"processCommand"`) || !strings.Contains(rr.Body.String(), "redis-server (PID 42)") {
+		t.Errorf("stored profile as html: %d %s", rr.Code, rr.Body.String())
+	}
+	if rr := get("format=svg"); rr.Header().Get("Content-Type") != "image/svg+xml" {
+		t.Errorf("format=svg: %s", rr.Header().Get("Content-Type"))
+	}
+	if rr := get("format=png"); rr.Code != http.StatusBadRequest {
+		t.Errorf("format=png: %d", rr.Code)
+	}
+}
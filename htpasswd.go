@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// htpasswdFile holds the users of an htpasswd file (-htpasswd) and reloads
+// them when the file changes, so credentials can be added or revoked
+// without a restart
+type htpasswdFile struct {
+	path string
+
+	mu      sync.Mutex
+	users   map[string][]byte
+	modTime time.Time
+	size    int64
+	// unknown is compared against for users that do not exist, at the
+	// highest cost of the users, so the response time does not tell
+	// whether a user exists
+	unknown []byte
+}
+
+// loadHtpasswd reads the htpasswd file at path
+func loadHtpasswd(path string) (*htpasswdFile, error) {
+	h := &htpasswdFile{path: path}
+	if err := h.reload(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// parseHtpasswd parses "user:hash" lines, skipping blank lines and comments.
+// Only bcrypt hashes (htpasswd -B) are accepted.
+func parseHtpasswd(data string) (map[string][]byte, error) {
+	users := make(map[string][]byte)
+	scanner := bufio.NewScanner(strings.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, hash, ok := strings.Cut(line, ":")
+		if !ok || user == "" {
+			return nil, fmt.Errorf("line %d: expected user:hash", n)
+		}
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, fmt.Errorf("line %d: user %s does not have a bcrypt hash (create it with htpasswd -B)", n, user)
+		}
+		if _, dup := users[user]; dup {
+			return nil, fmt.Errorf("line %d: duplicate user %s", n, user)
+		}
+		users[user] = []byte(hash)
+	}
+	return users, scanner.Err()
+}
+
+// reload re-reads the file if it changed since it was last read
+func (h *htpasswdFile) reload() error {
+	info, err := os.Stat(h.path)
+	if err != nil {
+		return err
+	}
+	if h.users != nil && info.ModTime().Equal(h.modTime) && info.Size() == h.size {
+		return nil
+	}
+
+	data, err := os.ReadFile(h.path)
+	if err != nil {
+		return err
+	}
+	users, err := parseHtpasswd(string(data))
+	if err != nil {
+		return fmt.Errorf("%s: %v", h.path, err)
+	}
+	cost := bcrypt.MinCost
+	for _, hash := range users {
+		if c, _ := bcrypt.Cost(hash); c > cost {
+			cost = c
+		}
+	}
+	if c, err := bcrypt.Cost(h.unknown); err != nil || c != cost {
+		if h.unknown, err = bcrypt.GenerateFromPassword([]byte("unknown user"), cost); err != nil {
+			return err
+		}
+	}
+	if h.users != nil {
+		log.Printf("Reloaded %d users from %s", len(users), h.path)
+	}
+	h.users, h.modTime, h.size = users, info.ModTime(), info.Size()
+	return nil
+}
+
+// check verifies the password of user. A file that became unreadable or
+// invalid keeps the users it had, so a bad edit does not lock everyone out.
+func (h *htpasswdFile) check(user, password string) bool {
+	h.mu.Lock()
+	if err := h.reload(); err != nil {
+		log.Printf("Failed to reload credentials, keeping the previous ones: %v", err)
+	}
+	hash, ok := h.users[user]
+	if !ok {
+		hash = h.unknown
+	}
+	h.mu.Unlock()
+
+	match := bcrypt.CompareHashAndPassword(hash, []byte(password)) == nil
+	return ok && match
+}
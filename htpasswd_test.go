@@ -0,0 +1,139 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// bcryptHash hashes password at the minimum cost to keep tests fast
+func bcryptHash(t *testing.T, password string) string {
+	t.Helper()
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(hash)
+}
+
+func TestParseHtpasswd(t *testing.T) {
+	hash := bcryptHash(t, "secret")
+	tests := []struct {
+		name      string
+		data      string
+		wantUsers int
+		wantErr   bool
+	}{
+		{"users", "# teams\nredis:" + hash + "\n\nsre:" + hash + "\n", 2, false},
+		{"empty", "", 0, false},
+		{"apr1", "redis:$apr1$abcdefgh$0123456789abcdefghijkl\n", 0, true},
+		{"sha1", "redis:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\n", 0, true},
+		{"no hash", "redis\n", 0, true},
+		{"duplicate", "redis:" + hash + "\nredis:" + hash + "\n", 0, true},
+	}
+	for _, tt := range tests {
+		users, err := parseHtpasswd(tt.data)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: parseHtpasswd() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if len(users) != tt.wantUsers {
+			t.Errorf("%s: %d users, want %d", tt.name, len(users), tt.wantUsers)
+		}
+	}
+}
+
+func TestHtpasswdReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	write := func(data string, mtime time.Time) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	start := time.Now().Add(-time.Hour)
+	write("redis:"+bcryptHash(t, "one")+"\nsre:"+bcryptHash(t, "two")+"\n", start)
+	users, err := loadHtpasswd(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !users.check("redis", "one") || !users.check("sre", "two") {
+		t.Error("valid credentials were rejected")
+	}
+	if users.check("redis", "two") || users.check("nobody", "one") {
+		t.Error("invalid credentials were accepted")
+	}
+	// Unknown users cost a bcrypt comparison like known ones
+	if cost, err := bcrypt.Cost(users.unknown); err != nil || cost != bcrypt.MinCost {
+		t.Errorf("unknown user hash cost = %d, %v", cost, err)
+	}
+	costly, err := bcrypt.GenerateFromPassword([]byte("two"), bcrypt.MinCost+1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	write("redis:"+bcryptHash(t, "one")+"\nsre:"+string(costly)+"\n", start.Add(30*time.Second))
+	if users.check("nobody", "one") {
+		t.Error("unknown user was accepted")
+	}
+	if cost, _ := bcrypt.Cost(users.unknown); cost != bcrypt.MinCost+1 {
+		t.Errorf("unknown user hash cost = %d, want the highest cost of the users", cost)
+	}
+
+	// Revoking a user takes effect without a restart
+	write("sre:"+bcryptHash(t, "two")+"\n", start.Add(time.Minute))
+	if users.check("redis", "one") {
+		t.Error("revoked user was accepted")
+	}
+	if !users.check("sre", "two") {
+		t.Error("remaining user was rejected")
+	}
+
+	// A broken edit keeps the previous users
+	write("sre:plaintext\n", start.Add(2*time.Minute))
+	if !users.check("sre", "two") {
+		t.Error("user was rejected after an invalid edit")
+	}
+
+	if _, err := loadHtpasswd(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("loadHtpasswd of a missing file succeeded")
+	}
+}
+
+func TestCheckBasicAuth(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	if err := os.WriteFile(path, []byte("redis:"+bcryptHash(t, "secret")+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	users, err := loadHtpasswd(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := checkBasicAuth(func(w http.ResponseWriter, r *http.Request) {}, users.check)
+
+	tests := []struct {
+		user, password string
+		wantCode       int
+	}{
+		{"redis", "secret", http.StatusOK},
+		{"redis", "wrong", http.StatusUnauthorized},
+		{"admin", "secret", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/debug/pprof/profile", nil)
+		req.SetBasicAuth(tt.user, tt.password)
+		rr := httptest.NewRecorder()
+		handler(rr, req)
+		if rr.Code != tt.wantCode {
+			t.Errorf("%s:%s: status = %d, want %d", tt.user, tt.password, rr.Code, tt.wantCode)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"github.com/google/pprof/profile"
+)
+
+// ipcEvents are the perf events of event=ipc, sampled independently at the
+// capture frequency
+var ipcEvents = []string{"cycles", "instructions"}
+
+// ipcWeights counts the instructions and cycles behind every sample, its
+// period, with cycles last as the default so flamegraphs show where the
+// time goes
+func ipcWeights() *sampleWeights {
+	return &sampleWeights{
+		Types: []*profile.ValueType{
+			{Type: "instructions", Unit: "count"},
+			{Type: "cycles", Unit: "count"},
+		},
+		Default:    "cycles",
+		PeriodType: &profile.ValueType{Type: "cycles", Unit: "count"},
+		Values: func(s perfSample) []int64 {
+			n := int64(s.Period)
+			if perfEventName(s.Event) == "instructions" {
+				return []int64{n, 0}
+			}
+			return []int64{0, n}
+		},
+	}
+}
+
+// ipcIndexes returns the indexes of the instructions and cycles sample
+// types of p, or false when it does not count both
+func ipcIndexes(p *profile.Profile) (instructions, cycles int, ok bool) {
+	instructions, cycles = -1, -1
+	for i, st := range p.SampleType {
+		switch st.Type {
+		case "instructions":
+			instructions = i
+		case "cycles":
+			cycles = i
+		}
+	}
+	return instructions, cycles, instructions >= 0 && cycles >= 0
+}
+
+// instructionsPerCycle returns instructions / cycles, or nil without cycles
+func instructionsPerCycle(instructions, cycles int64) *float64 {
+	if cycles == 0 {
+		return nil
+	}
+	ipc := float64(instructions) / float64(cycles)
+	return &ipc
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// libjvmRe matches the HotSpot and OpenJ9 JVM libraries
+var libjvmRe = regexp.MustCompile(`/libj9vm[0-9]*\.so$|/libjvm\.so$`)
+
+// isJavaProcess reports whether pid runs a JVM, by looking for libjvm in its
+// mappings so custom launchers are detected as well as plain java
+func isJavaProcess(pid int) bool {
+	return mapsLibrary(pid, libjvmRe)
+}
+
+// readUID returns the real user ID of process pid
+func readUID(pid int) (int, error) {
+	return readStatusID(pid, "Uid")
+}
+
+// readGID returns the real group ID of process pid
+func readGID(pid int) (int, error) {
+	return readStatusID(pid, "Gid")
+}
+
+// readStatusID returns the real ID from the Uid or Gid line of /proc/<pid>/status
+func readStatusID(pid int, key string) (int, error) {
+	data, err := os.ReadFile(filepath.Join(procRoot, strconv.Itoa(pid), "status"))
+	if err != nil {
+		return 0, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if rest, ok := strings.CutPrefix(line, key+":"); ok {
+			fields := strings.Fields(rest)
+			if len(fields) > 0 {
+				return strconv.Atoi(fields[0])
+			}
+		}
+	}
+	return 0, fmt.Errorf("no %s in /proc/%d/status", key, pid)
+}
+
+// javaPerfMapCommand returns the command that writes the perf map of JVM pid:
+// the jcmd of the JVM itself (JDK 17+), jcmd from PATH or perf-map-agent.
+// jcmd must run as the JVM's user to attach to it.
+func javaPerfMapCommand(pid int) (*exec.Cmd, error) {
+	uid, err := readUID(pid)
+	if err != nil {
+		return nil, err
+	}
+	gid, err := readGID(pid)
+	if err != nil {
+		return nil, err
+	}
+	jcmdCommand := func(jcmd string) *exec.Cmd {
+		return userCommand(uid, gid, jcmd, strconv.Itoa(pid), "Compiler.perfmap")
+	}
+
+	if exe, err := os.Readlink(filepath.Join(procRoot, strconv.Itoa(pid), "exe")); err == nil {
+		jcmd := filepath.Join(filepath.Dir(exe), "jcmd")
+		if _, err := os.Stat(jcmd); err == nil {
+			return jcmdCommand(jcmd), nil
+		}
+	}
+	if jcmd, err := exec.LookPath("jcmd"); err == nil {
+		return jcmdCommand(jcmd), nil
+	}
+	if agent, err := exec.LookPath("create-java-perf-map.sh"); err == nil {
+		return exec.Command(agent, strconv.Itoa(pid)), nil
+	}
+	if home := os.Getenv("PERF_MAP_AGENT_HOME"); home != "" {
+		agent := filepath.Join(home, "bin", "create-java-perf-map.sh")
+		if _, err := os.Stat(agent); err == nil {
+			return exec.Command(agent, strconv.Itoa(pid)), nil
+		}
+	}
+	return nil, fmt.Errorf("neither jcmd nor perf-map-agent (create-java-perf-map.sh) is available")
+}
+
+// generateJavaPerfMap writes /tmp/perf-<pid>.map for a JVM so its JIT
+// compiled frames are symbolized instead of showing as hex addresses
+func generateJavaPerfMap(pid int) error {
+	cmd, err := javaPerfMapCommand(pid)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Generating perf map for JVM %d: %s", pid, strings.Join(cmd.Args, " "))
+	var stderr bytes.Buffer
+	cmd.Stdout = &stderr
+	cmd.Stderr = &stderr
+	if err := runJob(cmd, jobGrace); err != nil {
+		return fmt.Errorf("%s failed: %v: %s", strings.Join(cmd.Args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	if _, err := os.Stat(perfMapPath(pid)); err != nil {
+		return fmt.Errorf("%s was not written", perfMapPath(pid))
+	}
+	return nil
+}
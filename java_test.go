@@ -0,0 +1,83 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestIsJavaProcess(t *testing.T) {
+	writeFakeProc(t, map[int]int{42: 1, 43: 1, 44: 1})
+
+	maps := map[int]string{
+		42: "7f0000000000-7f0000100000 r-xp 00000000 08:01 1234 /usr/lib/jvm/java-17-openjdk-amd64/lib/server/libjvm.so\n",
+		43: "55d000000000-55d000100000 r-xp 00000000 08:01 99 /usr/bin/redis-server\n",
+	}
+	for pid, content := range maps {
+		if err := os.WriteFile(filepath.Join(procRoot, strconv.Itoa(pid), "maps"), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		pid  int
+		want bool
+	}{
+		{42, true},
+		{43, false},
+		{44, false}, // no maps file
+		{999, false},
+	}
+	for _, tt := range tests {
+		if got := isJavaProcess(tt.pid); got != tt.want {
+			t.Errorf("isJavaProcess(%d) = %v, want %v", tt.pid, got, tt.want)
+		}
+	}
+}
+
+func TestJavaPerfMapCommand(t *testing.T) {
+	writeFakeProc(t, map[int]int{42: 1})
+	pidDir := filepath.Join(procRoot, "42")
+
+	status := "Name:\tjava\nUid:\t1001\t1001\t1001\t1001\nGid:\t1001\t1001\t1001\t1001\n"
+	if err := os.WriteFile(filepath.Join(pidDir, "status"), []byte(status), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// jcmd shipped with the target JVM is preferred over PATH
+	jdk := filepath.Join(t.TempDir(), "bin")
+	if err := os.MkdirAll(jdk, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(jdk, "jcmd"), nil, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(jdk, "java"), filepath.Join(pidDir, "exe")); err != nil {
+		t.Fatal(err)
+	}
+
+	setEscalation(t, "sudo")
+	cmd, err := javaPerfMapCommand(42)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"sudo", "-u", "#1001", filepath.Join(jdk, "jcmd"), "42", "Compiler.perfmap"}
+	if !reflect.DeepEqual(cmd.Args, want) {
+		t.Errorf("javaPerfMapCommand = %q, want %q", cmd.Args, want)
+	}
+
+	// Without sudo the exporter switches to the JVM's user itself
+	setEscalation(t, "none")
+	if cmd, err = javaPerfMapCommand(42); err != nil {
+		t.Fatal(err)
+	}
+	if cmd.Args[0] != filepath.Join(jdk, "jcmd") || cmd.SysProcAttr == nil || cmd.SysProcAttr.Credential.Uid != 1001 {
+		t.Errorf("javaPerfMapCommand = %q with %+v, want jcmd as uid 1001", cmd.Args, cmd.SysProcAttr)
+	}
+
+	if _, err := javaPerfMapCommand(999); err == nil {
+		t.Error("javaPerfMapCommand for a missing process succeeded")
+	}
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// progressInterval is how often a recording job reports its progress
+var progressInterval = time.Second
+
+// jobRetention is how long the events of a finished job stay available;
+// afterwards the events endpoint answers from the stored profile
+var jobRetention = 5 * time.Minute
+
+// sseKeepalive is how often an idle event stream gets a comment, so proxies
+// do not time it out while a conversion runs
+var sseKeepalive = 15 * time.Second
+
+// jobEvent is one progress event of a background capture
+type jobEvent struct {
+	// Event is "recording", "progress", "converting", "done" or "failed"
+	Event     string    `json:"event"`
+	Time      time.Time `json:"time"`
+	ProfileID string    `json:"profile_id"`
+	// Elapsed is how many seconds of the capture are over
+	Elapsed int `json:"elapsed"`
+	Seconds int `json:"seconds"`
+	// RecordedBytes is the size of perf.data so far, which grows with the
+	// samples perf collects; absent for BCC, which reports at the end
+	RecordedBytes int64 `json:"recorded_bytes,omitempty"`
+	// Samples is the number of samples in the stored profile, on "done"
+	Samples int64 `json:"samples,omitempty"`
+	// Message is the error, on "failed"
+	Message string `json:"message,omitempty"`
+}
+
+// terminal reports whether no event follows e
+func (e jobEvent) terminal() bool {
+	return e.Event == "done" || e.Event == "failed"
+}
+
+// jobProgress collects the events of one background capture. A nil
+// *jobProgress ignores all calls, for captures that are not tracked.
+type jobProgress struct {
+	id      string
+	seconds int
+
+	mu      sync.Mutex
+	start   time.Time
+	phase   string
+	events  []jobEvent
+	changed chan struct{} // closed and replaced on every event
+	stop    chan struct{} // ends the recording ticker
+}
+
+// jobRegistry holds the running and recently finished background captures
+type jobRegistry struct {
+	mu   sync.Mutex
+	byID map[string]*jobProgress
+}
+
+// jobs tracks the captures of the Alertmanager receiver, the watchdog and
+// the Redis watcher
+var jobs = &jobRegistry{byID: make(map[string]*jobProgress)}
+
+// start registers the capture that will be stored as profile id
+func (reg *jobRegistry) start(id string, seconds int) *jobProgress {
+	job := &jobProgress{id: id, seconds: seconds, changed: make(chan struct{})}
+	reg.mu.Lock()
+	reg.byID[id] = job
+	reg.mu.Unlock()
+	return job
+}
+
+// get returns the job of profile id, or nil
+func (reg *jobRegistry) get(id string) *jobProgress {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	return reg.byID[id]
+}
+
+// forget drops the job of profile id
+func (reg *jobRegistry) forget(id string) {
+	reg.mu.Lock()
+	delete(reg.byID, id)
+	reg.mu.Unlock()
+}
+
+// emit appends e to the events; j.mu must be held
+func (j *jobProgress) emit(e jobEvent) {
+	e.Time = time.Now().UTC()
+	e.ProfileID = j.id
+	e.Seconds = j.seconds
+	if !j.start.IsZero() {
+		e.Elapsed = min(int(time.Since(j.start)/time.Second), j.seconds)
+	}
+	j.phase = e.Event
+	j.events = append(j.events, e)
+	close(j.changed)
+	j.changed = make(chan struct{})
+}
+
+// recording reports that the profiler starts, and then the growth of
+// perf.data in dir every progressInterval until the next phase
+func (j *jobProgress) recording(dir string) {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	j.start = time.Now()
+	j.stop = make(chan struct{})
+	j.emit(jobEvent{Event: "recording"})
+	stop := j.stop
+	j.mu.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(progressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+			e := jobEvent{Event: "progress"}
+			if fi, err := os.Stat(filepath.Join(dir, "perf.data")); err == nil {
+				e.RecordedBytes = fi.Size()
+			}
+			j.mu.Lock()
+			if j.phase == "recording" || j.phase == "progress" {
+				j.emit(e)
+			}
+			j.mu.Unlock()
+		}
+	}()
+}
+
+// endRecording stops the recording ticker; j.mu must be held
+func (j *jobProgress) endRecording() {
+	if j.stop != nil {
+		close(j.stop)
+		j.stop = nil
+	}
+}
+
+// converting reports that the recording is over and is being converted
+func (j *jobProgress) converting() {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.endRecording()
+	j.emit(jobEvent{Event: "converting"})
+}
+
+// finish reports the outcome of the capture and forgets the job after
+// jobRetention
+func (j *jobProgress) finish(samples int64, err error) {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	j.endRecording()
+	if err != nil {
+		j.emit(jobEvent{Event: "failed", Message: err.Error()})
+	} else {
+		j.emit(jobEvent{Event: "done", Samples: samples})
+	}
+	j.mu.Unlock()
+
+	time.AfterFunc(jobRetention, func() { jobs.forget(j.id) })
+}
+
+// eventsSince returns the events after the first n, a channel closed when
+// more arrive and whether the job is over
+func (j *jobProgress) eventsSince(n int) ([]jobEvent, <-chan struct{}, bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	n = min(max(n, 0), len(j.events))
+	over := len(j.events) > 0 && j.events[len(j.events)-1].terminal()
+	return append([]jobEvent(nil), j.events[n:]...), j.changed, over
+}
+
+// profileSamples counts the samples of a pprof or folded capture, 0 for
+// other formats
+func profileSamples(format string, data []byte) int64 {
+	if format != "pprof" && format != "folded" {
+		return 0
+	}
+	p, err := parseProfileData(data)
+	if err != nil {
+		return 0
+	}
+	_, total := topFunctionsOf(p, 0)
+	return total
+}
+
+// writeEvent sends e as the server-sent event number seq
+func writeEvent(w http.ResponseWriter, seq int, e jobEvent) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", seq, e.Event, data)
+	return err
+}
+
+// handleProfileEvents streams the progress of the background capture that
+// produces profile id as server-sent events, until it is done or failed.
+// Reconnecting clients resume after their Last-Event-ID.
+func handleProfileEvents(w http.ResponseWriter, r *http.Request) {
+	if !requireStore(w) {
+		return
+	}
+	id := r.PathValue("id")
+	job := jobs.get(id)
+	if job == nil {
+		meta, err := store.Get(id)
+		if err != nil {
+			http.Error(w, "Profile not found", http.StatusNotFound)
+			return
+		}
+		// Long finished: the stored profile is all that is left
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		writeEvent(w, 1, jobEvent{Event: "done", Time: meta.CreatedAt, ProfileID: meta.ID, Elapsed: meta.Duration, Seconds: meta.Duration})
+		return
+	}
+
+	sent, _ := strconv.Atoi(r.Header.Get("Last-Event-ID"))
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// Keep nginx from buffering the stream
+	w.Header().Set("X-Accel-Buffering", "no")
+	rc := http.NewResponseController(w)
+
+	keepalive := time.NewTicker(sseKeepalive)
+	defer keepalive.Stop()
+	for {
+		events, changed, over := job.eventsSince(sent)
+		for _, e := range events {
+			sent++
+			if err := writeEvent(w, sent, e); err != nil {
+				return
+			}
+		}
+		if over {
+			rc.Flush()
+			return
+		}
+		if err := rc.Flush(); err != nil {
+			log.Printf("Failed to flush events of profile %s: %v", id, err)
+			return
+		}
+
+		select {
+		case <-changed:
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
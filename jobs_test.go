@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readEvents parses a server-sent event stream into its ids and events
+func readEvents(t *testing.T, body string) ([]string, []jobEvent) {
+	t.Helper()
+	var ids []string
+	var events []jobEvent
+	scanner := bufio.NewScanner(strings.NewReader(body))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if id, ok := strings.CutPrefix(line, "id: "); ok {
+			ids = append(ids, id)
+		}
+		if data, ok := strings.CutPrefix(line, "data: "); ok {
+			var e jobEvent
+			if err := json.Unmarshal([]byte(data), &e); err != nil {
+				t.Fatalf("event %q: %v", data, err)
+			}
+			events = append(events, e)
+		}
+	}
+	return ids, events
+}
+
+func eventNames(events []jobEvent) []string {
+	var names []string
+	for _, e := range events {
+		if len(names) == 0 || names[len(names)-1] != e.Event {
+			names = append(names, e.Event)
+		}
+	}
+	return names
+}
+
+func getEvents(id, lastEventID string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", "/api/v1/profiles/"+id+"/events", nil)
+	req.SetPathValue("id", id)
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+	rr := httptest.NewRecorder()
+	handleProfileEvents(rr, req)
+	return rr
+}
+
+func TestCaptureToStoreEvents(t *testing.T) {
+	withTestStore(t)
+	fakeProfileBPFCC(t, `sleep 0.3; echo "main;run 5"; echo "main;idle 2"`)
+	orig := progressInterval
+	t.Cleanup(func() { progressInterval = orig })
+	progressInterval = 50 * time.Millisecond
+
+	pid := strconv.Itoa(os.Getppid())
+	meta, err := captureToStore(profileOptions{PID: pid, Duration: 1}, profileMeta{Format: "folded", PID: pid})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := getEvents(meta.ID, "")
+	if ct := rr.Header().Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	ids, events := readEvents(t, rr.Body.String())
+	if got := strings.Join(eventNames(events), ","); got != "recording,progress,done" {
+		t.Fatalf("events = %s", got)
+	}
+	last := events[len(events)-1]
+	if last.ProfileID != meta.ID || last.Samples != 7 || last.Seconds != 1 {
+		t.Errorf("done event = %+v", last)
+	}
+
+	// A client reconnecting after the last but one event gets the last one
+	rr = getEvents(meta.ID, ids[len(ids)-2])
+	if _, resumed := readEvents(t, rr.Body.String()); len(resumed) != 1 || resumed[0].Event != "done" {
+		t.Errorf("resumed events = %+v", resumed)
+	}
+}
+
+func TestCaptureToStoreFailedEvent(t *testing.T) {
+	withTestStore(t)
+	fakeProfileBPFCC(t, `echo "no BPF for you" >&2; exit 1`)
+
+	pid := strconv.Itoa(os.Getppid())
+	meta, err := captureToStore(profileOptions{PID: pid, Duration: 1}, profileMeta{ID: "00112233445566ff", Format: "folded", PID: pid})
+	if err == nil {
+		t.Fatal("capture succeeded")
+	}
+	_, events := readEvents(t, getEvents(meta.ID, "").Body.String())
+	if last := events[len(events)-1]; last.Event != "failed" || !strings.Contains(last.Message, "no BPF for you") {
+		t.Errorf("last event = %+v", last)
+	}
+}
+
+func TestProfileEventsStream(t *testing.T) {
+	withTestStore(t)
+	job := jobs.start("0123456789abcdef", 10)
+	t.Cleanup(func() { jobs.forget(job.id) })
+	job.recording(t.TempDir())
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/v1/profiles/{id}/events", handleProfileEvents)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	resp, err := http.Get(srv.URL + "/api/v1/profiles/" + job.id + "/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	// The recording event arrives before the capture is over
+	br := bufio.NewReader(resp.Body)
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line == "event: recording\n" {
+			break
+		}
+	}
+
+	job.converting()
+	job.finish(3, nil)
+	rest := new(strings.Builder)
+	if _, err := br.WriteTo(rest); err != nil {
+		t.Fatal(err)
+	}
+	_, events := readEvents(t, rest.String())
+	if got := strings.Join(eventNames(events), ","); !strings.HasSuffix(got, "converting,done") {
+		t.Errorf("events after recording = %s", got)
+	}
+}
+
+func TestProfileEventsStored(t *testing.T) {
+	s := withTestStore(t)
+	meta, err := s.Save(profileMeta{Format: "folded", PID: "1", Duration: 10}, strings.NewReader("main 1\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, events := readEvents(t, getEvents(meta.ID, "").Body.String())
+	if len(events) != 1 || events[0].Event != "done" || events[0].ProfileID != meta.ID || events[0].Seconds != 10 {
+		t.Errorf("events of a stored profile = %+v", events)
+	}
+
+	if rr := getEvents("ffffffffffffffff", ""); rr.Code != http.StatusNotFound {
+		t.Errorf("unknown profile: status %d", rr.Code)
+	}
+}
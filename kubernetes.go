@@ -0,0 +1,463 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// profileJobAPI is the API group and version of the ProfileJob
+	// custom resource
+	profileJobAPI = "profiling.bcc-exporter.io/v1alpha1"
+	// serviceAccountDir holds the credentials of the pod's service account
+	serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+)
+
+// kubernetesConfig is the kubernetes section of the configuration file: the
+// controller that runs the captures of ProfileJob resources
+type kubernetesConfig struct {
+	// Controller enables the ProfileJob controller
+	Controller bool `json:"controller"`
+	// NodeName is the node the exporter runs on; only the jobs of this node
+	// are run (default $NODE_NAME)
+	NodeName string `json:"node_name"`
+	// Namespace limits the jobs to one namespace (default all)
+	Namespace string `json:"namespace,omitempty"`
+	// APIServer, TokenFile and CAFile reach the API server (default the
+	// in-cluster configuration of the pod's service account)
+	APIServer string `json:"api_server,omitempty"`
+	TokenFile string `json:"token_file,omitempty"`
+	CAFile    string `json:"ca_file,omitempty"`
+}
+
+func (c *kubernetesConfig) validate() error {
+	if !c.Controller {
+		return nil
+	}
+	if c.NodeName == "" {
+		c.NodeName = os.Getenv("NODE_NAME")
+	}
+	if c.NodeName == "" {
+		return fmt.Errorf("node_name or $NODE_NAME is required, e.g. from the downward API field spec.nodeName")
+	}
+	if c.APIServer == "" {
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" || port == "" {
+			return fmt.Errorf("api_server is required outside of a pod")
+		}
+		c.APIServer = "https://" + net.JoinHostPort(host, port)
+	}
+	if u, err := url.Parse(c.APIServer); err != nil || u.Scheme != "https" && u.Scheme != "http" || u.Host == "" {
+		return fmt.Errorf("api_server is not a URL")
+	}
+	c.APIServer = strings.TrimSuffix(c.APIServer, "/")
+	if c.TokenFile == "" {
+		c.TokenFile = serviceAccountDir + "/token"
+	}
+	if c.CAFile == "" && strings.HasPrefix(c.APIServer, "https://") {
+		c.CAFile = serviceAccountDir + "/ca.crt"
+	}
+	return nil
+}
+
+// profileJob is a ProfileJob resource: captures to run on one node
+type profileJob struct {
+	Metadata struct {
+		Name            string `json:"name"`
+		Namespace       string `json:"namespace"`
+		UID             string `json:"uid"`
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Spec   profileJobSpec   `json:"spec"`
+	Status profileJobStatus `json:"status"`
+}
+
+// profileJobSpec selects the node and the processes to profile; exactly one
+// of PID, RedisPort or Comm selects the processes
+type profileJobSpec struct {
+	NodeName  string `json:"nodeName"`
+	PID       int    `json:"pid,omitempty"`
+	RedisPort int    `json:"redisPort,omitempty"`
+	Comm      string `json:"comm,omitempty"`
+	// Container is the container PID is given in
+	Container string            `json:"container,omitempty"`
+	Seconds   int               `json:"seconds,omitempty"`
+	Format    string            `json:"format,omitempty"`
+	Labels    map[string]string `json:"labels,omitempty"`
+}
+
+// profileJobStatus is what the controller reports back on the resource
+type profileJobStatus struct {
+	// Phase is Running, Succeeded or Failed; jobs without a phase are
+	// waiting for their node's exporter
+	Phase          string     `json:"phase,omitempty"`
+	Message        string     `json:"message,omitempty"`
+	ProfileIDs     []string   `json:"profileIDs,omitempty"`
+	StartTime      *time.Time `json:"startTime,omitempty"`
+	CompletionTime *time.Time `json:"completionTime,omitempty"`
+}
+
+// name returns the namespace/name of the job
+func (j *profileJob) name() string {
+	return j.Metadata.Namespace + "/" + j.Metadata.Name
+}
+
+// validate checks the spec and fills in its defaults
+func (s *profileJobSpec) validate() error {
+	set := 0
+	for _, ok := range []bool{s.PID != 0, s.RedisPort != 0, s.Comm != ""} {
+		if ok {
+			set++
+		}
+	}
+	if set != 1 {
+		return fmt.Errorf("exactly one of pid, redisPort or comm is required")
+	}
+	if s.Container != "" && s.PID == 0 {
+		return fmt.Errorf("container requires pid")
+	}
+	if s.Seconds == 0 {
+		s.Seconds = 30
+	}
+	if s.Seconds < 0 || s.Seconds > 300 {
+		return fmt.Errorf("seconds must be between 1 and 300")
+	}
+	switch s.Format {
+	case "":
+		s.Format = "pprof"
+	case "pprof", "folded":
+	default:
+		return fmt.Errorf("format must be pprof or folded")
+	}
+	return validateLabels(s.Labels)
+}
+
+// kubeClient sends requests to the API server with the service account
+// token, read again for every request as kubelet rotates it
+type kubeClient struct {
+	cfg    kubernetesConfig
+	client *http.Client
+}
+
+func newKubeClient(cfg kubernetesConfig) (*kubeClient, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if cfg.CAFile != "" {
+		pem, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("ca_file: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("ca_file: no certificates in %s", cfg.CAFile)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	return &kubeClient{cfg: cfg, client: &http.Client{Transport: transport}}, nil
+}
+
+// do sends a request to path of the API server and fails on error statuses
+func (kc *kubeClient) do(ctx context.Context, method, path, contentType string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, kc.cfg.APIServer+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	req.Header.Set("Accept", "application/json")
+	if token, err := os.ReadFile(kc.cfg.TokenFile); err == nil {
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("token_file: %v", err)
+	}
+	resp, err := kc.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		var status struct{ Message string }
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		if json.Unmarshal(data, &status) != nil || status.Message == "" {
+			status.Message = strings.TrimSpace(string(data))
+		}
+		return nil, &kubeError{resp.StatusCode, status.Message}
+	}
+	return resp, nil
+}
+
+// kubeError is an error status of the API server
+type kubeError struct {
+	Status  int
+	Message string
+}
+
+func (e *kubeError) Error() string {
+	return fmt.Sprintf("%d %s: %s", e.Status, http.StatusText(e.Status), e.Message)
+}
+
+// jobsPath returns the path of the ProfileJob collection the controller
+// watches
+func (kc *kubeClient) jobsPath() string {
+	if kc.cfg.Namespace != "" {
+		return "/apis/" + profileJobAPI + "/namespaces/" + url.PathEscape(kc.cfg.Namespace) + "/profilejobs"
+	}
+	return "/apis/" + profileJobAPI + "/profilejobs"
+}
+
+// profileJobController runs the ProfileJobs of its node as they appear
+type profileJobController struct {
+	kc *kubeClient
+
+	mu      sync.Mutex
+	running map[string]bool // UIDs of the jobs being run
+
+	// capture takes and stores one profile; replaced in tests
+	capture func(opts profileOptions, meta profileMeta) (profileMeta, error)
+	// wg tracks the jobs being run, for tests
+	wg sync.WaitGroup
+}
+
+func newProfileJobController(cfg kubernetesConfig) (*profileJobController, error) {
+	kc, err := newKubeClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &profileJobController{kc: kc, running: map[string]bool{}, capture: captureToStore}, nil
+}
+
+// run lists and watches the ProfileJobs until ctx is done, listing again
+// after the watch ends or fails
+func (c *profileJobController) run(ctx context.Context) {
+	for ctx.Err() == nil {
+		version, err := c.list(ctx)
+		if err == nil {
+			err = c.watch(ctx, version)
+		}
+		if err != nil && ctx.Err() == nil {
+			log.Printf("ProfileJob controller: %v", err)
+			select {
+			case <-ctx.Done():
+			case <-time.After(5 * time.Second):
+			}
+		}
+	}
+}
+
+// list handles every existing job and returns the resource version to watch
+// from
+func (c *profileJobController) list(ctx context.Context) (string, error) {
+	resp, err := c.kc.do(ctx, "GET", c.kc.jobsPath(), "", nil)
+	if err != nil {
+		return "", fmt.Errorf("listing ProfileJobs: %v", err)
+	}
+	defer resp.Body.Close()
+	var list struct {
+		Metadata struct {
+			ResourceVersion string `json:"resourceVersion"`
+		} `json:"metadata"`
+		Items []profileJob `json:"items"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return "", fmt.Errorf("listing ProfileJobs: %v", err)
+	}
+	for i := range list.Items {
+		c.handle(ctx, &list.Items[i])
+	}
+	return list.Metadata.ResourceVersion, nil
+}
+
+// watch handles the jobs added or changed after version until the API
+// server ends the watch
+func (c *profileJobController) watch(ctx context.Context, version string) error {
+	q := url.Values{"watch": {"1"}, "resourceVersion": {version}, "allowWatchBookmarks": {"true"}}
+	resp, err := c.kc.do(ctx, "GET", c.kc.jobsPath()+"?"+q.Encode(), "", nil)
+	if err != nil {
+		return fmt.Errorf("watching ProfileJobs: %v", err)
+	}
+	defer resp.Body.Close()
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var event struct {
+			Type   string          `json:"type"`
+			Object json.RawMessage `json:"object"`
+		}
+		if err := dec.Decode(&event); err != nil {
+			if err == io.EOF || ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("watching ProfileJobs: %v", err)
+		}
+		switch event.Type {
+		case "ADDED", "MODIFIED":
+			var job profileJob
+			if err := json.Unmarshal(event.Object, &job); err != nil {
+				return fmt.Errorf("watching ProfileJobs: %v", err)
+			}
+			c.handle(ctx, &job)
+		case "ERROR":
+			// Typically 410 Gone once version is too old: list again
+			var status struct{ Message string }
+			json.Unmarshal(event.Object, &status)
+			log.Printf("ProfileJob watch ended: %s", status.Message)
+			return nil
+		}
+	}
+}
+
+// handle starts the job if it is a new job of this node
+func (c *profileJobController) handle(ctx context.Context, job *profileJob) {
+	if job.Spec.NodeName != c.kc.cfg.NodeName || job.Status.Phase != "" {
+		return
+	}
+	c.mu.Lock()
+	if c.running[job.Metadata.UID] {
+		c.mu.Unlock()
+		return
+	}
+	c.running[job.Metadata.UID] = true
+	c.mu.Unlock()
+
+	now := time.Now().UTC()
+	if err := job.Spec.validate(); err != nil {
+		c.finish(ctx, job, profileJobStatus{Phase: "Failed", Message: "Invalid spec: " + err.Error(), StartTime: &now, CompletionTime: &now})
+		return
+	}
+	// The resource version makes the claim fail if the job changed since
+	// it was read
+	if err := c.updateStatus(ctx, job, job.Metadata.ResourceVersion, profileJobStatus{Phase: "Running", StartTime: &now}); err != nil {
+		log.Printf("ProfileJob %s: failed to claim: %v", job.name(), err)
+		c.mu.Lock()
+		delete(c.running, job.Metadata.UID)
+		c.mu.Unlock()
+		return
+	}
+	log.Printf("Running ProfileJob %s", job.name())
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		status := c.execute(job)
+		status.StartTime = &now
+		c.finish(ctx, job, status)
+	}()
+}
+
+// finish records the final status of job
+func (c *profileJobController) finish(ctx context.Context, job *profileJob, status profileJobStatus) {
+	done := time.Now().UTC()
+	status.CompletionTime = &done
+	if err := c.updateStatus(ctx, job, "", status); err != nil {
+		log.Printf("ProfileJob %s: failed to update status: %v", job.name(), err)
+	}
+	log.Printf("ProfileJob %s %s: %s", job.name(), strings.ToLower(status.Phase), status.Message)
+	c.mu.Lock()
+	delete(c.running, job.Metadata.UID)
+	c.mu.Unlock()
+}
+
+// updateStatus replaces the status of job with a merge patch, conditional
+// on version when given
+func (c *profileJobController) updateStatus(ctx context.Context, job *profileJob, version string, status profileJobStatus) error {
+	patch := map[string]interface{}{"status": status}
+	if version != "" {
+		patch["metadata"] = map[string]string{"resourceVersion": version}
+	}
+	body, err := json.Marshal(patch)
+	if err != nil {
+		return err
+	}
+	path := "/apis/" + profileJobAPI + "/namespaces/" + url.PathEscape(job.Metadata.Namespace) + "/profilejobs/" + url.PathEscape(job.Metadata.Name) + "/status"
+	resp, err := c.kc.do(ctx, "PATCH", path, "application/merge-patch+json", body)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// jobPIDs returns the host PIDs spec selects
+func jobPIDs(spec profileJobSpec) ([]int, error) {
+	switch {
+	case spec.Container != "":
+		pid, err := translateContainerPID(spec.Container, spec.PID)
+		if err != nil {
+			return nil, err
+		}
+		return []int{pid}, nil
+	case spec.PID != 0:
+		if err := validatePID(strconv.Itoa(spec.PID)); err != nil {
+			return nil, err
+		}
+		return []int{spec.PID}, nil
+	case spec.RedisPort != 0:
+		pid, err := findPIDByPort(spec.RedisPort)
+		if err != nil {
+			return nil, err
+		}
+		return []int{pid}, nil
+	}
+	pids, err := findPIDsByComm(spec.Comm)
+	if err != nil {
+		return nil, err
+	}
+	if len(pids) == 0 {
+		return nil, fmt.Errorf("no process named %s", spec.Comm)
+	}
+	return pids, nil
+}
+
+// execute runs the captures of job one after the other and returns the
+// resulting status: Succeeded when at least one profile was stored
+func (c *profileJobController) execute(job *profileJob) profileJobStatus {
+	pids, err := jobPIDs(job.Spec)
+	if err != nil {
+		return profileJobStatus{Phase: "Failed", Message: err.Error()}
+	}
+	var status profileJobStatus
+	var failures []string
+	for _, pid := range pids {
+		opts := profileOptions{
+			PID:         strconv.Itoa(pid),
+			Duration:    job.Spec.Seconds,
+			Stacks:      "both",
+			CallGraph:   "fp",
+			LBRFallback: "fp",
+		}
+		meta := captureMeta(opts, job.Spec.Format)
+		meta.Trigger = "profilejob"
+		meta.TriggerReason = "ProfileJob " + job.name()
+		meta.Labels = map[string]string{"profilejob": job.name()}
+		for name, value := range job.Spec.Labels {
+			meta.Labels[name] = value
+		}
+		meta, err := c.capture(opts, meta)
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("PID %d: %v", pid, err))
+			continue
+		}
+		status.ProfileIDs = append(status.ProfileIDs, meta.ID)
+	}
+	status.Phase = "Succeeded"
+	if len(status.ProfileIDs) == 0 {
+		status.Phase = "Failed"
+	}
+	status.Message = fmt.Sprintf("%d of %d profiles stored", len(status.ProfileIDs), len(pids))
+	if len(failures) > 0 {
+		status.Message += "; " + strings.Join(failures, "; ")
+	}
+	return status
+}
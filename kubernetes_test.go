@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestKubernetesConfigValidate(t *testing.T) {
+	t.Setenv("NODE_NAME", "")
+	t.Setenv("KUBERNETES_SERVICE_HOST", "")
+	for name, cfg := range map[string]kubernetesConfig{
+		"no node name":  {Controller: true, APIServer: "https://10.0.0.1"},
+		"no api server": {Controller: true, NodeName: "node-1"},
+		"bad server":    {Controller: true, NodeName: "node-1", APIServer: "10.0.0.1:443"},
+	} {
+		if err := cfg.validate(); err == nil {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+
+	t.Setenv("NODE_NAME", "node-1")
+	t.Setenv("KUBERNETES_SERVICE_HOST", "10.96.0.1")
+	t.Setenv("KUBERNETES_SERVICE_PORT", "443")
+	cfg := kubernetesConfig{Controller: true}
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.NodeName != "node-1" || cfg.APIServer != "https://10.96.0.1:443" || cfg.TokenFile != serviceAccountDir+"/token" || cfg.CAFile != serviceAccountDir+"/ca.crt" {
+		t.Errorf("config = %+v", cfg)
+	}
+}
+
+func TestProfileJobSpecValidate(t *testing.T) {
+	for name, spec := range map[string]profileJobSpec{
+		"no target":        {},
+		"two targets":      {PID: 1, Comm: "redis-server"},
+		"container no pid": {Comm: "redis-server", Container: "abc"},
+		"too long":         {PID: 1, Seconds: 301},
+		"bad format":       {PID: 1, Format: "svg"},
+		"bad label":        {PID: 1, Labels: map[string]string{"bad-name": "x"}},
+	} {
+		if err := spec.validate(); err == nil {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+	spec := profileJobSpec{RedisPort: 6379}
+	if err := spec.validate(); err != nil || spec.Seconds != 30 || spec.Format != "pprof" {
+		t.Errorf("defaults: %+v, %v", spec, err)
+	}
+}
+
+// fakeKubeAPI serves a list of ProfileJobs and records the status patches
+type fakeKubeAPI struct {
+	t       *testing.T
+	mu      sync.Mutex
+	patches map[string][]profileJobStatus
+	// conflict answers 409 to the claims of these jobs
+	conflict map[string]bool
+}
+
+func (f *fakeKubeAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bearer t0ken" {
+		http.Error(w, `{"message":"Unauthorized"}`, http.StatusUnauthorized)
+		return
+	}
+	const collection = "/apis/" + profileJobAPI + "/profilejobs"
+	switch {
+	case r.Method == "GET" && r.URL.Path == collection && r.URL.Query().Get("watch") == "":
+		jobs := []string{
+			`{"metadata":{"name":"cpu","namespace":"cache","uid":"1","resourceVersion":"10"},"spec":{"nodeName":"node-1","comm":"redis-server","seconds":5}}`,
+			`{"metadata":{"name":"other-node","namespace":"cache","uid":"2","resourceVersion":"11"},"spec":{"nodeName":"node-2","pid":100}}`,
+			`{"metadata":{"name":"done","namespace":"cache","uid":"3","resourceVersion":"12"},"spec":{"nodeName":"node-1","pid":100},"status":{"phase":"Succeeded"}}`,
+			`{"metadata":{"name":"invalid","namespace":"cache","uid":"4","resourceVersion":"13"},"spec":{"nodeName":"node-1"}}`,
+			`{"metadata":{"name":"taken","namespace":"cache","uid":"5","resourceVersion":"14"},"spec":{"nodeName":"node-1","pid":100}}`,
+		}
+		fmt.Fprintf(w, `{"metadata":{"resourceVersion":"20"},"items":[%s]}`, strings.Join(jobs, ","))
+	case r.Method == "GET" && r.URL.Path == collection:
+		if r.URL.Query().Get("resourceVersion") != "20" {
+			f.t.Errorf("watch from %q", r.URL.Query().Get("resourceVersion"))
+		}
+		io.WriteString(w, `{"type":"ADDED","object":{"metadata":{"name":"missing","namespace":"web","uid":"6","resourceVersion":"21"},"spec":{"nodeName":"node-1","pid":99999}}}`+"\n")
+		io.WriteString(w, `{"type":"ERROR","object":{"kind":"Status","code":410,"message":"too old resource version"}}`+"\n")
+	case r.Method == "PATCH" && strings.HasSuffix(r.URL.Path, "/status"):
+		if r.Header.Get("Content-Type") != "application/merge-patch+json" {
+			f.t.Errorf("patch content type %q", r.Header.Get("Content-Type"))
+		}
+		var patch struct {
+			Metadata struct{ ResourceVersion string }
+			Status   profileJobStatus
+		}
+		json.NewDecoder(r.Body).Decode(&patch)
+		name := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/apis/"+profileJobAPI+"/namespaces/"), "/status")
+		name = strings.Replace(name, "/profilejobs/", "/", 1)
+		if patch.Status.Phase == "Running" && (patch.Metadata.ResourceVersion == "" || f.conflict[name]) {
+			http.Error(w, `{"message":"the object has been modified"}`, http.StatusConflict)
+			return
+		}
+		f.mu.Lock()
+		f.patches[name] = append(f.patches[name], patch.Status)
+		f.mu.Unlock()
+		io.WriteString(w, "{}")
+	default:
+		f.t.Errorf("unexpected request %s %s", r.Method, r.URL)
+		http.NotFound(w, r)
+	}
+}
+
+func TestProfileJobController(t *testing.T) {
+	writeFakeProc(t, map[int]int{100: 1, 101: 1})
+	for _, pid := range []string{"100", "101"} {
+		if err := os.WriteFile(filepath.Join(procRoot, pid, "comm"), []byte("redis-server\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	token := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(token, []byte("t0ken\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	api := &fakeKubeAPI{t: t, patches: map[string][]profileJobStatus{}, conflict: map[string]bool{"cache/taken": true}}
+	srv := httptest.NewServer(api)
+	defer srv.Close()
+
+	cfg := kubernetesConfig{Controller: true, NodeName: "node-1", APIServer: srv.URL, TokenFile: token}
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+	c, err := newProfileJobController(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	var captured []profileMeta
+	c.capture = func(opts profileOptions, meta profileMeta) (profileMeta, error) {
+		if opts.Duration != 5 {
+			t.Errorf("capture of %d seconds", opts.Duration)
+		}
+		if opts.PID == "101" {
+			return meta, fmt.Errorf("refused by the target policy")
+		}
+		meta.ID = "p" + opts.PID
+		mu.Lock()
+		captured = append(captured, meta)
+		mu.Unlock()
+		return meta, nil
+	}
+
+	version, err := c.list(context.Background())
+	if err != nil || version != "20" {
+		t.Fatalf("list: %q, %v", version, err)
+	}
+	if err := c.watch(context.Background(), version); err != nil {
+		t.Fatal(err)
+	}
+	c.wg.Wait()
+
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	for _, name := range []string{"cache/other-node", "cache/done", "cache/taken"} {
+		if len(api.patches[name]) > 0 {
+			t.Errorf("%s patched: %+v", name, api.patches[name])
+		}
+	}
+	cpu := api.patches["cache/cpu"]
+	if len(cpu) != 2 || cpu[0].Phase != "Running" || cpu[0].StartTime == nil {
+		t.Fatalf("cache/cpu status updates = %+v", cpu)
+	}
+	if final := cpu[1]; final.Phase != "Succeeded" || len(final.ProfileIDs) != 1 || final.ProfileIDs[0] != "p100" || !strings.Contains(final.Message, "1 of 2") || final.CompletionTime == nil {
+		t.Errorf("cache/cpu final status = %+v", final)
+	}
+	if len(captured) != 1 || captured[0].Trigger != "profilejob" || captured[0].TriggerReason != "ProfileJob cache/cpu" || captured[0].Labels["profilejob"] != "cache/cpu" {
+		t.Errorf("captured %+v", captured)
+	}
+	if invalid := api.patches["cache/invalid"]; len(invalid) != 1 || invalid[0].Phase != "Failed" || !strings.Contains(invalid[0].Message, "Invalid spec") {
+		t.Errorf("cache/invalid status updates = %+v", invalid)
+	}
+	if missing := api.patches["web/missing"]; len(missing) != 2 || missing[1].Phase != "Failed" || !strings.Contains(missing[1].Message, "does not exist") {
+		t.Errorf("web/missing status updates = %+v", missing)
+	}
+}
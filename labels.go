@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/google/pprof/profile"
+)
+
+// labelNameRe matches the label names accepted on capture requests, the
+// same as Prometheus label names
+var labelNameRe = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+const (
+	// maxLabels bounds the labels of one capture request
+	maxLabels = 16
+	// maxLabelValue bounds the length of a label value
+	maxLabelValue = 256
+)
+
+// parseLabels decodes the label=key:value parameters of a capture request
+func parseLabels(params []string) (map[string]string, error) {
+	if len(params) == 0 {
+		return nil, nil
+	}
+	if len(params) > maxLabels {
+		return nil, fmt.Errorf("Invalid label: at most %d labels are allowed", maxLabels)
+	}
+	labels := make(map[string]string, len(params))
+	for _, param := range params {
+		name, value, ok := strings.Cut(param, ":")
+		if !ok || !labelNameRe.MatchString(name) {
+			return nil, fmt.Errorf("Invalid label %q: must be name:value with a name of letters, digits and underscores", param)
+		}
+		if len(value) > maxLabelValue {
+			return nil, fmt.Errorf("Invalid label %q: values are limited to %d bytes", name, maxLabelValue)
+		}
+		if _, dup := labels[name]; dup {
+			return nil, fmt.Errorf("Invalid label %q: given twice", name)
+		}
+		labels[name] = value
+	}
+	return labels, nil
+}
+
+// validateLabels checks the labels of the configuration file against the
+// rules of capture request labels
+func validateLabels(labels map[string]string) error {
+	if len(labels) > maxLabels {
+		return fmt.Errorf("at most %d labels are allowed", maxLabels)
+	}
+	for name, value := range labels {
+		if !labelNameRe.MatchString(name) {
+			return fmt.Errorf("invalid label name %q: must be letters, digits and underscores", name)
+		}
+		if len(value) > maxLabelValue {
+			return fmt.Errorf("label %q: values are limited to %d bytes", name, maxLabelValue)
+		}
+	}
+	return nil
+}
+
+// withDefaultLabels returns labels completed with the labels section of the
+// configuration in effect; labels given with a capture win
+func withDefaultLabels(labels map[string]string) map[string]string {
+	s := state.Load()
+	if s == nil || len(s.cfg.Labels) == 0 {
+		return labels
+	}
+	merged := make(map[string]string, len(s.cfg.Labels)+len(labels))
+	for name, value := range s.cfg.Labels {
+		merged[name] = value
+	}
+	for name, value := range labels {
+		merged[name] = value
+	}
+	return merged
+}
+
+// userLabels returns the key/value labels of a capture as pprof sample
+// labels, so the profile carries them wherever it is pushed or merged
+func userLabels(labels map[string]string) map[string][]string {
+	sampleLabels := make(map[string][]string, len(labels))
+	for name, value := range labels {
+		sampleLabels[name] = []string{value}
+	}
+	return sampleLabels
+}
+
+// captureLabels returns the labels shared by every sample of a capture that
+// targets a single process (and optionally a single thread): the labels of
+// the request, then the pid, hostname, comm and tid, which take precedence
+func captureLabels(opts profileOptions, hostname string) map[string][]string {
+	labels := userLabels(opts.Labels)
+	labels["pid"] = []string{opts.PID}
+	labels["hostname"] = []string{hostname}
+	if pid, err := strconv.Atoi(opts.PID); err == nil {
+		if comm, err := readComm(pid); err == nil {
+			labels["comm"] = []string{comm}
+		}
+	}
+	if opts.TID != "" {
+		labels["tid"] = []string{opts.TID}
+	}
+	return labels
+}
+
+// sampleLabeler derives per-sample labels for profiles built from perf script
+// output, caching process names so each PID is only looked up once
+type sampleLabeler struct {
+	hostname string
+	comms    map[int]string
+}
+
+func newSampleLabeler(hostname string) *sampleLabeler {
+	return &sampleLabeler{hostname: hostname, comms: make(map[int]string)}
+}
+
+// labels returns the pid, comm, tid, thread and hostname labels of a sample
+func (l *sampleLabeler) labels(s perfSample) map[string][]string {
+	comm, ok := l.comms[s.PID]
+	if !ok {
+		var err error
+		if comm, err = readComm(s.PID); err != nil && s.PID == s.TID {
+			// The process is gone, but the main thread carries its name
+			comm = s.Comm
+		}
+		l.comms[s.PID] = comm
+	}
+
+	labels := map[string][]string{
+		"pid":      {strconv.Itoa(s.PID)},
+		"tid":      {strconv.Itoa(s.TID)},
+		"thread":   {s.Comm},
+		"hostname": {l.hostname},
+	}
+	if comm != "" {
+		labels["comm"] = []string{comm}
+	}
+	return labels
+}
+
+// labelProfileFile adds labels to every sample of the pprof file at path,
+// keeping any value a sample already has for the same key
+func labelProfileFile(path string, labels map[string][]string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	p, err := profile.Parse(f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	for _, s := range p.Sample {
+		if s.Label == nil {
+			s.Label = make(map[string][]string)
+		}
+		for k, v := range labels {
+			if _, ok := s.Label[k]; !ok {
+				s.Label[k] = v
+			}
+		}
+	}
+
+	out, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	return p.Write(out)
+}
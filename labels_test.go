@@ -0,0 +1,189 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/google/pprof/profile"
+)
+
+func TestCaptureLabels(t *testing.T) {
+	writeFakeProc(t, map[int]int{1234: 1})
+	if err := os.WriteFile(filepath.Join(procRoot, "1234", "comm"), []byte("redis-server\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	labels := captureLabels(profileOptions{PID: "1234", TID: "1240"}, "redis-host-1")
+
+	want := map[string]string{
+		"pid":      "1234",
+		"comm":     "redis-server",
+		"tid":      "1240",
+		"hostname": "redis-host-1",
+	}
+	for k, v := range want {
+		if got := labels[k]; len(got) != 1 || got[0] != v {
+			t.Errorf("label %s = %v, want [%s]", k, got, v)
+		}
+	}
+
+	if _, ok := captureLabels(profileOptions{PID: "1234"}, "h")["tid"]; ok {
+		t.Errorf("tid label should only be set when targeting a thread")
+	}
+}
+
+func TestConvertPerfDataThreadLabels(t *testing.T) {
+	dir := fakeTools(t)
+	script := filepath.Join(t.TempDir(), "perf.script")
+	if err := os.WriteFile(script, []byte(samplePerfScript), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "perf"), []byte("#!/bin/sh\ncat "+script+"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// A process capture, without thread_labels, still labels each sample
+	// with the thread it was taken on
+	pprofPath := filepath.Join(t.TempDir(), "profile.pb.gz")
+	if err := convertPerfData(profileOptions{PID: "1234"}, "perf.data", pprofPath); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(pprofPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	p, err := profile.Parse(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tids := map[string]bool{}
+	for _, s := range p.Sample {
+		if len(s.Label["tid"]) != 1 || len(s.Label["pid"]) != 1 {
+			t.Fatalf("sample labels = %v, want a pid and tid", s.Label)
+		}
+		tids[s.Label["tid"][0]] = true
+	}
+	if !tids["1234"] || !tids["1240"] {
+		t.Errorf("tid labels = %v, want 1234 and 1240", tids)
+	}
+
+	// perf script output counts against limits.max_response
+	setLimits(t, limitsConfig{MaxResponse: 64})
+	err = convertPerfData(profileOptions{PID: "1234"}, "perf.data", pprofPath)
+	if ce, ok := err.(*captureError); !ok || ce.Status != http.StatusInsufficientStorage {
+		t.Errorf("oversized perf script output: error = %v", err)
+	}
+}
+
+func TestCaptureLabelsUserLabels(t *testing.T) {
+	labels := captureLabels(profileOptions{PID: "1234", Labels: map[string]string{"incident": "INC-1234", "pid": "1"}}, "h")
+	if got := labels["incident"]; len(got) != 1 || got[0] != "INC-1234" {
+		t.Errorf("incident label = %v", got)
+	}
+	if got := labels["pid"]; len(got) != 1 || got[0] != "1234" {
+		t.Errorf("pid label = %v, want the target's", got)
+	}
+}
+
+func TestDefaultLabels(t *testing.T) {
+	orig := state.Load()
+	defer state.Store(orig)
+	state.Store(&serverState{cfg: &config{Labels: map[string]string{"env": "prod", "service": "redis-cache"}}})
+
+	got := withDefaultLabels(map[string]string{"service": "redis-sessions", "incident": "INC-1234"})
+	want := map[string]string{"env": "prod", "service": "redis-sessions", "incident": "INC-1234"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("withDefaultLabels() = %v, want %v", got, want)
+	}
+
+	if err := validateLabels(map[string]string{"env-name": "prod"}); err == nil {
+		t.Error("invalid label name accepted")
+	}
+}
+
+func TestParseLabels(t *testing.T) {
+	labels, err := parseLabels([]string{"service:redis-cache", "incident:INC-1234", "url:http://x:1"})
+	want := map[string]string{"service": "redis-cache", "incident": "INC-1234", "url": "http://x:1"}
+	if err != nil || !reflect.DeepEqual(labels, want) {
+		t.Errorf("parseLabels() = %v, %v, want %v", labels, err, want)
+	}
+
+	for _, bad := range [][]string{
+		{"service"},
+		{"env-name:prod"},
+		{":prod"},
+		{"env:prod", "env:dev"},
+		{"env:" + strings.Repeat("x", maxLabelValue+1)},
+	} {
+		if _, err := parseLabels(bad); err == nil {
+			t.Errorf("parseLabels(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestSampleLabelerExitedProcess(t *testing.T) {
+	writeFakeProc(t, map[int]int{})
+
+	l := newSampleLabeler("h")
+	if got := l.labels(perfSample{Comm: "redis-rdb-bgsave", PID: 99, TID: 99})["comm"]; len(got) != 1 || got[0] != "redis-rdb-bgsave" {
+		t.Errorf("comm of an exited process should fall back to its main thread name, got %v", got)
+	}
+	if _, ok := l.labels(perfSample{Comm: "worker", PID: 98, TID: 101})["comm"]; ok {
+		t.Errorf("comm should be omitted when it cannot be determined")
+	}
+}
+
+func TestLabelProfileFile(t *testing.T) {
+	fn := &profile.Function{ID: 1, Name: "aeMain"}
+	loc := &profile.Location{ID: 1, Line: []profile.Line{{Function: fn}}}
+	p := &profile.Profile{
+		SampleType: []*profile.ValueType{{Type: "samples", Unit: "count"}},
+		Sample: []*profile.Sample{
+			{Location: []*profile.Location{loc}, Value: []int64{3}},
+			{Location: []*profile.Location{loc}, Value: []int64{1}, Label: map[string][]string{"pid": {"7"}}},
+		},
+		Location: []*profile.Location{loc},
+		Function: []*profile.Function{fn},
+	}
+
+	path := filepath.Join(t.TempDir(), "profile.pb.gz")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Write(f); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	if err := labelProfileFile(path, map[string][]string{"pid": {"1234"}, "hostname": {"h"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err = os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	got, err := profile.Parse(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if pid := got.Sample[0].Label["pid"]; len(pid) != 1 || pid[0] != "1234" {
+		t.Errorf("sample 0 pid label = %v, want [1234]", pid)
+	}
+	if pid := got.Sample[1].Label["pid"]; len(pid) != 1 || pid[0] != "7" {
+		t.Errorf("existing pid label should be kept, got %v", pid)
+	}
+	for i, s := range got.Sample {
+		if host := s.Label["hostname"]; len(host) != 1 || host[0] != "h" {
+			t.Errorf("sample %d hostname label = %v, want [h]", i, host)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+)
+
+// limitsConfig is the limits section of the configuration file, which caps
+// what a capture may write to disk and send back
+type limitsConfig struct {
+	// MaxPerfData is passed to perf record --max-size (default 2G)
+	MaxPerfData byteSize `json:"max_perf_data"`
+	// MaxResponse caps profiler output held in memory and response bodies
+	// (default 512M)
+	MaxResponse byteSize `json:"max_response"`
+}
+
+func (c *limitsConfig) validate() error {
+	if c.MaxPerfData < 0 || c.MaxResponse < 0 {
+		return fmt.Errorf("sizes must not be negative")
+	}
+	if c.MaxPerfData == 0 {
+		c.MaxPerfData = 2 << 30
+	}
+	if c.MaxResponse == 0 {
+		c.MaxResponse = 512 << 20
+	}
+	return nil
+}
+
+// currentLimits returns the limits in effect; none before the server state
+// is set up
+func currentLimits() limitsConfig {
+	if s := state.Load(); s != nil {
+		return s.cfg.Limits
+	}
+	return limitsConfig{}
+}
+
+// perfDataLimitError is returned when perf record stopped at max_perf_data
+func perfDataLimitError(limit int64) error {
+	return &captureError{http.StatusInsufficientStorage, fmt.Sprintf(
+		"perf.data reached limits.max_perf_data (%s) before the capture finished. Shorten the capture, profile a single thread with tid, or raise the limit",
+		formatSize(limit))}
+}
+
+// outputTooLarge is returned for output over limits.max_response
+func outputTooLarge(what string, limit int64) error {
+	return &captureError{http.StatusInsufficientStorage, fmt.Sprintf(
+		"The %s is larger than limits.max_response (%s). Shorten the capture or raise the limit",
+		what, formatSize(limit))}
+}
+
+// checkOutputSize fails with 507 when output of size bytes exceeds
+// limits.max_response
+func checkOutputSize(what string, size int64) error {
+	if limit := int64(currentLimits().MaxResponse); limit > 0 && size > limit {
+		return outputTooLarge(what, limit)
+	}
+	return nil
+}
+
+// readOutputFile reads the output file of a profiler, refusing files over
+// limits.max_response
+func readOutputFile(what, path string) ([]byte, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkOutputSize(what, info.Size()); err != nil {
+		return nil, err
+	}
+	return os.ReadFile(path)
+}
+
+// limitedBuffer collects command output up to limits.max_response and drops
+// the rest, so a runaway profiler cannot exhaust the exporter's memory
+type limitedBuffer struct {
+	bytes.Buffer
+	limit    int64
+	overflow bool
+}
+
+func newLimitedBuffer() *limitedBuffer {
+	return &limitedBuffer{limit: int64(currentLimits().MaxResponse)}
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if b.overflow || (b.limit > 0 && int64(b.Len()+len(p)) > b.limit) {
+		b.overflow = true
+		return len(p), nil
+	}
+	return b.Buffer.Write(p)
+}
+
+// ReadFrom replaces the one of bytes.Buffer, which would take whatever r
+// holds: commands copy their output with io.Copy, which prefers it to Write
+func (b *limitedBuffer) ReadFrom(r io.Reader) (int64, error) {
+	return io.Copy(struct{ io.Writer }{b}, r)
+}
+
+// check returns the error for output that went over the limit
+func (b *limitedBuffer) check(what string) error {
+	if b.overflow {
+		return outputTooLarge(what, b.limit)
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestByteSizeUnmarshal(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    byteSize
+		wantErr bool
+	}{
+		{`"512M"`, 512 << 20, false},
+		{`"2G"`, 2 << 30, false},
+		{`1048576`, 1 << 20, false},
+		{`"lots"`, 0, true},
+		{`true`, 0, true},
+	}
+	for _, tt := range tests {
+		var got byteSize
+		err := json.Unmarshal([]byte(tt.in), &got)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("Unmarshal(%s) = %d, %v, want %d, wantErr %v", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestLimitsConfigValidate(t *testing.T) {
+	var c limitsConfig
+	if err := c.validate(); err != nil || c.MaxPerfData != 2<<30 || c.MaxResponse != 512<<20 {
+		t.Errorf("validate() = %+v, %v, want the defaults", c, err)
+	}
+	c = limitsConfig{MaxResponse: -1}
+	if err := c.validate(); err == nil {
+		t.Error("validate() accepted a negative size")
+	}
+}
+
+// setLimits makes limits the limits in effect for the test
+func setLimits(t *testing.T, limits limitsConfig) {
+	t.Helper()
+	orig := state.Load()
+	t.Cleanup(func() { state.Store(orig) })
+	state.Store(&serverState{cfg: &config{Limits: limits}})
+}
+
+func TestLimitedBuffer(t *testing.T) {
+	setLimits(t, limitsConfig{MaxResponse: 8})
+
+	b := newLimitedBuffer()
+	b.Write([]byte("12345"))
+	if err := b.check("output"); err != nil || b.String() != "12345" {
+		t.Errorf("under the limit: %q, %v", b.String(), err)
+	}
+	if n, err := b.Write([]byte("6789")); n != 4 || err != nil {
+		t.Errorf("Write over the limit = %d, %v, want the write to be dropped quietly", n, err)
+	}
+	b.Write([]byte("0"))
+	err := b.check("bpftrace output")
+	ce, ok := err.(*captureError)
+	if !ok || ce.Status != http.StatusInsufficientStorage || !strings.Contains(ce.Message, "bpftrace output is larger than limits.max_response") {
+		t.Errorf("check() = %v, want a 507 captureError", err)
+	}
+	if b.String() != "12345" {
+		t.Errorf("buffer kept %q past the limit", b.String())
+	}
+
+	// Command output reaches the buffer through io.Copy
+	cmd := exec.Command("echo", "123456789")
+	out := newLimitedBuffer()
+	cmd.Stdout = out
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if err := out.check("echo output"); err == nil || out.Len() != 0 {
+		t.Errorf("command output over the limit: %q, %v", out.String(), err)
+	}
+}
+
+func TestReadOutputFile(t *testing.T) {
+	setLimits(t, limitsConfig{MaxResponse: 4})
+	dir := t.TempDir()
+	small, large := filepath.Join(dir, "small"), filepath.Join(dir, "large")
+	os.WriteFile(small, []byte("1234"), 0644)
+	os.WriteFile(large, []byte("12345"), 0644)
+
+	if data, err := readOutputFile("py-spy output", small); err != nil || string(data) != "1234" {
+		t.Errorf("readOutputFile(small) = %q, %v", data, err)
+	}
+	if _, err := readOutputFile("py-spy output", large); err == nil {
+		t.Error("readOutputFile(large) succeeded")
+	}
+}
+
+func TestRecordPerfSizeLimit(t *testing.T) {
+	setLimits(t, limitsConfig{MaxPerfData: 64 << 20})
+	if args := strings.Join(perfRecordArgs(profileOptions{PID: "1", Duration: 1}, "perf.data"), " "); !strings.Contains(args, "--max-size 65536K") {
+		t.Errorf("perfRecordArgs = %s, want --max-size 65536K", args)
+	}
+
+	dir := fakeTools(t)
+	script := "echo '[ perf record: perf size limit reached (65536 KB), stopping session ]' >&2\nexit 0"
+	if err := os.WriteFile(filepath.Join(dir, "perf"), []byte("#!/bin/sh\n"+script+"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	_, err := recordPerf(profileOptions{PID: "1", Duration: 1}, t.TempDir())
+	ce, ok := err.(*captureError)
+	if !ok || ce.Status != http.StatusInsufficientStorage || !strings.Contains(ce.Message, "limits.max_perf_data (64.0 MiB)") {
+		t.Errorf("recordPerf = %v, want a 507 captureError", err)
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// parseSocketMode parses the octal permissions of -socket-mode
+func parseSocketMode(s string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, fmt.Errorf("invalid mode %q: must be octal permissions such as 0660", s)
+	}
+	return os.FileMode(mode), nil
+}
+
+// listenSocket listens on a Unix socket at path, readable and writable per
+// mode and owned by group when set. A socket left behind by an exporter
+// that did not shut down cleanly is replaced, one still being served is not.
+func listenSocket(path string, mode os.FileMode, group string) (net.Listener, error) {
+	gid := -1
+	if group != "" {
+		g, err := user.LookupGroup(group)
+		if err != nil {
+			return nil, err
+		}
+		if gid, err = strconv.Atoi(g.Gid); err != nil {
+			return nil, fmt.Errorf("group %s has non-numeric gid %q", group, g.Gid)
+		}
+	}
+
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode().Type() != os.ModeSocket {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is in use by another process", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+
+	// Create the socket without any permissions so no client can connect
+	// before the mode and group are set
+	old := syscall.Umask(0777)
+	ln, err := net.Listen("unix", path)
+	syscall.Umask(old)
+	if err != nil {
+		return nil, err
+	}
+	if gid != -1 {
+		if err := os.Chown(path, -1, gid); err != nil {
+			ln.Close()
+			return nil, err
+		}
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseSocketMode(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    os.FileMode
+		wantErr bool
+	}{
+		{"0660", 0660, false},
+		{"600", 0600, false},
+		{"0777", 0777, false},
+		{"1777", 0, true},
+		{"0680", 0, true},
+		{"rw", 0, true},
+		{"", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := parseSocketMode(tt.in)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseSocketMode(%q) = %v, %v, want %v, wantErr %v", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestListenSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bcc-exporter.sock")
+	ln, err := listenSocket(path, 0640, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Type() != os.ModeSocket || info.Mode().Perm() != 0640 {
+		t.Errorf("socket mode = %v, want socket with 0640", info.Mode())
+	}
+
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})}
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	// The watchdog probe reaches the server over the socket
+	if err := probeServer(ln.Addr())(); err != nil {
+		t.Errorf("probe() over the socket: %v", err)
+	}
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("GET / HTTP/1.0\r\n\r\n"))
+	resp, _ := io.ReadAll(conn)
+	conn.Close()
+	if len(resp) == 0 {
+		t.Error("no response over the socket")
+	}
+
+	// A socket being served is not taken over
+	if _, err := listenSocket(path, 0640, ""); err == nil {
+		t.Error("listenSocket() on a socket in use succeeded")
+	}
+}
+
+func TestListenSocketStale(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "bcc-exporter.sock")
+
+	// Leave a socket file behind, as a killed exporter would
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	ln, err := listenSocket(path, 0600, "")
+	if err != nil {
+		t.Fatalf("listenSocket() over a stale socket: %v", err)
+	}
+	ln.Close()
+
+	regular := filepath.Join(dir, "regular")
+	os.WriteFile(regular, nil, 0600)
+	if _, err := listenSocket(regular, 0600, ""); err == nil {
+		t.Error("listenSocket() replaced a regular file")
+	}
+	if _, err := listenSocket(filepath.Join(dir, "other.sock"), 0600, "no-such-group-bcc"); err == nil {
+		t.Error("listenSocket() with an unknown group succeeded")
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"net/http"
+)
+
+// liveMessage is a message of the /debug/live WebSocket
+type liveMessage struct {
+	// Type is "stacks" for the stacks of an interval, then "done" or
+	// "error"
+	Type string `json:"type"`
+	// Elapsed is how many seconds of the capture are over
+	Elapsed int `json:"elapsed"`
+	// Seconds is the duration of the capture
+	Seconds int `json:"seconds"`
+	// Stacks maps collapsed stacks to their samples in the interval
+	Stacks map[string]int64 `json:"stacks,omitempty"`
+	// ProfileID is the stored profile of the whole capture, on "done"
+	ProfileID string `json:"profile_id,omitempty"`
+	// Message is the error, on "error"
+	Message string `json:"message,omitempty"`
+}
+
+// handleLive serves /debug/live; test mode has no intervals to stream
+func handleLive(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("test") == "true" {
+		http.Error(w, "test is not supported by /debug/live", http.StatusBadRequest)
+		return
+	}
+	runProfile(w, r, "live")
+}
+
+// serveLive streams the stack counts of each interval of a profile-bpfcc
+// capture over a WebSocket, for live flamegraphs
+func serveLive(w http.ResponseWriter, r *http.Request, opts profileOptions) {
+	c, status, err := upgradeWebSocket(w, r)
+	if err != nil {
+		if status != 0 {
+			http.Error(w, err.Error(), status)
+		}
+		return
+	}
+
+	// The request context is not canceled when a hijacked client goes away
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-c.closed:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	total, elapsed, err := captureBCCIntervals(ctx, opts, func(elapsed int, folded []byte) {
+		stacks := make(map[string]int64)
+		addFolded(stacks, folded)
+		c.sendJSON(liveMessage{Type: "stacks", Elapsed: elapsed, Seconds: opts.Duration, Stacks: stacks})
+	})
+	switch {
+	case ctx.Err() != nil:
+		log.Printf("Client went away during live capture of PID %s", opts.PID)
+		return
+	case err != nil:
+		log.Printf("Live capture of PID %s failed after %d seconds: %v", opts.PID, elapsed, err)
+		c.sendJSON(liveMessage{Type: "error", Elapsed: elapsed, Seconds: opts.Duration, Message: err.Error()})
+		c.close("capture failed")
+		return
+	}
+
+	// The whole capture is stored like a folded profile; w is only used
+	// for the X-Profile-ID header that storeCapture sets
+	var buf bytes.Buffer
+	writeFolded(&buf, total)
+	storeCapture(w, captureMeta(opts, "folded"), &buf)
+
+	log.Printf("Successfully streamed live profile for PID %s", opts.PID)
+	c.sendJSON(liveMessage{Type: "done", Elapsed: elapsed, Seconds: opts.Duration, ProfileID: w.Header().Get("X-Profile-ID")})
+	c.close("capture complete")
+}
@@ -1,59 +1,414 @@
 package main
 
 import (
-	"bytes"
+	"archive/tar"
+	"context"
 	"crypto/subtle"
 	"flag"
 	"fmt"
-	"io"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
+	"time"
 )
 
 var (
 	port     = flag.String("port", "8080", "Port to listen on")
 	password = flag.String("password", "", "Password for basic authentication (optional)")
+	passFile = flag.String("password-file", "", "File holding the password for basic authentication (optional)")
+	htpasswd = flag.String("htpasswd", "", "htpasswd file with bcrypt hashed users for basic authentication (optional)")
+	storeDir = flag.String("store-dir", "", "Directory to keep captured profiles in with the local storage backend (optional)")
+	confPath = flag.String("config", "", "Path to a JSON configuration file (optional)")
+	symfsDir = flag.String("symfs", "", "Directory perf looks up binaries in, as if it were / (optional)")
+	symDirs  = flag.String("symbol-dirs", "", "Colon-separated directories searched for binaries and debug files during pprof conversion (optional)")
+	hostProc = flag.String("host-proc", "/proc", "Mount point of the host's /proc, when running in a container")
+	hostSys  = flag.String("host-sys", "/sys", "Mount point of the host's /sys, when running in a container")
+	escalate = flag.String("escalation", "auto", "How to run BCC, bpftrace and py-spy as root: auto, none, sudo, pkexec or doas")
+	cidrs    = flag.String("allow-cidrs", "", "Comma-separated CIDR ranges clients must connect from (optional)")
+	sockPath = flag.String("listen-socket", "", "Serve on this Unix socket instead of a TCP port (optional)")
+	sockMode = flag.String("socket-mode", "0660", "Permissions of the -listen-socket socket")
+	prefix   = flag.String("http-prefix", "", "Path prefix to serve under behind a reverse proxy, e.g. /profiling (optional)")
+	sockGrp  = flag.String("socket-group", "", "Group owning the -listen-socket socket (optional)")
+	adminAdr = flag.String("admin-addr", "", "Address to serve the exporter's own expvar and pprof handlers on, e.g. 127.0.0.1:9091 (optional)")
+	tmpDir   = flag.String("temp-dir", "", "Directory captures keep their working files in (default $TMPDIR or /tmp)")
+	tmpfsSz  = flag.String("tmpfs-size", "", "Keep capture working files on a tmpfs of this size, e.g. 512M, instead of disk (optional)")
+	grace    = flag.Duration("job-grace", 60*time.Second, "How long profilers may run past the capture duration, and conversions at all, before they are killed")
+	allowPrt = flag.Bool("allow-protected", false, "Allow profiling the exporter itself, PID 1 and the processes listed in target_policy.protected")
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "setcap" {
+		if err := runSetcap(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "profile" {
+		if err := runProfileCommand(os.Args[2:], os.Stdout, os.Stderr); err != nil && err != flag.ErrHelp {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	flag.Parse()
 
-	// Set up handlers with optional authentication
-	if *password != "" {
-		http.HandleFunc("/debug/pprof/profile", basicAuth(handlePprof, *password))
-		http.HandleFunc("/debug/folded/profile", basicAuth(handleFolded, *password))
+	procRoot, sysRoot = *hostProc, *hostSys
+	lbrCapsPath = filepath.Join(sysRoot, "bus/event_source/devices/cpu/caps/branches")
+	if _, err := os.Stat(filepath.Join(procRoot, "1")); err != nil {
+		log.Fatalf("-host-proc %s is not a proc filesystem: %v", procRoot, err)
+	}
+	initCapabilities()
+
+	if *grace <= 0 {
+		log.Fatalf("Invalid -job-grace %s: must be positive", *grace)
+	}
+	jobGrace = *grace
+	if *tmpDir != "" {
+		if err := checkTempRoot(*tmpDir); err != nil {
+			log.Fatalf("-temp-dir %s is not usable: %v", *tmpDir, err)
+		}
+		tempRoot = *tmpDir
+	}
+	// Profilers of a crashed exporter would otherwise run on forever
+	scratchBase := tempRoot
+	if scratchBase == "" {
+		scratchBase = os.TempDir()
+	}
+	self, err := lookupProcess(selfPID())
+	if err != nil {
+		log.Printf("Warning: cannot identify the exporter in %s, orphaned profilers will not be reaped: %v", procRoot, err)
 	} else {
-		http.HandleFunc("/debug/pprof/profile", handlePprof)
-		http.HandleFunc("/debug/folded/profile", handleFolded)
+		instanceID = self
+		reapOrphans(scratchBase)
+		sessions = newSessionTracker(sessionsFile(scratchBase, instanceID))
+		go runReaper(scratchBase, nil)
+	}
+	if *tmpfsSz != "" {
+		size, err := parseByteSize(*tmpfsSz)
+		if err != nil {
+			log.Fatalf("Invalid -tmpfs-size: %v", err)
+		}
+		dir, err := mountScratch(tempRoot, size)
+		if err != nil {
+			log.Fatalf("Failed to set up -tmpfs-size scratch space: %v", err)
+		}
+		go unmountScratchOnExit(dir)
+		tempRoot = dir
+		log.Printf("Keeping capture working files on a %s tmpfs at %s", formatSize(size), dir)
+	}
+
+	if !validEscalation(*escalate) {
+		log.Fatalf("Invalid -escalation %q: must be auto, none, sudo, pkexec or doas", *escalate)
+	}
+	escalation = *escalate
+	if method := escalationMethod(); method != "none" {
+		if _, err := exec.LookPath(method); err != nil {
+			log.Printf("Warning: -escalation %s: %v; BCC, bpftrace and py-spy captures will fail", method, err)
+		}
+	}
+	log.Printf("Running BCC, bpftrace and py-spy with escalation: %s", escalationMethod())
+
+	cfg, err := loadConfig(*confPath)
+	if err != nil {
+		log.Fatalf("Failed to load configuration: %v", err)
+	}
+	allowProtected = *allowPrt
+	if allowProtected {
+		log.Printf("Warning: -allow-protected lets clients profile the exporter, PID 1 and protected processes")
+	}
+	if audit, err = openAuditLog(cfg.Audit); err != nil {
+		log.Fatalf("Failed to open audit log: %v", err)
+	}
+	if audit != nil {
+		log.Printf("Audit logging enabled")
+	}
+	if tracing = newTracer(cfg.Tracing); tracing != nil {
+		log.Printf("Exporting traces to %s", cfg.Tracing.Endpoint)
+	}
+
+	st, err := openStorage(cfg.Storage, *storeDir)
+	if err != nil {
+		log.Fatalf("Failed to open profile store: %v", err)
+	}
+	if st != nil {
+		store = &profileStore{storage: st}
+		log.Printf("Storing profiles in %s", st)
+	}
+	if cfg.S3.Bucket != "" && store == nil {
+		log.Fatalf("Uploading profiles to S3 requires a profile store (-store-dir or the storage section)")
+	}
+	if uploads, err = newS3Uploader(cfg.S3); err != nil {
+		log.Fatalf("Failed to set up S3 uploads: %v", err)
+	}
+	if uploads != nil {
+		log.Printf("Uploading stored profiles to s3://%s/%s", cfg.S3.Bucket, cfg.S3.Prefix)
+	}
+	if cfg.Kubernetes.Controller && store == nil {
+		log.Fatalf("The ProfileJob controller requires a profile store (-store-dir or the storage section)")
+	}
+
+	notifier = newWebhookNotifier()
+
+	redisAuth = cfg.Redis
+	asyncProfiler = cfg.AsyncProfiler
+	debuginfod = cfg.Debuginfod
+	symfs = *symfsDir
+	symbolDirs = filepath.SplitList(*symDirs)
+	if len(debuginfod.URLs) > 0 {
+		log.Printf("Fetching missing debug symbols from %s", strings.Join(debuginfod.URLs, ", "))
+	}
+
+	adminPassword, err := resolvePassword(*password, *passFile)
+	if err != nil {
+		log.Fatalf("Failed to read the password: %v", err)
+	}
+	if adminPassword != "" && *htpasswd != "" {
+		log.Fatalf("-password, -password-file or $%s and -htpasswd are mutually exclusive", passwordEnv)
+	}
+	rl := &reloader{confPath: *confPath, passFile: *passFile}
+	if *passFile == "" {
+		rl.password = adminPassword
+	}
+	if *htpasswd != "" {
+		if rl.users, err = loadHtpasswd(*htpasswd); err != nil {
+			log.Fatalf("Failed to load -htpasswd: %v", err)
+		}
+	}
+	// The policy, credentials, rate limits and watchers can be reloaded;
+	// the other sections of the configuration file apply at startup only
+	if err := rl.reload(); err != nil {
+		log.Fatalf("Failed to load configuration: %v", err)
+	}
+	go rl.handleSIGHUP()
+
+	httpPrefix, err := parsePathPrefix(*prefix)
+	if err != nil {
+		log.Fatalf("Invalid -http-prefix: %v", err)
+	}
+
+	// Set up handlers with optional authentication. The API has its own
+	// mux so the exporter's debug handlers stay on the admin port.
+	mux := http.NewServeMux()
+	handle := func(pattern string, handler http.HandlerFunc) {
+		mux.HandleFunc(pattern, authenticated(handler))
+	}
+	// Endpoints that start captures are rate limited per client and
+	// recorded in the audit log as running tool. Those without a method
+	// in their pattern also take their parameters as a JSON POST body,
+	// and identical concurrent requests to them share one capture.
+	capture := func(pattern, tool string, handler http.HandlerFunc) {
+		route := pattern[strings.Index(pattern, "/"):]
+		run := func(w http.ResponseWriter, r *http.Request) {
+			runningCaptures.Add(1)
+			defer runningCaptures.Add(-1)
+			handler(w, r)
+		}
+		if route == pattern {
+			run = inflight.wrap(route, run)
+		}
+		h := tracing.wrap(route, audit.wrap(tool, func(w http.ResponseWriter, r *http.Request) {
+			state.Load().limiter.wrap(run)(w, r)
+		}))
+		if route == pattern {
+			h = jsonCaptureRequest(h)
+		}
+		handle(pattern, h)
+	}
+
+	capture("/debug/pprof/profile", "perf", handlePprof)
+	capture("/debug/folded/profile", "bcc", handleFolded)
+	capture("/debug/live", "bcc", handleLive)
+	capture("/debug/pprof/hotcold", "bcc", handleHotCold)
+	capture("/debug/pprof/pagefaults", "perf", handlePageFaults)
+	capture("/debug/pprof/redis", "perf", handleRedisProfile)
+	handle("/debug/pprof/{profile}", handlePprofProfileType)
+	capture("/debug/redis/cmdlatency", "bpftrace", handleRedisCmdLatency)
+	capture("/debug/perfstat", "perf-stat", handlePerfStat)
+	capture("/debug/memaccess", "perf-mem", handleMemAccess)
+	capture("/debug/numa", "perf-stat", handleNUMA)
+	capture("/debug/sched", "perf-sched", handleSched)
+	capture("GET /debug/fanout", "fanout", handleFanout)
+	handle("GET /debug/bpftrace/scripts", handleBpftraceScripts)
+	capture("/debug/bpftrace/run", "bpftrace", handleBpftraceRun)
+	capture("POST /debug/bpftrace/user", "bpftrace", func(w http.ResponseWriter, r *http.Request) {
+		state.Load().userBpftrace.ServeHTTP(w, r)
+	})
+	handle("GET /api/v1/profiles", handleListProfiles)
+	handle("GET /api/v1/store", handleSearchProfiles)
+	handle("GET /api/v1/signing-key", handleSigningKey)
+	handle("GET /api/v1/sd", handleServiceDiscovery)
+	handle("GET /api/v1/targets", handleTargets)
+	handle("GET /api/v1/profiles/{id}", handleGetProfile)
+	handle("DELETE /api/v1/profiles/{id}", handleDeleteProfile)
+	handle("PUT /api/v1/profiles/{id}/pin", handlePinProfile)
+	handle("DELETE /api/v1/profiles/{id}/pin", handlePinProfile)
+	handle("GET /api/v1/profiles/{id}/flamegraph", handleProfileFlameGraph)
+	handle("GET /api/v1/profiles/{id}/redis", handleGetRedisMetadata)
+	handle("GET /api/v1/profiles/{id}/events", handleProfileEvents)
+	handle("GET /ui/view/{id}", handlePprofView)
+	handle("GET /ui/view/{id}/", handlePprofView)
+	handle("/api/v1/diff", handleDiff)
+	handle("/api/v1/merge", handleMerge)
+	handle("POST /api/v1/hooks/alertmanager", func(w http.ResponseWriter, r *http.Request) {
+		state.Load().alerts.ServeHTTP(w, r)
+	})
+	handle("POST /-/reload", rl.ServeHTTP)
+	// Health checks of service registries come without credentials
+	mux.HandleFunc("GET /-/healthy", handleHealthy)
+	handle("GET /openapi.json", handleOpenAPI(httpPrefix))
+	handle("GET /version", handleVersion)
+	handle("GET /metrics", handleMetrics)
+
+	handler := cors(compressed(stripPathPrefix(mux, httpPrefix)))
+	if httpPrefix != "" {
+		log.Printf("Serving under %s/", httpPrefix)
+	}
+	if *cidrs != "" {
+		if *sockPath != "" {
+			log.Fatalf("-allow-cidrs does not apply to -listen-socket, whose clients are limited by -socket-mode and -socket-group")
+		}
+		prefixes, err := parseCIDRs(*cidrs)
+		if err != nil {
+			log.Fatalf("Invalid -allow-cidrs: %v", err)
+		}
+		if len(prefixes) == 0 {
+			log.Fatalf("Invalid -allow-cidrs: no CIDR ranges given")
+		}
+		handler = allowCIDRs(handler, prefixes)
+		log.Printf("Accepting connections from %s only", *cidrs)
 	}
 
 	addr := ":" + *port
-	log.Printf("Listening on %s...", addr)
-	if *password != "" {
+	var ln net.Listener
+	if *sockPath != "" {
+		mode, err := parseSocketMode(*sockMode)
+		if err != nil {
+			log.Fatalf("Invalid -socket-mode: %v", err)
+		}
+		addr = "unix:" + *sockPath
+		ln, err = listenSocket(*sockPath, mode, *sockGrp)
+		if err != nil {
+			log.Fatalf("Failed to listen on -listen-socket: %v", err)
+		}
+	} else if ln, err = net.Listen("tcp", addr); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("bcc-exporter %s listening on %s...", exporterBuildInfo().Version, addr)
+	if adminPassword != "" {
 		log.Println("Basic authentication enabled")
+	} else if rl.users != nil {
+		log.Printf("Basic authentication enabled for the users in %s", *htpasswd)
+	}
+
+	if *adminAdr != "" {
+		adminLn, err := net.Listen("tcp", *adminAdr)
+		if err != nil {
+			log.Fatalf("Failed to listen on -admin-addr: %v", err)
+		}
+		go func() { log.Fatal(http.Serve(adminLn, newAdminMux())) }()
+		log.Printf("Serving /debug/vars and /debug/pprof/ of the exporter on %s", *adminAdr)
+	}
+
+	if cfg.Consul.Address != "" {
+		tcp, ok := ln.Addr().(*net.TCPAddr)
+		if !ok {
+			log.Fatalf("Consul registration needs a TCP listener, not -listen-socket")
+		}
+		go runConsulRegistration(cfg.Consul, tcp.Port, nil)
+		go deregisterConsulOnExit(cfg.Consul)
+	}
+	if cfg.Kubernetes.Controller {
+		controller, err := newProfileJobController(cfg.Kubernetes)
+		if err != nil {
+			log.Fatalf("Failed to set up the ProfileJob controller: %v", err)
+		}
+		go controller.run(context.Background())
+		log.Printf("Running the ProfileJobs of node %s", cfg.Kubernetes.NodeName)
+	}
+
+	// Tell systemd the exporter is up once it accepts connections
+	notify("READY=1\nSTATUS=" + systemdStatus(addr))
+	if interval := watchdogInterval(); interval > 0 {
+		go runSystemdWatchdog(interval, addr, probeServer(ln.Addr()), nil)
+		log.Printf("Pinging the systemd watchdog every %s", interval)
+	}
+	log.Fatal(http.Serve(ln, handler))
+}
+
+// authenticated wraps a handler with the authentication configured in the
+// server state in effect, if any
+func authenticated(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s := state.Load()
+		if s.checkPassword != nil || s.jwt != nil {
+			requireAuth(handler, s.checkPassword, s.jwt)(w, r)
+			return
+		}
+		handler(w, r)
 	}
-	log.Fatal(http.ListenAndServe(addr, nil))
 }
 
-// basicAuth wraps a handler with basic authentication
+// basicAuth wraps a handler with basic authentication of the admin user
 func basicAuth(handler http.HandlerFunc, password string) http.HandlerFunc {
+	return checkBasicAuth(handler, func(user, pass string) bool {
+		return user == "admin" && subtle.ConstantTimeCompare([]byte(pass), []byte(password)) == 1
+	})
+}
+
+// checkBasicAuth wraps a handler with basic authentication verified by check
+func checkBasicAuth(handler http.HandlerFunc, check func(user, pass string) bool) http.HandlerFunc {
+	return requireAuth(handler, check, nil)
+}
+
+// clientKey is the context key of the authenticated client's name
+type clientKey struct{}
+
+// clientName returns the name the client of r authenticated as, or "" when
+// authentication is off
+func clientName(r *http.Request) string {
+	name, _ := r.Context().Value(clientKey{}).(string)
+	return name
+}
+
+// requireAuth wraps a handler with authentication by basic credentials
+// verified by check, a bearer JWT verified by jwt, or either when both are
+// set. The client's name is passed on in the request context.
+func requireAuth(handler http.HandlerFunc, check func(user, pass string) bool, jwt *jwtVerifier) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		user, pass, ok := r.BasicAuth()
-		if !ok || user != "admin" || subtle.ConstantTimeCompare([]byte(pass), []byte(password)) != 1 {
-			w.Header().Set("WWW-Authenticate", `Basic realm="bcc-exporter"`)
+		var name string
+		if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok && jwt != nil {
+			user, err := jwt.verify(token)
+			if err != nil {
+				log.Printf("Rejected bearer token from %s: %v", r.RemoteAddr, err)
+			}
+			name = user
+		} else if user, pass, ok := r.BasicAuth(); ok && check != nil && check(user, pass) {
+			name = user
+		}
+
+		if name == "" {
+			if check != nil {
+				w.Header().Add("WWW-Authenticate", `Basic realm="bcc-exporter"`)
+			}
+			if jwt != nil {
+				w.Header().Add("WWW-Authenticate", `Bearer realm="bcc-exporter"`)
+			}
 			http.Error(w, "Unauthorized", http.StatusUnauthorized)
 			return
 		}
-		handler(w, r)
+		handler(w, r.WithContext(context.WithValue(r.Context(), clientKey{}, name)))
 	}
 }
 
 func handlePprof(w http.ResponseWriter, r *http.Request) {
+	withDefaultSeconds(r)
 	runProfile(w, r, "pprof")
 }
 
@@ -61,25 +416,471 @@ func handleFolded(w http.ResponseWriter, r *http.Request) {
 	runProfile(w, r, "folded")
 }
 
+// handleHotCold captures on-CPU and off-CPU stacks over the same window
+// into one pprof profile
+func handleHotCold(w http.ResponseWriter, r *http.Request) {
+	runProfile(w, r, "hotcold")
+}
+
+// profileOptions holds the capture parameters shared by all profiling backends
+type profileOptions struct {
+	PID      string
+	Duration int
+	Stacks   string // "user", "kernel" or "both"
+
+	// CallGraph selects the perf unwinding method ("fp", "dwarf" or "lbr"),
+	// DwarfSize is the user stack dump size in bytes for dwarf mode and
+	// LBRFallback is used instead of "lbr" when the CPU lacks LBR support
+	CallGraph   string
+	DwarfSize   int
+	LBRFallback string
+
+	// Children includes descendants of PID in the capture; ChildPIDs holds
+	// the descendants found when the capture starts
+	Children  bool
+	ChildPIDs []string
+
+	// TID restricts the capture to a single thread of PID, ThreadLabels
+	// requires per-sample tid/thread labels, which only perf records: it
+	// picks perf and adds the thread label to captures of TID, as perf
+	// captures of a process always have them
+	TID          string
+	ThreadLabels bool
+
+	// Delay is the warmup in seconds to wait before the capture starts
+	Delay int
+
+	// Frequency is the sampling frequency in Hz; 0 for defaultFrequency
+	Frequency int
+
+	// Event is the perf event sampled instead of perf's default, cycles
+	// (or cpu-clock in VMs without a PMU); one of perfRecordEvents
+	Event string
+
+	// Mode is "cpu" to sample threads running on a CPU or "wall" to sample
+	// them on a timer whether running or blocked
+	Mode string
+
+	// Labels are the user's key/value labels kept with the stored profile
+	Labels map[string]string
+
+	// Snapshots is the number of consecutive captures of Duration seconds
+	// to take; more than one returns a series archive
+	Snapshots int
+
+	// StreamInterval streams folded stacks every that many seconds during
+	// the capture instead of once at the end; 0 when not streaming
+	StreamInterval int
+
+	// Output selects what the perf backend returns instead of pprof:
+	// "perfscript" for symbolized perf script text, "perfdata" for the
+	// unprocessed perf.data file or "perfarchive" for perf.data bundled with
+	// the build-ID objects it references; "top" and "summary-json" render a
+	// report of the top NodeCount functions of the pprof capture and
+	// "callgrind" converts it for KCachegrind; "chrometrace" lays out the
+	// timestamped samples as a Trace Event timeline; "html" renders an
+	// interactive flamegraph page and "bundle" packs the pprof profile, its
+	// folded stacks and an SVG flamegraph into one tar.gz
+	Output    string
+	NodeCount int
+
+	// RedisPort selects the target by the TCP port it listens on instead of
+	// PID; runProfile resolves it into PID
+	RedisPort int
+
+	// Container names the container (ID or cgroup path) whose PID
+	// namespace PID and TID are given in; runProfile translates them into
+	// host IDs
+	Container string
+
+	// RedisMetadata bundles Redis INFO, CONFIG and COMMANDSTATS snapshots
+	// taken around the capture when the target is redis-server
+	RedisMetadata bool
+
+	// Backend picks the profiler: "auto" (default) chooses one from the
+	// runtime of the target, "native" uses the endpoint's own tool and
+	// "perf", "bcc", "async-profiler" or "py-spy" require that profiler
+	Backend string
+
+	// Runtime overrides the detected language runtime of the target:
+	// "java", "python" or "node"
+	Runtime string
+
+	// PerfMap is set when the target has a /tmp/perf-<pid>.map naming its
+	// JIT compiled code, which only perf script resolves during conversion
+	PerfMap bool
+
+	// Annotate suffixes kernel frames with _[k] and JIT compiled frames
+	// with _[j] in folded output, which FlameGraph tools color by
+	Annotate bool
+
+	// Span is the trace span of the request the capture serves; the stages
+	// of the capture are recorded as its children. nil when not traced.
+	Span *span
+
+	// Progress receives the phases of a background capture. nil for
+	// captures that serve a request.
+	Progress *jobProgress
+}
+
+// targetPIDs returns the comma-separated PID list passed to the profilers
+func (opts profileOptions) targetPIDs() string {
+	return strings.Join(append([]string{opts.PID}, opts.ChildPIDs...), ",")
+}
+
+// defaultDwarfSize is perf's own default stack dump size for --call-graph dwarf
+const defaultDwarfSize = 8192
+
+// defaultFrequency is the sampling frequency of the profilers in Hz, unless
+// the request sets frequency; not 1000 to avoid lockstep with timer ticks
+const defaultFrequency = 999
+
+// maxFrequency bounds frequency well below the kernel's
+// perf_event_max_sample_rate
+const maxFrequency = 10000
+
+// frequency returns the sampling frequency of the capture in Hz
+func (opts profileOptions) frequency() int {
+	if opts.Frequency == 0 {
+		return defaultFrequency
+	}
+	return opts.Frequency
+}
+
+// dwarfOverheadWarning is returned to clients that request DWARF unwinding
+const dwarfOverheadWarning = "callgraph=dwarf copies user stacks on every sample; expect higher overhead and much larger perf.data files"
+
+// lbrCapsPath is where the kernel reports the LBR stack depth of the CPU PMU;
+// it only exists on Intel CPUs with Last Branch Record support
+var lbrCapsPath = "/sys/bus/event_source/devices/cpu/caps/branches"
+
+// lbrSupported reports whether perf can use --call-graph lbr on this host
+func lbrSupported() bool {
+	data, err := os.ReadFile(lbrCapsPath)
+	if err != nil {
+		return false
+	}
+	depth, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	return err == nil && depth > 0
+}
+
+// parseProfileOptions extracts and validates capture parameters from the query string
+func parseProfileOptions(r *http.Request) (profileOptions, error) {
+	q := r.URL.Query()
+	if (q.Get("pid") == "" && q.Get("redis_port") == "") || q.Get("seconds") == "" {
+		return profileOptions{}, fmt.Errorf("Missing pid or seconds")
+	}
+	return parseCaptureOptions(q)
+}
+
+// parseCaptureOptions validates the capture parameters in q; pid is optional
+// here for endpoints that choose their own targets
+func parseCaptureOptions(q url.Values) (profileOptions, error) {
+	opts := profileOptions{
+		PID:           q.Get("pid"),
+		Stacks:        q.Get("stacks"),
+		CallGraph:     q.Get("callgraph"),
+		DwarfSize:     defaultDwarfSize,
+		LBRFallback:   q.Get("lbr_fallback"),
+		Children:      q.Get("children") == "true",
+		TID:           q.Get("tid"),
+		ThreadLabels:  q.Get("thread_labels") == "true",
+		Snapshots:     1,
+		RedisMetadata: q.Get("redis_metadata") == "true",
+		Backend:       q.Get("backend"),
+		Runtime:       q.Get("runtime"),
+		Container:     q.Get("container"),
+		Annotate:      q.Get("annotate") != "false",
+	}
+	seconds := q.Get("seconds")
+
+	if seconds == "" {
+		return opts, fmt.Errorf("Missing seconds")
+	}
+
+	if port := q.Get("redis_port"); port != "" {
+		n, err := strconv.Atoi(port)
+		if err != nil || n < 1 || n > 65535 {
+			return opts, fmt.Errorf("Invalid redis_port")
+		}
+		if opts.PID != "" {
+			return opts, fmt.Errorf("pid and redis_port cannot be combined")
+		}
+		opts.RedisPort = n
+	}
+
+	if opts.Container != "" {
+		if opts.PID == "" {
+			return opts, fmt.Errorf("container requires pid")
+		}
+		if _, err := strconv.Atoi(opts.PID); err != nil {
+			return opts, fmt.Errorf("Invalid pid")
+		}
+	}
+
+	dur, err := strconv.Atoi(seconds)
+	if err != nil || dur <= 0 || dur > 300 {
+		return opts, fmt.Errorf("Invalid seconds")
+	}
+	opts.Duration = dur
+
+	switch opts.Stacks {
+	case "":
+		opts.Stacks = "both"
+	case "user", "kernel", "both":
+	default:
+		return opts, fmt.Errorf("Invalid stacks: must be user, kernel or both")
+	}
+
+	switch opts.CallGraph {
+	case "":
+		opts.CallGraph = "fp"
+	case "fp", "dwarf", "lbr":
+	default:
+		return opts, fmt.Errorf("Invalid callgraph: must be fp, dwarf or lbr")
+	}
+
+	switch opts.LBRFallback {
+	case "":
+		opts.LBRFallback = "fp"
+	case "fp", "dwarf":
+	default:
+		return opts, fmt.Errorf("Invalid lbr_fallback: must be fp or dwarf")
+	}
+
+	if opts.TID != "" {
+		if _, err := strconv.Atoi(opts.TID); err != nil {
+			return opts, fmt.Errorf("Invalid tid")
+		}
+		if opts.Children {
+			return opts, fmt.Errorf("tid and children=true cannot be combined")
+		}
+	}
+
+	if delay := q.Get("delay"); delay != "" {
+		n, err := strconv.Atoi(delay)
+		if err != nil || n < 0 || n > 300 {
+			return opts, fmt.Errorf("Invalid delay: must be between 0 and 300 seconds")
+		}
+		opts.Delay = n
+	}
+
+	if snapshots := q.Get("snapshots"); snapshots != "" {
+		n, err := strconv.Atoi(snapshots)
+		if err != nil || n < 1 || n > 100 {
+			return opts, fmt.Errorf("Invalid snapshots: must be between 1 and 100")
+		}
+		if n*opts.Duration > maxSeriesSeconds {
+			return opts, fmt.Errorf("Invalid snapshots: a series may last at most %d seconds", maxSeriesSeconds)
+		}
+		opts.Snapshots = n
+	}
+
+	if opts.RedisMetadata && opts.Snapshots > 1 {
+		return opts, fmt.Errorf("redis_metadata and snapshots cannot be combined")
+	}
+
+	if interval := q.Get("stream_interval"); interval != "" {
+		n, err := strconv.Atoi(interval)
+		if err != nil || n < 1 || n > opts.Duration {
+			return opts, fmt.Errorf("Invalid stream_interval: must be between 1 and seconds")
+		}
+		if opts.Snapshots > 1 || opts.RedisMetadata {
+			return opts, fmt.Errorf("stream_interval cannot be combined with snapshots or redis_metadata")
+		}
+		opts.StreamInterval = n
+	}
+
+	switch format := q.Get("format"); format {
+	case "", "pprof":
+	case "perfscript", "perfdata", "perfarchive", "speedscope", "flamegraph", "top", "summary-json", "callgrind", "chrometrace", "html", "bundle":
+		if opts.Snapshots > 1 || opts.RedisMetadata {
+			return opts, fmt.Errorf("format=%s cannot be combined with snapshots or redis_metadata", format)
+		}
+		opts.Output = format
+	default:
+		return opts, fmt.Errorf("Invalid format: must be pprof, perfscript, perfdata, perfarchive, speedscope, flamegraph, top, summary-json, callgrind, chrometrace, html or bundle")
+	}
+
+	if nodecount := q.Get("nodecount"); nodecount != "" {
+		n, err := strconv.Atoi(nodecount)
+		if err != nil || n < 1 || n > 100 {
+			return opts, fmt.Errorf("Invalid nodecount: must be between 1 and 100")
+		}
+		if opts.Output != "top" && opts.Output != "summary-json" {
+			return opts, fmt.Errorf("nodecount only applies to format=top and format=summary-json")
+		}
+		opts.NodeCount = n
+	} else {
+		opts.NodeCount = defaultNodeCount
+	}
+
+	switch opts.Backend {
+	case "":
+		opts.Backend = "auto"
+	case "auto", "native", "perf", "bcc", "async-profiler", "py-spy":
+	default:
+		return opts, fmt.Errorf("Invalid backend: must be auto, native, perf, bcc, async-profiler or py-spy")
+	}
+
+	switch opts.Runtime {
+	case "", "java", "python", "node":
+	default:
+		return opts, fmt.Errorf("Invalid runtime: must be java, python or node")
+	}
+
+	if freq := q.Get("frequency"); freq != "" {
+		n, err := strconv.Atoi(freq)
+		if err != nil || n < 1 || n > maxFrequency {
+			return opts, fmt.Errorf("Invalid frequency: must be between 1 and %d Hz", maxFrequency)
+		}
+		opts.Frequency = n
+	}
+
+	if opts.Event = q.Get("event"); opts.Event != "" && !slices.Contains(perfRecordEvents, opts.Event) {
+		return opts, fmt.Errorf("Invalid event: must be one of %s", strings.Join(perfRecordEvents, ", "))
+	}
+
+	switch opts.Mode = q.Get("mode"); opts.Mode {
+	case "":
+		opts.Mode = "cpu"
+	case "cpu":
+	case "wall":
+		if opts.Event != "" {
+			return opts, fmt.Errorf("event cannot be combined with mode=wall")
+		}
+		// Off-CPU time is recorded per stack at the end of the capture
+		if opts.Output == "chrometrace" {
+			return opts, fmt.Errorf("format=chrometrace cannot be combined with mode=wall")
+		}
+	default:
+		return opts, fmt.Errorf("Invalid mode: must be cpu or wall")
+	}
+
+	if opts.Labels, err = parseLabels(q["label"]); err != nil {
+		return opts, err
+	}
+	opts.Labels = withDefaultLabels(opts.Labels)
+
+	if size := q.Get("dwarf_size"); size != "" {
+		// perf requires a multiple of 8 below 64KiB
+		n, err := strconv.Atoi(size)
+		if err != nil || n < 8 || n > 65528 || n%8 != 0 {
+			return opts, fmt.Errorf("Invalid dwarf_size: must be a multiple of 8 between 8 and 65528")
+		}
+		opts.DwarfSize = n
+	}
+
+	return opts, nil
+}
+
 func runProfile(w http.ResponseWriter, r *http.Request, format string) {
-	pid := r.URL.Query().Get("pid")
-	seconds := r.URL.Query().Get("seconds")
 	testMode := r.URL.Query().Get("test") == "true"
 
-	if pid == "" || seconds == "" {
-		http.Error(w, "Missing pid or seconds", http.StatusBadRequest)
+	// Checking the request and resolving the target, up to the capture
+	validation := spanFrom(r).child("validate")
+	defer validation.finish()
+
+	opts, err := parseProfileOptions(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	opts.Span = spanFrom(r)
+	// Annotations would rename the functions of pprof profiles
+	if format == "pprof" || format == "hotcold" {
+		opts.Annotate = false
+	}
 
-	dur, err := strconv.Atoi(seconds)
-	if err != nil || dur <= 0 || dur > 300 {
-		http.Error(w, "Invalid seconds", http.StatusBadRequest)
+	if err := resolveRedisPort(&opts); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid redis_port: %v", err), http.StatusBadRequest)
+		return
+	}
+	if err := resolveContainerPID(&opts); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid container PID: %v", err), http.StatusBadRequest)
+		return
+	}
+	auditPID(r, opts.PID)
+
+	if format == "live" {
+		if opts.Snapshots > 1 || opts.RedisMetadata {
+			http.Error(w, "/debug/live cannot be combined with snapshots or redis_metadata", http.StatusBadRequest)
+			return
+		}
+		if opts.Mode == "wall" {
+			http.Error(w, "/debug/live cannot be combined with mode=wall", http.StatusBadRequest)
+			return
+		}
+		if opts.StreamInterval == 0 {
+			opts.StreamInterval = 1
+		}
+		// Live stacks come from profile-bpfcc alone
+		if opts.Backend == "auto" {
+			opts.Backend = "native"
+		}
+	}
+
+	if format == "hotcold" {
+		if opts.Snapshots > 1 || opts.RedisMetadata || opts.StreamInterval > 0 || opts.Mode == "wall" {
+			http.Error(w, "/debug/pprof/hotcold cannot be combined with snapshots, redis_metadata, stream_interval or mode=wall", http.StatusBadRequest)
+			return
+		}
+		// Both halves are BCC captures
+		switch opts.Backend {
+		case "auto":
+			opts.Backend = "native"
+		case "native", "bcc":
+		default:
+			http.Error(w, fmt.Sprintf("backend=%s is not supported by /debug/pprof/hotcold, which captures with BCC", opts.Backend), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if opts.Output != "" && format != "pprof" {
+		http.Error(w, fmt.Sprintf("format=%s is only supported by the pprof endpoint", opts.Output), http.StatusBadRequest)
 		return
 	}
 
 	// Test mode - return mock data
+	if testMode && opts.Snapshots > 1 {
+		runSeries(w, r, opts, format, func(opts profileOptions, dir string) ([]byte, error) {
+			return []byte(generateMockProfile(opts.PID, opts.Duration)), nil
+		})
+		return
+	}
+	if testMode && format == "hotcold" {
+		serveHotCold(w, opts, []byte(generateMockProfile(opts.PID, opts.Duration)), []byte(generateMockOffCPU()))
+		return
+	}
+	if testMode && opts.Output == "perfscript" {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(generateMockPerfScript(opts.PID)))
+		return
+	}
+	if testMode && opts.Output == "perfdata" {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write([]byte("PERFILE2 mock perf.data for PID " + opts.PID))
+		return
+	}
+	if testMode && opts.Output == "perfarchive" {
+		w.Header().Set("Content-Type", "application/x-tar")
+		tw := tar.NewWriter(w)
+		writeTarFile(tw, "perf.data", time.Now(), []byte("PERFILE2 mock perf.data for PID "+opts.PID))
+		writeTarFile(tw, "perf.data.tar.bz2", time.Now(), nil)
+		tw.Close()
+		return
+	}
+	if testMode && opts.Output == "chrometrace" {
+		samples, _ := parsePerfScript(strings.NewReader(generateMockPerfScript(opts.PID)))
+		writeJSON(w, http.StatusOK, buildChromeTrace(samples, 1/float64(opts.frequency())))
+		return
+	}
+	if _, ok := reportFormats[opts.Output]; testMode && ok {
+		writeReport(w, opts.Output, captureMeta(opts, "folded"), []byte(generateMockProfile(opts.PID, opts.Duration)), opts.NodeCount)
+		return
+	}
 	if testMode {
-		mockData := generateMockProfile(pid, dur)
+		mockData := generateMockProfile(opts.PID, opts.Duration)
 		if format == "pprof" {
 			w.Header().Set("Content-Type", "application/octet-stream")
 		} else {
@@ -89,189 +890,236 @@ func runProfile(w http.ResponseWriter, r *http.Request, format string) {
 		return
 	}
 
+	backend, err := selectBackend(opts, format)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if opts.StreamInterval > 0 && (format == "pprof" || backend != "bcc") {
+		http.Error(w, "stream_interval is only supported by the folded and live endpoints with the bcc backend", http.StatusBadRequest)
+		return
+	}
+	log.Printf("Profiling PID %s with %s", opts.PID, backend)
+	w.Header().Set("X-Profile-Backend", backend)
+
 	// Validate PID exists
-	if err := validatePID(pid); err != nil {
+	if err := validatePID(opts.PID); err != nil {
 		http.Error(w, fmt.Sprintf("Invalid PID: %v", err), http.StatusBadRequest)
 		return
 	}
 
-	// For pprof format, use perf record + pprof conversion
-	if format == "pprof" {
-		runPerfProfile(w, r, pid, dur)
-	} else {
-		// For folded format, keep the old BCC approach for now
-		runBCCProfile(w, r, pid, dur)
+	if opts.TID != "" {
+		if err := validateTID(opts.PID, opts.TID); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid TID: %v", err), http.StatusBadRequest)
+			return
+		}
 	}
-}
-
-// validatePID checks if the given PID exists and is accessible
-func validatePID(pid string) error {
-	// Check if PID is a valid number
-	if _, err := strconv.Atoi(pid); err != nil {
-		return fmt.Errorf("invalid PID format: %s", pid)
+	if err := currentPolicy().check(opts.PID); err != nil {
+		http.Error(w, fmt.Sprintf("Forbidden target: %v", err), http.StatusForbidden)
+		return
 	}
 
-	// Check if /proc/<pid> exists
-	procPath := fmt.Sprintf("/proc/%s", pid)
-	if _, err := os.Stat(procPath); os.IsNotExist(err) {
-		return fmt.Errorf("process with PID %s does not exist", pid)
-	} else if err != nil {
-		return fmt.Errorf("cannot access process %s: %v", pid, err)
+	if opts.ThreadLabels && format != "pprof" {
+		addWarning(w, "thread_labels only applies to the pprof endpoint")
 	}
 
-	return nil
-}
-
-// checkRequiredTools verifies that perf and pprof tools are available
-func checkRequiredTools() error {
-	// Check if perf is available
-	if _, err := exec.LookPath("perf"); err != nil {
-		return fmt.Errorf("perf tool not found: %v. Install with: sudo apt-get install linux-perf", err)
+	if opts.CallGraph == "lbr" && !lbrSupported() {
+		addWarning(w, fmt.Sprintf("CPU does not support LBR call graphs, falling back to callgraph=%s", opts.LBRFallback))
+		opts.CallGraph = opts.LBRFallback
 	}
 
-	// Check if pprof is available
-	if _, err := exec.LookPath("pprof"); err != nil {
-		return fmt.Errorf("pprof tool not found: %v. Install with: go install github.com/google/pprof@latest", err)
+	if opts.CallGraph == "dwarf" {
+		addWarning(w, dwarfOverheadWarning)
 	}
 
-	return nil
-}
+	if opts.Children {
+		pid, _ := strconv.Atoi(opts.PID)
+		children, err := findDescendants(pid)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to list child processes: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if permitted := currentPolicy().permitted(children); len(permitted) < len(children) {
+			addWarning(w, fmt.Sprintf("%d child processes are excluded by the target policy", len(children)-len(permitted)))
+			children = permitted
+		}
+		for _, child := range children {
+			opts.ChildPIDs = append(opts.ChildPIDs, strconv.Itoa(child))
+		}
+		log.Printf("Including %d child processes of PID %s", len(children), opts.PID)
 
-// runPerfProfile executes perf record + pprof conversion and serves the binary pprof file
-func runPerfProfile(w http.ResponseWriter, r *http.Request, pid string, duration int) {
-	// Check if required tools are available
-	if err := checkRequiredTools(); err != nil {
-		http.Error(w, fmt.Sprintf("Required tools not available: %v", err), http.StatusInternalServerError)
-		return
+		// perf inherits counters into tasks forked during the capture, the
+		// BPF filter of profile-bpfcc is fixed when it starts
+		if backend == "bcc" {
+			addWarning(w, "profile-bpfcc only follows children that exist when the capture starts")
+		}
 	}
 
-	// Create temporary directory for this profiling session
-	tempDir, err := os.MkdirTemp("", "bcc-exporter-")
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to create temp directory: %v", err), http.StatusInternalServerError)
+	validation.set("profile.pid", opts.PID)
+	validation.finish()
+
+	release, ok := takeCaptureSlot(w, r, opts.PID)
+	if !ok {
 		return
 	}
-	defer os.RemoveAll(tempDir) // Clean up when done
-
-	perfDataPath := filepath.Join(tempDir, "perf.data")
-	pprofPath := filepath.Join(tempDir, "profile.pb.gz")
-
-	// Step 1: Run perf record
-	log.Printf("Starting perf record for PID %s, duration %d seconds", pid, duration)
-	perfCmd := exec.Command("perf", "record", "-g", "--pid", pid, "-F", "999", "-o", perfDataPath, "--", "sleep", fmt.Sprintf("%d", duration))
+	defer release()
 
-	var perfStderr bytes.Buffer
-	perfCmd.Stderr = &perfStderr
+	if opts.Delay > 0 {
+		log.Printf("Waiting %d seconds before profiling PID %s", opts.Delay, opts.PID)
+		delay := opts.Span.child("delay")
+		select {
+		case <-time.After(time.Duration(opts.Delay) * time.Second):
+			delay.finish()
+		case <-r.Context().Done():
+			log.Printf("Client went away during warmup delay for PID %s", opts.PID)
+			delay.done(r.Context().Err())
+			return
+		}
+	}
 
-	if err := perfCmd.Run(); err != nil {
-		log.Printf("perf record failed: %v", err)
-		log.Printf("perf stderr: %s", perfStderr.String())
+	if opts.RedisMetadata {
+		pid, _ := strconv.Atoi(opts.PID)
+		if isRedisServer(pid) {
+			addr, err := redisBundleAddr(r, opts)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Failed to find the Redis port of PID %s: %v", opts.PID, err), http.StatusBadRequest)
+				return
+			}
+			capture := snapshotPerf
+			if format != "pprof" {
+				capture = snapshotBCC
+			}
+			runRedisBundle(w, r, opts, format, addr, capture)
+			return
+		}
+		addWarning(w, fmt.Sprintf("redis_metadata ignored: PID %s is not a redis-server process", opts.PID))
+	}
 
-		// Provide more specific error messages
-		stderrStr := perfStderr.String()
-		if strings.Contains(stderrStr, "Permission denied") {
-			http.Error(w, "Permission denied: perf requires elevated privileges. Run with sudo or adjust perf_event_paranoid settings.", http.StatusForbidden)
-		} else if strings.Contains(stderrStr, "No such process") {
-			http.Error(w, fmt.Sprintf("Process with PID %s not found or exited during profiling", pid), http.StatusBadRequest)
-		} else {
-			http.Error(w, fmt.Sprintf("perf record failed: %v\nStderr: %s", err, stderrStr), http.StatusInternalServerError)
+	if backend == "perf" {
+		if err := checkPerfPermitted(opts); err != nil {
+			http.Error(w, fmt.Sprintf("Permission denied: %v", err), http.StatusForbidden)
+			return
 		}
-		return
 	}
 
-	// Check if perf.data was created and has content
-	if stat, err := os.Stat(perfDataPath); err != nil {
-		http.Error(w, "perf.data file was not created", http.StatusInternalServerError)
+	switch backend {
+	case "async-profiler":
+		runAsyncProfile(w, opts, format)
 		return
-	} else if stat.Size() == 0 {
-		http.Error(w, "perf.data file is empty - no samples collected", http.StatusInternalServerError)
+	case "py-spy":
+		runPySpyProfile(w, opts, format)
 		return
 	}
 
-	// Step 2: Convert perf.data to pprof format
-	log.Printf("Converting perf.data to pprof format")
-	pprofCmd := exec.Command("pprof", "-proto", "-output", pprofPath, perfDataPath)
-
-	var pprofStderr bytes.Buffer
-	pprofCmd.Stderr = &pprofStderr
+	preparePerfMap(w, &opts)
 
-	if err := pprofCmd.Run(); err != nil {
-		log.Printf("pprof conversion failed: %v", err)
-		log.Printf("pprof stderr: %s", pprofStderr.String())
-
-		stderrStr := pprofStderr.String()
-		if strings.Contains(stderrStr, "no samples") {
-			http.Error(w, "No samples found in perf.data - process may have been idle during profiling", http.StatusBadRequest)
-		} else if strings.Contains(stderrStr, "permission denied") {
-			http.Error(w, "Permission denied accessing perf.data file", http.StatusForbidden)
+	if opts.Snapshots > 1 {
+		if backend == "perf" {
+			runSeries(w, r, opts, format, snapshotPerf)
 		} else {
-			http.Error(w, fmt.Sprintf("pprof conversion failed: %v\nStderr: %s", err, stderrStr), http.StatusInternalServerError)
+			runSeries(w, r, opts, format, snapshotBCC)
 		}
 		return
 	}
 
-	// Check if pprof file was created and has content
-	if stat, err := os.Stat(pprofPath); err != nil {
-		http.Error(w, "pprof file was not created", http.StatusInternalServerError)
-		return
-	} else if stat.Size() == 0 {
-		http.Error(w, "pprof file is empty - conversion produced no data", http.StatusInternalServerError)
-		return
+	switch {
+	case format == "live":
+		serveLive(w, r, opts)
+	case format == "hotcold":
+		runHotCold(w, opts)
+	case opts.StreamInterval > 0:
+		streamBCCFolded(w, r, opts)
+	case backend == "perf" && format == "pprof":
+		runPerfProfile(w, r, opts)
+	case backend == "perf":
+		runPerfFolded(w, opts)
+	default:
+		runBCCProfile(w, r, opts, format)
 	}
+}
 
-	// Step 3: Serve the pprof file
-	pprofFile, err := os.Open(pprofPath)
+// resolveRedisPort fills in opts.PID from opts.RedisPort when the target was
+// given by port
+func resolveRedisPort(opts *profileOptions) error {
+	if opts.RedisPort == 0 {
+		return nil
+	}
+	pid, err := findPIDByPort(opts.RedisPort)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to open pprof file: %v", err), http.StatusInternalServerError)
-		return
+		return err
 	}
-	defer pprofFile.Close()
+	opts.PID = strconv.Itoa(pid)
+	log.Printf("Resolved redis_port %d to PID %d", opts.RedisPort, pid)
+	return nil
+}
 
-	// Set appropriate headers
-	w.Header().Set("Content-Type", "application/octet-stream")
-	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=profile-%s-%d.pb.gz", pid, duration))
+// captureError is a profiling failure together with the HTTP status it maps to
+type captureError struct {
+	Status  int
+	Message string
+}
 
-	// Stream the file to the client
-	if _, err := io.Copy(w, pprofFile); err != nil {
-		log.Printf("Failed to stream pprof file: %v", err)
+func (e *captureError) Error() string {
+	return e.Message
+}
+
+// writeCaptureError reports a failed capture to the client
+func writeCaptureError(w http.ResponseWriter, err error) {
+	if ce, ok := err.(*captureError); ok {
+		http.Error(w, ce.Message, ce.Status)
 		return
 	}
-
-	log.Printf("Successfully served pprof profile for PID %s", pid)
+	http.Error(w, err.Error(), http.StatusInternalServerError)
 }
 
-// runBCCProfile executes the original BCC-based profiling for folded format
-func runBCCProfile(w http.ResponseWriter, r *http.Request, pid string, duration int) {
-	// Original BCC implementation for folded format
-	args := []string{
-		"profile-bpfcc",
-		"-p", pid,
-		"-F", "999",
-		"-f",                        // folded format
-		fmt.Sprintf("%d", duration), // duration as positional argument
+// captureMeta describes a capture for the profile store
+func captureMeta(opts profileOptions, format string) profileMeta {
+	meta := profileMeta{Format: format, PID: opts.PID, Duration: opts.Duration, Labels: opts.Labels}
+	if pid, err := strconv.Atoi(opts.PID); err == nil {
+		meta.Comm, _ = readComm(pid)
 	}
+	return meta
+}
+
+// addWarning logs a non-fatal problem with the request and surfaces it to the
+// client in an X-Profile-Warning response header
+func addWarning(w http.ResponseWriter, msg string) {
+	log.Printf("Warning: %s", msg)
+	w.Header().Add("X-Profile-Warning", msg)
+}
 
-	cmd := exec.Command("sudo", args...)
+// validatePID checks if the given PID exists and is accessible
+func validatePID(pid string) error {
+	// Check if PID is a valid number
+	if _, err := strconv.Atoi(pid); err != nil {
+		return fmt.Errorf("invalid PID format: %s", pid)
+	}
 
-	// Capture both stdout and stderr
-	var stdout, stderr bytes.Buffer
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
+	// Check if /proc/<pid> exists
+	procPath := filepath.Join(procRoot, pid)
+	if _, err := os.Stat(procPath); os.IsNotExist(err) {
+		return fmt.Errorf("process with PID %s does not exist", pid)
+	} else if err != nil {
+		return fmt.Errorf("cannot access process %s: %v", pid, err)
+	}
 
-	log.Printf("Running command: sudo %s", strings.Join(args, " "))
+	return nil
+}
 
-	if err := cmd.Run(); err != nil {
-		log.Printf("Command failed: %v", err)
-		log.Printf("Stderr: %s", stderr.String())
-		http.Error(w, fmt.Sprintf("Profiler failed: %v\nStderr: %s", err, stderr.String()), http.StatusInternalServerError)
-		return
+// validateTID checks that tid is a live thread of the process pid
+func validateTID(pid, tid string) error {
+	if _, err := strconv.Atoi(tid); err != nil {
+		return fmt.Errorf("invalid TID format: %s", tid)
 	}
 
-	// Set headers for folded format
-	w.Header().Set("Content-Type", "text/plain")
+	taskPath := filepath.Join(procRoot, pid, "task", tid)
+	if _, err := os.Stat(taskPath); os.IsNotExist(err) {
+		return fmt.Errorf("thread %s does not belong to process %s", tid, pid)
+	} else if err != nil {
+		return fmt.Errorf("cannot access thread %s: %v", tid, err)
+	}
 
-	// Return the output
-	w.Write(stdout.Bytes())
+	return nil
 }
 
 func generateMockProfile(pid string, duration int) string {
@@ -284,3 +1132,22 @@ redis-server;main;aeMain;aeProcessEvents;processCommand;lookupCommand 30
 redis-server;main;aeMain;aeProcessEvents;processCommand;call 40
 `, pid, duration)
 }
+
+// generateMockPerfScript creates perf script output for test mode
+func generateMockPerfScript(pid string) string {
+	return fmt.Sprintf(`# ========
+# captured on    : mock
+# ========
+#
+redis-server %[1]s/%[1]s 12345.678901:     250000 cycles: 
+	    55d0c1a2b3c4 aeApiPoll (/usr/bin/redis-server)
+	    55d0c1a2b000 aeProcessEvents (/usr/bin/redis-server)
+	    55d0c1a2a000 aeMain (/usr/bin/redis-server)
+
+redis-server %[1]s/%[1]s 12345.679901:     250000 cycles: 
+	    55d0c1a2c000 lookupCommand (/usr/bin/redis-server)
+	    55d0c1a2c400 processCommand (/usr/bin/redis-server)
+	    55d0c1a2a000 aeMain (/usr/bin/redis-server)
+
+`, pid)
+}
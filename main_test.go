@@ -1,12 +1,18 @@
 package main
 
 import (
+	"archive/tar"
+	"bytes"
+	"context"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestValidatePID(t *testing.T) {
@@ -120,11 +126,6 @@ func TestMissingParameters(t *testing.T) {
 			url:      "/debug/pprof/profile?seconds=5",
 			wantCode: http.StatusBadRequest,
 		},
-		{
-			name:     "missing seconds",
-			url:      "/debug/pprof/profile?pid=1234",
-			wantCode: http.StatusBadRequest,
-		},
 		{
 			name:     "missing both",
 			url:      "/debug/pprof/profile",
@@ -140,6 +141,86 @@ func TestMissingParameters(t *testing.T) {
 			url:      "/debug/pprof/profile?pid=1234&seconds=500",
 			wantCode: http.StatusBadRequest,
 		},
+		{
+			name:     "invalid runtime",
+			url:      "/debug/pprof/profile?pid=1234&seconds=5&runtime=ruby",
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "invalid backend",
+			url:      "/debug/pprof/profile?pid=1234&seconds=5&backend=jvm",
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "invalid stacks",
+			url:      "/debug/pprof/profile?pid=1234&seconds=5&stacks=both-ish",
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "invalid callgraph",
+			url:      "/debug/pprof/profile?pid=1234&seconds=5&callgraph=magic",
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "dwarf_size not a multiple of 8",
+			url:      "/debug/pprof/profile?pid=1234&seconds=5&callgraph=dwarf&dwarf_size=1000",
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "invalid lbr_fallback",
+			url:      "/debug/pprof/profile?pid=1234&seconds=5&callgraph=lbr&lbr_fallback=lbr",
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "invalid tid",
+			url:      "/debug/pprof/profile?pid=1234&seconds=5&tid=abc",
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "tid with children",
+			url:      "/debug/pprof/profile?pid=1234&seconds=5&tid=1235&children=true",
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "negative delay",
+			url:      "/debug/pprof/profile?pid=1234&seconds=5&delay=-1",
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "delay too large",
+			url:      "/debug/pprof/profile?pid=1234&seconds=5&delay=301",
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "dwarf_size too large",
+			url:      "/debug/pprof/profile?pid=1234&seconds=5&callgraph=dwarf&dwarf_size=65536",
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "invalid redis_port",
+			url:      "/debug/pprof/profile?redis_port=70000&seconds=5",
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "pid with redis_port",
+			url:      "/debug/pprof/profile?pid=1234&redis_port=6379&seconds=5",
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "frequency too high",
+			url:      "/debug/pprof/profile?pid=1234&seconds=5&frequency=20000",
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "unknown event",
+			url:      "/debug/pprof/profile?pid=1234&seconds=5&event=syscalls:sys_enter_write",
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "label without value",
+			url:      "/debug/pprof/profile?pid=1234&seconds=5&label=incident",
+			wantCode: http.StatusBadRequest,
+		},
 	}
 
 	for _, tt := range tests {
@@ -201,6 +282,294 @@ func TestGenerateMockProfile(t *testing.T) {
 	}
 }
 
+func TestStacksOption(t *testing.T) {
+	tests := []struct {
+		stacks   string
+		wantPerf string
+		wantBCC  string
+	}{
+		{stacks: "user", wantPerf: "--all-user", wantBCC: "-U"},
+		{stacks: "kernel", wantPerf: "--all-kernel", wantBCC: "-K"},
+		{stacks: "both"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.stacks, func(t *testing.T) {
+			opts := profileOptions{PID: "1234", Duration: 5, Stacks: tt.stacks}
+
+			perfArgs := strings.Join(perfRecordArgs(opts, "perf.data"), " ")
+			bccArgs := strings.Join(bccProfileArgs(opts), " ")
+
+			if tt.wantPerf != "" && !strings.Contains(perfArgs, tt.wantPerf) {
+				t.Errorf("perf args %q should contain %q", perfArgs, tt.wantPerf)
+			}
+			if tt.wantBCC != "" && !strings.Contains(bccArgs, tt.wantBCC) {
+				t.Errorf("bcc args %q should contain %q", bccArgs, tt.wantBCC)
+			}
+			if tt.stacks == "both" && (strings.Contains(perfArgs, "--all-") || strings.Contains(bccArgs, " -U") || strings.Contains(bccArgs, " -K")) {
+				t.Errorf("stacks=both should not filter: perf %q, bcc %q", perfArgs, bccArgs)
+			}
+			if !strings.HasSuffix(bccArgs, " 5") {
+				t.Errorf("bcc args %q should end with the duration", bccArgs)
+			}
+		})
+	}
+}
+
+func TestCallGraphOption(t *testing.T) {
+	fp := strings.Join(perfRecordArgs(profileOptions{PID: "1", Duration: 1, CallGraph: "fp"}, "perf.data"), " ")
+	if !strings.Contains(fp, "-g") || strings.Contains(fp, "--call-graph") {
+		t.Errorf("fp mode should use -g: %q", fp)
+	}
+
+	dwarf := strings.Join(perfRecordArgs(profileOptions{PID: "1", Duration: 1, CallGraph: "dwarf", DwarfSize: 16384}, "perf.data"), " ")
+	if !strings.Contains(dwarf, "--call-graph dwarf,16384") || strings.Contains(dwarf, " -g ") {
+		t.Errorf("dwarf mode should use --call-graph dwarf,16384: %q", dwarf)
+	}
+
+	lbr := strings.Join(perfRecordArgs(profileOptions{PID: "1", Duration: 1, CallGraph: "lbr"}, "perf.data"), " ")
+	if !strings.Contains(lbr, "--call-graph lbr") {
+		t.Errorf("lbr mode should use --call-graph lbr: %q", lbr)
+	}
+}
+
+func TestLBRSupported(t *testing.T) {
+	orig := lbrCapsPath
+	defer func() { lbrCapsPath = orig }()
+
+	dir := t.TempDir()
+	lbrCapsPath = filepath.Join(dir, "branches")
+
+	if lbrSupported() {
+		t.Errorf("lbrSupported() should be false when caps file is missing")
+	}
+
+	if err := os.WriteFile(lbrCapsPath, []byte("32\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if !lbrSupported() {
+		t.Errorf("lbrSupported() should be true for a 32 entry LBR stack")
+	}
+
+	if err := os.WriteFile(lbrCapsPath, []byte("0\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if lbrSupported() {
+		t.Errorf("lbrSupported() should be false for a zero depth LBR stack")
+	}
+}
+
+func TestCallGraphDwarfFolded(t *testing.T) {
+	req := httptest.NewRequest("GET", "/debug/folded/profile?pid=1&seconds=5&callgraph=dwarf", nil)
+	rr := httptest.NewRecorder()
+	handleFolded(rr, req)
+
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("folded endpoint should reject callgraph=dwarf: got %v", rr.Code)
+	}
+}
+
+func TestChildrenOption(t *testing.T) {
+	opts := profileOptions{PID: "100", Duration: 5, ChildPIDs: []string{"101", "102"}}
+
+	perfArgs := strings.Join(perfRecordArgs(opts, "perf.data"), " ")
+	if !strings.Contains(perfArgs, "--pid 100,101,102") {
+		t.Errorf("perf args %q should target the parent and its children", perfArgs)
+	}
+
+	bccArgs := strings.Join(bccProfileArgs(opts), " ")
+	if !strings.Contains(bccArgs, "-p 100,101,102") {
+		t.Errorf("bcc args %q should target the parent and its children", bccArgs)
+	}
+}
+
+func TestFrequencyAndEventOptions(t *testing.T) {
+	opts, err := parseCaptureOptions(url.Values{"pid": {"100"}, "seconds": {"5"}, "frequency": {"49"}, "event": {"page-faults"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	perfArgs := strings.Join(perfRecordArgs(opts, "perf.data"), " ")
+	if !strings.Contains(perfArgs, "-F 49 -e page-faults") {
+		t.Errorf("perf args %q should sample page-faults at 49 Hz", perfArgs)
+	}
+	bccArgs := strings.Join(bccProfileArgs(opts), " ")
+	if !strings.Contains(bccArgs, "-F 49") {
+		t.Errorf("bcc args %q should sample at 49 Hz", bccArgs)
+	}
+	if _, err := selectBackend(profileOptions{PID: "100", Backend: "bcc", CallGraph: "fp", Event: "page-faults"}, "folded"); err == nil {
+		t.Error("backend=bcc accepted event")
+	}
+
+	defaults := strings.Join(perfRecordArgs(profileOptions{PID: "100", Duration: 5}, "perf.data"), " ")
+	if !strings.Contains(defaults, "-F 999") || strings.Contains(defaults, "-e ") {
+		t.Errorf("perf args %q should sample the default event at 999 Hz", defaults)
+	}
+}
+
+func TestWallMode(t *testing.T) {
+	opts, err := parseCaptureOptions(url.Values{"pid": {"100"}, "seconds": {"5"}, "mode": {"wall"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perfArgs := strings.Join(perfRecordArgs(opts, "perf.data"), " "); !strings.Contains(perfArgs, "-F 999 -e cpu-clock --off-cpu") {
+		t.Errorf("perf args %q should sample cpu-clock and off-CPU time", perfArgs)
+	}
+	if args := pySpyArgs(opts, "raw", "py-spy.out"); args[len(args)-1] != "--idle" {
+		t.Errorf("py-spy args %q should include idle threads", args)
+	}
+	if args := strings.Join(asyncProfilerArgs(asyncProfilerConfig{Event: "cpu"}, opts, ""), " "); !strings.HasPrefix(args, "-d 5 -e wall ") {
+		t.Errorf("async-profiler args %q should sample wall clock", args)
+	}
+
+	if opts, _ := parseCaptureOptions(url.Values{"pid": {"100"}, "seconds": {"5"}}); opts.Mode != "cpu" {
+		t.Errorf("default mode = %q, want cpu", opts.Mode)
+	}
+	for _, q := range []url.Values{
+		{"pid": {"100"}, "seconds": {"5"}, "mode": {"offcpu"}},
+		{"pid": {"100"}, "seconds": {"5"}, "mode": {"wall"}, "event": {"cpu-clock"}},
+		{"pid": {"100"}, "seconds": {"5"}, "mode": {"wall"}, "format": {"chrometrace"}},
+	} {
+		if _, err := parseCaptureOptions(q); err == nil {
+			t.Errorf("%v accepted", q)
+		}
+	}
+}
+
+func TestTIDOption(t *testing.T) {
+	opts := profileOptions{PID: "100", Duration: 5, TID: "105"}
+
+	perfArgs := strings.Join(perfRecordArgs(opts, "perf.data"), " ")
+	if !strings.Contains(perfArgs, "--tid 105") || strings.Contains(perfArgs, "--pid") {
+		t.Errorf("perf args %q should target only the thread", perfArgs)
+	}
+
+	bccArgs := strings.Join(bccProfileArgs(opts), " ")
+	if !strings.Contains(bccArgs, "-L 105") || strings.Contains(bccArgs, "-p ") {
+		t.Errorf("bcc args %q should target only the thread", bccArgs)
+	}
+}
+
+func TestValidateTID(t *testing.T) {
+	self := strconv.Itoa(os.Getpid())
+
+	if err := validateTID(self, self); err != nil {
+		t.Errorf("validateTID() main thread: %v", err)
+	}
+	if err := validateTID(self, "999999999"); err == nil {
+		t.Errorf("validateTID() should reject threads of other processes")
+	}
+	if err := validateTID(self, "abc"); err == nil {
+		t.Errorf("validateTID() should reject malformed TIDs")
+	}
+}
+
+func TestDelayCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	req := httptest.NewRequest("GET", "/debug/pprof/profile?pid=1&seconds=1&delay=300", nil).WithContext(ctx)
+	rr := httptest.NewRecorder()
+
+	done := make(chan struct{})
+	go func() {
+		handlePprof(rr, req)
+		close(done)
+	}()
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler did not return after the client went away during the delay")
+	}
+}
+
+func TestRedisPortOption(t *testing.T) {
+	writeFakeProc(t, map[int]int{100: 1})
+	writeFakeListener(t, 100, 6379, "555")
+
+	req := httptest.NewRequest("GET", "/debug/folded/profile?redis_port=6379&seconds=5&test=true", nil)
+	rr := httptest.NewRecorder()
+	handleFolded(rr, req)
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "PID 100") {
+		t.Errorf("redis_port=6379: status %d: %s", rr.Code, rr.Body.String())
+	}
+
+	req = httptest.NewRequest("GET", "/debug/folded/profile?redis_port=6380&seconds=5&test=true", nil)
+	rr = httptest.NewRecorder()
+	handleFolded(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("redis_port=6380 without a listener: status %d, want %d", rr.Code, http.StatusBadRequest)
+	}
+}
+
+func TestRawPerfFormats(t *testing.T) {
+	req := httptest.NewRequest("GET", "/debug/pprof/profile?pid=1234&seconds=5&format=perfscript&test=true", nil)
+	rr := httptest.NewRecorder()
+	handlePprof(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rr.Code, rr.Body.String())
+	}
+	samples, err := parsePerfScript(rr.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(samples) != 2 || samples[0].PID != 1234 || samples[0].Stack[0].Symbol != "aeApiPoll" {
+		t.Errorf("mock perf script samples = %+v", samples)
+	}
+
+	req = httptest.NewRequest("GET", "/debug/pprof/profile?pid=1234&seconds=5&format=perfdata&test=true", nil)
+	rr = httptest.NewRecorder()
+	handlePprof(rr, req)
+	if rr.Code != http.StatusOK || !strings.HasPrefix(rr.Body.String(), "PERFILE2") {
+		t.Errorf("format=perfdata: status %d, body %q", rr.Code, rr.Body.String())
+	}
+
+	req = httptest.NewRequest("GET", "/debug/pprof/profile?pid=1234&seconds=5&format=perfarchive&test=true", nil)
+	rr = httptest.NewRecorder()
+	handlePprof(rr, req)
+	if names, _ := readTar(t, rr.Body); strings.Join(names, ",") != "perf.data,perf.data.tar.bz2" {
+		t.Errorf("format=perfarchive: archive files = %v", names)
+	}
+
+	for _, url := range []string{
+		"/debug/folded/profile?pid=1234&seconds=5&format=perfscript&test=true",
+		"/debug/folded/profile?pid=1234&seconds=5&format=perfdata&test=true",
+		"/debug/pprof/profile?pid=1234&seconds=5&format=svg&test=true",
+		"/debug/pprof/profile?pid=1234&seconds=5&format=perfscript&snapshots=2&test=true",
+	} {
+		req := httptest.NewRequest("GET", url, nil)
+		rr := httptest.NewRecorder()
+		if strings.Contains(url, "folded") {
+			handleFolded(rr, req)
+		} else {
+			handlePprof(rr, req)
+		}
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want %d", url, rr.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestCopyFileToTar(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "perf.data")
+	if err := os.WriteFile(path, []byte("PERFILE2"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	if err := copyFileToTar(tw, path); err != nil {
+		t.Fatal(err)
+	}
+	tw.Close()
+
+	names, files := readTar(t, &buf)
+	if len(names) != 1 || string(files["perf.data"]) != "PERFILE2" {
+		t.Errorf("archive = %v %q", names, files)
+	}
+}
+
 // TestBasicAuth tests the basic authentication functionality
 func TestBasicAuth(t *testing.T) {
 	password := "testpass"
@@ -0,0 +1,408 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// defaultMemFunctions is how many functions /debug/memaccess lists without
+// the functions parameter
+const defaultMemFunctions = 20
+
+// memAccessOps maps the ops parameter of /debug/memaccess to the perf mem
+// -t argument
+var memAccessOps = map[string]string{
+	"load":  "load",
+	"store": "store",
+	"all":   "load,store",
+}
+
+// perfMemRecordArgs builds the perf mem record command line sampling the
+// given memory operations of the target into outputPath
+func perfMemRecordArgs(opts profileOptions, ops, outputPath string) []string {
+	args := []string{"mem", "-t", ops, "record", "-o", outputPath}
+
+	if opts.TID != "" {
+		args = append(args, "--tid", opts.TID)
+	} else {
+		args = append(args, "--pid", opts.targetPIDs())
+	}
+
+	return append(args, "--", "sleep", fmt.Sprintf("%d", opts.Duration))
+}
+
+// perfMemReportArgs builds the perf mem report command line dumping the raw
+// samples of inputPath as CSV
+func perfMemReportArgs(inputPath string) []string {
+	return []string{"mem", "-D", "-x", ",", "-i", inputPath, "report"}
+}
+
+// memSample is one sample of perf mem report -D
+type memSample struct {
+	// Weight is the access latency in cycles, 0 when the CPU does not
+	// report it, as for most stores
+	Weight   int64
+	DataSrc  uint64
+	DSO      string
+	Function string
+}
+
+// parsePerfMem decodes perf mem report -D -x, output:
+// "pid,tid,ip,addr,local weight,data source,dso:symbol"
+func parsePerfMem(r io.Reader) ([]memSample, error) {
+	var samples []memSample
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		// Only the symbol, last, may hold commas
+		fields := strings.SplitN(line, ",", 7)
+		if len(fields) < 7 {
+			return nil, fmt.Errorf("unexpected perf mem line: %q", line)
+		}
+		weight, err := strconv.ParseInt(strings.TrimSpace(fields[4]), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("unexpected perf mem weight: %q", line)
+		}
+		dataSrc, err := strconv.ParseUint(strings.TrimSpace(fields[5]), 0, 64)
+		if err != nil {
+			return nil, fmt.Errorf("unexpected perf mem data source: %q", line)
+		}
+		dso, function, _ := strings.Cut(strings.TrimSpace(fields[6]), ":")
+		samples = append(samples, memSample{Weight: weight, DataSrc: dataSrc, DSO: dso, Function: function})
+	}
+	return samples, scanner.Err()
+}
+
+// Fields of the perf_mem_data_src union, see include/uapi/linux/perf_event.h
+const (
+	memOpLoad  = 0x02
+	memOpStore = 0x04
+
+	memLvlShift = 5
+	memLvlHit   = 0x02
+	memLvlMiss  = 0x04
+
+	memLvlNumShift = 33
+	memRemoteShift = 37
+)
+
+// memLvlNames names the levels of mem_lvl_num, set by kernels since 4.14
+var memLvlNames = map[uint64]string{
+	0x01: "L1",
+	0x02: "L2",
+	0x03: "L3",
+	0x04: "L4",
+	0x09: "CXL",
+	0x0a: "IO",
+	0x0b: "cache",
+	0x0c: "LFB",
+	0x0d: "RAM",
+	0x0e: "PMEM",
+}
+
+// memLvlBits names the bits of the older mem_lvl bitmask, in the order
+// they are checked
+var memLvlBits = []struct {
+	bit  uint64
+	name string
+}{
+	{0x0008, "L1"},
+	{0x0010, "LFB"},
+	{0x0020, "L2"},
+	{0x0040, "L3"},
+	{0x0080, "local RAM"},
+	{0x0300, "remote RAM"},
+	{0x0c00, "remote cache"},
+	{0x1000, "IO"},
+	{0x2000, "uncached"},
+}
+
+// memLevel names the memory level a sample's data was found in, e.g. L1,
+// local RAM or remote RAM, "L1 miss" when the CPU only reports the L1
+// outcome, and N/A when it reports none
+func memLevel(dataSrc uint64) string {
+	lvl := (dataSrc >> memLvlShift) & 0x3fff
+	remote := (dataSrc>>memRemoteShift)&1 == 1
+
+	name := memLvlNames[(dataSrc>>memLvlNumShift)&0xf]
+	switch {
+	case name == "RAM" && remote:
+		return "remote RAM"
+	case name == "RAM":
+		return "local RAM"
+	case remote && (name == "cache" || name != "LFB" && strings.HasPrefix(name, "L")):
+		return "remote cache"
+	case name == "":
+		for _, b := range memLvlBits {
+			if lvl&b.bit != 0 {
+				name = b.name
+				break
+			}
+		}
+	}
+	if name == "" {
+		return "N/A"
+	}
+	if lvl&memLvlMiss != 0 && lvl&memLvlHit == 0 {
+		return name + " miss"
+	}
+	return name
+}
+
+// memLevelStats is the share of the sampled accesses served by one level
+type memLevelStats struct {
+	Level   string  `json:"level"`
+	Samples int     `json:"samples"`
+	Pct     float64 `json:"pct"`
+	// AvgLatency is the mean latency in cycles of the samples that
+	// report one
+	AvgLatency float64 `json:"avg_latency"`
+
+	weighted     int
+	totalLatency int64
+}
+
+// memFunction is the memory accesses sampled in one function
+type memFunction struct {
+	Function     string         `json:"function"`
+	DSO          string         `json:"dso"`
+	Samples      int            `json:"samples"`
+	Loads        int            `json:"loads"`
+	Stores       int            `json:"stores"`
+	AvgLatency   float64        `json:"avg_latency"`
+	TotalLatency int64          `json:"total_latency"`
+	Levels       map[string]int `json:"levels"`
+
+	weighted int
+}
+
+// memAccessReport is the response of /debug/memaccess
+type memAccessReport struct {
+	PID     string `json:"pid"`
+	Seconds int    `json:"seconds"`
+	Ops     string `json:"ops"`
+	Samples int    `json:"samples"`
+	// Levels break the samples down by the level they were served from,
+	// most frequent first
+	Levels []memLevelStats `json:"levels"`
+	// Functions are those with the highest total latency, or the most
+	// samples when the CPU reports no latency
+	Functions []memFunction `json:"functions"`
+}
+
+// summarizeMemAccess aggregates samples into the level breakdown and the
+// top limit functions of report
+func summarizeMemAccess(report *memAccessReport, samples []memSample, limit int) {
+	levels := make(map[string]*memLevelStats)
+	functions := make(map[string]*memFunction)
+
+	for _, s := range samples {
+		level := memLevel(s.DataSrc)
+		l := levels[level]
+		if l == nil {
+			l = &memLevelStats{Level: level}
+			levels[level] = l
+		}
+		key := s.DSO + ":" + s.Function
+		f := functions[key]
+		if f == nil {
+			f = &memFunction{Function: s.Function, DSO: s.DSO, Levels: make(map[string]int)}
+			functions[key] = f
+		}
+
+		l.Samples++
+		f.Samples++
+		f.Levels[level]++
+		switch {
+		case s.DataSrc&memOpLoad != 0:
+			f.Loads++
+		case s.DataSrc&memOpStore != 0:
+			f.Stores++
+		}
+		if s.Weight > 0 {
+			l.weighted++
+			l.totalLatency += s.Weight
+			f.weighted++
+			f.TotalLatency += s.Weight
+		}
+	}
+
+	report.Samples = len(samples)
+	report.Levels = []memLevelStats{}
+	for _, l := range levels {
+		l.Pct = 100 * float64(l.Samples) / float64(len(samples))
+		if l.weighted > 0 {
+			l.AvgLatency = float64(l.totalLatency) / float64(l.weighted)
+		}
+		report.Levels = append(report.Levels, *l)
+	}
+	sort.Slice(report.Levels, func(i, j int) bool {
+		a, b := report.Levels[i], report.Levels[j]
+		if a.Samples != b.Samples {
+			return a.Samples > b.Samples
+		}
+		return a.Level < b.Level
+	})
+
+	report.Functions = []memFunction{}
+	for _, f := range functions {
+		if f.weighted > 0 {
+			f.AvgLatency = float64(f.TotalLatency) / float64(f.weighted)
+		}
+		report.Functions = append(report.Functions, *f)
+	}
+	sort.Slice(report.Functions, func(i, j int) bool {
+		a, b := report.Functions[i], report.Functions[j]
+		if a.TotalLatency != b.TotalLatency {
+			return a.TotalLatency > b.TotalLatency
+		}
+		if a.Samples != b.Samples {
+			return a.Samples > b.Samples
+		}
+		return a.Function < b.Function
+	})
+	if len(report.Functions) > limit {
+		report.Functions = report.Functions[:limit]
+	}
+}
+
+// mockPerfMem is the perf mem report output returned in test mode
+const mockPerfMem = `# PID, TID, IP, ADDR, LOCAL WEIGHT, DSRC, SYMBOL
+1234,1234,0x55d0c1a2b3c4,0x7f3a10002040,  412,0x3a00002042,/usr/bin/redis-server:dictFind
+1234,1234,0x55d0c1a2b3c4,0x7f3a10042080,  389,0x3a00002042,/usr/bin/redis-server:dictFind
+1234,1234,0x55d0c1a2b3c4,0x7f3a10082100,  287,0x1a00001042,/usr/bin/redis-server:dictFind
+1234,1234,0x55d0c1a2b3c4,0x7f3a100c2140,   41,0x0600000842,/usr/bin/redis-server:dictFind
+1234,1234,0x55d0c1a2b500,0x7f3a20001000,   38,0x0600000842,/usr/bin/redis-server:lookupKey
+1234,1234,0x55d0c1a2b500,0x7f3a20001040,    7,0x0200000142,/usr/bin/redis-server:lookupKey
+1234,1234,0x55d0c1a2b600,0x7f3a30000010,    5,0x0200000142,/usr/bin/redis-server:_addReplyToBuffer
+1234,1234,0x55d0c1a2b700,0x7f3a30000080,    0,0x0200000144,/usr/bin/redis-server:_addReplyToBuffer
+1234,1234,0x55d0c1a2b800,0x7f3a40000000,    0,0x0200000144,/usr/lib/x86_64-linux-gnu/libc.so.6:__memmove_avx_unaligned_erms
+1234,1234,0x55d0c1a2b800,0x7f3a40000040,    0,0x0200000184,/usr/lib/x86_64-linux-gnu/libc.so.6:__memmove_avx_unaligned_erms
+`
+
+// handleMemAccess samples the loads and stores of a process with perf mem
+// and reports their latency and the memory levels serving them
+func handleMemAccess(w http.ResponseWriter, r *http.Request) {
+	opts, err := parseProfileOptions(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	q := r.URL.Query()
+	if err := rejectParams(q, reportIgnoredParams); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := resolveRedisPort(&opts); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid redis_port: %v", err), http.StatusBadRequest)
+		return
+	}
+	if err := resolveContainerPID(&opts); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid container PID: %v", err), http.StatusBadRequest)
+		return
+	}
+	opsName := q.Get("ops")
+	if opsName == "" {
+		opsName = "all"
+	}
+	ops, ok := memAccessOps[opsName]
+	if !ok {
+		http.Error(w, "Invalid ops: must be load, store or all", http.StatusBadRequest)
+		return
+	}
+	limit := defaultMemFunctions
+	if functions := q.Get("functions"); functions != "" {
+		if limit, err = strconv.Atoi(functions); err != nil || limit < 1 || limit > 500 {
+			http.Error(w, "Invalid functions: must be between 1 and 500", http.StatusBadRequest)
+			return
+		}
+	}
+	auditPID(r, opts.PID)
+
+	report := memAccessReport{PID: opts.PID, Seconds: opts.Duration, Ops: opsName}
+	var output []byte
+
+	if q.Get("test") == "true" {
+		output = []byte(mockPerfMem)
+	} else {
+		release, ok := takeCaptureSlot(w, r, opts.PID)
+		if !ok {
+			return
+		}
+		defer release()
+		if output, err = runPerfMem(opts, ops); err != nil {
+			writeCaptureError(w, err)
+			return
+		}
+	}
+
+	samples, err := parsePerfMem(bytes.NewReader(output))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to parse perf mem output: %v", err), http.StatusInternalServerError)
+		return
+	}
+	summarizeMemAccess(&report, samples, limit)
+	writeJSON(w, http.StatusOK, report)
+}
+
+// runPerfMem validates the target, records its memory accesses with perf
+// mem and returns the raw samples of perf mem report
+func runPerfMem(opts profileOptions, ops string) ([]byte, error) {
+	if err := preparePerfTarget(&opts); err != nil {
+		return nil, err
+	}
+
+	tempDir, err := newCaptureDir()
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tempDir)
+	dataPath := filepath.Join(tempDir, "perf.data")
+
+	log.Printf("Starting perf mem for PID %s, duration %d seconds", opts.PID, opts.Duration)
+	cmd := newCommand("perf", perfMemRecordArgs(opts, ops, dataPath)...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := runJob(cmd, captureTimeout(opts.Duration)); err != nil {
+		if _, ok := err.(*captureError); ok {
+			return nil, err
+		}
+		if strings.Contains(stderr.String(), "Permission denied") {
+			return nil, &captureError{http.StatusForbidden, "Permission denied: perf requires elevated privileges. Run with sudo or adjust perf_event_paranoid settings."}
+		}
+		if strings.Contains(stderr.String(), "not supported") {
+			return nil, &captureError{http.StatusNotImplemented, "perf mem needs memory sampling support from the CPU (Intel PEBS or AMD IBS), which most VMs do not expose"}
+		}
+		return nil, &captureError{http.StatusInternalServerError, fmt.Sprintf("perf mem record failed: %v\nStderr: %s", err, stderr.String())}
+	}
+
+	cmd = newCommand("perf", perfMemReportArgs(dataPath)...)
+	stdout := newLimitedBuffer()
+	stderr.Reset()
+	cmd.Stdout = stdout
+	cmd.Stderr = &stderr
+	if err := runJob(cmd, captureTimeout(opts.Duration)); err != nil {
+		if _, ok := err.(*captureError); ok {
+			return nil, err
+		}
+		return nil, &captureError{http.StatusInternalServerError, fmt.Sprintf("perf mem report failed: %v\nStderr: %s", err, stderr.String())}
+	}
+	if err := stdout.check("perf mem report output"); err != nil {
+		return nil, err
+	}
+	return stdout.Bytes(), nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPerfMemRecordArgs(t *testing.T) {
+	args := strings.Join(perfMemRecordArgs(profileOptions{PID: "100", Duration: 5, ChildPIDs: []string{"101"}}, "load,store", "perf.data"), " ")
+	if args != "mem -t load,store record -o perf.data --pid 100,101 -- sleep 5" {
+		t.Errorf("perf mem args = %q", args)
+	}
+
+	args = strings.Join(perfMemRecordArgs(profileOptions{PID: "100", Duration: 5, TID: "105"}, "load", "perf.data"), " ")
+	if !strings.Contains(args, "--tid 105") || strings.Contains(args, "--pid") {
+		t.Errorf("perf mem args %q should target only the thread", args)
+	}
+}
+
+func TestMemLevel(t *testing.T) {
+	for _, tt := range []struct {
+		dataSrc uint64
+		want    string
+	}{
+		{0x200000142, "L1"},
+		{0x200000184, "L1 miss"},
+		{0x600000842, "L3"},
+		{0x1a00001042, "local RAM"},
+		{0x3a00002042, "remote RAM"},
+		{0x2600000842, "remote cache"},
+		// Kernels before 4.14 only set the mem_lvl bitmask
+		{0x1042, "local RAM"},
+		{0x2042, "remote RAM"},
+		{0x8042, "remote cache"},
+		{0x0, "N/A"},
+	} {
+		if got := memLevel(tt.dataSrc); got != tt.want {
+			t.Errorf("memLevel(%#x) = %q, want %q", tt.dataSrc, got, tt.want)
+		}
+	}
+}
+
+func TestParsePerfMem(t *testing.T) {
+	samples, err := parsePerfMem(strings.NewReader(mockPerfMem + "1,1,0x1,0x2,   10,0x200000142,/usr/bin/app:std::map<int, int>::find\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(samples) != 11 {
+		t.Fatalf("got %d samples", len(samples))
+	}
+	if s := samples[0]; s.Weight != 412 || s.DataSrc != 0x3a00002042 || s.DSO != "/usr/bin/redis-server" || s.Function != "dictFind" {
+		t.Errorf("first sample = %+v", s)
+	}
+	if s := samples[10]; s.Function != "std::map<int, int>::find" {
+		t.Errorf("symbol with commas = %q", s.Function)
+	}
+
+	if _, err := parsePerfMem(strings.NewReader("garbage\n")); err == nil {
+		t.Error("parsePerfMem() accepted a malformed line")
+	}
+}
+
+func TestMemAccessEndpoint(t *testing.T) {
+	get := func(query string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		handleMemAccess(rr, httptest.NewRequest("GET", "/debug/memaccess?pid=1234&seconds=2&test=true"+query, nil))
+		return rr
+	}
+
+	rr := get("&functions=3")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rr.Code, rr.Body.String())
+	}
+	var report memAccessReport
+	if err := json.Unmarshal(rr.Body.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+	if report.Samples != 10 || report.Ops != "all" {
+		t.Errorf("samples %d, ops %q", report.Samples, report.Ops)
+	}
+	if l := report.Levels[0]; l.Level != "L1" || l.Samples != 4 || l.Pct != 40 || l.AvgLatency != 6 {
+		t.Errorf("most frequent level = %+v", l)
+	}
+
+	if len(report.Functions) != 3 {
+		t.Fatalf("functions = %+v", report.Functions)
+	}
+	f := report.Functions[0]
+	if f.Function != "dictFind" || f.Loads != 4 || f.TotalLatency != 1129 || f.Levels["remote RAM"] != 2 {
+		t.Errorf("slowest function = %+v", f)
+	}
+	// Stores without a latency do not lower the average
+	if f := report.Functions[2]; f.Function != "_addReplyToBuffer" || f.Stores != 1 || f.AvgLatency != 5 {
+		t.Errorf("third function = %+v", f)
+	}
+
+	for _, query := range []string{"&ops=prefetch", "&functions=0", "&functions=x", "&format=top", "&snapshots=2", "&mode=wall", "&backend=perf", "&stream_interval=1"} {
+		if rr := get(query); rr.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d", query, rr.Code)
+		}
+	}
+}
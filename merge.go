@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/google/pprof/profile"
+)
+
+// mergeProfiles combines profiles of the same kind into one, summing the
+// values of identical stacks
+func mergeProfiles(profiles []*profile.Profile) (*profile.Profile, error) {
+	for _, p := range profiles {
+		// profile.Merge compares period types and cannot handle missing ones
+		if p.PeriodType == nil {
+			p.PeriodType = &profile.ValueType{}
+		}
+	}
+
+	merged, err := profile.Merge(profiles)
+	if err != nil {
+		return nil, fmt.Errorf("profiles cannot be merged: %v", err)
+	}
+	return merged, nil
+}
+
+// loadMergeInputs loads the profiles named by repeated or comma-separated id
+// query parameters, or uploaded as multipart files named profile
+func loadMergeInputs(r *http.Request) ([]*profile.Profile, error) {
+	var profiles []*profile.Profile
+
+	if r.Method == http.MethodPost {
+		for i, fh := range r.MultipartForm.File["profile"] {
+			f, err := fh.Open()
+			if err != nil {
+				return nil, fmt.Errorf("uploaded profile %d: %v", i+1, err)
+			}
+			p, err := readProfile(f)
+			f.Close()
+			if err != nil {
+				return nil, fmt.Errorf("uploaded profile %d (%s): %v", i+1, fh.Filename, err)
+			}
+			profiles = append(profiles, p)
+		}
+		return profiles, nil
+	}
+
+	for _, ids := range r.URL.Query()["id"] {
+		for _, id := range strings.Split(ids, ",") {
+			p, err := loadStoredProfile(id)
+			if err != nil {
+				return nil, err
+			}
+			profiles = append(profiles, p)
+		}
+	}
+	return profiles, nil
+}
+
+// handleMerge combines several stored (?id=a&id=b) or uploaded (multipart
+// files named profile) profiles into a single pprof or folded profile
+func handleMerge(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "pprof" && format != "folded" {
+		http.Error(w, "Invalid format: must be pprof or folded", http.StatusBadRequest)
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		r.Body = http.MaxBytesReader(w, r.Body, 4*maxUploadSize)
+		if err := r.ParseMultipartForm(maxUploadSize); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid upload: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	profiles, err := loadMergeInputs(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(profiles) < 2 {
+		http.Error(w, "At least two profiles are required", http.StatusBadRequest)
+		return
+	}
+
+	merged, err := mergeProfiles(profiles)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if format == "folded" {
+		w.Header().Set("Content-Type", "text/plain")
+		writeFolded(w, profileToFolded(merged))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", "attachment; filename=merged.pb.gz")
+	merged.Write(w)
+}
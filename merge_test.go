@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMergeEndpointStored(t *testing.T) {
+	s := withTestStore(t)
+
+	var ids []string
+	for _, data := range []string{"main;a 1\n", "main;a 2\nmain;b 5\n", "main;b 1\n"} {
+		meta, err := s.Save(profileMeta{Format: "folded"}, strings.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, meta.ID)
+	}
+
+	url := "/api/v1/merge?format=folded&id=" + ids[0] + "," + ids[1] + "&id=" + ids[2]
+	rr := httptest.NewRecorder()
+	handleMerge(rr, httptest.NewRequest("GET", url, nil))
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("merge returned %d: %s", rr.Code, rr.Body.String())
+	}
+	if want := "main;a 3\nmain;b 6\n"; rr.Body.String() != want {
+		t.Errorf("merged = %q, want %q", rr.Body.String(), want)
+	}
+}
+
+func TestMergeEndpointUpload(t *testing.T) {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for _, data := range []string{"main;a 1\n", "main;a 4\n"} {
+		fw, err := mw.CreateFormFile("profile", "p.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write([]byte(data))
+	}
+	mw.Close()
+
+	req := httptest.NewRequest("POST", "/api/v1/merge?format=folded", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	rr := httptest.NewRecorder()
+	handleMerge(rr, req)
+
+	if rr.Code != http.StatusOK || rr.Body.String() != "main;a 5\n" {
+		t.Errorf("merge = %d %q", rr.Code, rr.Body.String())
+	}
+}
+
+func TestMergeEndpointErrors(t *testing.T) {
+	withTestStore(t)
+
+	tests := []struct {
+		name string
+		url  string
+	}{
+		{name: "no profiles", url: "/api/v1/merge"},
+		{name: "single profile", url: "/api/v1/merge?id=0123456789abcdef"},
+		{name: "unknown profile", url: "/api/v1/merge?id=0123456789abcdef,fedcba9876543210"},
+		{name: "invalid format", url: "/api/v1/merge?format=svg"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			handleMerge(rr, httptest.NewRequest("GET", tt.url, nil))
+			if rr.Code != http.StatusBadRequest {
+				t.Errorf("got %d, want 400", rr.Code)
+			}
+		})
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseCIDRs(t *testing.T) {
+	tests := []struct {
+		list    string
+		want    []string
+		wantErr bool
+	}{
+		{"10.0.0.0/8", []string{"10.0.0.0/8"}, false},
+		{"10.1.2.3/16, 192.168.1.7", []string{"10.1.0.0/16", "192.168.1.7/32"}, false},
+		{"::ffff:10.0.0.0/104,fd00::/8", []string{"10.0.0.0/8", "fd00::/8"}, false},
+		{"", nil, false},
+		{"10.0.0.0/33", nil, true},
+		{"monitoring", nil, true},
+	}
+	for _, tt := range tests {
+		prefixes, err := parseCIDRs(tt.list)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseCIDRs(%q) error = %v, wantErr %v", tt.list, err, tt.wantErr)
+			continue
+		}
+		var got []string
+		for _, p := range prefixes {
+			got = append(got, p.String())
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("parseCIDRs(%q) = %v, want %v", tt.list, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("parseCIDRs(%q) = %v, want %v", tt.list, got, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestAllowCIDRs(t *testing.T) {
+	prefixes, err := parseCIDRs("10.20.0.0/16,fd00::/8,127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := allowCIDRs(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), prefixes)
+
+	tests := []struct {
+		remote     string
+		wantStatus int
+	}{
+		{"10.20.3.4:51000", http.StatusOK},
+		{"[::ffff:10.20.3.4]:51000", http.StatusOK},
+		{"[fd12::1]:51000", http.StatusOK},
+		{"[fe80::1%eth0]:51000", http.StatusForbidden},
+		{"127.0.0.1:51000", http.StatusOK},
+		{"127.0.0.2:51000", http.StatusForbidden},
+		{"10.21.0.1:51000", http.StatusForbidden},
+		{"garbage", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/debug/pprof/profile", nil)
+		req.RemoteAddr = tt.remote
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != tt.wantStatus {
+			t.Errorf("%s: status = %d, want %d", tt.remote, rr.Code, tt.wantStatus)
+		}
+	}
+}
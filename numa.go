@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// numaStatEvents count the loads and stores that missed the last level
+// cache, and how many of them another node served
+var numaStatEvents = []string{"node-loads", "node-load-misses", "node-stores", "node-store-misses"}
+
+// parseCPUList expands a sysfs CPU list such as "0-3,8-11"
+func parseCPUList(s string) ([]int, error) {
+	var cpus []int
+	for _, part := range strings.Split(strings.TrimSpace(s), ",") {
+		if part == "" {
+			continue
+		}
+		first, last, isRange := strings.Cut(part, "-")
+		lo, err := strconv.Atoi(first)
+		if err != nil {
+			return nil, fmt.Errorf("malformed CPU list %q", s)
+		}
+		hi := lo
+		if isRange {
+			if hi, err = strconv.Atoi(last); err != nil || hi < lo {
+				return nil, fmt.Errorf("malformed CPU list %q", s)
+			}
+		}
+		for cpu := lo; cpu <= hi; cpu++ {
+			cpus = append(cpus, cpu)
+		}
+	}
+	return cpus, nil
+}
+
+// readNodeCPUs returns the CPUs of every NUMA node of the host from sysfs
+func readNodeCPUs() (map[int][]int, error) {
+	dirs, err := filepath.Glob(filepath.Join(sysRoot, "devices", "system", "node", "node[0-9]*"))
+	if err != nil {
+		return nil, err
+	}
+	nodes := make(map[int][]int)
+	for _, dir := range dirs {
+		node, err := strconv.Atoi(strings.TrimPrefix(filepath.Base(dir), "node"))
+		if err != nil {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, "cpulist"))
+		if err != nil {
+			return nil, err
+		}
+		if nodes[node], err = parseCPUList(string(data)); err != nil {
+			return nil, err
+		}
+	}
+	return nodes, nil
+}
+
+// readThreadCPUs returns the CPU every thread of pid last ran on
+func readThreadCPUs(pid string) ([]int, error) {
+	taskDir := filepath.Join(procRoot, pid, "task")
+	tasks, err := os.ReadDir(taskDir)
+	if err != nil {
+		return nil, err
+	}
+	var cpus []int
+	for _, task := range tasks {
+		fields, err := statFields(filepath.Join(taskDir, task.Name(), "stat"))
+		if err != nil {
+			// Threads can exit while we scan
+			continue
+		}
+		// processor is field 39 in proc(5)
+		if len(fields) < 37 {
+			return nil, fmt.Errorf("malformed stat for thread %s of PID %s", task.Name(), pid)
+		}
+		cpu, err := strconv.Atoi(fields[36])
+		if err != nil {
+			return nil, fmt.Errorf("malformed stat for thread %s of PID %s", task.Name(), pid)
+		}
+		cpus = append(cpus, cpu)
+	}
+	return cpus, nil
+}
+
+// parseNUMAMaps sums the bytes of every node in /proc/<pid>/numa_maps, whose
+// lines count the pages of a mapping resident on node k as Nk=pages
+func parseNUMAMaps(r io.Reader) (map[int]int64, error) {
+	memory := make(map[int]int64)
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		pageSize := int64(4096)
+		pages := make(map[int]int64)
+		for _, field := range strings.Fields(scanner.Text()) {
+			key, value, ok := strings.Cut(field, "=")
+			if !ok {
+				continue
+			}
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				continue
+			}
+			if key == "kernelpagesize_kB" {
+				pageSize = n * 1024
+			} else if node, ok := strings.CutPrefix(key, "N"); ok {
+				if node, err := strconv.Atoi(node); err == nil {
+					pages[node] += n
+				}
+			}
+		}
+		for node, n := range pages {
+			memory[node] += n * pageSize
+		}
+	}
+	return memory, scanner.Err()
+}
+
+// numaNode is the placement of the target on one NUMA node
+type numaNode struct {
+	Node        int     `json:"node"`
+	CPUs        []int   `json:"cpus"`
+	MemoryBytes int64   `json:"memory_bytes"`
+	MemoryPct   float64 `json:"memory_pct"`
+	// Threads is how many threads of the target last ran on the node
+	Threads int `json:"threads"`
+}
+
+// numaReport is the response of /debug/numa
+type numaReport struct {
+	PID     string     `json:"pid"`
+	Seconds int        `json:"seconds"`
+	Nodes   []numaNode `json:"nodes"`
+	// LocalMemoryPct is the share of the memory on the nodes the threads
+	// last ran on; the rest is only reached across the interconnect
+	LocalMemoryPct *float64      `json:"local_memory_pct,omitempty"`
+	Counters       []perfCounter `json:"counters"`
+
+	// Shares of the accesses missing the last level cache that another
+	// node served, omitted when the CPU does not count them
+	RemoteLoadRatio  *float64 `json:"remote_load_ratio,omitempty"`
+	RemoteStoreRatio *float64 `json:"remote_store_ratio,omitempty"`
+}
+
+// buildNUMAReport fills in the nodes of report from the node CPUs of the
+// host, the memory of the target per node and the CPUs its threads last ran
+// on, and derives the remote ratios from its counters
+func buildNUMAReport(report *numaReport, nodeCPUs map[int][]int, memory map[int]int64, threadCPUs []int) {
+	cpuNode := make(map[int]int)
+	nodes := make(map[int]*numaNode)
+	for node, cpus := range nodeCPUs {
+		nodes[node] = &numaNode{Node: node, CPUs: cpus}
+		for _, cpu := range cpus {
+			cpuNode[cpu] = node
+		}
+	}
+	var total int64
+	for node, size := range memory {
+		// Memory-only nodes, such as CXL expanders, have no CPUs
+		if nodes[node] == nil {
+			nodes[node] = &numaNode{Node: node, CPUs: []int{}}
+		}
+		nodes[node].MemoryBytes = size
+		total += size
+	}
+	for _, cpu := range threadCPUs {
+		if node, ok := cpuNode[cpu]; ok {
+			nodes[node].Threads++
+		}
+	}
+
+	report.Nodes = []numaNode{}
+	var local int64
+	for _, n := range nodes {
+		if total > 0 {
+			n.MemoryPct = 100 * float64(n.MemoryBytes) / float64(total)
+		}
+		if n.Threads > 0 {
+			local += n.MemoryBytes
+		}
+		report.Nodes = append(report.Nodes, *n)
+	}
+	sort.Slice(report.Nodes, func(i, j int) bool { return report.Nodes[i].Node < report.Nodes[j].Node })
+	if total > 0 && len(threadCPUs) > 0 {
+		pct := 100 * float64(local) / float64(total)
+		report.LocalMemoryPct = &pct
+	}
+
+	values := counterValues(report.Counters)
+	report.RemoteLoadRatio = counterRatio(values, "node-load-misses", "node-loads")
+	report.RemoteStoreRatio = counterRatio(values, "node-store-misses", "node-stores")
+}
+
+// mockNUMAMaps is the numa_maps of a redis-server whose dataset was
+// allocated on the node its main thread does not run on, for test mode
+const mockNUMAMaps = `55d0c1a00000 default file=/usr/bin/redis-server mapped=412 N0=412 kernelpagesize_kB=4
+55d0c2400000 default heap anon=262144 dirty=262144 N0=65536 N1=196608 kernelpagesize_kB=4
+7f3a00000000 default anon=1024 dirty=1024 N1=1024 kernelpagesize_kB=4
+7f3a10000000 default anon=256 dirty=256 N1=256 kernelpagesize_kB=2048
+7ffc3e1f0000 default stack anon=33 dirty=33 N0=33 kernelpagesize_kB=4
+`
+
+// mockNUMAStat is the perf stat output of numaStatEvents for test mode
+const mockNUMAStat = `1851220,,node-loads,2001530000,100.00,,
+1203293,,node-load-misses,2001530000,100.00,,
+412077,,node-stores,2001530000,100.00,,
+<not supported>,,node-store-misses,0,100.00,,
+`
+
+// handleNUMA reports where the memory of a process lives across NUMA nodes,
+// where its threads run and how often it reaches memory on another node
+func handleNUMA(w http.ResponseWriter, r *http.Request) {
+	opts, err := parseProfileOptions(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// The placement covers the whole process
+	if err := rejectParams(r.URL.Query(), append(reportIgnoredParams, "tid", "children")); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := resolveRedisPort(&opts); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid redis_port: %v", err), http.StatusBadRequest)
+		return
+	}
+	if err := resolveContainerPID(&opts); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid container PID: %v", err), http.StatusBadRequest)
+		return
+	}
+	auditPID(r, opts.PID)
+
+	report := numaReport{PID: opts.PID, Seconds: opts.Duration}
+	var output, numaMaps []byte
+	var nodeCPUs map[int][]int
+	var threadCPUs []int
+
+	if r.URL.Query().Get("test") == "true" {
+		output, numaMaps = []byte(mockNUMAStat), []byte(mockNUMAMaps)
+		nodeCPUs = map[int][]int{0: {0, 1, 2, 3}, 1: {4, 5, 6, 7}}
+		threadCPUs = []int{1, 2, 2, 3}
+	} else {
+		release, ok := takeCaptureSlot(w, r, opts.PID)
+		if !ok {
+			return
+		}
+		defer release()
+		if output, err = runPerfStat(opts, numaStatEvents); err != nil {
+			writeCaptureError(w, err)
+			return
+		}
+
+		// Placement is read at the end of the window, after the counters
+		if numaMaps, err = os.ReadFile(filepath.Join(procRoot, opts.PID, "numa_maps")); os.IsNotExist(err) {
+			http.Error(w, "numa_maps is not available: the kernel was built without NUMA support", http.StatusNotImplemented)
+			return
+		} else if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to read numa_maps: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if nodeCPUs, err = readNodeCPUs(); err != nil {
+			http.Error(w, fmt.Sprintf("Failed to read the NUMA nodes: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if threadCPUs, err = readThreadCPUs(opts.PID); err != nil {
+			http.Error(w, fmt.Sprintf("Failed to read the threads of PID %s: %v", opts.PID, err), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if report.Counters, err = parsePerfStat(bytes.NewReader(output)); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to parse perf stat output: %v", err), http.StatusInternalServerError)
+		return
+	}
+	memory, err := parseNUMAMaps(bytes.NewReader(numaMaps))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to parse numa_maps: %v", err), http.StatusInternalServerError)
+		return
+	}
+	buildNUMAReport(&report, nodeCPUs, memory, threadCPUs)
+	writeJSON(w, http.StatusOK, report)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseCPUList(t *testing.T) {
+	for _, tt := range []struct {
+		list string
+		want []int
+	}{
+		{"0-3\n", []int{0, 1, 2, 3}},
+		{"0-1,8,10-11", []int{0, 1, 8, 10, 11}},
+		{"\n", nil},
+	} {
+		got, err := parseCPUList(tt.list)
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseCPUList(%q) = %v, %v, want %v", tt.list, got, err, tt.want)
+		}
+	}
+	for _, list := range []string{"a", "3-1", "0-x"} {
+		if _, err := parseCPUList(list); err == nil {
+			t.Errorf("parseCPUList(%q) succeeded", list)
+		}
+	}
+}
+
+func TestParseNUMAMaps(t *testing.T) {
+	memory, err := parseNUMAMaps(strings.NewReader(mockNUMAMaps))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[int]int64{
+		0: (412 + 65536 + 33) * 4096,
+		// Huge pages count at their size
+		1: (196608+1024)*4096 + 256*2048*1024,
+	}
+	if !reflect.DeepEqual(memory, want) {
+		t.Errorf("memory = %v, want %v", memory, want)
+	}
+}
+
+func TestReadNUMATopology(t *testing.T) {
+	sys := t.TempDir()
+	for node, cpus := range map[string]string{"node0": "0-1\n", "node1": "2-3\n"} {
+		dir := filepath.Join(sys, "devices", "system", "node", node)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, "cpulist"), []byte(cpus), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	orig := sysRoot
+	sysRoot = sys
+	t.Cleanup(func() { sysRoot = orig })
+
+	nodes, err := readNodeCPUs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[int][]int{0: {0, 1}, 1: {2, 3}}; !reflect.DeepEqual(nodes, want) {
+		t.Errorf("nodes = %v, want %v", nodes, want)
+	}
+
+	writeFakeProc(t, map[int]int{100: 1})
+	for tid, cpu := range map[string]int{"100": 3, "101": 0} {
+		dir := filepath.Join(procRoot, "100", "task", tid)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		// processor is the 39th field
+		stat := fmt.Sprintf("%s (redis-server) S%s %d 0 0 0\n", tid, strings.Repeat(" 0", 35), cpu)
+		if err := os.WriteFile(filepath.Join(dir, "stat"), []byte(stat), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cpus, err := readThreadCPUs("100")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(cpus, []int{3, 0}) {
+		t.Errorf("thread CPUs = %v", cpus)
+	}
+}
+
+func TestNUMAEndpoint(t *testing.T) {
+	rr := httptest.NewRecorder()
+	handleNUMA(rr, httptest.NewRequest("GET", "/debug/numa?pid=1234&seconds=2&test=true", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rr.Code, rr.Body.String())
+	}
+	var report numaReport
+	if err := json.Unmarshal(rr.Body.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(report.Nodes) != 2 {
+		t.Fatalf("nodes = %+v", report.Nodes)
+	}
+	if n := report.Nodes[0]; n.Node != 0 || n.Threads != 4 || len(n.CPUs) != 4 {
+		t.Errorf("node 0 = %+v", n)
+	}
+	if n := report.Nodes[1]; n.Threads != 0 || n.MemoryPct < 80 {
+		t.Errorf("node 1 = %+v", n)
+	}
+	if report.LocalMemoryPct == nil || math.Abs(*report.LocalMemoryPct+report.Nodes[1].MemoryPct-100) > 0.001 {
+		t.Errorf("LocalMemoryPct = %v", report.LocalMemoryPct)
+	}
+	if report.RemoteLoadRatio == nil || math.Abs(*report.RemoteLoadRatio-0.65) > 0.001 {
+		t.Errorf("RemoteLoadRatio = %v, want 0.65", report.RemoteLoadRatio)
+	}
+	if report.RemoteStoreRatio != nil {
+		t.Errorf("RemoteStoreRatio = %v from an unsupported counter", *report.RemoteStoreRatio)
+	}
+
+	for _, query := range []string{"&format=top", "&snapshots=2", "&mode=wall", "&backend=perf", "&stream_interval=1", "&tid=1235", "&children=true"} {
+		rr := httptest.NewRecorder()
+		handleNUMA(rr, httptest.NewRequest("GET", "/debug/numa?pid=1234&seconds=2&test=true"+query, nil))
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d", query, rr.Code)
+		}
+	}
+}
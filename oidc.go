@@ -0,0 +1,380 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// jwtLeeway tolerates clock skew between the exporter and the issuer
+const jwtLeeway = time.Minute
+
+// jwksRefreshInterval bounds how often the signing keys are fetched when
+// tokens name unknown keys
+const jwksRefreshInterval = time.Minute
+
+// jwksMaxAge is how long fetched keys are used before they are fetched again,
+// so keys the issuer withdrew stop being trusted
+const jwksMaxAge = time.Hour
+
+// oidcConfig is the oidc section of the configuration file, which accepts
+// bearer JWTs issued by an OpenID Connect provider
+type oidcConfig struct {
+	// Issuer must match the iss claim; JWT authentication is off without it
+	Issuer string `json:"issuer"`
+	// JWKSURL serves the signing keys (default: the jwks_uri of the
+	// issuer's /.well-known/openid-configuration)
+	JWKSURL string `json:"jwks_url"`
+	// Audience must be one of the aud claims
+	Audience string `json:"audience"`
+	// Claims must be present with these values; for list claims such as
+	// groups, the value must be one of the elements
+	Claims map[string]string `json:"claims"`
+	// UsernameClaim identifies the client in logs and rate limits (default sub)
+	UsernameClaim string `json:"username_claim"`
+}
+
+func (c *oidcConfig) validate() error {
+	if c.Issuer == "" {
+		if c.JWKSURL != "" || c.Audience != "" || len(c.Claims) > 0 {
+			return fmt.Errorf("issuer is required")
+		}
+		return nil
+	}
+	for _, u := range []string{c.Issuer, c.JWKSURL} {
+		if u == "" {
+			continue
+		}
+		if parsed, err := url.Parse(u); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+			return fmt.Errorf("invalid url %q", u)
+		}
+	}
+	if c.Audience == "" {
+		return fmt.Errorf("audience is required")
+	}
+	if c.UsernameClaim == "" {
+		c.UsernameClaim = "sub"
+	}
+	return nil
+}
+
+// jwtVerifier checks bearer tokens against an oidcConfig
+type jwtVerifier struct {
+	cfg    oidcConfig
+	client *http.Client
+	now    func() time.Time
+
+	mu      sync.Mutex
+	jwksURL string
+	keys    map[string]crypto.PublicKey
+	fetched time.Time
+}
+
+// newJWTVerifier returns a verifier for cfg, or nil when JWT authentication
+// is off
+func newJWTVerifier(cfg oidcConfig) *jwtVerifier {
+	if cfg.Issuer == "" {
+		return nil
+	}
+	return &jwtVerifier{
+		cfg:     cfg,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		now:     time.Now,
+		jwksURL: cfg.JWKSURL,
+	}
+}
+
+// getJSON fetches url and decodes its JSON body into v
+func (v *jwtVerifier) getJSON(url string, out interface{}) error {
+	resp, err := v.client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// jsonWebKey is a key of a JWKS document
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// publicKey decodes an RSA or EC signing key
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	decode := func(s string) (*big.Int, error) {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil || len(b) == 0 {
+			return nil, fmt.Errorf("key %s: invalid encoding", k.Kid)
+		}
+		return new(big.Int).SetBytes(b), nil
+	}
+
+	switch k.Kty {
+	case "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("key %s: unsupported curve %q", k.Kid, k.Crv)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("key %s: unsupported key type %q", k.Kid, k.Kty)
+}
+
+// refreshKeys fetches the signing keys, discovering the JWKS URL first when
+// it is not configured. The caller holds v.mu.
+func (v *jwtVerifier) refreshKeys() error {
+	v.fetched = v.now()
+	if v.jwksURL == "" {
+		var discovery struct {
+			JWKSURI string `json:"jwks_uri"`
+		}
+		if err := v.getJSON(strings.TrimSuffix(v.cfg.Issuer, "/")+"/.well-known/openid-configuration", &discovery); err != nil {
+			return fmt.Errorf("OIDC discovery failed: %v", err)
+		}
+		if discovery.JWKSURI == "" {
+			return fmt.Errorf("OIDC discovery document has no jwks_uri")
+		}
+		v.jwksURL = discovery.JWKSURI
+	}
+
+	var jwks struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := v.getJSON(v.jwksURL, &jwks); err != nil {
+		return fmt.Errorf("failed to fetch JWKS: %v", err)
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range jwks.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		// Keys of types we cannot verify with are skipped, not fatal
+		if key, err := k.publicKey(); err == nil {
+			keys[k.Kid] = key
+		}
+	}
+	v.keys = keys
+	return nil
+}
+
+// key returns the signing key kid, fetching the keys again when it is unknown
+// so key rotation at the issuer is picked up
+func (v *jwtVerifier) key(kid string) (crypto.PublicKey, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	key, ok := v.keys[kid]
+	age := v.now().Sub(v.fetched)
+	if (!ok && age >= jwksRefreshInterval) || (v.keys != nil && age >= jwksMaxAge) {
+		if err := v.refreshKeys(); err != nil {
+			if !ok {
+				return nil, err
+			}
+			log.Printf("Failed to refresh signing keys, keeping the previous ones: %v", err)
+		}
+		key, ok = v.keys[kid]
+	}
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	return key, nil
+}
+
+// jwtAlgorithms maps the supported JWS algorithms to their hash; HMAC and
+// "none" are deliberately absent
+var jwtAlgorithms = map[string]crypto.Hash{
+	"RS256": crypto.SHA256, "RS384": crypto.SHA384, "RS512": crypto.SHA512,
+	"ES256": crypto.SHA256, "ES384": crypto.SHA384, "ES512": crypto.SHA512,
+}
+
+// verifySignature checks the JWS signature of signed with key
+func verifySignature(alg string, key crypto.PublicKey, signed, sig []byte) error {
+	hash := jwtAlgorithms[alg]
+	h := hash.New()
+	h.Write(signed)
+	digest := h.Sum(nil)
+
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if !strings.HasPrefix(alg, "RS") {
+			return fmt.Errorf("algorithm %s does not match the RSA key", alg)
+		}
+		return rsa.VerifyPKCS1v15(k, hash, digest, sig)
+	case *ecdsa.PublicKey:
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if !strings.HasPrefix(alg, "ES") || len(sig) != 2*size {
+			return fmt.Errorf("algorithm %s does not match the EC key", alg)
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(k, digest, r, s) {
+			return fmt.Errorf("invalid signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported key")
+}
+
+// numericDate is a JWT timestamp, in seconds since the epoch
+type numericDate float64
+
+func (d numericDate) time() time.Time {
+	return time.Unix(0, int64(float64(d)*float64(time.Second)))
+}
+
+// jwtClaims holds the registered claims we check and all claims as decoded
+type jwtClaims struct {
+	Issuer    string          `json:"iss"`
+	Audience  json.RawMessage `json:"aud"`
+	Expires   *numericDate    `json:"exp"`
+	NotBefore *numericDate    `json:"nbf"`
+	all       map[string]interface{}
+}
+
+// audiences returns the aud claim, which may be a string or a list
+func (c *jwtClaims) audiences() []string {
+	var one string
+	if json.Unmarshal(c.Audience, &one) == nil {
+		return []string{one}
+	}
+	var list []string
+	json.Unmarshal(c.Audience, &list)
+	return list
+}
+
+// claimMatches reports whether claim is want or, for lists, contains it
+func claimMatches(claim interface{}, want string) bool {
+	switch v := claim.(type) {
+	case string:
+		return v == want
+	case []interface{}:
+		for _, e := range v {
+			if s, ok := e.(string); ok && s == want {
+				return true
+			}
+		}
+	case bool, float64:
+		return fmt.Sprint(v) == want
+	}
+	return false
+}
+
+// verify checks token and returns the client's username
+func (v *jwtVerifier) verify(token string) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", fmt.Errorf("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return "", fmt.Errorf("malformed token header: %v", err)
+	}
+	if _, ok := jwtAlgorithms[header.Alg]; !ok {
+		return "", fmt.Errorf("unsupported algorithm %q", header.Alg)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", fmt.Errorf("malformed token signature")
+	}
+	key, err := v.key(header.Kid)
+	if err != nil {
+		return "", err
+	}
+	if err := verifySignature(header.Alg, key, []byte(parts[0]+"."+parts[1]), sig); err != nil {
+		return "", err
+	}
+
+	var claims jwtClaims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return "", fmt.Errorf("malformed token claims: %v", err)
+	}
+	if err := decodeSegment(parts[1], &claims.all); err != nil {
+		return "", fmt.Errorf("malformed token claims: %v", err)
+	}
+	now := v.now()
+	if claims.Issuer != v.cfg.Issuer {
+		return "", fmt.Errorf("issuer %q is not trusted", claims.Issuer)
+	}
+	if claims.Expires == nil || now.After(claims.Expires.time().Add(jwtLeeway)) {
+		return "", fmt.Errorf("token expired")
+	}
+	if claims.NotBefore != nil && now.Add(jwtLeeway).Before(claims.NotBefore.time()) {
+		return "", fmt.Errorf("token not valid yet")
+	}
+	audienceOK := false
+	for _, aud := range claims.audiences() {
+		audienceOK = audienceOK || aud == v.cfg.Audience
+	}
+	if !audienceOK {
+		return "", fmt.Errorf("token is not meant for audience %q", v.cfg.Audience)
+	}
+	for name, want := range v.cfg.Claims {
+		if !claimMatches(claims.all[name], want) {
+			return "", fmt.Errorf("claim %s does not match", name)
+		}
+	}
+
+	user, _ := claims.all[v.cfg.UsernameClaim].(string)
+	if user == "" {
+		return "", fmt.Errorf("token has no %s claim", v.cfg.UsernameClaim)
+	}
+	return user, nil
+}
+
+// decodeSegment decodes a base64url JSON segment of a JWT into v
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
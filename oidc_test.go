@@ -0,0 +1,267 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeIssuer is an OpenID Connect provider serving discovery and JWKS
+type fakeIssuer struct {
+	*httptest.Server
+	mu      sync.Mutex
+	keys    []map[string]string
+	fetches int
+}
+
+func newFakeIssuer(t *testing.T) *fakeIssuer {
+	t.Helper()
+	iss := &fakeIssuer{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{"issuer": iss.URL, "jwks_uri": iss.URL + "/keys"})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		iss.mu.Lock()
+		defer iss.mu.Unlock()
+		iss.fetches++
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": iss.keys})
+	})
+	iss.Server = httptest.NewServer(mux)
+	t.Cleanup(iss.Close)
+	return iss
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// addRSAKey publishes a new RSA key as kid
+func (iss *fakeIssuer) addRSAKey(t *testing.T, kid string) *rsa.PrivateKey {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	iss.mu.Lock()
+	defer iss.mu.Unlock()
+	iss.keys = append(iss.keys, map[string]string{
+		"kty": "RSA", "kid": kid, "use": "sig",
+		"n": b64(key.N.Bytes()), "e": b64(big.NewInt(int64(key.E)).Bytes()),
+	})
+	return key
+}
+
+// addECKey publishes a new P-256 key as kid
+func (iss *fakeIssuer) addECKey(t *testing.T, kid string) *ecdsa.PrivateKey {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	iss.mu.Lock()
+	defer iss.mu.Unlock()
+	iss.keys = append(iss.keys, map[string]string{
+		"kty": "EC", "kid": kid, "crv": "P-256",
+		"x": b64(key.X.FillBytes(make([]byte, 32))), "y": b64(key.Y.FillBytes(make([]byte, 32))),
+	})
+	return key
+}
+
+// signJWT returns a token with claims signed by key
+func signJWT(t *testing.T, alg, kid string, key crypto.Signer, claims map[string]interface{}) string {
+	t.Helper()
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := b64(header) + "." + b64(payload)
+
+	digest := crypto.SHA256.New()
+	digest.Write([]byte(signed))
+	sum := digest.Sum(nil)
+
+	var sig []byte
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		s, err := rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, sum)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig = s
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, sum)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+	return signed + "." + b64(sig)
+}
+
+func TestOIDCConfigValidate(t *testing.T) {
+	tests := []struct {
+		cfg     oidcConfig
+		wantErr bool
+	}{
+		{oidcConfig{}, false},
+		{oidcConfig{Issuer: "https://sso.example.com", Audience: "bcc-exporter"}, false},
+		{oidcConfig{Audience: "bcc-exporter"}, true},
+		{oidcConfig{Issuer: "https://sso.example.com"}, true},
+		{oidcConfig{Issuer: "sso.example.com", Audience: "bcc-exporter"}, true},
+		{oidcConfig{Issuer: "https://sso.example.com", JWKSURL: "ftp://keys", Audience: "bcc-exporter"}, true},
+	}
+	for _, tt := range tests {
+		if err := tt.cfg.validate(); (err != nil) != tt.wantErr {
+			t.Errorf("validate(%+v) error = %v, wantErr %v", tt.cfg, err, tt.wantErr)
+		}
+	}
+}
+
+func TestJWTVerify(t *testing.T) {
+	iss := newFakeIssuer(t)
+	rsaKey := iss.addRSAKey(t, "rsa-1")
+	ecKey := iss.addECKey(t, "ec-1")
+
+	cfg := oidcConfig{Issuer: iss.URL, Audience: "bcc-exporter", Claims: map[string]string{"groups": "sre"}}
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+	v := newJWTVerifier(cfg)
+	now := time.Now()
+	v.now = func() time.Time { return now }
+
+	claims := func(override map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{
+			"iss":    iss.URL,
+			"sub":    "alice",
+			"aud":    []string{"bcc-exporter", "grafana"},
+			"exp":    now.Add(time.Hour).Unix(),
+			"nbf":    now.Add(-time.Minute).Unix(),
+			"groups": []string{"dev", "sre"},
+		}
+		for k, val := range override {
+			if val == nil {
+				delete(c, k)
+			} else {
+				c[k] = val
+			}
+		}
+		return c
+	}
+	other, _ := rsa.GenerateKey(rand.Reader, 2048)
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr bool
+	}{
+		{"rsa", signJWT(t, "RS256", "rsa-1", rsaKey, claims(nil)), false},
+		{"ec", signJWT(t, "ES256", "ec-1", ecKey, claims(map[string]interface{}{"aud": "bcc-exporter"})), false},
+		{"expired", signJWT(t, "RS256", "rsa-1", rsaKey, claims(map[string]interface{}{"exp": now.Add(-time.Hour).Unix()})), true},
+		{"no exp", signJWT(t, "RS256", "rsa-1", rsaKey, claims(map[string]interface{}{"exp": nil})), true},
+		{"not yet valid", signJWT(t, "RS256", "rsa-1", rsaKey, claims(map[string]interface{}{"nbf": now.Add(time.Hour).Unix()})), true},
+		{"issuer", signJWT(t, "RS256", "rsa-1", rsaKey, claims(map[string]interface{}{"iss": "https://evil.example.com"})), true},
+		{"audience", signJWT(t, "RS256", "rsa-1", rsaKey, claims(map[string]interface{}{"aud": "grafana"})), true},
+		{"claim", signJWT(t, "RS256", "rsa-1", rsaKey, claims(map[string]interface{}{"groups": []string{"dev"}})), true},
+		{"no sub", signJWT(t, "RS256", "rsa-1", rsaKey, claims(map[string]interface{}{"sub": nil})), true},
+		{"wrong key", signJWT(t, "RS256", "rsa-1", other, claims(nil)), true},
+		{"algorithm mismatch", signJWT(t, "ES256", "rsa-1", ecKey, claims(nil)), true},
+		{"unknown key", signJWT(t, "RS256", "rsa-9", rsaKey, claims(nil)), true},
+		{"none", b64([]byte(`{"alg":"none"}`)) + "." + b64([]byte(`{"sub":"alice"}`)) + ".", true},
+		{"malformed", "not-a-jwt", true},
+	}
+	for _, tt := range tests {
+		user, err := v.verify(tt.token)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: verify() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+		} else if err == nil && user != "alice" {
+			t.Errorf("%s: user = %q, want alice", tt.name, user)
+		}
+	}
+}
+
+func TestJWTKeyRotation(t *testing.T) {
+	iss := newFakeIssuer(t)
+	first := iss.addRSAKey(t, "k1")
+
+	cfg := oidcConfig{Issuer: iss.URL, Audience: "bcc-exporter", UsernameClaim: "email"}
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+	v := newJWTVerifier(cfg)
+	now := time.Now()
+	v.now = func() time.Time { return now }
+	claims := map[string]interface{}{"iss": iss.URL, "aud": "bcc-exporter", "email": "alice@example.com", "exp": now.Add(time.Hour).Unix()}
+
+	if user, err := v.verify(signJWT(t, "RS256", "k1", first, claims)); err != nil || user != "alice@example.com" {
+		t.Fatalf("verify() = %q, %v", user, err)
+	}
+
+	// A key published after the last fetch is picked up, but unknown key
+	// IDs do not hammer the issuer
+	second := iss.addRSAKey(t, "k2")
+	if _, err := v.verify(signJWT(t, "RS256", "k2", second, claims)); err == nil {
+		t.Error("verify() with a new key succeeded before the refresh interval")
+	}
+	now = now.Add(jwksRefreshInterval)
+	if _, err := v.verify(signJWT(t, "RS256", "k2", second, claims)); err != nil {
+		t.Errorf("verify() with a rotated key: %v", err)
+	}
+	if iss.fetches != 2 {
+		t.Errorf("JWKS fetched %d times, want 2", iss.fetches)
+	}
+}
+
+func TestRequireAuthBearer(t *testing.T) {
+	iss := newFakeIssuer(t)
+	key := iss.addRSAKey(t, "k1")
+	cfg := oidcConfig{Issuer: iss.URL, Audience: "bcc-exporter"}
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+	jwt := newJWTVerifier(cfg)
+
+	var got string
+	handler := requireAuth(func(w http.ResponseWriter, r *http.Request) {
+		got = clientName(r)
+	}, func(user, pass string) bool { return user == "admin" && pass == "secret" }, jwt)
+
+	token := signJWT(t, "RS256", "k1", key, map[string]interface{}{
+		"iss": iss.URL, "aud": "bcc-exporter", "sub": "alice", "exp": time.Now().Add(time.Hour).Unix(),
+	})
+	tests := []struct {
+		name     string
+		auth     string
+		wantCode int
+		wantName string
+	}{
+		{"bearer", "Bearer " + token, http.StatusOK, "alice"},
+		{"basic", "Basic " + base64.StdEncoding.EncodeToString([]byte("admin:secret")), http.StatusOK, "admin"},
+		{"bad bearer", "Bearer " + token + "x", http.StatusUnauthorized, ""},
+		{"none", "", http.StatusUnauthorized, ""},
+	}
+	for _, tt := range tests {
+		got = ""
+		req := httptest.NewRequest("GET", "/debug/pprof/profile", nil)
+		if tt.auth != "" {
+			req.Header.Set("Authorization", tt.auth)
+		}
+		rr := httptest.NewRecorder()
+		handler(rr, req)
+		if rr.Code != tt.wantCode || got != tt.wantName {
+			t.Errorf("%s: status %d as %q, want %d as %q", tt.name, rr.Code, got, tt.wantCode, tt.wantName)
+		}
+		if rr.Code == http.StatusUnauthorized && len(rr.Header().Values("WWW-Authenticate")) != 2 {
+			t.Errorf("%s: WWW-Authenticate = %q, want Basic and Bearer", tt.name, rr.Header().Values("WWW-Authenticate"))
+		}
+	}
+}
@@ -0,0 +1,489 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// apiParam describes a query parameter in the OpenAPI document
+type apiParam struct {
+	name        string
+	description string
+	// typ is the JSON schema type: "string", "integer" or "boolean"
+	typ      string
+	enum     []string
+	min, max int
+}
+
+// apiParams are the query parameters of the API, referenced by name from
+// the operations
+var apiParams = []apiParam{
+	{name: "pid", description: "PID of the process to profile (required unless redis_port is given)", typ: "integer", min: 1},
+	{name: "redis_port", description: "Target the process listening on this TCP port instead of giving pid", typ: "integer", min: 1, max: 65535},
+	{name: "container", description: "Container ID or cgroup path that pid and tid are given in", typ: "string"},
+	{name: "seconds", description: "Capture duration", typ: "integer", min: 1, max: 300},
+	{name: "stacks", description: "Which stacks to record", typ: "string", enum: []string{"user", "kernel", "both"}},
+	{name: "callgraph", description: "Call graph mode", typ: "string", enum: []string{"fp", "dwarf", "lbr"}},
+	{name: "dwarf_size", description: "User stack dump size in bytes for callgraph=dwarf, a multiple of 8", typ: "integer", min: 8, max: 65528},
+	{name: "lbr_fallback", description: "Call graph mode used when the CPU has no LBR support", typ: "string", enum: []string{"fp", "dwarf"}},
+	{name: "children", description: "Also profile descendants of pid", typ: "boolean"},
+	{name: "tid", description: "Profile a single thread of pid", typ: "integer", min: 1},
+	{name: "thread_labels", description: "Require per-sample tid and thread labels, captured with perf", typ: "boolean"},
+	{name: "delay", description: "Seconds to wait before starting the capture", typ: "integer", max: 300},
+	{name: "snapshots", description: "Number of consecutive captures; more than one returns a tar archive", typ: "integer", min: 1, max: 100},
+	{name: "stream_interval", description: "Send the folded stacks of the capture every this many seconds, in a chunked response (bcc backend only)", typ: "integer", min: 1, max: 300},
+	{name: "redis_metadata", description: "Bundle Redis state captured before and after the profile in a tar archive", typ: "boolean"},
+	{name: "redis_addr", description: "Redis address for redis_metadata, by default the lowest port the process listens on", typ: "string"},
+	{name: "backend", description: "Profiler to use", typ: "string", enum: []string{"auto", "native", "perf", "bcc", "async-profiler", "py-spy"}},
+	{name: "runtime", description: "Overrides runtime detection", typ: "string", enum: []string{"java", "python", "node"}},
+	{name: "frequency", description: "Sampling frequency in Hz (default 999)", typ: "integer", min: 1, max: maxFrequency},
+	{name: "event", description: "perf event to sample instead of CPU cycles (perf only)", typ: "string", enum: perfRecordEvents},
+	{name: "mode", description: "cpu (default) samples running threads, wall samples them whether running or blocked", typ: "string", enum: []string{"cpu", "wall"}},
+	{name: "label", description: "name:value label kept with the stored profile, repeated for several labels", typ: "string"},
+	{name: "queue", description: "Wait for a capture slot when the concurrency limits are reached instead of failing with 503", typ: "boolean"},
+	{name: "test", description: "Return mock data instead of running a capture", typ: "boolean"},
+	{name: "profile_format", description: "Output format", typ: "string", enum: []string{"pprof", "perfscript", "perfdata", "perfarchive", "speedscope", "flamegraph", "top", "summary-json", "callgrind", "chrometrace", "html", "bundle"}},
+	{name: "annotate", description: "Suffix kernel frames with _[k] and JIT compiled frames with _[j] (default true)", typ: "boolean"},
+	{name: "nodecount", description: "Functions listed by format=top and format=summary-json (default 10)", typ: "integer", min: 1, max: 100},
+	{name: "ops", description: "Memory operations sampled by perf mem (default all)", typ: "string", enum: []string{"load", "store", "all"}},
+	{name: "functions", description: "Functions listed by /debug/memaccess (default 20)", typ: "integer", min: 1, max: 500},
+	{name: "parallel", description: "Maximum number of processes captured at the same time", typ: "integer", min: 1, max: 64},
+	{name: "commands", description: "Comma-separated Redis commands to trace, e.g. get,set (default all)", typ: "string"},
+	{name: "endpoint", description: "Capture endpoint to run on every peer; its other parameters are forwarded", typ: "string", enum: []string{"/debug/pprof/profile", "/debug/pprof/redis", "/debug/folded/profile", "/debug/perfstat", "/debug/memaccess", "/debug/numa", "/debug/sched", "/debug/redis/cmdlatency", "/debug/bpftrace/run"}},
+	{name: "peers", description: "Comma-separated peers, host:port or base URLs (default fanout.peers)", typ: "string"},
+	{name: "output", description: "Merge the profiles of the peers, or return a tar archive of their responses (default merged for pprof and folded profiles)", typ: "string", enum: []string{"merged", "tar"}},
+	{name: "script", description: "Name of a script listed by /debug/bpftrace/scripts", typ: "string"},
+	{name: "base", description: "Stored profile ID to compare from", typ: "string"},
+	{name: "target", description: "Stored profile ID to compare to", typ: "string"},
+	{name: "diff_format", description: "Output format", typ: "string", enum: []string{"pprof", "flamegraph", "folded"}},
+	{name: "id", description: "Stored profile IDs, repeated or comma-separated", typ: "string"},
+	{name: "flamegraph_format", description: "svg (default) or an interactive html page", typ: "string", enum: []string{"svg", "html"}},
+	{name: "merge_format", description: "Output format", typ: "string", enum: []string{"pprof", "folded"}},
+	{name: "search_pid", description: "Only profiles of this PID", typ: "integer", min: 1},
+	{name: "sd_comm", description: "Process names to list, repeated for several (default redis-server)", typ: "string"},
+	{name: "targets_comm", description: "Only processes with this name, repeated for several (default all)", typ: "string"},
+	{name: "profilable", description: "Only processes that can be profiled", typ: "boolean"},
+	{name: "comm", description: "Only profiles of processes with this name, e.g. redis-server", typ: "string"},
+	{name: "search_format", description: "Only profiles in this format", typ: "string", enum: []string{"pprof", "folded", "perfscript", "perfdata", "perfarchive", "speedscope", "flamegraph", "chrometrace"}},
+	{name: "trigger", description: "Only profiles captured by this trigger, or none for those captured on request", typ: "string", enum: []string{"watchdog", "alertmanager", "redis-latency", "profilejob", "none"}},
+	{name: "since", description: "Only profiles created at or after this RFC 3339 time, or this long ago, e.g. 24h or 7d", typ: "string"},
+	{name: "until", description: "Only profiles created before this RFC 3339 time, or this long ago", typ: "string"},
+	{name: "search_label", description: "Only profiles with this name:value label, or with the label name at all; repeated, all must match", typ: "string"},
+	{name: "limit", description: "Profiles per page (default 100)", typ: "integer", min: 1, max: maxSearchLimit},
+	{name: "cursor", description: "next_cursor of the previous page", typ: "string"},
+}
+
+// queryName returns the query parameter p stands for: the format
+// parameters of different endpoints are named after them, e.g. diff_format
+func (p apiParam) queryName() string {
+	if strings.HasSuffix(p.name, "_format") {
+		return "format"
+	}
+	// Filters of the store search, service discovery and target list share
+	// the names of capture parameters
+	for _, prefix := range []string{"search_", "sd_", "targets_"} {
+		if name, ok := strings.CutPrefix(p.name, prefix); ok {
+			return name
+		}
+	}
+	return p.name
+}
+
+func (p apiParam) document() map[string]interface{} {
+	schema := map[string]interface{}{"type": p.typ}
+	if p.enum != nil {
+		schema["enum"] = p.enum
+	}
+	if p.typ == "integer" {
+		schema["minimum"] = p.min
+		if p.max > 0 {
+			schema["maximum"] = p.max
+		}
+	}
+	return map[string]interface{}{
+		"name":        p.queryName(),
+		"in":          "query",
+		"description": p.description,
+		"schema":      schema,
+	}
+}
+
+// captureParams are the parameters shared by the profiling endpoints
+var captureParams = []string{"pid", "redis_port", "container", "seconds", "stacks", "callgraph", "dwarf_size", "lbr_fallback", "children", "tid", "thread_labels", "delay", "snapshots", "redis_metadata", "redis_addr", "backend", "runtime", "frequency", "event", "mode", "label", "queue", "test"}
+
+// pathParamRe matches the path parameters of an operation, e.g. {id}
+var pathParamRe = regexp.MustCompile(`\{(\w+)\}`)
+
+// apiOperation describes one endpoint in the OpenAPI document
+type apiOperation struct {
+	method, path string
+	summary      string
+	params       []string
+	// required lists the params a request must give
+	required []string
+	// body is the media type of the request body, if any, and bodyValue
+	// the Go value a JSON body decodes into
+	body      string
+	bodyValue interface{}
+	// content maps the media types of a successful response to the Go
+	// value they encode, nil for binary or text
+	content map[string]interface{}
+	status  int
+	// capture marks endpoints that run a profiler: they are rate limited
+	// and may report warnings
+	capture bool
+}
+
+// apiOperations are the endpoints described at /openapi.json
+var apiOperations = []apiOperation{
+	{method: "get", path: "/debug/pprof/profile", summary: "Profile a process and return pprof or another perf format; seconds defaults to 30",
+		params: append(slices.Clone(captureParams), "profile_format", "nodecount"), capture: true,
+		content: map[string]interface{}{"application/octet-stream": nil, "application/x-tar": nil, "text/plain": nil, "application/json": nil, "image/svg+xml": nil, "text/html": nil, "application/gzip": nil}},
+	{method: "get", path: "/debug/pprof/{profile}", summary: "Go runtime profile types, such as allocs or goroutine, that pull-mode collectors scrape by default; always 404 since only CPU profiles are served"},
+	{method: "get", path: "/debug/folded/profile", summary: "Profile a process and return folded stacks",
+		params: append(slices.Clone(captureParams), "stream_interval", "annotate"), required: []string{"seconds"}, capture: true,
+		content: map[string]interface{}{"text/plain": nil, "application/x-tar": nil}},
+	{method: "get", path: "/debug/pprof/pagefaults", summary: "Profile the page faults of a process with their stacks, event=faults (minor and major faults) by default; seconds defaults to 30",
+		params: append(slices.Clone(captureParams), "profile_format", "nodecount"), capture: true,
+		content: map[string]interface{}{"application/octet-stream": nil, "application/x-tar": nil, "text/plain": nil, "application/json": nil, "text/html": nil, "application/gzip": nil}},
+	{method: "get", path: "/debug/pprof/hotcold", summary: "Profile a process on and off CPU over the same window with profile-bpfcc and offcputime-bpfcc, returning one pprof profile with cpu, off-cpu and wall sample types",
+		params: []string{"pid", "redis_port", "container", "seconds", "stacks", "children", "tid", "delay", "backend", "frequency", "label", "queue", "test"}, required: []string{"seconds"}, capture: true,
+		content: map[string]interface{}{"application/octet-stream": nil}},
+	{method: "get", path: "/debug/live", summary: "Profile a process with profile-bpfcc and stream the stack counts of every stream_interval seconds (default 1) over a WebSocket, as JSON messages of type stacks, then done or error",
+		params: append(slices.Clone(captureParams), "stream_interval", "annotate"), required: []string{"seconds"}, capture: true, status: http.StatusSwitchingProtocols},
+	{method: "get", path: "/debug/pprof/redis", summary: "Profile every redis-server on the host into one pprof profile",
+		params: []string{"seconds", "parallel", "stacks", "callgraph", "dwarf_size", "lbr_fallback", "children", "delay", "frequency", "event", "mode", "label", "queue", "test"}, required: []string{"seconds"}, capture: true,
+		content: map[string]interface{}{"application/octet-stream": nil}},
+	{method: "get", path: "/debug/perfstat", summary: "Count hardware and software events of a process with perf stat",
+		params: []string{"pid", "redis_port", "container", "seconds", "tid", "children", "queue", "test"}, required: []string{"seconds"}, capture: true,
+		content: map[string]interface{}{"application/json": perfStatReport{}}},
+	{method: "get", path: "/debug/memaccess", summary: "Sample the loads and stores of a process with perf mem, reporting their latency and the memory levels serving them per function",
+		params: []string{"pid", "redis_port", "container", "seconds", "tid", "children", "ops", "functions", "queue", "test"}, required: []string{"seconds"}, capture: true,
+		content: map[string]interface{}{"application/json": memAccessReport{}}},
+	{method: "get", path: "/debug/numa", summary: "Report the memory of a process per NUMA node, the nodes its threads run on and the share of its memory accesses another node served",
+		params: []string{"pid", "redis_port", "container", "seconds", "queue", "test"}, required: []string{"seconds"}, capture: true,
+		content: map[string]interface{}{"application/json": numaReport{}}},
+	{method: "get", path: "/debug/sched", summary: "Trace the scheduler with perf sched and report the maximum and average scheduling delay of every thread of a process",
+		params: []string{"pid", "redis_port", "container", "seconds", "tid", "children", "queue", "test"}, required: []string{"seconds"}, capture: true,
+		content: map[string]interface{}{"application/json": schedReport{}}},
+	{method: "get", path: "/debug/redis/cmdlatency", summary: "Measure per-command latency inside redis-server",
+		params: []string{"pid", "redis_port", "container", "seconds", "commands", "queue", "test"}, required: []string{"seconds"}, capture: true,
+		content: map[string]interface{}{"application/json": cmdLatencyReport{}}},
+	{method: "get", path: "/debug/fanout", summary: "Run a capture on several exporters at once and merge their profiles",
+		params: []string{"endpoint", "peers", "output", "seconds"}, required: []string{"endpoint"}, capture: true,
+		content: map[string]interface{}{"application/octet-stream": nil, "text/plain": nil, "application/x-tar": nil}},
+	{method: "get", path: "/debug/bpftrace/scripts", summary: "List the bpftrace script library",
+		content: map[string]interface{}{"application/json": []bpftraceScript{}}},
+	{method: "get", path: "/debug/bpftrace/run", summary: "Run a bpftrace script of the library",
+		params: []string{"script", "seconds", "pid", "queue", "test"}, required: []string{"script", "seconds"}, capture: true,
+		content: map[string]interface{}{"application/json": bpftraceResult{}}},
+	{method: "post", path: "/debug/bpftrace/user", summary: "Run a bpftrace program given in the request body",
+		params: []string{"seconds", "pid", "queue"}, required: []string{"seconds"}, body: "text/plain", capture: true,
+		content: map[string]interface{}{"application/json": bpftraceResult{}}},
+	{method: "get", path: "/api/v1/profiles", summary: "List stored profiles, newest first",
+		content: map[string]interface{}{"application/json": []profileMeta{}}},
+	{method: "get", path: "/api/v1/store", summary: "Search stored profiles, newest first, a page at a time",
+		params:  []string{"search_pid", "comm", "search_format", "trigger", "since", "until", "search_label", "limit", "cursor"},
+		content: map[string]interface{}{"application/json": searchResult{}}},
+	{method: "get", path: "/api/v1/sd", summary: "Processes that can be profiled on this host, for Prometheus HTTP service discovery",
+		params: []string{"sd_comm"}, content: map[string]interface{}{"application/json": []sdTargetGroup{}}},
+	{method: "get", path: "/api/v1/targets", summary: "Processes of the host with their container, pod, CPU usage over one second and whether they can be profiled, busiest first",
+		params: []string{"targets_comm", "profilable"}, content: map[string]interface{}{"application/json": []processTarget{}}},
+	{method: "get", path: "/api/v1/signing-key", summary: "Public key verifying the signatures of profiles",
+		content: map[string]interface{}{"application/x-pem-file": nil}},
+	{method: "get", path: "/api/v1/profiles/{id}", summary: "Download a stored profile",
+		content: map[string]interface{}{"application/octet-stream": nil, "text/plain": nil, "application/json": nil, "image/svg+xml": nil}},
+	{method: "delete", path: "/api/v1/profiles/{id}", summary: "Delete a stored profile with its attachments",
+		status: http.StatusNoContent},
+	{method: "put", path: "/api/v1/profiles/{id}/pin", summary: "Keep a stored profile from being evicted by the store quota",
+		status: http.StatusNoContent},
+	{method: "delete", path: "/api/v1/profiles/{id}/pin", summary: "Let a pinned profile be evicted again",
+		status: http.StatusNoContent},
+	{method: "get", path: "/api/v1/profiles/{id}/flamegraph", summary: "Render a stored pprof or folded profile as a flamegraph",
+		params: []string{"flamegraph_format"}, content: map[string]interface{}{"image/svg+xml": nil, "text/html": nil}},
+	{method: "get", path: "/api/v1/profiles/{id}/redis", summary: "Redis metadata of a redis_metadata capture",
+		content: map[string]interface{}{"application/json": redisMetadata{}}},
+	{method: "get", path: "/api/v1/profiles/{id}/events", summary: "Progress of the background capture producing a profile, as server-sent events",
+		content: map[string]interface{}{"text/event-stream": jobEvent{}}},
+	{method: "get", path: "/ui/view/{id}", summary: "Redirect to the pprof web interface of a stored profile",
+		status: http.StatusMovedPermanently},
+	{method: "get", path: "/ui/view/{id}/", summary: "The pprof web interface of a stored pprof or folded profile; its pages, such as top, graph and source, are below this path",
+		content: map[string]interface{}{"text/html": nil}},
+	{method: "get", path: "/api/v1/diff", summary: "Compare two stored profiles",
+		params: []string{"base", "target", "diff_format"}, required: []string{"base", "target"},
+		content: map[string]interface{}{"application/octet-stream": nil, "image/svg+xml": nil, "text/plain": nil}},
+	{method: "post", path: "/api/v1/diff", summary: "Compare two uploaded profiles, multipart files named base and target",
+		params: []string{"diff_format"}, body: "multipart/form-data",
+		content: map[string]interface{}{"application/octet-stream": nil, "image/svg+xml": nil, "text/plain": nil}},
+	{method: "get", path: "/api/v1/merge", summary: "Merge stored profiles",
+		params: []string{"id", "merge_format"}, required: []string{"id"},
+		content: map[string]interface{}{"application/octet-stream": nil, "text/plain": nil}},
+	{method: "post", path: "/api/v1/merge", summary: "Merge uploaded profiles, multipart files named profile",
+		params: []string{"merge_format"}, body: "multipart/form-data",
+		content: map[string]interface{}{"application/octet-stream": nil, "text/plain": nil}},
+	{method: "post", path: "/api/v1/hooks/alertmanager", summary: "Start captures for firing Alertmanager alerts",
+		body: "application/json", status: http.StatusAccepted,
+		content: map[string]interface{}{"application/json": []alertResult{}}},
+	{method: "get", path: "/version", summary: "Exporter build and the versions of the profiling tools on the host",
+		content: map[string]interface{}{"application/json": versionReport{}}},
+	{method: "get", path: "/metrics", summary: "Hottest functions of the latest capture of each process, for Prometheus",
+		content: map[string]interface{}{"text/plain": nil}},
+	{method: "get", path: "/-/healthy", summary: "Health check for service registries such as Consul; needs no authentication",
+		content: map[string]interface{}{"text/plain": nil}},
+	{method: "post", path: "/-/reload", summary: "Reload the configuration file",
+		content: map[string]interface{}{"text/plain": nil}},
+}
+
+// jsonSchema returns the JSON schema of the values of t as encoding/json
+// writes them
+func jsonSchema(t reflect.Type) map[string]interface{} {
+	if t == reflect.TypeOf(time.Time{}) {
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+	if t == reflect.TypeOf(json.RawMessage{}) {
+		return map[string]interface{}{}
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		schema := jsonSchema(t.Elem())
+		schema["nullable"] = true
+		return schema
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": jsonSchema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": jsonSchema(t.Elem())}
+	case reflect.Struct:
+		properties := map[string]interface{}{}
+		var required []string
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			name, opts, _ := strings.Cut(f.Tag.Get("json"), ",")
+			if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+				// encoding/json promotes the fields of embedded structs
+				embedded := jsonSchema(f.Type)
+				for k, v := range embedded["properties"].(map[string]interface{}) {
+					properties[k] = v
+				}
+				if req, ok := embedded["required"].([]string); ok {
+					required = append(required, req...)
+				}
+				continue
+			}
+			if !f.IsExported() || name == "-" {
+				continue
+			}
+			if name == "" {
+				name = f.Name
+			}
+			properties[name] = jsonSchema(f.Type)
+			if !strings.Contains(opts, "omitempty") {
+				required = append(required, name)
+			}
+		}
+		schema := map[string]interface{}{"type": "object", "properties": properties}
+		if required != nil {
+			schema["required"] = required
+		}
+		return schema
+	}
+	return map[string]interface{}{}
+}
+
+// errorResponse documents an error answered with a plain text message
+func errorResponse(description string) map[string]interface{} {
+	return map[string]interface{}{
+		"description": description,
+		"content": map[string]interface{}{
+			"text/plain": map[string]interface{}{"schema": map[string]interface{}{"$ref": "#/components/schemas/Error"}},
+		},
+	}
+}
+
+func (op apiOperation) document() map[string]interface{} {
+	var params []interface{}
+	for _, name := range op.params {
+		if !slices.Contains(op.required, name) {
+			params = append(params, map[string]interface{}{"$ref": "#/components/parameters/" + name})
+			continue
+		}
+		// A reference cannot override required, so required parameters
+		// are inlined
+		for _, p := range apiParams {
+			if p.name == name {
+				doc := p.document()
+				doc["required"] = true
+				params = append(params, doc)
+			}
+		}
+	}
+	for _, m := range pathParamRe.FindAllStringSubmatch(op.path, -1) {
+		params = append(params, map[string]interface{}{
+			"name": m[1], "in": "path", "required": true, "schema": map[string]interface{}{"type": "string"},
+		})
+	}
+
+	content := map[string]interface{}{}
+	for mediaType, v := range op.content {
+		schema := map[string]interface{}{"type": "string", "format": "binary"}
+		if v != nil {
+			schema = jsonSchema(reflect.TypeOf(v))
+		}
+		content[mediaType] = map[string]interface{}{"schema": schema}
+	}
+	success := map[string]interface{}{"description": "Success"}
+	if len(content) > 0 {
+		success["content"] = content
+	}
+	if op.capture {
+		success["headers"] = map[string]interface{}{
+			"X-Profile-Backend":   map[string]interface{}{"description": "Profiler that served the request", "schema": map[string]interface{}{"type": "string"}},
+			"X-Profile-ID":        map[string]interface{}{"description": "ID of the stored profile, when the profile store is enabled", "schema": map[string]interface{}{"type": "string"}},
+			"X-Profile-SHA256":    map[string]interface{}{"description": "Hex SHA-256 digest of the profile", "schema": map[string]interface{}{"type": "string"}},
+			"X-Profile-Signature": map[string]interface{}{"description": "Base64 signature of the profile, when signing is configured", "schema": map[string]interface{}{"type": "string"}},
+			"X-Profile-Warning":   map[string]interface{}{"description": "Non-fatal issue with the request, one header per warning", "schema": map[string]interface{}{"type": "string"}},
+		}
+	}
+
+	status := op.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	responses := map[string]interface{}{
+		strconv.Itoa(status): success,
+		"400":                map[string]interface{}{"$ref": "#/components/responses/BadRequest"},
+		"401":                map[string]interface{}{"$ref": "#/components/responses/Unauthorized"},
+		"403":                map[string]interface{}{"$ref": "#/components/responses/Forbidden"},
+		"404":                map[string]interface{}{"$ref": "#/components/responses/NotFound"},
+		"500":                map[string]interface{}{"$ref": "#/components/responses/InternalError"},
+	}
+	if op.capture {
+		responses["429"] = map[string]interface{}{"$ref": "#/components/responses/TooManyRequests"}
+		responses["503"] = map[string]interface{}{"$ref": "#/components/responses/Busy"}
+		responses["507"] = map[string]interface{}{"$ref": "#/components/responses/InsufficientStorage"}
+	}
+
+	doc := map[string]interface{}{
+		"summary":     op.summary,
+		"operationId": op.method + strings.NewReplacer("/", "_", "{", "", "}", "", "-", "").Replace(op.path),
+		"responses":   responses,
+	}
+	if params != nil {
+		doc["parameters"] = params
+	}
+	if op.body != "" {
+		body := map[string]interface{}{}
+		if op.bodyValue != nil {
+			body["schema"] = jsonSchema(reflect.TypeOf(op.bodyValue))
+		}
+		doc["requestBody"] = map[string]interface{}{
+			"required": true,
+			"content":  map[string]interface{}{op.body: body},
+		}
+	}
+	return doc
+}
+
+// openAPIDocument returns the OpenAPI 3 description of the API served
+// under pathPrefix
+func openAPIDocument(pathPrefix string) map[string]interface{} {
+	paths := map[string]interface{}{}
+	for _, op := range apiOperations {
+		item, ok := paths[op.path].(map[string]interface{})
+		if !ok {
+			item = map[string]interface{}{}
+			paths[op.path] = item
+		}
+		item[op.method] = op.document()
+
+		// Capture endpoints served with GET also take a JSON POST body;
+		// the WebSocket of /debug/live can only be opened with GET
+		if op.capture && op.method == "get" && op.status != http.StatusSwitchingProtocols {
+			post := op
+			post.method = "post"
+			post.summary += ", with the parameters in a JSON body"
+			post.params, post.required = nil, nil
+			post.body, post.bodyValue = "application/json", captureRequest{}
+			item["post"] = post.document()
+		}
+	}
+
+	params := map[string]interface{}{}
+	for _, p := range apiParams {
+		params[p.name] = p.document()
+	}
+
+	server := pathPrefix
+	if server == "" {
+		server = "/"
+	}
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":       "bcc-exporter",
+			"description": "Linux CPU profiling over HTTP with perf, BCC, bpftrace and runtime specific profilers",
+			"version":     "1",
+		},
+		"servers":  []interface{}{map[string]interface{}{"url": server}},
+		"paths":    paths,
+		"security": []interface{}{map[string]interface{}{"basicAuth": []string{}}, map[string]interface{}{"bearerAuth": []string{}}},
+		"components": map[string]interface{}{
+			"parameters": params,
+			"schemas": map[string]interface{}{
+				"Error": map[string]interface{}{"type": "string", "description": "Plain text error message"},
+			},
+			"responses": map[string]interface{}{
+				"BadRequest":          errorResponse("Invalid parameters"),
+				"Unauthorized":        errorResponse("Missing or invalid credentials"),
+				"Forbidden":           errorResponse("Target refused by the target policy, or client outside -allow-cidrs"),
+				"NotFound":            errorResponse("Process, profile or script not found, or the profile store is not enabled"),
+				"InternalError":       errorResponse("The profiler or the conversion failed"),
+				"InsufficientStorage": errorResponse("Not enough disk space under -temp-dir for the capture"),
+				"TooManyRequests": map[string]interface{}{
+					"description": "Rate limit exceeded",
+					"headers": map[string]interface{}{
+						"Retry-After": map[string]interface{}{"description": "Seconds until the client may try again", "schema": map[string]interface{}{"type": "integer"}},
+					},
+					"content": map[string]interface{}{
+						"text/plain": map[string]interface{}{"schema": map[string]interface{}{"$ref": "#/components/schemas/Error"}},
+					},
+				},
+				"Busy": map[string]interface{}{
+					"description": "No capture slot is free within the concurrency limits",
+					"headers": map[string]interface{}{
+						"Retry-After":      map[string]interface{}{"description": "Estimated seconds until a slot frees up", "schema": map[string]interface{}{"type": "integer"}},
+						"X-Queue-Position": map[string]interface{}{"description": "Place the request would have in the queue", "schema": map[string]interface{}{"type": "integer"}},
+					},
+					"content": map[string]interface{}{
+						"text/plain": map[string]interface{}{"schema": map[string]interface{}{"$ref": "#/components/schemas/Error"}},
+					},
+				},
+			},
+			"securitySchemes": map[string]interface{}{
+				"basicAuth":  map[string]interface{}{"type": "http", "scheme": "basic"},
+				"bearerAuth": map[string]interface{}{"type": "http", "scheme": "bearer", "bearerFormat": "JWT"},
+			},
+		},
+	}
+}
+
+// handleOpenAPI serves the OpenAPI document of the API
+func handleOpenAPI(pathPrefix string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, openAPIDocument(pathPrefix))
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJSONSchema(t *testing.T) {
+	type inner struct {
+		N int `json:"n"`
+	}
+	type sample struct {
+		Name     string            `json:"name"`
+		Rate     *float64          `json:"rate,omitempty"`
+		When     time.Time         `json:"when"`
+		Tags     map[string]string `json:"tags"`
+		Items    []inner           `json:"items"`
+		Raw      json.RawMessage   `json:"raw"`
+		Skipped  string            `json:"-"`
+		internal int
+	}
+
+	got := jsonSchema(reflect.TypeOf(sample{}))
+	want := map[string]interface{}{
+		"type": "object",
+		"properties": map[string]interface{}{
+			"name":  map[string]interface{}{"type": "string"},
+			"rate":  map[string]interface{}{"type": "number", "nullable": true},
+			"when":  map[string]interface{}{"type": "string", "format": "date-time"},
+			"tags":  map[string]interface{}{"type": "object", "additionalProperties": map[string]interface{}{"type": "string"}},
+			"items": map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "object", "properties": map[string]interface{}{"n": map[string]interface{}{"type": "integer"}}, "required": []string{"n"}}},
+			"raw":   map[string]interface{}{},
+		},
+		"required": []string{"name", "when", "tags", "items", "raw"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("jsonSchema() = %v\nwant %v", got, want)
+	}
+}
+
+// resolveRefs reports every $ref in v that does not point into doc
+func resolveRefs(t *testing.T, doc map[string]interface{}, v interface{}) {
+	t.Helper()
+	switch v := v.(type) {
+	case map[string]interface{}:
+		if ref, ok := v["$ref"].(string); ok {
+			var target interface{} = doc
+			for _, part := range strings.Split(strings.TrimPrefix(ref, "#/"), "/") {
+				m, _ := target.(map[string]interface{})
+				target = m[part]
+			}
+			if target == nil {
+				t.Errorf("unresolved $ref %s", ref)
+			}
+		}
+		for _, child := range v {
+			resolveRefs(t, doc, child)
+		}
+	case []interface{}:
+		for _, child := range v {
+			resolveRefs(t, doc, child)
+		}
+	}
+}
+
+func TestOpenAPIDocument(t *testing.T) {
+	rr := httptest.NewRecorder()
+	handleOpenAPI("/profiling")(rr, httptest.NewRequest("GET", "/openapi.json", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status %d", rr.Code)
+	}
+	var doc map[string]interface{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &doc); err != nil {
+		t.Fatal(err)
+	}
+	if doc["openapi"] != "3.0.3" {
+		t.Errorf("openapi = %v", doc["openapi"])
+	}
+	if url := doc["servers"].([]interface{})[0].(map[string]interface{})["url"]; url != "/profiling" {
+		t.Errorf("server url = %v, want /profiling", url)
+	}
+	resolveRefs(t, doc, doc)
+
+	paths := doc["paths"].(map[string]interface{})
+	op := paths["/debug/pprof/profile"].(map[string]interface{})["get"].(map[string]interface{})
+	var format map[string]interface{}
+	for _, p := range op["parameters"].([]interface{}) {
+		p := p.(map[string]interface{})
+		if p["name"] == "seconds" {
+			t.Errorf("/debug/pprof/profile: seconds = %v, want optional", p)
+		}
+		if p["$ref"] == "#/components/parameters/profile_format" {
+			format = p
+		}
+	}
+	var seconds map[string]interface{}
+	for _, p := range paths["/debug/folded/profile"].(map[string]interface{})["get"].(map[string]interface{})["parameters"].([]interface{}) {
+		if p := p.(map[string]interface{}); p["name"] == "seconds" {
+			seconds = p
+		}
+	}
+	if seconds == nil || seconds["required"] != true {
+		t.Errorf("seconds parameter = %v, want inlined as required", seconds)
+	}
+	if format == nil {
+		t.Error("format parameter missing from /debug/pprof/profile")
+	}
+	responses := op["responses"].(map[string]interface{})
+	for _, code := range []string{"200", "400", "401", "403", "429", "500"} {
+		if responses[code] == nil {
+			t.Errorf("/debug/pprof/profile: no %s response", code)
+		}
+	}
+
+	latency := paths["/debug/redis/cmdlatency"].(map[string]interface{})["get"].(map[string]interface{})
+	schema := latency["responses"].(map[string]interface{})["200"].(map[string]interface{})["content"].(map[string]interface{})["application/json"].(map[string]interface{})["schema"].(map[string]interface{})
+	if _, ok := schema["properties"].(map[string]interface{})["commands"]; !ok {
+		t.Errorf("cmdlatency schema = %v, want commands property", schema)
+	}
+}
+
+// TestOpenAPICoversRoutes checks that every route registered in main is
+// described, so the document cannot fall behind the handlers
+func TestOpenAPICoversRoutes(t *testing.T) {
+	src, err := os.ReadFile("main.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	documented := map[string]bool{}
+	for _, op := range apiOperations {
+		documented[op.path] = true
+	}
+	routes := regexp.MustCompile(`(?m)^\t(?:handle|capture)\("(?:[A-Z]+ )?(/[^"]*)"`).FindAllSubmatch(src, -1)
+	if len(routes) == 0 {
+		t.Fatal("no routes found in main.go")
+	}
+	for _, m := range routes {
+		path := string(m[1])
+		if path != "/openapi.json" && !documented[path] {
+			t.Errorf("route %s is not in the OpenAPI document", path)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/google/pprof/profile"
+)
+
+// faultEvents are the perf events of event=faults: minor faults, such as
+// the copy-on-write faults of a forked BGSAVE, and major faults, which wait
+// for the disk
+var faultEvents = []string{"minor-faults", "major-faults"}
+
+// faultWeights counts the faults of each kind behind every sample, its
+// period, with their sum last as the default
+func faultWeights() *sampleWeights {
+	return &sampleWeights{
+		Types: []*profile.ValueType{
+			{Type: "minor-faults", Unit: "count"},
+			{Type: "major-faults", Unit: "count"},
+			{Type: "page-faults", Unit: "count"},
+		},
+		Default:    "page-faults",
+		PeriodType: &profile.ValueType{Type: "page-faults", Unit: "count"},
+		Values: func(s perfSample) []int64 {
+			n := int64(s.Period)
+			if perfEventName(s.Event) == "major-faults" {
+				return []int64{0, n, n}
+			}
+			return []int64{n, 0, n}
+		},
+	}
+}
+
+// handlePageFaults profiles the page faults of a process with their stacks,
+// like the pprof endpoint with event=faults
+func handlePageFaults(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	switch q.Get("event") {
+	case "":
+		q.Set("event", "faults")
+		r.URL.RawQuery = q.Encode()
+	case "faults", "page-faults", "minor-faults", "major-faults":
+	default:
+		http.Error(w, "Invalid event: must be faults, page-faults, minor-faults or major-faults", http.StatusBadRequest)
+		return
+	}
+	handlePprof(w, r)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+const faultsPerfScript = `redis-server  1234/1234  5000.100000:         64 minor-faults:
+	    55d0c1a2b3c4 dictAdd (/usr/bin/redis-server)
+	    55d0c1a2b000 processCommand (/usr/bin/redis-server)
+
+redis-server  1234/1234  5000.200000:         32 minor-faults:
+	    55d0c1a2b3c4 dictAdd (/usr/bin/redis-server)
+	    55d0c1a2b000 processCommand (/usr/bin/redis-server)
+
+redis-server  1234/1234  5000.300000:          1 major-faults:
+	    55d0c1a2b3c4 dictAdd (/usr/bin/redis-server)
+	    55d0c1a2b000 processCommand (/usr/bin/redis-server)
+`
+
+func TestFaultWeights(t *testing.T) {
+	samples, err := parsePerfScript(strings.NewReader(faultsPerfScript))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if samples[0].Event != "minor-faults" || samples[2].Event != "major-faults" || samples[2].Period != 1 {
+		t.Fatalf("samples = %+v", samples)
+	}
+
+	p := buildProfile(samples, nil, nil, faultWeights())
+	if err := p.CheckValid(); err != nil {
+		t.Fatal(err)
+	}
+	if len(p.Sample) != 1 {
+		t.Fatalf("samples = %v", p.Sample)
+	}
+	if v := p.Sample[0].Value; v[0] != 96 || v[1] != 1 || v[2] != 97 {
+		t.Errorf("values = %v, want 96 minor and 1 major", v)
+	}
+	// Folded output and flamegraphs count all faults
+	if folded := profileToFolded(p); folded["processCommand;dictAdd"] != 97 {
+		t.Errorf("folded = %v", folded)
+	}
+
+	// With stacks=user perf reports the events as minor-faults:u and
+	// major-faults:u
+	samples, err = parsePerfScript(strings.NewReader(strings.ReplaceAll(faultsPerfScript, "faults:", "faults:u:")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if samples[2].Event != "major-faults:u" {
+		t.Fatalf("event = %q", samples[2].Event)
+	}
+	p = buildProfile(samples, nil, nil, faultWeights())
+	if v := p.Sample[0].Value; v[0] != 96 || v[1] != 1 || v[2] != 97 {
+		t.Errorf("values of user-only faults = %v, want 96 minor and 1 major", v)
+	}
+}
+
+func TestFaultsEvent(t *testing.T) {
+	opts, err := parseCaptureOptions(url.Values{"pid": {"100"}, "seconds": {"5"}, "event": {"faults"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if args := strings.Join(perfRecordArgs(opts, "perf.data"), " "); !strings.Contains(args, "-F 999 -e minor-faults -e major-faults -o") {
+		t.Errorf("perf args %q should record minor and major faults", args)
+	}
+
+	for _, tt := range []struct {
+		query string
+		code  int
+	}{
+		{"", http.StatusOK},
+		{"&event=major-faults", http.StatusOK},
+		{"&event=cycles", http.StatusBadRequest},
+	} {
+		rr := httptest.NewRecorder()
+		handlePageFaults(rr, httptest.NewRequest("GET", "/debug/pprof/pagefaults?pid=1234&seconds=5&test=true"+tt.query, nil))
+		if rr.Code != tt.code {
+			t.Errorf("%q: status %d: %s", tt.query, rr.Code, rr.Body.String())
+		}
+	}
+}
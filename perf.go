@@ -0,0 +1,495 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/pprof/profile"
+)
+
+// checkRequiredTools verifies that perf and pprof tools are available
+func checkRequiredTools() error {
+	if err := checkPerf(); err != nil {
+		return err
+	}
+
+	// Check if pprof is available
+	if _, err := exec.LookPath("pprof"); err != nil {
+		return fmt.Errorf("pprof tool not found: %v. Install with: go install github.com/google/pprof@latest", err)
+	}
+
+	return nil
+}
+
+// checkPerf reports whether the perf tool is available
+func checkPerf() error {
+	if _, err := exec.LookPath("perf"); err != nil {
+		return fmt.Errorf("perf tool not found: %v. Install with: sudo apt-get install linux-perf", err)
+	}
+	return nil
+}
+
+// perfRecordEvents are the events a capture may sample with event=
+var perfRecordEvents = []string{
+	"cycles",
+	"instructions",
+	"cache-misses",
+	"branch-misses",
+	"cpu-clock",
+	"task-clock",
+	"page-faults",
+	"minor-faults",
+	"major-faults",
+	"context-switches",
+	// minor-faults and major-faults together, see faultEvents
+	"faults",
+	// cycles and instructions together, see ipcEvents
+	"ipc",
+}
+
+// perfRecordArgs builds the perf record command line for the given options
+func perfRecordArgs(opts profileOptions, outputPath string) []string {
+	args := []string{"record"}
+
+	switch opts.CallGraph {
+	case "dwarf":
+		args = append(args, "--call-graph", fmt.Sprintf("dwarf,%d", opts.DwarfSize))
+	case "lbr":
+		args = append(args, "--call-graph", "lbr")
+	default:
+		args = append(args, "-g")
+	}
+
+	if limit := currentLimits().MaxPerfData; limit > 0 {
+		args = append(args, "--max-size", fmt.Sprintf("%dK", limit>>10))
+	}
+
+	if opts.TID != "" {
+		args = append(args, "--tid", opts.TID)
+	} else {
+		args = append(args, "--pid", opts.targetPIDs())
+	}
+	args = append(args, "-F", fmt.Sprintf("%d", opts.frequency()))
+	switch opts.Event {
+	case "":
+	case "faults":
+		for _, event := range faultEvents {
+			args = append(args, "-e", event)
+		}
+	case "ipc":
+		for _, event := range ipcEvents {
+			args = append(args, "-e", event)
+		}
+	default:
+		args = append(args, "-e", opts.Event)
+	}
+	if opts.Mode == "wall" {
+		// Timer samples while running, and the time blocked per stack
+		// from perf's BPF off-CPU profiler, both in nanoseconds
+		args = append(args, "-e", "cpu-clock", "--off-cpu")
+	}
+
+	switch opts.Stacks {
+	case "user":
+		args = append(args, "--all-user")
+	case "kernel":
+		args = append(args, "--all-kernel")
+	}
+
+	return append(args, "-o", outputPath, "--", "sleep", fmt.Sprintf("%d", opts.Duration))
+}
+
+// capturePerfProfile runs perf record + pprof conversion for opts inside dir
+// and returns the path of the resulting pprof file
+func capturePerfProfile(opts profileOptions, dir string) (string, error) {
+	// Check if required tools are available
+	if err := checkRequiredTools(); err != nil {
+		return "", &captureError{http.StatusInternalServerError, fmt.Sprintf("Required tools not available: %v", err)}
+	}
+
+	perfDataPath, err := recordPerf(opts, dir)
+	if err != nil {
+		return "", err
+	}
+	pprofPath := filepath.Join(dir, "profile.pb.gz")
+	opts.Progress.converting()
+	conversion := opts.Span.child("convert")
+	err = convertPerfData(opts, perfDataPath, pprofPath)
+	conversion.done(err)
+	if err != nil {
+		return "", err
+	}
+	return pprofPath, nil
+}
+
+// recordPerf runs perf record for opts and returns the path of perf.data in dir
+func recordPerf(opts profileOptions, dir string) (perfDataPath string, err error) {
+	pid, duration := opts.PID, opts.Duration
+	perfDataPath = filepath.Join(dir, "perf.data")
+	if err := checkDiskSpace(dir, estimatePerfData(opts)); err != nil {
+		return "", err
+	}
+
+	stage := opts.Span.child("perf record")
+	stage.set("profile.seconds", duration)
+	stage.set("perf.callgraph", opts.CallGraph)
+	defer func() { stage.done(err) }()
+
+	// Step 1: Run perf record
+	log.Printf("Starting perf record for PID %s, duration %d seconds", pid, duration)
+	perfCmd := newCommand("perf", perfRecordArgs(opts, perfDataPath)...)
+
+	var perfStderr bytes.Buffer
+	perfCmd.Stderr = &perfStderr
+
+	err = runJob(perfCmd, captureTimeout(duration))
+	if opts.Mode == "wall" && strings.Contains(perfStderr.String(), "off-cpu") {
+		return "", &captureError{http.StatusNotImplemented, "mode=wall needs perf 6.1 or later built with BPF skeletons (perf record --off-cpu)"}
+	}
+	// perf stops the session, successfully, once --max-size is reached
+	if strings.Contains(perfStderr.String(), "size limit reached") {
+		return "", perfDataLimitError(int64(currentLimits().MaxPerfData))
+	}
+	if err != nil {
+		if _, ok := err.(*captureError); ok {
+			return "", err
+		}
+		log.Printf("perf record failed: %v", err)
+		log.Printf("perf stderr: %s", perfStderr.String())
+
+		// Provide more specific error messages
+		stderrStr := perfStderr.String()
+		if strings.Contains(stderrStr, "Permission denied") {
+			return "", &captureError{http.StatusForbidden, "Permission denied: perf requires elevated privileges. Run with sudo or adjust perf_event_paranoid settings."}
+		} else if strings.Contains(stderrStr, "No such process") {
+			return "", &captureError{http.StatusBadRequest, fmt.Sprintf("Process with PID %s not found or exited during profiling", pid)}
+		}
+		return "", &captureError{http.StatusInternalServerError, fmt.Sprintf("perf record failed: %v\nStderr: %s", err, stderrStr)}
+	}
+
+	// Check if perf.data was created and has content
+	if stat, err := os.Stat(perfDataPath); err != nil {
+		return "", &captureError{http.StatusInternalServerError, "perf.data file was not created"}
+	} else if stat.Size() == 0 {
+		return "", &captureError{http.StatusInternalServerError, "perf.data file is empty - no samples collected"}
+	}
+
+	return perfDataPath, nil
+}
+
+// capturePerfScript runs perf record for opts inside dir and returns the path
+// of the symbolized perf script text output
+func capturePerfScript(opts profileOptions, dir string) (string, error) {
+	if err := checkPerf(); err != nil {
+		return "", &captureError{http.StatusInternalServerError, err.Error()}
+	}
+
+	perfDataPath, err := recordPerf(opts, dir)
+	if err != nil {
+		return "", err
+	}
+
+	scriptPath := filepath.Join(dir, "perf.script")
+	out, err := os.Create(scriptPath)
+	if err != nil {
+		return "", err
+	}
+	defer out.Close()
+
+	// --header keeps the recording metadata FlameScope expects
+	log.Printf("Running perf script for PID %s", opts.PID)
+	stage := opts.Span.child("perf script")
+	cmd := newCommand("perf", append([]string{"script", "-i", perfDataPath, "--header"}, perfSymbolArgs()...)...)
+	cmd.Env = symbolEnv()
+	var stderr bytes.Buffer
+	cmd.Stdout = out
+	cmd.Stderr = &stderr
+	err = runJob(cmd, jobGrace)
+	stage.done(err)
+	if _, ok := err.(*captureError); ok {
+		return "", err
+	} else if err != nil {
+		return "", &captureError{http.StatusInternalServerError, fmt.Sprintf("perf script failed: %v\nStderr: %s", err, stderr.String())}
+	}
+	return scriptPath, nil
+}
+
+// capturePerfData runs perf record for opts inside dir and returns the path
+// of the unprocessed perf.data
+func capturePerfData(opts profileOptions, dir string) (string, error) {
+	if err := checkPerf(); err != nil {
+		return "", &captureError{http.StatusInternalServerError, err.Error()}
+	}
+	return recordPerf(opts, dir)
+}
+
+// capturePerfArchive runs perf record and perf archive for opts inside dir
+// and returns the path of a tar file holding perf.data and the archive of the
+// build-ID objects it references
+func capturePerfArchive(opts profileOptions, dir string) (string, error) {
+	perfDataPath, err := capturePerfData(opts, dir)
+	if err != nil {
+		return "", err
+	}
+
+	log.Printf("Running perf archive for PID %s", opts.PID)
+	cmd := newCommand("perf", "archive", perfDataPath)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := runJob(cmd, jobGrace); err != nil {
+		if _, ok := err.(*captureError); ok {
+			return "", err
+		}
+		return "", &captureError{http.StatusInternalServerError, fmt.Sprintf("perf archive failed: %v\nStderr: %s", err, stderr.String())}
+	}
+
+	// Depending on the perf version the archive is compressed with bzip2 or xz
+	archives, _ := filepath.Glob(perfDataPath + ".tar.*")
+	if len(archives) == 0 {
+		return "", &captureError{http.StatusInternalServerError, "perf archive did not produce an archive"}
+	}
+
+	bundlePath := filepath.Join(dir, "perf-archive.tar")
+	bundle, err := os.Create(bundlePath)
+	if err != nil {
+		return "", err
+	}
+	defer bundle.Close()
+
+	tw := tar.NewWriter(bundle)
+	for _, path := range []string{perfDataPath, archives[0]} {
+		if err := copyFileToTar(tw, path); err != nil {
+			return "", err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return "", err
+	}
+	return bundlePath, nil
+}
+
+// copyFileToTar streams the file at path into a tar entry named after it
+func copyFileToTar(tw *tar.Writer, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	hdr := &tar.Header{
+		Name:    filepath.Base(path),
+		Mode:    0644,
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+// convertPerfData turns perfDataPath into a labelled pprof file at pprofPath
+func convertPerfData(opts profileOptions, perfDataPath, pprofPath string) error {
+	// Step 2: Convert perf.data to pprof format
+	debuginfod.fetchMissingDebugInfo(perfDataPath)
+	hostname, _ := os.Hostname()
+	if opts.TID == "" || opts.ThreadLabels || opts.Children || opts.PerfMap || symfs != "" || opts.Mode == "wall" || opts.Event == "faults" || opts.Event == "ipc" {
+		// pprof's converter drops PIDs and thread IDs, ignores perf maps
+		// and -symfs and counts samples without their period, so decode
+		// the samples ourselves unless a single thread was captured, or
+		// when they include JIT compiled code, live in another root,
+		// carry off-CPU time or record several events
+		log.Printf("Converting perf.data to pprof format with per-sample labels")
+		var weights *sampleWeights
+		switch {
+		case opts.Mode == "wall":
+			weights = wallWeights(int64(time.Second) / int64(opts.frequency()))
+		case opts.Event == "faults":
+			weights = faultWeights()
+		case opts.Event == "ipc":
+			weights = ipcWeights()
+		}
+		if err := convertPerfScript(perfDataPath, pprofPath, newSampleLabeler(hostname).labels, weights); err != nil {
+			log.Printf("perf script conversion failed: %v", err)
+			if _, ok := err.(*captureError); ok {
+				return err
+			}
+			return &captureError{http.StatusInternalServerError, fmt.Sprintf("perf script conversion failed: %v", err)}
+		}
+		if len(opts.Labels) > 0 {
+			if err := labelProfileFile(pprofPath, userLabels(opts.Labels)); err != nil {
+				return &captureError{http.StatusInternalServerError, fmt.Sprintf("Failed to label pprof profile: %v", err)}
+			}
+		}
+	} else {
+		log.Printf("Converting perf.data to pprof format")
+		pprofCmd := exec.Command("pprof", "-proto", "-output", pprofPath, perfDataPath)
+		// Binaries of containerized targets are only reachable through
+		// /proc/<pid>/root; perf script looks there by itself
+		pprofCmd.Env = symbolEnv(captureBinaryDirs(opts)...)
+
+		var pprofStderr bytes.Buffer
+		pprofCmd.Stderr = &pprofStderr
+
+		if err := runJob(pprofCmd, jobGrace); err != nil {
+			log.Printf("pprof conversion failed: %v", err)
+			if _, ok := err.(*captureError); ok {
+				return err
+			}
+			log.Printf("pprof stderr: %s", pprofStderr.String())
+
+			stderrStr := pprofStderr.String()
+			if strings.Contains(stderrStr, "no samples") {
+				return &captureError{http.StatusBadRequest, "No samples found in perf.data - process may have been idle during profiling"}
+			} else if strings.Contains(stderrStr, "permission denied") {
+				return &captureError{http.StatusForbidden, "Permission denied accessing perf.data file"}
+			}
+			return &captureError{http.StatusInternalServerError, fmt.Sprintf("pprof conversion failed: %v\nStderr: %s", err, stderrStr)}
+		}
+
+		if err := labelProfileFile(pprofPath, captureLabels(opts, hostname)); err != nil {
+			log.Printf("Failed to label pprof profile: %v", err)
+			return &captureError{http.StatusInternalServerError, fmt.Sprintf("Failed to label pprof profile: %v", err)}
+		}
+	}
+
+	// Check if pprof file was created and has content
+	if stat, err := os.Stat(pprofPath); err != nil {
+		return &captureError{http.StatusInternalServerError, "pprof file was not created"}
+	} else if stat.Size() == 0 {
+		return &captureError{http.StatusInternalServerError, "pprof file is empty - conversion produced no data"}
+	}
+
+	if err := addCPUTime(pprofPath, opts); err != nil {
+		log.Printf("Failed to add CPU time to pprof profile: %v", err)
+		return &captureError{http.StatusInternalServerError, fmt.Sprintf("Failed to add CPU time to pprof profile: %v", err)}
+	}
+
+	return nil
+}
+
+// runPerfProfile executes perf record and serves the result as a binary
+// pprof file, or in the raw form selected by opts.Output
+func runPerfProfile(w http.ResponseWriter, r *http.Request, opts profileOptions) {
+	// Create temporary directory for this profiling session
+	tempDir, err := newCaptureDir()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to create temp directory: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer os.RemoveAll(tempDir) // Clean up when done
+
+	format, contentType, capture := "pprof", "application/octet-stream", capturePerfProfile
+	switch opts.Output {
+	case "perfscript":
+		format, contentType, capture = "perfscript", "text/plain", capturePerfScript
+	case "perfdata":
+		format, capture = "perfdata", capturePerfData
+	case "perfarchive":
+		format, contentType, capture = "perfarchive", "application/x-tar", capturePerfArchive
+	case "chrometrace":
+		format, contentType, capture = "chrometrace", "application/json", captureChromeTrace
+	}
+
+	outputPath, err := capture(opts, tempDir)
+	if err != nil {
+		writeCaptureError(w, err)
+		return
+	}
+
+	// Step 3: Serve the output file
+	outputFile, err := os.Open(outputPath)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to open %s file: %v", format, err), http.StatusInternalServerError)
+		return
+	}
+	defer outputFile.Close()
+	if info, err := outputFile.Stat(); err == nil {
+		if err := checkOutputSize(format+" file", info.Size()); err != nil {
+			writeCaptureError(w, err)
+			return
+		}
+	}
+
+	stored := opts.Span.child("store")
+	meta := captureMeta(opts, format)
+	storeCapture(w, meta, outputFile)
+	stored.finish()
+	if _, err := outputFile.Seek(0, io.SeekStart); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to rewind %s file: %v", format, err), http.StatusInternalServerError)
+		return
+	}
+
+	// Reports are rendered from the pprof capture, which is what is stored
+	if _, ok := reportFormats[opts.Output]; ok {
+		data, err := io.ReadAll(outputFile)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to read pprof file: %v", err), http.StatusInternalServerError)
+			return
+		}
+		writeReport(w, opts.Output, meta, data, opts.NodeCount)
+		log.Printf("Successfully served %s report for PID %s", opts.Output, opts.PID)
+		return
+	}
+
+	// Set appropriate headers
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=profile-%s-%d%s", opts.PID, opts.Duration, profileExtension(format)))
+
+	// Stream the file to the client
+	stream := opts.Span.child("stream")
+	n, err := io.Copy(w, outputFile)
+	stream.set("bytes", n)
+	stream.done(err)
+	if err != nil {
+		log.Printf("Failed to stream %s file: %v", format, err)
+		return
+	}
+
+	log.Printf("Successfully served %s profile for PID %s", format, opts.PID)
+}
+
+// runPerfFolded serves a perf capture as folded stacks, for the folded
+// endpoint with backend=perf
+func runPerfFolded(w http.ResponseWriter, opts profileOptions) {
+	tempDir, err := newCaptureDir()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to create temp directory: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer os.RemoveAll(tempDir)
+
+	data, err := snapshotPerf(opts, tempDir)
+	if err != nil {
+		writeCaptureError(w, err)
+		return
+	}
+	p, err := profile.ParseData(data)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to read pprof profile: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if opts.Annotate {
+		annotateFrames(p)
+	}
+
+	var folded bytes.Buffer
+	writeFolded(&folded, profileToFolded(p))
+	storeCapture(w, captureMeta(opts, "folded"), bytes.NewReader(folded.Bytes()))
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write(folded.Bytes())
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// perfMapPath is where perf and BCC look up symbols of JIT compiled code
+func perfMapPath(pid int) string {
+	return fmt.Sprintf("/tmp/perf-%d.map", pid)
+}
+
+// hasPerfMap reports whether pid has a non-empty perf map
+func hasPerfMap(pid int) bool {
+	info, err := os.Stat(perfMapPath(pid))
+	return err == nil && info.Mode().IsRegular() && info.Size() > 0
+}
+
+// isNodeProcess reports whether pid runs Node.js
+func isNodeProcess(pid int) bool {
+	if comm, err := readComm(pid); err == nil && (comm == "node" || comm == "nodejs") {
+		return true
+	}
+	exe, err := os.Readlink(filepath.Join(procRoot, strconv.Itoa(pid), "exe"))
+	if err != nil {
+		return false
+	}
+	base := filepath.Base(exe)
+	return base == "node" || base == "nodejs"
+}
+
+// preparePerfMap makes sure JIT compiled frames of the target can be
+// symbolized: it writes the perf map of JVMs, checks that Node.js targets
+// were started with --perf-basic-prof and flags opts when a map exists
+func preparePerfMap(w http.ResponseWriter, opts *profileOptions) {
+	pid, _ := strconv.Atoi(opts.PID)
+
+	switch {
+	case isJavaProcess(pid):
+		if err := generateJavaPerfMap(pid); err != nil {
+			addWarning(w, fmt.Sprintf("Java frames will not be symbolized: %v", err))
+		}
+	case isNodeProcess(pid):
+		if !hasPerfMap(pid) {
+			addWarning(w, fmt.Sprintf("Node.js process %d has no %s: start it with --perf-basic-prof to symbolize JavaScript frames", pid, perfMapPath(pid)))
+		}
+	}
+
+	opts.PerfMap = hasPerfMap(pid)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestIsNodeProcess(t *testing.T) {
+	writeFakeProc(t, map[int]int{42: 1, 43: 1, 44: 1})
+
+	if err := os.WriteFile(filepath.Join(procRoot, "42", "comm"), []byte("node\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(procRoot, "43", "comm"), []byte("MainThread\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("/usr/local/bin/nodejs", filepath.Join(procRoot, "43", "exe")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(procRoot, "44", "comm"), []byte("redis-server\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		pid  int
+		want bool
+	}{
+		{42, true},
+		{43, true}, // renamed main thread, detected by its binary
+		{44, false},
+		{999, false},
+	}
+	for _, tt := range tests {
+		if got := isNodeProcess(tt.pid); got != tt.want {
+			t.Errorf("isNodeProcess(%d) = %v, want %v", tt.pid, got, tt.want)
+		}
+	}
+}
+
+func TestPreparePerfMapNode(t *testing.T) {
+	// A PID close to pid_max so the map cannot belong to a real process
+	const pid = 4190001
+	writeFakeProc(t, map[int]int{pid: 1})
+	if err := os.WriteFile(filepath.Join(procRoot, strconv.Itoa(pid), "comm"), []byte("node\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := profileOptions{PID: strconv.Itoa(pid)}
+	rec := httptest.NewRecorder()
+	preparePerfMap(rec, &opts)
+	if opts.PerfMap {
+		t.Error("PerfMap set without a perf map")
+	}
+	if warning := rec.Header().Get("X-Profile-Warning"); !strings.Contains(warning, "--perf-basic-prof") {
+		t.Errorf("X-Profile-Warning = %q, want a --perf-basic-prof hint", warning)
+	}
+
+	if err := os.WriteFile(perfMapPath(pid), []byte("3ef414c0 398 LazyCompile:~main /app/index.js:1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Remove(perfMapPath(pid)) })
+
+	opts = profileOptions{PID: strconv.Itoa(pid)}
+	rec = httptest.NewRecorder()
+	preparePerfMap(rec, &opts)
+	if !opts.PerfMap {
+		t.Error("PerfMap not set with a perf map")
+	}
+	if warnings := rec.Header().Values("X-Profile-Warning"); len(warnings) != 0 {
+		t.Errorf("unexpected warnings: %q", warnings)
+	}
+}
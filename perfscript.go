@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/google/pprof/profile"
+)
+
+// perfScriptFields is the perf script field list understood by parsePerfScript
+const perfScriptFields = "comm,pid,tid,time,period,event,ip,sym,dso"
+
+// perfSample is a single stack sample decoded from perf script output
+type perfSample struct {
+	Comm   string
+	PID    int
+	TID    int
+	Time   float64 // seconds since boot
+	Period uint64
+	Event  string
+	Stack  []perfFrame // leaf frame first
+}
+
+// perfFrame is one callchain entry of a perf sample
+type perfFrame struct {
+	Addr   uint64
+	Symbol string
+	DSO    string
+}
+
+var (
+	// "redis-server  1234/1240  12345.678901:     250000 cycles:"
+	perfHeaderRe = regexp.MustCompile(`^(.*?)\s+(\d+)/(\d+)\s+(?:\[\d+\]\s+)?(\d+\.\d+):\s*(\d+)?(?:\s*(\S+):)?`)
+	// "	    55d0c1a2b3c4 aeProcessEvents (/usr/bin/redis-server)"
+	perfFrameRe = regexp.MustCompile(`^\s+([0-9a-f]+)\s+(.*?)\s+\((.*)\)$`)
+)
+
+// perfScriptArgs builds the perf script command line for decoding perfDataPath
+func perfScriptArgs(perfDataPath string) []string {
+	return append([]string{"script", "-i", perfDataPath, "-F", perfScriptFields}, perfSymbolArgs()...)
+}
+
+// parsePerfScript decodes perf script output produced with perfScriptFields
+func parsePerfScript(r io.Reader) ([]perfSample, error) {
+	var samples []perfSample
+	var cur *perfSample
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if strings.TrimSpace(line) == "" {
+			cur = nil
+			continue
+		}
+		// Header comments written by perf script --header
+		if line[0] == '#' {
+			continue
+		}
+
+		if line[0] == ' ' || line[0] == '\t' {
+			if cur == nil {
+				continue
+			}
+			m := perfFrameRe.FindStringSubmatch(line)
+			if m == nil {
+				continue
+			}
+			addr, _ := strconv.ParseUint(m[1], 16, 64)
+			cur.Stack = append(cur.Stack, perfFrame{Addr: addr, Symbol: m[2], DSO: m[3]})
+			continue
+		}
+
+		m := perfHeaderRe.FindStringSubmatch(line)
+		if m == nil {
+			return nil, fmt.Errorf("unexpected perf script line: %q", line)
+		}
+		pid, _ := strconv.Atoi(m[2])
+		tid, _ := strconv.Atoi(m[3])
+		ts, _ := strconv.ParseFloat(m[4], 64)
+		period, _ := strconv.ParseUint(m[5], 10, 64)
+
+		samples = append(samples, perfSample{
+			Comm:   strings.TrimSpace(m[1]),
+			PID:    pid,
+			TID:    tid,
+			Time:   ts,
+			Period: period,
+			Event:  m[6],
+		})
+		cur = &samples[len(samples)-1]
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return samples, nil
+}
+
+// sampleWeights gives the sample types of a profile built from perf samples
+// and the values each sample adds to them
+type sampleWeights struct {
+	Types      []*profile.ValueType
+	Default    string
+	PeriodType *profile.ValueType
+	Period     int64
+	Values     func(perfSample) []int64
+}
+
+// wallWeights weights the samples of a wall-clock capture sampled every
+// interval nanoseconds by their period, which perf gives in nanoseconds for
+// cpu-clock and off-CPU samples: each adds its period as wall/nanoseconds
+// and the number of intervals in it as samples, so the time a stack spent
+// blocked counts like timer samples
+func wallWeights(interval int64) *sampleWeights {
+	return &sampleWeights{
+		Types:      []*profile.ValueType{{Type: "samples", Unit: "count"}, {Type: "wall", Unit: "nanoseconds"}},
+		Default:    "wall",
+		PeriodType: &profile.ValueType{Type: "wall", Unit: "nanoseconds"},
+		Period:     interval,
+		Values: func(s perfSample) []int64 {
+			period := int64(s.Period)
+			return []int64{(period + interval/2) / interval, period}
+		},
+	}
+}
+
+// perfEventName returns the event of a perf script header without its PMU
+// and modifiers, e.g. cycles for cycles:u or cpu_core/cycles/
+func perfEventName(event string) string {
+	if parts := strings.Split(event, "/"); len(parts) >= 3 {
+		return parts[1]
+	}
+	name, _, _ := strings.Cut(event, ":")
+	return name
+}
+
+// buildProfile converts decoded perf samples into a pprof profile with a
+// samples/count value, or the values of weights, attaching the labels
+// returned by labelsFor to each sample. With maps, the mappings of user
+// space frames get the address range, file offset and build ID of the
+// processes they were sampled in.
+func buildProfile(samples []perfSample, labelsFor func(perfSample) map[string][]string, maps *processMaps, weights *sampleWeights) *profile.Profile {
+	p := &profile.Profile{
+		SampleType: []*profile.ValueType{{Type: "samples", Unit: "count"}},
+		PeriodType: &profile.ValueType{Type: "cpu", Unit: "nanoseconds"},
+	}
+	if weights != nil {
+		p.SampleType = weights.Types
+		p.DefaultSampleType = weights.Default
+		p.PeriodType = weights.PeriodType
+		p.Period = weights.Period
+	}
+
+	mappings := make(map[string]*profile.Mapping)
+	functions := make(map[string]*profile.Function)
+	locations := make(map[string]*profile.Location)
+
+	mappingFor := func(frame perfFrame, pid int) *profile.Mapping {
+		var pm *procMapping
+		if maps != nil {
+			if pm = maps.lookup(pid, frame.Addr); pm != nil && pm.Path != frame.DSO {
+				pm = nil
+			}
+		}
+		key := frame.DSO
+		if pm != nil {
+			key = fmt.Sprintf("%s\x00%x\x00%x", frame.DSO, pm.Start, pm.Limit)
+		}
+		if m, ok := mappings[key]; ok {
+			return m
+		}
+		m := &profile.Mapping{
+			ID:           uint64(len(p.Mapping) + 1),
+			File:         frame.DSO,
+			HasFunctions: true,
+		}
+		if pm != nil {
+			m.Start, m.Limit, m.Offset = pm.Start, pm.Limit, pm.Offset
+			m.BuildID = maps.buildID(pid, pm)
+		}
+		mappings[key] = m
+		p.Mapping = append(p.Mapping, m)
+		return m
+	}
+
+	functionFor := func(name, dso string) *profile.Function {
+		key := dso + "\x00" + name
+		if f, ok := functions[key]; ok {
+			return f
+		}
+		f := &profile.Function{
+			ID:         uint64(len(p.Function) + 1),
+			Name:       name,
+			SystemName: name,
+		}
+		functions[key] = f
+		p.Function = append(p.Function, f)
+		return f
+	}
+
+	locationFor := func(frame perfFrame, pid int) *profile.Location {
+		m := mappingFor(frame, pid)
+		key := fmt.Sprintf("%d\x00%x\x00%s", m.ID, frame.Addr, frame.Symbol)
+		if l, ok := locations[key]; ok {
+			return l
+		}
+		l := &profile.Location{
+			ID:      uint64(len(p.Location) + 1),
+			Mapping: m,
+			Address: frame.Addr,
+			Line:    []profile.Line{{Function: functionFor(frame.Symbol, frame.DSO)}},
+		}
+		locations[key] = l
+		p.Location = append(p.Location, l)
+		return l
+	}
+
+	// Aggregate identical stacks with identical labels into one sample
+	aggregated := make(map[string]*profile.Sample)
+	for _, s := range samples {
+		var labels map[string][]string
+		if labelsFor != nil {
+			labels = labelsFor(s)
+		}
+
+		value := []int64{1}
+		if weights != nil {
+			value = weights.Values(s)
+		}
+
+		var key strings.Builder
+		sample := &profile.Sample{Value: value, Label: labels}
+		for _, frame := range s.Stack {
+			loc := locationFor(frame, s.PID)
+			sample.Location = append(sample.Location, loc)
+			fmt.Fprintf(&key, "%d,", loc.ID)
+		}
+		fmt.Fprintf(&key, "%v", labels)
+
+		if existing, ok := aggregated[key.String()]; ok {
+			for i, v := range value {
+				existing.Value[i] += v
+			}
+			continue
+		}
+		aggregated[key.String()] = sample
+		p.Sample = append(p.Sample, sample)
+	}
+
+	return p
+}
+
+// convertPerfScript decodes perfDataPath with perf script and writes a
+// labelled pprof profile to pprofPath, with the values of weights when given
+func convertPerfScript(perfDataPath, pprofPath string, labelsFor func(perfSample) map[string][]string, weights *sampleWeights) error {
+	cmd := newCommand("perf", perfScriptArgs(perfDataPath)...)
+	cmd.Env = symbolEnv()
+
+	stdout := newLimitedBuffer()
+	var stderr bytes.Buffer
+	cmd.Stdout = stdout
+	cmd.Stderr = &stderr
+
+	if err := runJob(cmd, jobGrace); err != nil {
+		if _, ok := err.(*captureError); ok {
+			return err
+		}
+		return fmt.Errorf("perf script failed: %v\nStderr: %s", err, stderr.String())
+	}
+	if err := stdout.check("perf script output"); err != nil {
+		return err
+	}
+
+	samples, err := parsePerfScript(stdout)
+	if err != nil {
+		return err
+	}
+	if len(samples) == 0 {
+		return fmt.Errorf("no samples found in perf.data")
+	}
+
+	f, err := os.Create(pprofPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return buildProfile(samples, labelsFor, newProcessMaps(), weights).Write(f)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+const samplePerfScript = `redis-server  1234/1234  5000.100000:     250000
+	    55d0c1a2b3c4 aeApiPoll (/usr/bin/redis-server)
+	    55d0c1a2b000 aeMain (/usr/bin/redis-server)
+	    7f0000001000 __libc_start_main (/usr/lib/x86_64-linux-gnu/libc.so.6)
+
+bio_aof   1234/1240  5000.200000:     250000
+	    ffffffff81000000 do_fsync ([kernel.kallsyms])
+	    55d0c1a2c000 bioProcessBackgroundJobs (/usr/bin/redis-server)
+
+redis-server  1234/1234  5000.300000:     250000
+	    55d0c1a2b3c4 aeApiPoll (/usr/bin/redis-server)
+	    55d0c1a2b000 aeMain (/usr/bin/redis-server)
+	    7f0000001000 __libc_start_main (/usr/lib/x86_64-linux-gnu/libc.so.6)
+`
+
+func TestParsePerfScript(t *testing.T) {
+	samples, err := parsePerfScript(strings.NewReader(samplePerfScript))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(samples) != 3 {
+		t.Fatalf("parsePerfScript() returned %d samples, want 3", len(samples))
+	}
+
+	s := samples[1]
+	if s.Comm != "bio_aof" || s.PID != 1234 || s.TID != 1240 || s.Period != 250000 {
+		t.Errorf("unexpected sample header: %+v", s)
+	}
+	if s.Time != 5000.2 {
+		t.Errorf("sample time = %v, want 5000.2", s.Time)
+	}
+	if len(s.Stack) != 2 || s.Stack[0].Symbol != "do_fsync" || s.Stack[0].DSO != "[kernel.kallsyms]" {
+		t.Errorf("unexpected sample stack: %+v", s.Stack)
+	}
+	if s.Stack[0].Addr != 0xffffffff81000000 {
+		t.Errorf("frame address = %x, want ffffffff81000000", s.Stack[0].Addr)
+	}
+}
+
+func TestParsePerfScriptMalformed(t *testing.T) {
+	if _, err := parsePerfScript(strings.NewReader("not a perf header\n")); err == nil {
+		t.Errorf("parsePerfScript() should reject malformed headers")
+	}
+}
+
+func TestParsePerfScriptHeader(t *testing.T) {
+	// perf script --header starts with the header of perf.data
+	header := `# ========
+# captured on    : Thu Oct 15 09:15:41 2026
+# hostname : redis-host-1
+# cmdline : /usr/bin/perf record -g --pid 1234 -- sleep 5
+# ========
+#
+`
+	samples, err := parsePerfScript(strings.NewReader(header + samplePerfScript))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(samples) != 3 || samples[0].Comm != "redis-server" {
+		t.Errorf("parsePerfScript() with a header = %+v", samples)
+	}
+}
+
+func TestBuildProfileWallClock(t *testing.T) {
+	// A cpu-clock sample at 1000 Hz and the off-CPU time perf records per
+	// stack at the end of the capture
+	samples, err := parsePerfScript(strings.NewReader(`redis-server  1234/1234  5000.100000:    1000000
+	    55d0c1a2b3c4 processCommand (/usr/bin/redis-server)
+	    55d0c1a2b000 aeMain (/usr/bin/redis-server)
+
+redis-server  1234/1234  5010.000000:   42400000
+	    ffffffff81000000 schedule ([kernel.kallsyms])
+	    55d0c1a2c000 fsync (/usr/lib/x86_64-linux-gnu/libc.so.6)
+	    55d0c1a2b000 aeMain (/usr/bin/redis-server)
+
+redis-server  1234/1234  5010.000000:     300000
+	    ffffffff81000000 schedule ([kernel.kallsyms])
+	    55d0c1a2c000 fsync (/usr/lib/x86_64-linux-gnu/libc.so.6)
+	    55d0c1a2b000 aeMain (/usr/bin/redis-server)
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := buildProfile(samples, nil, nil, wallWeights(1000000))
+	if err := p.CheckValid(); err != nil {
+		t.Fatalf("invalid profile: %v", err)
+	}
+	if len(p.SampleType) != 2 || p.SampleType[1].Type != "wall" || p.DefaultSampleType != "wall" || p.Period != 1000000 {
+		t.Errorf("sample types %v %v, default %q, period %d", p.SampleType[0], p.SampleType[1], p.DefaultSampleType, p.Period)
+	}
+	folded := profileToFolded(p)
+	if folded["aeMain;processCommand"] != 1 || folded["aeMain;fsync;schedule"] != 42 {
+		t.Errorf("folded = %v", folded)
+	}
+	if v := p.Sample[1].Value; v[1] != 42700000 {
+		t.Errorf("blocked sample values = %v", v)
+	}
+}
+
+func TestBuildProfileThreadLabels(t *testing.T) {
+	samples, err := parsePerfScript(strings.NewReader(samplePerfScript))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := buildProfile(samples, newSampleLabeler("redis-host-1").labels, nil, nil)
+	if err := p.CheckValid(); err != nil {
+		t.Fatalf("invalid profile: %v", err)
+	}
+
+	// The two identical main thread stacks are aggregated
+	if len(p.Sample) != 2 {
+		t.Fatalf("profile has %d samples, want 2", len(p.Sample))
+	}
+
+	byTID := make(map[string]int64)
+	for _, s := range p.Sample {
+		byTID[s.Label["tid"][0]] += s.Value[0]
+	}
+	if byTID["1234"] != 2 || byTID["1240"] != 1 {
+		t.Errorf("unexpected per-thread counts: %v", byTID)
+	}
+
+	if got := p.Sample[1].Label["thread"]; len(got) != 1 || got[0] != "bio_aof" {
+		t.Errorf("thread label = %v, want [bio_aof]", got)
+	}
+	if got := p.Sample[1].Label["hostname"]; len(got) != 1 || got[0] != "redis-host-1" {
+		t.Errorf("hostname label = %v, want [redis-host-1]", got)
+	}
+	if got := p.Sample[0].Location[0].Line[0].Function.Name; got != "aeApiPoll" {
+		t.Errorf("leaf function = %q, want aeApiPoll", got)
+	}
+}
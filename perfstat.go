@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// perfStatEvents are the counters collected by /debug/perfstat
+var perfStatEvents = []string{
+	"task-clock",
+	"cycles",
+	"instructions",
+	"cache-references",
+	"cache-misses",
+	"branches",
+	"branch-misses",
+	"context-switches",
+	"cpu-migrations",
+	"page-faults",
+}
+
+// perfStatArgs builds the perf stat command line counting events and writing
+// CSV to outputPath
+func perfStatArgs(opts profileOptions, events []string, outputPath string) []string {
+	args := []string{"stat", "-x", ",", "-o", outputPath, "-e", strings.Join(events, ",")}
+
+	if opts.TID != "" {
+		args = append(args, "--tid", opts.TID)
+	} else {
+		args = append(args, "--pid", opts.targetPIDs())
+	}
+
+	return append(args, "--", "sleep", fmt.Sprintf("%d", opts.Duration))
+}
+
+// perfCounter is one counter reported by perf stat
+type perfCounter struct {
+	Event string `json:"event"`
+	// Value is nil when the counter is not supported or was not counted
+	Value *float64 `json:"value"`
+	Unit  string   `json:"unit,omitempty"`
+	// RunningPct is the share of the window the counter was scheduled on
+	// the PMU; below 100 the value is scaled from multiplexed measurements
+	RunningPct float64 `json:"running_pct"`
+	Status     string  `json:"status,omitempty"`
+}
+
+// perfStatReport is the response of /debug/perfstat
+type perfStatReport struct {
+	PID      string        `json:"pid"`
+	Seconds  int           `json:"seconds"`
+	Counters []perfCounter `json:"counters"`
+
+	// Derived metrics, omitted when their counters are unavailable
+	IPC                   *float64 `json:"ipc,omitempty"`
+	CacheMissRate         *float64 `json:"cache_miss_rate,omitempty"`
+	BranchMissRate        *float64 `json:"branch_miss_rate,omitempty"`
+	ContextSwitchesPerSec *float64 `json:"context_switches_per_sec,omitempty"`
+}
+
+// parsePerfStat decodes perf stat -x, output:
+// "value,unit,event,run time,running percent,metric value,metric unit"
+func parsePerfStat(r io.Reader) ([]perfCounter, error) {
+	var counters []perfCounter
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Split(line, ",")
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("unexpected perf stat line: %q", line)
+		}
+
+		c := perfCounter{Event: fields[2], Unit: fields[1]}
+		switch fields[0] {
+		case "<not supported>":
+			c.Status = "not supported"
+		case "<not counted>":
+			c.Status = "not counted"
+		default:
+			v, err := strconv.ParseFloat(fields[0], 64)
+			if err != nil {
+				return nil, fmt.Errorf("unexpected perf stat value: %q", line)
+			}
+			c.Value = &v
+		}
+		if len(fields) > 4 {
+			c.RunningPct, _ = strconv.ParseFloat(fields[4], 64)
+		}
+		counters = append(counters, c)
+	}
+	return counters, scanner.Err()
+}
+
+// counterValues returns the values of the counted events of counters
+func counterValues(counters []perfCounter) map[string]float64 {
+	values := make(map[string]float64)
+	for _, c := range counters {
+		if c.Value != nil {
+			values[c.Event] = *c.Value
+		}
+	}
+	return values
+}
+
+// counterRatio returns num / den, or nil when either was not counted or den
+// is 0
+func counterRatio(values map[string]float64, num, den string) *float64 {
+	n, ok1 := values[num]
+	d, ok2 := values[den]
+	if !ok1 || !ok2 || d == 0 {
+		return nil
+	}
+	v := n / d
+	return &v
+}
+
+// derivePerfStat computes the ratios of the report from its counters
+func derivePerfStat(report *perfStatReport) {
+	values := counterValues(report.Counters)
+	report.IPC = counterRatio(values, "instructions", "cycles")
+	report.CacheMissRate = counterRatio(values, "cache-misses", "cache-references")
+	report.BranchMissRate = counterRatio(values, "branch-misses", "branches")
+	if cs, ok := values["context-switches"]; ok && report.Seconds > 0 {
+		v := cs / float64(report.Seconds)
+		report.ContextSwitchesPerSec = &v
+	}
+}
+
+// mockPerfStat is the perf stat output returned in test mode
+const mockPerfStat = `2001.53,msec,task-clock,2001530000,100.00,1.000,CPUs utilized
+4004587120,,cycles,2001530000,100.00,2.001,GHz
+6806798104,,instructions,2001530000,100.00,1.70,insn per cycle
+52301871,,cache-references,2001530000,100.00,,
+4184149,,cache-misses,2001530000,100.00,8.00,of all cache refs
+1300561002,,branches,2001530000,100.00,,
+9104127,,branch-misses,2001530000,100.00,0.70,of all branches
+8411,,context-switches,2001530000,100.00,,
+12,,cpu-migrations,2001530000,100.00,,
+<not supported>,,page-faults,0,100.00,,
+`
+
+// handlePerfStat counts hardware and software events of a process over the
+// requested duration with perf stat
+func handlePerfStat(w http.ResponseWriter, r *http.Request) {
+	opts, err := parseProfileOptions(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := resolveRedisPort(&opts); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid redis_port: %v", err), http.StatusBadRequest)
+		return
+	}
+	if err := resolveContainerPID(&opts); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid container PID: %v", err), http.StatusBadRequest)
+		return
+	}
+	auditPID(r, opts.PID)
+
+	report := perfStatReport{PID: opts.PID, Seconds: opts.Duration}
+	var output []byte
+
+	if r.URL.Query().Get("test") == "true" {
+		output = []byte(mockPerfStat)
+	} else {
+		release, ok := takeCaptureSlot(w, r, opts.PID)
+		if !ok {
+			return
+		}
+		defer release()
+		if output, err = runPerfStat(opts, perfStatEvents); err != nil {
+			writeCaptureError(w, err)
+			return
+		}
+	}
+
+	if report.Counters, err = parsePerfStat(bytes.NewReader(output)); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to parse perf stat output: %v", err), http.StatusInternalServerError)
+		return
+	}
+	derivePerfStat(&report)
+	writeJSON(w, http.StatusOK, report)
+}
+
+// reportIgnoredParams are the capture parameters of profiles that the
+// report endpoints built on perf cannot honour
+var reportIgnoredParams = []string{"format", "snapshots", "mode", "backend", "stream_interval"}
+
+// rejectParams returns an error for the first of names given in q
+func rejectParams(q url.Values, names []string) error {
+	for _, name := range names {
+		if q.Has(name) {
+			return fmt.Errorf("%s is not supported on this endpoint", name)
+		}
+	}
+	return nil
+}
+
+// preparePerfTarget validates the target of a perf counting or sampling
+// session outside runProfile and fills in the permitted children of opts
+func preparePerfTarget(opts *profileOptions) error {
+	if err := validatePID(opts.PID); err != nil {
+		return &captureError{http.StatusBadRequest, fmt.Sprintf("Invalid PID: %v", err)}
+	}
+	if opts.TID != "" {
+		if err := validateTID(opts.PID, opts.TID); err != nil {
+			return &captureError{http.StatusBadRequest, fmt.Sprintf("Invalid TID: %v", err)}
+		}
+	}
+	if err := currentPolicy().check(opts.PID); err != nil {
+		return &captureError{http.StatusForbidden, fmt.Sprintf("Forbidden target: %v", err)}
+	}
+	if err := checkPerfPermitted(*opts); err != nil {
+		return &captureError{http.StatusForbidden, fmt.Sprintf("Permission denied: %v", err)}
+	}
+	if opts.Children {
+		pid, _ := strconv.Atoi(opts.PID)
+		children, err := findDescendants(pid)
+		if err != nil {
+			return &captureError{http.StatusInternalServerError, fmt.Sprintf("Failed to list child processes: %v", err)}
+		}
+		for _, child := range currentPolicy().permitted(children) {
+			opts.ChildPIDs = append(opts.ChildPIDs, strconv.Itoa(child))
+		}
+	}
+	if err := checkPerf(); err != nil {
+		return &captureError{http.StatusInternalServerError, err.Error()}
+	}
+	return nil
+}
+
+// runPerfStat validates the target and counts events with perf stat,
+// returning its CSV output
+func runPerfStat(opts profileOptions, events []string) ([]byte, error) {
+	if err := preparePerfTarget(&opts); err != nil {
+		return nil, err
+	}
+
+	tempDir, err := newCaptureDir()
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tempDir)
+	outputPath := filepath.Join(tempDir, "perfstat.csv")
+
+	log.Printf("Starting perf stat for PID %s, duration %d seconds", opts.PID, opts.Duration)
+	cmd := newCommand("perf", perfStatArgs(opts, events, outputPath)...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := runJob(cmd, captureTimeout(opts.Duration)); err != nil {
+		if _, ok := err.(*captureError); ok {
+			return nil, err
+		}
+		if strings.Contains(stderr.String(), "Permission denied") {
+			return nil, &captureError{http.StatusForbidden, "Permission denied: perf requires elevated privileges. Run with sudo or adjust perf_event_paranoid settings."}
+		}
+		return nil, &captureError{http.StatusInternalServerError, fmt.Sprintf("perf stat failed: %v\nStderr: %s", err, stderr.String())}
+	}
+
+	return os.ReadFile(outputPath)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPerfStatArgs(t *testing.T) {
+	args := strings.Join(perfStatArgs(profileOptions{PID: "100", Duration: 5, ChildPIDs: []string{"101"}}, perfStatEvents, "out.csv"), " ")
+	for _, want := range []string{"stat -x , -o out.csv", "cycles,instructions", "--pid 100,101", "-- sleep 5"} {
+		if !strings.Contains(args, want) {
+			t.Errorf("perf stat args %q do not contain %q", args, want)
+		}
+	}
+
+	args = strings.Join(perfStatArgs(profileOptions{PID: "100", Duration: 5, TID: "105"}, perfStatEvents, "out.csv"), " ")
+	if !strings.Contains(args, "--tid 105") || strings.Contains(args, "--pid") {
+		t.Errorf("perf stat args %q should target only the thread", args)
+	}
+}
+
+func TestParsePerfStat(t *testing.T) {
+	counters, err := parsePerfStat(strings.NewReader("# started on Thu\n\n" + mockPerfStat))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(counters) != len(perfStatEvents) {
+		t.Fatalf("got %d counters, want %d", len(counters), len(perfStatEvents))
+	}
+
+	if c := counters[0]; c.Event != "task-clock" || c.Unit != "msec" || *c.Value != 2001.53 || c.RunningPct != 100 {
+		t.Errorf("task-clock = %+v", c)
+	}
+	if c := counters[len(counters)-1]; c.Event != "page-faults" || c.Value != nil || c.Status != "not supported" {
+		t.Errorf("page-faults = %+v", c)
+	}
+
+	if _, err := parsePerfStat(strings.NewReader("garbage\n")); err == nil {
+		t.Error("parsePerfStat() accepted a malformed line")
+	}
+}
+
+func TestPerfStatEndpoint(t *testing.T) {
+	req := httptest.NewRequest("GET", "/debug/perfstat?pid=1234&seconds=2&test=true", nil)
+	rr := httptest.NewRecorder()
+	handlePerfStat(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rr.Code, rr.Body.String())
+	}
+	var report perfStatReport
+	if err := json.Unmarshal(rr.Body.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+	if report.IPC == nil || math.Abs(*report.IPC-1.70) > 0.01 {
+		t.Errorf("IPC = %v, want 1.70", report.IPC)
+	}
+	if report.CacheMissRate == nil || math.Abs(*report.CacheMissRate-0.08) > 0.001 {
+		t.Errorf("CacheMissRate = %v, want 0.08", report.CacheMissRate)
+	}
+	if report.ContextSwitchesPerSec == nil || *report.ContextSwitchesPerSec != 4205.5 {
+		t.Errorf("ContextSwitchesPerSec = %v, want 4205.5", report.ContextSwitchesPerSec)
+	}
+
+	req = httptest.NewRequest("GET", "/debug/perfstat?seconds=2", nil)
+	rr = httptest.NewRecorder()
+	handlePerfStat(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("missing pid: status = %d, want %d", rr.Code, http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,447 @@
+// Package client talks to a bcc-exporter over HTTP: it starts captures,
+// follows background captures and lists, searches and downloads the
+// profiles of the exporter's profile store.
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Client sends requests to one exporter. Its fields must not be changed
+// while requests are running.
+type Client struct {
+	// BaseURL is the URL of the exporter, including its -http-prefix
+	BaseURL string
+	// Username and Password are the basic credentials, sent when Password
+	// is set; Token is a bearer token, e.g. an OIDC ID token, sent instead
+	Username string
+	Password string
+	Token    string
+	// HTTPClient sends the requests (default http.DefaultClient). It should
+	// have no timeout, as captures take as long as they record.
+	HTTPClient *http.Client
+	// RetryLimit is how long requests keep retrying when the exporter is
+	// busy and answers 429 or 503 with a Retry-After header (default no
+	// retries)
+	RetryLimit time.Duration
+	// OnRetry, when set, is called before each retry of a busy request
+	OnRetry func(err *Error, wait time.Duration)
+}
+
+// New returns a client of the exporter at baseURL, which may carry the
+// basic credentials as user:password@ and defaults to http:// without a
+// scheme
+func New(baseURL string) (*Client, error) {
+	if !strings.Contains(baseURL, "://") {
+		baseURL = "http://" + baseURL
+	}
+	u, err := url.Parse(baseURL)
+	if err != nil || u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return nil, fmt.Errorf("invalid exporter URL %q: must be an http(s) URL", baseURL)
+	}
+	c := &Client{Username: "admin"}
+	if u.User != nil {
+		c.Username = u.User.Username()
+		c.Password, _ = u.User.Password()
+		u.User = nil
+	}
+	c.BaseURL = strings.TrimSuffix(u.String(), "/")
+	return c, nil
+}
+
+// Error is an error status answered by the exporter
+type Error struct {
+	StatusCode int
+	Status     string
+	// Message is the body of the answer, which explains the error
+	Message string
+	// RetryAfter is when a busy exporter expects a slot to be free
+	RetryAfter time.Duration
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Status, e.Message)
+}
+
+// busy reports whether the request may be sent again after RetryAfter
+func (e *Error) busy() bool {
+	return (e.StatusCode == http.StatusTooManyRequests || e.StatusCode == http.StatusServiceUnavailable) && e.RetryAfter > 0
+}
+
+// do sends a request for path and query, retrying busy answers within
+// RetryLimit, and returns the response of a 2xx status
+func (c *Client) do(ctx context.Context, method, path string, q url.Values, header http.Header) (*http.Response, error) {
+	target := c.BaseURL + path
+	if len(q) > 0 {
+		target += "?" + q.Encode()
+	}
+	hc := c.HTTPClient
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	deadline := time.Now().Add(c.RetryLimit)
+	for {
+		req, err := http.NewRequestWithContext(ctx, method, target, nil)
+		if err != nil {
+			return nil, err
+		}
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		if c.Token != "" {
+			req.Header.Set("Authorization", "Bearer "+c.Token)
+		} else if c.Password != "" {
+			req.SetBasicAuth(c.Username, c.Password)
+		}
+		resp, err := hc.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode/100 == 2 {
+			return resp, nil
+		}
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		resp.Body.Close()
+		apiErr := &Error{StatusCode: resp.StatusCode, Status: resp.Status, Message: strings.TrimSpace(string(msg))}
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+			apiErr.RetryAfter = time.Duration(seconds) * time.Second
+		}
+		if !apiErr.busy() || time.Now().Add(apiErr.RetryAfter).After(deadline) {
+			return nil, apiErr
+		}
+		if c.OnRetry != nil {
+			c.OnRetry(apiErr, apiErr.RetryAfter)
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(apiErr.RetryAfter):
+		}
+	}
+}
+
+// getJSON decodes the answer to a GET request for path into v
+func (c *Client) getJSON(ctx context.Context, path string, q url.Values, v interface{}) error {
+	resp, err := c.do(ctx, "GET", path, q, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// Target selects the process of a capture: PID, or the process listening on
+// RedisPort
+type Target struct {
+	PID       int
+	RedisPort int
+	// Container is the container ID or cgroup path PID and TID are given in
+	Container string
+	TID       int
+	Children  bool
+}
+
+// CaptureRequest describes a capture
+type CaptureRequest struct {
+	Target  Target
+	Seconds int
+	// Format is "pprof" (default), "folded", which captures through the
+	// folded endpoint, or another format of the pprof endpoint such as
+	// "perfscript" or "perfarchive"
+	Format    string
+	Frequency int
+	Event     string
+	Labels    map[string]string
+	// Params are other query parameters of the capture endpoint
+	Params url.Values
+}
+
+// endpoint returns the path and query of the capture
+func (r CaptureRequest) endpoint() (string, url.Values, error) {
+	q := url.Values{}
+	for name, values := range r.Params {
+		q[name] = append([]string(nil), values...)
+	}
+	switch {
+	case r.Target.PID != 0 && r.Target.RedisPort != 0:
+		return "", nil, errors.New("PID and RedisPort are exclusive")
+	case r.Target.PID != 0:
+		q.Set("pid", strconv.Itoa(r.Target.PID))
+	case r.Target.RedisPort != 0:
+		q.Set("redis_port", strconv.Itoa(r.Target.RedisPort))
+	case q.Get("pid") == "" && q.Get("redis_port") == "":
+		return "", nil, errors.New("the target needs a PID or RedisPort")
+	}
+	if r.Target.Container != "" {
+		q.Set("container", r.Target.Container)
+	}
+	if r.Target.TID != 0 {
+		q.Set("tid", strconv.Itoa(r.Target.TID))
+	}
+	if r.Target.Children {
+		q.Set("children", "true")
+	}
+	if r.Seconds != 0 {
+		q.Set("seconds", strconv.Itoa(r.Seconds))
+	}
+	if r.Frequency != 0 {
+		q.Set("frequency", strconv.Itoa(r.Frequency))
+	}
+	if r.Event != "" {
+		q.Set("event", r.Event)
+	}
+	for name, value := range r.Labels {
+		q.Add("label", name+":"+value)
+	}
+	path := "/debug/pprof/profile"
+	switch r.Format {
+	case "", "pprof":
+	case "folded":
+		path = "/debug/folded/profile"
+	default:
+		q.Set("format", r.Format)
+	}
+	return path, q, nil
+}
+
+// Profile is the data of a capture or stored profile, read as the exporter
+// sends it; it must be closed
+type Profile struct {
+	io.ReadCloser
+	ContentType string
+	// ID is the ID of the profile in the exporter's store, empty when the
+	// exporter has no store
+	ID string
+	// SHA256 is the hex digest of the data, when the exporter sends it
+	SHA256 string
+	// Warnings are the non-fatal problems the exporter reported
+	Warnings []string
+}
+
+func newProfile(resp *http.Response) *Profile {
+	return &Profile{
+		ReadCloser:  resp.Body,
+		ContentType: resp.Header.Get("Content-Type"),
+		ID:          resp.Header.Get("X-Profile-ID"),
+		SHA256:      resp.Header.Get("X-Profile-SHA256"),
+		Warnings:    resp.Header.Values("X-Profile-Warning"),
+	}
+}
+
+// Capture runs a capture and returns its data once the exporter starts
+// sending it, which is as the samples arrive for streamed folded captures
+// and after the capture otherwise
+func (c *Client) Capture(ctx context.Context, r CaptureRequest) (*Profile, error) {
+	path, q, err := r.endpoint()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.do(ctx, "GET", path, q, nil)
+	if err != nil {
+		return nil, err
+	}
+	return newProfile(resp), nil
+}
+
+// Download returns the data of stored profile id
+func (c *Client) Download(ctx context.Context, id string) (*Profile, error) {
+	resp, err := c.do(ctx, "GET", "/api/v1/profiles/"+url.PathEscape(id), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	p := newProfile(resp)
+	if p.ID == "" {
+		p.ID = id
+	}
+	return p, nil
+}
+
+// ProfileInfo describes a stored profile
+type ProfileInfo struct {
+	ID            string            `json:"id"`
+	Format        string            `json:"format"`
+	PID           string            `json:"pid,omitempty"`
+	Comm          string            `json:"comm,omitempty"`
+	Duration      int               `json:"duration,omitempty"`
+	CreatedAt     time.Time         `json:"created_at"`
+	Size          int64             `json:"size"`
+	SHA256        string            `json:"sha256,omitempty"`
+	Signature     string            `json:"signature,omitempty"`
+	SignatureKey  string            `json:"signature_key,omitempty"`
+	Series        string            `json:"series,omitempty"`
+	SeriesIndex   int               `json:"series_index,omitempty"`
+	Trigger       string            `json:"trigger,omitempty"`
+	TriggerReason string            `json:"trigger_reason,omitempty"`
+	Labels        map[string]string `json:"labels,omitempty"`
+	Attachments   []string          `json:"attachments,omitempty"`
+	Pinned        bool              `json:"pinned,omitempty"`
+}
+
+// ListProfiles returns every stored profile, newest first
+func (c *Client) ListProfiles(ctx context.Context) ([]ProfileInfo, error) {
+	var profiles []ProfileInfo
+	if err := c.getJSON(ctx, "/api/v1/profiles", nil, &profiles); err != nil {
+		return nil, err
+	}
+	return profiles, nil
+}
+
+// Query selects stored profiles; empty fields select all
+type Query struct {
+	PID     int
+	Comm    string
+	Format  string
+	Trigger string
+	// Since and Until are an RFC 3339 time or a duration ago, e.g. "24h"
+	Since string
+	Until string
+	// Labels are "name:value" or "name" labels the profiles must have
+	Labels []string
+	Limit  int
+	// Cursor is the NextCursor of the previous page
+	Cursor string
+}
+
+// SearchResult is a page of stored profiles
+type SearchResult struct {
+	Profiles []ProfileInfo `json:"profiles"`
+	// Total counts the matching profiles of all pages
+	Total int `json:"total"`
+	// NextCursor fetches the next page, empty on the last one
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// SearchProfiles returns the page of stored profiles q selects, newest
+// first
+func (c *Client) SearchProfiles(ctx context.Context, q Query) (*SearchResult, error) {
+	v := url.Values{}
+	if q.PID != 0 {
+		v.Set("pid", strconv.Itoa(q.PID))
+	}
+	for name, value := range map[string]string{"comm": q.Comm, "format": q.Format, "trigger": q.Trigger, "since": q.Since, "until": q.Until, "cursor": q.Cursor} {
+		if value != "" {
+			v.Set(name, value)
+		}
+	}
+	v["label"] = q.Labels
+	if q.Limit != 0 {
+		v.Set("limit", strconv.Itoa(q.Limit))
+	}
+	var res SearchResult
+	if err := c.getJSON(ctx, "/api/v1/store", v, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// DeleteProfile deletes stored profile id with its attachments
+func (c *Client) DeleteProfile(ctx context.Context, id string) error {
+	resp, err := c.do(ctx, "DELETE", "/api/v1/profiles/"+url.PathEscape(id), nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Event is a progress event of a background capture
+type Event struct {
+	// Event is "recording", "progress", "converting", "done" or "failed"
+	Event     string    `json:"event"`
+	Time      time.Time `json:"time"`
+	ProfileID string    `json:"profile_id"`
+	Elapsed   int       `json:"elapsed"`
+	Seconds   int       `json:"seconds"`
+	// RecordedBytes is the size of perf.data so far
+	RecordedBytes int64 `json:"recorded_bytes,omitempty"`
+	// Samples is the number of samples of the stored profile, on "done"
+	Samples int64 `json:"samples,omitempty"`
+	// Message is the error, on "failed"
+	Message string `json:"message,omitempty"`
+}
+
+// CaptureError is the failure of a background capture
+type CaptureError struct {
+	ProfileID string
+	Message   string
+}
+
+func (e *CaptureError) Error() string {
+	return fmt.Sprintf("capture %s failed: %s", e.ProfileID, e.Message)
+}
+
+// Follow calls fn with the events of the background capture that produces
+// profile id until it is stored, and returns a *CaptureError if it fails.
+// Streams that break off are resumed after the last event seen.
+func (c *Client) Follow(ctx context.Context, id string, fn func(Event)) error {
+	lastID := ""
+	for attempt := 0; ; attempt++ {
+		header := http.Header{"Accept": {"text/event-stream"}}
+		if lastID != "" {
+			header.Set("Last-Event-ID", lastID)
+		}
+		resp, err := c.do(ctx, "GET", "/api/v1/profiles/"+url.PathEscape(id)+"/events", nil, header)
+		if err != nil {
+			return err
+		}
+		done, err := readEvents(resp.Body, &lastID, fn)
+		resp.Body.Close()
+		if ce, ok := err.(*CaptureError); ok && ce.ProfileID == "" {
+			ce.ProfileID = id
+		}
+		if done || err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if attempt == 5 {
+			return fmt.Errorf("events of capture %s ended before it finished", id)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// readEvents passes the server-sent events of r to fn, recording their ID
+// in lastID, and reports whether the capture is over
+func readEvents(r io.Reader, lastID *string, fn func(Event)) (bool, error) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if v, ok := strings.CutPrefix(line, "id: "); ok {
+			*lastID = v
+		}
+		data, ok := strings.CutPrefix(line, "data: ")
+		if !ok {
+			continue
+		}
+		var e Event
+		if err := json.Unmarshal([]byte(data), &e); err != nil {
+			continue
+		}
+		if fn != nil {
+			fn(e)
+		}
+		switch e.Event {
+		case "done":
+			return true, nil
+		case "failed":
+			return true, &CaptureError{ProfileID: e.ProfileID, Message: e.Message}
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,156 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestNew(t *testing.T) {
+	for _, bad := range []string{"ftp://host", "http://", "://"} {
+		if _, err := New(bad); err == nil {
+			t.Errorf("New(%q) accepted", bad)
+		}
+	}
+	c, err := New("ops:s3cr3t@redis-7:8080/profiling/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.BaseURL != "http://redis-7:8080/profiling" || c.Username != "ops" || c.Password != "s3cr3t" {
+		t.Errorf("client = %+v", c)
+	}
+}
+
+func TestCaptureRequestEndpoint(t *testing.T) {
+	for _, tc := range []struct {
+		req   CaptureRequest
+		path  string
+		query string
+	}{
+		{CaptureRequest{Target: Target{PID: 42}, Seconds: 10}, "/debug/pprof/profile", "pid=42&seconds=10"},
+		{CaptureRequest{Target: Target{RedisPort: 6379, Children: true}, Format: "folded", Frequency: 99}, "/debug/folded/profile", "children=true&frequency=99&redis_port=6379"},
+		{CaptureRequest{Target: Target{PID: 1, Container: "abc", TID: 7}, Format: "perfarchive", Labels: map[string]string{"incident": "INC-1"}}, "/debug/pprof/profile", "container=abc&format=perfarchive&label=incident%3AINC-1&pid=1&tid=7"},
+		{CaptureRequest{Params: map[string][]string{"pid": {"5"}, "stacks": {"user"}}}, "/debug/pprof/profile", "pid=5&stacks=user"},
+	} {
+		path, q, err := tc.req.endpoint()
+		if err != nil || path != tc.path || q.Encode() != tc.query {
+			t.Errorf("%+v: %s?%s, %v, want %s?%s", tc.req, path, q.Encode(), err, tc.path, tc.query)
+		}
+	}
+	for _, req := range []CaptureRequest{{}, {Target: Target{PID: 1, RedisPort: 6379}}} {
+		if _, _, err := req.endpoint(); err == nil {
+			t.Errorf("%+v: accepted", req)
+		}
+	}
+}
+
+func TestClient(t *testing.T) {
+	busy := 1
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer t0ken" {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		switch r.Method + " " + r.URL.Path {
+		case "GET /debug/folded/profile":
+			if busy > 0 {
+				busy--
+				w.Header().Set("Retry-After", "1")
+				http.Error(w, "Rate limit exceeded", http.StatusTooManyRequests)
+				return
+			}
+			w.Header().Set("X-Profile-ID", "3f9a1c0e7b2d4856")
+			w.Header().Add("X-Profile-Warning", "no frame pointers")
+			fmt.Fprint(w, "main;work 10\n")
+		case "GET /api/v1/profiles":
+			fmt.Fprint(w, `[{"id":"3f9a1c0e7b2d4856","format":"folded","pid":"42","created_at":"2024-06-11T10:15:12Z","size":13,"labels":{"incident":"INC-1"}}]`)
+		case "GET /api/v1/store":
+			if r.URL.RawQuery != "comm=redis-server&label=incident%3AINC-1&limit=10&since=24h" {
+				t.Errorf("search query %s", r.URL.RawQuery)
+			}
+			fmt.Fprint(w, `{"profiles":[{"id":"3f9a1c0e7b2d4856","format":"folded"}],"total":11,"next_cursor":"abc"}`)
+		case "GET /api/v1/profiles/3f9a1c0e7b2d4856/events":
+			fmt.Fprint(w, "id: 1\nevent: recording\ndata: {\"event\":\"recording\",\"seconds\":1}\n\n: keepalive\n\nid: 2\nevent: done\ndata: {\"event\":\"done\",\"samples\":10}\n\n")
+		case "GET /api/v1/profiles/0123456789abcdef/events":
+			fmt.Fprint(w, "id: 1\nevent: failed\ndata: {\"event\":\"failed\",\"message\":\"perf exited with status 1\"}\n\n")
+		case "GET /api/v1/profiles/3f9a1c0e7b2d4856":
+			fmt.Fprint(w, "main;work 10\n")
+		case "DELETE /api/v1/profiles/3f9a1c0e7b2d4856":
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	ctx := context.Background()
+	c, err := New(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.ListProfiles(ctx); err == nil {
+		t.Error("unauthenticated request succeeded")
+	}
+	c.Token = "t0ken"
+
+	if _, err := c.Capture(ctx, CaptureRequest{Target: Target{PID: 42}, Format: "folded"}); err == nil {
+		t.Error("busy capture succeeded without RetryLimit")
+	} else if apiErr := (*Error)(nil); !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusTooManyRequests || apiErr.RetryAfter != time.Second {
+		t.Errorf("busy capture: %#v", err)
+	}
+	busy = 1
+	c.RetryLimit = time.Minute
+	retries := 0
+	c.OnRetry = func(*Error, time.Duration) { retries++ }
+	p, err := c.Capture(ctx, CaptureRequest{Target: Target{PID: 42}, Format: "folded"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(p)
+	p.Close()
+	if string(data) != "main;work 10\n" || p.ID != "3f9a1c0e7b2d4856" || !slices.Equal(p.Warnings, []string{"no frame pointers"}) || retries != 1 {
+		t.Errorf("capture = %q, %+v after %d retries", data, p, retries)
+	}
+
+	profiles, err := c.ListProfiles(ctx)
+	if err != nil || len(profiles) != 1 || profiles[0].PID != "42" || profiles[0].Labels["incident"] != "INC-1" || profiles[0].CreatedAt.IsZero() {
+		t.Errorf("ListProfiles = %+v, %v", profiles, err)
+	}
+	res, err := c.SearchProfiles(ctx, Query{Comm: "redis-server", Since: "24h", Labels: []string{"incident:INC-1"}, Limit: 10})
+	if err != nil || res.Total != 11 || res.NextCursor != "abc" || len(res.Profiles) != 1 {
+		t.Errorf("SearchProfiles = %+v, %v", res, err)
+	}
+
+	var events []string
+	if err := c.Follow(ctx, "3f9a1c0e7b2d4856", func(e Event) { events = append(events, e.Event) }); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(events, []string{"recording", "done"}) {
+		t.Errorf("events = %v", events)
+	}
+	err = c.Follow(ctx, "0123456789abcdef", nil)
+	if ce := (*CaptureError)(nil); !errors.As(err, &ce) || ce.ProfileID != "0123456789abcdef" || ce.Message != "perf exited with status 1" {
+		t.Errorf("failed capture: %v", err)
+	}
+
+	p, err = c.Download(ctx, "3f9a1c0e7b2d4856")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Close()
+	if p.ID != "3f9a1c0e7b2d4856" {
+		t.Errorf("download = %+v", p)
+	}
+	if err := c.DeleteProfile(ctx, "3f9a1c0e7b2d4856"); err != nil {
+		t.Error(err)
+	}
+	if err := c.DeleteProfile(ctx, "missing"); err == nil {
+		t.Error("deleting a missing profile succeeded")
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// targetPolicy is the target_policy section of the configuration file, which
+// restricts the processes the exporter may profile
+type targetPolicy struct {
+	// Allow lists the processes that may be profiled; everything is allowed
+	// when it is empty
+	Allow []targetRule `json:"allow"`
+	// Deny overrides Allow
+	Deny []targetRule `json:"deny"`
+	// AllowDescendants also allows descendants of allowed processes, such as
+	// the forked children of redis-server that rename themselves
+	AllowDescendants bool `json:"allow_descendants"`
+	// Protected lists the comm names of critical processes that, like the
+	// exporter itself and PID 1, are only profiled with -allow-protected
+	Protected []string `json:"protected"`
+}
+
+// targetRule matches a process when every field that is set matches
+type targetRule struct {
+	// Comm is a regular expression matched against /proc/<pid>/comm
+	Comm string `json:"comm,omitempty"`
+	// UID is the real user ID of the process
+	UID *int `json:"uid,omitempty"`
+	// Cgroup is a prefix of the process's cgroup path
+	Cgroup string `json:"cgroup,omitempty"`
+
+	commRe *regexp.Regexp
+}
+
+func (c *targetPolicy) validate() error {
+	for i, comm := range c.Protected {
+		if comm == "" || len(comm) > 15 {
+			return fmt.Errorf("protected entry %d: comm must be 1 to 15 characters", i+1)
+		}
+	}
+	for _, list := range []struct {
+		name  string
+		rules []targetRule
+	}{{"allow", c.Allow}, {"deny", c.Deny}} {
+		for i := range list.rules {
+			rule := &list.rules[i]
+			if rule.Comm == "" && rule.UID == nil && rule.Cgroup == "" {
+				return fmt.Errorf("%s rule %d: one of comm, uid or cgroup is required", list.name, i+1)
+			}
+			if rule.Comm != "" {
+				re, err := regexp.Compile(rule.Comm)
+				if err != nil {
+					return fmt.Errorf("%s rule %d: invalid comm: %v", list.name, i+1, err)
+				}
+				rule.commRe = re
+			}
+		}
+	}
+	return nil
+}
+
+// policy holds the target_policy section of the configuration file, which a
+// reload replaces while captures are running
+var policy atomic.Pointer[targetPolicy]
+
+// currentPolicy returns the target policy in effect
+func currentPolicy() *targetPolicy {
+	if p := policy.Load(); p != nil {
+		return p
+	}
+	return &targetPolicy{}
+}
+
+// allowProtected lifts the protection of the exporter, PID 1 and the
+// protected processes (-allow-protected)
+var allowProtected bool
+
+// selfPID returns the PID of the exporter as seen in procRoot, which differs
+// from os.Getpid when a container mounts the host's /proc
+func selfPID() int {
+	if link, err := os.Readlink(filepath.Join(procRoot, "self")); err == nil {
+		if pid, err := strconv.Atoi(link); err == nil {
+			return pid
+		}
+	}
+	return os.Getpid()
+}
+
+// checkProtected returns an error when pid is the exporter, PID 1 or a
+// protected process: profiling the exporter feeds back into its own
+// samples and a stalled init takes the host down with it
+func (c *targetPolicy) checkProtected(pid int) error {
+	if allowProtected {
+		return nil
+	}
+	switch pid {
+	case selfPID():
+		return fmt.Errorf("PID %d is the exporter itself (start with -allow-protected to profile it)", pid)
+	case 1:
+		return fmt.Errorf("PID 1 is init (start with -allow-protected to profile it)")
+	}
+	if len(c.Protected) > 0 {
+		if comm, err := readComm(pid); err == nil && slices.Contains(c.Protected, comm) {
+			return fmt.Errorf("PID %d (%s) is a protected process (start with -allow-protected to profile it)", pid, comm)
+		}
+	}
+	return nil
+}
+
+// restricted reports whether the policy limits the processes that may be
+// profiled, which rules out system-wide tracing
+func (c *targetPolicy) restricted() bool {
+	return len(c.Allow) > 0 || len(c.Deny) > 0
+}
+
+// matches reports whether process pid matches the rule
+func (r *targetRule) matches(pid int) bool {
+	if r.commRe != nil {
+		comm, err := readComm(pid)
+		if err != nil || !r.commRe.MatchString(comm) {
+			return false
+		}
+	}
+	if r.UID != nil {
+		uid, err := readUID(pid)
+		if err != nil || uid != *r.UID {
+			return false
+		}
+	}
+	if r.Cgroup != "" {
+		cgroup, err := readCgroup(pid)
+		if err != nil || !cgroupHasPrefix(cgroup, r.Cgroup) {
+			return false
+		}
+	}
+	return true
+}
+
+// cgroupHasPrefix reports whether any hierarchy listed in the contents of
+// /proc/<pid>/cgroup places the process under prefix
+func cgroupHasPrefix(cgroup, prefix string) bool {
+	for _, line := range strings.Split(cgroup, "\n") {
+		// hierarchy-ID:controllers:path
+		fields := strings.SplitN(line, ":", 3)
+		if len(fields) == 3 && strings.HasPrefix(fields[2], prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesAny reports whether process pid matches one of rules
+func matchesAny(rules []targetRule, pid int) bool {
+	for i := range rules {
+		if rules[i].matches(pid) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowed reports whether the allow list admits pid, directly or, with
+// AllowDescendants, through one of its ancestors
+func (c *targetPolicy) allowed(pid int) bool {
+	if len(c.Allow) == 0 || matchesAny(c.Allow, pid) {
+		return true
+	}
+	if !c.AllowDescendants {
+		return false
+	}
+	for cur, seen := pid, map[int]bool{pid: true}; ; {
+		ppid, err := readParentPID(cur)
+		if err != nil || ppid <= 0 || seen[ppid] {
+			return false
+		}
+		if matchesAny(c.Allow, ppid) {
+			return true
+		}
+		seen[ppid] = true
+		cur = ppid
+	}
+}
+
+// check returns an error when the policy forbids profiling pid
+func (c *targetPolicy) check(pid string) error {
+	n, err := strconv.Atoi(pid)
+	if err != nil {
+		return fmt.Errorf("invalid PID %q", pid)
+	}
+	if err := c.checkProtected(n); err != nil {
+		return err
+	}
+	if matchesAny(c.Deny, n) {
+		return fmt.Errorf("PID %d matches a deny rule of the target policy", n)
+	}
+	if !c.allowed(n) {
+		return fmt.Errorf("PID %d is not allowed by the target policy", n)
+	}
+	return nil
+}
+
+// permitted returns the pids the policy allows, in order
+func (c *targetPolicy) permitted(pids []int) []int {
+	var result []int
+	for _, pid := range pids {
+		if c.check(strconv.Itoa(pid)) == nil {
+			result = append(result, pid)
+		}
+	}
+	return result
+}
+
+// checkTrace checks the pid argument of a bpftrace script, where "0" traces
+// every process and is only allowed without a policy
+func (c *targetPolicy) checkTrace(pid string) error {
+	if pid != "0" {
+		return c.check(pid)
+	}
+	if c.restricted() {
+		return fmt.Errorf("the target policy requires a pid")
+	}
+	return nil
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+// writeFakeTargets creates a fake /proc with a systemd managed redis-server
+// (10) and its forked child (11), sshd (20) and a user's redis-server (30)
+func writeFakeTargets(t *testing.T) {
+	t.Helper()
+	writeFakeProc(t, map[int]int{10: 1, 11: 10, 20: 1, 30: 1})
+
+	procs := []struct {
+		pid    int
+		comm   string
+		uid    int
+		cgroup string
+	}{
+		{10, "redis-server", 999, "/system.slice/redis-server.service"},
+		{11, "redis-rdb-bgsave", 999, "/system.slice/redis-server.service"},
+		{20, "sshd", 0, "/system.slice/ssh.service"},
+		{30, "redis-server", 1000, "/user.slice/user-1000.slice/session-2.scope"},
+	}
+	for _, p := range procs {
+		dir := filepath.Join(procRoot, strconv.Itoa(p.pid))
+		files := map[string]string{
+			"comm":   p.comm + "\n",
+			"status": "Name:\t" + p.comm + "\nUid:\t" + strconv.Itoa(p.uid) + "\t0\t0\t0\n",
+			"cgroup": "0::" + p.cgroup + "\n",
+		}
+		for name, content := range files {
+			if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+// setPolicy validates p and makes it the target policy for the test
+func setPolicy(t *testing.T, p targetPolicy) {
+	t.Helper()
+	if err := p.validate(); err != nil {
+		t.Fatal(err)
+	}
+	orig := policy.Load()
+	policy.Store(&p)
+	t.Cleanup(func() { policy.Store(orig) })
+}
+
+func TestTargetPolicyValidate(t *testing.T) {
+	uid := 999
+	tests := []struct {
+		name    string
+		policy  targetPolicy
+		wantErr bool
+	}{
+		{"empty", targetPolicy{}, false},
+		{"comm", targetPolicy{Allow: []targetRule{{Comm: "^redis-server$"}}}, false},
+		{"uid and cgroup", targetPolicy{Deny: []targetRule{{UID: &uid, Cgroup: "/user.slice"}}}, false},
+		{"empty rule", targetPolicy{Allow: []targetRule{{}}}, true},
+		{"bad regexp", targetPolicy{Deny: []targetRule{{Comm: "redis-(server"}}}, true},
+	}
+	for _, tt := range tests {
+		if err := tt.policy.validate(); (err != nil) != tt.wantErr {
+			t.Errorf("%s: validate() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestCgroupHasPrefix(t *testing.T) {
+	cgroup := "12:pids:/system.slice/redis.service\n1:name=systemd:/system.slice/redis.service\n0::/system.slice/redis.service\n"
+	tests := []struct {
+		prefix string
+		want   bool
+	}{
+		{"/system.slice/redis", true},
+		{"/system.slice/", true},
+		{"/user.slice", false},
+		{"pids", false},
+	}
+	for _, tt := range tests {
+		if got := cgroupHasPrefix(cgroup, tt.prefix); got != tt.want {
+			t.Errorf("cgroupHasPrefix(%q) = %v, want %v", tt.prefix, got, tt.want)
+		}
+	}
+}
+
+func TestTargetPolicyCheck(t *testing.T) {
+	writeFakeTargets(t)
+
+	uid := 999
+	tests := []struct {
+		name   string
+		policy targetPolicy
+		want   []int // permitted PIDs out of 10, 11, 20, 30
+	}{
+		{"no policy", targetPolicy{}, []int{10, 11, 20, 30}},
+		{"comm", targetPolicy{Allow: []targetRule{{Comm: "^redis-server$"}}}, []int{10, 30}},
+		{"comm and uid", targetPolicy{Allow: []targetRule{{Comm: "^redis-server$", UID: &uid}}}, []int{10}},
+		{"cgroup", targetPolicy{Allow: []targetRule{{Cgroup: "/system.slice/redis-server"}}}, []int{10, 11}},
+		{
+			"descendants",
+			targetPolicy{Allow: []targetRule{{Comm: "^redis-server$", UID: &uid}}, AllowDescendants: true},
+			[]int{10, 11},
+		},
+		{"deny only", targetPolicy{Deny: []targetRule{{Comm: "^sshd$"}}}, []int{10, 11, 30}},
+		{
+			"deny overrides allow",
+			targetPolicy{Allow: []targetRule{{Comm: "^redis"}}, Deny: []targetRule{{Cgroup: "/user.slice"}}},
+			[]int{10, 11},
+		},
+	}
+	for _, tt := range tests {
+		if err := tt.policy.validate(); err != nil {
+			t.Fatal(err)
+		}
+		if got := tt.policy.permitted([]int{10, 11, 20, 30}); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: permitted = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestTargetPolicyCheckTrace(t *testing.T) {
+	writeFakeTargets(t)
+
+	open := targetPolicy{}
+	if err := open.checkTrace("0"); err != nil {
+		t.Errorf("checkTrace(0) without a policy: %v", err)
+	}
+
+	restricted := targetPolicy{Allow: []targetRule{{Comm: "^redis-server$"}}}
+	if err := restricted.validate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := restricted.checkTrace("0"); err == nil {
+		t.Error("checkTrace(0) with a policy succeeded")
+	}
+	if err := restricted.checkTrace("10"); err != nil {
+		t.Errorf("checkTrace(10): %v", err)
+	}
+	if err := restricted.checkTrace("20"); err == nil {
+		t.Error("checkTrace(20) succeeded for sshd")
+	}
+}
+
+func TestBpftraceRunTargetPolicy(t *testing.T) {
+	writeFakeTargets(t)
+	setPolicy(t, targetPolicy{Allow: []targetRule{{Comm: "^redis-server$"}}})
+
+	tests := []struct {
+		query      string
+		wantStatus int
+	}{
+		{"script=biolatency&seconds=5&test=true", http.StatusForbidden},
+		{"script=fsynclat&seconds=5&pid=20&test=true", http.StatusForbidden},
+		{"script=fsynclat&seconds=5&pid=10&test=true", http.StatusOK},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/debug/bpftrace/run?"+tt.query, nil)
+		rr := httptest.NewRecorder()
+		handleBpftraceRun(rr, req)
+		if rr.Code != tt.wantStatus {
+			t.Errorf("%s: status = %d, want %d: %s", tt.query, rr.Code, tt.wantStatus, rr.Body.String())
+		}
+	}
+}
+
+func TestCheckProtected(t *testing.T) {
+	writeFakeTargets(t)
+
+	p := targetPolicy{Protected: []string{"sshd"}}
+	if err := p.validate(); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		pid     int
+		wantErr bool
+	}{
+		{os.Getpid(), true}, // no /proc/self in the fake tree
+		{1, true},
+		{20, true},
+		{10, false},
+	}
+	for _, tt := range tests {
+		if err := p.check(strconv.Itoa(tt.pid)); (err != nil) != tt.wantErr {
+			t.Errorf("check(%d) error = %v, wantErr %v", tt.pid, err, tt.wantErr)
+		}
+	}
+
+	// /proc/self names the exporter in the PID namespace of the mount
+	if err := os.Symlink("10", filepath.Join(procRoot, "self")); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.check("10"); err == nil {
+		t.Error("check(10) succeeded for the exporter's own PID")
+	}
+
+	allowProtected = true
+	t.Cleanup(func() { allowProtected = false })
+	for _, pid := range []string{"1", "10", "20"} {
+		if err := p.check(pid); err != nil {
+			t.Errorf("check(%s) with -allow-protected: %v", pid, err)
+		}
+	}
+
+	if err := (&targetPolicy{Protected: []string{"a-very-long-process-name"}}).validate(); err == nil {
+		t.Error("validate() accepted a comm longer than 15 characters")
+	}
+}
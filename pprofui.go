@@ -0,0 +1,208 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/pprof/driver"
+	"github.com/google/pprof/profile"
+)
+
+// pprofViewCacheSize is how many stored profiles keep their pprof web
+// interface, so browsing a profile does not parse it again on every page
+const pprofViewCacheSize = 16
+
+// pprofFlags gives the pprof driver a fixed command line instead of the
+// exporter's own
+type pprofFlags struct {
+	fs   *flag.FlagSet
+	args []string
+}
+
+func (f *pprofFlags) Bool(name string, def bool, usage string) *bool {
+	return f.fs.Bool(name, def, usage)
+}
+
+func (f *pprofFlags) Int(name string, def int, usage string) *int {
+	return f.fs.Int(name, def, usage)
+}
+
+func (f *pprofFlags) Float64(name string, def float64, usage string) *float64 {
+	return f.fs.Float64(name, def, usage)
+}
+
+func (f *pprofFlags) String(name, def, usage string) *string {
+	return f.fs.String(name, def, usage)
+}
+
+func (f *pprofFlags) StringList(name, def, usage string) *[]*string {
+	return &[]*string{f.fs.String(name, def, usage)}
+}
+
+func (f *pprofFlags) ExtraUsage() string { return "" }
+
+func (f *pprofFlags) AddExtraUsage(string) {}
+
+func (f *pprofFlags) Parse(usage func()) []string {
+	if err := f.fs.Parse(f.args); err != nil {
+		usage()
+		return nil
+	}
+	return f.fs.Args()
+}
+
+// pprofFetcher hands the driver the stored profile it views
+type pprofFetcher struct {
+	p *profile.Profile
+}
+
+func (f pprofFetcher) Fetch(src string, duration, timeout time.Duration) (*profile.Profile, string, error) {
+	return f.p, src, nil
+}
+
+// pprofUI logs what the driver would print on a terminal
+type pprofUI struct{}
+
+func (pprofUI) ReadLine(string) (string, error) { return "", fmt.Errorf("no terminal") }
+func (pprofUI) Print(args ...interface{})       {}
+func (pprofUI) PrintErr(args ...interface{}) {
+	log.Printf("pprof viewer: %s", strings.TrimSpace(fmt.Sprint(args...)))
+}
+func (pprofUI) IsTerminal() bool                    { return false }
+func (pprofUI) WantBrowser() bool                   { return false }
+func (pprofUI) SetAutoComplete(func(string) string) {}
+
+// newPprofViewer runs the pprof driver in-process on stored profile id and
+// returns the handler of its web interface, which serves the pages at paths
+// relative to the viewer's root
+func newPprofViewer(id string, p *profile.Profile) (http.Handler, error) {
+	var handlers map[string]http.Handler
+	err := driver.PProf(&driver.Options{
+		// Perf and BCC profiles are symbolized when they are captured
+		Flagset: &pprofFlags{fs: flag.NewFlagSet("pprof", flag.ContinueOnError), args: []string{"-http=localhost:0", "-no_browser", "-symbolize=none", id}},
+		Fetch:   pprofFetcher{p},
+		UI:      pprofUI{},
+		HTTPServer: func(args *driver.HTTPServerArgs) error {
+			handlers = args.Handlers
+			return nil
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if handlers == nil {
+		return nil, fmt.Errorf("pprof did not start its web interface")
+	}
+	mux := http.NewServeMux()
+	for path, h := range handlers {
+		// Settings would be saved in the exporter's home directory, shared
+		// by every user of the viewer
+		if path == "/saveconfig" || path == "/deleteconfig" {
+			h = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				http.Error(w, "Saving pprof settings is disabled in the exporter", http.StatusForbidden)
+			})
+		}
+		mux.Handle(path, h)
+	}
+	return mux, nil
+}
+
+// pprofViewers caches the web interfaces of recently viewed profiles
+type pprofViewers struct {
+	mu    sync.Mutex
+	byID  map[string]http.Handler
+	order []string // least recently created first
+}
+
+var pprofViews = &pprofViewers{byID: make(map[string]http.Handler)}
+
+// get returns the web interface of stored profile id, starting it if needed
+func (v *pprofViewers) get(id string) (http.Handler, error) {
+	v.mu.Lock()
+	h, ok := v.byID[id]
+	v.mu.Unlock()
+	if ok {
+		return h, nil
+	}
+
+	p, err := loadStoredProfile(id)
+	if err != nil {
+		return nil, err
+	}
+	if h, err = newPprofViewer(id, p); err != nil {
+		return nil, err
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if cached, ok := v.byID[id]; ok {
+		return cached, nil
+	}
+	v.byID[id] = h
+	v.order = append(v.order, id)
+	if len(v.order) > pprofViewCacheSize {
+		delete(v.byID, v.order[0])
+		v.order = v.order[1:]
+	}
+	return h, nil
+}
+
+// forget drops the web interface of a deleted profile
+func (v *pprofViewers) forget(id string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	delete(v.byID, id)
+	for i, cached := range v.order {
+		if cached == id {
+			v.order = append(v.order[:i], v.order[i+1:]...)
+			break
+		}
+	}
+}
+
+// handlePprofView serves the pprof web interface of a stored profile under
+// /ui/view/{id}/, with its graph, flame graph, top, peek and source views
+func handlePprofView(w http.ResponseWriter, r *http.Request) {
+	if !requireStore(w) {
+		return
+	}
+	id := r.PathValue("id")
+	base := "/ui/view/" + id
+	rest, ok := strings.CutPrefix(r.URL.Path, base)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if rest == "" {
+		// The pages link to each other relative to the directory. The
+		// location stays relative, as http.Redirect would drop -http-prefix.
+		w.Header().Set("Location", id+"/")
+		w.WriteHeader(http.StatusMovedPermanently)
+		return
+	}
+
+	meta, err := store.Get(id)
+	if err == errProfileNotFound {
+		http.Error(w, "Profile not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to open profile: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if meta.Format != "pprof" && meta.Format != "folded" {
+		http.Error(w, fmt.Sprintf("Profile %s is in %s format, which the pprof viewer cannot open", id, meta.Format), http.StatusBadRequest)
+		return
+	}
+	h, err := pprofViews.get(id)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to open profile in pprof: %v", err), http.StatusInternalServerError)
+		return
+	}
+	r2 := r.Clone(r.Context())
+	r2.URL.Path, r2.URL.RawPath = rest, ""
+	h.ServeHTTP(w, r2)
+}
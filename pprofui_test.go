@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPprofView(t *testing.T) {
+	s := withTestStore(t)
+	folded, err := s.Save(profileMeta{Format: "folded", PID: "42", Comm: "redis-server"}, strings.NewReader("main;aeMain;processCommand 10\nmain;aeMain;beforeSleep 5\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	perf, err := s.Save(profileMeta{Format: "perfdata", PID: "42"}, strings.NewReader("PERFILE2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /ui/view/{id}", handlePprofView)
+	mux.HandleFunc("GET /ui/view/{id}/", handlePprofView)
+	get := func(path string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest("GET", path, nil))
+		return rr
+	}
+
+	if rr := get("/ui/view/" + folded.ID); rr.Code != http.StatusMovedPermanently || rr.Header().Get("Location") != folded.ID+"/" {
+		t.Errorf("viewer root without slash: %d %v", rr.Code, rr.Header())
+	}
+	if rr := get("/ui/view/" + folded.ID + "/"); rr.Code != http.StatusMovedPermanently || !strings.Contains(rr.Header().Get("Location"), "flamegraph") {
+		t.Errorf("viewer root: %d %v", rr.Code, rr.Header())
+	}
+	rr := get("/ui/view/" + folded.ID + "/top")
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "processCommand") || !strings.Contains(rr.Body.String(), `href="./flamegraph"`) {
+		t.Errorf("top view: %d %.500s", rr.Code, rr.Body.String())
+	}
+	if rr := get("/ui/view/" + folded.ID + "/saveconfig"); rr.Code != http.StatusForbidden {
+		t.Errorf("saveconfig: %d", rr.Code)
+	}
+	if rr := get("/ui/view/" + perf.ID + "/top"); rr.Code != http.StatusBadRequest {
+		t.Errorf("viewer of perf data: %d", rr.Code)
+	}
+	if rr := get("/ui/view/0123456789abcdef/top"); rr.Code != http.StatusNotFound {
+		t.Errorf("viewer of a missing profile: %d", rr.Code)
+	}
+
+	// Deleted profiles lose their viewer
+	if _, err := pprofViews.get(folded.ID); err != nil {
+		t.Fatal(err)
+	}
+	pprofViews.forget(folded.ID)
+	if _, ok := pprofViews.byID[folded.ID]; ok {
+		t.Error("viewer kept after forget")
+	}
+}
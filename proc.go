@@ -0,0 +1,363 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// procRoot is the mount point of the host's proc filesystem (-host-proc)
+var procRoot = "/proc"
+
+// sysRoot is the mount point of the host's sysfs (-host-sys)
+var sysRoot = "/sys"
+
+// readParentPID returns the parent PID recorded in /proc/<pid>/stat
+func readParentPID(pid int) (int, error) {
+	fields, err := readStatFields(pid)
+	if err != nil {
+		return 0, err
+	}
+	if len(fields) < 2 {
+		return 0, fmt.Errorf("malformed stat for PID %d", pid)
+	}
+	return strconv.Atoi(fields[1])
+}
+
+// listPIDs returns every numeric entry in the proc filesystem
+func listPIDs() ([]int, error) {
+	entries, err := os.ReadDir(procRoot)
+	if err != nil {
+		return nil, err
+	}
+
+	var pids []int
+	for _, entry := range entries {
+		if pid, err := strconv.Atoi(entry.Name()); err == nil {
+			pids = append(pids, pid)
+		}
+	}
+	return pids, nil
+}
+
+// findDescendants returns the PIDs of all live descendants of pid, sorted
+func findDescendants(pid int) ([]int, error) {
+	pids, err := listPIDs()
+	if err != nil {
+		return nil, err
+	}
+
+	children := make(map[int][]int)
+	for _, p := range pids {
+		ppid, err := readParentPID(p)
+		if err != nil {
+			// Processes can exit while we scan
+			continue
+		}
+		children[ppid] = append(children[ppid], p)
+	}
+
+	var result []int
+	queue := []int{pid}
+	for len(queue) > 0 {
+		cur := queue[0]
+		queue = queue[1:]
+		for _, child := range children[cur] {
+			result = append(result, child)
+			queue = append(queue, child)
+		}
+	}
+
+	sort.Ints(result)
+	return result, nil
+}
+
+// readComm returns the command name of pid from /proc/<pid>/comm
+func readComm(pid int) (string, error) {
+	data, err := os.ReadFile(filepath.Join(procRoot, strconv.Itoa(pid), "comm"))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// readStatFields returns the fields of /proc/<pid>/stat that follow the comm
+// field, so fields[0] is the state (field 3 in proc(5))
+func readStatFields(pid int) ([]string, error) {
+	return statFields(filepath.Join(procRoot, strconv.Itoa(pid), "stat"))
+}
+
+// statFields returns the fields after the comm field of a stat file of a
+// process or of one of its threads
+func statFields(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// comm may contain spaces and parentheses, so parse after the last ')'
+	stat := string(data)
+	end := strings.LastIndexByte(stat, ')')
+	if end < 0 {
+		return nil, fmt.Errorf("malformed %s", path)
+	}
+	return strings.Fields(stat[end+1:]), nil
+}
+
+// readCPUTicks returns the user plus system CPU time of pid in clock ticks
+func readCPUTicks(pid int) (uint64, error) {
+	fields, err := readStatFields(pid)
+	if err != nil {
+		return 0, err
+	}
+	if len(fields) < 13 {
+		return 0, fmt.Errorf("malformed stat for PID %d", pid)
+	}
+
+	utime, err := strconv.ParseUint(fields[11], 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	stime, err := strconv.ParseUint(fields[12], 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return utime + stime, nil
+}
+
+// findPIDsByComm returns the PIDs of all processes named comm
+func findPIDsByComm(comm string) ([]int, error) {
+	pids, err := listPIDs()
+	if err != nil {
+		return nil, err
+	}
+
+	var matches []int
+	for _, pid := range pids {
+		if c, err := readComm(pid); err == nil && c == comm {
+			matches = append(matches, pid)
+		}
+	}
+	return matches, nil
+}
+
+// readCgroup returns the contents of /proc/<pid>/cgroup
+func readCgroup(pid int) (string, error) {
+	data, err := os.ReadFile(filepath.Join(procRoot, strconv.Itoa(pid), "cgroup"))
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// findPIDsByContainer returns the PIDs of all processes whose cgroup path
+// contains the given container ID (full or abbreviated to 12+ characters)
+func findPIDsByContainer(id string) ([]int, error) {
+	if len(id) < 12 {
+		return nil, fmt.Errorf("container ID %q is too short", id)
+	}
+
+	pids, err := listPIDs()
+	if err != nil {
+		return nil, err
+	}
+
+	var matches []int
+	for _, pid := range pids {
+		if cg, err := readCgroup(pid); err == nil && strings.Contains(cg, id) {
+			matches = append(matches, pid)
+		}
+	}
+	return matches, nil
+}
+
+// socketInodes returns the inodes of the sockets open in process pid
+func socketInodes(pid int) (map[string]bool, error) {
+	dir := filepath.Join(procRoot, strconv.Itoa(pid), "fd")
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	inodes := make(map[string]bool)
+	for _, entry := range entries {
+		link, err := os.Readlink(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			continue
+		}
+		if inode, ok := strings.CutPrefix(link, "socket:["); ok {
+			inodes[strings.TrimSuffix(inode, "]")] = true
+		}
+	}
+	return inodes, nil
+}
+
+// tcpListener is a listening TCP socket from /proc/<pid>/net/tcp{,6}
+type tcpListener struct {
+	IP    net.IP
+	Port  int
+	Inode string
+}
+
+// readTCPListeners returns the listening TCP sockets listed in the tcp and
+// tcp6 files of netDir, a /proc/<pid>/net directory
+func readTCPListeners(netDir string) ([]tcpListener, error) {
+	var listeners []tcpListener
+	for _, name := range []string{"tcp", "tcp6"} {
+		data, err := os.ReadFile(filepath.Join(netDir, name))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		lines := strings.Split(string(data), "\n")
+		for _, line := range lines[1:] {
+			fields := strings.Fields(line)
+			// sl local_address rem_address st ... inode is the tenth field
+			if len(fields) < 10 || fields[3] != "0A" {
+				continue
+			}
+			ip, port, err := parseProcNetAddr(fields[1])
+			if err != nil {
+				continue
+			}
+			listeners = append(listeners, tcpListener{IP: ip, Port: port, Inode: fields[9]})
+		}
+	}
+	return listeners, nil
+}
+
+// parseProcNetAddr decodes an "ADDR:PORT" pair of /proc/net/tcp, where the
+// address is hex in host byte order, 32 bits at a time
+func parseProcNetAddr(s string) (net.IP, int, error) {
+	addr, portHex, ok := strings.Cut(s, ":")
+	if !ok {
+		return nil, 0, fmt.Errorf("malformed socket address %q", s)
+	}
+	port, err := strconv.ParseUint(portHex, 16, 16)
+	if err != nil {
+		return nil, 0, err
+	}
+	raw, err := hex.DecodeString(addr)
+	if err != nil || (len(raw) != 4 && len(raw) != 16) {
+		return nil, 0, fmt.Errorf("malformed socket address %q", s)
+	}
+	ip := make(net.IP, len(raw))
+	for i := 0; i < len(raw); i += 4 {
+		binary.BigEndian.PutUint32(ip[i:], binary.LittleEndian.Uint32(raw[i:]))
+	}
+	return ip, int(port), nil
+}
+
+// findListenAddrs returns dialable addresses of the TCP ports process pid
+// listens on, lowest port first; wildcard binds are reached through loopback
+func findListenAddrs(pid int) ([]string, error) {
+	inodes, err := socketInodes(pid)
+	if err != nil {
+		return nil, err
+	}
+	listeners, err := readTCPListeners(filepath.Join(procRoot, strconv.Itoa(pid), "net"))
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(listeners, func(i, j int) bool { return listeners[i].Port < listeners[j].Port })
+	var addrs []string
+	seen := make(map[int]bool)
+	for _, l := range listeners {
+		if !inodes[l.Inode] || seen[l.Port] {
+			continue
+		}
+		seen[l.Port] = true
+
+		ip := l.IP
+		if ip.IsUnspecified() {
+			ip = net.IPv4(127, 0, 0, 1)
+			if l.IP.To4() == nil {
+				ip = net.IPv6loopback
+			}
+		}
+		addrs = append(addrs, net.JoinHostPort(ip.String(), strconv.Itoa(l.Port)))
+	}
+	return addrs, nil
+}
+
+// findPIDByPort returns the process listening on TCP port in the network
+// namespace of the exporter. When a listening socket is shared, as with
+// forked children that inherit it, the topmost process owning it wins.
+func findPIDByPort(port int) (int, error) {
+	listeners, err := readTCPListeners(filepath.Join(procRoot, "net"))
+	if err != nil {
+		return 0, err
+	}
+	inodes := make(map[string]bool)
+	for _, l := range listeners {
+		if l.Port == port {
+			inodes[l.Inode] = true
+		}
+	}
+	if len(inodes) == 0 {
+		return 0, fmt.Errorf("no process listens on port %d", port)
+	}
+
+	pids, err := listPIDs()
+	if err != nil {
+		return 0, err
+	}
+	owners := make(map[int]bool)
+	for _, pid := range pids {
+		sockets, err := socketInodes(pid)
+		if err != nil {
+			continue
+		}
+		for inode := range inodes {
+			if sockets[inode] {
+				owners[pid] = true
+				break
+			}
+		}
+	}
+
+	var roots []int
+	for pid := range owners {
+		if ppid, err := readParentPID(pid); err != nil || !owners[ppid] {
+			roots = append(roots, pid)
+		}
+	}
+	sort.Ints(roots)
+
+	switch len(roots) {
+	case 0:
+		return 0, fmt.Errorf("the process listening on port %d is not visible to the exporter", port)
+	case 1:
+		return roots[0], nil
+	}
+	return 0, fmt.Errorf("port %d is shared by processes %v", port, roots)
+}
+
+// mapsLibrary reports whether pid has a file matching re mapped, which
+// identifies runtimes linked into binaries of any name
+func mapsLibrary(pid int, re *regexp.Regexp) bool {
+	f, err := os.Open(filepath.Join(procRoot, strconv.Itoa(pid), "maps"))
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if re.MatchString(scanner.Text()) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+// writeFakeProc creates a fake /proc tree from a pid -> ppid map and points
+// procRoot at it for the duration of the test
+func writeFakeProc(t *testing.T, parents map[int]int) {
+	t.Helper()
+
+	dir := t.TempDir()
+	for pid, ppid := range parents {
+		pidDir := filepath.Join(dir, strconv.Itoa(pid))
+		if err := os.MkdirAll(pidDir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		stat := fmt.Sprintf("%d (redis server) S %d 1 1 0 -1\n", pid, ppid)
+		if err := os.WriteFile(filepath.Join(pidDir, "stat"), []byte(stat), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	orig := procRoot
+	procRoot = dir
+	t.Cleanup(func() { procRoot = orig })
+}
+
+// writeFakeListener makes pid own a socket with the given inode listening on
+// port, in both /proc/net/tcp and the per-process view of it
+func writeFakeListener(t *testing.T, pid, port int, inode string) {
+	t.Helper()
+
+	pidDir := filepath.Join(procRoot, strconv.Itoa(pid))
+	line := fmt.Sprintf("   0: 00000000:%04X 00000000:0000 0A 00000000:00000000 00:00000000 00000000   999        0 %s 1 0 100 0 0 10 0\n", port, inode)
+	for _, dir := range []string{filepath.Join(procRoot, "net"), filepath.Join(pidDir, "net"), filepath.Join(pidDir, "fd")} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, path := range []string{filepath.Join(procRoot, "net", "tcp"), filepath.Join(pidDir, "net", "tcp")} {
+		data, err := os.ReadFile(path)
+		if os.IsNotExist(err) {
+			data = []byte("  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode\n")
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, append(data, line...), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fd := filepath.Join(pidDir, "fd", inode)
+	if err := os.Symlink("socket:["+inode+"]", fd); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadParentPID(t *testing.T) {
+	writeFakeProc(t, map[int]int{42: 7})
+
+	ppid, err := readParentPID(42)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ppid != 7 {
+		t.Errorf("readParentPID() = %d, want 7", ppid)
+	}
+
+	if _, err := readParentPID(43); err == nil {
+		t.Errorf("readParentPID() should fail for a missing process")
+	}
+}
+
+func TestFindDescendants(t *testing.T) {
+	writeFakeProc(t, map[int]int{
+		1:   0,
+		100: 1,
+		101: 100, // BGSAVE fork
+		102: 101,
+		200: 1,
+	})
+
+	got, err := findDescendants(100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []int{101, 102}; !reflect.DeepEqual(got, want) {
+		t.Errorf("findDescendants() = %v, want %v", got, want)
+	}
+
+	got, err = findDescendants(200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 0 {
+		t.Errorf("findDescendants() = %v, want none", got)
+	}
+}
+
+func TestParseProcNetAddr(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"0100007F:18EB", "127.0.0.1:6379"},
+		{"00000000:1F90", "0.0.0.0:8080"},
+		{"00000000000000000000000001000000:18EB", "[::1]:6379"},
+	}
+
+	for _, tt := range tests {
+		ip, port, err := parseProcNetAddr(tt.input)
+		if err != nil {
+			t.Errorf("parseProcNetAddr(%q) error: %v", tt.input, err)
+			continue
+		}
+		if got := net.JoinHostPort(ip.String(), strconv.Itoa(port)); got != tt.want {
+			t.Errorf("parseProcNetAddr(%q) = %s, want %s", tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestFindListenAddrs(t *testing.T) {
+	writeFakeProc(t, map[int]int{42: 1})
+
+	pidDir := filepath.Join(procRoot, "42")
+	for _, dir := range []string{"fd", "net"} {
+		if err := os.MkdirAll(filepath.Join(pidDir, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The redis-server owns the client and cluster bus listeners, another
+	// process in the same network namespace owns port 9121
+	for fd, inode := range map[string]string{"6": "1001", "7": "1002", "8": "1004"} {
+		if err := os.Symlink("socket:["+inode+"]", filepath.Join(pidDir, "fd", fd)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tcp := `  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode
+   0: 00000000:5AFB 00000000:0000 0A 00000000:00000000 00:00000000 00000000   999        0 1002 1 0 100 0 0 10 0
+   1: 00000000:18EB 00000000:0000 0A 00000000:00000000 00:00000000 00000000   999        0 1001 1 0 100 0 0 10 0
+   2: 00000000:23A1 00000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 1003 1 0 100 0 0 10 0
+   3: 0100007F:18EB 0100007F:D431 01 00000000:00000000 00:00000000 00000000   999        0 1004 1 0 100 0 0 10 0
+`
+	if err := os.WriteFile(filepath.Join(pidDir, "net", "tcp"), []byte(tcp), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	addrs, err := findListenAddrs(42)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"127.0.0.1:6379", "127.0.0.1:23291"}
+	if !reflect.DeepEqual(addrs, want) {
+		t.Errorf("findListenAddrs() = %v, want %v", addrs, want)
+	}
+}
+
+func TestFindPIDByPort(t *testing.T) {
+	// 100 is redis-server, 101 a fork that inherited its listener and 200
+	// an unrelated process
+	writeFakeProc(t, map[int]int{100: 1, 101: 100, 200: 1})
+	writeFakeListener(t, 100, 6379, "555")
+	writeFakeListener(t, 200, 9121, "777")
+	if err := os.MkdirAll(filepath.Join(procRoot, "101", "fd"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("socket:[555]", filepath.Join(procRoot, "101", "fd", "6")); err != nil {
+		t.Fatal(err)
+	}
+
+	pid, err := findPIDByPort(6379)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pid != 100 {
+		t.Errorf("findPIDByPort(6379) = %d, want 100", pid)
+	}
+
+	if _, err := findPIDByPort(6380); err == nil {
+		t.Error("findPIDByPort(6380) should fail without a listener")
+	}
+}
+
+func TestValidatePIDHostProc(t *testing.T) {
+	// A -host-proc mount shows host processes the exporter's /proc lacks
+	writeFakeProc(t, map[int]int{4190002: 1})
+	if err := os.MkdirAll(filepath.Join(procRoot, "4190002", "task", "4190003"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := validatePID("4190002"); err != nil {
+		t.Errorf("validatePID of a host process: %v", err)
+	}
+	if err := validatePID("1"); err == nil {
+		t.Error("validatePID accepted a PID missing from -host-proc")
+	}
+	if err := validateTID("4190002", "4190003"); err != nil {
+		t.Errorf("validateTID of a host thread: %v", err)
+	}
+}
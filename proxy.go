@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// parsePathPrefix normalizes -http-prefix to a path starting with a slash
+// and without a trailing one, e.g. "profiling/" to "/profiling"
+func parsePathPrefix(s string) (string, error) {
+	prefix := "/" + strings.Trim(s, "/")
+	if prefix == "/" {
+		return "", nil
+	}
+	if u, err := url.Parse(prefix); err != nil || u.Path != prefix || strings.Contains(prefix, "//") {
+		return "", fmt.Errorf("invalid path prefix %q", s)
+	}
+	return prefix, nil
+}
+
+// stripPathPrefix serves handler under prefix, as a reverse proxy that does
+// not rewrite paths forwards them. Requests outside prefix get 404.
+func stripPathPrefix(handler http.Handler, prefix string) http.Handler {
+	if prefix == "" {
+		return handler
+	}
+	strip := http.StripPrefix(prefix, handler)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, prefix+"/") {
+			http.NotFound(w, r)
+			return
+		}
+		strip.ServeHTTP(w, r)
+	})
+}
+
+// corsExposedHeaders are the response headers scripts in browsers may read
+var corsExposedHeaders = []string{"Content-Disposition", "Repr-Digest", "Retry-After", "X-Profile-Backend", "X-Profile-ID", "X-Profile-SHA256", "X-Profile-Series", "X-Profile-Signature", "X-Profile-Signature-Key", "X-Profile-Warning"}
+
+// corsConfig is the cors section of the configuration file, which lets
+// browser-based tools such as speedscope fetch profiles directly
+type corsConfig struct {
+	// AllowedOrigins lists origins such as "https://www.speedscope.app", or
+	// "*" for any; CORS is off when empty
+	AllowedOrigins []string `json:"allowed_origins"`
+	// AllowCredentials lets browsers send basic authentication and bearer
+	// tokens along, which requires listing the origins
+	AllowCredentials bool `json:"allow_credentials"`
+	// MaxAge is how long browsers cache a preflight response (default 10m)
+	MaxAge duration `json:"max_age"`
+}
+
+func (c *corsConfig) validate() error {
+	for _, origin := range c.AllowedOrigins {
+		if origin == "*" {
+			if c.AllowCredentials {
+				return fmt.Errorf("allow_credentials requires listing the allowed origins instead of *")
+			}
+			continue
+		}
+		u, err := url.Parse(origin)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.Path != "" || u.RawQuery != "" {
+			return fmt.Errorf("invalid origin %q: must be a scheme and host such as https://www.speedscope.app", origin)
+		}
+	}
+	if c.MaxAge < 0 {
+		return fmt.Errorf("max_age must not be negative")
+	}
+	if c.MaxAge == 0 {
+		c.MaxAge = duration(10 * time.Minute)
+	}
+	return nil
+}
+
+// allowedOrigin returns the Access-Control-Allow-Origin value for origin, or
+// "" when origin may not read responses
+func (c *corsConfig) allowedOrigin(origin string) string {
+	for _, allowed := range c.AllowedOrigins {
+		if allowed == "*" {
+			return "*"
+		}
+		if strings.EqualFold(allowed, origin) {
+			return origin
+		}
+	}
+	return ""
+}
+
+// cors adds CORS headers for the origins allowed by the configuration in
+// effect and answers preflight requests itself, since browsers send them
+// without credentials
+func cors(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		c := state.Load().cfg.CORS
+		w.Header().Add("Vary", "Origin")
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+
+		allowed := c.allowedOrigin(origin)
+		if allowed == "" {
+			if preflight {
+				http.Error(w, "Origin not allowed", http.StatusForbidden)
+				return
+			}
+			handler.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Access-Control-Allow-Origin", allowed)
+		if c.AllowCredentials {
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+		}
+		if preflight {
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+			w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(time.Duration(c.MaxAge).Seconds())))
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.Header().Set("Access-Control-Expose-Headers", strings.Join(corsExposedHeaders, ", "))
+		handler.ServeHTTP(w, r)
+	})
+}
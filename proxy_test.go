@@ -0,0 +1,152 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParsePathPrefix(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{"", "", false},
+		{"/", "", false},
+		{"/profiling", "/profiling", false},
+		{"profiling/", "/profiling", false},
+		{"/tools/profiling/", "/tools/profiling", false},
+		{"/a//b", "", true},
+		{"/profiling?x=1", "", true},
+	}
+	for _, tt := range tests {
+		got, err := parsePathPrefix(tt.in)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parsePathPrefix(%q) = %q, %v, want %q, wantErr %v", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestStripPathPrefix(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/profile", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path))
+	})
+	handler := stripPathPrefix(mux, "/profiling")
+
+	tests := []struct {
+		path     string
+		wantCode int
+	}{
+		{"/profiling/debug/pprof/profile", http.StatusOK},
+		{"/debug/pprof/profile", http.StatusNotFound},
+		{"/profilingdebug/pprof/profile", http.StatusNotFound},
+		{"/profiling", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest("GET", tt.path, nil))
+		if rr.Code != tt.wantCode {
+			t.Errorf("GET %s: status %d, want %d", tt.path, rr.Code, tt.wantCode)
+		}
+		if rr.Code == http.StatusOK && rr.Body.String() != "/debug/pprof/profile" {
+			t.Errorf("GET %s: handler saw %q", tt.path, rr.Body.String())
+		}
+	}
+
+	if stripPathPrefix(mux, "") != http.Handler(mux) {
+		t.Error("stripPathPrefix() without a prefix wrapped the handler")
+	}
+}
+
+func TestCORSConfigValidate(t *testing.T) {
+	tests := []struct {
+		cfg     corsConfig
+		wantErr bool
+	}{
+		{corsConfig{}, false},
+		{corsConfig{AllowedOrigins: []string{"*"}}, false},
+		{corsConfig{AllowedOrigins: []string{"https://www.speedscope.app", "http://localhost:3000"}, AllowCredentials: true}, false},
+		{corsConfig{AllowedOrigins: []string{"*"}, AllowCredentials: true}, true},
+		{corsConfig{AllowedOrigins: []string{"www.speedscope.app"}}, true},
+		{corsConfig{AllowedOrigins: []string{"https://www.speedscope.app/"}}, true},
+		{corsConfig{MaxAge: duration(-time.Second)}, true},
+	}
+	for _, tt := range tests {
+		if err := tt.cfg.validate(); (err != nil) != tt.wantErr {
+			t.Errorf("validate(%+v) error = %v, wantErr %v", tt.cfg, err, tt.wantErr)
+		}
+	}
+}
+
+func TestCORS(t *testing.T) {
+	orig := state.Load()
+	t.Cleanup(func() { state.Store(orig) })
+	c := corsConfig{AllowedOrigins: []string{"https://www.speedscope.app"}, AllowCredentials: true}
+	if err := c.validate(); err != nil {
+		t.Fatal(err)
+	}
+	state.Store(&serverState{cfg: &config{CORS: c}})
+
+	// The handler stands in for authentication, which preflight requests
+	// must not reach
+	handler := cors(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") == "" {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte("profile"))
+	}))
+
+	tests := []struct {
+		name       string
+		method     string
+		origin     string
+		preflight  bool
+		auth       bool
+		wantCode   int
+		wantOrigin string
+	}{
+		{"no origin", "GET", "", false, true, http.StatusOK, ""},
+		{"allowed", "GET", "https://www.speedscope.app", false, true, http.StatusOK, "https://www.speedscope.app"},
+		{"other origin", "GET", "https://evil.example.com", false, true, http.StatusOK, ""},
+		{"preflight", "OPTIONS", "https://www.speedscope.app", true, false, http.StatusNoContent, "https://www.speedscope.app"},
+		{"preflight other origin", "OPTIONS", "https://evil.example.com", true, false, http.StatusForbidden, ""},
+		{"unauthenticated", "GET", "https://www.speedscope.app", false, false, http.StatusUnauthorized, "https://www.speedscope.app"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, "/debug/pprof/profile", nil)
+		if tt.origin != "" {
+			req.Header.Set("Origin", tt.origin)
+		}
+		if tt.preflight {
+			req.Header.Set("Access-Control-Request-Method", "GET")
+			req.Header.Set("Access-Control-Request-Headers", "authorization")
+		}
+		if tt.auth {
+			req.Header.Set("Authorization", "Basic YWRtaW46c2VjcmV0")
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != tt.wantCode {
+			t.Errorf("%s: status %d, want %d", tt.name, rr.Code, tt.wantCode)
+		}
+		if got := rr.Header().Get("Access-Control-Allow-Origin"); got != tt.wantOrigin {
+			t.Errorf("%s: Access-Control-Allow-Origin = %q, want %q", tt.name, got, tt.wantOrigin)
+		}
+		if tt.wantOrigin != "" && rr.Header().Get("Access-Control-Allow-Credentials") != "true" {
+			t.Errorf("%s: credentials not allowed", tt.name)
+		}
+	}
+
+	req := httptest.NewRequest("OPTIONS", "/debug/pprof/profile", nil)
+	req.Header.Set("Origin", "https://www.speedscope.app")
+	req.Header.Set("Access-Control-Request-Method", "GET")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if got := rr.Header().Get("Access-Control-Max-Age"); got != "600" {
+		t.Errorf("Access-Control-Max-Age = %q, want 600", got)
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/google/pprof/profile"
+)
+
+// defaultPprofSeconds is the capture duration of /debug/pprof/profile
+// without seconds, the default of Go's net/http/pprof
+const defaultPprofSeconds = 30
+
+// goRuntimeProfiles maps the Go runtime profiles that pull-mode collectors
+// such as Pyroscope and Grafana Alloy scrape by default to the
+// profiling_config block of pyroscope.scrape that turns them off
+var goRuntimeProfiles = map[string]string{
+	"allocs":       "memory",
+	"heap":         "memory",
+	"block":        "block",
+	"mutex":        "mutex",
+	"goroutine":    "goroutine",
+	"threadcreate": "",
+	"delta_heap":   "godeltaprof_memory",
+	"delta_block":  "godeltaprof_block",
+	"delta_mutex":  "godeltaprof_mutex",
+}
+
+// cpuTimeEvents are the perf events whose samples, taken at a frequency,
+// each stand for one sampling period of CPU time
+var cpuTimeEvents = []string{"", "cycles", "cpu-clock", "task-clock"}
+
+// handlePprofProfileType answers the other /debug/pprof/ paths: the
+// exporter only has CPU profiles, so collectors asking for the Go runtime
+// profiles get a 404 that says which setting stops them from asking
+func handlePprofProfileType(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("profile")
+	block, ok := goRuntimeProfiles[name]
+	switch {
+	case !ok:
+		http.Error(w, fmt.Sprintf("Unknown profile type %q: use /debug/pprof/profile for CPU profiles", name), http.StatusNotFound)
+	case block == "":
+		http.Error(w, fmt.Sprintf("%s is a Go runtime profile: only CPU profiles are served, at /debug/pprof/profile", name), http.StatusNotFound)
+	default:
+		http.Error(w, fmt.Sprintf("%s is a Go runtime profile: only CPU profiles are served, at /debug/pprof/profile; disable profile.%s in the scrape configuration", name, block), http.StatusNotFound)
+	}
+}
+
+// addCPUTime gives the perf profile in the pprof file at path the sample
+// types of setCPUTime
+func addCPUTime(path string, opts profileOptions) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	p, err := profile.Parse(f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	setCPUTime(p, opts, slices.Contains(cpuTimeEvents, opts.Event))
+
+	out, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	return p.Write(out)
+}
+
+// setCPUTime gives a captured profile the time and duration of the capture
+// and, when its samples were taken on CPU, the sample types of Go CPU
+// profiles, which Pyroscope and the pprof tools read as CPU time; samples of
+// a wall-clock capture count wall time instead. The capture is taken to have
+// ended just before the conversion.
+func setCPUTime(p *profile.Profile, opts profileOptions, onCPU bool) {
+	duration := time.Duration(opts.Duration) * time.Second
+	if p.TimeNanos == 0 {
+		p.TimeNanos = time.Now().Add(-duration).UnixNano()
+	}
+	if p.DurationNanos == 0 {
+		p.DurationNanos = int64(duration)
+	}
+	switch {
+	case opts.Mode == "wall":
+		timeProfile(p, "wall", opts.frequency())
+	case onCPU:
+		timeProfile(p, "cpu", opts.frequency())
+	}
+}
+
+// timeProfile sets the sample types of p to samples/count and timeType
+// ("cpu" or "wall") in nanoseconds, one sampling period at frequency Hz per
+// sample, dropping the event counts pprof's converter takes from perf.data.
+// The time is shown by default. Profiles that already have it are left
+// alone.
+func timeProfile(p *profile.Profile, timeType string, frequency int) {
+	for _, st := range p.SampleType {
+		if st.Type == timeType {
+			return
+		}
+	}
+	counts := 0
+	for i, st := range p.SampleType {
+		if st.Type == "samples" {
+			counts = i
+		}
+	}
+	period := int64(time.Second) / int64(frequency)
+	p.SampleType = []*profile.ValueType{{Type: "samples", Unit: "count"}, {Type: timeType, Unit: "nanoseconds"}}
+	p.DefaultSampleType = timeType
+	p.PeriodType = &profile.ValueType{Type: timeType, Unit: "nanoseconds"}
+	p.Period = period
+	for _, s := range p.Sample {
+		n := s.Value[counts]
+		s.Value = []int64{n, n * period}
+	}
+}
+
+// withDefaultSeconds sets the seconds of r to defaultPprofSeconds when it
+// has none, like Go's /debug/pprof/profile
+func withDefaultSeconds(r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("seconds") != "" {
+		return
+	}
+	q.Set("seconds", strconv.Itoa(defaultPprofSeconds))
+	r.URL.RawQuery = q.Encode()
+}
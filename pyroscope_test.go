@@ -0,0 +1,162 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/pprof/profile"
+)
+
+func TestPprofDefaultSeconds(t *testing.T) {
+	rr := httptest.NewRecorder()
+	handlePprof(rr, httptest.NewRequest("GET", "/debug/pprof/profile?pid=1234&test=true", nil))
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "duration 30 seconds") {
+		t.Errorf("pprof without seconds: %d %q", rr.Code, rr.Body.String())
+	}
+
+	rr = httptest.NewRecorder()
+	handleFolded(rr, httptest.NewRequest("GET", "/debug/folded/profile?pid=1234&test=true", nil))
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("folded without seconds: %d", rr.Code)
+	}
+}
+
+func TestAddCPUTime(t *testing.T) {
+	write := func(t *testing.T) string {
+		t.Helper()
+		p, err := parseFolded(strings.NewReader("main;aeMain;dictFind 3\nmain;aeMain 1\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(t.TempDir(), "profile.pb.gz")
+		f, err := os.Create(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		if err := p.Write(f); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	read := func(t *testing.T, path string) *profile.Profile {
+		t.Helper()
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		p, err := profile.Parse(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+
+	path := write(t)
+	if err := addCPUTime(path, profileOptions{Duration: 10, Frequency: 100}); err != nil {
+		t.Fatal(err)
+	}
+	p := read(t, path)
+	if len(p.SampleType) != 2 || p.SampleType[1].Type != "cpu" || p.SampleType[1].Unit != "nanoseconds" || p.DefaultSampleType != "cpu" {
+		t.Errorf("sample types = %v, default %q", p.SampleType, p.DefaultSampleType)
+	}
+	if p.PeriodType.Type != "cpu" || p.Period != int64(10*time.Millisecond) {
+		t.Errorf("period = %d %v", p.Period, p.PeriodType)
+	}
+	if p.DurationNanos != int64(10*time.Second) || time.Since(time.Unix(0, p.TimeNanos)) < 10*time.Second {
+		t.Errorf("time = %d, duration = %d", p.TimeNanos, p.DurationNanos)
+	}
+	for _, s := range p.Sample {
+		if s.Value[1] != s.Value[0]*int64(10*time.Millisecond) {
+			t.Errorf("sample values = %v", s.Value)
+		}
+	}
+
+	path = write(t)
+	if err := addCPUTime(path, profileOptions{Duration: 10, Event: "cache-misses"}); err != nil {
+		t.Fatal(err)
+	}
+	if p := read(t, path); len(p.SampleType) != 1 || p.DurationNanos != int64(10*time.Second) {
+		t.Errorf("cache-misses profile: sample types = %v, duration = %d", p.SampleType, p.DurationNanos)
+	}
+}
+
+func TestPprofProfileType(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/profile", handlePprof)
+	mux.HandleFunc("/debug/pprof/{profile}", handlePprofProfileType)
+	for path, want := range map[string]string{
+		"/debug/pprof/allocs":       "disable profile.memory",
+		"/debug/pprof/goroutine":    "disable profile.goroutine",
+		"/debug/pprof/threadcreate": "only CPU profiles are served",
+		"/debug/pprof/trace":        "Unknown profile type",
+	} {
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest("GET", path, nil))
+		if rr.Code != http.StatusNotFound || !strings.Contains(rr.Body.String(), want) {
+			t.Errorf("%s: %d %q", path, rr.Code, rr.Body.String())
+		}
+	}
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("GET", "/debug/pprof/profile?pid=1234&seconds=1&test=true", nil))
+	if rr.Code != http.StatusOK {
+		t.Errorf("/debug/pprof/profile: %d", rr.Code)
+	}
+}
+
+func TestCPUTimeProfile(t *testing.T) {
+	// pprof's converter keeps the event counts of perf.data next to the samples
+	p := &profile.Profile{
+		SampleType: []*profile.ValueType{{Type: "event", Unit: "count"}, {Type: "samples", Unit: "count"}},
+		Sample:     []*profile.Sample{{Value: []int64{2500000, 5}}, {Value: []int64{500000, 1}}},
+	}
+	timeProfile(p, "cpu", 999)
+	period := int64(time.Second) / 999
+	if len(p.SampleType) != 2 || p.SampleType[0].Type != "samples" || p.SampleType[1].Type != "cpu" || p.DefaultSampleType != "cpu" || p.Period != period {
+		t.Errorf("sample types = %v %v, default %q, period %d", p.SampleType[0], p.SampleType[1], p.DefaultSampleType, p.Period)
+	}
+	if v := p.Sample[0].Value; len(v) != 2 || v[0] != 5 || v[1] != 5*period {
+		t.Errorf("sample values = %v", v)
+	}
+
+	// Profiles with CPU time already are left alone
+	timeProfile(p, "cpu", 100)
+	if p.Period != period {
+		t.Errorf("period = %d after a second conversion", p.Period)
+	}
+}
+
+func TestFoldedCaptureSampleTypes(t *testing.T) {
+	for _, tt := range []struct {
+		backend string
+		event   string
+		mode    string
+		want    string
+	}{
+		{"bcc", "", "cpu", "cpu"},
+		{"py-spy", "", "cpu", "cpu"},
+		{"py-spy", "", "wall", "wall"},
+		{"async-profiler", "itimer", "cpu", "cpu"},
+		{"async-profiler", "alloc", "cpu", "samples"},
+		{"async-profiler", "cpu", "wall", "wall"},
+	} {
+		orig := asyncProfiler
+		asyncProfiler.Event = tt.event
+		rr := httptest.NewRecorder()
+		serveFoldedCapture(rr, profileOptions{PID: "42", Duration: 10, Mode: tt.mode}, "pprof", tt.backend, []byte("main;work 10\n"))
+		asyncProfiler = orig
+		p, err := profile.ParseData(rr.Body.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := p.SampleType[len(p.SampleType)-1].Type; got != tt.want || p.DurationNanos != int64(10*time.Second) {
+			t.Errorf("%s %s mode=%s: sample type %s, duration %d", tt.backend, tt.event, tt.mode, got, p.DurationNanos)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// pythonExeRe matches CPython interpreter binaries such as python3.11
+var pythonExeRe = regexp.MustCompile(`^python[0-9.]*$`)
+
+// libpythonRe matches the shared CPython library of embedded interpreters
+var libpythonRe = regexp.MustCompile(`/libpython[0-9.]+\.so[0-9.]*$`)
+
+// isPythonProcess reports whether pid runs a CPython interpreter, either as
+// a python binary or embedded through libpython (e.g. uWSGI)
+func isPythonProcess(pid int) bool {
+	exe, err := os.Readlink(filepath.Join(procRoot, strconv.Itoa(pid), "exe"))
+	if err == nil && pythonExeRe.MatchString(filepath.Base(exe)) {
+		return true
+	}
+	return mapsLibrary(pid, libpythonRe)
+}
+
+// pySpyInstalled reports whether py-spy is in PATH
+func pySpyInstalled() bool {
+	_, err := exec.LookPath("py-spy")
+	return err == nil
+}
+
+// pySpySupports returns why opts cannot be captured by py-spy, or nil when
+// they can
+func pySpySupports(opts profileOptions) error {
+	switch {
+	case opts.Output != "" && opts.Output != "speedscope" && opts.Output != "flamegraph":
+		return fmt.Errorf("format=%s is not supported", opts.Output)
+	case opts.TID != "", opts.ThreadLabels:
+		return fmt.Errorf("tid and thread_labels need perf")
+	case opts.Snapshots > 1, opts.RedisMetadata:
+		return fmt.Errorf("snapshots and redis_metadata need perf")
+	case opts.Stacks == "kernel":
+		return fmt.Errorf("stacks=kernel needs perf")
+	case opts.Event != "":
+		return fmt.Errorf("event needs perf")
+	}
+	return nil
+}
+
+// pySpyArgs builds the py-spy record command line writing pyFormat to outputPath
+func pySpyArgs(opts profileOptions, pyFormat, outputPath string) []string {
+	args := []string{"py-spy", "record",
+		"--pid", opts.PID,
+		"--duration", strconv.Itoa(opts.Duration),
+		"--rate", strconv.Itoa(opts.frequency()),
+		"--format", pyFormat,
+		"--output", outputPath,
+		// Sample without pausing the interpreter, as perf and BCC do
+		"--nonblocking",
+	}
+	if opts.Children {
+		args = append(args, "--subprocesses")
+	}
+	// Include threads waiting on locks or I/O
+	if opts.Mode == "wall" {
+		args = append(args, "--idle")
+	}
+	return args
+}
+
+// capturePySpy runs py-spy for opts inside dir and returns its output in pyFormat
+func capturePySpy(opts profileOptions, dir, pyFormat string) ([]byte, error) {
+	outputPath := filepath.Join(dir, "py-spy.out")
+	args := pySpyArgs(opts, pyFormat, outputPath)
+
+	cmd := privilegedCommand(context.Background(), args...)
+	log.Printf("Running command: %s", strings.Join(cmd.Args, " "))
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := runJob(cmd, captureTimeout(opts.Duration)); err != nil {
+		if _, ok := err.(*captureError); ok {
+			return nil, err
+		}
+		return nil, &captureError{http.StatusInternalServerError, fmt.Sprintf("py-spy failed: %v\nStderr: %s", err, stderr.String())}
+	}
+	return readOutputFile("py-spy output", outputPath)
+}
+
+// runPySpyProfile serves a py-spy capture of opts: speedscope JSON or a
+// flamegraph SVG when requested with format, otherwise collapsed stacks or
+// pprof depending on the endpoint
+func runPySpyProfile(w http.ResponseWriter, opts profileOptions, format string) {
+	tempDir, err := newCaptureDir()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to create temp directory: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer os.RemoveAll(tempDir)
+
+	pyFormat := "raw"
+	if opts.Output != "" {
+		pyFormat = opts.Output
+	}
+	data, err := capturePySpy(opts, tempDir, pyFormat)
+	if err != nil {
+		writeCaptureError(w, err)
+		return
+	}
+
+	switch opts.Output {
+	case "speedscope":
+		storeCapture(w, captureMeta(opts, "speedscope"), bytes.NewReader(data))
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=profile-%s-%d%s", opts.PID, opts.Duration, profileExtension("speedscope")))
+		w.Write(data)
+	case "flamegraph":
+		storeCapture(w, captureMeta(opts, "flamegraph"), bytes.NewReader(data))
+		w.Header().Set("Content-Type", "image/svg+xml")
+		w.Write(data)
+	default:
+		serveFoldedCapture(w, opts, format, "py-spy", data)
+	}
+	log.Printf("Successfully served py-spy profile for PID %s", opts.PID)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestIsPythonProcess(t *testing.T) {
+	writeFakeProc(t, map[int]int{42: 1, 43: 1, 44: 1, 45: 1})
+	exes := map[string]string{
+		"42": "/usr/bin/python3.11",
+		"43": "/opt/venv/bin/python",
+		"44": "/usr/bin/python-config",
+		"45": "/usr/bin/redis-server",
+	}
+	for pid, exe := range exes {
+		if err := os.Symlink(exe, filepath.Join(procRoot, pid, "exe")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		pid  int
+		want bool
+	}{
+		{42, true},
+		{43, true},
+		{44, false},
+		{45, false},
+		{999, false},
+	}
+	for _, tt := range tests {
+		if got := isPythonProcess(tt.pid); got != tt.want {
+			t.Errorf("isPythonProcess(%d) = %v, want %v", tt.pid, got, tt.want)
+		}
+	}
+}
+
+func TestPySpyArgs(t *testing.T) {
+	opts := profileOptions{PID: "42", Duration: 10, Children: true}
+	got := pySpyArgs(opts, "speedscope", "/tmp/x/py-spy.out")
+	want := []string{"py-spy", "record", "--pid", "42", "--duration", "10", "--rate", "999",
+		"--format", "speedscope", "--output", "/tmp/x/py-spy.out", "--nonblocking", "--subprocesses"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("pySpyArgs = %q, want %q", got, want)
+	}
+}
+
+func TestPySpySupports(t *testing.T) {
+	tests := []struct {
+		name string
+		opts profileOptions
+		ok   bool
+	}{
+		{"defaults", profileOptions{Stacks: "both", Snapshots: 1}, true},
+		{"speedscope", profileOptions{Stacks: "both", Snapshots: 1, Output: "speedscope"}, true},
+		{"children", profileOptions{Stacks: "user", Snapshots: 1, Children: true}, true},
+		{"perfdata", profileOptions{Stacks: "both", Snapshots: 1, Output: "perfdata"}, false},
+		{"tid", profileOptions{Stacks: "both", Snapshots: 1, TID: "43"}, false},
+		{"kernel stacks", profileOptions{Stacks: "kernel", Snapshots: 1}, false},
+		{"series", profileOptions{Stacks: "both", Snapshots: 3}, false},
+	}
+	for _, tt := range tests {
+		if err := pySpySupports(tt.opts); (err == nil) != tt.ok {
+			t.Errorf("%s: pySpySupports = %v, want ok %v", tt.name, err, tt.ok)
+		}
+	}
+}
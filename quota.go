@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"expvar"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// evictedProfiles counts the profiles removed to keep the store within its
+// quota
+var evictedProfiles atomic.Int64
+
+func init() {
+	expvar.Publish("profiles_evicted", expvar.Func(func() interface{} { return evictedProfiles.Load() }))
+}
+
+// quotaConfig is the quota section of the configuration file, which caps
+// the size of the profile store
+type quotaConfig struct {
+	// MaxSize caps the total size of the stored profiles (default no cap)
+	MaxSize byteSize `json:"max_size"`
+	// MaxPerTarget caps the size of the stored profiles of each target,
+	// as named by quotaTarget (default no cap)
+	MaxPerTarget byteSize `json:"max_per_target"`
+}
+
+func (c *quotaConfig) validate() error {
+	if c.MaxSize < 0 || c.MaxPerTarget < 0 {
+		return fmt.Errorf("sizes must not be negative")
+	}
+	return nil
+}
+
+// currentQuota returns the quota in effect; none before the server state
+// is set up
+func currentQuota() quotaConfig {
+	if s := state.Load(); s != nil {
+		return s.cfg.Quota
+	}
+	return quotaConfig{}
+}
+
+// quotaTarget names the target max_per_target applies to: the command name
+// of the profiled process, or its PID when the name is unknown
+func quotaTarget(meta profileMeta) string {
+	if meta.Comm != "" {
+		return meta.Comm
+	}
+	return "pid:" + meta.PID
+}
+
+// evictMu keeps concurrent saves from evicting the same profiles
+var evictMu sync.Mutex
+
+// enforceQuota deletes the oldest unpinned profiles until the store is
+// within q, keeping the profile keep that was just saved
+func (s *profileStore) enforceQuota(q quotaConfig, keep string) error {
+	if q.MaxSize == 0 && q.MaxPerTarget == 0 {
+		return nil
+	}
+	evictMu.Lock()
+	defer evictMu.Unlock()
+
+	metas, err := s.List()
+	if err != nil {
+		return err
+	}
+	var total int64
+	perTarget := make(map[string]int64)
+	for _, meta := range metas {
+		total += meta.Size
+		perTarget[quotaTarget(meta)] += meta.Size
+	}
+
+	// List orders the profiles newest first
+	for i := len(metas) - 1; i >= 0; i-- {
+		meta, target := metas[i], quotaTarget(metas[i])
+		overTotal := q.MaxSize > 0 && total > int64(q.MaxSize)
+		overTarget := q.MaxPerTarget > 0 && perTarget[target] > int64(q.MaxPerTarget)
+		if !overTotal && !overTarget || meta.Pinned || meta.ID == keep {
+			continue
+		}
+		if err := s.Delete(meta.ID); err != nil {
+			return fmt.Errorf("evicting profile %s: %v", meta.ID, err)
+		}
+		total -= meta.Size
+		perTarget[target] -= meta.Size
+		evictedProfiles.Add(1)
+		log.Printf("Evicted %s profile %s of %s (%s, %s) to stay within the store quota",
+			meta.Format, meta.ID, target, formatSize(meta.Size), meta.CreatedAt.Format(time.RFC3339))
+	}
+	if q.MaxSize > 0 && total > int64(q.MaxSize) {
+		log.Printf("Profile store holds %s, over quota.max_size (%s): the remaining profiles are pinned",
+			formatSize(total), formatSize(int64(q.MaxSize)))
+	}
+	return nil
+}
+
+// pinnedName returns the name of the marker object of a pinned profile
+func pinnedName(id string) string {
+	return id + ".pinned"
+}
+
+// Pin keeps profile id from being evicted, or lets it be evicted again
+func (s *profileStore) Pin(id string, pinned bool) error {
+	if _, err := s.Get(id); err != nil {
+		return err
+	}
+	// The metadata is never rewritten, as List caches it: a marker object
+	// records the pin instead
+	if !pinned {
+		return s.storage.Delete(pinnedName(id))
+	}
+	return s.storage.Put(pinnedName(id), bytes.NewReader(nil), 0)
+}
+
+// handlePinProfile pins a stored profile with PUT and unpins it with DELETE
+func handlePinProfile(w http.ResponseWriter, r *http.Request) {
+	if !requireStore(w) {
+		return
+	}
+
+	pinned := r.Method == http.MethodPut
+	err := store.Pin(r.PathValue("id"), pinned)
+	if err == errProfileNotFound {
+		http.Error(w, "Profile not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to update profile: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if pinned {
+		log.Printf("Pinned profile %s", r.PathValue("id"))
+	} else {
+		log.Printf("Unpinned profile %s", r.PathValue("id"))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQuotaConfigValidate(t *testing.T) {
+	cfg := quotaConfig{MaxSize: 10 << 30, MaxPerTarget: 1 << 30}
+	if err := cfg.validate(); err != nil {
+		t.Errorf("valid quota: %v", err)
+	}
+	cfg.MaxPerTarget = -1
+	if err := cfg.validate(); err == nil {
+		t.Error("negative max_per_target accepted")
+	}
+}
+
+func TestEnforceQuota(t *testing.T) {
+	s := withTestStore(t)
+	created := time.Now().UTC().Add(-time.Hour)
+	save := func(comm string, i int) profileMeta {
+		t.Helper()
+		meta, err := s.Save(profileMeta{Format: "folded", PID: "42", Comm: comm, CreatedAt: created.Add(time.Duration(i) * time.Minute)},
+			strings.NewReader(strings.Repeat("x", 100)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return meta
+	}
+	var server, sentinel []profileMeta
+	for i := 0; i < 4; i++ {
+		server = append(server, save("redis-server", i))
+		sentinel = append(sentinel, save("redis-sentinel", i))
+	}
+	if err := s.Pin(server[0].ID, true); err != nil {
+		t.Fatal(err)
+	}
+
+	stored := func() map[string]bool {
+		t.Helper()
+		metas, err := s.List()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids := make(map[string]bool)
+		for _, meta := range metas {
+			ids[meta.ID] = true
+			if meta.Pinned != (meta.ID == server[0].ID) {
+				t.Errorf("profile %s pinned = %v", meta.ID, meta.Pinned)
+			}
+		}
+		return ids
+	}
+
+	// Two profiles per target fit: the oldest unpinned ones go
+	if err := s.enforceQuota(quotaConfig{MaxPerTarget: 200}, ""); err != nil {
+		t.Fatal(err)
+	}
+	ids := stored()
+	for id, want := range map[string]bool{
+		server[0].ID: true, server[1].ID: false, server[2].ID: false, server[3].ID: true,
+		sentinel[0].ID: false, sentinel[1].ID: false, sentinel[2].ID: true, sentinel[3].ID: true,
+	} {
+		if ids[id] != want {
+			t.Errorf("per target: profile %s stored = %v, want %v", id, ids[id], want)
+		}
+	}
+
+	// The profile just saved stays even when it alone is over the quota
+	if err := s.enforceQuota(quotaConfig{MaxSize: 150}, sentinel[2].ID); err != nil {
+		t.Fatal(err)
+	}
+	ids = stored()
+	if len(ids) != 2 || !ids[server[0].ID] || !ids[sentinel[2].ID] {
+		t.Errorf("total: stored %v, want the pinned and the kept profile", ids)
+	}
+	if evictedProfiles.Load() < 6 {
+		t.Errorf("profiles_evicted = %d", evictedProfiles.Load())
+	}
+}
+
+func TestSaveEnforcesQuota(t *testing.T) {
+	s := withTestStore(t)
+	orig := state.Load()
+	t.Cleanup(func() { state.Store(orig) })
+	state.Store(&serverState{cfg: &config{Quota: quotaConfig{MaxSize: 250}}})
+
+	created := time.Now().UTC().Add(-time.Hour)
+	var last profileMeta
+	for i := 0; i < 5; i++ {
+		meta, err := s.Save(profileMeta{Format: "folded", PID: "42", CreatedAt: created.Add(time.Duration(i) * time.Minute)},
+			strings.NewReader(strings.Repeat("x", 100)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		last = meta
+	}
+	metas, err := s.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(metas) != 2 || metas[0].ID != last.ID {
+		t.Errorf("stored %+v, want the 2 newest profiles", metas)
+	}
+}
+
+func TestPinProfile(t *testing.T) {
+	s := withTestStore(t)
+	meta, err := s.Save(profileMeta{Format: "folded", PID: "42"}, strings.NewReader("a;b 1\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		method, id string
+		status     int
+		pinned     bool
+	}{
+		{"PUT", meta.ID, http.StatusNoContent, true},
+		{"PUT", meta.ID, http.StatusNoContent, true},
+		{"DELETE", meta.ID, http.StatusNoContent, false},
+		{"DELETE", meta.ID, http.StatusNoContent, false},
+		{"PUT", "0123456789abcdef", http.StatusNotFound, false},
+		{"PUT", "../etc", http.StatusNotFound, false},
+	} {
+		req := httptest.NewRequest(tc.method, "/api/v1/profiles/"+tc.id+"/pin", nil)
+		req.SetPathValue("id", tc.id)
+		rr := httptest.NewRecorder()
+		handlePinProfile(rr, req)
+		if rr.Code != tc.status {
+			t.Errorf("%s %s: %d %s", tc.method, tc.id, rr.Code, rr.Body.String())
+		}
+		metas, _ := s.List()
+		if len(metas) != 1 || metas[0].Pinned != tc.pinned {
+			t.Errorf("after %s %s: %+v", tc.method, tc.id, metas)
+		}
+	}
+
+	// Deleting a pinned profile removes its marker too
+	if err := s.Pin(meta.ID, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete(meta.ID); err != nil {
+		t.Fatal(err)
+	}
+	if names, _ := s.storage.List(""); len(names) != 0 {
+		t.Errorf("objects left after delete: %v", names)
+	}
+}
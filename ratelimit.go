@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// rateLimitConfig is the rate_limit section of the configuration file, which
+// bounds how often each client may start captures
+type rateLimitConfig struct {
+	// RequestsPerMinute is the sustained rate; rate limiting is off when 0
+	RequestsPerMinute float64 `json:"requests_per_minute"`
+	// Burst is how many requests a client may make at once (default 1)
+	Burst int `json:"burst"`
+	// Key identifies clients by "ip" (default) or by the "user" they
+	// authenticated as, falling back to the IP for anonymous requests
+	Key string `json:"key"`
+}
+
+func (c *rateLimitConfig) validate() error {
+	if c.RequestsPerMinute < 0 {
+		return fmt.Errorf("requests_per_minute must not be negative")
+	}
+	if c.Burst == 0 {
+		c.Burst = 1
+	}
+	if c.Burst < 0 {
+		return fmt.Errorf("burst must be positive")
+	}
+	switch c.Key {
+	case "":
+		c.Key = "ip"
+	case "ip", "user":
+	default:
+		return fmt.Errorf("key must be ip or user")
+	}
+	return nil
+}
+
+// tokenBucket holds the tokens left to one client
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter is a token bucket per client
+type rateLimiter struct {
+	cfg     rateLimitConfig
+	now     func() time.Time
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	pruned  time.Time
+}
+
+// newRateLimiter returns a limiter for cfg, or nil when rate limiting is off
+func newRateLimiter(cfg rateLimitConfig) *rateLimiter {
+	if cfg.RequestsPerMinute == 0 {
+		return nil
+	}
+	return &rateLimiter{cfg: cfg, now: time.Now, buckets: make(map[string]*tokenBucket)}
+}
+
+// refill adds the tokens earned since the bucket was last used
+func (l *rateLimiter) refill(b *tokenBucket, now time.Time) {
+	rate := l.cfg.RequestsPerMinute / 60
+	b.tokens = math.Min(float64(l.cfg.Burst), b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+}
+
+// allow takes a token from the bucket of key; when it is empty, it returns
+// how long until the next token
+func (l *rateLimiter) allow(key string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.prune(now)
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: float64(l.cfg.Burst), last: now}
+		l.buckets[key] = b
+	}
+	l.refill(b, now)
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	wait := (1 - b.tokens) / (l.cfg.RequestsPerMinute / 60)
+	return false, time.Duration(wait * float64(time.Second))
+}
+
+// inherit carries the buckets of prev over to l, so changing the rate limit
+// does not give every client a full burst again; tokens are capped at the
+// burst of l
+func (l *rateLimiter) inherit(prev *rateLimiter) {
+	if l == nil || prev == nil {
+		return
+	}
+	prev.mu.Lock()
+	defer prev.mu.Unlock()
+	now := l.now()
+	for key, b := range prev.buckets {
+		prev.refill(b, now)
+		l.buckets[key] = &tokenBucket{tokens: math.Min(b.tokens, float64(l.cfg.Burst)), last: now}
+	}
+}
+
+// prune forgets clients whose buckets have refilled, once a minute, so the
+// map does not grow with every address that ever connected
+func (l *rateLimiter) prune(now time.Time) {
+	if now.Sub(l.pruned) < time.Minute {
+		return
+	}
+	l.pruned = now
+	for key, b := range l.buckets {
+		l.refill(b, now)
+		if b.tokens >= float64(l.cfg.Burst) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// clientKey identifies the client of r for rate limiting
+func (l *rateLimiter) clientKey(r *http.Request) string {
+	if l.cfg.Key == "user" {
+		if name := clientName(r); name != "" {
+			return "user:" + name
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// wrap rejects requests of clients that exceeded their rate with 429
+func (l *rateLimiter) wrap(handler http.HandlerFunc) http.HandlerFunc {
+	if l == nil {
+		return handler
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := l.clientKey(r)
+		if ok, wait := l.allow(key); !ok {
+			seconds := int(math.Ceil(wait.Seconds()))
+			log.Printf("Rate limited %s on %s", key, r.URL.Path)
+			w.Header().Set("Retry-After", strconv.Itoa(seconds))
+			http.Error(w, fmt.Sprintf("Too many requests, retry in %d seconds", seconds), http.StatusTooManyRequests)
+			return
+		}
+		handler(w, r)
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateLimitConfigValidate(t *testing.T) {
+	tests := []struct {
+		cfg     rateLimitConfig
+		wantErr bool
+	}{
+		{rateLimitConfig{}, false},
+		{rateLimitConfig{RequestsPerMinute: 6, Burst: 3, Key: "user"}, false},
+		{rateLimitConfig{RequestsPerMinute: -1}, true},
+		{rateLimitConfig{RequestsPerMinute: 6, Burst: -1}, true},
+		{rateLimitConfig{RequestsPerMinute: 6, Key: "header"}, true},
+	}
+	for _, tt := range tests {
+		if err := tt.cfg.validate(); (err != nil) != tt.wantErr {
+			t.Errorf("validate(%+v) error = %v, wantErr %v", tt.cfg, err, tt.wantErr)
+		}
+	}
+
+	if newRateLimiter(rateLimitConfig{}) != nil {
+		t.Error("newRateLimiter returned a limiter with rate limiting off")
+	}
+}
+
+func TestRateLimiterAllow(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	l := newRateLimiter(rateLimitConfig{RequestsPerMinute: 6, Burst: 2, Key: "ip"})
+	l.now = func() time.Time { return now }
+
+	// The burst is available at once, then one token every 10 seconds
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.allow("a"); !ok {
+			t.Fatalf("request %d within the burst was limited", i+1)
+		}
+	}
+	ok, wait := l.allow("a")
+	if ok || wait != 10*time.Second {
+		t.Errorf("allow() after the burst = %v, %v; want false, 10s", ok, wait)
+	}
+	if ok, _ := l.allow("b"); !ok {
+		t.Error("another client was limited")
+	}
+
+	now = now.Add(4 * time.Second)
+	if ok, wait := l.allow("a"); ok || wait.Round(time.Millisecond) != 6*time.Second {
+		t.Errorf("allow() after 4s = %v, %v; want false, 6s", ok, wait)
+	}
+	now = now.Add(6 * time.Second)
+	if ok, _ := l.allow("a"); !ok {
+		t.Error("allow() after 10s was limited")
+	}
+
+	// Idle clients are forgotten once their buckets are full again
+	now = now.Add(time.Hour)
+	l.allow("c")
+	if len(l.buckets) != 1 {
+		t.Errorf("%d buckets after pruning, want 1", len(l.buckets))
+	}
+}
+
+func TestRateLimiterInherit(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	prev := newRateLimiter(rateLimitConfig{RequestsPerMinute: 6, Burst: 3, Key: "ip"})
+	prev.now = func() time.Time { return now }
+	for i := 0; i < 3; i++ {
+		prev.allow("a")
+	}
+	prev.allow("b")
+
+	// A higher rate and burst do not refill the buckets of the old one
+	l := newRateLimiter(rateLimitConfig{RequestsPerMinute: 60, Burst: 10, Key: "ip"})
+	l.now = prev.now
+	l.inherit(prev)
+	if ok, _ := l.allow("a"); ok {
+		t.Error("client out of tokens was allowed after the change")
+	}
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.allow("b"); !ok {
+			t.Errorf("request %d of the tokens left was limited", i+1)
+		}
+	}
+	if ok, _ := l.allow("b"); ok {
+		t.Error("client was allowed more than the tokens it had left")
+	}
+
+	// A lower burst caps the tokens left
+	l = newRateLimiter(rateLimitConfig{RequestsPerMinute: 6, Burst: 1, Key: "ip"})
+	l.now = prev.now
+	l.inherit(prev)
+	if ok, _ := l.allow("b"); !ok {
+		t.Error("client with tokens left was limited")
+	}
+	if ok, _ := l.allow("b"); ok {
+		t.Error("tokens were not capped at the new burst")
+	}
+}
+
+func TestRateLimiterWrap(t *testing.T) {
+	l := newRateLimiter(rateLimitConfig{RequestsPerMinute: 1, Burst: 1, Key: "user"})
+	limited := l.wrap(func(w http.ResponseWriter, r *http.Request) {})
+	// Clients are named by authentication, which runs first
+	authenticated := requireAuth(limited, func(user, pass string) bool { return pass == "secret" }, nil)
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		if _, _, ok := r.BasicAuth(); ok {
+			authenticated(w, r)
+		} else {
+			limited(w, r)
+		}
+	}
+
+	request := func(remote, user string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/debug/pprof/profile", nil)
+		req.RemoteAddr = remote
+		if user != "" {
+			req.SetBasicAuth(user, "secret")
+		}
+		rr := httptest.NewRecorder()
+		handler(rr, req)
+		return rr
+	}
+
+	tests := []struct {
+		remote, user string
+		wantStatus   int
+	}{
+		{"10.0.0.1:40000", "alice", http.StatusOK},
+		{"10.0.0.2:40000", "alice", http.StatusTooManyRequests}, // same user, other address
+		{"10.0.0.1:40001", "bob", http.StatusOK},
+		{"10.0.0.1:40002", "", http.StatusOK}, // anonymous requests fall back to the IP
+		{"10.0.0.1:40003", "", http.StatusTooManyRequests},
+	}
+	for _, tt := range tests {
+		rr := request(tt.remote, tt.user)
+		if rr.Code != tt.wantStatus {
+			t.Errorf("%s as %q: status = %d, want %d", tt.remote, tt.user, rr.Code, tt.wantStatus)
+		}
+		if rr.Code == http.StatusTooManyRequests && rr.Header().Get("Retry-After") != "60" {
+			t.Errorf("Retry-After = %q, want 60", rr.Header().Get("Retry-After"))
+		}
+	}
+
+	var disabled *rateLimiter
+	if disabled.wrap(limited) == nil {
+		t.Error("wrap on a nil limiter returned nil")
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// reapInterval is how often the reaper looks for sessions of exporters
+// that are gone
+const reapInterval = 10 * time.Minute
+
+// processID identifies a process across PID reuse by its start time, in
+// clock ticks since boot
+type processID struct {
+	PID   int    `json:"pid"`
+	Start uint64 `json:"start"`
+}
+
+func (p processID) String() string {
+	return fmt.Sprintf("%d.%d", p.PID, p.Start)
+}
+
+// parseProcessID parses the form written by processID.String
+func parseProcessID(s string) (processID, bool) {
+	pid, start, ok := strings.Cut(s, ".")
+	if !ok {
+		return processID{}, false
+	}
+	p, err1 := strconv.Atoi(pid)
+	st, err2 := strconv.ParseUint(start, 10, 64)
+	return processID{p, st}, err1 == nil && err2 == nil
+}
+
+// readStartTime returns the start time of pid from /proc/<pid>/stat
+func readStartTime(pid int) (uint64, error) {
+	fields, err := readStatFields(pid)
+	if err != nil {
+		return 0, err
+	}
+	// starttime is field 22 in proc(5)
+	if len(fields) < 20 {
+		return 0, fmt.Errorf("malformed stat for PID %d", pid)
+	}
+	return strconv.ParseUint(fields[19], 10, 64)
+}
+
+// lookupProcess returns the processID of the running process pid
+func lookupProcess(pid int) (processID, error) {
+	start, err := readStartTime(pid)
+	return processID{pid, start}, err
+}
+
+// alive reports whether p is still running, and not a later process that
+// reused its PID
+func (p processID) alive() bool {
+	start, err := readStartTime(p.PID)
+	return err == nil && start == p.Start
+}
+
+// sessionEntry is a profiler process recorded in a sessions file
+type sessionEntry struct {
+	Process processID `json:"process"`
+	Command string    `json:"command"`
+}
+
+// sessionTracker records the profilers the exporter runs in a sessions
+// file, so a later exporter can find and kill them if this one crashes
+type sessionTracker struct {
+	mu      sync.Mutex
+	path    string
+	running map[int]sessionEntry
+}
+
+// sessions tracks the exporter's profilers; nil until main sets it up,
+// in which case profilers run untracked
+var sessions *sessionTracker
+
+// instanceID identifies this exporter in the names of its sessions file
+// and capture directories; zero until main sets it up
+var instanceID processID
+
+// instancePrefix is the name prefix of the exporter's temporary
+// directories, which tells the reaper whose they are
+func instancePrefix() string {
+	if instanceID == (processID{}) {
+		return "bcc-exporter-"
+	}
+	return fmt.Sprintf("bcc-exporter-%s-", instanceID)
+}
+
+// sessionsFile returns the sessions file of the exporter instance in dir
+func sessionsFile(dir string, instance processID) string {
+	return filepath.Join(dir, fmt.Sprintf("bcc-exporter-%s.sessions", instance))
+}
+
+func newSessionTracker(path string) *sessionTracker {
+	return &sessionTracker{path: path, running: make(map[int]sessionEntry)}
+}
+
+// save rewrites the sessions file; callers hold t.mu
+func (t *sessionTracker) save() {
+	entries := make([]sessionEntry, 0, len(t.running))
+	for _, e := range t.running {
+		entries = append(entries, e)
+	}
+	data, err := json.Marshal(entries)
+	if err == nil {
+		tmp := t.path + ".tmp"
+		if err = os.WriteFile(tmp, data, 0600); err == nil {
+			err = os.Rename(tmp, t.path)
+		}
+	}
+	if err != nil {
+		log.Printf("Failed to update sessions file %s: %v", t.path, err)
+	}
+}
+
+// track records the running cmd in the sessions file until the returned
+// function is called
+func (t *sessionTracker) track(cmd *exec.Cmd) (untrack func()) {
+	if t == nil {
+		return func() {}
+	}
+	pid := cmd.Process.Pid
+	p, err := lookupProcess(pid)
+	if err != nil {
+		return func() {}
+	}
+	t.mu.Lock()
+	t.running[pid] = sessionEntry{Process: p, Command: strings.Join(cmd.Args, " ")}
+	t.save()
+	t.mu.Unlock()
+	return func() {
+		t.mu.Lock()
+		delete(t.running, pid)
+		t.save()
+		t.mu.Unlock()
+	}
+}
+
+// killTree kills pid and its descendants, descendants first since sudo and
+// the like do not pass SIGKILL on
+func killTree(pid int) {
+	children, _ := findDescendants(pid)
+	for _, p := range append(children, pid) {
+		err := syscall.Kill(p, syscall.SIGKILL)
+		if err == syscall.EPERM && escalationMethod() != "none" {
+			err = privilegedCommand(context.Background(), "kill", "-KILL", strconv.Itoa(p)).Run()
+		}
+		if err != nil && err != syscall.ESRCH {
+			log.Printf("Failed to kill PID %d: %v", p, err)
+		}
+	}
+}
+
+// isMountPoint reports whether dir is mounted on, i.e. on another device
+// than its parent
+func isMountPoint(dir string) bool {
+	var st, parent syscall.Stat_t
+	if syscall.Stat(dir, &st) != nil || syscall.Stat(filepath.Dir(dir), &parent) != nil {
+		return false
+	}
+	return st.Dev != parent.Dev
+}
+
+// reapOrphans kills the profilers and removes the capture directories and
+// scratch tmpfs mounts that exporters no longer running left in dir
+func reapOrphans(dir string) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		log.Printf("Failed to look for orphaned sessions in %s: %v", dir, err)
+		return
+	}
+	for _, entry := range entries {
+		rest, ok := strings.CutPrefix(entry.Name(), "bcc-exporter-")
+		if !ok {
+			continue
+		}
+		tag, _, _ := strings.Cut(strings.TrimSuffix(rest, ".sessions"), "-")
+		owner, ok := parseProcessID(tag)
+		if !ok || owner.alive() {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+
+		if strings.HasSuffix(entry.Name(), ".sessions") {
+			reapSessions(path, owner)
+			continue
+		}
+		if isMountPoint(path) {
+			if err := syscall.Unmount(path, syscall.MNT_DETACH); err != nil {
+				log.Printf("Failed to unmount orphaned scratch tmpfs %s: %v", path, err)
+				continue
+			}
+		}
+		log.Printf("Removing %s left by exporter PID %d", path, owner.PID)
+		if err := os.RemoveAll(path); err != nil {
+			log.Printf("Failed to remove %s: %v", path, err)
+		}
+	}
+}
+
+// reapSessions kills the profilers recorded in the sessions file at path,
+// which exporter owner left behind, and removes the file
+func reapSessions(path string, owner processID) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		log.Printf("Failed to read sessions file %s: %v", path, err)
+		return
+	}
+	var entries []sessionEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		log.Printf("Ignoring malformed sessions file %s: %v", path, err)
+	}
+	for _, e := range entries {
+		if !e.Process.alive() {
+			continue
+		}
+		log.Printf("Killing PID %d (%s), left running by exporter PID %d", e.Process.PID, e.Command, owner.PID)
+		killTree(e.Process.PID)
+	}
+	os.Remove(path)
+}
+
+// runReaper reaps orphans in dir every reapInterval until stop is closed
+func runReaper(dir string, stop <-chan struct{}) {
+	ticker := time.NewTicker(reapInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			reapOrphans(dir)
+		case <-stop:
+			return
+		}
+	}
+}
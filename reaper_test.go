@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestParseProcessID(t *testing.T) {
+	tests := []struct {
+		in     string
+		want   processID
+		wantOK bool
+	}{
+		{"1234.5678", processID{1234, 5678}, true},
+		{"scratch", processID{}, false},
+		{"123456789", processID{}, false},
+		{"12.x", processID{}, false},
+	}
+	for _, tt := range tests {
+		got, ok := parseProcessID(tt.in)
+		if ok != tt.wantOK || (ok && got != tt.want) {
+			t.Errorf("parseProcessID(%q) = %v, %v, want %v, %v", tt.in, got, ok, tt.want, tt.wantOK)
+		}
+	}
+	if s := (processID{1234, 5678}).String(); s != "1234.5678" {
+		t.Errorf("String() = %q", s)
+	}
+}
+
+func TestSessionTrackerTrack(t *testing.T) {
+	dir := t.TempDir()
+	tracker := newSessionTracker(filepath.Join(dir, "test.sessions"))
+
+	cmd := exec.Command("sleep", "60")
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Process.Kill()
+	untrack := tracker.track(cmd)
+
+	var entries []sessionEntry
+	data, _ := os.ReadFile(tracker.path)
+	json.Unmarshal(data, &entries)
+	if len(entries) != 1 || entries[0].Command != "sleep 60" || !entries[0].Process.alive() {
+		t.Errorf("sessions file while running = %s", data)
+	}
+
+	untrack()
+	data, _ = os.ReadFile(tracker.path)
+	if string(data) != "[]" {
+		t.Errorf("sessions file after exit = %s, want []", data)
+	}
+}
+
+func TestReapOrphans(t *testing.T) {
+	dir := t.TempDir()
+	self, err := lookupProcess(os.Getpid())
+	if err != nil {
+		t.Skipf("no proc filesystem: %v", err)
+	}
+	// An exporter that is gone: our PID with another start time
+	gone := processID{self.PID, self.Start + 1}
+
+	orphan := exec.Command("sleep", "60")
+	if err := orphan.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer orphan.Process.Kill()
+	orphanID, err := lookupProcess(orphan.Process.Pid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := json.Marshal([]sessionEntry{{Process: orphanID, Command: "sleep 60"}})
+	os.WriteFile(sessionsFile(dir, gone), data, 0600)
+
+	// A profiler of a live exporter is left alone
+	running := exec.Command("sleep", "60")
+	if err := running.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer running.Process.Kill()
+	runningID, _ := lookupProcess(running.Process.Pid)
+	data, _ = json.Marshal([]sessionEntry{{Process: runningID, Command: "sleep 60"}})
+	os.WriteFile(sessionsFile(dir, self), data, 0600)
+
+	for _, name := range []string{"bcc-exporter-" + gone.String() + "-123", "bcc-exporter-" + self.String() + "-456", "bcc-exporter-789", "other"} {
+		os.Mkdir(filepath.Join(dir, name), 0700)
+	}
+
+	reapOrphans(dir)
+
+	waited := make(chan error)
+	go func() { waited <- orphan.Wait() }()
+	select {
+	case <-waited:
+	case <-time.After(5 * time.Second):
+		t.Error("orphaned profiler still running")
+	}
+	if !runningID.alive() {
+		t.Error("profiler of a live exporter was killed")
+	}
+
+	var left []string
+	entries, _ := os.ReadDir(dir)
+	for _, e := range entries {
+		left = append(left, e.Name())
+	}
+	want := []string{"bcc-exporter-" + self.String() + "-456", "bcc-exporter-" + self.String() + ".sessions", "bcc-exporter-789", "other"}
+	slices.Sort(want)
+	if !slices.Equal(left, want) {
+		t.Errorf("left in temp dir: %q, want %q", left, want)
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// redisError is an error reply sent by the Redis server
+type redisError string
+
+func (e redisError) Error() string {
+	return string(e)
+}
+
+// redisConn is a minimal RESP2 client, enough to run administrative
+// commands such as INFO, CONFIG GET and LATENCY LATEST
+type redisConn struct {
+	conn    net.Conn
+	r       *bufio.Reader
+	timeout time.Duration
+}
+
+// dialRedis connects to addr and authenticates when a password is given
+func dialRedis(addr, username, password string, timeout time.Duration) (*redisConn, error) {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &redisConn{conn: conn, r: bufio.NewReader(conn), timeout: timeout}
+
+	if password != "" {
+		args := []string{"AUTH", password}
+		if username != "" {
+			args = []string{"AUTH", username, password}
+		}
+		if _, err := c.Do(args...); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("AUTH failed: %v", err)
+		}
+	}
+	return c, nil
+}
+
+// Close closes the connection
+func (c *redisConn) Close() error {
+	return c.conn.Close()
+}
+
+// Do sends a command and returns its reply: a string for simple and bulk
+// strings, int64 for integers, []interface{} for arrays and nil for null replies
+func (c *redisConn) Do(args ...string) (interface{}, error) {
+	c.conn.SetDeadline(time.Now().Add(c.timeout))
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := io.WriteString(c.conn, b.String()); err != nil {
+		return nil, err
+	}
+
+	reply, err := readRESP(c.r)
+	if err != nil {
+		return nil, err
+	}
+	if rerr, ok := reply.(redisError); ok {
+		return nil, rerr
+	}
+	return reply, nil
+}
+
+// readRESP decodes a single RESP2 reply
+func readRESP(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, fmt.Errorf("empty RESP line")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return redisError(line[1:]), nil
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			if items[i], err = readRESP(r); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("unexpected RESP type %q", line[0])
+}
+
+// redisInfo runs INFO [section] and returns its fields
+func (c *redisConn) redisInfo(section string) (map[string]string, error) {
+	args := []string{"INFO"}
+	if section != "" {
+		args = append(args, section)
+	}
+	reply, err := c.Do(args...)
+	if err != nil {
+		return nil, err
+	}
+	text, ok := reply.(string)
+	if !ok {
+		return nil, fmt.Errorf("unexpected INFO reply %T", reply)
+	}
+
+	fields := make(map[string]string)
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		if k, v, ok := strings.Cut(line, ":"); ok {
+			fields[k] = v
+		}
+	}
+	return fields, nil
+}
+
+// redisPID returns the process_id reported by INFO server
+func (c *redisConn) redisPID() (int, error) {
+	info, err := c.redisInfo("server")
+	if err != nil {
+		return 0, err
+	}
+	pid, err := strconv.Atoi(info["process_id"])
+	if err != nil {
+		return 0, fmt.Errorf("INFO server has no process_id")
+	}
+	return pid, nil
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"debug/elf"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// redisCommandSymbolRe matches the functions implementing Redis commands,
+// which call() dispatches to: getCommand, zaddCommand, evalShaCommand, ...
+var redisCommandSymbolRe = regexp.MustCompile(`^([a-z]+(?:Sha|Ro|ShaRo)?)Command$`)
+
+// redisCommandHelpers are functions named like command implementations that
+// are part of command dispatch itself
+var redisCommandHelpers = map[string]bool{
+	"processCommand": true,
+	"lookupCommand":  true,
+	"rejectCommand":  true,
+	"afterCommand":   true,
+}
+
+// redisCommandFunc is a command implementation found in a redis-server binary
+type redisCommandFunc struct {
+	Symbol  string
+	Command string
+}
+
+// redisCommandName derives the command name from its implementation, e.g.
+// "zaddCommand" is ZADD and "evalShaRoCommand" is EVALSHA_RO
+func redisCommandName(symbol string) string {
+	m := redisCommandSymbolRe.FindStringSubmatch(symbol)
+	if m == nil {
+		return ""
+	}
+	name := m[1]
+	if base, ok := strings.CutSuffix(name, "Ro"); ok {
+		name = base + "_ro"
+	}
+	return strings.ToUpper(strings.Replace(name, "Sha", "sha", 1))
+}
+
+// findRedisCommandFuncs lists the command implementations in the symbol
+// table of the ELF binary at path
+func findRedisCommandFuncs(path string) ([]redisCommandFunc, error) {
+	f, err := elf.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	syms, err := f.Symbols()
+	if err != nil || len(syms) == 0 {
+		if syms, err = f.DynamicSymbols(); err != nil {
+			return nil, fmt.Errorf("binary has no symbol table (stripped?): %v", err)
+		}
+	}
+
+	seen := make(map[string]bool)
+	var funcs []redisCommandFunc
+	for _, sym := range syms {
+		if elf.ST_TYPE(sym.Info) != elf.STT_FUNC || sym.Value == 0 || seen[sym.Name] || redisCommandHelpers[sym.Name] {
+			continue
+		}
+		if cmd := redisCommandName(sym.Name); cmd != "" {
+			seen[sym.Name] = true
+			funcs = append(funcs, redisCommandFunc{Symbol: sym.Name, Command: cmd})
+		}
+	}
+	if len(funcs) == 0 {
+		return nil, fmt.Errorf("no Redis command functions found in %s", path)
+	}
+
+	sort.Slice(funcs, func(i, j int) bool { return funcs[i].Symbol < funcs[j].Symbol })
+	return funcs, nil
+}
+
+// cmdLatencyScript builds a bpftrace program timing every command function
+// of binary for seconds. Start times are keyed by thread and command so
+// commands nested in MULTI/EXEC or scripts are timed separately.
+func cmdLatencyScript(binary string, funcs []redisCommandFunc, seconds int) string {
+	var b strings.Builder
+	for _, fn := range funcs {
+		fmt.Fprintf(&b, "uprobe:%s:%s { @start[tid, %q] = nsecs; }\n", binary, fn.Symbol, fn.Command)
+		fmt.Fprintf(&b, "uretprobe:%s:%s /@start[tid, %q]/ { $d = nsecs - @start[tid, %q]; @ns[%q] = hist($d); @calls[%q] = count(); @total[%q] = sum($d); delete(@start[tid, %q]); }\n",
+			binary, fn.Symbol, fn.Command, fn.Command, fn.Command, fn.Command, fn.Command, fn.Command)
+	}
+	fmt.Fprintf(&b, "interval:s:%d { exit(); }\n", seconds)
+	b.WriteString("END { clear(@start); }\n")
+	return b.String()
+}
+
+// latencyBucket is one power-of-two bucket of a latency histogram
+type latencyBucket struct {
+	MinNs int64 `json:"min_ns"`
+	MaxNs int64 `json:"max_ns"`
+	Count int64 `json:"count"`
+}
+
+// commandLatency is the latency distribution of one Redis command
+type commandLatency struct {
+	Command string          `json:"command"`
+	Calls   int64           `json:"calls"`
+	TotalNs int64           `json:"total_ns"`
+	MeanNs  int64           `json:"mean_ns"`
+	P50Ns   int64           `json:"p50_ns"`
+	P99Ns   int64           `json:"p99_ns"`
+	Buckets []latencyBucket `json:"histogram"`
+}
+
+// cmdLatencyReport is the response of /debug/redis/cmdlatency
+type cmdLatencyReport struct {
+	PID      string           `json:"pid"`
+	Seconds  int              `json:"seconds"`
+	Commands []commandLatency `json:"commands"`
+}
+
+// parseCmdLatency decodes the maps printed by cmdLatencyScript on exit
+func parseCmdLatency(r io.Reader) ([]commandLatency, error) {
+	byCmd := make(map[string]*commandLatency)
+	get := func(cmd string) *commandLatency {
+		if c, ok := byCmd[cmd]; ok {
+			return c
+		}
+		c := &commandLatency{Command: cmd}
+		byCmd[cmd] = c
+		return c
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	for scanner.Scan() {
+		var line bpftraceLine
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			continue
+		}
+		var maps map[string]map[string]json.RawMessage
+		if line.Type == "hist" || line.Type == "map" {
+			if err := json.Unmarshal(line.Data, &maps); err != nil {
+				return nil, fmt.Errorf("malformed %s record: %v", line.Type, err)
+			}
+		}
+		switch line.Type {
+		case "hist":
+			for cmd, raw := range maps["@ns"] {
+				var buckets []struct {
+					Min   *int64 `json:"min"`
+					Max   int64  `json:"max"`
+					Count int64  `json:"count"`
+				}
+				if err := json.Unmarshal(raw, &buckets); err != nil {
+					return nil, fmt.Errorf("malformed histogram for %s: %v", cmd, err)
+				}
+				c := get(cmd)
+				for _, b := range buckets {
+					bucket := latencyBucket{MaxNs: b.Max, Count: b.Count}
+					if b.Min != nil {
+						bucket.MinNs = *b.Min
+					}
+					c.Buckets = append(c.Buckets, bucket)
+				}
+			}
+		case "map":
+			for name, values := range maps {
+				for cmd, raw := range values {
+					n, _ := strconv.ParseInt(string(raw), 10, 64)
+					switch name {
+					case "@calls":
+						get(cmd).Calls = n
+					case "@total":
+						get(cmd).TotalNs = n
+					}
+				}
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	commands := make([]commandLatency, 0, len(byCmd))
+	for _, c := range byCmd {
+		if c.Calls > 0 {
+			c.MeanNs = c.TotalNs / c.Calls
+		}
+		c.P50Ns = bucketPercentile(c.Buckets, 0.50)
+		c.P99Ns = bucketPercentile(c.Buckets, 0.99)
+		commands = append(commands, *c)
+	}
+	sort.Slice(commands, func(i, j int) bool {
+		if commands[i].Calls != commands[j].Calls {
+			return commands[i].Calls > commands[j].Calls
+		}
+		return commands[i].Command < commands[j].Command
+	})
+	return commands, nil
+}
+
+// bucketPercentile returns the upper bound of the bucket holding quantile q
+func bucketPercentile(buckets []latencyBucket, q float64) int64 {
+	var total int64
+	for _, b := range buckets {
+		total += b.Count
+	}
+	if total == 0 {
+		return 0
+	}
+
+	var seen int64
+	for _, b := range buckets {
+		seen += b.Count
+		if float64(seen) >= q*float64(total) {
+			return b.MaxNs
+		}
+	}
+	return buckets[len(buckets)-1].MaxNs
+}
+
+// filterRedisCommandFuncs keeps the functions of the comma-separated commands
+func filterRedisCommandFuncs(funcs []redisCommandFunc, commands string) []redisCommandFunc {
+	want := make(map[string]bool)
+	for _, cmd := range strings.Split(commands, ",") {
+		want[strings.ToUpper(strings.TrimSpace(cmd))] = true
+	}
+	var filtered []redisCommandFunc
+	for _, fn := range funcs {
+		if want[fn.Command] {
+			filtered = append(filtered, fn)
+		}
+	}
+	return filtered
+}
+
+// mockCmdLatency returns sample latency data for test mode
+func mockCmdLatency() []commandLatency {
+	return []commandLatency{
+		{Command: "GET", Calls: 1500, TotalNs: 1500 * 900, MeanNs: 900, P50Ns: 1023, P99Ns: 4095, Buckets: []latencyBucket{
+			{MinNs: 512, MaxNs: 1023, Count: 1200}, {MinNs: 1024, MaxNs: 2047, Count: 280}, {MinNs: 2048, MaxNs: 4095, Count: 20}}},
+		{Command: "SET", Calls: 500, TotalNs: 500 * 1400, MeanNs: 1400, P50Ns: 2047, P99Ns: 8191, Buckets: []latencyBucket{
+			{MinNs: 1024, MaxNs: 2047, Count: 450}, {MinNs: 2048, MaxNs: 4095, Count: 45}, {MinNs: 4096, MaxNs: 8191, Count: 5}}},
+	}
+}
+
+// handleRedisCmdLatency measures per-command latency inside redis-server
+// with uprobes on the command implementations for the requested window
+func handleRedisCmdLatency(w http.ResponseWriter, r *http.Request) {
+	opts, err := parseProfileOptions(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := resolveRedisPort(&opts); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid redis_port: %v", err), http.StatusBadRequest)
+		return
+	}
+	if err := resolveContainerPID(&opts); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid container PID: %v", err), http.StatusBadRequest)
+		return
+	}
+	auditPID(r, opts.PID)
+
+	report := cmdLatencyReport{PID: opts.PID, Seconds: opts.Duration}
+	if r.URL.Query().Get("test") == "true" {
+		report.Commands = mockCmdLatency()
+		writeJSON(w, http.StatusOK, report)
+		return
+	}
+
+	if err := validatePID(opts.PID); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid PID: %v", err), http.StatusBadRequest)
+		return
+	}
+	if err := currentPolicy().check(opts.PID); err != nil {
+		http.Error(w, fmt.Sprintf("Forbidden target: %v", err), http.StatusForbidden)
+		return
+	}
+	// /proc/<pid>/exe reaches the binary even when it lives in another mount namespace
+	binary := filepath.Join(procRoot, opts.PID, "exe")
+	funcs, err := findRedisCommandFuncs(binary)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to find Redis commands: %v", err), http.StatusBadRequest)
+		return
+	}
+	if commands := r.URL.Query().Get("commands"); commands != "" {
+		if funcs = filterRedisCommandFuncs(funcs, commands); len(funcs) == 0 {
+			http.Error(w, fmt.Sprintf("None of the commands %q were found", commands), http.StatusBadRequest)
+			return
+		}
+	}
+
+	release, ok := takeCaptureSlot(w, r, opts.PID)
+	if !ok {
+		return
+	}
+	defer release()
+
+	log.Printf("Tracing %d Redis commands of PID %s for %d seconds", len(funcs), opts.PID, opts.Duration)
+	out, err := runBpftrace(r.Context(), opts.Duration, "-p", opts.PID, "-f", "json", "-e", cmdLatencyScript(binary, funcs, opts.Duration))
+	if err != nil {
+		writeCaptureError(w, err)
+		return
+	}
+
+	if report.Commands, err = parseCmdLatency(bytes.NewReader(out)); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to parse bpftrace output: %v", err), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, report)
+}
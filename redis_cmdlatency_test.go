@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestRedisCommandName(t *testing.T) {
+	tests := []struct {
+		symbol string
+		want   string
+	}{
+		{"getCommand", "GET"},
+		{"zaddCommand", "ZADD"},
+		{"evalShaCommand", "EVALSHA"},
+		{"evalRoCommand", "EVAL_RO"},
+		{"evalShaRoCommand", "EVALSHA_RO"},
+		{"sunionDiffGenericCommand", ""},
+		{"getCommandFlags", ""},
+		{"call", ""},
+	}
+
+	for _, tt := range tests {
+		if got := redisCommandName(tt.symbol); got != tt.want {
+			t.Errorf("redisCommandName(%q) = %q, want %q", tt.symbol, got, tt.want)
+		}
+	}
+}
+
+func TestFindRedisCommandFuncsNoCommands(t *testing.T) {
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := findRedisCommandFuncs(exe); err == nil {
+		t.Error("findRedisCommandFuncs() should fail on a binary without Redis commands")
+	}
+}
+
+func TestCmdLatencyScript(t *testing.T) {
+	funcs := []redisCommandFunc{{"getCommand", "GET"}, {"setCommand", "SET"}}
+	script := cmdLatencyScript("/proc/42/exe", funcs, 10)
+
+	for _, want := range []string{
+		`uprobe:/proc/42/exe:getCommand { @start[tid, "GET"] = nsecs; }`,
+		`uretprobe:/proc/42/exe:setCommand /@start[tid, "SET"]/`,
+		`@ns["SET"] = hist($d)`,
+		"interval:s:10 { exit(); }",
+	} {
+		if !strings.Contains(script, want) {
+			t.Errorf("script does not contain %q:\n%s", want, script)
+		}
+	}
+}
+
+func TestParseCmdLatency(t *testing.T) {
+	output := `{"type": "attached_probes", "data": {"probes": 5}}
+{"type": "map", "data": {"@calls": {"GET": 10, "SET": 30}}}
+{"type": "hist", "data": {"@ns": {"GET": [{"min": 512, "max": 1023, "count": 9}, {"min": 1024, "max": 2047, "count": 1}], "SET": [{"min": 1024, "max": 2047, "count": 30}]}}}
+{"type": "map", "data": {"@total": {"GET": 8000, "SET": 45000}}}
+`
+	commands, err := parseCmdLatency(strings.NewReader(output))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(commands) != 2 {
+		t.Fatalf("got %d commands, want 2", len(commands))
+	}
+
+	set, get := commands[0], commands[1]
+	if set.Command != "SET" || set.Calls != 30 || set.MeanNs != 1500 || set.P99Ns != 2047 {
+		t.Errorf("SET = %+v", set)
+	}
+	if get.Command != "GET" || get.Calls != 10 || get.P50Ns != 1023 || get.P99Ns != 2047 || len(get.Buckets) != 2 {
+		t.Errorf("GET = %+v", get)
+	}
+}
+
+func TestFilterRedisCommandFuncs(t *testing.T) {
+	funcs := []redisCommandFunc{{"getCommand", "GET"}, {"setCommand", "SET"}, {"hsetCommand", "HSET"}}
+	filtered := filterRedisCommandFuncs(funcs, "get, hset")
+	if len(filtered) != 2 || filtered[0].Command != "GET" || filtered[1].Command != "HSET" {
+		t.Errorf("filterRedisCommandFuncs() = %v", filtered)
+	}
+}
+
+func TestRedisCmdLatencyTestMode(t *testing.T) {
+	req := httptest.NewRequest("GET", "/debug/redis/cmdlatency?pid=1234&seconds=5&test=true", nil)
+	rr := httptest.NewRecorder()
+	handleRedisCmdLatency(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rr.Code, rr.Body.String())
+	}
+	var report cmdLatencyReport
+	if err := json.Unmarshal(rr.Body.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+	if report.PID != "1234" || len(report.Commands) == 0 {
+		t.Errorf("report = %+v", report)
+	}
+}
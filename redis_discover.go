@@ -0,0 +1,208 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/pprof/profile"
+)
+
+// defaultRedisParallel is how many redis-server processes /debug/pprof/redis
+// profiles at the same time unless the parallel parameter says otherwise
+const defaultRedisParallel = 8
+
+// redisTarget is one redis-server process found on the host
+type redisTarget struct {
+	PID  int
+	Port string // empty when the process has no TCP listener
+}
+
+// findRedisTargets returns every local redis-server process with its client port
+func findRedisTargets() ([]redisTarget, error) {
+	pids, err := findPIDsByComm("redis-server")
+	if err != nil {
+		return nil, err
+	}
+	sort.Ints(pids)
+
+	targets := make([]redisTarget, 0, len(pids))
+	for _, pid := range pids {
+		target := redisTarget{PID: pid}
+		if addr, err := redisAddrForPID(pid); err == nil {
+			_, target.Port, _ = net.SplitHostPort(addr)
+		}
+		targets = append(targets, target)
+	}
+	return targets, nil
+}
+
+// profileRedisTargets captures every target with at most parallel captures
+// running at once and merges the results into one profile whose samples
+// carry pid and port labels
+func profileRedisTargets(opts profileOptions, targets []redisTarget, parallel int, dir string, capture snapshotFunc) (*profile.Profile, []error) {
+	profiles := make([]*profile.Profile, len(targets))
+	errs := make([]error, len(targets))
+
+	sem := make(chan struct{}, parallel)
+	var wg sync.WaitGroup
+	for i, target := range targets {
+		wg.Add(1)
+		go func(i int, target redisTarget) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			topts := opts
+			topts.PID = strconv.Itoa(target.PID)
+			if err := currentPolicy().check(topts.PID); err != nil {
+				errs[i] = err
+				return
+			}
+			if opts.Children {
+				children, _ := findDescendants(target.PID)
+				for _, child := range currentPolicy().permitted(children) {
+					topts.ChildPIDs = append(topts.ChildPIDs, strconv.Itoa(child))
+				}
+			}
+			tdir := filepath.Join(dir, topts.PID)
+			if err := os.Mkdir(tdir, 0700); err != nil {
+				errs[i] = err
+				return
+			}
+
+			data, err := capture(topts, tdir)
+			if err != nil {
+				errs[i] = fmt.Errorf("PID %d: %v", target.PID, err)
+				return
+			}
+			p, err := parseProfileData(data)
+			if err != nil {
+				errs[i] = fmt.Errorf("PID %d: %v", target.PID, err)
+				return
+			}
+
+			for _, s := range p.Sample {
+				if s.Label == nil {
+					s.Label = make(map[string][]string)
+				}
+				s.Label["pid"] = []string{topts.PID}
+				if target.Port != "" {
+					s.Label["port"] = []string{target.Port}
+				}
+			}
+			profiles[i] = p
+		}(i, target)
+	}
+	wg.Wait()
+
+	var captured []*profile.Profile
+	var failed []error
+	for i := range targets {
+		if errs[i] != nil {
+			failed = append(failed, errs[i])
+		} else {
+			captured = append(captured, profiles[i])
+		}
+	}
+	if len(captured) == 0 {
+		return nil, failed
+	}
+
+	merged, err := mergeProfiles(captured)
+	if err != nil {
+		return nil, append(failed, err)
+	}
+	return merged, failed
+}
+
+// handleRedisProfile profiles all redis-server processes on the host and
+// returns a single merged pprof profile
+func handleRedisProfile(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	opts, err := parseCaptureOptions(q)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if opts.PID != "" || opts.RedisPort != 0 || opts.TID != "" || opts.Snapshots > 1 || opts.RedisMetadata || opts.Output != "" {
+		http.Error(w, "pid, redis_port, tid, snapshots, redis_metadata and format are not supported when profiling all Redis servers", http.StatusBadRequest)
+		return
+	}
+
+	parallel := defaultRedisParallel
+	if s := q.Get("parallel"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > 64 {
+			http.Error(w, "Invalid parallel: must be between 1 and 64", http.StatusBadRequest)
+			return
+		}
+		parallel = n
+	}
+
+	capture := snapshotPerf
+	if q.Get("test") == "true" {
+		capture = func(opts profileOptions, dir string) ([]byte, error) {
+			return []byte(generateMockProfile(opts.PID, opts.Duration)), nil
+		}
+	}
+
+	targets, err := findRedisTargets()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to list processes: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if len(targets) == 0 {
+		http.Error(w, "No redis-server processes found", http.StatusNotFound)
+		return
+	}
+
+	tempDir, err := newCaptureDir()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to create temp directory: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer os.RemoveAll(tempDir)
+
+	release, ok := takeCaptureSlot(w, r, "")
+	if !ok {
+		return
+	}
+	defer release()
+
+	if opts.Delay > 0 {
+		select {
+		case <-time.After(time.Duration(opts.Delay) * time.Second):
+		case <-r.Context().Done():
+			log.Printf("Client went away during warmup delay of Redis profile")
+			return
+		}
+	}
+
+	log.Printf("Profiling %d redis-server processes for %d seconds", len(targets), opts.Duration)
+	merged, errs := profileRedisTargets(opts, targets, parallel, tempDir, capture)
+	if merged == nil {
+		http.Error(w, fmt.Sprintf("All captures failed: %v", errs), http.StatusInternalServerError)
+		return
+	}
+	// A shard that exits mid-capture should not cost the rest of the fleet
+	for _, err := range errs {
+		addWarning(w, err.Error())
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=redis-%d.pb.gz", opts.Duration))
+	if err := merged.Write(w); err != nil {
+		log.Printf("Failed to write merged profile: %v", err)
+		return
+	}
+
+	log.Printf("Successfully served merged profile of %d redis-server processes", len(targets)-len(errs))
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/google/pprof/profile"
+)
+
+func TestFindRedisTargets(t *testing.T) {
+	writeFakeProc(t, map[int]int{})
+	writeFakeStat(t, 300, "redis-server", 0)
+	writeFakeStat(t, 100, "redis-server", 0)
+	writeFakeStat(t, 200, "sshd", 0)
+
+	// PID 100 listens on 6379
+	pidDir := filepath.Join(procRoot, "100")
+	os.MkdirAll(filepath.Join(pidDir, "fd"), 0755)
+	os.MkdirAll(filepath.Join(pidDir, "net"), 0755)
+	if err := os.Symlink("socket:[555]", filepath.Join(pidDir, "fd", "6")); err != nil {
+		t.Fatal(err)
+	}
+	tcp := "  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode\n" +
+		"   0: 00000000:18EB 00000000:0000 0A 00000000:00000000 00:00000000 00000000   999        0 555 1 0 100 0 0 10 0\n"
+	if err := os.WriteFile(filepath.Join(pidDir, "net", "tcp"), []byte(tcp), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	targets, err := findRedisTargets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []redisTarget{{PID: 100, Port: "6379"}, {PID: 300}}
+	if fmt.Sprint(targets) != fmt.Sprint(want) {
+		t.Errorf("findRedisTargets() = %v, want %v", targets, want)
+	}
+}
+
+func TestProfileRedisTargets(t *testing.T) {
+	targets := []redisTarget{{PID: 100, Port: "6379"}, {PID: 101, Port: "6380"}, {PID: 102, Port: "6381"}}
+	capture := func(opts profileOptions, dir string) ([]byte, error) {
+		if opts.PID == "102" {
+			return nil, fmt.Errorf("process exited")
+		}
+		return []byte("main;aeMain;processCommand 10\n"), nil
+	}
+
+	merged, errs := profileRedisTargets(profileOptions{Duration: 5}, targets, 2, t.TempDir(), capture)
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), "PID 102") {
+		t.Errorf("errors = %v, want a failure for PID 102", errs)
+	}
+	if merged == nil {
+		t.Fatal("no merged profile")
+	}
+
+	var keys []string
+	for _, s := range merged.Sample {
+		keys = append(keys, s.Label["pid"][0]+"/"+s.Label["port"][0])
+	}
+	sort.Strings(keys)
+	if strings.Join(keys, ",") != "100/6379,101/6380" {
+		t.Errorf("sample pid/port labels = %v", keys)
+	}
+}
+
+func TestRedisProfileEndpoint(t *testing.T) {
+	writeFakeProc(t, map[int]int{})
+	writeFakeStat(t, 100, "redis-server", 0)
+	writeFakeStat(t, 101, "redis-server", 0)
+
+	tests := []struct {
+		query      string
+		wantStatus int
+	}{
+		{"seconds=5&test=true", http.StatusOK},
+		{"seconds=5&parallel=1&test=true", http.StatusOK},
+		{"test=true", http.StatusBadRequest},
+		{"seconds=5&parallel=0&test=true", http.StatusBadRequest},
+		{"seconds=5&pid=100&test=true", http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/debug/pprof/redis?"+tt.query, nil)
+		w := httptest.NewRecorder()
+		handleRedisProfile(w, req)
+
+		if w.Code != tt.wantStatus {
+			t.Errorf("%s: status = %d, want %d: %s", tt.query, w.Code, tt.wantStatus, w.Body.String())
+			continue
+		}
+		if w.Code != http.StatusOK {
+			continue
+		}
+		p, err := profile.Parse(w.Body)
+		if err != nil {
+			t.Errorf("%s: %v", tt.query, err)
+			continue
+		}
+		pids := make(map[string]bool)
+		for _, s := range p.Sample {
+			pids[s.Label["pid"][0]] = true
+		}
+		if !pids["100"] || !pids["101"] {
+			t.Errorf("%s: merged profile has samples of PIDs %v, want 100 and 101", tt.query, pids)
+		}
+	}
+}
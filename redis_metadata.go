@@ -0,0 +1,206 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// redisCredentials authenticates connections the exporter opens to Redis
+// servers it profiles
+type redisCredentials struct {
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	// PasswordFile and PasswordEnv name a file or environment variable
+	// holding the password, to keep it out of the configuration file
+	PasswordFile string `json:"password_file,omitempty"`
+	PasswordEnv  string `json:"password_env,omitempty"`
+}
+
+func (c *redisCredentials) validate() error {
+	password, err := resolveSecret(c.Password, c.PasswordFile, c.PasswordEnv)
+	if err != nil {
+		return fmt.Errorf("password: %v", err)
+	}
+	c.Password = password
+	return nil
+}
+
+// redisAuth holds the credentials from the redis section of the configuration file
+var redisAuth redisCredentials
+
+// redisSensitiveConfig lists CONFIG parameters that are never returned
+var redisSensitiveConfig = map[string]bool{
+	"requirepass":              true,
+	"masterauth":               true,
+	"masteruser":               true,
+	"tls-key-file-pass":        true,
+	"tls-client-key-file-pass": true,
+}
+
+// redisSnapshot is the state of a Redis server at one point of a capture
+type redisSnapshot struct {
+	Time         time.Time         `json:"time"`
+	Info         map[string]string `json:"info"`
+	Config       map[string]string `json:"config"`
+	CommandStats map[string]string `json:"commandstats"`
+}
+
+// redisMetadata is the Redis context recorded around a capture
+type redisMetadata struct {
+	Addr   string         `json:"addr"`
+	Before *redisSnapshot `json:"before,omitempty"`
+	After  *redisSnapshot `json:"after,omitempty"`
+}
+
+// isRedisServer reports whether pid runs redis-server
+func isRedisServer(pid int) bool {
+	comm, err := readComm(pid)
+	return err == nil && comm == "redis-server"
+}
+
+// redisAddrForPID returns the address of the lowest TCP port pid listens on,
+// which for redis-server is the client port rather than the cluster bus
+func redisAddrForPID(pid int) (string, error) {
+	addrs, err := findListenAddrs(pid)
+	if err != nil {
+		return "", err
+	}
+	if len(addrs) == 0 {
+		return "", fmt.Errorf("PID %d does not listen on any TCP port", pid)
+	}
+	return addrs[0], nil
+}
+
+// takeRedisSnapshot runs INFO ALL, CONFIG GET * and INFO commandstats on addr
+func takeRedisSnapshot(addr string) (*redisSnapshot, error) {
+	c, err := dialRedis(addr, redisAuth.Username, redisAuth.Password, 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	snap := &redisSnapshot{Time: time.Now().UTC()}
+	if snap.Info, err = c.redisInfo("all"); err != nil {
+		return nil, fmt.Errorf("INFO ALL: %v", err)
+	}
+	if snap.CommandStats, err = c.redisInfo("commandstats"); err != nil {
+		return nil, fmt.Errorf("INFO commandstats: %v", err)
+	}
+
+	reply, err := c.Do("CONFIG", "GET", "*")
+	if err != nil {
+		return nil, fmt.Errorf("CONFIG GET: %v", err)
+	}
+	items, _ := reply.([]interface{})
+	snap.Config = make(map[string]string)
+	for i := 0; i+1 < len(items); i += 2 {
+		key, _ := items[i].(string)
+		value, _ := items[i+1].(string)
+		if redisSensitiveConfig[key] {
+			continue
+		}
+		snap.Config[key] = value
+	}
+	return snap, nil
+}
+
+// runRedisBundle captures a profile of a redis-server process together with
+// Redis state taken before and after it, and returns both as a tar archive
+func runRedisBundle(w http.ResponseWriter, r *http.Request, opts profileOptions, format, addr string, capture snapshotFunc) {
+	tempDir, err := newCaptureDir()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to create temp directory: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer os.RemoveAll(tempDir)
+
+	md := redisMetadata{Addr: addr}
+	if md.Before, err = takeRedisSnapshot(addr); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to read Redis metadata from %s: %v", addr, err), http.StatusBadGateway)
+		return
+	}
+
+	data, err := capture(opts, tempDir)
+	if err != nil {
+		writeCaptureError(w, err)
+		return
+	}
+
+	// The profile is still useful when the server went away during the capture
+	if md.After, err = takeRedisSnapshot(addr); err != nil {
+		addWarning(w, fmt.Sprintf("failed to read Redis metadata after the capture: %v", err))
+	}
+	mdData, _ := json.MarshalIndent(md, "", "  ")
+
+	if store != nil {
+		meta := captureMeta(opts, format)
+		meta.Attachments = []string{"redis"}
+		if meta, err = store.Save(meta, bytes.NewReader(data)); err != nil {
+			log.Printf("Failed to store profile: %v", err)
+		} else if err := store.SaveAttachment(meta.ID, "redis", mdData); err != nil {
+			log.Printf("Failed to store Redis metadata of profile %s: %v", meta.ID, err)
+		} else {
+			w.Header().Set("X-Profile-ID", meta.ID)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/x-tar")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=redis-%s-%d.tar", opts.PID, opts.Duration))
+
+	now := time.Now()
+	tw := tar.NewWriter(w)
+	if err := writeTarFile(tw, "profile"+profileExtension(format), now, data); err != nil {
+		log.Printf("Failed to write Redis bundle: %v", err)
+		return
+	}
+	if err := writeTarFile(tw, "redis.json", now, mdData); err != nil {
+		log.Printf("Failed to write Redis bundle: %v", err)
+		return
+	}
+	if err := tw.Close(); err != nil {
+		log.Printf("Failed to write Redis bundle: %v", err)
+		return
+	}
+
+	log.Printf("Successfully served Redis bundle for PID %s (%s)", opts.PID, addr)
+}
+
+// redisBundleAddr resolves the Redis address for a redis_metadata capture:
+// redis_addr, then redis_port, then the ports the process listens on
+func redisBundleAddr(r *http.Request, opts profileOptions) (string, error) {
+	if addr := r.URL.Query().Get("redis_addr"); addr != "" {
+		return addr, nil
+	}
+	if opts.RedisPort != 0 {
+		return net.JoinHostPort("127.0.0.1", strconv.Itoa(opts.RedisPort)), nil
+	}
+	pid, _ := strconv.Atoi(opts.PID)
+	return redisAddrForPID(pid)
+}
+
+// handleGetRedisMetadata serves the Redis metadata recorded with a stored profile
+func handleGetRedisMetadata(w http.ResponseWriter, r *http.Request) {
+	if !requireStore(w) {
+		return
+	}
+
+	data, err := store.ReadAttachment(r.PathValue("id"), "redis")
+	if err == errProfileNotFound {
+		http.Error(w, "Redis metadata not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to read Redis metadata: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
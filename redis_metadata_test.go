@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// fakeRedisState answers the commands used by takeRedisSnapshot
+func fakeRedisState(calls *int) func(args []string) string {
+	return func(args []string) string {
+		switch strings.ToUpper(args[0]) {
+		case "INFO":
+			*calls++
+			if len(args) > 1 && args[1] == "commandstats" {
+				return respBulk("# Commandstats\r\ncmdstat_get:calls=10,usec=20,usec_per_call=2.00\r\n")
+			}
+			return respBulk("# Server\r\nredis_version:7.2.4\r\nprocess_id:4242\r\n# Stats\r\ntotal_commands_processed:10\r\n")
+		case "CONFIG":
+			return "*4\r\n" + respBulk("maxmemory") + respBulk("0") + respBulk("requirepass") + respBulk("secret")
+		}
+		return "-ERR unknown command\r\n"
+	}
+}
+
+func TestTakeRedisSnapshot(t *testing.T) {
+	var calls int
+	fr := newFakeRedis(t, fakeRedisState(&calls))
+
+	snap, err := takeRedisSnapshot(fr.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snap.Info["redis_version"] != "7.2.4" {
+		t.Errorf("Info = %v, want redis_version 7.2.4", snap.Info)
+	}
+	if snap.CommandStats["cmdstat_get"] == "" {
+		t.Errorf("CommandStats = %v, want cmdstat_get", snap.CommandStats)
+	}
+	if snap.Config["maxmemory"] != "0" {
+		t.Errorf("Config = %v, want maxmemory 0", snap.Config)
+	}
+	if _, ok := snap.Config["requirepass"]; ok {
+		t.Error("CONFIG snapshot includes requirepass")
+	}
+}
+
+func TestRedisBundle(t *testing.T) {
+	s := withTestStore(t)
+	var calls int
+	fr := newFakeRedis(t, fakeRedisState(&calls))
+
+	opts := profileOptions{PID: "4242", Duration: 5, RedisMetadata: true}
+	capture := func(opts profileOptions, dir string) ([]byte, error) {
+		return []byte("main;serveClient 10\n"), nil
+	}
+
+	req := httptest.NewRequest("GET", "/debug/folded/profile?pid=4242&seconds=5&redis_metadata=true", nil)
+	w := httptest.NewRecorder()
+	runRedisBundle(w, req, opts, "folded", fr.addr(), capture)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body.String())
+	}
+	names, files := readTar(t, w.Body)
+	if strings.Join(names, ",") != "profile.folded.txt,redis.json" {
+		t.Errorf("bundle files = %v", names)
+	}
+
+	var md redisMetadata
+	if err := json.Unmarshal(files["redis.json"], &md); err != nil {
+		t.Fatal(err)
+	}
+	if md.Addr != fr.addr() || md.Before == nil || md.After == nil {
+		t.Errorf("redis.json = %+v, want before and after snapshots of %s", md, fr.addr())
+	}
+	if calls != 4 {
+		t.Errorf("INFO was called %d times, want 4", calls)
+	}
+
+	id := w.Header().Get("X-Profile-ID")
+	meta, err := s.Get(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(meta.Attachments) != 1 || meta.Attachments[0] != "redis" {
+		t.Errorf("Attachments = %v, want [redis]", meta.Attachments)
+	}
+
+	req = httptest.NewRequest("GET", "/api/v1/profiles/"+id+"/redis", nil)
+	req.SetPathValue("id", id)
+	w = httptest.NewRecorder()
+	handleGetRedisMetadata(w, req)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "total_commands_processed") {
+		t.Errorf("GET redis metadata = %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestRedisMetadataIgnoredForOtherProcesses(t *testing.T) {
+	writeFakeProc(t, map[int]int{})
+	writeFakeStat(t, 77, "sshd", 0)
+
+	if isRedisServer(77) {
+		t.Error("isRedisServer(77) = true for sshd")
+	}
+	writeFakeStat(t, 78, "redis-server", 0)
+	if !isRedisServer(78) {
+		t.Error("isRedisServer(78) = false for redis-server")
+	}
+}
+
+func TestRedisMetadataWithSnapshots(t *testing.T) {
+	req := httptest.NewRequest("GET", "/debug/pprof/profile?pid=1&seconds=5&snapshots=2&redis_metadata=true", nil)
+	if _, err := parseProfileOptions(req); err == nil {
+		t.Error("parseProfileOptions() accepted redis_metadata with snapshots")
+	}
+}
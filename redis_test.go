@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis is a RESP server answering commands through handler, which
+// returns the raw reply to send
+type fakeRedis struct {
+	ln      net.Listener
+	mu      sync.Mutex
+	handler func(args []string) string
+}
+
+func newFakeRedis(t *testing.T, handler func(args []string) string) *fakeRedis {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	fr := &fakeRedis{ln: ln, handler: handler}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go fr.serve(conn)
+		}
+	}()
+	return fr
+}
+
+func (fr *fakeRedis) addr() string {
+	return fr.ln.Addr().String()
+}
+
+func (fr *fakeRedis) setHandler(handler func(args []string) string) {
+	fr.mu.Lock()
+	fr.handler = handler
+	fr.mu.Unlock()
+}
+
+func (fr *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		cmd, err := readRESP(r)
+		if err != nil {
+			return
+		}
+		items, _ := cmd.([]interface{})
+		args := make([]string, len(items))
+		for i, item := range items {
+			args[i], _ = item.(string)
+		}
+
+		fr.mu.Lock()
+		reply := fr.handler(args)
+		fr.mu.Unlock()
+		conn.Write([]byte(reply))
+	}
+}
+
+// respBulk encodes s as a RESP bulk string
+func respBulk(s string) string {
+	return fmt.Sprintf("$%d\r\n%s\r\n", len(s), s)
+}
+
+func TestReadRESP(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"+OK\r\n", "OK"},
+		{":42\r\n", "42"},
+		{"$5\r\nhello\r\n", "hello"},
+		{"$-1\r\n", "<nil>"},
+		{"*2\r\n$3\r\nfoo\r\n:7\r\n", "[foo 7]"},
+		{"*1\r\n*2\r\n+a\r\n+b\r\n", "[[a b]]"},
+		{"-ERR unknown\r\n", "ERR unknown"},
+	}
+
+	for _, tt := range tests {
+		reply, err := readRESP(bufio.NewReader(strings.NewReader(tt.input)))
+		if err != nil {
+			t.Errorf("readRESP(%q) error: %v", tt.input, err)
+			continue
+		}
+		if got := fmt.Sprint(reply); got != tt.want {
+			t.Errorf("readRESP(%q) = %s, want %s", tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestRedisConnAuthAndInfo(t *testing.T) {
+	authed := false
+	fr := newFakeRedis(t, func(args []string) string {
+		switch strings.ToUpper(args[0]) {
+		case "AUTH":
+			if args[len(args)-1] != "secret" {
+				return "-WRONGPASS invalid password\r\n"
+			}
+			authed = true
+			return "+OK\r\n"
+		case "INFO":
+			if !authed {
+				return "-NOAUTH Authentication required.\r\n"
+			}
+			return respBulk("# Server\r\nredis_version:7.2.4\r\nprocess_id:4242\r\n")
+		}
+		return "-ERR unknown command\r\n"
+	})
+
+	if _, err := dialRedis(fr.addr(), "", "wrong", time.Second); err == nil {
+		t.Error("dialRedis() with a wrong password succeeded")
+	}
+
+	c, err := dialRedis(fr.addr(), "", "secret", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	pid, err := c.redisPID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pid != 4242 {
+		t.Errorf("redisPID() = %d, want 4242", pid)
+	}
+}
+
+func TestParseLatencyLatest(t *testing.T) {
+	reply := []interface{}{
+		[]interface{}{"command", int64(1700000000), int64(120), int64(300)},
+		[]interface{}{"fork", int64(1700000005), int64(15), int64(15)},
+	}
+
+	events, err := parseLatencyLatest(reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []latencyEvent{
+		{Name: "command", Timestamp: 1700000000, LatestMs: 120, MaxMs: 300},
+		{Name: "fork", Timestamp: 1700000005, LatestMs: 15, MaxMs: 15},
+	}
+	if fmt.Sprint(events) != fmt.Sprint(want) {
+		t.Errorf("parseLatencyLatest() = %v, want %v", events, want)
+	}
+
+	if _, err := parseLatencyLatest("OK"); err == nil {
+		t.Error("parseLatencyLatest() accepted a non-array reply")
+	}
+}
+
+// latencyReply encodes a LATENCY LATEST reply with a single command event
+func latencyReply(ts, latest int64) string {
+	return fmt.Sprintf("*1\r\n*4\r\n%s:%d\r\n:%d\r\n:%d\r\n", respBulk("command"), ts, latest, latest)
+}
+
+func TestRedisWatcherTriggers(t *testing.T) {
+	writeFakeProc(t, map[int]int{})
+	writeFakeStat(t, 4242, "redis-server", 0)
+
+	var ts, latest int64 = 100, 500
+	fr := newFakeRedis(t, nil)
+	fr.setHandler(func(args []string) string {
+		switch strings.ToUpper(args[0]) {
+		case "LATENCY":
+			return latencyReply(ts, latest)
+		case "INFO":
+			return respBulk("# Server\r\nprocess_id:4242\r\n")
+		}
+		return "-ERR unknown command\r\n"
+	})
+
+	cfg := redisWatchConfig{Instances: []redisWatchInstance{{Addr: fr.addr(), ThresholdMs: 100}}}
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	captured := make(chan profileMeta, 10)
+	rw := newRedisWatcher(cfg)
+	rw.capture = func(opts profileOptions, meta profileMeta) {
+		captured <- meta
+	}
+	inst := cfg.Instances[0]
+
+	poll := func(now time.Time) {
+		t.Helper()
+		if err := rw.poll(inst, now); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The first poll only records events that predate the watcher
+	start := time.Now()
+	poll(start)
+	select {
+	case meta := <-captured:
+		t.Fatalf("unexpected capture of an old event: %+v", meta)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// A new event below the threshold is ignored
+	fr.setHandler(func(args []string) string {
+		if strings.ToUpper(args[0]) == "LATENCY" {
+			return latencyReply(101, 20)
+		}
+		return "-ERR unknown command\r\n"
+	})
+	poll(start.Add(time.Second))
+
+	// A new spike above the threshold is profiled
+	ts, latest = 102, 250
+	fr.setHandler(func(args []string) string {
+		switch strings.ToUpper(args[0]) {
+		case "LATENCY":
+			return latencyReply(ts, latest)
+		case "INFO":
+			return respBulk("# Server\r\nprocess_id:4242\r\n")
+		}
+		return "-ERR unknown command\r\n"
+	})
+	poll(start.Add(2 * time.Second))
+
+	select {
+	case meta := <-captured:
+		if meta.PID != "4242" || meta.Trigger != "redis-latency" {
+			t.Errorf("capture meta = %+v, want PID 4242 with trigger redis-latency", meta)
+		}
+		if !strings.Contains(meta.TriggerReason, "command latency 250ms") {
+			t.Errorf("TriggerReason = %q, want the latency event", meta.TriggerReason)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("spike did not trigger a capture")
+	}
+
+	// Another spike within the cooldown is not profiled
+	ts = 103
+	poll(start.Add(3 * time.Second))
+	select {
+	case meta := <-captured:
+		t.Errorf("capture during cooldown: %+v", meta)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestRedisWatchConfigValidation(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     redisWatchConfig
+		wantErr bool
+	}{
+		{"valid", redisWatchConfig{Instances: []redisWatchInstance{{Addr: "127.0.0.1:6379", ThresholdMs: 50}}}, false},
+		{"missing addr", redisWatchConfig{Instances: []redisWatchInstance{{ThresholdMs: 50}}}, true},
+		{"missing threshold", redisWatchConfig{Instances: []redisWatchInstance{{Addr: "127.0.0.1:6379"}}}, true},
+		{"bad format", redisWatchConfig{Instances: []redisWatchInstance{{Addr: "127.0.0.1:6379", ThresholdMs: 50, Format: "svg"}}}, true},
+		{"too long", redisWatchConfig{Instances: []redisWatchInstance{{Addr: "127.0.0.1:6379", ThresholdMs: 50, Seconds: 301}}}, true},
+	}
+
+	for _, tt := range tests {
+		err := tt.cfg.validate()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: validate() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
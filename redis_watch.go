@@ -0,0 +1,239 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// redisWatchConfig configures captures triggered by Redis latency events
+type redisWatchConfig struct {
+	// Interval between LATENCY LATEST polls (default 1s)
+	Interval  duration             `json:"interval"`
+	Instances []redisWatchInstance `json:"instances"`
+}
+
+// redisWatchInstance is one Redis server polled for latency spikes
+type redisWatchInstance struct {
+	Addr     string `json:"addr"`
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	// PasswordFile and PasswordEnv read the password from a file or an
+	// environment variable instead
+	PasswordFile string `json:"password_file,omitempty"`
+	PasswordEnv  string `json:"password_env,omitempty"`
+	// ThresholdMs is the latency spike that triggers a capture
+	ThresholdMs int64  `json:"threshold_ms"`
+	Seconds     int    `json:"seconds"`
+	Format      string `json:"format"`
+	// Cooldown suppresses new captures of the same instance (default 5m)
+	Cooldown duration `json:"cooldown"`
+}
+
+func (c *redisWatchConfig) validate() error {
+	if c.Interval == 0 {
+		c.Interval = duration(time.Second)
+	}
+	for i := range c.Instances {
+		inst := &c.Instances[i]
+		if inst.Addr == "" {
+			return fmt.Errorf("instance %d: addr is required", i+1)
+		}
+		password, err := resolveSecret(inst.Password, inst.PasswordFile, inst.PasswordEnv)
+		if err != nil {
+			return fmt.Errorf("%s: password: %v", inst.Addr, err)
+		}
+		inst.Password = password
+		if inst.ThresholdMs <= 0 {
+			return fmt.Errorf("%s: threshold_ms must be positive", inst.Addr)
+		}
+		if inst.Seconds == 0 {
+			inst.Seconds = 10
+		}
+		if inst.Seconds < 0 || inst.Seconds > 300 {
+			return fmt.Errorf("%s: seconds must be between 1 and 300", inst.Addr)
+		}
+		switch inst.Format {
+		case "":
+			inst.Format = "pprof"
+		case "pprof", "folded":
+		default:
+			return fmt.Errorf("%s: format must be pprof or folded", inst.Addr)
+		}
+		if inst.Cooldown == 0 {
+			inst.Cooldown = duration(5 * time.Minute)
+		}
+	}
+	return nil
+}
+
+// latencyEvent is one entry of LATENCY LATEST
+type latencyEvent struct {
+	Name      string
+	Timestamp int64
+	LatestMs  int64
+	MaxMs     int64
+}
+
+// parseLatencyLatest decodes the reply of LATENCY LATEST
+func parseLatencyLatest(reply interface{}) ([]latencyEvent, error) {
+	items, ok := reply.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("unexpected LATENCY LATEST reply %T", reply)
+	}
+
+	var events []latencyEvent
+	for _, item := range items {
+		fields, ok := item.([]interface{})
+		if !ok || len(fields) < 4 {
+			return nil, fmt.Errorf("unexpected LATENCY LATEST entry %v", item)
+		}
+		name, _ := fields[0].(string)
+		ev := latencyEvent{Name: name}
+		ev.Timestamp, _ = fields[1].(int64)
+		ev.LatestMs, _ = fields[2].(int64)
+		ev.MaxMs, _ = fields[3].(int64)
+		events = append(events, ev)
+	}
+	return events, nil
+}
+
+// redisWatcher polls LATENCY LATEST on configured instances and profiles the
+// redis-server process behind an instance when a new spike is recorded
+type redisWatcher struct {
+	cfg redisWatchConfig
+
+	mu          sync.Mutex
+	conns       map[string]*redisConn
+	seen        map[string]int64 // latest timestamp per instance and event
+	lastTrigger map[string]time.Time
+	capturing   map[string]bool
+
+	// capture takes and stores the profile; replaced in tests
+	capture func(opts profileOptions, meta profileMeta)
+}
+
+func newRedisWatcher(cfg redisWatchConfig) *redisWatcher {
+	return &redisWatcher{
+		cfg:         cfg,
+		conns:       make(map[string]*redisConn),
+		seen:        make(map[string]int64),
+		lastTrigger: make(map[string]time.Time),
+		capturing:   make(map[string]bool),
+		capture: func(opts profileOptions, meta profileMeta) {
+			if _, err := captureToStore(opts, meta); err != nil {
+				log.Printf("Redis latency capture of PID %s failed: %v", opts.PID, err)
+			}
+		},
+	}
+}
+
+// run polls all instances until stop is closed
+func (rw *redisWatcher) run(stop <-chan struct{}) {
+	ticker := time.NewTicker(time.Duration(rw.cfg.Interval))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			for _, inst := range rw.cfg.Instances {
+				if err := rw.poll(inst, now); err != nil {
+					log.Printf("Redis watcher %s: %v", inst.Addr, err)
+				}
+			}
+		}
+	}
+}
+
+// conn returns a cached connection to inst, dialing it if needed
+func (rw *redisWatcher) conn(inst redisWatchInstance) (*redisConn, error) {
+	if c, ok := rw.conns[inst.Addr]; ok {
+		return c, nil
+	}
+	c, err := dialRedis(inst.Addr, inst.Username, inst.Password, 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	rw.conns[inst.Addr] = c
+	return c, nil
+}
+
+// poll checks one instance for new latency spikes
+func (rw *redisWatcher) poll(inst redisWatchInstance, now time.Time) error {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+
+	c, err := rw.conn(inst)
+	if err != nil {
+		return err
+	}
+	reply, err := c.Do("LATENCY", "LATEST")
+	if err != nil {
+		c.Close()
+		delete(rw.conns, inst.Addr)
+		return err
+	}
+	events, err := parseLatencyLatest(reply)
+	if err != nil {
+		return err
+	}
+
+	var spike *latencyEvent
+	for i, ev := range events {
+		key := inst.Addr + "/" + ev.Name
+		prev, known := rw.seen[key]
+		rw.seen[key] = ev.Timestamp
+
+		// Events already present on the first poll predate the watcher
+		if !known || ev.Timestamp <= prev || ev.LatestMs < inst.ThresholdMs {
+			continue
+		}
+		if spike == nil || ev.LatestMs > spike.LatestMs {
+			spike = &events[i]
+		}
+	}
+	if spike == nil {
+		return nil
+	}
+
+	if rw.capturing[inst.Addr] || now.Sub(rw.lastTrigger[inst.Addr]) < time.Duration(inst.Cooldown) {
+		return nil
+	}
+
+	pid, err := c.redisPID()
+	if err != nil {
+		return err
+	}
+	// A Redis server in another PID namespace reports a PID we cannot profile
+	if _, err := readComm(pid); err != nil {
+		return fmt.Errorf("redis-server PID %d is not visible to the exporter: %v", pid, err)
+	}
+
+	rw.lastTrigger[inst.Addr] = now
+	rw.capturing[inst.Addr] = true
+
+	opts := profileOptions{
+		PID:         strconv.Itoa(pid),
+		Duration:    inst.Seconds,
+		Stacks:      "both",
+		CallGraph:   "fp",
+		LBRFallback: "fp",
+	}
+	meta := captureMeta(opts, inst.Format)
+	meta.Trigger = "redis-latency"
+	meta.TriggerReason = fmt.Sprintf("%s: %s latency %dms >= %dms (max %dms)", inst.Addr, spike.Name, spike.LatestMs, inst.ThresholdMs, spike.MaxMs)
+
+	log.Printf("Redis watcher %s: %s, capturing %ds profile of PID %d", inst.Addr, meta.TriggerReason, inst.Seconds, pid)
+	go func(addr string) {
+		rw.capture(opts, meta)
+		rw.mu.Lock()
+		rw.capturing[addr] = false
+		rw.mu.Unlock()
+	}(inst.Addr)
+
+	return nil
+}
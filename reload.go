@@ -0,0 +1,181 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// serverState holds the settings a reload replaces: credentials, rate
+// limits, the target policy and the automatic capture definitions.
+// Requests keep the state they started with, so reloading never affects
+// captures in flight.
+type serverState struct {
+	cfg           *config
+	checkPassword func(user, pass string) bool
+	jwt           *jwtVerifier
+	limiter       *rateLimiter
+	alerts        *alertReceiver
+	userBpftrace  *userBpftraceHandler
+	// stopWatchers stops the watchdog, Redis watcher and profile pusher of
+	// this state
+	stopWatchers chan struct{}
+}
+
+// state is the server state in effect
+var state atomic.Pointer[serverState]
+
+// reloader builds the server state from the configuration file and the
+// authentication flags
+type reloader struct {
+	confPath string
+	// password comes from -password or $BCC_EXPORTER_PASSWORD, which
+	// cannot change after startup; passFile is read again on reload
+	password string
+	passFile string
+	users    *htpasswdFile
+
+	mu sync.Mutex
+}
+
+// load reads the configuration file and -password-file into a new state,
+// reusing the parts of prev whose configuration did not change so rate
+// limit buckets and capture cooldowns survive a reload
+func (rl *reloader) load(prev *serverState) (*serverState, error) {
+	cfg, err := loadConfig(rl.confPath)
+	if err != nil {
+		return nil, err
+	}
+	if (len(cfg.Watchdog.Rules) > 0 || len(cfg.RedisWatch.Instances) > 0) && store == nil {
+		return nil, fmt.Errorf("the CPU watchdog and Redis latency watcher store their captures and require a profile store (-store-dir or the storage section)")
+	}
+
+	password := rl.password
+	if rl.passFile != "" {
+		if password, err = readSecretFile(rl.passFile); err != nil {
+			return nil, fmt.Errorf("-password-file: %v", err)
+		}
+	}
+
+	s := &serverState{cfg: cfg, userBpftrace: newUserBpftraceHandler(cfg.BpftraceUser)}
+	if password != "" {
+		s.checkPassword = func(user, pass string) bool {
+			return user == "admin" && subtle.ConstantTimeCompare([]byte(pass), []byte(password)) == 1
+		}
+	} else if rl.users != nil {
+		s.checkPassword = rl.users.check
+	}
+
+	if prev != nil && reflect.DeepEqual(prev.cfg.OIDC, cfg.OIDC) {
+		s.jwt = prev.jwt
+	} else {
+		s.jwt = newJWTVerifier(cfg.OIDC)
+	}
+	if prev != nil && prev.cfg.RateLimit == cfg.RateLimit {
+		s.limiter = prev.limiter
+	} else {
+		s.limiter = newRateLimiter(cfg.RateLimit)
+		if prev != nil {
+			s.limiter.inherit(prev.limiter)
+		}
+	}
+	if prev != nil && prev.cfg.Alertmanager == cfg.Alertmanager {
+		s.alerts = prev.alerts
+	} else {
+		s.alerts = newAlertReceiver(cfg.Alertmanager)
+	}
+	return s, nil
+}
+
+// apply makes s the state in effect, restarting the watchers when their
+// definitions changed
+func (rl *reloader) apply(s, prev *serverState) {
+	p := s.cfg.TargetPolicy
+	policy.Store(&p)
+
+	watchersChanged := prev == nil ||
+		!reflect.DeepEqual(prev.cfg.Watchdog, s.cfg.Watchdog) ||
+		!reflect.DeepEqual(prev.cfg.RedisWatch, s.cfg.RedisWatch) ||
+		!reflect.DeepEqual(prev.cfg.GrafanaCloud, s.cfg.GrafanaCloud)
+	if !watchersChanged {
+		s.stopWatchers = prev.stopWatchers
+	} else {
+		if prev != nil {
+			close(prev.stopWatchers)
+		}
+		s.stopWatchers = make(chan struct{})
+		if len(s.cfg.Watchdog.Rules) > 0 {
+			go newWatchdog(s.cfg.Watchdog).run(s.stopWatchers)
+			log.Printf("CPU watchdog enabled with %d rules", len(s.cfg.Watchdog.Rules))
+		}
+		if len(s.cfg.RedisWatch.Instances) > 0 {
+			go newRedisWatcher(s.cfg.RedisWatch).run(s.stopWatchers)
+			log.Printf("Redis latency watcher enabled for %d instances", len(s.cfg.RedisWatch.Instances))
+		}
+		if len(s.cfg.GrafanaCloud.Targets) > 0 {
+			pp := newProfilePusher(s.cfg.GrafanaCloud)
+			go pp.run(s.stopWatchers)
+			log.Printf("Pushing profiles of %d targets to %s every %s", len(s.cfg.GrafanaCloud.Targets), pp.endpoint, time.Duration(s.cfg.GrafanaCloud.Interval))
+		}
+	}
+	state.Store(s)
+
+	if p.restricted() {
+		log.Printf("Target policy enabled with %d allow and %d deny rules", len(p.Allow), len(p.Deny))
+	}
+	if s.limiter != nil {
+		log.Printf("Rate limiting captures to %g per minute per %s (burst %d)", s.cfg.RateLimit.RequestsPerMinute, s.cfg.RateLimit.Key, s.cfg.RateLimit.Burst)
+	}
+	if s.jwt != nil {
+		log.Printf("Bearer token authentication enabled for issuer %s", s.cfg.OIDC.Issuer)
+	}
+}
+
+// reload replaces the state in effect; on error the previous state stays
+func (rl *reloader) reload() error {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	prev := state.Load()
+	if prev != nil {
+		notify("RELOADING=1")
+		defer notify("READY=1")
+	}
+	s, err := rl.load(prev)
+	if err != nil {
+		return err
+	}
+	rl.apply(s, prev)
+	return nil
+}
+
+// handleSIGHUP reloads the configuration whenever the process gets SIGHUP
+func (rl *reloader) handleSIGHUP() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		log.Printf("Reloading configuration on SIGHUP")
+		if err := rl.reload(); err != nil {
+			log.Printf("Reload failed, keeping the previous configuration: %v", err)
+		}
+	}
+}
+
+// ServeHTTP reloads the configuration for POST /-/reload
+func (rl *reloader) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	log.Printf("Reloading configuration on request from %s", r.RemoteAddr)
+	if err := rl.reload(); err != nil {
+		log.Printf("Reload failed, keeping the previous configuration: %v", err)
+		http.Error(w, fmt.Sprintf("Reload failed, keeping the previous configuration: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.Write([]byte("Configuration reloaded\n"))
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newTestReloader returns a reloader of a configuration file that write
+// replaces, restoring the server state and target policy after the test
+func newTestReloader(t *testing.T) (*reloader, func(config string)) {
+	t.Helper()
+	dir := t.TempDir()
+	rl := &reloader{confPath: filepath.Join(dir, "config.json"), passFile: filepath.Join(dir, "password")}
+
+	origState, origPolicy := state.Load(), policy.Load()
+	t.Cleanup(func() {
+		state.Store(origState)
+		policy.Store(origPolicy)
+	})
+
+	write := func(config string) {
+		t.Helper()
+		if err := os.WriteFile(rl.confPath, []byte(config), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return rl, write
+}
+
+func TestReload(t *testing.T) {
+	writeFakeTargets(t)
+	rl, write := newTestReloader(t)
+	if err := os.WriteFile(rl.passFile, []byte("first\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	write(`{"rate_limit": {"requests_per_minute": 6}, "target_policy": {"allow": [{"comm": "^redis-server$"}]}}`)
+	if err := rl.reload(); err != nil {
+		t.Fatal(err)
+	}
+	first := state.Load()
+	if currentPolicy().check("20") == nil {
+		t.Error("policy of the first configuration allows sshd")
+	}
+	if !first.checkPassword("admin", "first") {
+		t.Error("password from -password-file was rejected")
+	}
+
+	// Unchanged sections keep their state, changed ones are replaced
+	if err := os.WriteFile(rl.passFile, []byte("second\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	write(`{"rate_limit": {"requests_per_minute": 6}, "target_policy": {"allow": [{"comm": "^(redis-server|sshd)$"}]}}`)
+	if err := rl.reload(); err != nil {
+		t.Fatal(err)
+	}
+	second := state.Load()
+	if second.limiter != first.limiter {
+		t.Error("rate limiter was replaced although its configuration did not change")
+	}
+	if second.alerts != first.alerts {
+		t.Error("alert receiver was replaced although its configuration did not change")
+	}
+	if err := currentPolicy().check("20"); err != nil {
+		t.Errorf("reloaded policy refuses sshd: %v", err)
+	}
+	if second.checkPassword("admin", "first") || !second.checkPassword("admin", "second") {
+		t.Error("password was not re-read from -password-file")
+	}
+
+	// An invalid configuration keeps the previous one in effect
+	write(`{"target_policy": {"allow": [{"comm": "("}]}}`)
+	if err := rl.reload(); err == nil {
+		t.Error("reload of an invalid configuration succeeded")
+	}
+	if state.Load() != second || currentPolicy().check("20") != nil {
+		t.Error("failed reload replaced the configuration")
+	}
+
+	// The watchers need the profile store
+	write(`{"watchdog": {"rules": [{"comm": "redis-server", "cpu_percent": 90, "for": "10s"}]}}`)
+	if err := rl.reload(); err == nil {
+		t.Error("reload enabled the watchdog without a profile store")
+	}
+}
+
+func TestReloadEndpoint(t *testing.T) {
+	rl, write := newTestReloader(t)
+	rl.passFile = ""
+
+	tests := []struct {
+		config   string
+		wantCode int
+	}{
+		{`{"rate_limit": {"requests_per_minute": 10}}`, http.StatusOK},
+		{`{"rate_limit": {"key": "header"}}`, http.StatusInternalServerError},
+		{`not json`, http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		write(tt.config)
+		rr := httptest.NewRecorder()
+		rl.ServeHTTP(rr, httptest.NewRequest("POST", "/-/reload", nil))
+		if rr.Code != tt.wantCode {
+			t.Errorf("%s: status = %d, want %d: %s", tt.config, rr.Code, tt.wantCode, rr.Body.String())
+		}
+	}
+	if s := state.Load(); s == nil || s.cfg.RateLimit.RequestsPerMinute != 10 {
+		t.Error("failed reloads replaced the last valid configuration")
+	}
+}
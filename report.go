@@ -0,0 +1,212 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+
+	"github.com/google/pprof/profile"
+)
+
+// defaultNodeCount is how many functions the top and summary-json reports
+// list without nodecount
+const defaultNodeCount = 10
+
+// reportFormats are the formats of the pprof endpoint rendered from the
+// pprof capture, which is what the store keeps
+var reportFormats = map[string]string{
+	"top":          "text/plain; charset=utf-8",
+	"summary-json": "application/json",
+	"callgrind":    "application/octet-stream",
+	"html":         "text/html; charset=utf-8",
+	"bundle":       "application/gzip",
+}
+
+// functionSummary is the flat and cumulative weight of one function
+type functionSummary struct {
+	Name string `json:"name"`
+	// Flat counts the samples the function was running in, Cum those it
+	// was on the stack of
+	Flat        int64   `json:"flat"`
+	FlatPercent float64 `json:"flat_percent"`
+	SumPercent  float64 `json:"sum_percent"`
+	Cum         int64   `json:"cum"`
+	CumPercent  float64 `json:"cum_percent"`
+	// IPC is the instructions per cycle of the function itself, in
+	// profiles counting both, e.g. of event=ipc
+	IPC *float64 `json:"ipc,omitempty"`
+}
+
+// profileSummary is the summary-json report of a profile
+type profileSummary struct {
+	PID        string `json:"pid,omitempty"`
+	Comm       string `json:"comm,omitempty"`
+	SampleType string `json:"sample_type"`
+	Unit       string `json:"unit"`
+	Total      int64  `json:"total"`
+	// IPC is the instructions per cycle of the whole profile
+	IPC *float64 `json:"ipc,omitempty"`
+	// Functions counts the functions of the profile, of which the top ones
+	// are listed in Top
+	Functions int               `json:"functions"`
+	Top       []functionSummary `json:"top"`
+}
+
+// percent returns v as a percentage of total, rounded to two decimals
+func percent(v, total int64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(v*10000/total) / 100
+}
+
+// summarizeProfile returns the n functions of p with the most flat samples,
+// as pprof -top lists them
+func summarizeProfile(p *profile.Profile, n int) profileSummary {
+	index := sampleIndex(p)
+	sum := profileSummary{Top: []functionSummary{}}
+	if index >= 0 {
+		sum.SampleType, sum.Unit = p.SampleType[index].Type, p.SampleType[index].Unit
+	}
+	flat := make(map[string]int64)
+	cum := make(map[string]int64)
+	ins, cyc, hasIPC := ipcIndexes(p)
+	instructions := make(map[string]int64)
+	cycles := make(map[string]int64)
+	var totalInstructions, totalCycles int64
+	for _, s := range p.Sample {
+		stack := sampleStack(s)
+		// Instructions and cycles are sampled apart, so a sample holds
+		// one of them and the ratio is only meaningful per function
+		if hasIPC {
+			totalInstructions += s.Value[ins]
+			totalCycles += s.Value[cyc]
+			if len(stack) > 0 {
+				instructions[stack[len(stack)-1]] += s.Value[ins]
+				cycles[stack[len(stack)-1]] += s.Value[cyc]
+			}
+		}
+		if index < 0 || s.Value[index] == 0 {
+			continue
+		}
+		v := s.Value[index]
+		sum.Total += v
+		if len(stack) == 0 {
+			continue
+		}
+		flat[stack[len(stack)-1]] += v
+		// Recursive functions count once per sample
+		seen := make(map[string]bool, len(stack))
+		for _, name := range stack {
+			if !seen[name] {
+				seen[name] = true
+				cum[name] += v
+			}
+		}
+	}
+
+	funcs := make([]functionSummary, 0, len(cum))
+	for name, c := range cum {
+		funcs = append(funcs, functionSummary{Name: name, Flat: flat[name], Cum: c})
+	}
+	sort.Slice(funcs, func(i, j int) bool {
+		if funcs[i].Flat != funcs[j].Flat {
+			return funcs[i].Flat > funcs[j].Flat
+		}
+		if funcs[i].Cum != funcs[j].Cum {
+			return funcs[i].Cum > funcs[j].Cum
+		}
+		return funcs[i].Name < funcs[j].Name
+	})
+	sum.Functions = len(funcs)
+	if hasIPC {
+		sum.IPC = instructionsPerCycle(totalInstructions, totalCycles)
+	}
+	var running int64
+	for _, f := range funcs[:min(n, len(funcs))] {
+		running += f.Flat
+		f.FlatPercent = percent(f.Flat, sum.Total)
+		f.SumPercent = percent(running, sum.Total)
+		f.CumPercent = percent(f.Cum, sum.Total)
+		if hasIPC {
+			f.IPC = instructionsPerCycle(instructions[f.Name], cycles[f.Name])
+		}
+		sum.Top = append(sum.Top, f)
+	}
+	return sum
+}
+
+// writeTopReport writes sum in the layout of pprof -top
+func writeTopReport(w io.Writer, sum profileSummary) {
+	var shown int64
+	for _, f := range sum.Top {
+		shown += f.Flat
+	}
+	fmt.Fprintf(w, "Showing nodes accounting for %d, %.2f%% of %d total\n", shown, percent(shown, sum.Total), sum.Total)
+	if len(sum.Top) < sum.Functions {
+		fmt.Fprintf(w, "Showing top %d nodes out of %d\n", len(sum.Top), sum.Functions)
+	}
+	if sum.IPC == nil {
+		fmt.Fprintf(w, "%10s %6s %6s %10s %6s\n", "flat", "flat%", "sum%", "cum", "cum%")
+		for _, f := range sum.Top {
+			fmt.Fprintf(w, "%10d %5.2f%% %5.2f%% %10d %5.2f%%  %s\n", f.Flat, f.FlatPercent, f.SumPercent, f.Cum, f.CumPercent, f.Name)
+		}
+		return
+	}
+
+	// Profiles counting instructions and cycles get an IPC column, low
+	// for functions stalled on memory and high for compute-bound ones
+	fmt.Fprintf(w, "%.2f instructions per cycle\n", *sum.IPC)
+	fmt.Fprintf(w, "%10s %6s %6s %10s %6s %5s\n", "flat", "flat%", "sum%", "cum", "cum%", "ipc")
+	for _, f := range sum.Top {
+		ipc := "-"
+		if f.IPC != nil {
+			ipc = fmt.Sprintf("%.2f", *f.IPC)
+		}
+		fmt.Fprintf(w, "%10d %5.2f%% %5.2f%% %10d %5.2f%% %5s  %s\n", f.Flat, f.FlatPercent, f.SumPercent, f.Cum, f.CumPercent, ipc, f.Name)
+	}
+}
+
+// writeReport renders the pprof or folded capture data of meta in report
+// format, limiting top and summary-json to n functions
+func writeReport(w http.ResponseWriter, format string, meta profileMeta, data []byte, n int) {
+	p, err := parseProfileData(data)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to read pprof profile: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if format == "html" {
+		w.Header().Set("Content-Type", reportFormats[format])
+		if err := renderFlameGraphHTML(w, flameTreeFromFolded(profileToFolded(p)), flameTitle(meta)); err != nil {
+			log.Printf("Failed to write flamegraph page: %v", err)
+		}
+		return
+	}
+	if format == "bundle" {
+		w.Header().Set("Content-Type", reportFormats[format])
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=profile-%s-%d.tar.gz", meta.PID, meta.Duration))
+		if err := writeBundle(w, meta, p); err != nil {
+			log.Printf("Failed to write profile bundle: %v", err)
+		}
+		return
+	}
+	if format == "callgrind" {
+		w.Header().Set("Content-Type", reportFormats[format])
+		// KCachegrind lists files named like valgrind's output
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=callgrind.out.%s", meta.PID))
+		if err := writeCallgrind(w, p); err != nil {
+			log.Printf("Failed to write callgrind profile: %v", err)
+		}
+		return
+	}
+	sum := summarizeProfile(p, n)
+	sum.PID, sum.Comm = meta.PID, meta.Comm
+	if format == "summary-json" {
+		writeJSON(w, http.StatusOK, sum)
+		return
+	}
+	w.Header().Set("Content-Type", reportFormats[format])
+	writeTopReport(w, sum)
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestSummarizeProfile(t *testing.T) {
+	p, err := parseProfileData([]byte("main;processCommand;dictFind 6\nmain;processCommand;dictFind 2\nmain;aeMain;epoll_wait 3\nmain;processCommand 1\nmain;sort;sort 4\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := summarizeProfile(p, 3)
+	if sum.Total != 16 || sum.Functions != 6 || len(sum.Top) != 3 {
+		t.Fatalf("summary = %+v", sum)
+	}
+	want := []functionSummary{
+		{Name: "dictFind", Flat: 8, FlatPercent: 50, SumPercent: 50, Cum: 8, CumPercent: 50},
+		// Recursion counts once towards cum
+		{Name: "sort", Flat: 4, FlatPercent: 25, SumPercent: 75, Cum: 4, CumPercent: 25},
+		{Name: "epoll_wait", Flat: 3, FlatPercent: 18.75, SumPercent: 93.75, Cum: 3, CumPercent: 18.75},
+	}
+	for i, f := range sum.Top {
+		if f != want[i] {
+			t.Errorf("top[%d] = %+v, want %+v", i, f, want[i])
+		}
+	}
+	if all := summarizeProfile(p, 100); len(all.Top) != 6 || all.Top[3].Name != "processCommand" || all.Top[3].Cum != 9 || all.Top[4].Name != "main" || all.Top[4].CumPercent != 100 {
+		t.Errorf("all functions = %+v", all.Top)
+	}
+
+	var top strings.Builder
+	writeTopReport(&top, sum)
+	for _, line := range []string{
+		"Showing nodes accounting for 15, 93.75% of 16 total",
+		"Showing top 3 nodes out of 6",
+		"      flat  flat%   sum%        cum   cum%",
+		"         8 50.00% 50.00%          8 50.00%  dictFind",
+	} {
+		if !strings.Contains(top.String(), line+"\n") {
+			t.Errorf("top report lacks %q:\n%s", line, top.String())
+		}
+	}
+}
+
+func TestReportFormats(t *testing.T) {
+	for _, tc := range []struct {
+		query       string
+		code        int
+		contentType string
+	}{
+		{"format=top", http.StatusOK, "text/plain; charset=utf-8"},
+		{"format=summary-json&nodecount=2", http.StatusOK, "application/json"},
+		{"format=top&nodecount=0", http.StatusBadRequest, ""},
+		{"format=top&nodecount=101", http.StatusBadRequest, ""},
+		{"nodecount=5", http.StatusBadRequest, ""},
+	} {
+		rr := httptest.NewRecorder()
+		handlePprof(rr, httptest.NewRequest("GET", "/debug/pprof/profile?pid=1234&seconds=5&test=true&"+tc.query, nil))
+		if rr.Code != tc.code {
+			t.Errorf("%s: status %d: %s", tc.query, rr.Code, rr.Body.String())
+			continue
+		}
+		if tc.code != http.StatusOK {
+			continue
+		}
+		if ct := rr.Header().Get("Content-Type"); ct != tc.contentType {
+			t.Errorf("%s: Content-Type %s", tc.query, ct)
+		}
+		if tc.contentType == "application/json" {
+			var sum profileSummary
+			if err := json.Unmarshal(rr.Body.Bytes(), &sum); err != nil || sum.PID != "1234" || sum.Total == 0 || len(sum.Top) != 2 {
+				t.Errorf("%s: %s, %v", tc.query, rr.Body.String(), err)
+			}
+		} else if !strings.HasPrefix(rr.Body.String(), "Showing nodes accounting for") {
+			t.Errorf("%s: %s", tc.query, rr.Body.String())
+		}
+	}
+
+	rr := httptest.NewRecorder()
+	handleFolded(rr, httptest.NewRequest("GET", "/debug/folded/profile?pid=1234&seconds=5&test=true&format=top", nil))
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("format=top on the folded endpoint: %d", rr.Code)
+	}
+}
+
+const ipcPerfScript = `redis-server  1234/1234  5000.100000:    3000000 cycles:
+	    55d0c1a2b3c4 dictFind (/usr/bin/redis-server)
+	    55d0c1a2b000 processCommand (/usr/bin/redis-server)
+
+redis-server  1234/1234  5000.100500:    1200000 instructions:
+	    55d0c1a2b3c4 dictFind (/usr/bin/redis-server)
+	    55d0c1a2b000 processCommand (/usr/bin/redis-server)
+
+redis-server  1234/1234  5000.200000:    1000000 cpu_core/cycles/u:
+	    55d0c1a2b800 __memmove_avx_unaligned_erms (/usr/lib/x86_64-linux-gnu/libc.so.6)
+	    55d0c1a2b000 processCommand (/usr/bin/redis-server)
+
+redis-server  1234/1234  5000.200500:    3000000 instructions:u:
+	    55d0c1a2b800 __memmove_avx_unaligned_erms (/usr/lib/x86_64-linux-gnu/libc.so.6)
+	    55d0c1a2b000 processCommand (/usr/bin/redis-server)
+`
+
+func TestIPCReport(t *testing.T) {
+	opts, err := parseCaptureOptions(url.Values{"pid": {"100"}, "seconds": {"5"}, "event": {"ipc"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if args := strings.Join(perfRecordArgs(opts, "perf.data"), " "); !strings.Contains(args, "-e cycles -e instructions") {
+		t.Errorf("perf args %q should record cycles and instructions", args)
+	}
+
+	samples, err := parsePerfScript(strings.NewReader(ipcPerfScript))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := buildProfile(samples, nil, nil, ipcWeights())
+	if err := p.CheckValid(); err != nil {
+		t.Fatal(err)
+	}
+
+	sum := summarizeProfile(p, 10)
+	if sum.SampleType != "cycles" || sum.Total != 4000000 {
+		t.Errorf("summary of %s, total %d", sum.SampleType, sum.Total)
+	}
+	if sum.IPC == nil || *sum.IPC != 1.05 {
+		t.Errorf("IPC = %v, want 1.05", sum.IPC)
+	}
+	want := map[string]float64{"dictFind": 0.4, "__memmove_avx_unaligned_erms": 3}
+	for _, f := range sum.Top[:2] {
+		if f.IPC == nil || *f.IPC != want[f.Name] {
+			t.Errorf("IPC of %s = %v, want %v", f.Name, f.IPC, want[f.Name])
+		}
+	}
+	// processCommand never runs itself
+	if len(sum.Top) != 3 || sum.Top[2].Name != "processCommand" || sum.Top[2].IPC != nil {
+		t.Errorf("top = %+v", sum.Top)
+	}
+
+	var top strings.Builder
+	writeTopReport(&top, sum)
+	for _, want := range []string{"1.05 instructions per cycle", "cum%   ipc", " 0.40  dictFind", "     -  processCommand"} {
+		if !strings.Contains(top.String(), want) {
+			t.Errorf("top report lacks %q:\n%s", want, top.String())
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// maxCaptureRequest bounds the JSON body of a capture request
+const maxCaptureRequest = 64 << 10
+
+// captureTarget selects the process of a capture request
+type captureTarget struct {
+	PID       int    `json:"pid,omitempty"`
+	RedisPort int    `json:"redis_port,omitempty"`
+	Container string `json:"container,omitempty"`
+	TID       int    `json:"tid,omitempty"`
+	Children  bool   `json:"children,omitempty"`
+}
+
+// captureRequest is the JSON body capture endpoints accept with POST, as an
+// alternative to the query string. Its fields are the query parameters of
+// the same names.
+type captureRequest struct {
+	Target  captureTarget `json:"target,omitempty"`
+	Seconds int           `json:"seconds"`
+	Delay   int           `json:"delay,omitempty"`
+
+	Frequency int               `json:"frequency,omitempty"`
+	Event     string            `json:"event,omitempty"`
+	Mode      string            `json:"mode,omitempty"`
+	Labels    map[string]string `json:"labels,omitempty"`
+
+	Format         string `json:"format,omitempty"`
+	Backend        string `json:"backend,omitempty"`
+	Runtime        string `json:"runtime,omitempty"`
+	Stacks         string `json:"stacks,omitempty"`
+	CallGraph      string `json:"callgraph,omitempty"`
+	DwarfSize      int    `json:"dwarf_size,omitempty"`
+	LBRFallback    string `json:"lbr_fallback,omitempty"`
+	ThreadLabels   bool   `json:"thread_labels,omitempty"`
+	Snapshots      int    `json:"snapshots,omitempty"`
+	StreamInterval int    `json:"stream_interval,omitempty"`
+	RedisMetadata  bool   `json:"redis_metadata,omitempty"`
+	RedisAddr      string `json:"redis_addr,omitempty"`
+	Queue          bool   `json:"queue,omitempty"`
+	Test           bool   `json:"test,omitempty"`
+
+	// Parameters of single endpoints
+	Parallel int      `json:"parallel,omitempty"`
+	Commands []string `json:"commands,omitempty"`
+	Script   string   `json:"script,omitempty"`
+}
+
+// values returns the query parameters equivalent to c
+func (c captureRequest) values() url.Values {
+	q := url.Values{}
+	setString := func(name, v string) {
+		if v != "" {
+			q.Set(name, v)
+		}
+	}
+	setInt := func(name string, n int) {
+		if n != 0 {
+			q.Set(name, strconv.Itoa(n))
+		}
+	}
+	setBool := func(name string, b bool) {
+		if b {
+			q.Set(name, "true")
+		}
+	}
+
+	setInt("pid", c.Target.PID)
+	setInt("redis_port", c.Target.RedisPort)
+	setString("container", c.Target.Container)
+	setInt("tid", c.Target.TID)
+	setBool("children", c.Target.Children)
+	setInt("seconds", c.Seconds)
+	setInt("delay", c.Delay)
+	setInt("frequency", c.Frequency)
+	setString("event", c.Event)
+	setString("mode", c.Mode)
+	setString("format", c.Format)
+	setString("backend", c.Backend)
+	setString("runtime", c.Runtime)
+	setString("stacks", c.Stacks)
+	setString("callgraph", c.CallGraph)
+	setInt("dwarf_size", c.DwarfSize)
+	setString("lbr_fallback", c.LBRFallback)
+	setBool("thread_labels", c.ThreadLabels)
+	setInt("snapshots", c.Snapshots)
+	setInt("stream_interval", c.StreamInterval)
+	setBool("redis_metadata", c.RedisMetadata)
+	setString("redis_addr", c.RedisAddr)
+	setBool("queue", c.Queue)
+	setBool("test", c.Test)
+	setInt("parallel", c.Parallel)
+	setString("commands", strings.Join(c.Commands, ","))
+	setString("script", c.Script)
+
+	names := make([]string, 0, len(c.Labels))
+	for name := range c.Labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		q.Add("label", name+":"+c.Labels[name])
+	}
+	return q
+}
+
+// jsonCaptureRequest lets the capture endpoint handler take its parameters
+// from a captureRequest sent with POST: they are merged into the query
+// string, so handlers, the audit log and the rate limiter see no difference
+func jsonCaptureRequest(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			handler(w, r)
+			return
+		}
+		if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "application/json" {
+			http.Error(w, "POST requests take a JSON body with Content-Type: application/json", http.StatusUnsupportedMediaType)
+			return
+		}
+
+		var req captureRequest
+		dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxCaptureRequest))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid capture request: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		q := r.URL.Query()
+		for name, values := range req.values() {
+			if q.Has(name) {
+				http.Error(w, fmt.Sprintf("%s is given both in the query string and the body", name), http.StatusBadRequest)
+				return
+			}
+			q[name] = values
+		}
+		r = r.Clone(r.Context())
+		r.URL.RawQuery = q.Encode()
+		handler(w, r)
+	}
+}
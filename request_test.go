@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCaptureRequestValues(t *testing.T) {
+	req := captureRequest{
+		Target:    captureTarget{PID: 1234, Children: true},
+		Seconds:   30,
+		Frequency: 99,
+		Event:     "cache-misses",
+		Format:    "perfscript",
+		Labels:    map[string]string{"service": "redis-cache", "env": "prod"},
+		Commands:  []string{"get", "set"},
+	}
+	want := url.Values{
+		"pid":       {"1234"},
+		"children":  {"true"},
+		"seconds":   {"30"},
+		"frequency": {"99"},
+		"event":     {"cache-misses"},
+		"format":    {"perfscript"},
+		"label":     {"env:prod", "service:redis-cache"},
+		"commands":  {"get,set"},
+	}
+	if got := req.values(); !reflect.DeepEqual(got, want) {
+		t.Errorf("values() = %v, want %v", got, want)
+	}
+}
+
+func TestJSONCaptureRequest(t *testing.T) {
+	var got url.Values
+	h := jsonCaptureRequest(func(w http.ResponseWriter, r *http.Request) {
+		got = r.URL.Query()
+	})
+
+	tests := []struct {
+		name        string
+		target      string
+		contentType string
+		body        string
+		wantCode    int
+		want        url.Values
+	}{
+		{"body", "/debug/pprof/profile", "application/json; charset=utf-8",
+			`{"target": {"redis_port": 6379}, "seconds": 10, "labels": {"incident": "INC-1234"}}`,
+			http.StatusOK, url.Values{"redis_port": {"6379"}, "seconds": {"10"}, "label": {"incident:INC-1234"}}},
+		{"body and query", "/debug/pprof/profile?test=true", "application/json",
+			`{"target": {"pid": 1}, "seconds": 5}`,
+			http.StatusOK, url.Values{"pid": {"1"}, "seconds": {"5"}, "test": {"true"}}},
+		{"given twice", "/debug/pprof/profile?seconds=5", "application/json",
+			`{"target": {"pid": 1}, "seconds": 10}`, http.StatusBadRequest, nil},
+		{"unknown field", "/debug/pprof/profile", "application/json",
+			`{"target": {"pid": 1}, "secs": 10}`, http.StatusBadRequest, nil},
+		{"not JSON", "/debug/pprof/profile", "application/json",
+			`pid=1&seconds=10`, http.StatusBadRequest, nil},
+		{"form", "/debug/pprof/profile", "application/x-www-form-urlencoded",
+			`pid=1&seconds=10`, http.StatusUnsupportedMediaType, nil},
+	}
+	for _, tt := range tests {
+		got = nil
+		req := httptest.NewRequest("POST", tt.target, strings.NewReader(tt.body))
+		req.Header.Set("Content-Type", tt.contentType)
+		rr := httptest.NewRecorder()
+		h(rr, req)
+		if rr.Code != tt.wantCode || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: status %d, query %v, want %d, %v", tt.name, rr.Code, got, tt.wantCode, tt.want)
+		}
+	}
+
+	// GET requests are passed on untouched
+	h(httptest.NewRecorder(), httptest.NewRequest("GET", "/debug/pprof/profile?pid=1&seconds=5", nil))
+	if got.Get("pid") != "1" {
+		t.Errorf("GET query = %v", got)
+	}
+}
+
+func TestJSONCaptureRequestTestMode(t *testing.T) {
+	req := httptest.NewRequest("POST", "/debug/folded/profile", strings.NewReader(`{"target": {"pid": 1234}, "seconds": 5, "test": true}`))
+	req.Header.Set("Content-Type", "application/json")
+	rr := httptest.NewRecorder()
+	jsonCaptureRequest(handleFolded)(rr, req)
+	if rr.Code != http.StatusOK || rr.Header().Get("Content-Type") != "text/plain" {
+		t.Errorf("POST test capture: status %d, Content-Type %q: %s", rr.Code, rr.Header().Get("Content-Type"), rr.Body.String())
+	}
+}
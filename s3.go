@@ -0,0 +1,567 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// s3QueueSize bounds the profiles waiting to be uploaded
+const s3QueueSize = 256
+
+// s3Attempts is how many times an upload is tried before it is given up
+const s3Attempts = 3
+
+// maxS3Tags is the number of tags S3 allows on an object
+const maxS3Tags = 10
+
+// s3Config is the s3 section of the configuration file: profiles saved to
+// the store are also uploaded to a bucket. The storage.s3 section has the
+// same fields and keeps the store itself in a bucket.
+type s3Config struct {
+	// Bucket receives the profiles; uploading is off when empty
+	Bucket string `json:"bucket"`
+	// Prefix is prepended to the object keys, e.g. "profiles/"
+	Prefix string `json:"prefix"`
+	// Region of the bucket (default $AWS_REGION, or us-east-1)
+	Region string `json:"region"`
+	// Endpoint is the URL of an S3-compatible service, such as MinIO,
+	// instead of AWS
+	Endpoint string `json:"endpoint"`
+	// PathStyle puts the bucket in the path of the URL instead of the host
+	// name, as most S3-compatible services need
+	PathStyle bool `json:"path_style"`
+}
+
+func (c *s3Config) validate() error {
+	if c.Bucket == "" {
+		if c.Prefix != "" || c.Endpoint != "" {
+			return fmt.Errorf("bucket is required")
+		}
+		return nil
+	}
+	if c.Endpoint != "" {
+		if u, err := url.Parse(c.Endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid endpoint %q", c.Endpoint)
+		}
+	}
+	c.Region = awsRegion(c.Region)
+	return nil
+}
+
+// awsRegion returns region, or else the region of the environment, or else
+// us-east-1
+func awsRegion(region string) string {
+	if region == "" {
+		region = os.Getenv("AWS_REGION")
+	}
+	if region == "" {
+		region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if region == "" {
+		region = "us-east-1"
+	}
+	return region
+}
+
+// awsCredentials sign requests to AWS
+type awsCredentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	// Expires is when temporary credentials stop working, zero for
+	// long-term keys
+	Expires time.Time
+}
+
+// stsEndpoint returns the URL of the STS service of region
+var stsEndpoint = func(region string) string {
+	return "https://sts." + region + ".amazonaws.com/"
+}
+
+// awsCredentialSource returns the credentials of the exporter, from
+// $AWS_ACCESS_KEY_ID and $AWS_SECRET_ACCESS_KEY, or from the web identity
+// token of an IAM role for service accounts (IRSA) exchanged with STS.
+// Temporary credentials are renewed before they expire.
+type awsCredentialSource struct {
+	region string
+	client *http.Client
+
+	mu     sync.Mutex
+	cached awsCredentials
+}
+
+// get returns valid credentials
+func (s *awsCredentialSource) get() (awsCredentials, error) {
+	if id, secret := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY"); id != "" && secret != "" {
+		return awsCredentials{AccessKeyID: id, SecretAccessKey: secret, SessionToken: os.Getenv("AWS_SESSION_TOKEN")}, nil
+	}
+	role, tokenFile := os.Getenv("AWS_ROLE_ARN"), os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE")
+	if role == "" || tokenFile == "" {
+		return awsCredentials{}, fmt.Errorf("no AWS credentials: set AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY, or AWS_ROLE_ARN and AWS_WEB_IDENTITY_TOKEN_FILE")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if time.Until(s.cached.Expires) > 5*time.Minute {
+		return s.cached, nil
+	}
+	creds, err := s.assumeRole(role, tokenFile)
+	if err != nil {
+		return awsCredentials{}, fmt.Errorf("assume role %s: %v", role, err)
+	}
+	s.cached = creds
+	return creds, nil
+}
+
+// assumeRole exchanges the web identity token in tokenFile, which the
+// kubelet keeps fresh, for temporary credentials of role
+func (s *awsCredentialSource) assumeRole(role, tokenFile string) (awsCredentials, error) {
+	token, err := os.ReadFile(tokenFile)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	session := os.Getenv("AWS_ROLE_SESSION_NAME")
+	if session == "" {
+		session = "bcc-exporter"
+	}
+	form := url.Values{
+		"Action":           {"AssumeRoleWithWebIdentity"},
+		"Version":          {"2011-06-15"},
+		"RoleArn":          {role},
+		"RoleSessionName":  {session},
+		"WebIdentityToken": {strings.TrimSpace(string(token))},
+	}
+	resp, err := s.client.PostForm(stsEndpoint(s.region), form)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return awsCredentials{}, fmt.Errorf("STS returned %s: %s", resp.Status, s3ErrorMessage(body))
+	}
+
+	var result struct {
+		Credentials struct {
+			AccessKeyID     string    `xml:"AccessKeyId"`
+			SecretAccessKey string    `xml:"SecretAccessKey"`
+			SessionToken    string    `xml:"SessionToken"`
+			Expiration      time.Time `xml:"Expiration"`
+		} `xml:"AssumeRoleWithWebIdentityResult>Credentials"`
+	}
+	if err := xml.Unmarshal(body, &result); err != nil {
+		return awsCredentials{}, fmt.Errorf("invalid STS response: %v", err)
+	}
+	c := result.Credentials
+	if c.AccessKeyID == "" || c.SecretAccessKey == "" {
+		return awsCredentials{}, fmt.Errorf("STS response has no credentials")
+	}
+	return awsCredentials{AccessKeyID: c.AccessKeyID, SecretAccessKey: c.SecretAccessKey, SessionToken: c.SessionToken, Expires: c.Expiration}, nil
+}
+
+// s3ErrorMessage returns the message of an S3 or STS XML error document
+func s3ErrorMessage(body []byte) string {
+	var doc struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+		Error   struct {
+			Code    string `xml:"Code"`
+			Message string `xml:"Message"`
+		} `xml:"Error"`
+	}
+	if xml.Unmarshal(body, &doc) == nil {
+		if doc.Code == "" {
+			doc.Code, doc.Message = doc.Error.Code, doc.Error.Message
+		}
+		if doc.Code != "" {
+			return doc.Code + ": " + doc.Message
+		}
+	}
+	return strings.TrimSpace(string(body))
+}
+
+// hmacSHA256 returns the HMAC-SHA256 of data with key
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// signV4 signs req for service in region with AWS Signature Version 4.
+// payloadHash is the hex SHA-256 of the body; all headers of req are
+// signed along with the host.
+func signV4(req *http.Request, creds awsCredentials, region, service, payloadHash string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if creds.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+creds.SecretAccessKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		creds.AccessKeyID, scope, signedHeaders, signature))
+}
+
+// canonicalQuery encodes q as SigV4 requires: sorted, with spaces as %20
+func canonicalQuery(q url.Values) string {
+	return strings.ReplaceAll(q.Encode(), "+", "%20")
+}
+
+// emptyPayloadHash is the SHA-256 of an empty request body
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// s3Storage keeps objects in a bucket of S3 or of an S3-compatible service,
+// under the configured prefix
+type s3Storage struct {
+	cfg    s3Config
+	creds  *awsCredentialSource
+	client *http.Client
+}
+
+// newS3Storage returns the storage of cfg. It fails when no credentials are
+// available.
+func newS3Storage(cfg s3Config) (*s3Storage, error) {
+	s := &s3Storage{
+		cfg:    cfg,
+		creds:  &awsCredentialSource{region: cfg.Region, client: &http.Client{Timeout: 30 * time.Second}},
+		client: &http.Client{Timeout: 10 * time.Minute},
+	}
+	if _, err := s.creds.get(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *s3Storage) String() string {
+	return "s3://" + s.cfg.Bucket + "/" + s.cfg.Prefix
+}
+
+// objectURL returns the URL of the object at key, or of the bucket when
+// key is ""
+func (s *s3Storage) objectURL(key string, query url.Values) string {
+	endpoint := s.cfg.Endpoint
+	if endpoint == "" {
+		endpoint = "https://s3." + s.cfg.Region + ".amazonaws.com"
+	}
+	u, _ := url.Parse(endpoint)
+	path := "/" + key
+	if s.cfg.PathStyle {
+		path = strings.TrimSuffix("/"+s.cfg.Bucket+path, "/")
+	} else {
+		u.Host = s.cfg.Bucket + "." + u.Host
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + path
+	u.RawQuery = canonicalQuery(query)
+	return u.String()
+}
+
+// do sends a signed request for key. payloadHash is the hex SHA-256 of
+// body, or UNSIGNED-PAYLOAD.
+func (s *s3Storage) do(method, key string, query url.Values, header http.Header, body io.Reader, size int64, payloadHash string) (*http.Response, error) {
+	creds, err := s.creds.get()
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(method, s.objectURL(key, query), body)
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = size
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	signV4(req, creds, s.cfg.Region, "s3", payloadHash, time.Now())
+	return s.client.Do(req)
+}
+
+// putObject uploads size bytes of body to key with header. digest is the
+// hex SHA-256 of body, or "" to leave the payload unsigned.
+func (s *s3Storage) putObject(key string, body io.Reader, size int64, digest string, header http.Header) error {
+	if digest == "" {
+		digest = "UNSIGNED-PAYLOAD"
+	}
+	resp, err := s.do("PUT", key, nil, header, body, size, digest)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+		return fmt.Errorf("PUT %s: %s: %s", key, resp.Status, s3ErrorMessage(body))
+	}
+	return nil
+}
+
+func (s *s3Storage) Put(name string, r io.Reader, size int64) error {
+	r, size, cleanup, err := spool(r, size)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	return s.putObject(s.cfg.Prefix+name, r, size, "", nil)
+}
+
+func (s *s3Storage) Get(name string) (io.ReadSeekCloser, error) {
+	return openRemoteObject(func(offset int64) (*http.Response, error) {
+		header := http.Header{}
+		if r := rangeHeader(offset); r != "" {
+			header.Set("Range", r)
+		}
+		return s.do("GET", s.cfg.Prefix+name, nil, header, nil, 0, emptyPayloadHash)
+	})
+}
+
+func (s *s3Storage) List(prefix string) ([]string, error) {
+	var names []string
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {s.cfg.Prefix + prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		resp, err := s.do("GET", "", query, nil, nil, 0, emptyPayloadHash)
+		if err != nil {
+			return nil, err
+		}
+		body, err := io.ReadAll(io.LimitReader(resp.Body, 16<<20))
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("list s3://%s/%s: %s: %s", s.cfg.Bucket, s.cfg.Prefix+prefix, resp.Status, s3ErrorMessage(body))
+		}
+
+		var result struct {
+			Contents []struct {
+				Key string `xml:"Key"`
+			} `xml:"Contents"`
+			IsTruncated           bool   `xml:"IsTruncated"`
+			NextContinuationToken string `xml:"NextContinuationToken"`
+		}
+		if err := xml.Unmarshal(body, &result); err != nil {
+			return nil, fmt.Errorf("invalid S3 listing: %v", err)
+		}
+		for _, c := range result.Contents {
+			// Only the objects directly under the prefix are the store's
+			if name := strings.TrimPrefix(c.Key, s.cfg.Prefix); !strings.Contains(name, "/") {
+				names = append(names, name)
+			}
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return names, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+func (s *s3Storage) Delete(name string) error {
+	resp, err := s.do("DELETE", s.cfg.Prefix+name, nil, nil, nil, 0, emptyPayloadHash)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 && resp.StatusCode != http.StatusNotFound {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+		return fmt.Errorf("DELETE %s: %s: %s", name, resp.Status, s3ErrorMessage(body))
+	}
+	return nil
+}
+
+// s3Upload is a stored profile waiting to be uploaded
+type s3Upload struct {
+	store *profileStore
+	meta  profileMeta
+}
+
+// s3Uploader copies stored profiles to a bucket in the background
+type s3Uploader struct {
+	dest     *s3Storage
+	hostname string
+	queue    chan s3Upload
+	// retryDelay is the wait before the first retry of a failed upload,
+	// doubled for each further attempt
+	retryDelay time.Duration
+}
+
+// uploads uploads stored profiles to S3, nil when uploading is off
+var uploads *s3Uploader
+
+// newS3Uploader returns an uploader for cfg, or nil when no bucket is set.
+// It fails when no credentials are available.
+func newS3Uploader(cfg s3Config) (*s3Uploader, error) {
+	if cfg.Bucket == "" {
+		return nil, nil
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+	dest, err := newS3Storage(cfg)
+	if err != nil {
+		return nil, err
+	}
+	u := &s3Uploader{
+		dest:       dest,
+		hostname:   hostname,
+		queue:      make(chan s3Upload, s3QueueSize),
+		retryDelay: 5 * time.Second,
+	}
+	go u.run()
+	return u, nil
+}
+
+// enqueue schedules the upload of the profile of meta in s; uploads are
+// dropped with a log message when the queue is full
+func (u *s3Uploader) enqueue(s *profileStore, meta profileMeta) {
+	if u == nil {
+		return
+	}
+	select {
+	case u.queue <- s3Upload{store: s, meta: meta}:
+	default:
+		log.Printf("S3 upload queue is full, not uploading profile %s", meta.ID)
+	}
+}
+
+// run uploads queued profiles one at a time, so a slow bucket never delays
+// captures
+func (u *s3Uploader) run() {
+	for up := range u.queue {
+		delay := u.retryDelay
+		for attempt := 1; ; attempt++ {
+			err := u.upload(up.store, up.meta)
+			if err == nil {
+				break
+			}
+			if attempt == s3Attempts {
+				log.Printf("Failed to upload profile %s to S3: %v", up.meta.ID, err)
+				break
+			}
+			log.Printf("Failed to upload profile %s to S3, retrying in %s: %v", up.meta.ID, delay, err)
+			time.Sleep(delay)
+			delay *= 2
+		}
+	}
+}
+
+// objectKey returns the key of the object holding the profile of meta:
+// profiles are grouped by host and day, e.g.
+// profiles/redis-7/2024/05/01/3f9a1c0e7b2d4856.pb.gz
+func (u *s3Uploader) objectKey(meta profileMeta, ext string) string {
+	return u.dest.cfg.Prefix + u.hostname + "/" + meta.CreatedAt.UTC().Format("2006/01/02") + "/" + meta.ID + ext
+}
+
+// s3TagValue replaces the characters S3 does not allow in tags with _, and
+// cuts values to the longest S3 accepts
+func s3TagValue(s string, limit int) string {
+	s = strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', strings.ContainsRune("+-=._:/@", r):
+			return r
+		}
+		return '_'
+	}, s)
+	if len(s) > limit {
+		s = s[:limit]
+	}
+	return s
+}
+
+// tags returns the object tags of the profile of meta: the host, ID,
+// format, target and trigger, then as many of its labels as S3 allows
+func (u *s3Uploader) tags(meta profileMeta) string {
+	tags := url.Values{}
+	add := func(key, value string) {
+		if value != "" && len(tags) < maxS3Tags {
+			tags.Set(s3TagValue(key, 128), s3TagValue(value, 256))
+		}
+	}
+	add("host", u.hostname)
+	add("id", meta.ID)
+	add("format", meta.Format)
+	add("pid", meta.PID)
+	add("comm", meta.Comm)
+	add("trigger", meta.Trigger)
+	names := make([]string, 0, len(meta.Labels))
+	for name := range meta.Labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		add("label:"+name, meta.Labels[name])
+	}
+	return canonicalQuery(tags)
+}
+
+// upload puts the profile of meta and its metadata next to it in the bucket
+func (u *s3Uploader) upload(s *profileStore, meta profileMeta) error {
+	f, err := s.storage.Get(dataName(meta))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	header := http.Header{"Content-Type": {"application/octet-stream"}, "X-Amz-Tagging": {u.tags(meta)}}
+	if err := u.dest.putObject(u.objectKey(meta, profileExtension(meta.Format)), f, meta.Size, meta.SHA256, header); err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(data)
+	header = http.Header{"Content-Type": {"application/json"}}
+	return u.dest.putObject(u.objectKey(meta, ".json"), bytes.NewReader(data), int64(len(data)), hex.EncodeToString(sum[:]), header)
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// perfSchedRecordArgs builds the perf sched record command line tracing the
+// scheduler of every CPU into outputPath for seconds; wakeups are recorded
+// in the context of the waker, so it cannot be limited to the target
+func perfSchedRecordArgs(seconds int, outputPath string) []string {
+	return []string{"sched", "record", "-o", outputPath, "--", "sleep", fmt.Sprintf("%d", seconds)}
+}
+
+// perfSchedLatencyArgs builds the perf sched latency command line reporting
+// every thread of inputPath, worst delay first
+func perfSchedLatencyArgs(inputPath string) []string {
+	return []string{"sched", "latency", "-i", inputPath, "-p", "-s", "max"}
+}
+
+// schedTask is the scheduling delay of one thread, the time it spent
+// runnable before getting a CPU
+type schedTask struct {
+	Task      string  `json:"task"`
+	TID       int     `json:"tid"`
+	RuntimeMs float64 `json:"runtime_ms"`
+	// Switches is how many times the thread was scheduled in after a
+	// wakeup, the number of delays averaged
+	Switches   int     `json:"switches"`
+	AvgDelayMs float64 `json:"avg_delay_ms"`
+	MaxDelayMs float64 `json:"max_delay_ms"`
+	// MaxDelayAt is the perf timestamp, in seconds, of the worst delay
+	MaxDelayAt float64 `json:"max_delay_at"`
+}
+
+// schedReport is the response of /debug/sched
+type schedReport struct {
+	PID        string  `json:"pid"`
+	Seconds    int     `json:"seconds"`
+	Switches   int     `json:"switches"`
+	AvgDelayMs float64 `json:"avg_delay_ms"`
+	MaxDelayMs float64 `json:"max_delay_ms"`
+	// Tasks are the threads of the target, worst delay first
+	Tasks []schedTask `json:"tasks"`
+}
+
+// schedValue parses the number that follows prefix in a column of perf
+// sched latency, e.g. "avg:    0.012 ms"
+func schedValue(column, prefix string) (float64, error) {
+	fields := strings.Fields(strings.TrimPrefix(strings.TrimSpace(column), prefix))
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("empty column %q", column)
+	}
+	return strconv.ParseFloat(fields[0], 64)
+}
+
+// parsePerfSchedLatency decodes the per-thread rows of perf sched latency -p:
+// "comm:tid | runtime ms | switches | avg: ms | max: ms | max start: s | ..."
+func parsePerfSchedLatency(r io.Reader) ([]schedTask, error) {
+	var tasks []schedTask
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		columns := strings.Split(line, "|")
+		// Headers, rulers and the TOTAL row have no avg column
+		if len(columns) < 6 || !strings.HasPrefix(strings.TrimSpace(columns[3]), "avg:") {
+			continue
+		}
+
+		task := strings.TrimSpace(columns[0])
+		sep := strings.LastIndexByte(task, ':')
+		if sep < 0 {
+			return nil, fmt.Errorf("unexpected perf sched task: %q", line)
+		}
+		t := schedTask{Task: task[:sep]}
+		var err error
+		if t.TID, err = strconv.Atoi(task[sep+1:]); err != nil {
+			return nil, fmt.Errorf("unexpected perf sched task: %q", line)
+		}
+		if t.RuntimeMs, err = schedValue(columns[1], ""); err != nil {
+			return nil, fmt.Errorf("unexpected perf sched runtime: %q", line)
+		}
+		if t.Switches, err = strconv.Atoi(strings.TrimSpace(columns[2])); err != nil {
+			return nil, fmt.Errorf("unexpected perf sched switches: %q", line)
+		}
+		if t.AvgDelayMs, err = schedValue(columns[3], "avg:"); err != nil {
+			return nil, fmt.Errorf("unexpected perf sched delay: %q", line)
+		}
+		if t.MaxDelayMs, err = schedValue(columns[4], "max:"); err != nil {
+			return nil, fmt.Errorf("unexpected perf sched delay: %q", line)
+		}
+		// perf before 5.19 prints "max at:", later "max start:"
+		at := strings.TrimSpace(columns[5])
+		if _, rest, ok := strings.Cut(at, ":"); ok {
+			t.MaxDelayAt, _ = schedValue(rest, "")
+		}
+		tasks = append(tasks, t)
+	}
+	return tasks, scanner.Err()
+}
+
+// summarizeSched keeps the tasks of report whose TID is in tids, worst delay
+// first, and totals their delays
+func summarizeSched(report *schedReport, tasks []schedTask, tids map[int]bool) {
+	report.Tasks = []schedTask{}
+	var totalDelay float64
+	for _, t := range tasks {
+		if !tids[t.TID] {
+			continue
+		}
+		report.Tasks = append(report.Tasks, t)
+		report.Switches += t.Switches
+		totalDelay += t.AvgDelayMs * float64(t.Switches)
+		report.MaxDelayMs = max(report.MaxDelayMs, t.MaxDelayMs)
+	}
+	if report.Switches > 0 {
+		report.AvgDelayMs = totalDelay / float64(report.Switches)
+	}
+	sort.SliceStable(report.Tasks, func(i, j int) bool { return report.Tasks[i].MaxDelayMs > report.Tasks[j].MaxDelayMs })
+}
+
+// targetTIDs adds the threads of the target of opts to tids
+func targetTIDs(opts profileOptions, tids map[int]bool) {
+	if opts.TID != "" {
+		tid, _ := strconv.Atoi(opts.TID)
+		tids[tid] = true
+		return
+	}
+	for _, pid := range strings.Split(opts.targetPIDs(), ",") {
+		tasks, err := os.ReadDir(filepath.Join(procRoot, pid, "task"))
+		if err != nil {
+			continue
+		}
+		for _, task := range tasks {
+			if tid, err := strconv.Atoi(task.Name()); err == nil {
+				tids[tid] = true
+			}
+		}
+	}
+}
+
+// mockPerfSchedLatency is the perf sched latency output returned in test
+// mode, with a thread of another process
+const mockPerfSchedLatency = `
+ -------------------------------------------------------------------------------------------------------------------------------------------
+  Task                  |   Runtime ms  | Switches | Avg delay ms    | Max delay ms    | Max delay start           | Max delay end          |
+ -------------------------------------------------------------------------------------------------------------------------------------------
+  kworker/3:1:210       |      2.104 ms |       48 | avg:    0.510 ms | max:    9.204 ms | max start: 41210.220113 s | max end: 41210.229317 s
+  redis-server:1234     |    912.345 ms |     8412 | avg:    0.012 ms | max:    4.512 ms | max start: 41211.008120 s | max end: 41211.012632 s
+  bio_aof:1236          |     31.870 ms |      602 | avg:    0.045 ms | max:    2.210 ms | max start: 41210.503411 s | max end: 41210.505621 s
+  bio_close_file:1235   |      0.211 ms |       11 | avg:    0.008 ms | max:    0.031 ms | max start: 41212.100452 s | max end: 41212.100483 s
+ -----------------------------------------------------------------------------------------------------------------
+  TOTAL:                |    946.530 ms |     9073 |
+ ---------------------------------------------------
+`
+
+// handleSched traces the scheduler with perf sched over the requested
+// duration and reports how long each thread of a process waited for a CPU
+func handleSched(w http.ResponseWriter, r *http.Request) {
+	opts, err := parseProfileOptions(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := rejectParams(r.URL.Query(), reportIgnoredParams); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := resolveRedisPort(&opts); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid redis_port: %v", err), http.StatusBadRequest)
+		return
+	}
+	if err := resolveContainerPID(&opts); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid container PID: %v", err), http.StatusBadRequest)
+		return
+	}
+	auditPID(r, opts.PID)
+
+	report := schedReport{PID: opts.PID, Seconds: opts.Duration}
+	var output []byte
+	tids := make(map[int]bool)
+
+	if r.URL.Query().Get("test") == "true" {
+		output = []byte(mockPerfSchedLatency)
+		tids = map[int]bool{1234: true, 1235: true, 1236: true}
+	} else {
+		release, ok := takeCaptureSlot(w, r, opts.PID)
+		if !ok {
+			return
+		}
+		defer release()
+		if output, err = runPerfSched(opts, tids); err != nil {
+			writeCaptureError(w, err)
+			return
+		}
+	}
+
+	tasks, err := parsePerfSchedLatency(bytes.NewReader(output))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to parse perf sched output: %v", err), http.StatusInternalServerError)
+		return
+	}
+	summarizeSched(&report, tasks, tids)
+	writeJSON(w, http.StatusOK, report)
+}
+
+// runPerfSched validates the target, records the scheduler events of every
+// CPU with perf sched and returns the perf sched latency report; tids gets
+// the threads of the target at the start and end of the window, so those
+// exiting or starting during it are reported
+func runPerfSched(opts profileOptions, tids map[int]bool) ([]byte, error) {
+	if err := preparePerfTarget(&opts); err != nil {
+		return nil, err
+	}
+	if !exporterCaps.canTrace() && perfEventParanoid() > -1 {
+		return nil, &captureError{http.StatusForbidden, "Permission denied: perf sched traces every CPU, which needs CAP_PERFMON or kernel.perf_event_paranoid -1 (run bcc-exporter setcap)"}
+	}
+
+	tempDir, err := newCaptureDir()
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tempDir)
+	dataPath := filepath.Join(tempDir, "perf.data")
+
+	targetTIDs(opts, tids)
+	log.Printf("Starting perf sched for PID %s, duration %d seconds", opts.PID, opts.Duration)
+	cmd := newCommand("perf", perfSchedRecordArgs(opts.Duration, dataPath)...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := runJob(cmd, captureTimeout(opts.Duration)); err != nil {
+		if _, ok := err.(*captureError); ok {
+			return nil, err
+		}
+		if strings.Contains(stderr.String(), "Permission denied") {
+			return nil, &captureError{http.StatusForbidden, "Permission denied: perf requires elevated privileges. Run with sudo or adjust perf_event_paranoid settings."}
+		}
+		return nil, &captureError{http.StatusInternalServerError, fmt.Sprintf("perf sched record failed: %v\nStderr: %s", err, stderr.String())}
+	}
+	targetTIDs(opts, tids)
+
+	cmd = newCommand("perf", perfSchedLatencyArgs(dataPath)...)
+	stdout := newLimitedBuffer()
+	stderr.Reset()
+	cmd.Stdout = stdout
+	cmd.Stderr = &stderr
+	if err := runJob(cmd, captureTimeout(opts.Duration)); err != nil {
+		if _, ok := err.(*captureError); ok {
+			return nil, err
+		}
+		return nil, &captureError{http.StatusInternalServerError, fmt.Sprintf("perf sched latency failed: %v\nStderr: %s", err, stderr.String())}
+	}
+	if err := stdout.check("perf sched latency output"); err != nil {
+		return nil, err
+	}
+	return stdout.Bytes(), nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParsePerfSchedLatency(t *testing.T) {
+	tasks, err := parsePerfSchedLatency(strings.NewReader(mockPerfSchedLatency))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tasks) != 4 {
+		t.Fatalf("tasks = %+v", tasks)
+	}
+	// Kernel thread names hold colons too
+	if task := tasks[0]; task.Task != "kworker/3:1" || task.TID != 210 {
+		t.Errorf("first task = %+v", task)
+	}
+	want := schedTask{Task: "redis-server", TID: 1234, RuntimeMs: 912.345, Switches: 8412, AvgDelayMs: 0.012, MaxDelayMs: 4.512, MaxDelayAt: 41211.008120}
+	if tasks[1] != want {
+		t.Errorf("redis-server = %+v, want %+v", tasks[1], want)
+	}
+
+	// perf before 5.19 names the timestamp of the worst delay "max at"
+	old := "  redis-server:1234     |    912.345 ms |     8412 | avg:    0.012 ms | max:    4.512 ms | max at: 41211.008120 s\n"
+	if tasks, err := parsePerfSchedLatency(strings.NewReader(old)); err != nil || len(tasks) != 1 || tasks[0].MaxDelayAt != 41211.008120 {
+		t.Errorf("old format: %+v, %v", tasks, err)
+	}
+	if _, err := parsePerfSchedLatency(strings.NewReader("  redis-server | 1 ms | x | avg: 1 ms | max: 1 ms | max at: 1 s\n")); err == nil {
+		t.Error("parsePerfSchedLatency() accepted a task without a TID")
+	}
+}
+
+func TestSchedEndpoint(t *testing.T) {
+	rr := httptest.NewRecorder()
+	handleSched(rr, httptest.NewRequest("GET", "/debug/sched?pid=1234&seconds=2&test=true", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rr.Code, rr.Body.String())
+	}
+	var report schedReport
+	if err := json.Unmarshal(rr.Body.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the threads of the target are reported
+	var names []string
+	for _, task := range report.Tasks {
+		names = append(names, task.Task)
+	}
+	if strings.Join(names, " ") != "redis-server bio_aof bio_close_file" {
+		t.Errorf("tasks = %v", names)
+	}
+	if report.Switches != 9025 || report.MaxDelayMs != 4.512 {
+		t.Errorf("switches %d, max delay %v", report.Switches, report.MaxDelayMs)
+	}
+	// The average is weighted by the switches of every thread
+	want := (8412*0.012 + 602*0.045 + 11*0.008) / 9025
+	if math.Abs(report.AvgDelayMs-want) > 1e-9 {
+		t.Errorf("avg delay %v, want %v", report.AvgDelayMs, want)
+	}
+
+	for _, query := range []string{"&format=top", "&snapshots=2", "&mode=wall", "&backend=perf", "&stream_interval=1"} {
+		rr := httptest.NewRecorder()
+		handleSched(rr, httptest.NewRequest("GET", "/debug/sched?pid=1234&seconds=2&test=true"+query, nil))
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d", query, rr.Code)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// parseByteSize parses a size such as 512M or 2G, with binary K, M and G
+// suffixes, into bytes
+func parseByteSize(s string) (int64, error) {
+	num, shift := strings.ToUpper(strings.TrimSpace(s)), 0
+	switch {
+	case strings.HasSuffix(num, "K"):
+		num, shift = num[:len(num)-1], 10
+	case strings.HasSuffix(num, "M"):
+		num, shift = num[:len(num)-1], 20
+	case strings.HasSuffix(num, "G"):
+		num, shift = num[:len(num)-1], 30
+	}
+	n, err := strconv.ParseInt(num, 10, 64)
+	if err != nil || n <= 0 || n > (1<<62)>>shift {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n << shift, nil
+}
+
+// mountScratch mounts a tmpfs of size bytes on a new directory under parent
+// (os.TempDir() when empty) and returns the directory. The mount is private
+// to the exporter and refuses executables and device files.
+func mountScratch(parent string, size int64) (string, error) {
+	dir, err := os.MkdirTemp(parent, instancePrefix()+"scratch-")
+	if err != nil {
+		return "", err
+	}
+	opts := fmt.Sprintf("size=%d,mode=0700,uid=%d,gid=%d", size, os.Getuid(), os.Getgid())
+	if err := syscall.Mount("tmpfs", dir, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, opts); err != nil {
+		os.Remove(dir)
+		if err == syscall.EPERM {
+			return "", fmt.Errorf("mounting tmpfs needs root or CAP_SYS_ADMIN: %v", err)
+		}
+		return "", fmt.Errorf("mount tmpfs: %v", err)
+	}
+	return dir, nil
+}
+
+// unmountScratch unmounts and removes a directory made by mountScratch
+func unmountScratch(dir string) error {
+	if err := syscall.Unmount(dir, syscall.MNT_DETACH); err != nil {
+		return err
+	}
+	return os.Remove(dir)
+}
+
+// unmountScratchOnExit unmounts dir when the exporter is interrupted or
+// terminated, so restarts do not pile up tmpfs mounts, then lets the signal
+// end the process as usual
+func unmountScratchOnExit(dir string) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	s := <-sig
+	if err := unmountScratch(dir); err != nil {
+		log.Printf("Failed to unmount scratch tmpfs %s: %v", dir, err)
+	}
+	signal.Reset(s)
+	syscall.Kill(os.Getpid(), s.(syscall.Signal))
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseByteSize(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    int64
+		wantErr bool
+	}{
+		{"4096", 4096, false},
+		{"64K", 64 << 10, false},
+		{"512M", 512 << 20, false},
+		{"2g", 2 << 30, false},
+		{"0", 0, true},
+		{"-1M", 0, true},
+		{"1T", 0, true},
+		{"M", 0, true},
+		{"", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := parseByteSize(tt.in)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseByteSize(%q) = %d, %v, want %d, wantErr %v", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestMountScratch(t *testing.T) {
+	parent := t.TempDir()
+	dir, err := mountScratch(parent, 1<<20)
+	if err != nil {
+		t.Skipf("cannot mount tmpfs here: %v", err)
+	}
+	defer unmountScratch(dir)
+
+	// The size cap shows up as free space, so checkDiskSpace enforces it
+	if free, err := freeSpace(dir); err != nil || free > 1<<20 {
+		t.Errorf("freeSpace of a 1 MiB tmpfs = %d, %v", free, err)
+	}
+	if err := checkDiskSpace(dir, 2<<20); err == nil {
+		t.Error("checkDiskSpace allowed 2 MiB on a 1 MiB tmpfs")
+	}
+
+	if err := unmountScratch(dir); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(parent, filepath.Base(dir))); !os.IsNotExist(err) {
+		t.Errorf("scratch directory left behind: %v", err)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+)
+
+// sdTargetGroup is one entry of a Prometheus HTTP service discovery
+// response
+type sdTargetGroup struct {
+	Targets []string          `json:"targets"`
+	Labels  map[string]string `json:"labels"`
+}
+
+// containerIDRe matches the 64 hex digit IDs of Docker, containerd and
+// CRI-O containers in cgroup paths
+var containerIDRe = regexp.MustCompile(`[0-9a-f]{64}`)
+
+// containerID returns the ID of the container pid runs in, or "" for
+// processes outside of containers
+func containerID(pid int) string {
+	cgroup, err := readCgroup(pid)
+	if err != nil {
+		return ""
+	}
+	ids := containerIDRe.FindAllString(cgroup, -1)
+	if len(ids) == 0 {
+		return ""
+	}
+	return ids[len(ids)-1]
+}
+
+// discoverTargets returns a target group for every process named one of
+// comms. Targets point at the exporter, at addr, with the parameters that
+// select the process in a way that survives restarts where possible: the
+// container and the PID inside it for containers, the port of redis-server
+// processes, and the PID otherwise.
+func discoverTargets(comms []string, addr, hostname string) ([]sdTargetGroup, error) {
+	groups := []sdTargetGroup{}
+	for _, comm := range comms {
+		pids, err := findPIDsByComm(comm)
+		if err != nil {
+			return nil, err
+		}
+		sort.Ints(pids)
+		for _, pid := range pids {
+			labels := map[string]string{
+				"__metrics_path__": *prefix + "/debug/pprof/profile",
+				"service_name":     comm,
+				"comm":             comm,
+				"pid":              strconv.Itoa(pid),
+				"hostname":         hostname,
+			}
+			if comm == "redis-server" {
+				if listen, err := redisAddrForPID(pid); err == nil {
+					if _, port, err := net.SplitHostPort(listen); err == nil {
+						labels["redis_port"] = port
+					}
+				}
+			}
+			id := containerID(pid)
+			nspids, _ := readNSpid(filepath.Join(procRoot, strconv.Itoa(pid), "status"))
+			switch {
+			case id != "" && len(nspids) > 0:
+				labels["container_id"] = id
+				labels["__param_container"] = id
+				labels["__param_pid"] = strconv.Itoa(nspids[len(nspids)-1])
+			case labels["redis_port"] != "":
+				labels["__param_redis_port"] = labels["redis_port"]
+			default:
+				labels["__param_pid"] = strconv.Itoa(pid)
+			}
+			groups = append(groups, sdTargetGroup{Targets: []string{addr}, Labels: labels})
+		}
+	}
+	return groups, nil
+}
+
+// handleServiceDiscovery lists the processes that can be profiled on this
+// host in the Prometheus HTTP service discovery format
+func handleServiceDiscovery(w http.ResponseWriter, r *http.Request) {
+	comms := r.URL.Query()["comm"]
+	if len(comms) == 0 {
+		comms = []string{"redis-server"}
+	}
+	for _, comm := range comms {
+		// Command names are at most 15 characters in /proc/<pid>/comm
+		if comm == "" || len(comm) > 15 {
+			http.Error(w, fmt.Sprintf("Invalid comm %q: must be a process name of 1 to 15 characters", comm), http.StatusBadRequest)
+			return
+		}
+	}
+	hostname, _ := os.Hostname()
+	groups, err := discoverTargets(comms, r.Host, hostname)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to list processes: %v", err), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, groups)
+}
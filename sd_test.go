@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestServiceDiscovery(t *testing.T) {
+	writeFakeProc(t, map[int]int{100: 1, 200: 1, 300: 1, 400: 1})
+	id := strings.Repeat("ab12", 16)
+	for pid, files := range map[string]map[string]string{
+		"100": {"comm": "redis-server\n", "cgroup": "0::/system.slice/redis.service\n"},
+		"200": {"comm": "redis-server\n", "cgroup": "0::/system.slice/docker-" + id + ".scope\n", "status": "Name:\tredis-server\nNSpid:\t200\t1\n"},
+		"300": {"comm": "redis-sentinel\n"},
+		"400": {"comm": "bash\n"},
+	} {
+		for name, data := range files {
+			if err := os.WriteFile(filepath.Join(procRoot, pid, name), []byte(data), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	writeFakeListener(t, 100, 6379, "555")
+
+	r := httptest.NewRequest("GET", "/api/v1/sd?comm=redis-server&comm=redis-sentinel", nil)
+	r.Host = "node-1:8080"
+	rr := httptest.NewRecorder()
+	handleServiceDiscovery(rr, r)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("%d %s", rr.Code, rr.Body.String())
+	}
+	var groups []sdTargetGroup
+	if err := json.Unmarshal(rr.Body.Bytes(), &groups); err != nil {
+		t.Fatal(err)
+	}
+	if len(groups) != 3 {
+		t.Fatalf("groups = %+v", groups)
+	}
+	for i, want := range []map[string]string{
+		{"pid": "100", "comm": "redis-server", "redis_port": "6379", "__param_redis_port": "6379"},
+		{"pid": "200", "container_id": id, "__param_container": id, "__param_pid": "1"},
+		{"pid": "300", "service_name": "redis-sentinel", "__param_pid": "300", "__metrics_path__": "/debug/pprof/profile"},
+	} {
+		if len(groups[i].Targets) != 1 || groups[i].Targets[0] != "node-1:8080" {
+			t.Errorf("group %d targets = %v", i, groups[i].Targets)
+		}
+		for name, value := range want {
+			if groups[i].Labels[name] != value {
+				t.Errorf("group %d: %s = %q, want %q", i, name, groups[i].Labels[name], value)
+			}
+		}
+	}
+	if _, ok := groups[0].Labels["__param_pid"]; ok {
+		t.Errorf("redis-server with a port selected by PID: %v", groups[0].Labels)
+	}
+
+	rr = httptest.NewRecorder()
+	handleServiceDiscovery(rr, httptest.NewRequest("GET", "/api/v1/sd?comm=a-very-long-process-name", nil))
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("long comm: %d", rr.Code)
+	}
+}
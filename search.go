@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultSearchLimit is the page size of store searches without limit
+	defaultSearchLimit = 100
+	// maxSearchLimit bounds the page size of store searches
+	maxSearchLimit = 1000
+)
+
+// profileQuery selects stored profiles; empty fields match every profile
+type profileQuery struct {
+	PID     string
+	Comm    string
+	Format  string
+	Trigger string
+	// Since and Until bound the creation time, Since included
+	Since, Until time.Time
+	// Labels must all be present with the given values; an empty value
+	// only requires the label
+	Labels map[string]string
+
+	Limit int
+	// after is the position of the last profile of the previous page
+	after *searchCursor
+}
+
+// searchCursor is a position in the store, which is ordered newest first
+// and then by descending ID
+type searchCursor struct {
+	createdAt time.Time
+	id        string
+}
+
+// before reports whether the profile of meta comes after c in the order of
+// the store
+func (c *searchCursor) before(meta profileMeta) bool {
+	if !meta.CreatedAt.Equal(c.createdAt) {
+		return meta.CreatedAt.Before(c.createdAt)
+	}
+	return meta.ID < c.id
+}
+
+// encode returns the opaque cursor given to clients
+func (c *searchCursor) encode() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(c.createdAt.UnixNano(), 10) + ":" + c.id))
+}
+
+// decodeSearchCursor parses a cursor returned by encode
+func decodeSearchCursor(s string) (*searchCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid cursor")
+	}
+	nanos, id, ok := strings.Cut(string(data), ":")
+	n, err := strconv.ParseInt(nanos, 10, 64)
+	if !ok || err != nil || !validProfileID(id) {
+		return nil, fmt.Errorf("Invalid cursor")
+	}
+	return &searchCursor{createdAt: time.Unix(0, n).UTC(), id: id}, nil
+}
+
+// parseSearchTime parses a since or until parameter: an RFC 3339 time, or
+// a duration before now such as 24h, 90m or 7d
+func parseSearchTime(s string, now time.Time) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		if n, err := strconv.Atoi(days); err == nil && n >= 0 {
+			return now.AddDate(0, 0, -n), nil
+		}
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return time.Time{}, fmt.Errorf("must be an RFC 3339 time or a duration such as 24h or 7d")
+	}
+	return now.Add(-d), nil
+}
+
+// parseProfileQuery decodes the parameters of a store search
+func parseProfileQuery(q url.Values, now time.Time) (profileQuery, error) {
+	query := profileQuery{
+		PID:     q.Get("pid"),
+		Comm:    q.Get("comm"),
+		Format:  q.Get("format"),
+		Trigger: q.Get("trigger"),
+		Limit:   defaultSearchLimit,
+	}
+	if query.PID != "" {
+		if n, err := strconv.Atoi(query.PID); err != nil || n <= 0 {
+			return query, fmt.Errorf("Invalid pid: must be a positive integer")
+		}
+	}
+
+	var err error
+	for _, param := range []struct {
+		name string
+		dest *time.Time
+	}{{"since", &query.Since}, {"until", &query.Until}} {
+		if s := q.Get(param.name); s != "" {
+			if *param.dest, err = parseSearchTime(s, now); err != nil {
+				return query, fmt.Errorf("Invalid %s: %v", param.name, err)
+			}
+		}
+	}
+
+	for _, param := range q["label"] {
+		name, value, _ := strings.Cut(param, ":")
+		if !labelNameRe.MatchString(name) {
+			return query, fmt.Errorf("Invalid label %q: must be name:value or name", param)
+		}
+		if query.Labels == nil {
+			query.Labels = make(map[string]string)
+		}
+		query.Labels[name] = value
+	}
+
+	if s := q.Get("limit"); s != "" {
+		if query.Limit, err = strconv.Atoi(s); err != nil || query.Limit < 1 || query.Limit > maxSearchLimit {
+			return query, fmt.Errorf("Invalid limit: must be between 1 and %d", maxSearchLimit)
+		}
+	}
+	if s := q.Get("cursor"); s != "" {
+		if query.after, err = decodeSearchCursor(s); err != nil {
+			return query, err
+		}
+	}
+	return query, nil
+}
+
+// matches reports whether the profile of meta is selected by q, ignoring
+// pagination. Profiles captured on request match trigger=none.
+func (q profileQuery) matches(meta profileMeta) bool {
+	switch {
+	case q.PID != "" && meta.PID != q.PID,
+		q.Comm != "" && meta.Comm != q.Comm,
+		q.Format != "" && meta.Format != q.Format,
+		q.Trigger == "none" && meta.Trigger != "",
+		q.Trigger != "" && q.Trigger != "none" && meta.Trigger != q.Trigger,
+		!q.Since.IsZero() && meta.CreatedAt.Before(q.Since),
+		!q.Until.IsZero() && !meta.CreatedAt.Before(q.Until):
+		return false
+	}
+	for name, value := range q.Labels {
+		got, ok := meta.Labels[name]
+		if !ok || value != "" && got != value {
+			return false
+		}
+	}
+	return true
+}
+
+// searchResult is the response of a store search
+type searchResult struct {
+	Profiles []profileMeta `json:"profiles"`
+	// Total is the number of profiles matching the query, on all pages
+	Total int `json:"total"`
+	// NextCursor fetches the next page, absent on the last one
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// search returns the page of metas, ordered as store.List orders them, that
+// q selects
+func (q profileQuery) search(metas []profileMeta) searchResult {
+	res := searchResult{Profiles: []profileMeta{}}
+	for _, meta := range metas {
+		if !q.matches(meta) {
+			continue
+		}
+		res.Total++
+		if q.after != nil && !q.after.before(meta) {
+			continue
+		}
+		if len(res.Profiles) == q.Limit {
+			last := res.Profiles[len(res.Profiles)-1]
+			res.NextCursor = (&searchCursor{createdAt: last.CreatedAt, id: last.ID}).encode()
+			continue
+		}
+		res.Profiles = append(res.Profiles, meta)
+	}
+	return res
+}
+
+// handleSearchProfiles serves the stored profiles matching the query,
+// newest first, a page at a time
+func handleSearchProfiles(w http.ResponseWriter, r *http.Request) {
+	if !requireStore(w) {
+		return
+	}
+	query, err := parseProfileQuery(r.URL.Query(), time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	metas, err := store.List()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to list profiles: %v", err), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, query.search(metas))
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSearchTime(t *testing.T) {
+	now := time.Date(2024, 6, 11, 12, 0, 0, 0, time.UTC)
+	for s, want := range map[string]time.Time{
+		"24h":                  now.Add(-24 * time.Hour),
+		"90m":                  now.Add(-90 * time.Minute),
+		"7d":                   now.AddDate(0, 0, -7),
+		"2024-06-01T00:00:00Z": time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC),
+	} {
+		if got, err := parseSearchTime(s, now); err != nil || !got.Equal(want) {
+			t.Errorf("parseSearchTime(%q) = %v, %v, want %v", s, got, err, want)
+		}
+	}
+	for _, bad := range []string{"yesterday", "-1h", "1w"} {
+		if _, err := parseSearchTime(bad, now); err == nil {
+			t.Errorf("parseSearchTime(%q) accepted", bad)
+		}
+	}
+}
+
+func TestProfileQueryMatches(t *testing.T) {
+	now := time.Date(2024, 6, 11, 12, 0, 0, 0, time.UTC)
+	meta := profileMeta{ID: "3f9a1c0e7b2d4856", Format: "pprof", PID: "42", Comm: "redis-server", Trigger: "watchdog",
+		CreatedAt: now.Add(-time.Hour), Labels: map[string]string{"incident": "INC-1234", "env": "prod"}}
+	for query, want := range map[string]bool{
+		"":                               true,
+		"comm=redis-server&since=24h":    true,
+		"comm=redis-sentinel":            false,
+		"pid=42&format=pprof":            true,
+		"pid=43":                         false,
+		"since=30m":                      false,
+		"until=30m":                      true,
+		"until=2h":                       false,
+		"label=incident:INC-1234":        true,
+		"label=incident:INC-1&label=env": false,
+		"label=env":                      true,
+		"label=service":                  false,
+		"trigger=watchdog":               true,
+		"trigger=none":                   false,
+	} {
+		q, _ := url.ParseQuery(query)
+		pq, err := parseProfileQuery(q, now)
+		if err != nil {
+			t.Errorf("%s: %v", query, err)
+			continue
+		}
+		if got := pq.matches(meta); got != want {
+			t.Errorf("%s matches = %v, want %v", query, got, want)
+		}
+	}
+
+	for _, bad := range []string{"pid=redis", "since=later", "label=env-name:prod", "limit=0", "limit=5000", "cursor=abc"} {
+		q, _ := url.ParseQuery(bad)
+		if _, err := parseProfileQuery(q, now); err == nil {
+			t.Errorf("%s accepted", bad)
+		}
+	}
+}
+
+func TestSearchProfilesPagination(t *testing.T) {
+	s := withTestStore(t)
+	created := time.Now().UTC().Add(-time.Minute)
+	for i := 0; i < 5; i++ {
+		meta := profileMeta{Format: "folded", PID: "42", Comm: "redis-server", CreatedAt: created.Add(time.Duration(i) * time.Second)}
+		if i == 2 {
+			meta.Comm = "redis-sentinel"
+		}
+		if _, err := s.Save(meta, strings.NewReader("a;b 1\n")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	search := func(query string) searchResult {
+		t.Helper()
+		rr := httptest.NewRecorder()
+		handleSearchProfiles(rr, httptest.NewRequest("GET", "/api/v1/store?"+query, nil))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("%s: %d %s", query, rr.Code, rr.Body.String())
+		}
+		var res searchResult
+		if err := json.Unmarshal(rr.Body.Bytes(), &res); err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	var seen []time.Time
+	query := "comm=redis-server&since=1h&limit=3"
+	res := search(query)
+	for page := 0; ; page++ {
+		if res.Total != 4 {
+			t.Errorf("page %d: total = %d, want 4", page, res.Total)
+		}
+		for _, meta := range res.Profiles {
+			seen = append(seen, meta.CreatedAt)
+		}
+		if res.NextCursor == "" {
+			break
+		}
+		res = search(query + "&cursor=" + res.NextCursor)
+	}
+	if len(seen) != 4 {
+		t.Fatalf("%d profiles over all pages, want 4", len(seen))
+	}
+	for i := 1; i < len(seen); i++ {
+		if !seen[i].Before(seen[i-1]) {
+			t.Errorf("profiles not newest first: %v", seen)
+		}
+	}
+
+	rr := httptest.NewRecorder()
+	handleSearchProfiles(rr, httptest.NewRequest("GET", "/api/v1/store?since=soon", nil))
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("invalid since: %d", rr.Code)
+	}
+}
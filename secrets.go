@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+// passwordEnv is the environment variable -password falls back to
+const passwordEnv = "BCC_EXPORTER_PASSWORD"
+
+// readSecretFile returns the contents of a file holding a secret, without
+// the trailing newline editors and echo add
+func readSecretFile(path string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		log.Printf("Warning: secret file %s is accessible to other users (mode %v)", path, info.Mode().Perm())
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	secret := strings.TrimRight(string(data), "\r\n")
+	if secret == "" {
+		return "", fmt.Errorf("%s is empty", path)
+	}
+	return secret, nil
+}
+
+// resolveSecret returns the secret given literally, in the file at path or
+// in the environment variable env, of which at most one may be set
+func resolveSecret(value, path, env string) (string, error) {
+	set := 0
+	for _, s := range []string{value, path, env} {
+		if s != "" {
+			set++
+		}
+	}
+	if set > 1 {
+		return "", fmt.Errorf("only one of a literal value, a file and an environment variable may be given")
+	}
+
+	switch {
+	case path != "":
+		return readSecretFile(path)
+	case env != "":
+		secret, ok := os.LookupEnv(env)
+		if !ok || secret == "" {
+			return "", fmt.Errorf("environment variable %s is not set", env)
+		}
+		return secret, nil
+	}
+	return value, nil
+}
+
+// resolvePassword returns the basic authentication password from -password,
+// -password-file or $BCC_EXPORTER_PASSWORD, in that order of precedence
+func resolvePassword(flagValue, path string) (string, error) {
+	if flagValue != "" && path != "" {
+		return "", fmt.Errorf("-password and -password-file are mutually exclusive")
+	}
+	if flagValue != "" {
+		log.Printf("Warning: -password is visible in process listings and shell history, use -password-file or $%s", passwordEnv)
+		return flagValue, nil
+	}
+	if path != "" {
+		return readSecretFile(path)
+	}
+	// Keep the password out of the environment of perf, BCC and the others
+	secret := os.Getenv(passwordEnv)
+	os.Unsetenv(passwordEnv)
+	return secret, nil
+}
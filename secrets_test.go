@@ -0,0 +1,94 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeSecret writes secret to a file readable only by its owner
+func writeSecret(t *testing.T, secret string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(path, []byte(secret), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestResolveSecret(t *testing.T) {
+	t.Setenv("TEST_REDIS_PASSWORD", "from-env")
+	file := writeSecret(t, "from-file\n")
+	empty := writeSecret(t, "\n")
+
+	tests := []struct {
+		name             string
+		value, path, env string
+		want             string
+		wantErr          bool
+	}{
+		{"none", "", "", "", "", false},
+		{"literal", "literal", "", "", "literal", false},
+		{"file", "", file, "", "from-file", false},
+		{"env", "", "", "TEST_REDIS_PASSWORD", "from-env", false},
+		{"missing env", "", "", "TEST_UNSET_PASSWORD", "", true},
+		{"missing file", "", filepath.Join(t.TempDir(), "missing"), "", "", true},
+		{"empty file", "", empty, "", "", true},
+		{"two sources", "literal", file, "", "", true},
+	}
+	for _, tt := range tests {
+		got, err := resolveSecret(tt.value, tt.path, tt.env)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: resolveSecret() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+		} else if got != tt.want {
+			t.Errorf("%s: resolveSecret() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestResolvePassword(t *testing.T) {
+	file := writeSecret(t, "from-file\r\n")
+
+	if got, err := resolvePassword("flag", ""); err != nil || got != "flag" {
+		t.Errorf("resolvePassword(flag) = %q, %v", got, err)
+	}
+	if got, err := resolvePassword("", file); err != nil || got != "from-file" {
+		t.Errorf("resolvePassword(file) = %q, %v", got, err)
+	}
+	if _, err := resolvePassword("flag", file); err == nil {
+		t.Error("resolvePassword accepted both -password and -password-file")
+	}
+
+	// The environment variable is removed so child processes don't see it
+	t.Setenv(passwordEnv, "from-env")
+	if got, err := resolvePassword("", ""); err != nil || got != "from-env" {
+		t.Errorf("resolvePassword(env) = %q, %v", got, err)
+	}
+	if _, ok := os.LookupEnv(passwordEnv); ok {
+		t.Errorf("$%s is still set", passwordEnv)
+	}
+}
+
+func TestLoadConfigSecrets(t *testing.T) {
+	t.Setenv("TEST_WATCH_PASSWORD", "watch-secret")
+	file := writeSecret(t, "redis-secret\n")
+	path := filepath.Join(t.TempDir(), "config.json")
+	config := `{
+		"redis": {"username": "exporter", "password_file": "` + file + `"},
+		"redis_watch": {"instances": [{"addr": "127.0.0.1:6379", "password_env": "TEST_WATCH_PASSWORD", "threshold_ms": 50}]}
+	}`
+	if err := os.WriteFile(path, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Redis.Password != "redis-secret" {
+		t.Errorf("redis password = %q, want redis-secret", cfg.Redis.Password)
+	}
+	if got := cfg.RedisWatch.Instances[0].Password; got != "watch-secret" {
+		t.Errorf("redis_watch password = %q, want watch-secret", got)
+	}
+}
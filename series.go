@@ -0,0 +1,153 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// maxSeriesSeconds bounds the total duration of a snapshot series
+const maxSeriesSeconds = 3600
+
+// snapshotFunc captures one snapshot of a series into dir and returns its data
+type snapshotFunc func(opts profileOptions, dir string) ([]byte, error)
+
+// snapshotPerf captures a pprof snapshot with perf
+func snapshotPerf(opts profileOptions, dir string) ([]byte, error) {
+	path, err := capturePerfProfile(opts, dir)
+	if err != nil {
+		return nil, err
+	}
+	return readOutputFile("pprof profile", path)
+}
+
+// snapshotBCC captures a folded snapshot with profile-bpfcc
+func snapshotBCC(opts profileOptions, dir string) ([]byte, error) {
+	return captureBCCProfile(opts)
+}
+
+// seriesSnapshot describes one capture of a series in its manifest
+type seriesSnapshot struct {
+	Index     int       `json:"index"`
+	File      string    `json:"file"`
+	Start     time.Time `json:"start"`
+	End       time.Time `json:"end"`
+	ProfileID string    `json:"profile_id,omitempty"`
+}
+
+// seriesManifest is written as series.json at the end of a series archive
+type seriesManifest struct {
+	SeriesID  string           `json:"series_id,omitempty"`
+	PID       string           `json:"pid"`
+	Format    string           `json:"format"`
+	Seconds   int              `json:"seconds"`
+	Snapshots []seriesSnapshot `json:"snapshots"`
+}
+
+// runSeries takes opts.Snapshots consecutive captures of opts.Duration seconds
+// each and returns them as a tar archive, storing each one when the store is enabled
+func runSeries(w http.ResponseWriter, r *http.Request, opts profileOptions, format string, capture snapshotFunc) {
+	tempDir, err := newCaptureDir()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to create temp directory: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer os.RemoveAll(tempDir)
+
+	manifest := seriesManifest{PID: opts.PID, Format: format, Seconds: opts.Duration}
+	if store != nil {
+		if manifest.SeriesID, err = newProfileID(); err != nil {
+			http.Error(w, fmt.Sprintf("Failed to create series ID: %v", err), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	var snapshots [][]byte
+	for i := 1; i <= opts.Snapshots; i++ {
+		if r.Context().Err() != nil {
+			log.Printf("Client went away during snapshot series for PID %s", opts.PID)
+			return
+		}
+
+		dir := filepath.Join(tempDir, fmt.Sprintf("%03d", i))
+		if err := os.Mkdir(dir, 0700); err != nil {
+			http.Error(w, fmt.Sprintf("Failed to create temp directory: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		log.Printf("Capturing snapshot %d/%d for PID %s", i, opts.Snapshots, opts.PID)
+		snap := seriesSnapshot{
+			Index: i,
+			File:  fmt.Sprintf("snapshot-%03d%s", i, profileExtension(format)),
+			Start: time.Now().UTC(),
+		}
+		data, err := capture(opts, dir)
+		if err != nil {
+			writeCaptureError(w, err)
+			return
+		}
+		snap.End = time.Now().UTC()
+
+		if store != nil {
+			meta := captureMeta(opts, format)
+			meta.CreatedAt = snap.End
+			meta.Series = manifest.SeriesID
+			meta.SeriesIndex = i
+			if meta, err = store.Save(meta, bytes.NewReader(data)); err != nil {
+				log.Printf("Failed to store snapshot %d: %v", i, err)
+			} else {
+				snap.ProfileID = meta.ID
+			}
+		}
+
+		topFunctions.observe(captureMeta(opts, format), data)
+		manifest.Snapshots = append(manifest.Snapshots, snap)
+		snapshots = append(snapshots, data)
+	}
+
+	if manifest.SeriesID != "" {
+		w.Header().Set("X-Profile-Series", manifest.SeriesID)
+	}
+	w.Header().Set("Content-Type", "application/x-tar")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=series-%s-%dx%d.tar", opts.PID, opts.Snapshots, opts.Duration))
+
+	tw := tar.NewWriter(w)
+	for i, data := range snapshots {
+		if err := writeTarFile(tw, manifest.Snapshots[i].File, manifest.Snapshots[i].End, data); err != nil {
+			log.Printf("Failed to write snapshot archive: %v", err)
+			return
+		}
+	}
+	data, _ := json.MarshalIndent(manifest, "", "  ")
+	if err := writeTarFile(tw, "series.json", time.Now(), data); err != nil {
+		log.Printf("Failed to write snapshot archive: %v", err)
+		return
+	}
+	if err := tw.Close(); err != nil {
+		log.Printf("Failed to write snapshot archive: %v", err)
+		return
+	}
+
+	log.Printf("Successfully served %d snapshots for PID %s", opts.Snapshots, opts.PID)
+}
+
+// writeTarFile adds a regular file entry to a tar archive
+func writeTarFile(tw *tar.Writer, name string, modTime time.Time, data []byte) error {
+	hdr := &tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    int64(len(data)),
+		ModTime: modTime,
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err := tw.Write(data)
+	return err
+}
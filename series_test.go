@@ -0,0 +1,94 @@
+package main
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// readTar returns the contents of a tar archive keyed by entry name, in order
+func readTar(t *testing.T, r io.Reader) ([]string, map[string][]byte) {
+	t.Helper()
+
+	var names []string
+	files := make(map[string][]byte)
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, hdr.Name)
+		files[hdr.Name] = data
+	}
+	return names, files
+}
+
+func TestSeriesTestMode(t *testing.T) {
+	s := withTestStore(t)
+
+	rr := httptest.NewRecorder()
+	handleFolded(rr, httptest.NewRequest("GET", "/debug/folded/profile?pid=1234&seconds=2&snapshots=3&test=true", nil))
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("series returned %d: %s", rr.Code, rr.Body.String())
+	}
+	if ct := rr.Header().Get("Content-Type"); ct != "application/x-tar" {
+		t.Errorf("Content-Type = %q, want application/x-tar", ct)
+	}
+
+	names, files := readTar(t, rr.Body)
+	want := []string{"snapshot-001.folded.txt", "snapshot-002.folded.txt", "snapshot-003.folded.txt", "series.json"}
+	if len(names) != len(want) {
+		t.Fatalf("archive entries = %v, want %v", names, want)
+	}
+	for i := range want {
+		if names[i] != want[i] {
+			t.Errorf("entry %d = %q, want %q", i, names[i], want[i])
+		}
+	}
+
+	var manifest seriesManifest
+	if err := json.Unmarshal(files["series.json"], &manifest); err != nil {
+		t.Fatal(err)
+	}
+	if manifest.SeriesID == "" || manifest.SeriesID != rr.Header().Get("X-Profile-Series") {
+		t.Errorf("series ID %q does not match header %q", manifest.SeriesID, rr.Header().Get("X-Profile-Series"))
+	}
+	if len(manifest.Snapshots) != 3 || manifest.Snapshots[2].Index != 3 {
+		t.Fatalf("unexpected manifest: %+v", manifest)
+	}
+
+	meta, err := s.Get(manifest.Snapshots[1].ProfileID)
+	if err != nil {
+		t.Fatalf("snapshot 2 was not stored: %v", err)
+	}
+	if meta.Series != manifest.SeriesID || meta.SeriesIndex != 2 {
+		t.Errorf("stored snapshot metadata = %+v", meta)
+	}
+}
+
+func TestSeriesValidation(t *testing.T) {
+	tests := []string{
+		"/debug/pprof/profile?pid=1234&seconds=5&snapshots=0",
+		"/debug/pprof/profile?pid=1234&seconds=5&snapshots=101",
+		"/debug/pprof/profile?pid=1234&seconds=60&snapshots=61",
+	}
+
+	for _, url := range tests {
+		rr := httptest.NewRecorder()
+		handlePprof(rr, httptest.NewRequest("GET", url, nil))
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("%s returned %d, want 400", url, rr.Code)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+)
+
+// signingConfig is the signing section of the configuration file: every
+// stored and served profile is signed with the key, so pipelines consuming
+// the profiles can check they come from the exporter
+type signingConfig struct {
+	// KeyFile holds a PEM encoded Ed25519, ECDSA or RSA private key, in
+	// PKCS #8, SEC 1 or PKCS #1 form
+	KeyFile string `json:"key_file"`
+	// KeyID names the key in signatures (default the first 16 hex digits
+	// of the SHA-256 of its public key)
+	KeyID string `json:"key_id"`
+
+	signer crypto.Signer
+}
+
+func (c *signingConfig) validate() error {
+	if c.KeyFile == "" {
+		if c.KeyID != "" {
+			return fmt.Errorf("key_id needs a key_file")
+		}
+		return nil
+	}
+	data, err := readSecretFile(c.KeyFile)
+	if err != nil {
+		return fmt.Errorf("key_file: %v", err)
+	}
+	if c.signer, err = parseSigningKey([]byte(data)); err != nil {
+		return fmt.Errorf("key_file: %v", err)
+	}
+	if c.KeyID == "" {
+		der, err := x509.MarshalPKIXPublicKey(c.signer.Public())
+		if err != nil {
+			return fmt.Errorf("key_file: %v", err)
+		}
+		sum := sha256.Sum256(der)
+		c.KeyID = hex.EncodeToString(sum[:8])
+	}
+	return nil
+}
+
+// parseSigningKey decodes a PEM encoded private key usable for signing
+func parseSigningKey(data []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM encoded key found")
+	}
+	var key interface{}
+	var err error
+	switch block.Type {
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, err
+	}
+	switch key := key.(type) {
+	case ed25519.PrivateKey:
+		return key, nil
+	case *ecdsa.PrivateKey:
+		return key, nil
+	case *rsa.PrivateKey:
+		return key, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %T", key)
+}
+
+// currentSigning returns the signing settings in effect; none before the
+// server state is set up
+func currentSigning() signingConfig {
+	if s := state.Load(); s != nil {
+		return s.cfg.Signing
+	}
+	return signingConfig{}
+}
+
+// sign returns the base64 signature of the profile whose SHA-256 digest is
+// hexDigest, or "" when signing is off. ECDSA and RSA keys sign the digest
+// as the hash of the profile, so the signature verifies against the profile
+// itself; Ed25519 keys sign the 32 digest bytes.
+func (c signingConfig) sign(hexDigest string) (string, error) {
+	if c.signer == nil {
+		return "", nil
+	}
+	digest, err := hex.DecodeString(hexDigest)
+	if err != nil || len(digest) != sha256.Size {
+		return "", fmt.Errorf("invalid SHA-256 digest %q", hexDigest)
+	}
+	var opts crypto.SignerOpts = crypto.SHA256
+	if _, ok := c.signer.(ed25519.PrivateKey); ok {
+		opts = crypto.Hash(0)
+	}
+	sig, err := c.signer.Sign(rand.Reader, digest, opts)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(sig), nil
+}
+
+// setDigestHeaders reports the digest of a profile, and its signature when
+// it has one, in response headers
+func setDigestHeaders(w http.ResponseWriter, hexDigest, signature, keyID string) {
+	w.Header().Set("X-Profile-SHA256", hexDigest)
+	if digest, err := hex.DecodeString(hexDigest); err == nil {
+		// RFC 9530: standard clients can check the body they received
+		w.Header().Set("Repr-Digest", "sha-256=:"+base64.StdEncoding.EncodeToString(digest)+":")
+	}
+	if signature != "" {
+		w.Header().Set("X-Profile-Signature", signature)
+		w.Header().Set("X-Profile-Signature-Key", keyID)
+	}
+}
+
+// handleSigningKey serves the public key verifying profile signatures
+func handleSigningKey(w http.ResponseWriter, r *http.Request) {
+	cfg := currentSigning()
+	if cfg.signer == nil {
+		http.Error(w, "Profile signing is not enabled (configure signing.key_file)", http.StatusNotFound)
+		return
+	}
+	der, err := x509.MarshalPKIXPublicKey(cfg.signer.Public())
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to encode public key: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-pem-file")
+	w.Header().Set("X-Profile-Signature-Key", cfg.KeyID)
+	pem.Encode(w, &pem.Block{Type: "PUBLIC KEY", Bytes: der})
+}
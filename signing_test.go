@@ -0,0 +1,167 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeSigningKey writes key to a PEM file in form blockType and returns a
+// signing section using it
+func writeSigningKey(t *testing.T, key crypto.Signer, blockType string) signingConfig {
+	t.Helper()
+	var der []byte
+	var err error
+	switch blockType {
+	case "EC PRIVATE KEY":
+		der, err = x509.MarshalECPrivateKey(key.(*ecdsa.PrivateKey))
+	case "RSA PRIVATE KEY":
+		der = x509.MarshalPKCS1PrivateKey(key.(*rsa.PrivateKey))
+	default:
+		der, err = x509.MarshalPKCS8PrivateKey(key)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "signing.pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg := signingConfig{KeyFile: path}
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+// verifyProfileSignature checks a signature made by sign over data
+func verifyProfileSignature(pub crypto.PublicKey, data []byte, signature string) bool {
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+	digest := sha256.Sum256(data)
+	switch pub := pub.(type) {
+	case ed25519.PublicKey:
+		return ed25519.Verify(pub, digest[:], sig)
+	case *ecdsa.PublicKey:
+		return ecdsa.VerifyASN1(pub, digest[:], sig)
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sig) == nil
+	}
+	return false
+}
+
+func TestSigningKeys(t *testing.T) {
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+
+	data := []byte("redis-server;main;aeMain 42\n")
+	digest := sha256.Sum256(data)
+	for _, tc := range []struct {
+		key       crypto.Signer
+		blockType string
+	}{
+		{edKey, "PRIVATE KEY"},
+		{ecKey, "PRIVATE KEY"},
+		{ecKey, "EC PRIVATE KEY"},
+		{rsaKey, "RSA PRIVATE KEY"},
+	} {
+		cfg := writeSigningKey(t, tc.key, tc.blockType)
+		if len(cfg.KeyID) != 16 {
+			t.Errorf("%T: key ID %q", tc.key, cfg.KeyID)
+		}
+		sig, err := cfg.sign(hex.EncodeToString(digest[:]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !verifyProfileSignature(tc.key.Public(), data, sig) {
+			t.Errorf("%T in %s: signature does not verify", tc.key, tc.blockType)
+		}
+	}
+
+	if sig, err := (signingConfig{}).sign(hex.EncodeToString(digest[:])); sig != "" || err != nil {
+		t.Errorf("signing off: %q, %v", sig, err)
+	}
+	for _, cfg := range []signingConfig{
+		{KeyID: "prod"},
+		{KeyFile: filepath.Join(t.TempDir(), "missing.pem")},
+	} {
+		if err := cfg.validate(); err == nil {
+			t.Errorf("%+v accepted", cfg)
+		}
+	}
+}
+
+func TestProfileDigestHeaders(t *testing.T) {
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	cfg := writeSigningKey(t, key, "PRIVATE KEY")
+	orig := state.Load()
+	t.Cleanup(func() { state.Store(orig) })
+	state.Store(&serverState{cfg: &config{Signing: cfg}})
+
+	data := "redis-server;main;aeMain 42\n"
+	digest := sha256.Sum256([]byte(data))
+	check := func(what string, rr *httptest.ResponseRecorder) {
+		t.Helper()
+		if got := rr.Header().Get("X-Profile-SHA256"); got != hex.EncodeToString(digest[:]) {
+			t.Errorf("%s: X-Profile-SHA256 = %q", what, got)
+		}
+		if got := rr.Header().Get("Repr-Digest"); got != "sha-256=:"+base64.StdEncoding.EncodeToString(digest[:])+":" {
+			t.Errorf("%s: Repr-Digest = %q", what, got)
+		}
+		if rr.Header().Get("X-Profile-Signature-Key") != cfg.KeyID || !verifyProfileSignature(key.Public(), []byte(data), rr.Header().Get("X-Profile-Signature")) {
+			t.Errorf("%s: signature headers = %v", what, rr.Header())
+		}
+	}
+
+	// Served without a store
+	origStore := store
+	store = nil
+	rr := httptest.NewRecorder()
+	storeCapture(rr, profileMeta{Format: "perfscript", PID: "42"}, strings.NewReader(data))
+	store = origStore
+	check("capture", rr)
+
+	// Stored, then downloaded
+	s := withTestStore(t)
+	rr = httptest.NewRecorder()
+	storeCapture(rr, profileMeta{Format: "folded", PID: "42"}, strings.NewReader(data))
+	check("stored capture", rr)
+	meta, err := s.Get(rr.Header().Get("X-Profile-ID"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.SignatureKey != cfg.KeyID || !verifyProfileSignature(key.Public(), []byte(data), meta.Signature) {
+		t.Errorf("stored metadata = %+v", meta)
+	}
+	req := httptest.NewRequest("GET", "/api/v1/profiles/"+meta.ID, nil)
+	req.SetPathValue("id", meta.ID)
+	rr = httptest.NewRecorder()
+	handleGetProfile(rr, req)
+	check("download", rr)
+
+	rr = httptest.NewRecorder()
+	handleSigningKey(rr, httptest.NewRequest("GET", "/api/v1/signing-key", nil))
+	block, _ := pem.Decode(rr.Body.Bytes())
+	if block == nil {
+		t.Fatalf("signing key response: %s", rr.Body.String())
+	}
+	if pub, err := x509.ParsePKIXPublicKey(block.Bytes); err != nil || !key.Public().(ed25519.PublicKey).Equal(pub) {
+		t.Errorf("served public key = %v, %v", pub, err)
+	}
+}
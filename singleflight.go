@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"expvar"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// sharedCaptures counts the requests answered with the result of an
+// identical capture already running
+var sharedCaptures atomic.Int64
+
+func init() {
+	expvar.Publish("captures_shared", expvar.Func(func() interface{} { return sharedCaptures.Load() }))
+}
+
+// sharedCapture is the response of a capture that identical requests wait
+// for instead of starting their own
+type sharedCapture struct {
+	done    chan struct{}
+	waiters int
+
+	status int
+	header http.Header
+	body   bytes.Buffer
+	// ok is set when the response was complete and can be replayed
+	ok bool
+}
+
+// replay writes the response of c to w
+func (c *sharedCapture) replay(w http.ResponseWriter) {
+	for name, values := range c.header {
+		w.Header()[name] = values
+	}
+	w.Header().Set("X-Capture-Shared", "true")
+	w.WriteHeader(c.status)
+	w.Write(c.body.Bytes())
+}
+
+// teeWriter sends the response of the leading request to its client and
+// keeps a copy for the requests waiting for it
+type teeWriter struct {
+	http.ResponseWriter
+	c        *sharedCapture
+	limit    int64
+	overflow bool
+}
+
+// Unwrap lets http.ResponseController flush the response
+func (w *teeWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *teeWriter) WriteHeader(status int) {
+	if w.c.status == 0 {
+		w.c.status = status
+		w.c.header = w.Header().Clone()
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *teeWriter) Write(p []byte) (int, error) {
+	if w.c.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.limit > 0 && int64(w.c.body.Len()+len(p)) > w.limit {
+		w.overflow = true
+		w.c.body.Reset()
+	}
+	if !w.overflow {
+		w.c.body.Write(p)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// captureGroup runs one capture at a time per route and set of parameters:
+// a request arriving while an identical one is being served waits for its
+// response rather than starting a second profiler against the same process
+type captureGroup struct {
+	mu      sync.Mutex
+	running map[string]*sharedCapture
+}
+
+// inflight is the group of the capture endpoints
+var inflight = &captureGroup{running: make(map[string]*sharedCapture)}
+
+// shareable reports whether the response to r can be replayed to other
+// clients: streamed responses are sent as the capture runs, and WebSocket
+// connections are taken over by the handler
+func shareable(r *http.Request) bool {
+	return !r.URL.Query().Has("stream_interval") && r.Header.Get("Upgrade") == ""
+}
+
+// wrap shares the responses of handler, which serves route, between
+// identical concurrent requests. Parameters are compared after sorting, so
+// their order in the query string does not matter, and queue is left out:
+// a request that joins a running capture does not wait for a slot.
+func (g *captureGroup) wrap(route string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !shareable(r) {
+			handler(w, r)
+			return
+		}
+		q := r.URL.Query()
+		q.Del("queue")
+		key := route + "?" + q.Encode()
+		for {
+			g.mu.Lock()
+			c, found := g.running[key]
+			if found {
+				c.waiters++
+			} else {
+				c = &sharedCapture{done: make(chan struct{})}
+				g.running[key] = c
+			}
+			g.mu.Unlock()
+
+			if !found {
+				g.lead(key, c, handler, w, r)
+				return
+			}
+			select {
+			case <-c.done:
+			case <-r.Context().Done():
+				return
+			}
+			if c.ok {
+				sharedCaptures.Add(1)
+				c.replay(w)
+				return
+			}
+			// The leading client went away and its capture was cut
+			// short, or its response was too large to keep: start over
+		}
+	}
+}
+
+// lead serves r with handler and publishes its response to the requests
+// that joined it under key
+func (g *captureGroup) lead(key string, c *sharedCapture, handler http.HandlerFunc, w http.ResponseWriter, r *http.Request) {
+	tw := &teeWriter{ResponseWriter: w, c: c, limit: int64(currentLimits().MaxResponse)}
+	returned := false
+	defer func() {
+		g.mu.Lock()
+		delete(g.running, key)
+		g.mu.Unlock()
+		c.ok = returned && c.status != 0 && !tw.overflow && r.Context().Err() == nil
+		close(c.done)
+	}()
+	handler(tw, r)
+	returned = true
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// waitForWaiters polls g until n requests wait for the capture under key
+func waitForWaiters(t *testing.T, g *captureGroup, key string, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		g.mu.Lock()
+		c := g.running[key]
+		waiting := c != nil && c.waiters >= n
+		g.mu.Unlock()
+		if waiting {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("no %d requests waiting for %s", n, key)
+}
+
+func TestCaptureGroupSharesIdenticalRequests(t *testing.T) {
+	g := &captureGroup{running: make(map[string]*sharedCapture)}
+	release := make(chan struct{})
+	var calls atomic.Int32
+	h := g.wrap("/debug/folded/profile", func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		<-release
+		w.Header().Set("X-Profile-ID", "0123456789abcdef")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("a;b 1\n"))
+	})
+
+	urls := []string{
+		"/debug/folded/profile?pid=42&seconds=10",
+		"/debug/folded/profile?seconds=10&pid=42",
+		"/debug/folded/profile?pid=42&seconds=10",
+	}
+	recorders := make([]*httptest.ResponseRecorder, len(urls))
+	var wg sync.WaitGroup
+	for i, url := range urls {
+		recorders[i] = httptest.NewRecorder()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			h(recorders[i], httptest.NewRequest("GET", url, nil))
+		}()
+		if i == 0 {
+			for calls.Load() == 0 {
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}
+	waitForWaiters(t, g, "/debug/folded/profile?pid=42&seconds=10", 2)
+	close(release)
+	wg.Wait()
+
+	if n := calls.Load(); n != 1 {
+		t.Errorf("handler ran %d times, want 1", n)
+	}
+	for i, rr := range recorders {
+		if rr.Code != http.StatusOK || rr.Body.String() != "a;b 1\n" || rr.Header().Get("X-Profile-ID") != "0123456789abcdef" {
+			t.Errorf("response %d = %d %q %v", i, rr.Code, rr.Body.String(), rr.Header())
+		}
+		if shared := rr.Header().Get("X-Capture-Shared") == "true"; shared != (i > 0) {
+			t.Errorf("response %d X-Capture-Shared = %q", i, rr.Header().Get("X-Capture-Shared"))
+		}
+	}
+	if len(g.running) != 0 {
+		t.Errorf("captures left running: %v", g.running)
+	}
+}
+
+func TestCaptureGroupRunsOthersSeparately(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		first  string
+		second string
+		header http.Header
+	}{
+		{"other parameters", "/p?pid=42&seconds=10", "/p?pid=42&seconds=20", nil},
+		{"streamed", "/p?pid=42&stream_interval=1", "/p?pid=42&stream_interval=1", nil},
+		{"websocket", "/p?pid=42", "/p?pid=42", http.Header{"Upgrade": {"websocket"}}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			g := &captureGroup{running: make(map[string]*sharedCapture)}
+			release := make(chan struct{})
+			var calls atomic.Int32
+			h := g.wrap("/p", func(w http.ResponseWriter, r *http.Request) {
+				if calls.Add(1) == 2 {
+					close(release)
+				}
+				<-release
+			})
+
+			var wg sync.WaitGroup
+			for _, url := range []string{tc.first, tc.second} {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					req := httptest.NewRequest("GET", url, nil)
+					req.Header = tc.header
+					h(httptest.NewRecorder(), req)
+				}()
+			}
+			done := make(chan struct{})
+			go func() { wg.Wait(); close(done) }()
+			select {
+			case <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatal("requests waited for each other")
+			}
+		})
+	}
+}
+
+func TestCaptureGroupLeaderGone(t *testing.T) {
+	g := &captureGroup{running: make(map[string]*sharedCapture)}
+	var calls atomic.Int32
+	h := g.wrap("/p", func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			// The first client hangs up mid-capture
+			<-r.Context().Done()
+			http.Error(w, "capture interrupted", http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte("a;b 1\n"))
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	leader := make(chan struct{})
+	go func() {
+		defer close(leader)
+		h(httptest.NewRecorder(), httptest.NewRequest("GET", "/p?pid=42", nil).WithContext(ctx))
+	}()
+	for calls.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	rr := httptest.NewRecorder()
+	follower := make(chan struct{})
+	go func() {
+		defer close(follower)
+		h(rr, httptest.NewRequest("GET", "/p?pid=42", nil))
+	}()
+	waitForWaiters(t, g, "/p?pid=42", 1)
+	cancel()
+	<-leader
+	<-follower
+
+	if rr.Code != http.StatusOK || rr.Body.String() != "a;b 1\n" || rr.Header().Get("X-Capture-Shared") != "" {
+		t.Errorf("follower response = %d %q %v", rr.Code, rr.Body.String(), rr.Header())
+	}
+	if n := calls.Load(); n != 2 {
+		t.Errorf("handler ran %d times, want 2", n)
+	}
+}
+
+func TestCaptureGroupResponseTooLarge(t *testing.T) {
+	setLimits(t, limitsConfig{MaxResponse: 4})
+	g := &captureGroup{running: make(map[string]*sharedCapture)}
+	release := make(chan struct{})
+	var calls atomic.Int32
+	h := g.wrap("/p", func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			<-release
+		}
+		w.Write([]byte("a;b 1\n"))
+	})
+
+	var wg sync.WaitGroup
+	recorders := []*httptest.ResponseRecorder{httptest.NewRecorder(), httptest.NewRecorder()}
+	for i, rr := range recorders {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			h(rr, httptest.NewRequest("GET", "/p?pid=42", nil))
+		}()
+		if i == 0 {
+			for calls.Load() == 0 {
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}
+	waitForWaiters(t, g, "/p?pid=42", 1)
+	close(release)
+	wg.Wait()
+
+	if n := calls.Load(); n != 2 {
+		t.Errorf("handler ran %d times, want 2", n)
+	}
+	for i, rr := range recorders {
+		if rr.Body.String() != "a;b 1\n" {
+			t.Errorf("response %d = %q", i, rr.Body.String())
+		}
+	}
+}
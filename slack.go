@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// slackConfig is the slack section of the configuration file: profiles
+// captured by the watchdog, the Alertmanager receiver, the Redis latency
+// watcher or ProfileJobs are announced in a Slack channel
+type slackConfig struct {
+	// WebhookURL is the incoming webhook of the channel; WebhookURL,
+	// WebhookURLFile and WebhookURLEnv work like the Redis password
+	// settings, as the URL is a secret
+	WebhookURL     string `json:"webhook_url,omitempty"`
+	WebhookURLFile string `json:"webhook_url_file,omitempty"`
+	WebhookURLEnv  string `json:"webhook_url_env,omitempty"`
+	// BaseURL is the external URL of the exporter the flamegraph links
+	// start with
+	BaseURL string `json:"base_url"`
+	// Triggers limits the messages to captures of these triggers:
+	// "watchdog", "alertmanager", "redis-latency" or "profilejob" (default
+	// all)
+	Triggers []string `json:"triggers,omitempty"`
+}
+
+func (c *slackConfig) validate() error {
+	webhook, err := resolveSecret(c.WebhookURL, c.WebhookURLFile, c.WebhookURLEnv)
+	if err != nil {
+		return fmt.Errorf("webhook_url: %v", err)
+	}
+	c.WebhookURL = webhook
+	if c.WebhookURL == "" {
+		return nil
+	}
+	if u, err := url.Parse(c.WebhookURL); err != nil || u.Scheme != "https" && u.Scheme != "http" || u.Host == "" {
+		return fmt.Errorf("webhook_url is not a URL")
+	}
+	if u, err := url.Parse(c.BaseURL); err != nil || u.Scheme != "https" && u.Scheme != "http" || u.Host == "" {
+		return fmt.Errorf("base_url is required to link the flamegraphs, e.g. https://bcc-exporter.example.com")
+	}
+	c.BaseURL = strings.TrimSuffix(c.BaseURL, "/")
+	for _, trigger := range c.Triggers {
+		if _, ok := slackTriggers[trigger]; !ok {
+			return fmt.Errorf("triggers must be watchdog, alertmanager, redis-latency or profilejob, not %q", trigger)
+		}
+	}
+	return nil
+}
+
+// wants reports whether the stored profile of meta is announced
+func (c slackConfig) wants(meta profileMeta) bool {
+	if c.WebhookURL == "" || meta.Trigger == "" {
+		return false
+	}
+	return len(c.Triggers) == 0 || slices.Contains(c.Triggers, meta.Trigger)
+}
+
+// currentSlack returns the Slack settings in effect; none before the
+// server state is set up
+func currentSlack() slackConfig {
+	if s := state.Load(); s != nil {
+		return s.cfg.Slack
+	}
+	return slackConfig{}
+}
+
+// slackEscape escapes the characters Slack gives a meaning in message text
+func slackEscape(s string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(s)
+}
+
+// slackTriggers names the triggers in messages
+var slackTriggers = map[string]string{
+	"watchdog":      "the CPU watchdog",
+	"alertmanager":  "an Alertmanager alert",
+	"redis-latency": "the Redis latency watcher",
+	"profilejob":    "a Kubernetes ProfileJob",
+}
+
+// slackMessage returns the incoming webhook payload announcing the stored
+// profile of meta, captured on host
+func slackMessage(cfg slackConfig, host string, meta profileMeta) ([]byte, error) {
+	target := "PID " + meta.PID
+	if meta.Comm != "" {
+		target = meta.Comm + " (" + target + ")"
+	}
+	profileURL := cfg.BaseURL + *prefix + "/api/v1/profiles/" + meta.ID
+	text := fmt.Sprintf(":fire: Profile of *%s* on `%s` captured by %s\n*Reason:* %s\n<%s/flamegraph|Flamegraph> · <%s|Download %s>",
+		slackEscape(target), slackEscape(host), slackTriggers[meta.Trigger], slackEscape(meta.TriggerReason),
+		profileURL, profileURL, meta.Format)
+	return json.Marshal(map[string]interface{}{"text": text, "unfurl_links": false})
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSlackConfigValidate(t *testing.T) {
+	var cfg slackConfig
+	if err := cfg.validate(); err != nil {
+		t.Errorf("empty section: %v", err)
+	}
+	for _, cfg := range []slackConfig{
+		{WebhookURL: "https://hooks.slack.com/services/T0/B0/x"},
+		{WebhookURL: "https://hooks.slack.com/services/T0/B0/x", BaseURL: "https://bcc.example.com", Triggers: []string{"manual"}},
+		{WebhookURL: "hooks.slack.com", BaseURL: "https://bcc.example.com"},
+	} {
+		if err := cfg.validate(); err == nil {
+			t.Errorf("%+v accepted", cfg)
+		}
+	}
+}
+
+func TestSlackMessage(t *testing.T) {
+	cfg := slackConfig{WebhookURL: "https://hooks.slack.com/services/T0/B0/x", BaseURL: "https://bcc.example.com"}
+	meta := profileMeta{ID: "3f9a1c0e7b2d4856", Format: "pprof", PID: "4242", Comm: "redis-server",
+		Trigger: "alertmanager", TriggerReason: "RedisHighCPU <instance=redis-7>"}
+	data, err := slackMessage(cfg, "redis-7", meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var msg struct {
+		Text string `json:"text"`
+	}
+	json.Unmarshal(data, &msg)
+	for _, want := range []string{
+		"*redis-server (PID 4242)* on `redis-7` captured by an Alertmanager alert",
+		"RedisHighCPU &lt;instance=redis-7&gt;",
+		"<https://bcc.example.com/api/v1/profiles/3f9a1c0e7b2d4856/flamegraph|Flamegraph>",
+	} {
+		if !strings.Contains(msg.Text, want) {
+			t.Errorf("message %q lacks %q", msg.Text, want)
+		}
+	}
+
+	if cfg.wants(profileMeta{ID: meta.ID}) {
+		t.Error("profile captured on request announced")
+	}
+	cfg.Triggers = []string{"watchdog"}
+	if cfg.wants(meta) {
+		t.Error("profile of a trigger left out announced")
+	}
+}
+
+func TestSlackNotify(t *testing.T) {
+	got := make(chan string, 2)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		got <- string(body)
+	}))
+	defer srv.Close()
+
+	n := setWebhooks(t, webhooksConfig{})
+	slack := slackConfig{WebhookURL: srv.URL, BaseURL: "https://bcc.example.com"}
+	if err := slack.validate(); err != nil {
+		t.Fatal(err)
+	}
+	state.Store(&serverState{cfg: &config{Slack: slack}})
+
+	n.profileDone(profileMeta{ID: "3f9a1c0e7b2d4856", Format: "folded", PID: "1"})
+	n.profileDone(profileMeta{ID: "0123456789abcdef", Format: "pprof", PID: "42", Trigger: "watchdog", TriggerReason: "redis-cpu: cpu 97.2% >= 90.0% for 30s"})
+	select {
+	case body := <-got:
+		if !strings.Contains(body, "0123456789abcdef") || !strings.Contains(body, "redis-cpu") {
+			t.Errorf("message = %s", body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no Slack message for the watchdog capture")
+	}
+	select {
+	case body := <-got:
+		t.Errorf("unexpected message %s", body)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
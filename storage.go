@@ -0,0 +1,320 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// errObjectNotFound is returned by a Storage for objects it does not hold
+var errObjectNotFound = errors.New("object not found")
+
+// Storage holds the objects of the profile store by name: the data of the
+// profiles, their metadata and attachments. Names are flat, such as
+// "3f9a1c0e7b2d4856.json".
+type Storage interface {
+	// Put writes the object name with the contents of r, size bytes long
+	// or -1 when unknown, replacing any previous one
+	Put(name string, r io.Reader, size int64) error
+	// Get opens the object name, or returns errObjectNotFound
+	Get(name string) (io.ReadSeekCloser, error)
+	// List returns the names of the objects starting with prefix
+	List(prefix string) ([]string, error)
+	// Delete removes the object name; removing a missing object succeeds
+	Delete(name string) error
+}
+
+// storageConfig is the storage section of the configuration file, which
+// selects where the profile store keeps its objects
+type storageConfig struct {
+	// Backend is "local" (default) for the -store-dir directory, "s3",
+	// "gcs" or "azure"
+	Backend string      `json:"backend"`
+	S3      s3Config    `json:"s3"`
+	GCS     gcsConfig   `json:"gcs"`
+	Azure   azureConfig `json:"azure"`
+	// Encryption encrypts the objects of every backend
+	Encryption encryptionConfig `json:"encryption"`
+}
+
+func (c *storageConfig) validate() error {
+	if err := c.Encryption.validate(); err != nil {
+		return fmt.Errorf("encryption: %v", err)
+	}
+	switch c.Backend {
+	case "", "local":
+		c.Backend = "local"
+		return nil
+	case "s3":
+		if c.S3.Bucket == "" {
+			return fmt.Errorf("s3.bucket is required")
+		}
+		if err := c.S3.validate(); err != nil {
+			return fmt.Errorf("s3: %v", err)
+		}
+	case "gcs":
+		if err := c.GCS.validate(); err != nil {
+			return fmt.Errorf("gcs: %v", err)
+		}
+	case "azure":
+		if err := c.Azure.validate(); err != nil {
+			return fmt.Errorf("azure: %v", err)
+		}
+	default:
+		return fmt.Errorf("backend must be local, s3, gcs or azure")
+	}
+	return nil
+}
+
+// openStorage returns the storage of cfg, with dir as the directory of the
+// local backend. It returns nil when the local backend has no directory:
+// the profile store is off.
+func openStorage(cfg storageConfig, dir string) (Storage, error) {
+	var s Storage
+	var err error
+	switch cfg.Backend {
+	case "s3":
+		s, err = newS3Storage(cfg.S3)
+	case "gcs":
+		s, err = newGCSStorage(cfg.GCS)
+	case "azure":
+		s, err = newAzureStorage(cfg.Azure)
+	default:
+		if dir == "" {
+			return nil, nil
+		}
+		s, err = newLocalStorage(dir)
+	}
+	if err != nil || !cfg.Encryption.enabled() {
+		return s, err
+	}
+	return newEncryptedStorage(s, cfg.Encryption)
+}
+
+// localStorage keeps objects as files of a directory
+type localStorage struct {
+	dir string
+}
+
+// newLocalStorage creates dir if needed
+func newLocalStorage(dir string) (*localStorage, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &localStorage{dir: dir}, nil
+}
+
+func (s *localStorage) String() string {
+	return s.dir
+}
+
+// path returns the file of object name, refusing names that would leave
+// the directory
+func (s *localStorage) path(name string) (string, error) {
+	if name == "" || strings.ContainsAny(name, `/\`) || name == "." || name == ".." {
+		return "", fmt.Errorf("invalid object name %q", name)
+	}
+	return filepath.Join(s.dir, name), nil
+}
+
+// Put writes a temporary file and renames it into place, so readers never
+// see a partial object
+func (s *localStorage) Put(name string, r io.Reader, size int64) error {
+	path, err := s.path(name)
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(s.dir, ".tmp-"+name+"-")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+func (s *localStorage) Get(name string) (io.ReadSeekCloser, error) {
+	path, err := s.path(name)
+	if err != nil {
+		return nil, errObjectNotFound
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, errObjectNotFound
+	}
+	return f, err
+}
+
+func (s *localStorage) List(prefix string) ([]string, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, entry := range entries {
+		if name := entry.Name(); strings.HasPrefix(name, prefix) && !strings.HasPrefix(name, ".tmp-") {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+func (s *localStorage) Delete(name string) error {
+	path, err := s.path(name)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// spool copies r to a temporary file when its size is unknown, for object
+// stores that need the length of an upload up front. The returned function
+// removes the file.
+func spool(r io.Reader, size int64) (io.Reader, int64, func(), error) {
+	if size >= 0 {
+		return r, size, func() {}, nil
+	}
+	f, err := os.CreateTemp(tempRoot, "bcc-exporter-upload-")
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	cleanup := func() {
+		f.Close()
+		os.Remove(f.Name())
+	}
+	n, err := io.Copy(f, r)
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		cleanup()
+		return nil, 0, nil, err
+	}
+	return f, n, cleanup, nil
+}
+
+// remoteObject reads an object of an HTTP object store, fetching it again
+// from the new offset with a Range request after a seek. This lets
+// http.ServeContent answer Range requests for remote profiles without
+// downloading them whole.
+type remoteObject struct {
+	// fetch requests the object from offset on
+	fetch func(offset int64) (*http.Response, error)
+	size  int64
+	pos   int64
+
+	body    io.ReadCloser
+	bodyPos int64
+}
+
+// openRemoteObject fetches an object with fetch; a 404 response yields
+// errObjectNotFound
+func openRemoteObject(fetch func(offset int64) (*http.Response, error)) (*remoteObject, error) {
+	o := &remoteObject{fetch: fetch}
+	resp, err := o.open(0)
+	if err != nil {
+		return nil, err
+	}
+	o.body = resp.Body
+	o.size = resp.ContentLength
+	if resp.StatusCode == http.StatusPartialContent {
+		_, total, _ := strings.Cut(resp.Header.Get("Content-Range"), "/")
+		if o.size, err = strconv.ParseInt(total, 10, 64); err != nil {
+			resp.Body.Close()
+			return nil, fmt.Errorf("invalid Content-Range %q", resp.Header.Get("Content-Range"))
+		}
+	}
+	if o.size < 0 {
+		o.body.Close()
+		return nil, fmt.Errorf("object store did not send the object size")
+	}
+	return o, nil
+}
+
+// open fetches the object from offset
+func (o *remoteObject) open(offset int64) (*http.Response, error) {
+	resp, err := o.fetch(offset)
+	if err != nil {
+		return nil, err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusPartialContent:
+		return resp, nil
+	case http.StatusNotFound:
+		resp.Body.Close()
+		return nil, errObjectNotFound
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	return nil, fmt.Errorf("%s: %s", resp.Status, s3ErrorMessage(body))
+}
+
+func (o *remoteObject) Read(p []byte) (int, error) {
+	if o.pos >= o.size {
+		return 0, io.EOF
+	}
+	if o.body == nil || o.bodyPos != o.pos {
+		if o.body != nil {
+			o.body.Close()
+			o.body = nil
+		}
+		resp, err := o.open(o.pos)
+		if err != nil {
+			return 0, err
+		}
+		o.body, o.bodyPos = resp.Body, o.pos
+	}
+	n, err := o.body.Read(p)
+	o.pos += int64(n)
+	o.bodyPos = o.pos
+	if err == io.EOF && o.pos < o.size {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (o *remoteObject) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += o.pos
+	case io.SeekEnd:
+		offset += o.size
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("negative offset")
+	}
+	o.pos = offset
+	return offset, nil
+}
+
+func (o *remoteObject) Close() error {
+	if o.body != nil {
+		return o.body.Close()
+	}
+	return nil
+}
+
+// rangeHeader returns the Range header asking for an object from offset
+// on, or "" for the whole object
+func rangeHeader(offset int64) string {
+	if offset == 0 {
+		return ""
+	}
+	return fmt.Sprintf("bytes=%d-", offset)
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testStorage puts, reads, lists and deletes objects of st
+func testStorage(t *testing.T, st Storage) {
+	t.Helper()
+	if err := st.Put("3f9a1c0e7b2d4856.json", strings.NewReader(`{"id":"3f9a1c0e7b2d4856"}`), -1); err != nil {
+		t.Fatal(err)
+	}
+	data := "main;aeMain;processCommand 10\n"
+	if err := st.Put("3f9a1c0e7b2d4856.folded.txt", strings.NewReader(data), int64(len(data))); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := st.Get("3f9a1c0e7b2d4856.folded.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Seek(5, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(f)
+	f.Close()
+	if err != nil || string(got) != data[5:] {
+		t.Errorf("read from offset 5 = %q, %v", got, err)
+	}
+
+	names, err := st.List("3f9a")
+	slices.Sort(names)
+	if err != nil || !slices.Equal(names, []string{"3f9a1c0e7b2d4856.folded.txt", "3f9a1c0e7b2d4856.json"}) {
+		t.Errorf("List() = %v, %v", names, err)
+	}
+
+	if err := st.Delete("3f9a1c0e7b2d4856.json"); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.Delete("3f9a1c0e7b2d4856.json"); err != nil {
+		t.Errorf("deleting a missing object: %v", err)
+	}
+	if _, err := st.Get("3f9a1c0e7b2d4856.json"); err != errObjectNotFound {
+		t.Errorf("Get() of a deleted object: %v", err)
+	}
+}
+
+// fakeObjects is the content of a fake object store
+type fakeObjects struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func newFakeObjects() *fakeObjects {
+	return &fakeObjects{objects: map[string][]byte{}}
+}
+
+func (o *fakeObjects) put(name string, r io.Reader) {
+	data, _ := io.ReadAll(r)
+	o.mu.Lock()
+	o.objects[name] = data
+	o.mu.Unlock()
+}
+
+// serve answers a GET of object name, honoring Range
+func (o *fakeObjects) serve(w http.ResponseWriter, r *http.Request, name string) {
+	o.mu.Lock()
+	data, ok := o.objects[name]
+	o.mu.Unlock()
+	if !ok {
+		http.Error(w, "no such object", http.StatusNotFound)
+		return
+	}
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+}
+
+// delete removes object name and reports whether it existed
+func (o *fakeObjects) delete(name string) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	_, ok := o.objects[name]
+	delete(o.objects, name)
+	return ok
+}
+
+// list returns the names starting with prefix
+func (o *fakeObjects) list(prefix string) []string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	var names []string
+	for name := range o.objects {
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	return names
+}
+
+func TestLocalStorage(t *testing.T) {
+	st, err := newLocalStorage(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStorage(t, st)
+
+	for _, name := range []string{"", "..", "../passwd", `a\b`} {
+		if err := st.Put(name, strings.NewReader("x"), 1); err == nil {
+			t.Errorf("Put(%q) accepted", name)
+		}
+	}
+}
+
+func TestStorageConfigValidate(t *testing.T) {
+	var cfg storageConfig
+	if err := cfg.validate(); err != nil || cfg.Backend != "local" {
+		t.Errorf("default backend = %q, %v", cfg.Backend, err)
+	}
+	for _, cfg := range []storageConfig{
+		{Backend: "ftp"},
+		{Backend: "s3"},
+		{Backend: "gcs"},
+		{Backend: "azure", Azure: azureConfig{Account: "profiles"}},
+	} {
+		if err := cfg.validate(); err == nil {
+			t.Errorf("%+v accepted", cfg)
+		}
+	}
+}
+
+func TestRemoteObjectNotFound(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	defer srv.Close()
+	_, err := openRemoteObject(func(offset int64) (*http.Response, error) {
+		return http.Get(srv.URL)
+	})
+	if err != errObjectNotFound {
+		t.Errorf("openRemoteObject() = %v", err)
+	}
+}
+
+func TestProfileStoreDelete(t *testing.T) {
+	s := withTestStore(t)
+	meta, err := s.Save(profileMeta{Format: "folded", PID: "42", Attachments: []string{"redis"}}, strings.NewReader("a;b 1\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SaveAttachment(meta.ID, "redis", []byte(`{}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	del := func(id string) int {
+		r := httptest.NewRequest("DELETE", "/api/v1/profiles/"+id, nil)
+		r.SetPathValue("id", id)
+		rr := httptest.NewRecorder()
+		handleDeleteProfile(rr, r)
+		return rr.Code
+	}
+	if code := del(meta.ID); code != http.StatusNoContent {
+		t.Fatalf("DELETE = %d", code)
+	}
+	if code := del(meta.ID); code != http.StatusNotFound {
+		t.Errorf("second DELETE = %d", code)
+	}
+	if names, _ := s.storage.List(meta.ID); len(names) != 0 {
+		t.Errorf("objects left: %v", names)
+	}
+}
@@ -0,0 +1,535 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// store holds captured profiles when the exporter runs with -store-dir or
+// a remote storage backend
+var store *profileStore
+
+// errProfileNotFound is returned for unknown or malformed profile IDs
+var errProfileNotFound = errors.New("profile not found")
+
+// profileMeta describes a stored profile
+type profileMeta struct {
+	ID        string    `json:"id"`
+	Format    string    `json:"format"` // "pprof", "folded", "perfscript", "perfdata", "perfarchive", "speedscope", "flamegraph" or "chrometrace"
+	PID       string    `json:"pid,omitempty"`
+	Comm      string    `json:"comm,omitempty"`
+	Duration  int       `json:"duration,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	Size      int64     `json:"size"`
+	// SHA256 is the hex digest of the data, empty for profiles stored by
+	// older versions
+	SHA256 string `json:"sha256,omitempty"`
+	// Signature is the base64 signature of the data with the signing key
+	// SignatureKey, when signing is configured
+	Signature    string `json:"signature,omitempty"`
+	SignatureKey string `json:"signature_key,omitempty"`
+
+	// Series groups the snapshots of a series capture, in SeriesIndex order
+	Series      string `json:"series,omitempty"`
+	SeriesIndex int    `json:"series_index,omitempty"`
+
+	// Trigger names what started an automatic capture ("watchdog",
+	// "alertmanager", "redis-latency" or "profilejob") and
+	// TriggerReason records why
+	Trigger       string `json:"trigger,omitempty"`
+	TriggerReason string `json:"trigger_reason,omitempty"`
+
+	// Labels are the key/value labels given with the capture request
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// Attachments names the extra documents stored with the profile, such
+	// as "redis" for the Redis metadata of a redis_metadata capture
+	Attachments []string `json:"attachments,omitempty"`
+
+	// Pinned profiles are never evicted to stay within the store quota.
+	// It is set by List from the marker object written by Pin.
+	Pinned bool `json:"pinned,omitempty"`
+}
+
+// profileStore keeps profiles, their metadata and attachments as objects of
+// a Storage
+type profileStore struct {
+	storage Storage
+
+	// listed caches the metadata read by List, which never changes once
+	// written, so listing a remote store does not fetch every object again
+	mu     sync.Mutex
+	listed map[string]profileMeta
+}
+
+// newProfileStore returns a store keeping its objects in the local
+// directory dir, which is created if needed
+func newProfileStore(dir string) (*profileStore, error) {
+	storage, err := newLocalStorage(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &profileStore{storage: storage}, nil
+}
+
+// newProfileID returns a random identifier for a stored profile
+func newProfileID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// validProfileID reports whether id has the shape produced by newProfileID,
+// which keeps user supplied IDs from escaping the store directory
+func validProfileID(id string) bool {
+	if len(id) != 16 {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
+
+// profileExtension returns the data file extension used for a format
+func profileExtension(format string) string {
+	switch format {
+	case "folded":
+		return ".folded.txt"
+	case "perfscript":
+		return ".perf.txt"
+	case "perfdata":
+		return ".perf.data"
+	case "perfarchive":
+		return ".perf.tar"
+	case "speedscope":
+		return ".speedscope.json"
+	case "flamegraph":
+		return ".svg"
+	case "chrometrace":
+		return ".trace.json"
+	}
+	return ".pb.gz"
+}
+
+// metaName returns the name of the metadata object of profile id
+func metaName(id string) string {
+	return id + ".json"
+}
+
+// dataName returns the name of the data object of the profile of meta
+func dataName(meta profileMeta) string {
+	return meta.ID + profileExtension(meta.Format)
+}
+
+// attachmentName returns the name of the attachment name of profile id
+func attachmentName(id, name string) string {
+	return id + "." + name + ".json"
+}
+
+// countingWriter counts the bytes written to it
+type countingWriter struct {
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
+
+// Save writes the profile read from r and returns its completed metadata.
+// The profile gets a new ID unless meta already has one.
+func (s *profileStore) Save(meta profileMeta, r io.Reader) (profileMeta, error) {
+	if meta.ID == "" {
+		id, err := newProfileID()
+		if err != nil {
+			return meta, err
+		}
+		meta.ID = id
+	} else if !validProfileID(meta.ID) {
+		return meta, fmt.Errorf("invalid profile ID %q", meta.ID)
+	}
+	if meta.CreatedAt.IsZero() {
+		meta.CreatedAt = time.Now().UTC()
+	}
+
+	size := int64(-1)
+	if l, ok := r.(interface{ Len() int }); ok {
+		size = int64(l.Len())
+	}
+	digest, count := sha256.New(), &countingWriter{}
+	err := s.storage.Put(dataName(meta), io.TeeReader(r, io.MultiWriter(digest, count)), size)
+	if err != nil {
+		return meta, err
+	}
+	meta.Size = count.n
+	meta.SHA256 = hex.EncodeToString(digest.Sum(nil))
+	signing := currentSigning()
+	if meta.Signature, err = signing.sign(meta.SHA256); err != nil {
+		s.storage.Delete(dataName(meta))
+		return meta, fmt.Errorf("signing profile: %v", err)
+	}
+	if meta.Signature != "" {
+		meta.SignatureKey = signing.KeyID
+	}
+
+	// The metadata goes last: profiles are listed by their metadata, so
+	// they never show up before their data is complete
+	data, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return meta, err
+	}
+	if err := s.storage.Put(metaName(meta.ID), bytes.NewReader(data), int64(len(data))); err != nil {
+		s.storage.Delete(dataName(meta))
+		return meta, err
+	}
+
+	uploads.enqueue(s, meta)
+	if err := s.enforceQuota(currentQuota(), meta.ID); err != nil {
+		log.Printf("Failed to enforce the store quota: %v", err)
+	}
+	return meta, nil
+}
+
+// SaveAttachment stores a JSON document alongside profile id
+func (s *profileStore) SaveAttachment(id, name string, data []byte) error {
+	if !validProfileID(id) {
+		return errProfileNotFound
+	}
+	return s.storage.Put(attachmentName(id, name), bytes.NewReader(data), int64(len(data)))
+}
+
+// ReadAttachment returns a JSON document stored alongside profile id
+func (s *profileStore) ReadAttachment(id, name string) ([]byte, error) {
+	if !validProfileID(id) {
+		return nil, errProfileNotFound
+	}
+	return s.readObject(attachmentName(id, name))
+}
+
+// readObject returns the contents of a small object, such as metadata
+func (s *profileStore) readObject(name string) ([]byte, error) {
+	f, err := s.storage.Get(name)
+	if err == errObjectNotFound {
+		return nil, errProfileNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+// Get returns the metadata of a stored profile
+func (s *profileStore) Get(id string) (profileMeta, error) {
+	var meta profileMeta
+	if !validProfileID(id) {
+		return meta, errProfileNotFound
+	}
+	data, err := s.readObject(metaName(id))
+	if err != nil {
+		return meta, err
+	}
+	err = json.Unmarshal(data, &meta)
+	return meta, err
+}
+
+// Open returns a reader for the data of a stored profile
+func (s *profileStore) Open(id string) (io.ReadSeekCloser, profileMeta, error) {
+	meta, err := s.Get(id)
+	if err != nil {
+		return nil, meta, err
+	}
+	f, err := s.storage.Get(dataName(meta))
+	if err == errObjectNotFound {
+		return nil, meta, errProfileNotFound
+	}
+	return f, meta, err
+}
+
+// List returns the metadata of all stored profiles, newest first and then by
+// descending ID
+func (s *profileStore) List() ([]profileMeta, error) {
+	names, err := s.storage.List("")
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	listed := make(map[string]profileMeta, len(names))
+	pinned := make(map[string]bool)
+	for _, name := range names {
+		if id, ok := strings.CutSuffix(name, ".pinned"); ok {
+			pinned[id] = true
+		}
+	}
+	var metas []profileMeta
+	for _, name := range names {
+		id, ok := strings.CutSuffix(name, ".json")
+		if !ok || !validProfileID(id) {
+			continue
+		}
+		meta, ok := s.listed[id]
+		if !ok {
+			if meta, err = s.Get(id); err != nil {
+				continue
+			}
+		}
+		listed[id] = meta
+		meta.Pinned = pinned[id]
+		metas = append(metas, meta)
+	}
+	// Profiles deleted since, possibly by another exporter sharing the
+	// storage, drop out of the cache
+	s.listed = listed
+
+	sort.Slice(metas, func(i, j int) bool {
+		if !metas[i].CreatedAt.Equal(metas[j].CreatedAt) {
+			return metas[i].CreatedAt.After(metas[j].CreatedAt)
+		}
+		return metas[i].ID > metas[j].ID
+	})
+	return metas, nil
+}
+
+// Delete removes a stored profile with its attachments, pinned or not
+func (s *profileStore) Delete(id string) error {
+	meta, err := s.Get(id)
+	if err != nil {
+		return err
+	}
+	// The metadata goes first, so a failure midway never lists a profile
+	// whose data is gone
+	if err := s.storage.Delete(metaName(id)); err != nil {
+		return err
+	}
+	if err := s.storage.Delete(dataName(meta)); err != nil {
+		return err
+	}
+	for _, name := range meta.Attachments {
+		if err := s.storage.Delete(attachmentName(id, name)); err != nil {
+			return err
+		}
+	}
+	return s.storage.Delete(pinnedName(id))
+}
+
+// storeCapture saves a captured profile when the store is enabled and
+// reports its ID to the client in the X-Profile-ID header, and its digest
+// and signature in the headers of setDigestHeaders
+func storeCapture(w http.ResponseWriter, meta profileMeta, r io.Reader) {
+	if meta.Format == "pprof" || meta.Format == "folded" {
+		data, err := io.ReadAll(r)
+		if err != nil {
+			log.Printf("Failed to read profile: %v", err)
+			return
+		}
+		topFunctions.observe(meta, data)
+		r = bytes.NewReader(data)
+	}
+	if store == nil {
+		// Callers serve what r held afterwards, so its digest is still
+		// worth reporting
+		h := sha256.New()
+		if _, err := io.Copy(h, r); err != nil {
+			log.Printf("Failed to read profile: %v", err)
+			return
+		}
+		signing := currentSigning()
+		digest := hex.EncodeToString(h.Sum(nil))
+		signature, err := signing.sign(digest)
+		if err != nil {
+			log.Printf("Failed to sign profile: %v", err)
+		}
+		setDigestHeaders(w, digest, signature, signing.KeyID)
+		return
+	}
+
+	meta, err := store.Save(meta, r)
+	if err != nil {
+		log.Printf("Failed to store profile: %v", err)
+		return
+	}
+
+	log.Printf("Stored %s profile %s for PID %s", meta.Format, meta.ID, meta.PID)
+	w.Header().Set("X-Profile-ID", meta.ID)
+	setDigestHeaders(w, meta.SHA256, meta.Signature, meta.SignatureKey)
+	notifier.profileDone(meta)
+}
+
+// captureToStore takes a single capture in meta.Format and saves it to the
+// store, reporting its progress at /api/v1/profiles/{id}/events. meta.ID
+// may be set beforehand to tell clients where to look.
+func captureToStore(opts profileOptions, meta profileMeta) (_ profileMeta, err error) {
+	if meta.ID == "" {
+		if meta.ID, err = newProfileID(); err != nil {
+			return meta, err
+		}
+	}
+	meta.Labels = withDefaultLabels(meta.Labels)
+	opts.Labels = meta.Labels
+	job := jobs.start(meta.ID, opts.Duration)
+	opts.Progress = job
+	var samples int64
+	defer func() {
+		job.finish(samples, err)
+		if err != nil {
+			notifier.profileFailed(meta, err)
+		} else {
+			notifier.profileDone(meta)
+		}
+	}()
+
+	if err := currentPolicy().check(opts.PID); err != nil {
+		return meta, err
+	}
+	tempDir, err := newCaptureDir()
+	if err != nil {
+		return meta, err
+	}
+	defer os.RemoveAll(tempDir)
+
+	capture, tool := snapshotPerf, "perf"
+	if meta.Format == "folded" {
+		capture, tool = snapshotBCC, "bcc"
+	}
+	start := time.Now()
+	job.recording(tempDir)
+	data, err := capture(opts, tempDir)
+	auditCapture(opts, meta, tool, start, int64(len(data)), err)
+	if err != nil {
+		return meta, err
+	}
+	topFunctions.observe(meta, data)
+	samples = profileSamples(meta.Format, data)
+
+	meta, err = store.Save(meta, bytes.NewReader(data))
+	if err != nil {
+		return meta, err
+	}
+	log.Printf("Stored %s profile %s for PID %s (trigger: %s)", meta.Format, meta.ID, meta.PID, meta.TriggerReason)
+	return meta, nil
+}
+
+// writeJSON serves v as an indented JSON document
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		log.Printf("Failed to encode JSON response: %v", err)
+	}
+}
+
+// requireStore fails the request when the exporter runs without a store
+func requireStore(w http.ResponseWriter) bool {
+	if store == nil {
+		http.Error(w, "Profile store is not enabled (start with -store-dir or configure storage)", http.StatusNotFound)
+		return false
+	}
+	return true
+}
+
+// handleListProfiles serves the metadata of all stored profiles
+func handleListProfiles(w http.ResponseWriter, r *http.Request) {
+	if !requireStore(w) {
+		return
+	}
+
+	metas, err := store.List()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to list profiles: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if metas == nil {
+		metas = []profileMeta{}
+	}
+
+	writeJSON(w, http.StatusOK, metas)
+}
+
+// handleGetProfile serves the data of a stored profile
+func handleGetProfile(w http.ResponseWriter, r *http.Request) {
+	if !requireStore(w) {
+		return
+	}
+
+	f, meta, err := store.Open(r.PathValue("id"))
+	if err == errProfileNotFound {
+		http.Error(w, "Profile not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to open profile: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	switch meta.Format {
+	case "folded", "perfscript":
+		w.Header().Set("Content-Type", "text/plain")
+	case "speedscope", "chrometrace":
+		w.Header().Set("Content-Type", "application/json")
+	case "flamegraph":
+		w.Header().Set("Content-Type", "image/svg+xml")
+	default:
+		w.Header().Set("Content-Type", "application/octet-stream")
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s%s", meta.ID, profileExtension(meta.Format)))
+
+	digest := meta.SHA256
+	if digest == "" {
+		// Stored by an older version: hash the data on every download
+		h := sha256.New()
+		if _, err := io.Copy(h, f); err != nil {
+			http.Error(w, fmt.Sprintf("Failed to read profile: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			http.Error(w, fmt.Sprintf("Failed to read profile: %v", err), http.StatusInternalServerError)
+			return
+		}
+		digest = hex.EncodeToString(h.Sum(nil))
+	}
+	// A strong ETag lets dashboards polling a profile revalidate it with
+	// If-None-Match instead of downloading it again
+	w.Header().Set("ETag", `"`+digest+`"`)
+	setDigestHeaders(w, digest, meta.Signature, meta.SignatureKey)
+
+	// ServeContent answers conditional and Range requests, so interrupted downloads of large
+	// perf archives can resume
+	http.ServeContent(w, r, "", meta.CreatedAt, f)
+}
+
+// handleDeleteProfile removes a stored profile with its attachments
+func handleDeleteProfile(w http.ResponseWriter, r *http.Request) {
+	if !requireStore(w) {
+		return
+	}
+
+	err := store.Delete(r.PathValue("id"))
+	if err == errProfileNotFound {
+		http.Error(w, "Profile not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to delete profile: %v", err), http.StatusInternalServerError)
+		return
+	}
+	pprofViews.forget(r.PathValue("id"))
+	log.Printf("Deleted profile %s", r.PathValue("id"))
+	w.WriteHeader(http.StatusNoContent)
+}
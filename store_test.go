@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// withTestStore enables a profile store in a temporary directory for the
+// duration of the test
+func withTestStore(t *testing.T) *profileStore {
+	t.Helper()
+
+	s, err := newProfileStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	orig := store
+	store = s
+	t.Cleanup(func() { store = orig })
+	return s
+}
+
+func TestProfileStoreSaveAndOpen(t *testing.T) {
+	s := withTestStore(t)
+
+	meta, err := s.Save(profileMeta{Format: "folded", PID: "1234"}, strings.NewReader("main;aeMain 10\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !validProfileID(meta.ID) {
+		t.Errorf("Save() returned malformed ID %q", meta.ID)
+	}
+	if meta.Size != 15 {
+		t.Errorf("Save() size = %d, want 15", meta.Size)
+	}
+
+	f, got, err := s.Open(meta.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if got.PID != "1234" || got.Format != "folded" {
+		t.Errorf("Open() metadata = %+v", got)
+	}
+
+	list, err := s.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].ID != meta.ID {
+		t.Errorf("List() = %+v", list)
+	}
+}
+
+func TestProfileStoreRejectsBadIDs(t *testing.T) {
+	s := withTestStore(t)
+
+	for _, id := range []string{"", "../../etc/passwd", "0123456789abcdeg", "0123456789abcdef"} {
+		if _, _, err := s.Open(id); err != errProfileNotFound {
+			t.Errorf("Open(%q) error = %v, want errProfileNotFound", id, err)
+		}
+	}
+}
+
+func TestProfileHandlers(t *testing.T) {
+	s := withTestStore(t)
+	meta, err := s.Save(profileMeta{Format: "folded", PID: "1"}, strings.NewReader("a;b 1\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/v1/profiles", handleListProfiles)
+	mux.HandleFunc("GET /api/v1/profiles/{id}", handleGetProfile)
+
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("GET", "/api/v1/profiles", nil))
+	var list []profileMeta
+	if err := json.Unmarshal(rr.Body.Bytes(), &list); err != nil {
+		t.Fatalf("list response is not JSON: %v", err)
+	}
+	if len(list) != 1 || list[0].ID != meta.ID {
+		t.Errorf("list response = %+v", list)
+	}
+
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("GET", "/api/v1/profiles/"+meta.ID, nil))
+	if rr.Code != http.StatusOK || rr.Body.String() != "a;b 1\n" {
+		t.Errorf("get response = %d %q", rr.Code, rr.Body.String())
+	}
+
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("GET", "/api/v1/profiles/0123456789abcdef", nil))
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("missing profile returned %d, want 404", rr.Code)
+	}
+
+	// An interrupted download resumes with a Range request
+	req := httptest.NewRequest("GET", "/api/v1/profiles/"+meta.ID, nil)
+	req.Header.Set("Range", "bytes=2-")
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	if rr.Code != http.StatusPartialContent || rr.Body.String() != "b 1\n" || rr.Header().Get("Content-Range") != "bytes 2-5/6" {
+		t.Errorf("range response = %d %q %v", rr.Code, rr.Body.String(), rr.Header())
+	}
+
+	// ... unless the profile changed since, which stored profiles never do
+	req.Header.Set("If-Range", meta.CreatedAt.Add(-time.Hour).UTC().Format(http.TimeFormat))
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK || rr.Body.String() != "a;b 1\n" {
+		t.Errorf("stale If-Range response = %d %q", rr.Code, rr.Body.String())
+	}
+
+	req = httptest.NewRequest("GET", "/api/v1/profiles/"+meta.ID, nil)
+	req.Header.Set("Range", "bytes=100-")
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	if rr.Code != http.StatusRequestedRangeNotSatisfiable {
+		t.Errorf("range past the end returned %d, want 416", rr.Code)
+	}
+}
+
+func TestProfileHandlersWithoutStore(t *testing.T) {
+	orig := store
+	store = nil
+	defer func() { store = orig }()
+
+	rr := httptest.NewRecorder()
+	handleListProfiles(rr, httptest.NewRequest("GET", "/api/v1/profiles", nil))
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("list without store returned %d, want 404", rr.Code)
+	}
+}
+
+func TestGetProfileETag(t *testing.T) {
+	s := withTestStore(t)
+	meta, err := s.Save(profileMeta{Format: "folded", PID: "1"}, strings.NewReader("a;b 1\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256([]byte("a;b 1\n"))
+	if meta.SHA256 != hex.EncodeToString(sum[:]) {
+		t.Errorf("SHA256 = %s", meta.SHA256)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/v1/profiles/{id}", handleGetProfile)
+	get := func(ifNoneMatch string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/api/v1/profiles/"+meta.ID, nil)
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		return rr
+	}
+
+	etag := get("").Header().Get("ETag")
+	if etag != `"`+meta.SHA256+`"` {
+		t.Fatalf("ETag = %s", etag)
+	}
+	if rr := get(etag); rr.Code != http.StatusNotModified || rr.Body.Len() != 0 {
+		t.Errorf("matching If-None-Match: %d, %d bytes", rr.Code, rr.Body.Len())
+	}
+	if rr := get(`"0123"`); rr.Code != http.StatusOK {
+		t.Errorf("other If-None-Match: %d", rr.Code)
+	}
+
+	// Profiles stored before digests were recorded get the same ETag
+	meta.SHA256 = ""
+	data, _ := json.Marshal(meta)
+	if err := s.storage.Put(metaName(meta.ID), bytes.NewReader(data), int64(len(data))); err != nil {
+		t.Fatal(err)
+	}
+	if got := get("").Header().Get("ETag"); got != etag {
+		t.Errorf("ETag without stored digest = %s, want %s", got, etag)
+	}
+}
+
+func TestProfileFlameGraph(t *testing.T) {
+	s := withTestStore(t)
+	folded, err := s.Save(profileMeta{Format: "folded", PID: "42", Comm: "redis-server"}, strings.NewReader("main;aeMain;processCommand 10\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	perf, err := s.Save(profileMeta{Format: "perfdata", PID: "42"}, strings.NewReader("PERFILE2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(id string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/api/v1/profiles/"+id+"/flamegraph", nil)
+		r.SetPathValue("id", id)
+		rr := httptest.NewRecorder()
+		handleProfileFlameGraph(rr, r)
+		return rr
+	}
+	rr := get(folded.ID)
+	if rr.Code != http.StatusOK || rr.Header().Get("Content-Type") != "image/svg+xml" ||
+		!strings.Contains(rr.Body.String(), "processCommand") || !strings.Contains(rr.Body.String(), "redis-server (PID 42)") {
+		t.Errorf("flamegraph of a folded profile: %d %s", rr.Code, rr.Body.String())
+	}
+	if rr := get(perf.ID); rr.Code != http.StatusBadRequest {
+		t.Errorf("flamegraph of perf data: %d", rr.Code)
+	}
+	if rr := get("0123456789abcdef"); rr.Code != http.StatusNotFound {
+		t.Errorf("flamegraph of a missing profile: %d", rr.Code)
+	}
+}
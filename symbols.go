@@ -0,0 +1,49 @@
+package main
+
+import (
+	"os"
+	"strings"
+)
+
+// symfs is the -symfs directory perf resolves binaries in, for targets whose
+// files are only available under another root such as a mounted image
+var symfs string
+
+// symbolDirs are the -symbol-dirs directories pprof searches for binaries and
+// separate debug files, by name or by build ID
+var symbolDirs []string
+
+// perfSymbolArgs returns the perf script arguments for -symfs
+func perfSymbolArgs() []string {
+	if symfs == "" {
+		return nil
+	}
+	return []string{"--symfs=" + symfs}
+}
+
+// symbolEnv returns the environment for perf and pprof commands: pprof
+// searches -symbol-dirs, extraDirs and the debuginfod cache through
+// PPROF_BINARY_PATH, and perf built with libdebuginfod fetches missing
+// symbols itself
+func symbolEnv(extraDirs ...string) []string {
+	env := os.Environ()
+
+	var binaryPath []string
+	if existing := os.Getenv("PPROF_BINARY_PATH"); existing != "" {
+		binaryPath = append(binaryPath, existing)
+	}
+	binaryPath = append(binaryPath, symbolDirs...)
+	binaryPath = append(binaryPath, extraDirs...)
+
+	if len(debuginfod.URLs) > 0 {
+		binaryPath = append(binaryPath, debuginfod.CacheDir)
+		env = append(env,
+			"DEBUGINFOD_URLS="+strings.Join(debuginfod.URLs, " "),
+			"DEBUGINFOD_CACHE_PATH="+debuginfod.CacheDir,
+		)
+	}
+	if len(binaryPath) > 0 {
+		env = append(env, "PPROF_BINARY_PATH="+strings.Join(binaryPath, string(os.PathListSeparator)))
+	}
+	return env
+}
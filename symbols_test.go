@@ -0,0 +1,84 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// setSymbolConfig points the symbol settings at the given values for the
+// duration of the test
+func setSymbolConfig(t *testing.T, fs string, dirs []string, d debuginfodConfig) {
+	origFS, origDirs, origD := symfs, symbolDirs, debuginfod
+	symfs, symbolDirs, debuginfod = fs, dirs, d
+	t.Cleanup(func() { symfs, symbolDirs, debuginfod = origFS, origDirs, origD })
+}
+
+func TestPerfSymbolArgs(t *testing.T) {
+	setSymbolConfig(t, "", nil, debuginfodConfig{})
+	if args := perfSymbolArgs(); args != nil {
+		t.Errorf("perfSymbolArgs without -symfs = %q", args)
+	}
+
+	symfs = "/mnt/rootfs"
+	want := []string{"script", "-i", "perf.data", "-F", perfScriptFields, "--symfs=/mnt/rootfs"}
+	if got := perfScriptArgs("perf.data"); !reflect.DeepEqual(got, want) {
+		t.Errorf("perfScriptArgs = %q, want %q", got, want)
+	}
+}
+
+func TestSymbolEnv(t *testing.T) {
+	t.Setenv("PPROF_BINARY_PATH", "/home/user/pprof/binaries")
+
+	tests := []struct {
+		name       string
+		dirs       []string
+		debuginfod debuginfodConfig
+		want       []string
+		absent     []string
+	}{
+		{
+			name:   "defaults",
+			want:   []string{"PPROF_BINARY_PATH=/home/user/pprof/binaries"},
+			absent: []string{"DEBUGINFOD_URLS="},
+		},
+		{
+			name: "symbol dirs",
+			dirs: []string{"/mnt/artifacts/debug", "/opt/symbols"},
+			want: []string{"PPROF_BINARY_PATH=/home/user/pprof/binaries:/mnt/artifacts/debug:/opt/symbols"},
+		},
+		{
+			name:       "debuginfod",
+			dirs:       []string{"/opt/symbols"},
+			debuginfod: debuginfodConfig{URLs: []string{"https://a.example", "https://b.example"}, CacheDir: "/var/cache/debuginfod"},
+			want: []string{
+				"PPROF_BINARY_PATH=/home/user/pprof/binaries:/opt/symbols:/var/cache/debuginfod",
+				"DEBUGINFOD_URLS=https://a.example https://b.example",
+				"DEBUGINFOD_CACHE_PATH=/var/cache/debuginfod",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setSymbolConfig(t, "", tt.dirs, tt.debuginfod)
+			env := symbolEnv()
+			// The last assignment of a variable wins
+			last := make(map[string]string)
+			for _, kv := range env {
+				k, _, _ := strings.Cut(kv, "=")
+				last[k] = kv
+			}
+			for _, kv := range tt.want {
+				k, _, _ := strings.Cut(kv, "=")
+				if last[k] != kv {
+					t.Errorf("%s = %q, want %q", k, last[k], kv)
+				}
+			}
+			for _, prefix := range tt.absent {
+				if _, ok := last[strings.TrimSuffix(prefix, "=")]; ok {
+					t.Errorf("unexpected %s in environment", prefix)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// runningCaptures counts the requests to capture endpoints being served,
+// for the status shown by systemctl status
+var runningCaptures atomic.Int64
+
+// sdNotify sends state to the service manager over $NOTIFY_SOCKET. It
+// reports false without error when the exporter does not run under systemd
+// with Type=notify.
+func sdNotify(state string) (bool, error) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return false, nil
+	}
+	// Abstract sockets are given with a leading @
+	if strings.HasPrefix(socket, "@") {
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// notify sends state to systemd, logging failures
+func notify(state string) {
+	if _, err := sdNotify(state); err != nil {
+		log.Printf("Failed to notify systemd: %v", err)
+	}
+}
+
+// watchdogInterval returns how often systemd expects a watchdog ping, half
+// of WatchdogSec as sd_watchdog_enabled(3) recommends, or 0 when the
+// watchdog is off
+func watchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond / 2
+}
+
+// systemdStatus is the one-line status shown by systemctl status
+func systemdStatus(addr string) string {
+	status := fmt.Sprintf("Serving on %s", addr)
+	switch n := runningCaptures.Load(); n {
+	case 0:
+		return status + ", idle"
+	case 1:
+		return status + ", 1 capture running"
+	default:
+		return fmt.Sprintf("%s, %d captures running", status, n)
+	}
+}
+
+// runSystemdWatchdog pings the systemd watchdog and refreshes the status
+// until stop is closed. A ping goes out only after probe succeeds, so an
+// exporter that stopped serving is restarted rather than kept alive by
+// this goroutine.
+func runSystemdWatchdog(interval time.Duration, addr string, probe func() error, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if err := probe(); err != nil {
+				log.Printf("Skipping systemd watchdog ping: %v", err)
+				continue
+			}
+			notify("WATCHDOG=1\nSTATUS=" + systemdStatus(addr))
+		}
+	}
+}
+
+// probeServer returns a check that the server at addr still answers HTTP
+// requests. Any response will do, even a 404 or 401: it proves requests are
+// being served rather than the process merely being alive.
+func probeServer(addr net.Addr) func() error {
+	host := addr.String()
+	if tcp, ok := addr.(*net.TCPAddr); ok && tcp.IP.IsUnspecified() {
+		host = net.JoinHostPort("localhost", strconv.Itoa(tcp.Port))
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	if addr.Network() == "unix" {
+		path := host
+		host = "localhost"
+		client.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", path)
+			},
+		}
+	}
+	return func() error {
+		resp, err := client.Get("http://" + host + "/-/watchdog")
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		return nil
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// listenNotify points $NOTIFY_SOCKET at a new datagram socket and returns it
+func listenNotify(t *testing.T) *net.UnixConn {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	t.Setenv("NOTIFY_SOCKET", path)
+	return conn
+}
+
+// readNotify returns the next message sent to conn
+func readNotify(t *testing.T, conn *net.UnixConn) string {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 4096)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(buf[:n])
+}
+
+func TestSdNotify(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+	if sent, err := sdNotify("READY=1"); sent || err != nil {
+		t.Errorf("sdNotify() without NOTIFY_SOCKET = %v, %v, want false, nil", sent, err)
+	}
+
+	conn := listenNotify(t)
+	if sent, err := sdNotify("READY=1\nSTATUS=idle"); !sent || err != nil {
+		t.Fatalf("sdNotify() = %v, %v", sent, err)
+	}
+	if got := readNotify(t, conn); got != "READY=1\nSTATUS=idle" {
+		t.Errorf("received %q", got)
+	}
+
+	t.Setenv("NOTIFY_SOCKET", filepath.Join(t.TempDir(), "missing"))
+	if _, err := sdNotify("READY=1"); err == nil {
+		t.Error("sdNotify() to a missing socket succeeded")
+	}
+}
+
+func TestSdNotifyAbstract(t *testing.T) {
+	name := "bcc-exporter-test-" + strconv.Itoa(os.Getpid())
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: "\x00" + name, Net: "unixgram"})
+	if err != nil {
+		t.Skipf("abstract sockets unavailable: %v", err)
+	}
+	defer conn.Close()
+	t.Setenv("NOTIFY_SOCKET", "@"+name)
+	if sent, err := sdNotify("WATCHDOG=1"); !sent || err != nil {
+		t.Fatalf("sdNotify() = %v, %v", sent, err)
+	}
+	if got := readNotify(t, conn); got != "WATCHDOG=1" {
+		t.Errorf("received %q", got)
+	}
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	self := strconv.Itoa(os.Getpid())
+	tests := []struct {
+		usec, pid string
+		want      time.Duration
+	}{
+		{"", "", 0},
+		{"30000000", "", 15 * time.Second},
+		{"30000000", self, 15 * time.Second},
+		{"30000000", "1", 0},
+		{"0", "", 0},
+		{"soon", "", 0},
+	}
+	for _, tt := range tests {
+		t.Setenv("WATCHDOG_USEC", tt.usec)
+		t.Setenv("WATCHDOG_PID", tt.pid)
+		if got := watchdogInterval(); got != tt.want {
+			t.Errorf("watchdogInterval() with WATCHDOG_USEC=%q WATCHDOG_PID=%q = %s, want %s", tt.usec, tt.pid, got, tt.want)
+		}
+	}
+}
+
+func TestSystemdStatus(t *testing.T) {
+	defer runningCaptures.Store(0)
+	tests := []struct {
+		running int64
+		want    string
+	}{
+		{0, "Serving on :8080, idle"},
+		{1, "Serving on :8080, 1 capture running"},
+		{3, "Serving on :8080, 3 captures running"},
+	}
+	for _, tt := range tests {
+		runningCaptures.Store(tt.running)
+		if got := systemdStatus(":8080"); got != tt.want {
+			t.Errorf("systemdStatus() with %d running = %q, want %q", tt.running, got, tt.want)
+		}
+	}
+}
+
+func TestRunSystemdWatchdog(t *testing.T) {
+	conn := listenNotify(t)
+	var healthy atomic.Bool
+	probe := func() error {
+		if !healthy.Load() {
+			return errors.New("not serving")
+		}
+		return nil
+	}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		runSystemdWatchdog(10*time.Millisecond, ":8080", probe, stop)
+		close(done)
+	}()
+
+	// No ping while the probe fails
+	conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if n, _ := conn.Read(make([]byte, 4096)); n > 0 {
+		t.Error("watchdog pinged while the probe failed")
+	}
+
+	healthy.Store(true)
+	if got := readNotify(t, conn); !strings.HasPrefix(got, "WATCHDOG=1\nSTATUS=Serving on :8080") {
+		t.Errorf("received %q", got)
+	}
+	close(stop)
+	<-done
+}
+
+func TestProbeServer(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	probe := probeServer(srv.Listener.Addr())
+	if err := probe(); err != nil {
+		t.Errorf("probe() of a serving server: %v", err)
+	}
+	srv.Close()
+	if err := probe(); err == nil {
+		t.Error("probe() of a closed server succeeded")
+	}
+}
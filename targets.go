@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// targetsCPUWindow is how long /api/v1/targets measures CPU usage over
+var targetsCPUWindow = time.Second
+
+// processTarget describes a process of the host for target pickers
+type processTarget struct {
+	PID         int    `json:"pid"`
+	PPID        int    `json:"ppid"`
+	Comm        string `json:"comm"`
+	Cgroup      string `json:"cgroup,omitempty"`
+	ContainerID string `json:"container_id,omitempty"`
+	// PodUID comes from the cgroup of Kubernetes pods; Pod and Namespace
+	// are resolved from the kubelet's log directories when readable
+	PodUID    string `json:"pod_uid,omitempty"`
+	Pod       string `json:"pod,omitempty"`
+	Namespace string `json:"namespace,omitempty"`
+	// Runtime is the detected language runtime, which selects the backend
+	Runtime string `json:"runtime,omitempty"`
+	// CPUPercent is the CPU usage over the last targetsCPUWindow, where
+	// 100 is one CPU
+	CPUPercent float64 `json:"cpu_percent"`
+	// Profilable is false for kernel threads and the processes the target
+	// policy or the built-in protection refuse, with the reason why
+	Profilable bool   `json:"profilable"`
+	Reason     string `json:"reason,omitempty"`
+}
+
+// podUIDRe matches the pod UID in the cgroup paths of the cgroupfs
+// (pod<uid>) and systemd (pod<uid with underscores>.slice) drivers
+var podUIDRe = regexp.MustCompile(`pod([0-9a-f]{8}[-_][0-9a-f]{4}[-_][0-9a-f]{4}[-_][0-9a-f]{4}[-_][0-9a-f]{12})`)
+
+// cgroupPath returns the path of the unified hierarchy in the contents of
+// /proc/<pid>/cgroup, or of the first hierarchy on cgroup v1 hosts
+func cgroupPath(cgroup string) string {
+	var first string
+	for _, line := range strings.Split(strings.TrimSpace(cgroup), "\n") {
+		parts := strings.SplitN(line, ":", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		if parts[0] == "0" && parts[1] == "" {
+			return parts[2]
+		}
+		if first == "" {
+			first = parts[2]
+		}
+	}
+	return first
+}
+
+// kubernetesPods maps pod UIDs to the namespace and name of the pods, read
+// from the kubelet's /var/log/pods/<namespace>_<name>_<uid> directories
+// of the host; empty when the directory is not readable
+func kubernetesPods() map[string][2]string {
+	pods := map[string][2]string{}
+	entries, err := os.ReadDir(filepath.Join(procRoot, "1", "root", "var", "log", "pods"))
+	if err != nil {
+		return pods
+	}
+	for _, entry := range entries {
+		// Namespaces and pod names cannot contain underscores
+		parts := strings.Split(entry.Name(), "_")
+		if len(parts) == 3 {
+			pods[parts[2]] = [2]string{parts[0], parts[1]}
+		}
+	}
+	return pods
+}
+
+// listTargets describes the processes named one of comms, or all of them
+// without comms, measuring their CPU usage over window
+func listTargets(comms []string, window time.Duration) ([]processTarget, error) {
+	pids, err := listPIDs()
+	if err != nil {
+		return nil, err
+	}
+	before := map[int]uint64{}
+	var targets []processTarget
+	for _, pid := range pids {
+		comm, err := readComm(pid)
+		if err != nil || len(comms) > 0 && !slices.Contains(comms, comm) {
+			continue
+		}
+		ticks, err := readCPUTicks(pid)
+		if err != nil {
+			continue
+		}
+		before[pid] = ticks
+		targets = append(targets, processTarget{PID: pid, Comm: comm})
+	}
+	start := time.Now()
+	time.Sleep(window)
+	elapsed := time.Since(start).Seconds()
+
+	pods := kubernetesPods()
+	tp := currentPolicy()
+	live := targets[:0]
+	for _, t := range targets {
+		ticks, err := readCPUTicks(t.PID)
+		if err != nil {
+			// The process exited during the window
+			continue
+		}
+		if ticks >= before[t.PID] && elapsed > 0 {
+			t.CPUPercent = math.Round(float64(ticks-before[t.PID])/clockTicks/elapsed*1000) / 10
+		}
+		t.PPID, _ = readParentPID(t.PID)
+		if cgroup, err := readCgroup(t.PID); err == nil {
+			t.Cgroup = cgroupPath(cgroup)
+			t.ContainerID = containerID(t.PID)
+			if m := podUIDRe.FindStringSubmatch(cgroup); m != nil {
+				t.PodUID = strings.ReplaceAll(m[1], "_", "-")
+				if pod, ok := pods[t.PodUID]; ok {
+					t.Namespace, t.Pod = pod[0], pod[1]
+				}
+			}
+		}
+
+		// kthreadd and its children have no user space to profile
+		if t.PID == 2 || t.PPID == 2 {
+			t.Reason = "kernel thread"
+		} else if err := tp.check(strconv.Itoa(t.PID)); err != nil {
+			t.Reason = err.Error()
+		} else {
+			t.Profilable = true
+			t.Runtime = detectRuntime(t.PID)
+		}
+		live = append(live, t)
+	}
+	sort.SliceStable(live, func(i, j int) bool { return live[i].CPUPercent > live[j].CPUPercent })
+	return live, nil
+}
+
+// handleTargets lists the processes of the host, busiest first, so UIs can
+// offer a choice of targets instead of asking for a PID
+func handleTargets(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	comms := q["comm"]
+	for _, comm := range comms {
+		if comm == "" || len(comm) > 15 {
+			http.Error(w, fmt.Sprintf("Invalid comm %q: must be a process name of 1 to 15 characters", comm), http.StatusBadRequest)
+			return
+		}
+	}
+	targets, err := listTargets(comms, targetsCPUWindow)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to list processes: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if q.Get("profilable") == "true" {
+		profilable := targets[:0]
+		for _, t := range targets {
+			if t.Profilable {
+				profilable = append(profilable, t)
+			}
+		}
+		targets = profilable
+	}
+	if targets == nil {
+		targets = []processTarget{}
+	}
+	writeJSON(w, http.StatusOK, targets)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCgroupPath(t *testing.T) {
+	for cgroup, want := range map[string]string{
+		"0::/system.slice/redis.service\n":                                  "/system.slice/redis.service",
+		"12:cpu,cpuacct:/docker/abc\n11:memory:/docker/abc\n":               "/docker/abc",
+		"1:name=systemd:/init.scope\n0::/kubepods.slice/kubepods-pod.slice": "/kubepods.slice/kubepods-pod.slice",
+		"": "",
+	} {
+		if got := cgroupPath(cgroup); got != want {
+			t.Errorf("cgroupPath(%q) = %q, want %q", cgroup, got, want)
+		}
+	}
+}
+
+func TestTargets(t *testing.T) {
+	writeFakeProc(t, map[int]int{1: 0, 2: 0, 50: 2, 100: 1, 200: 1, 300: 1})
+	id := strings.Repeat("cd34", 16)
+	uid := "1f2e3d4c-5b6a-4789-8abc-def012345678"
+	for pid, files := range map[int]map[string]string{
+		1:   {"comm": "systemd\n", "cgroup": "0::/init.scope\n"},
+		2:   {"comm": "kthreadd\n"},
+		50:  {"comm": "kworker/0:1\n"},
+		100: {"comm": "redis-server\n", "cgroup": "0::/kubepods.slice/kubepods-burstable.slice/kubepods-burstable-pod" + strings.ReplaceAll(uid, "-", "_") + ".slice/cri-containerd-" + id + ".scope\n"},
+		200: {"comm": "redis-server\n", "cgroup": "0::/system.slice/redis.service\n"},
+		300: {"comm": "sshd\n", "cgroup": "0::/system.slice/ssh.service\n"},
+	} {
+		for name, data := range files {
+			if err := os.WriteFile(filepath.Join(procRoot, strconv.Itoa(pid), name), []byte(data), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// Every process but 100 stays idle; 100 uses half a CPU over the
+	// window once the second read comes
+	setTicks := func(pid, ppid int, ticks int) {
+		stat := fmt.Sprintf("%d (x) S %d 1 1 0 -1 0 0 0 0 0 %d 0\n", pid, ppid, ticks)
+		if err := os.WriteFile(filepath.Join(procRoot, strconv.Itoa(pid), "stat"), []byte(stat), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for pid, ppid := range map[int]int{1: 0, 2: 0, 50: 2, 100: 1, 200: 1, 300: 1} {
+		setTicks(pid, ppid, 10)
+	}
+	if err := os.MkdirAll(filepath.Join(procRoot, "1", "root", "var", "log", "pods", "cache_redis-0_"+uid), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	p := targetPolicy{Deny: []targetRule{{Comm: "^sshd$"}}}
+	if err := p.validate(); err != nil {
+		t.Fatal(err)
+	}
+	orig := policy.Load()
+	policy.Store(&p)
+	t.Cleanup(func() { policy.Store(orig) })
+
+	origWindow := targetsCPUWindow
+	targetsCPUWindow = 200 * time.Millisecond
+	t.Cleanup(func() { targetsCPUWindow = origWindow })
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		setTicks(100, 1, 20)
+	}()
+
+	rr := httptest.NewRecorder()
+	handleTargets(rr, httptest.NewRequest("GET", "/api/v1/targets", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("%d %s", rr.Code, rr.Body.String())
+	}
+	var targets []processTarget
+	if err := json.Unmarshal(rr.Body.Bytes(), &targets); err != nil {
+		t.Fatal(err)
+	}
+	if len(targets) != 6 {
+		t.Fatalf("targets = %+v", targets)
+	}
+	redis := targets[0]
+	if redis.PID != 100 || redis.CPUPercent < 25 || redis.ContainerID != id || redis.PodUID != uid || redis.Pod != "redis-0" || redis.Namespace != "cache" || !redis.Profilable {
+		t.Errorf("busiest target = %+v", redis)
+	}
+	byPID := map[int]processTarget{}
+	for _, target := range targets {
+		byPID[target.PID] = target
+	}
+	for pid, reason := range map[int]string{1: "init", 2: "kernel thread", 50: "kernel thread", 300: "deny rule"} {
+		if byPID[pid].Profilable || !strings.Contains(byPID[pid].Reason, reason) {
+			t.Errorf("PID %d = %+v, want not profilable: %s", pid, byPID[pid], reason)
+		}
+	}
+	if target := byPID[200]; !target.Profilable || target.Cgroup != "/system.slice/redis.service" || target.PPID != 1 {
+		t.Errorf("PID 200 = %+v", target)
+	}
+
+	rr = httptest.NewRecorder()
+	handleTargets(rr, httptest.NewRequest("GET", "/api/v1/targets?comm=redis-server&comm=sshd&profilable=true", nil))
+	targets = nil
+	json.Unmarshal(rr.Body.Bytes(), &targets)
+	if len(targets) != 2 || targets[0].Comm != "redis-server" || targets[1].Comm != "redis-server" {
+		t.Errorf("profilable redis-server targets = %+v", targets)
+	}
+}
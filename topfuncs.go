@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/pprof/profile"
+)
+
+// topFunctionsConfig is the top_functions section of the configuration
+// file, which controls the hottest functions exported at /metrics
+type topFunctionsConfig struct {
+	// Count is how many functions are exported per process (default 10)
+	Count int `json:"count"`
+	// MaxAge drops the functions of processes not captured for this long
+	// (default 1h)
+	MaxAge duration `json:"max_age"`
+}
+
+func (c *topFunctionsConfig) validate() error {
+	if c.Count == 0 {
+		c.Count = 10
+	}
+	if c.Count < 0 || c.Count > 100 {
+		return fmt.Errorf("count must be between 1 and 100")
+	}
+	if c.MaxAge < 0 {
+		return fmt.Errorf("max_age must not be negative")
+	}
+	if c.MaxAge == 0 {
+		c.MaxAge = duration(time.Hour)
+	}
+	return nil
+}
+
+// functionSelf is the self time of one function in a profile
+type functionSelf struct {
+	Name    string
+	Samples int64
+}
+
+// topFunctionsOf returns the n functions of p that are most often the leaf
+// frame of a sample, and the total number of samples
+func topFunctionsOf(p *profile.Profile, n int) ([]functionSelf, int64) {
+	index := sampleIndex(p)
+	self := make(map[string]int64)
+	var total int64
+	for _, s := range p.Sample {
+		v := s.Value[index]
+		if v == 0 {
+			continue
+		}
+		total += v
+		if stack := sampleStack(s); len(stack) > 0 {
+			self[stack[len(stack)-1]] += v
+		}
+	}
+
+	top := make([]functionSelf, 0, len(self))
+	for name, samples := range self {
+		top = append(top, functionSelf{name, samples})
+	}
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Samples != top[j].Samples {
+			return top[i].Samples > top[j].Samples
+		}
+		return top[i].Name < top[j].Name
+	})
+	if len(top) > n {
+		top = top[:n]
+	}
+	return top, total
+}
+
+// processTop is the hottest functions of the latest capture of a process
+type processTop struct {
+	Target    string
+	PID       string
+	Functions []functionSelf
+	Total     int64
+	At        time.Time
+}
+
+// topFunctionsRegistry keeps the latest top functions of each process
+type topFunctionsRegistry struct {
+	mu      sync.Mutex
+	byPID   map[string]processTop
+	nowFunc func() time.Time
+}
+
+// topFunctions holds what /metrics reports
+var topFunctions = &topFunctionsRegistry{byPID: make(map[string]processTop), nowFunc: time.Now}
+
+// observe records the top functions of a capture in the pprof or folded
+// data of meta. Profiles of other formats are ignored.
+func (t *topFunctionsRegistry) observe(meta profileMeta, data []byte) {
+	if meta.Format != "pprof" && meta.Format != "folded" {
+		return
+	}
+	p, err := parseProfileData(data)
+	if err != nil {
+		log.Printf("Failed to read the %s profile of PID %s for /metrics: %v", meta.Format, meta.PID, err)
+		return
+	}
+
+	count := 10
+	if s := state.Load(); s != nil {
+		count = s.cfg.TopFunctions.Count
+	}
+	funcs, total := topFunctionsOf(p, count)
+	target := meta.Comm
+	if target == "" {
+		target = "unknown"
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.byPID[meta.PID] = processTop{Target: target, PID: meta.PID, Functions: funcs, Total: total, At: t.nowFunc()}
+}
+
+// snapshot returns the processes captured within maxAge, dropping older ones
+func (t *topFunctionsRegistry) snapshot(maxAge time.Duration) []processTop {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := t.nowFunc()
+	out := make([]processTop, 0, len(t.byPID))
+	for pid, top := range t.byPID {
+		if now.Sub(top.At) > maxAge {
+			delete(t.byPID, pid)
+			continue
+		}
+		out = append(out, top)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].PID < out[j].PID })
+	return out
+}
+
+// escapeLabel escapes a Prometheus label value
+var escapeLabel = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace
+
+// writeTopFunctionMetrics writes the top functions in the Prometheus text
+// exposition format
+func writeTopFunctionMetrics(w io.Writer, tops []processTop) {
+	fmt.Fprintln(w, "# HELP bcc_exporter_function_self_ratio Share of the samples of the latest capture of a process in which the function was running.")
+	fmt.Fprintln(w, "# TYPE bcc_exporter_function_self_ratio gauge")
+	for _, top := range tops {
+		for _, f := range top.Functions {
+			fmt.Fprintf(w, "bcc_exporter_function_self_ratio{target=\"%s\",pid=\"%s\",function=\"%s\"} %g\n",
+				escapeLabel(top.Target), escapeLabel(top.PID), escapeLabel(f.Name), float64(f.Samples)/float64(top.Total))
+		}
+	}
+	fmt.Fprintln(w, "# HELP bcc_exporter_function_self_samples Samples of the latest capture of a process in which the function was running.")
+	fmt.Fprintln(w, "# TYPE bcc_exporter_function_self_samples gauge")
+	for _, top := range tops {
+		for _, f := range top.Functions {
+			fmt.Fprintf(w, "bcc_exporter_function_self_samples{target=\"%s\",pid=\"%s\",function=\"%s\"} %d\n",
+				escapeLabel(top.Target), escapeLabel(top.PID), escapeLabel(f.Name), f.Samples)
+		}
+	}
+	fmt.Fprintln(w, "# HELP bcc_exporter_profile_samples Samples in the latest capture of a process.")
+	fmt.Fprintln(w, "# TYPE bcc_exporter_profile_samples gauge")
+	for _, top := range tops {
+		fmt.Fprintf(w, "bcc_exporter_profile_samples{target=\"%s\",pid=\"%s\"} %d\n", escapeLabel(top.Target), escapeLabel(top.PID), top.Total)
+	}
+	fmt.Fprintln(w, "# HELP bcc_exporter_profile_timestamp_seconds When the latest capture of a process finished.")
+	fmt.Fprintln(w, "# TYPE bcc_exporter_profile_timestamp_seconds gauge")
+	for _, top := range tops {
+		fmt.Fprintf(w, "bcc_exporter_profile_timestamp_seconds{target=\"%s\",pid=\"%s\"} %d\n", escapeLabel(top.Target), escapeLabel(top.PID), top.At.Unix())
+	}
+}
+
+// handleMetrics serves the hottest functions of the latest captures for
+// Prometheus
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	maxAge := time.Duration(state.Load().cfg.TopFunctions.MaxAge)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	writeTopFunctionMetrics(w, topFunctions.snapshot(maxAge))
+}
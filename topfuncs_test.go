@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTopFunctionsConfigValidate(t *testing.T) {
+	tests := []struct {
+		cfg       topFunctionsConfig
+		wantCount int
+		wantErr   bool
+	}{
+		{topFunctionsConfig{}, 10, false},
+		{topFunctionsConfig{Count: 25}, 25, false},
+		{topFunctionsConfig{Count: 101}, 0, true},
+		{topFunctionsConfig{Count: -1}, 0, true},
+		{topFunctionsConfig{MaxAge: duration(-time.Minute)}, 0, true},
+	}
+	for _, tt := range tests {
+		cfg := tt.cfg
+		err := cfg.validate()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("validate(%+v) error = %v, wantErr %v", tt.cfg, err, tt.wantErr)
+			continue
+		}
+		if err == nil && (cfg.Count != tt.wantCount || cfg.MaxAge <= 0) {
+			t.Errorf("validate(%+v) = %+v", tt.cfg, cfg)
+		}
+	}
+}
+
+func TestTopFunctionsOf(t *testing.T) {
+	p, err := parseProfileData([]byte("main;processCommand;dictFind 6\nmain;processCommand;dictFind 2\nmain;aeMain;epoll_wait 3\nmain;processCommand 1\nmain;sdslen 1\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	funcs, total := topFunctionsOf(p, 3)
+	want := []functionSelf{{"dictFind", 8}, {"epoll_wait", 3}, {"processCommand", 1}}
+	if total != 13 || !reflect.DeepEqual(funcs, want) {
+		t.Errorf("topFunctionsOf = %v, %d, want %v, 13", funcs, total, want)
+	}
+}
+
+func TestHandleMetrics(t *testing.T) {
+	origState := state.Load()
+	t.Cleanup(func() { state.Store(origState) })
+	cfg := &config{TopFunctions: topFunctionsConfig{Count: 2, MaxAge: duration(time.Hour)}}
+	state.Store(&serverState{cfg: cfg})
+
+	now := time.Unix(1700000000, 0)
+	reg := &topFunctionsRegistry{byPID: make(map[string]processTop), nowFunc: func() time.Time { return now }}
+	origReg := topFunctions
+	topFunctions = reg
+	t.Cleanup(func() { topFunctions = origReg })
+
+	reg.observe(profileMeta{PID: "1234", Comm: "redis-server", Format: "folded"}, []byte("main;dictFind 3\nmain;epoll_wait 1\nmain;\"quoted\" 1\n"))
+	reg.observe(profileMeta{PID: "99", Comm: "redis-server", Format: "perf-script"}, []byte("not a profile"))
+
+	rr := httptest.NewRecorder()
+	handleMetrics(rr, httptest.NewRequest("GET", "/metrics", nil))
+	body := rr.Body.String()
+	for _, line := range []string{
+		"# TYPE bcc_exporter_function_self_ratio gauge",
+		`bcc_exporter_function_self_ratio{target="redis-server",pid="1234",function="dictFind"} 0.6`,
+		`bcc_exporter_function_self_samples{target="redis-server",pid="1234",function="\"quoted\""} 1`,
+		`bcc_exporter_profile_samples{target="redis-server",pid="1234"} 5`,
+		`bcc_exporter_profile_timestamp_seconds{target="redis-server",pid="1234"} 1700000000`,
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("/metrics lacks %q:\n%s", line, body)
+		}
+	}
+	if strings.Contains(body, "epoll_wait") || strings.Contains(body, `pid="99"`) {
+		t.Errorf("/metrics has more than the top 2 functions of pprof and folded captures:\n%s", body)
+	}
+
+	now = now.Add(2 * time.Hour)
+	rr = httptest.NewRecorder()
+	handleMetrics(rr, httptest.NewRequest("GET", "/metrics", nil))
+	if strings.Contains(rr.Body.String(), "1234") {
+		t.Errorf("/metrics still reports a capture older than max_age:\n%s", rr.Body)
+	}
+}
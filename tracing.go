@@ -0,0 +1,376 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// spanQueueSize bounds the finished spans waiting to be exported
+	spanQueueSize = 2048
+	// spanBatchSize is the most spans sent in one export request
+	spanBatchSize = 256
+	// spanFlushInterval is how long finished spans wait for a batch to fill
+	spanFlushInterval = 5 * time.Second
+)
+
+// tracingConfig is the tracing section of the configuration file
+type tracingConfig struct {
+	// Endpoint is the OTLP/HTTP receiver, e.g. http://otel-collector:4318;
+	// spans are sent to its /v1/traces path. Tracing is off when empty.
+	Endpoint string `json:"endpoint"`
+	// Headers are added to export requests, e.g. for authentication
+	Headers map[string]string `json:"headers"`
+	// ServiceName is the service.name resource attribute (default
+	// bcc-exporter)
+	ServiceName string `json:"service_name"`
+	// SampleRatio is the share of requests without a sampled parent that
+	// are traced, from 0 to 1 (default 1)
+	SampleRatio *float64 `json:"sample_ratio"`
+}
+
+func (c *tracingConfig) validate() error {
+	if c.Endpoint == "" {
+		return nil
+	}
+	u, err := url.Parse(c.Endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid endpoint %q", c.Endpoint)
+	}
+	if !strings.HasSuffix(u.Path, "/v1/traces") {
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/v1/traces"
+		c.Endpoint = u.String()
+	}
+	if c.ServiceName == "" {
+		c.ServiceName = "bcc-exporter"
+	}
+	if c.SampleRatio == nil {
+		one := 1.0
+		c.SampleRatio = &one
+	}
+	if *c.SampleRatio < 0 || *c.SampleRatio > 1 {
+		return fmt.Errorf("sample_ratio must be between 0 and 1")
+	}
+	return nil
+}
+
+// span is one timed stage of a request. A nil span records nothing, so
+// code paths run the same whether or not tracing is enabled.
+type span struct {
+	tracer  *tracer
+	traceID [16]byte
+	spanID  [8]byte
+	parent  [8]byte
+	name    string
+	server  bool
+	start   time.Time
+
+	mu     sync.Mutex
+	end    time.Time
+	attrs  map[string]interface{}
+	errMsg string
+}
+
+// child starts a span for a stage of s
+func (s *span) child(name string) *span {
+	if s == nil {
+		return nil
+	}
+	c := &span{tracer: s.tracer, traceID: s.traceID, parent: s.spanID, name: name, start: time.Now()}
+	rand.Read(c.spanID[:])
+	return c
+}
+
+// set records an attribute of the span
+func (s *span) set(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.attrs == nil {
+		s.attrs = make(map[string]interface{})
+	}
+	s.attrs[key] = value
+}
+
+// fail marks the span as failed with err
+func (s *span) fail(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	s.errMsg = err.Error()
+	s.mu.Unlock()
+}
+
+// done ends the span, marking it failed when err is set
+func (s *span) done(err error) {
+	s.fail(err)
+	s.finish()
+}
+
+// finish ends the span and queues it for export; later calls do nothing
+func (s *span) finish() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	done := !s.end.IsZero()
+	if !done {
+		s.end = time.Now()
+	}
+	s.mu.Unlock()
+	if !done {
+		s.tracer.queueSpan(s)
+	}
+}
+
+// tracer exports finished spans to an OTLP/HTTP receiver in batches
+type tracer struct {
+	cfg    tracingConfig
+	client *http.Client
+	queue  chan *span
+}
+
+// tracing is the tracer, nil when tracing is off
+var tracing *tracer
+
+// newTracer starts exporting spans as configured by cfg, or returns nil
+// when no endpoint is set
+func newTracer(cfg tracingConfig) *tracer {
+	if cfg.Endpoint == "" {
+		return nil
+	}
+	t := &tracer{cfg: cfg, client: &http.Client{Timeout: 10 * time.Second}, queue: make(chan *span, spanQueueSize)}
+	go t.run()
+	return t
+}
+
+// queueSpan hands a finished span to the export loop without blocking
+func (t *tracer) queueSpan(s *span) {
+	select {
+	case t.queue <- s:
+	default:
+		log.Printf("Trace export queue is full, dropping span %s", s.name)
+	}
+}
+
+// run exports queued spans whenever a batch fills or spanFlushInterval
+// passes
+func (t *tracer) run() {
+	ticker := time.NewTicker(spanFlushInterval)
+	defer ticker.Stop()
+	var batch []*span
+	for {
+		select {
+		case s := <-t.queue:
+			batch = append(batch, s)
+			if len(batch) < spanBatchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		if err := t.export(batch); err != nil {
+			log.Printf("Failed to export %d spans: %v", len(batch), err)
+		}
+		batch = nil
+	}
+}
+
+// otlpValue encodes an attribute value as an OTLP AnyValue
+func otlpValue(v interface{}) map[string]interface{} {
+	switch v := v.(type) {
+	case bool:
+		return map[string]interface{}{"boolValue": v}
+	case int:
+		return map[string]interface{}{"intValue": strconv.Itoa(v)}
+	case int64:
+		return map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+	case float64:
+		return map[string]interface{}{"doubleValue": v}
+	case string:
+		return map[string]interface{}{"stringValue": v}
+	}
+	return map[string]interface{}{"stringValue": fmt.Sprint(v)}
+}
+
+func otlpAttributes(attrs map[string]interface{}) []interface{} {
+	out := make([]interface{}, 0, len(attrs))
+	for k, v := range attrs {
+		out = append(out, map[string]interface{}{"key": k, "value": otlpValue(v)})
+	}
+	return out
+}
+
+// otlpSpan encodes s in the OTLP/JSON mapping, which writes IDs as hex
+func otlpSpan(s *span) map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	kind := 1 // SPAN_KIND_INTERNAL
+	if s.server {
+		kind = 2 // SPAN_KIND_SERVER
+	}
+	status := map[string]interface{}{"code": 0}
+	if s.errMsg != "" {
+		status = map[string]interface{}{"code": 2, "message": s.errMsg}
+	}
+	out := map[string]interface{}{
+		"traceId":           hex.EncodeToString(s.traceID[:]),
+		"spanId":            hex.EncodeToString(s.spanID[:]),
+		"name":              s.name,
+		"kind":              kind,
+		"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+		"endTimeUnixNano":   strconv.FormatInt(s.end.UnixNano(), 10),
+		"attributes":        otlpAttributes(s.attrs),
+		"status":            status,
+	}
+	if s.parent != [8]byte{} {
+		out["parentSpanId"] = hex.EncodeToString(s.parent[:])
+	}
+	return out
+}
+
+// export sends spans to the receiver in one OTLP request
+func (t *tracer) export(spans []*span) error {
+	encoded := make([]interface{}, len(spans))
+	for i, s := range spans {
+		encoded[i] = otlpSpan(s)
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": otlpAttributes(map[string]interface{}{"service.name": t.cfg.ServiceName, "service.version": exporterBuildInfo().Version}),
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]interface{}{"name": "bcc-exporter"},
+				"spans": encoded,
+			}},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", t.cfg.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range t.cfg.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s returned %s", t.cfg.Endpoint, resp.Status)
+	}
+	return nil
+}
+
+// parseTraceparent decodes a W3C traceparent header
+func parseTraceparent(header string) (traceID [16]byte, parent [8]byte, sampled, ok bool) {
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return traceID, parent, false, false
+	}
+	flags, err1 := hex.DecodeString(parts[3])
+	_, err2 := hex.Decode(traceID[:], []byte(parts[1]))
+	_, err3 := hex.Decode(parent[:], []byte(parts[2]))
+	if err1 != nil || err2 != nil || err3 != nil || traceID == [16]byte{} || parent == [8]byte{} {
+		return traceID, parent, false, false
+	}
+	return traceID, parent, flags[0]&1 == 1, true
+}
+
+// startRequest starts the server span of r, continuing the trace of its
+// traceparent header. It returns nil when r is not sampled.
+func (t *tracer) startRequest(r *http.Request, name string) *span {
+	if t == nil {
+		return nil
+	}
+	s := &span{tracer: t, name: name, server: true, start: time.Now()}
+	if traceID, parent, sampled, ok := parseTraceparent(r.Header.Get("traceparent")); ok {
+		if !sampled {
+			return nil
+		}
+		s.traceID, s.parent = traceID, parent
+	} else {
+		rand.Read(s.traceID[:])
+		// Sample on the trace ID so the decision is the same for every
+		// span of the trace
+		if float64(binary.BigEndian.Uint64(s.traceID[8:]))/math.MaxUint64 >= *t.cfg.SampleRatio {
+			return nil
+		}
+	}
+	rand.Read(s.spanID[:])
+	return s
+}
+
+// spanKey is the context key of the server span of a request
+type spanKey struct{}
+
+// spanFrom returns the server span of r, nil when r is not traced
+func spanFrom(r *http.Request) *span {
+	s, _ := r.Context().Value(spanKey{}).(*span)
+	return s
+}
+
+// wrap traces every request to handler as a server span named after the
+// route, with its status and size
+func (t *tracer) wrap(route string, handler http.HandlerFunc) http.HandlerFunc {
+	if t == nil {
+		return handler
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		s := t.startRequest(r, r.Method+" "+route)
+		if s == nil {
+			handler(w, r)
+			return
+		}
+		s.set("http.request.method", r.Method)
+		s.set("http.route", route)
+		s.set("url.query", r.URL.RawQuery)
+		if client := clientName(r); client != "" {
+			s.set("enduser.id", client)
+		}
+		// Clients can find the trace of a slow capture by this header
+		w.Header().Set("X-Trace-ID", hex.EncodeToString(s.traceID[:]))
+
+		tw := &auditWriter{ResponseWriter: w}
+		handler(tw, r.WithContext(context.WithValue(r.Context(), spanKey{}, s)))
+
+		status := tw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		s.set("http.response.status_code", status)
+		s.set("http.response.body.size", tw.bytes)
+		if backend := w.Header().Get("X-Profile-Backend"); backend != "" {
+			s.set("profile.backend", backend)
+		}
+		if status >= 500 {
+			s.fail(fmt.Errorf("%s", strings.TrimSpace(tw.errBuf.String())))
+		}
+		s.finish()
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTracingConfigValidate(t *testing.T) {
+	tooHigh := 1.5
+	tests := []struct {
+		cfg          tracingConfig
+		wantEndpoint string
+		wantErr      bool
+	}{
+		{tracingConfig{}, "", false},
+		{tracingConfig{Endpoint: "http://otel-collector:4318"}, "http://otel-collector:4318/v1/traces", false},
+		{tracingConfig{Endpoint: "https://otlp.example.com/otlp/"}, "https://otlp.example.com/otlp/v1/traces", false},
+		{tracingConfig{Endpoint: "http://otel-collector:4318/v1/traces"}, "http://otel-collector:4318/v1/traces", false},
+		{tracingConfig{Endpoint: "otel-collector:4317"}, "", true},
+		{tracingConfig{Endpoint: "http://otel-collector:4318", SampleRatio: &tooHigh}, "", true},
+	}
+	for _, tt := range tests {
+		cfg := tt.cfg
+		err := cfg.validate()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("validate(%+v) error = %v, wantErr %v", tt.cfg, err, tt.wantErr)
+			continue
+		}
+		if err == nil && cfg.Endpoint != tt.wantEndpoint {
+			t.Errorf("validate(%+v) endpoint = %q, want %q", tt.cfg, cfg.Endpoint, tt.wantEndpoint)
+		}
+	}
+}
+
+func TestParseTraceparent(t *testing.T) {
+	tests := []struct {
+		header      string
+		wantSampled bool
+		wantOK      bool
+	}{
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", true, true},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", false, true},
+		{"00-00000000000000000000000000000000-00f067aa0ba902b7-01", false, false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", false, false},
+		{"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", false, false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e47-00f067aa0ba902b7-01", false, false},
+		{"garbage", false, false},
+		{"", false, false},
+	}
+	for _, tt := range tests {
+		traceID, _, sampled, ok := parseTraceparent(tt.header)
+		if ok != tt.wantOK || sampled != tt.wantSampled {
+			t.Errorf("parseTraceparent(%q) = sampled %v ok %v, want %v %v", tt.header, sampled, ok, tt.wantSampled, tt.wantOK)
+		}
+		if ok && hex.EncodeToString(traceID[:]) != "4bf92f3577b34da6a3ce929d0e0e4736" {
+			t.Errorf("parseTraceparent(%q) trace ID = %x", tt.header, traceID)
+		}
+	}
+}
+
+// otlpSpanJSON is the part of an exported span the tests look at
+type otlpSpanJSON struct {
+	TraceID      string `json:"traceId"`
+	SpanID       string `json:"spanId"`
+	ParentSpanID string `json:"parentSpanId"`
+	Name         string `json:"name"`
+	Kind         int    `json:"kind"`
+	Attributes   []struct {
+		Key   string                 `json:"key"`
+		Value map[string]interface{} `json:"value"`
+	} `json:"attributes"`
+	Status struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"status"`
+}
+
+func (s otlpSpanJSON) attr(key string) interface{} {
+	for _, a := range s.Attributes {
+		if a.Key == key {
+			for _, v := range a.Value {
+				return v
+			}
+		}
+	}
+	return nil
+}
+
+// newTestTracer returns a tracer exporting to a fake OTLP receiver, and a
+// function flushing the queued spans and returning all spans received
+func newTestTracer(t *testing.T, ratio float64) (*tracer, func() []otlpSpanJSON) {
+	t.Helper()
+	var mu sync.Mutex
+	var received []otlpSpanJSON
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" || r.Header.Get("Authorization") != "Bearer collector-token" {
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+			return
+		}
+		var body struct {
+			ResourceSpans []struct {
+				ScopeSpans []struct {
+					Spans []otlpSpanJSON `json:"spans"`
+				} `json:"scopeSpans"`
+			} `json:"resourceSpans"`
+		}
+		data, _ := io.ReadAll(r.Body)
+		if err := json.Unmarshal(data, &body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		for _, rs := range body.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				received = append(received, ss.Spans...)
+			}
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	cfg := tracingConfig{Endpoint: srv.URL, Headers: map[string]string{"Authorization": "Bearer collector-token"}, SampleRatio: &ratio}
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+	// No export loop: the test flushes by hand
+	tr := &tracer{cfg: cfg, client: srv.Client(), queue: make(chan *span, spanQueueSize)}
+	flush := func() []otlpSpanJSON {
+		var batch []*span
+		for len(tr.queue) > 0 {
+			batch = append(batch, <-tr.queue)
+		}
+		if len(batch) > 0 {
+			if err := tr.export(batch); err != nil {
+				t.Fatal(err)
+			}
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		return received
+	}
+	return tr, flush
+}
+
+func TestTracerWrap(t *testing.T) {
+	tr, flush := newTestTracer(t, 1)
+
+	handler := tr.wrap("/debug/pprof/profile", func(w http.ResponseWriter, r *http.Request) {
+		stage := spanFrom(r).child("perf record")
+		time.Sleep(time.Millisecond)
+		stage.finish()
+		if r.URL.Query().Get("fail") == "true" {
+			http.Error(w, "perf record failed", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("X-Profile-Backend", "perf")
+		w.Write([]byte("profile"))
+	})
+
+	req := httptest.NewRequest("GET", "/debug/pprof/profile?pid=1234&seconds=10", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	rr := httptest.NewRecorder()
+	handler(rr, req)
+	if got := rr.Header().Get("X-Trace-ID"); got != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("X-Trace-ID = %q", got)
+	}
+
+	handler(httptest.NewRecorder(), httptest.NewRequest("GET", "/debug/pprof/profile?fail=true", nil))
+
+	spans := flush()
+	if len(spans) != 4 {
+		t.Fatalf("got %d spans, want 4: %+v", len(spans), spans)
+	}
+	stage, server := spans[0], spans[1]
+	if server.Name != "GET /debug/pprof/profile" || server.Kind != 2 || server.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" || server.ParentSpanID != "00f067aa0ba902b7" {
+		t.Errorf("server span = %+v", server)
+	}
+	if server.attr("http.response.status_code") != "200" || server.attr("profile.backend") != "perf" || server.attr("url.query") != "pid=1234&seconds=10" {
+		t.Errorf("server span attributes = %+v", server.Attributes)
+	}
+	if stage.Name != "perf record" || stage.Kind != 1 || stage.TraceID != server.TraceID || stage.ParentSpanID != server.SpanID {
+		t.Errorf("stage span = %+v, want child of %s", stage, server.SpanID)
+	}
+
+	failed := spans[3]
+	if failed.TraceID == server.TraceID || failed.ParentSpanID != "" {
+		t.Errorf("request without traceparent continued another trace: %+v", failed)
+	}
+	if failed.Status.Code != 2 || failed.Status.Message != "perf record failed" {
+		t.Errorf("failed request status = %+v", failed.Status)
+	}
+}
+
+func TestTracerSampling(t *testing.T) {
+	tr, _ := newTestTracer(t, 0)
+	if s := tr.startRequest(httptest.NewRequest("GET", "/", nil), "GET /"); s != nil {
+		t.Error("request traced with sample_ratio 0")
+	}
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	if s := tr.startRequest(req, "GET /"); s == nil {
+		t.Error("request with a sampled parent not traced")
+	}
+
+	tr, _ = newTestTracer(t, 1)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	if s := tr.startRequest(req, "GET /"); s != nil {
+		t.Error("request with an unsampled parent traced")
+	}
+
+	// Untraced code paths work on nil spans
+	var s *span
+	c := s.child("stage")
+	c.set("k", 1)
+	c.done(io.EOF)
+	if c != nil {
+		t.Error("child of a nil span is not nil")
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"debug/buildinfo"
+	"net/http"
+	"os/exec"
+	"regexp"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+)
+
+// version is the exporter release, set at build time with
+// -ldflags "-X main.version=v1.2.3"
+var version = ""
+
+// toolVersionTTL is how long detected tool versions are reused, so
+// inventory scrapes do not fork a handful of processes each
+const toolVersionTTL = 5 * time.Minute
+
+// buildInfo describes the exporter binary
+type buildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit,omitempty"`
+	CommitAt  string `json:"commit_time,omitempty"`
+	Modified  bool   `json:"modified,omitempty"`
+	GoVersion string `json:"go_version"`
+}
+
+// toolVersion is the version of a profiling tool found on the host
+type toolVersion struct {
+	Path    string `json:"path,omitempty"`
+	Version string `json:"version,omitempty"`
+	// Error says why the tool or its version could not be found
+	Error string `json:"error,omitempty"`
+}
+
+// versionReport is the response of /version
+type versionReport struct {
+	buildInfo
+	Tools map[string]toolVersion `json:"tools"`
+}
+
+// exporterBuildInfo returns the version of the exporter, falling back to the
+// module version and VCS stamp the Go toolchain records
+func exporterBuildInfo() buildInfo {
+	info := buildInfo{Version: version, GoVersion: runtime.Version()}
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		if info.Version == "" {
+			info.Version = "unknown"
+		}
+		return info
+	}
+	if info.Version == "" {
+		info.Version = bi.Main.Version
+	}
+	for _, s := range bi.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			info.Commit = s.Value
+		case "vcs.time":
+			info.CommitAt = s.Value
+		case "vcs.modified":
+			info.Modified = s.Value == "true"
+		}
+	}
+	if info.Version == "" || info.Version == "(devel)" {
+		info.Version = "devel"
+	}
+	return info
+}
+
+// versionPattern finds the first dotted version number in tool output
+var versionPattern = regexp.MustCompile(`\d+\.\d+(\.\d+)*`)
+
+// toolProbe finds the version of one tool
+type toolProbe struct {
+	// binary is looked up in PATH
+	binary string
+	// args make the binary print its version
+	args []string
+	// command prints the version instead of the binary, e.g. for Python
+	// packages whose tools have no --version
+	command []string
+}
+
+// toolProbes are the tools reported by /version
+var toolProbes = map[string]toolProbe{
+	"perf":     {binary: "perf", args: []string{"--version"}},
+	"pprof":    {binary: "pprof"},
+	"bcc":      {binary: "profile-bpfcc", command: []string{"python3", "-c", "import bcc; print(bcc.__version__)"}},
+	"bpftrace": {binary: "bpftrace", args: []string{"--version"}},
+	"py-spy":   {binary: "py-spy", args: []string{"--version"}},
+}
+
+// detect runs the probe, giving up after a few seconds. Go binaries without
+// args or command are identified by the build info they embed.
+func (p toolProbe) detect() toolVersion {
+	path, err := exec.LookPath(p.binary)
+	if err != nil {
+		return toolVersion{Error: "not installed"}
+	}
+	tv := toolVersion{Path: path}
+
+	if p.args == nil && p.command == nil {
+		bi, err := buildinfo.ReadFile(path)
+		if err != nil {
+			tv.Error = err.Error()
+		} else {
+			tv.Version = bi.Main.Version
+		}
+		return tv
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	name, args := path, p.args
+	if p.command != nil {
+		name, args = p.command[0], p.command[1:]
+	}
+	out, err := exec.CommandContext(ctx, name, args...).CombinedOutput()
+	if err != nil {
+		tv.Error = strings.TrimSpace(firstLine(out, err.Error()))
+		return tv
+	}
+	if tv.Version = versionPattern.FindString(string(out)); tv.Version == "" {
+		tv.Error = "no version in " + firstLine(out, "empty output")
+	}
+	return tv
+}
+
+// firstLine returns the first line of out, or fallback when out is empty
+func firstLine(out []byte, fallback string) string {
+	line, _, _ := bytes.Cut(bytes.TrimSpace(out), []byte("\n"))
+	if len(line) == 0 {
+		return fallback
+	}
+	return string(line)
+}
+
+// toolVersionCache keeps the detected tool versions for toolVersionTTL
+type toolVersionCache struct {
+	mu       sync.Mutex
+	versions map[string]toolVersion
+	expires  time.Time
+}
+
+var toolVersions toolVersionCache
+
+// get returns the tool versions, detecting them again once expired
+func (c *toolVersionCache) get() map[string]toolVersion {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.versions != nil && time.Now().Before(c.expires) {
+		return c.versions
+	}
+
+	versions := make(map[string]toolVersion, len(toolProbes))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for name, probe := range toolProbes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			tv := probe.detect()
+			mu.Lock()
+			versions[name] = tv
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	c.versions, c.expires = versions, time.Now().Add(toolVersionTTL)
+	return versions
+}
+
+// handleVersion reports the exporter build and the profiling tools on the
+// host, for inventorying which hosts need upgrades
+func handleVersion(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, versionReport{buildInfo: exporterBuildInfo(), Tools: toolVersions.get()})
+}
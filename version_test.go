@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+// fakeTools puts scripts printing tool versions first in PATH
+func fakeTools(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	scripts := map[string]string{
+		"perf":          "echo 'perf version 6.1.76'",
+		"bpftrace":      "echo 'bpftrace v0.20.1'",
+		"py-spy":        "echo 'py-spy: unsupported platform' >&2; exit 1",
+		"profile-bpfcc": "exit 0",
+		"python3":       "echo 0.29.1",
+	}
+	for name, body := range scripts {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("#!/bin/sh\n"+body+"\n"), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Any Go binary stands in for pprof
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(exe, filepath.Join(dir, "pprof")); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+":/bin:/usr/bin")
+	return dir
+}
+
+func TestToolProbeDetect(t *testing.T) {
+	dir := fakeTools(t)
+
+	tests := []struct {
+		tool        string
+		wantVersion string
+		wantErr     string
+	}{
+		{"perf", "6.1.76", ""},
+		{"bpftrace", "0.20.1", ""},
+		{"bcc", "0.29.1", ""},
+		{"py-spy", "", "py-spy: unsupported platform"},
+	}
+	for _, tt := range tests {
+		got := toolProbes[tt.tool].detect()
+		if got.Version != tt.wantVersion || got.Error != tt.wantErr {
+			t.Errorf("%s: detect() = %+v, want version %q error %q", tt.tool, got, tt.wantVersion, tt.wantErr)
+		}
+	}
+
+	if got := toolProbes["pprof"].detect(); got.Error != "" || got.Path != filepath.Join(dir, "pprof") {
+		t.Errorf("pprof: detect() = %+v", got)
+	}
+	if got := (toolProbe{binary: "no-such-tool"}).detect(); got.Error != "not installed" {
+		t.Errorf("missing tool: detect() = %+v", got)
+	}
+}
+
+func TestHandleVersion(t *testing.T) {
+	fakeTools(t)
+	toolVersions = toolVersionCache{}
+	t.Cleanup(func() { toolVersions = toolVersionCache{} })
+
+	rr := httptest.NewRecorder()
+	handleVersion(rr, httptest.NewRequest("GET", "/version", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status %d", rr.Code)
+	}
+	var got struct {
+		Version   string                 `json:"version"`
+		GoVersion string                 `json:"go_version"`
+		Tools     map[string]toolVersion `json:"tools"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Version == "" || got.GoVersion != runtime.Version() {
+		t.Errorf("version = %q, go_version = %q", got.Version, got.GoVersion)
+	}
+	if len(got.Tools) != len(toolProbes) || got.Tools["perf"].Version != "6.1.76" {
+		t.Errorf("tools = %+v", got.Tools)
+	}
+
+	// Versions are cached rather than detected on every request
+	t.Setenv("PATH", "/nonexistent")
+	if v := toolVersions.get()["perf"]; v.Version != "6.1.76" {
+		t.Errorf("cached perf = %+v", v)
+	}
+}
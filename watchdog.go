@@ -0,0 +1,211 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// clockTicks is USER_HZ, the unit of the CPU times in /proc/<pid>/stat,
+// which is 100 on every mainstream Linux architecture
+const clockTicks = 100
+
+// watchdogConfig configures automatic captures of busy processes
+type watchdogConfig struct {
+	// Interval between CPU usage samples (default 1s)
+	Interval duration    `json:"interval"`
+	Rules    []watchRule `json:"rules"`
+}
+
+// watchRule triggers a capture of a process whose CPU usage stays at or above
+// CPUPercent for For
+type watchRule struct {
+	Name       string   `json:"name"`
+	Comm       string   `json:"comm,omitempty"`
+	PID        int      `json:"pid,omitempty"`
+	CPUPercent float64  `json:"cpu_percent"`
+	For        duration `json:"for"`
+	Seconds    int      `json:"seconds"`
+	Format     string   `json:"format"`
+	// Cooldown suppresses new captures of the same process (default 5m)
+	Cooldown duration `json:"cooldown"`
+}
+
+func (c *watchdogConfig) validate() error {
+	if c.Interval == 0 {
+		c.Interval = duration(time.Second)
+	}
+	for i := range c.Rules {
+		rule := &c.Rules[i]
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("rule-%d", i+1)
+		}
+		if (rule.Comm == "") == (rule.PID == 0) {
+			return fmt.Errorf("%s: exactly one of comm or pid is required", rule.Name)
+		}
+		if rule.CPUPercent <= 0 {
+			return fmt.Errorf("%s: cpu_percent must be positive", rule.Name)
+		}
+		if rule.Seconds == 0 {
+			rule.Seconds = 10
+		}
+		if rule.Seconds < 0 || rule.Seconds > 300 {
+			return fmt.Errorf("%s: seconds must be between 1 and 300", rule.Name)
+		}
+		switch rule.Format {
+		case "":
+			rule.Format = "pprof"
+		case "pprof", "folded":
+		default:
+			return fmt.Errorf("%s: format must be pprof or folded", rule.Name)
+		}
+		if rule.Cooldown == 0 {
+			rule.Cooldown = duration(5 * time.Minute)
+		}
+	}
+	return nil
+}
+
+// cpuSample is the cumulative CPU time of a process at a point in time
+type cpuSample struct {
+	ticks uint64
+	at    time.Time
+}
+
+// watchState tracks one process matched by one rule
+type watchState struct {
+	last        cpuSample
+	aboveSince  time.Time
+	lastTrigger time.Time
+	capturing   bool
+}
+
+// watchdog samples the CPU usage of configured targets and captures a
+// profile when a rule's threshold is exceeded for long enough
+type watchdog struct {
+	cfg   watchdogConfig
+	mu    sync.Mutex
+	state map[string]*watchState // keyed by rule name and PID
+
+	// capture takes and stores the profile; replaced in tests
+	capture func(rule watchRule, pid int, reason string)
+}
+
+func newWatchdog(cfg watchdogConfig) *watchdog {
+	wd := &watchdog{cfg: cfg, state: make(map[string]*watchState)}
+	wd.capture = wd.captureAndStore
+	return wd
+}
+
+// run samples targets until stop is closed
+func (wd *watchdog) run(stop <-chan struct{}) {
+	ticker := time.NewTicker(time.Duration(wd.cfg.Interval))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			wd.check(now)
+		}
+	}
+}
+
+// targets returns the PIDs currently matched by rule
+func (wd *watchdog) targets(rule watchRule) []int {
+	if rule.PID != 0 {
+		return []int{rule.PID}
+	}
+	pids, err := findPIDsByComm(rule.Comm)
+	if err != nil {
+		log.Printf("Watchdog %s: failed to list processes: %v", rule.Name, err)
+	}
+	return pids
+}
+
+// check takes one CPU sample of every target and fires captures as needed
+func (wd *watchdog) check(now time.Time) {
+	wd.mu.Lock()
+	defer wd.mu.Unlock()
+
+	seen := make(map[string]bool)
+	for _, rule := range wd.cfg.Rules {
+		for _, pid := range wd.targets(rule) {
+			ticks, err := readCPUTicks(pid)
+			if err != nil {
+				continue
+			}
+
+			key := rule.Name + "/" + strconv.Itoa(pid)
+			seen[key] = true
+			st, ok := wd.state[key]
+			if !ok {
+				wd.state[key] = &watchState{last: cpuSample{ticks, now}}
+				continue
+			}
+
+			elapsed := now.Sub(st.last.at).Seconds()
+			if elapsed <= 0 || ticks < st.last.ticks {
+				st.last = cpuSample{ticks, now}
+				continue
+			}
+			usage := float64(ticks-st.last.ticks) / clockTicks / elapsed * 100
+			st.last = cpuSample{ticks, now}
+
+			if usage < rule.CPUPercent {
+				st.aboveSince = time.Time{}
+				continue
+			}
+			if st.aboveSince.IsZero() {
+				st.aboveSince = now
+			}
+
+			above := now.Sub(st.aboveSince)
+			if above < time.Duration(rule.For) || st.capturing || now.Sub(st.lastTrigger) < time.Duration(rule.Cooldown) {
+				continue
+			}
+
+			st.capturing = true
+			st.lastTrigger = now
+			reason := fmt.Sprintf("cpu %.1f%% >= %.1f%% for %s", usage, rule.CPUPercent, above.Round(time.Second))
+			log.Printf("Watchdog %s: PID %d %s, capturing %ds profile", rule.Name, pid, reason, rule.Seconds)
+
+			go func(rule watchRule, pid int, key string) {
+				wd.capture(rule, pid, reason)
+				wd.mu.Lock()
+				wd.state[key].capturing = false
+				wd.mu.Unlock()
+			}(rule, pid, key)
+		}
+	}
+
+	// Forget processes that exited or no longer match
+	for key, st := range wd.state {
+		if !seen[key] && !st.capturing {
+			delete(wd.state, key)
+		}
+	}
+}
+
+// captureAndStore profiles pid for rule and stores the result with the
+// trigger that caused it
+func (wd *watchdog) captureAndStore(rule watchRule, pid int, reason string) {
+	opts := profileOptions{
+		PID:         strconv.Itoa(pid),
+		Duration:    rule.Seconds,
+		Stacks:      "both",
+		CallGraph:   "fp",
+		LBRFallback: "fp",
+	}
+
+	meta := captureMeta(opts, rule.Format)
+	meta.Trigger = "watchdog"
+	meta.TriggerReason = fmt.Sprintf("%s: %s", rule.Name, reason)
+
+	if _, err := captureToStore(opts, meta); err != nil {
+		log.Printf("Watchdog %s: capture of PID %d failed: %v", rule.Name, pid, err)
+	}
+}
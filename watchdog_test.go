@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeFakeStat writes /proc/<pid>/stat and comm under procRoot with the
+// given total CPU time split evenly between user and system
+func writeFakeStat(t *testing.T, pid int, comm string, ticks uint64) {
+	t.Helper()
+
+	dir := filepath.Join(procRoot, strconv.Itoa(pid))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	stat := fmt.Sprintf("%d (%s) R 1 1 1 0 -1 4194560 100 0 0 0 %d %d 0 0 20 0 4 0 100 0 0\n", pid, comm, ticks/2, ticks-ticks/2)
+	if err := os.WriteFile(filepath.Join(dir, "stat"), []byte(stat), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "comm"), []byte(comm+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadCPUTicks(t *testing.T) {
+	writeFakeProc(t, map[int]int{})
+	writeFakeStat(t, 42, "redis server", 1234)
+
+	ticks, err := readCPUTicks(42)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ticks != 1234 {
+		t.Errorf("readCPUTicks() = %d, want 1234", ticks)
+	}
+}
+
+func TestWatchdogTriggers(t *testing.T) {
+	writeFakeProc(t, map[int]int{})
+	writeFakeStat(t, 100, "redis-server", 0)
+	writeFakeStat(t, 200, "sshd", 0)
+
+	cfg := watchdogConfig{Rules: []watchRule{{Comm: "redis-server", CPUPercent: 80, For: duration(3 * time.Second)}}}
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	captured := make(chan string, 10)
+	wd := newWatchdog(cfg)
+	wd.capture = func(rule watchRule, pid int, reason string) {
+		captured <- fmt.Sprintf("%d %s", pid, reason)
+	}
+
+	start := time.Now()
+	tick := func(sec int, ticks uint64) {
+		writeFakeStat(t, 100, "redis-server", ticks)
+		writeFakeStat(t, 200, "sshd", ticks)
+		wd.check(start.Add(time.Duration(sec) * time.Second))
+	}
+
+	// 95% busy from the first second on
+	tick(0, 0)
+	for sec := 1; sec <= 3; sec++ {
+		tick(sec, uint64(sec*95))
+	}
+	select {
+	case got := <-captured:
+		t.Fatalf("watchdog fired before the threshold duration: %s", got)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	tick(4, 4*95)
+	select {
+	case got := <-captured:
+		if !strings.HasPrefix(got, "100 cpu 95.0% >= 80.0%") {
+			t.Errorf("unexpected capture: %s", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("watchdog did not fire")
+	}
+
+	// Still busy, but within the cooldown
+	time.Sleep(50 * time.Millisecond)
+	tick(5, 5*95)
+	select {
+	case got := <-captured:
+		t.Errorf("watchdog fired again during cooldown: %s", got)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestWatchdogConfigValidation(t *testing.T) {
+	tests := []struct {
+		name string
+		rule watchRule
+	}{
+		{name: "no target", rule: watchRule{CPUPercent: 50}},
+		{name: "two targets", rule: watchRule{Comm: "redis-server", PID: 1, CPUPercent: 50}},
+		{name: "no threshold", rule: watchRule{Comm: "redis-server"}},
+		{name: "bad format", rule: watchRule{Comm: "redis-server", CPUPercent: 50, Format: "svg"}},
+		{name: "too long", rule: watchRule{Comm: "redis-server", CPUPercent: 50, Seconds: 301}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := watchdogConfig{Rules: []watchRule{tt.rule}}
+			if err := cfg.validate(); err == nil {
+				t.Errorf("validate() should fail")
+			}
+		})
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	data := `{"watchdog": {"rules": [{"name": "redis-hot", "comm": "redis-server", "cpu_percent": 90, "for": "10s"}]}}`
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rule := cfg.Watchdog.Rules[0]
+	if time.Duration(rule.For) != 10*time.Second || rule.Seconds != 10 || rule.Format != "pprof" {
+		t.Errorf("unexpected rule: %+v", rule)
+	}
+	if time.Duration(cfg.Watchdog.Interval) != time.Second || time.Duration(rule.Cooldown) != 5*time.Minute {
+		t.Errorf("defaults not applied: %+v", cfg.Watchdog)
+	}
+
+	if err := os.WriteFile(path, []byte(`{"watchdog": {"rules": [{"comm": "x", "cpu_percent": 1, "for": 10}]}}`), 0644); err == nil {
+		if _, err := loadConfig(path); err == nil {
+			t.Errorf("loadConfig() should reject numeric durations")
+		}
+	}
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// webhookQueueSize bounds the notifications waiting to be delivered
+const webhookQueueSize = 256
+
+// webhookAttempts is how many times a notification is posted to an
+// endpoint before it is given up
+const webhookAttempts = 3
+
+// webhooksConfig is the webhooks section of the configuration file:
+// endpoints notified when a stored profile is done or a background capture
+// failed
+type webhooksConfig struct {
+	Endpoints []webhookEndpoint `json:"endpoints"`
+	// BaseURL is the external URL of the exporter, e.g.
+	// https://bcc-exporter.example.com, that result URLs start with; they
+	// are paths without it
+	BaseURL string `json:"base_url"`
+}
+
+// webhookEndpoint is a receiver of completion notifications
+type webhookEndpoint struct {
+	URL string `json:"url"`
+	// Secret signs the notifications; Secret, SecretFile and SecretEnv
+	// work like the Redis password settings
+	Secret     string `json:"secret,omitempty"`
+	SecretFile string `json:"secret_file,omitempty"`
+	SecretEnv  string `json:"secret_env,omitempty"`
+	// Statuses limits the notifications to "done" or "failed" (default
+	// both)
+	Statuses []string `json:"statuses,omitempty"`
+	// Headers are added to the requests, e.g. for authentication
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+func (c *webhooksConfig) validate() error {
+	if c.BaseURL != "" {
+		if u, err := url.Parse(c.BaseURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid base_url %q", c.BaseURL)
+		}
+		c.BaseURL = strings.TrimSuffix(c.BaseURL, "/")
+	}
+	for i := range c.Endpoints {
+		ep := &c.Endpoints[i]
+		if u, err := url.Parse(ep.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("endpoint %d: invalid url %q", i+1, ep.URL)
+		}
+		secret, err := resolveSecret(ep.Secret, ep.SecretFile, ep.SecretEnv)
+		if err != nil {
+			return fmt.Errorf("%s: secret: %v", ep.URL, err)
+		}
+		ep.Secret = secret
+		for _, status := range ep.Statuses {
+			if status != "done" && status != "failed" {
+				return fmt.Errorf("%s: statuses must be done or failed, not %q", ep.URL, status)
+			}
+		}
+	}
+	return nil
+}
+
+// wants reports whether ep is notified of status
+func (ep webhookEndpoint) wants(status string) bool {
+	return len(ep.Statuses) == 0 || slices.Contains(ep.Statuses, status)
+}
+
+// currentWebhooks returns the webhooks in effect; none before the server
+// state is set up
+func currentWebhooks() webhooksConfig {
+	if s := state.Load(); s != nil {
+		return s.cfg.Webhooks
+	}
+	return webhooksConfig{}
+}
+
+// webhookTarget is the process a notified capture profiled
+type webhookTarget struct {
+	Host string `json:"host"`
+	PID  string `json:"pid,omitempty"`
+	Comm string `json:"comm,omitempty"`
+}
+
+// webhookNotification is the JSON body posted to webhook endpoints
+type webhookNotification struct {
+	// JobID is the ID the profile is stored, or would have been stored,
+	// under
+	JobID string `json:"job_id"`
+	// Status is "done" or "failed"
+	Status        string            `json:"status"`
+	Target        webhookTarget     `json:"target"`
+	Format        string            `json:"format"`
+	Trigger       string            `json:"trigger,omitempty"`
+	TriggerReason string            `json:"trigger_reason,omitempty"`
+	Labels        map[string]string `json:"labels,omitempty"`
+	Time          time.Time         `json:"time"`
+	// ResultURL downloads the profile, when done
+	ResultURL string `json:"result_url,omitempty"`
+	Size      int64  `json:"size,omitempty"`
+	SHA256    string `json:"sha256,omitempty"`
+	// Signature and SignatureKey are those of the stored profile, when
+	// signing is configured
+	Signature    string `json:"signature,omitempty"`
+	SignatureKey string `json:"signature_key,omitempty"`
+	// Error is why the capture failed
+	Error string `json:"error,omitempty"`
+}
+
+// webhookDelivery is a notification waiting to be posted to an endpoint
+type webhookDelivery struct {
+	// name identifies the endpoint in logs, which must not show the
+	// secret URL of a Slack webhook
+	name     string
+	endpoint webhookEndpoint
+	body     []byte
+}
+
+// webhookNotifier posts completion notifications in the background
+type webhookNotifier struct {
+	hostname  string
+	userAgent string
+	client    *http.Client
+	queue     chan webhookDelivery
+	// retryDelay is the wait before the first retry of a failed delivery,
+	// doubled for each further attempt
+	retryDelay time.Duration
+	// now stamps the signatures; tests replace it
+	now func() time.Time
+}
+
+// notifier sends the completion webhooks and Slack messages of the
+// configuration in effect
+var notifier *webhookNotifier
+
+func newWebhookNotifier() *webhookNotifier {
+	hostname, _ := os.Hostname()
+	n := &webhookNotifier{
+		hostname:   hostname,
+		userAgent:  "bcc-exporter/" + exporterBuildInfo().Version,
+		client:     &http.Client{Timeout: 10 * time.Second},
+		queue:      make(chan webhookDelivery, webhookQueueSize),
+		retryDelay: 5 * time.Second,
+		now:        time.Now,
+	}
+	go n.run()
+	return n
+}
+
+// profileDone notifies the endpoints that the profile of meta is stored
+func (n *webhookNotifier) profileDone(meta profileMeta) {
+	n.notify(meta, nil)
+}
+
+// profileFailed notifies the endpoints that the background capture of
+// meta failed with err
+func (n *webhookNotifier) profileFailed(meta profileMeta, err error) {
+	n.notify(meta, err)
+}
+
+// notify queues the notification of meta for the endpoints that want it,
+// and its Slack message when it was triggered
+func (n *webhookNotifier) notify(meta profileMeta, err error) {
+	if n == nil {
+		return
+	}
+	if slack := currentSlack(); err == nil && slack.wants(meta) {
+		body, err := slackMessage(slack, n.hostname, meta)
+		if err != nil {
+			log.Printf("Failed to encode Slack message: %v", err)
+		} else {
+			n.enqueue(webhookDelivery{name: "Slack", endpoint: webhookEndpoint{URL: slack.WebhookURL}, body: body})
+		}
+	}
+
+	cfg := currentWebhooks()
+	status := "done"
+	if err != nil {
+		status = "failed"
+	}
+	var endpoints []webhookEndpoint
+	for _, ep := range cfg.Endpoints {
+		if ep.wants(status) {
+			endpoints = append(endpoints, ep)
+		}
+	}
+	if len(endpoints) == 0 {
+		return
+	}
+
+	msg := webhookNotification{
+		JobID:         meta.ID,
+		Status:        status,
+		Target:        webhookTarget{Host: n.hostname, PID: meta.PID, Comm: meta.Comm},
+		Format:        meta.Format,
+		Trigger:       meta.Trigger,
+		TriggerReason: meta.TriggerReason,
+		Labels:        meta.Labels,
+		Time:          n.now().UTC(),
+	}
+	if err != nil {
+		msg.Error = err.Error()
+	} else {
+		msg.ResultURL = cfg.BaseURL + *prefix + "/api/v1/profiles/" + meta.ID
+		msg.Size, msg.SHA256 = meta.Size, meta.SHA256
+		msg.Signature, msg.SignatureKey = meta.Signature, meta.SignatureKey
+	}
+	body, merr := json.Marshal(msg)
+	if merr != nil {
+		log.Printf("Failed to encode webhook notification: %v", merr)
+		return
+	}
+
+	for _, ep := range endpoints {
+		n.enqueue(webhookDelivery{name: ep.URL, endpoint: ep, body: body})
+	}
+}
+
+// enqueue schedules d; deliveries are dropped with a log message when the
+// queue is full
+func (n *webhookNotifier) enqueue(d webhookDelivery) {
+	select {
+	case n.queue <- d:
+	default:
+		log.Printf("Webhook queue is full, not notifying %s", d.name)
+	}
+}
+
+// run delivers queued notifications one at a time, so a slow receiver
+// never delays captures
+func (n *webhookNotifier) run() {
+	for d := range n.queue {
+		delay := n.retryDelay
+		for attempt := 1; ; attempt++ {
+			err := n.post(d.endpoint, d.body)
+			if err == nil {
+				break
+			}
+			if attempt == webhookAttempts {
+				log.Printf("Failed to notify %s: %v", d.name, err)
+				break
+			}
+			log.Printf("Failed to notify %s, retrying in %s: %v", d.name, delay, err)
+			time.Sleep(delay)
+			delay *= 2
+		}
+	}
+}
+
+// webhookSignature returns the X-Webhook-Signature of body sent at
+// timestamp: the HMAC-SHA256 with secret of "<timestamp>.<body>"
+func webhookSignature(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// post sends body to ep, signed when ep has a secret
+func (n *webhookNotifier) post(ep webhookEndpoint, body []byte) error {
+	req, err := http.NewRequest("POST", ep.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", n.userAgent)
+	for name, value := range ep.Headers {
+		req.Header.Set(name, value)
+	}
+	if ep.Secret != "" {
+		timestamp := strconv.FormatInt(n.now().Unix(), 10)
+		req.Header.Set("X-Webhook-Timestamp", timestamp)
+		req.Header.Set("X-Webhook-Signature", webhookSignature(ep.Secret, timestamp, body))
+	}
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s", resp.Status)
+	}
+	return nil
+}
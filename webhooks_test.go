@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// setWebhooks puts cfg in effect for the duration of the test, with a
+// notifier whose retries and clock are fast
+func setWebhooks(t *testing.T, cfg webhooksConfig) *webhookNotifier {
+	t.Helper()
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+	origState, origNotifier := state.Load(), notifier
+	t.Cleanup(func() {
+		state.Store(origState)
+		notifier = origNotifier
+	})
+	state.Store(&serverState{cfg: &config{Webhooks: cfg}})
+	notifier = newWebhookNotifier()
+	notifier.retryDelay = time.Millisecond
+	notifier.now = func() time.Time { return time.Unix(1717000000, 0) }
+	return notifier
+}
+
+func TestWebhooksConfigValidate(t *testing.T) {
+	t.Setenv("HOOK_SECRET", "s3cret")
+	cfg := webhooksConfig{BaseURL: "https://bcc.example.com/", Endpoints: []webhookEndpoint{{URL: "https://hooks.example.com/profile", SecretEnv: "HOOK_SECRET"}}}
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.BaseURL != "https://bcc.example.com" || cfg.Endpoints[0].Secret != "s3cret" {
+		t.Errorf("validated config = %+v", cfg)
+	}
+	for _, cfg := range []webhooksConfig{
+		{Endpoints: []webhookEndpoint{{URL: "hooks.example.com"}}},
+		{Endpoints: []webhookEndpoint{{URL: "https://hooks.example.com", Statuses: []string{"started"}}}},
+		{Endpoints: []webhookEndpoint{{URL: "https://hooks.example.com", Secret: "a", SecretEnv: "HOOK_SECRET"}}},
+		{BaseURL: "/profiling"},
+	} {
+		if err := cfg.validate(); err == nil {
+			t.Errorf("%+v accepted", cfg)
+		}
+	}
+}
+
+func TestWebhookNotify(t *testing.T) {
+	type received struct {
+		header http.Header
+		body   []byte
+	}
+	got := make(chan received, 4)
+	var fail atomic.Int32
+	fail.Store(1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fail.Add(-1) >= 0 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		got <- received{r.Header, body}
+	}))
+	defer srv.Close()
+
+	n := setWebhooks(t, webhooksConfig{BaseURL: "https://bcc.example.com", Endpoints: []webhookEndpoint{
+		{URL: srv.URL + "/all", Secret: "s3cret", Headers: map[string]string{"X-Team": "infra"}},
+		{URL: srv.URL + "/failed", Statuses: []string{"failed"}},
+	}})
+
+	meta := profileMeta{ID: "3f9a1c0e7b2d4856", Format: "pprof", PID: "42", Comm: "redis-server", Trigger: "watchdog", Size: 1024, SHA256: "abcd"}
+	n.profileDone(meta)
+	var r received
+	select {
+	case r = <-got:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no notification after a retry")
+	}
+	var msg webhookNotification
+	if err := json.Unmarshal(r.body, &msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.JobID != meta.ID || msg.Status != "done" || msg.Target.PID != "42" || msg.Target.Comm != "redis-server" ||
+		msg.ResultURL != "https://bcc.example.com/api/v1/profiles/3f9a1c0e7b2d4856" || msg.SHA256 != "abcd" {
+		t.Errorf("notification = %s", r.body)
+	}
+	if r.header.Get("X-Webhook-Timestamp") != "1717000000" || r.header.Get("X-Team") != "infra" ||
+		r.header.Get("X-Webhook-Signature") != webhookSignature("s3cret", "1717000000", r.body) {
+		t.Errorf("headers = %v", r.header)
+	}
+
+	n.profileFailed(meta, errors.New("perf record failed: exit status 1"))
+	for i := 0; i < 2; i++ {
+		select {
+		case r = <-got:
+		case <-time.After(5 * time.Second):
+			t.Fatal("failure was not sent to both endpoints")
+		}
+		msg = webhookNotification{}
+		json.Unmarshal(r.body, &msg)
+		if msg.Status != "failed" || msg.Error != "perf record failed: exit status 1" || msg.ResultURL != "" {
+			t.Errorf("failure notification = %s", r.body)
+		}
+	}
+	select {
+	case r = <-got:
+		t.Errorf("unexpected notification %s", r.body)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestWebhookSignature(t *testing.T) {
+	// echo -n '1717000000.{}' | openssl dgst -sha256 -hmac s3cret
+	want := "sha256=d8f9610820c927f0db8676bc5ae1d57f809604704381c432a992eb306bd1eef7"
+	if got := webhookSignature("s3cret", "1717000000", []byte("{}")); got != want {
+		t.Errorf("webhookSignature() = %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// websocketGUID is appended to the client key to form the accept key
+// (RFC 6455 section 1.3)
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// WebSocket opcodes
+const (
+	wsText  = 0x1
+	wsClose = 0x8
+	wsPing  = 0x9
+	wsPong  = 0xA
+)
+
+// wsMaxControlPayload is the largest payload RFC 6455 allows in control
+// frames; the exporter only reads control frames from clients
+const wsMaxControlPayload = 125
+
+// websocketAccept returns the Sec-WebSocket-Accept value for key
+func websocketAccept(key string) string {
+	sum := sha1.Sum([]byte(key + websocketGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// headerHasToken reports whether the comma-separated header name of h
+// lists token, ignoring case
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// websocketOriginAllowed reports whether a browser page at the Origin of r
+// may open a WebSocket: browsers do not apply CORS to WebSockets, so the
+// exporter checks the origin itself against the host and cors settings
+func websocketOriginAllowed(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		// Not a browser
+		return true
+	}
+	if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	c := state.Load().cfg.CORS
+	return c.allowedOrigin(origin) != ""
+}
+
+// wsConn is the server side of a WebSocket connection: enough to push
+// messages to a client and notice when it goes away
+type wsConn struct {
+	conn net.Conn
+	rw   *bufio.ReadWriter
+
+	mu     sync.Mutex // serializes frame writes
+	closed chan struct{}
+	once   sync.Once
+}
+
+// upgradeWebSocket completes the WebSocket handshake of r, passing on the
+// headers already set on w. On failure nothing has been written to w.
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request) (*wsConn, int, error) {
+	if r.Method != "GET" || !headerHasToken(r.Header, "Connection", "upgrade") || !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		return nil, http.StatusUpgradeRequired, fmt.Errorf("this endpoint requires a WebSocket connection")
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		return nil, http.StatusBadRequest, fmt.Errorf("unsupported WebSocket version %q", r.Header.Get("Sec-WebSocket-Version"))
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if decoded, err := base64.StdEncoding.DecodeString(key); err != nil || len(decoded) != 16 {
+		return nil, http.StatusBadRequest, fmt.Errorf("invalid Sec-WebSocket-Key")
+	}
+	if !websocketOriginAllowed(r) {
+		return nil, http.StatusForbidden, fmt.Errorf("origin %s is not allowed", r.Header.Get("Origin"))
+	}
+
+	conn, rw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		return nil, http.StatusInternalServerError, fmt.Errorf("failed to take over the connection: %v", err)
+	}
+	h := w.Header().Clone()
+	h.Set("Upgrade", "websocket")
+	h.Set("Connection", "Upgrade")
+	h.Set("Sec-WebSocket-Accept", websocketAccept(key))
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+	h.Write(rw)
+	rw.WriteString("\r\n")
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return nil, 0, err
+	}
+
+	c := &wsConn{conn: conn, rw: rw, closed: make(chan struct{})}
+	go c.readLoop()
+	return c, 0, nil
+}
+
+// writeFrame sends one unmasked, unfragmented frame
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	header := []byte{0x80 | opcode}
+	switch n := len(payload); {
+	case n < 126:
+		header = append(header, byte(n))
+	case n <= 0xFFFF:
+		header = append(header, 126)
+		header = binary.BigEndian.AppendUint16(header, uint16(n))
+	default:
+		header = append(header, 127)
+		header = binary.BigEndian.AppendUint64(header, uint64(n))
+	}
+	c.rw.Write(header)
+	c.rw.Write(payload)
+	return c.rw.Flush()
+}
+
+// sendJSON sends v as a text message
+func (c *wsConn) sendJSON(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.writeFrame(wsText, data)
+}
+
+// readLoop answers pings and notices the client closing the connection;
+// the exporter ignores data messages from clients
+func (c *wsConn) readLoop() {
+	defer c.shutdown()
+	for {
+		var head [2]byte
+		if _, err := io.ReadFull(c.rw, head[:]); err != nil {
+			return
+		}
+		opcode, masked := head[0]&0x0F, head[1]&0x80 != 0
+		length := uint64(head[1] & 0x7F)
+		switch length {
+		case 126:
+			var ext [2]byte
+			if _, err := io.ReadFull(c.rw, ext[:]); err != nil {
+				return
+			}
+			length = uint64(binary.BigEndian.Uint16(ext[:]))
+		case 127:
+			var ext [8]byte
+			if _, err := io.ReadFull(c.rw, ext[:]); err != nil {
+				return
+			}
+			length = binary.BigEndian.Uint64(ext[:])
+		}
+		// Clients must mask their frames
+		if !masked {
+			return
+		}
+		var mask [4]byte
+		if _, err := io.ReadFull(c.rw, mask[:]); err != nil {
+			return
+		}
+
+		if opcode < wsClose {
+			if _, err := io.CopyN(io.Discard, c.rw, int64(length)); err != nil {
+				return
+			}
+			continue
+		}
+		if length > wsMaxControlPayload {
+			return
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(c.rw, payload); err != nil {
+			return
+		}
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+		switch opcode {
+		case wsClose:
+			c.writeFrame(wsClose, payload)
+			return
+		case wsPing:
+			c.writeFrame(wsPong, payload)
+		}
+	}
+}
+
+// shutdown closes the connection once
+func (c *wsConn) shutdown() {
+	c.once.Do(func() {
+		close(c.closed)
+		c.conn.Close()
+	})
+}
+
+// close sends a normal closure frame with reason and closes the connection
+func (c *wsConn) close(reason string) {
+	payload := binary.BigEndian.AppendUint16(nil, 1000)
+	c.writeFrame(wsClose, append(payload, reason[:min(len(reason), wsMaxControlPayload-2)]...))
+	c.shutdown()
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWebsocketAccept(t *testing.T) {
+	// The example of RFC 6455 section 1.3
+	if got := websocketAccept("dGhlIHNhbXBsZSBub25jZQ=="); got != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Errorf("websocketAccept = %q", got)
+	}
+}
+
+func TestUpgradeWebSocketRefused(t *testing.T) {
+	origState := state.Load()
+	t.Cleanup(func() { state.Store(origState) })
+	state.Store(&serverState{cfg: &config{CORS: corsConfig{AllowedOrigins: []string{"https://grafana.example.com"}}}})
+
+	handshake := map[string]string{
+		"Connection":            "keep-alive, Upgrade",
+		"Upgrade":               "websocket",
+		"Sec-WebSocket-Version": "13",
+		"Sec-WebSocket-Key":     "dGhlIHNhbXBsZSBub25jZQ==",
+	}
+	tests := []struct {
+		name   string
+		change map[string]string
+		want   int
+	}{
+		{"plain request", map[string]string{"Upgrade": ""}, http.StatusUpgradeRequired},
+		{"old version", map[string]string{"Sec-WebSocket-Version": "8"}, http.StatusBadRequest},
+		{"bad key", map[string]string{"Sec-WebSocket-Key": "short"}, http.StatusBadRequest},
+		{"foreign origin", map[string]string{"Origin": "https://evil.example.com"}, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/debug/live", nil)
+		for k, v := range handshake {
+			req.Header.Set(k, v)
+		}
+		for k, v := range tt.change {
+			req.Header.Set(k, v)
+		}
+		_, status, err := upgradeWebSocket(httptest.NewRecorder(), req)
+		if err == nil || status != tt.want {
+			t.Errorf("%s: status %d, error %v, want %d", tt.name, status, err, tt.want)
+		}
+	}
+
+	req := httptest.NewRequest("GET", "/debug/live", nil)
+	req.Header.Set("Origin", "https://grafana.example.com")
+	if !websocketOriginAllowed(req) {
+		t.Error("origin allowed by cors refused")
+	}
+	req.Header.Set("Origin", "http://"+req.Host)
+	if !websocketOriginAllowed(req) {
+		t.Error("same origin refused")
+	}
+}
+
+// dialWebSocket opens a WebSocket to url on srv and returns the connection
+// and the handshake response
+func dialWebSocket(t *testing.T, srv *httptest.Server, path string) (net.Conn, *bufio.Reader, *http.Response) {
+	t.Helper()
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	io.WriteString(conn, "GET "+path+" HTTP/1.1\r\nHost: "+srv.Listener.Addr().String()+
+		"\r\nConnection: Upgrade\r\nUpgrade: websocket\r\nSec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n")
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, br, resp
+}
+
+// readFrame reads one unmasked server frame
+func readFrame(t *testing.T, br *bufio.Reader) (byte, []byte) {
+	t.Helper()
+	var head [2]byte
+	if _, err := io.ReadFull(br, head[:]); err != nil {
+		t.Fatal(err)
+	}
+	length := uint64(head[1] & 0x7F)
+	switch length {
+	case 126:
+		var ext [2]byte
+		io.ReadFull(br, ext[:])
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		io.ReadFull(br, ext[:])
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(br, payload); err != nil {
+		t.Fatal(err)
+	}
+	return head[0] & 0x0F, payload
+}
+
+// writeMaskedFrame sends a client frame, which must be masked
+func writeMaskedFrame(conn net.Conn, opcode byte, payload []byte) {
+	mask := [4]byte{1, 2, 3, 4}
+	frame := append([]byte{0x80 | opcode, 0x80 | byte(len(payload))}, mask[:]...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	conn.Write(frame)
+}
+
+func TestServeLive(t *testing.T) {
+	fakeProfileBPFCC(t, `for last; do :; done; echo "main;run $last"; echo "main;idle 1"`)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Profile-Backend", "bcc")
+		serveLive(w, r, profileOptions{PID: "1", Duration: 3, StreamInterval: 2})
+	}))
+	defer srv.Close()
+
+	conn, br, resp := dialWebSocket(t, srv, "/debug/live")
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" || resp.Header.Get("X-Profile-Backend") != "bcc" {
+		t.Fatalf("handshake response: %d %v", resp.StatusCode, resp.Header)
+	}
+
+	// A ping in the middle of the capture is answered
+	writeMaskedFrame(conn, wsPing, []byte("hi"))
+
+	var messages []liveMessage
+	for {
+		opcode, payload := readFrame(t, br)
+		if opcode == wsPong {
+			if string(payload) != "hi" {
+				t.Errorf("pong payload %q", payload)
+			}
+			continue
+		}
+		if opcode == wsClose {
+			if code := binary.BigEndian.Uint16(payload); code != 1000 {
+				t.Errorf("close code %d", code)
+			}
+			break
+		}
+		var m liveMessage
+		if err := json.Unmarshal(payload, &m); err != nil {
+			t.Fatalf("message %q: %v", payload, err)
+		}
+		messages = append(messages, m)
+	}
+
+	if len(messages) != 3 {
+		t.Fatalf("got %d messages, want 2 intervals and done: %+v", len(messages), messages)
+	}
+	if m := messages[0]; m.Type != "stacks" || m.Elapsed != 2 || m.Seconds != 3 || m.Stacks["main;run"] != 2 || m.Stacks["main;idle"] != 1 {
+		t.Errorf("first interval = %+v", m)
+	}
+	if m := messages[1]; m.Type != "stacks" || m.Elapsed != 3 || m.Stacks["main;run"] != 1 {
+		t.Errorf("second interval = %+v", m)
+	}
+	if m := messages[2]; m.Type != "done" || m.Elapsed != 3 {
+		t.Errorf("last message = %+v", m)
+	}
+}
+
+func TestServeLiveClientGone(t *testing.T) {
+	fakeProfileBPFCC(t, `sleep 0.2; echo "main;run 1"`)
+
+	done := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer close(done)
+		serveLive(w, r, profileOptions{PID: "1", Duration: 300, StreamInterval: 1})
+	}))
+	defer srv.Close()
+
+	conn, br, _ := dialWebSocket(t, srv, "/debug/live")
+	if opcode, payload := readFrame(t, br); opcode != wsText || !strings.Contains(string(payload), `"type":"stacks"`) {
+		t.Fatalf("first frame %x %q", opcode, payload)
+	}
+	writeMaskedFrame(conn, wsClose, binary.BigEndian.AppendUint16(nil, 1000))
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("capture kept running after the client closed the connection")
+	}
+}